@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"user/user/config"
+)
+
+const accessLogKey contextKey = "accessLog"
+
+// Query parameters whose values are credentials, logged as REDACTED
+var redactedQueryParams = map[string]bool{
+	"access_token": true,
+	"api_key":      true,
+	"code":         true,
+	"key":          true,
+	"password":     true,
+	"secret":       true,
+	"sig":          true,
+	"signature":    true,
+	"state":        true,
+	"token":        true,
+}
+
+// Email addresses anywhere in a logged path or query, such as a lookup by email
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+(@|%40)[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// accessEntry is the part of a request's access log line filled in on the way:
+// the caller is only known once the auth middleware has run, deeper in the chain
+type accessEntry struct {
+	principal *Principal
+}
+
+// accessLogger writes one line per request, keeping every failure but only a
+// sample of the successes on routes with access-log sample rates below 1
+type accessLogger struct {
+	sampleRate float64            // For routes without their own
+	routeRates map[string]float64 // By method and route template, as in server.route_timeouts
+}
+
+func newAccessLogger(cfg config.Config) *accessLogger {
+	return &accessLogger{sampleRate: cfg.Logging.AccessSampleRate, routeRates: cfg.Logging.AccessRouteSampleRates}
+}
+
+// start puts the entry for a request in its context
+func (l *accessLogger) start(r *http.Request) (*http.Request, *accessEntry) {
+	entry := &accessEntry{}
+	return r.WithContext(context.WithValue(r.Context(), accessLogKey, entry)), entry
+}
+
+// log writes the line for a finished request, unless sampling drops it
+func (l *accessLogger) log(r *http.Request, entry *accessEntry, route string, status int, bytes int64, elapsed time.Duration) {
+	rate, ok := l.routeRates[r.Method+" "+route]
+	if !ok {
+		rate = l.sampleRate
+	}
+	if status < http.StatusBadRequest && rate < 1 && rand.Float64() >= rate {
+		return
+	}
+	ctx := r.Context()
+	if entry.principal != nil {
+		ctx = context.WithValue(ctx, principalKey, *entry.principal)
+	}
+	slog.InfoContext(r.Context(), "Request handled", "method", r.Method, "path", redactURL(r.URL), "status", status,
+		"duration", elapsed, "bytes", bytes, "caller", auditActor(ctx))
+}
+
+// withPrincipal stores the authenticated caller in the request's context, and
+// on its access log entry
+func withPrincipal(r *http.Request, principal Principal) *http.Request {
+	if entry, ok := r.Context().Value(accessLogKey).(*accessEntry); ok {
+		entry.principal = &principal
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalKey, principal))
+}
+
+// redactURL is the request's path and query as logged: emails are masked and
+// credentials in the query replaced
+func redactURL(u *url.URL) string {
+	path := emailPattern.ReplaceAllString(u.EscapedPath(), "REDACTED")
+	if u.RawQuery == "" {
+		return path
+	}
+	query := u.Query()
+	for name, values := range query {
+		for i, value := range values {
+			if redactedQueryParams[strings.ToLower(name)] {
+				values[i] = "REDACTED"
+			} else {
+				values[i] = emailPattern.ReplaceAllString(value, "REDACTED")
+			}
+		}
+	}
+	return path + "?" + query.Encode()
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"user/user/store"
+)
+
+// Types of activities on a user's timeline
+const (
+	activityCreated      = "created"
+	activityLogin        = "login"
+	activityEmailChanged = "email_changed"
+	activityPhotoChanged = "photo_changed"
+)
+
+// Response of GET /users/{id}/activity
+type ActivityPage struct {
+	Activities []store.Activity `json:"activities"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+// ActivityUserStore wraps a UserStore, adding to the user's timeline once a
+// create, login, email change or picture change succeeded. Like the audit
+// log, it leaves out the users the queue consumer mirrors. A failure to record
+// is logged rather than undoing the change.
+type ActivityUserStore struct {
+	store.UserStore
+	Activities store.ActivityStore
+}
+
+// record stores the activities of changes that just succeeded
+func (s ActivityUserStore) record(ctx context.Context, activities ...store.Activity) {
+	if len(activities) == 0 {
+		return
+	}
+	actor, requestID := auditActor(ctx), truncate(requestIDFromContext(ctx), maxAuditFieldLength)
+	for i := range activities {
+		activities[i].Actor, activities[i].RequestID = actor, requestID
+	}
+	if err := s.Activities.RecordActivities(context.WithoutCancel(ctx), activities); err != nil {
+		slog.ErrorContext(ctx, "Error recording user activities", "type", activities[0].Type, "user_id", activities[0].UserID, "count", len(activities), "error", err)
+	}
+}
+
+// changeActivities lists what a change from before to after did to the user's
+// email and picture
+func changeActivities(before, after store.User) []store.Activity {
+	var activities []store.Activity
+	if !strings.EqualFold(before.Email, after.Email) {
+		activities = append(activities, store.Activity{TenantID: after.TenantID, UserID: after.ID, Type: activityEmailChanged})
+	}
+	if before.Link != after.Link {
+		activities = append(activities, store.Activity{TenantID: after.TenantID, UserID: after.ID, Type: activityPhotoChanged})
+	}
+	return activities
+}
+
+func (s ActivityUserStore) CreateUser(ctx context.Context, user store.User) (store.User, error) {
+	created, err := s.UserStore.CreateUser(ctx, user)
+	if err == nil {
+		s.record(ctx, store.Activity{TenantID: created.TenantID, UserID: created.ID, Type: activityCreated})
+	}
+	return created, err
+}
+
+func (s ActivityUserStore) BulkCreateUsers(ctx context.Context, tenant string, users []store.User, results []store.BulkResult, atomic bool) error {
+	if err := s.UserStore.BulkCreateUsers(ctx, tenant, users, results, atomic); err != nil {
+		return err
+	}
+	var activities []store.Activity
+	for _, result := range results {
+		if result.ID != 0 {
+			activities = append(activities, store.Activity{TenantID: tenant, UserID: result.ID, Type: activityCreated})
+		}
+	}
+	s.record(ctx, activities...)
+	return nil
+}
+
+// UpdateUser fetches the user first only when the change may touch their email
+// or picture
+func (s ActivityUserStore) UpdateUser(ctx context.Context, tenant string, id int64, changes store.UserChanges) (store.User, error) {
+	if changes.Email == nil && changes.Link == nil {
+		return s.UserStore.UpdateUser(ctx, tenant, id, changes)
+	}
+	before, beforeErr := s.UserStore.GetUser(ctx, tenant, id)
+	user, err := s.UserStore.UpdateUser(ctx, tenant, id, changes)
+	if err == nil && beforeErr == nil {
+		s.record(ctx, changeActivities(before, user)...)
+	}
+	return user, err
+}
+
+func (s ActivityUserStore) UpsertUserByEmail(ctx context.Context, user store.User) (store.User, bool, error) {
+	// Only an upsert with a picture changes anything on the timeline
+	var before *store.User
+	if user.Link != "" {
+		if previous, err := s.UserStore.GetUserByEmail(ctx, user.TenantID, user.Email); err == nil {
+			before = &previous
+		}
+	}
+	saved, created, err := s.UserStore.UpsertUserByEmail(ctx, user)
+	switch {
+	case err != nil:
+	case created:
+		s.record(ctx, store.Activity{TenantID: saved.TenantID, UserID: saved.ID, Type: activityCreated})
+	case before != nil:
+		s.record(ctx, changeActivities(*before, saved)...)
+	}
+	return saved, created, err
+}
+
+func (s ActivityUserStore) TouchUser(ctx context.Context, tenant string, id int64) (time.Time, error) {
+	at, err := s.UserStore.TouchUser(ctx, tenant, id)
+	if err == nil {
+		s.record(ctx, store.Activity{TenantID: tenant, UserID: id, Type: activityLogin})
+	}
+	return at, err
+}
+
+// API to Get a User's Activity (GET /users/{id}/activity[?limit=&cursor=])
+//
+// The user's timeline, newest first: when they were created and logged in, and
+// changed their email or picture, and who did it.
+func (h *handler) listUserActivity(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	var beforeID int64
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		cursor, err := decodeCursor(token)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+			return
+		}
+		beforeID = cursor.ID
+	}
+	tenant := tenantFromContext(r.Context())
+	_, err = h.users.GetUser(r.Context(), tenant, id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+
+	// Fetch one extra activity to learn whether another page follows
+	list, err := h.activities.ListActivities(r.Context(), tenant, id, beforeID, limit+1)
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingActivity)
+		return
+	}
+	page := ActivityPage{Activities: list}
+	if len(list) > limit {
+		page.Activities = list[:limit]
+		page.NextCursor = encodeCursor(pageCursor{ID: page.Activities[limit-1].ID})
+	}
+	if page.Activities == nil {
+		page.Activities = []store.Activity{}
+	}
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,245 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+// Environment variable with the token admin -api sends, so it stays out of
+// shell history
+const AdminTokenEnv = "USERSVC_ADMIN_TOKEN"
+
+// Actor the audit log records for changes made by admin without -api
+const adminCommandActor = "admin-command"
+
+// AdminOperation is an admin subcommand, as the /v1 API request it makes
+type AdminOperation struct {
+	method   string
+	path     string            // Under /v1, query included
+	vars     map[string]string // Route variables of path, for serving it directly
+	body     any               // Sent as JSON unless nil
+	tenanted bool              // Served within a tenant, like the /users routes
+
+	// serve handles the request without the API, as its route does
+	serve func(h *handler, w http.ResponseWriter, r *http.Request)
+}
+
+// AdminUsage describes the admin subcommands, after the flags common to them
+const AdminUsage = `
+Admin commands, each either run directly against the configured stores or,
+with -api, sent to a running instance with an admin token:
+  users list [-limit n] [-cursor c] [-include-deleted]
+  users get <id>
+  users delete <id>
+  blobs gc [-dry-run]
+  dlq replay [-sequence n] [-max n]
+  keys create -name <name> [-scopes users:read,users:write]
+`
+
+// ParseAdminOperation reads an admin subcommand and its flags, tenant selecting
+// the tenant of the users it works on
+func ParseAdminOperation(args []string, tenant string) (AdminOperation, error) {
+	if len(args) < 2 {
+		return AdminOperation{}, errors.New("admin needs a command, e.g. users list")
+	}
+	command := args[0] + " " + args[1]
+	flags := flag.NewFlagSet("admin "+command, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	query := url.Values{}
+	if tenant != "" {
+		query.Set("tenant", tenant)
+	}
+
+	var op AdminOperation
+	var positional int
+	switch command {
+	case "users list":
+		limit := flags.Int("limit", 0, "")
+		cursor := flags.String("cursor", "", "")
+		deleted := flags.Bool("include-deleted", false, "")
+		if err := flags.Parse(args[2:]); err != nil {
+			return op, fmt.Errorf("%s: %w", command, err)
+		}
+		if *limit > 0 {
+			query.Set("limit", strconv.Itoa(*limit))
+		}
+		if *cursor != "" {
+			query.Set("cursor", *cursor)
+		}
+		if *deleted {
+			query.Set("include_deleted", "true")
+		}
+		op = AdminOperation{method: http.MethodGet, path: "/users", tenanted: true, serve: (*handler).getUsers}
+	case "users get", "users delete":
+		if err := flags.Parse(args[2:]); err != nil {
+			return op, fmt.Errorf("%s: %w", command, err)
+		}
+		positional = 1
+		if flags.NArg() < 1 {
+			return op, fmt.Errorf("%s needs a user ID", command)
+		}
+		id := flags.Arg(0)
+		if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+			return op, fmt.Errorf("%s: invalid user ID %q", command, id)
+		}
+		op = AdminOperation{method: http.MethodGet, path: "/users/" + id, vars: map[string]string{"id": id}, tenanted: true, serve: (*handler).getUser}
+		if command == "users delete" {
+			// Deleted directly, no webhooks are notified, though the outbox
+			// still publishes user.deleted
+			op.method, op.serve = http.MethodDelete, (*handler).deleteUser
+		}
+	case "blobs gc":
+		dryRun := flags.Bool("dry-run", false, "")
+		if err := flags.Parse(args[2:]); err != nil {
+			return op, fmt.Errorf("%s: %w", command, err)
+		}
+		query.Del("tenant") // Orphans are found across every tenant
+		if *dryRun {
+			query.Set("dry_run", "true")
+		}
+		op = AdminOperation{method: http.MethodPost, path: "/admin/cleanup-blobs", serve: (*handler).cleanupBlobs}
+	case "dlq replay":
+		sequence := flags.Int64("sequence", 0, "")
+		max := flags.Int("max", 0, "")
+		if err := flags.Parse(args[2:]); err != nil {
+			return op, fmt.Errorf("%s: %w", command, err)
+		}
+		query.Del("tenant")
+		op = AdminOperation{method: http.MethodPost, path: "/admin/deadletters/requeue", serve: (*handler).requeueDeadLettersHandler}
+		switch {
+		case *sequence > 0:
+			seq := strconv.FormatInt(*sequence, 10)
+			op.path, op.vars = "/admin/deadletters/"+seq+"/requeue", map[string]string{"sequence": seq}
+		case *max > 0:
+			query.Set("max", strconv.Itoa(*max))
+		}
+	case "keys create":
+		name := flags.String("name", "", "")
+		scopes := flags.String("scopes", "", "")
+		if err := flags.Parse(args[2:]); err != nil {
+			return op, fmt.Errorf("%s: %w", command, err)
+		}
+		query.Del("tenant")
+		body := apiKeyRequest{Name: *name, Tenant: tenant}
+		if *scopes != "" {
+			body.Scopes = strings.Split(*scopes, ",")
+		}
+		op = AdminOperation{method: http.MethodPost, path: "/admin/api-keys", body: body, serve: (*handler).createAPIKey}
+	default:
+		return op, fmt.Errorf("unknown admin command %q", command)
+	}
+	if flags.NArg() > positional {
+		return op, fmt.Errorf("%s: unexpected arguments: %v", command, flags.Args()[positional:])
+	}
+	if len(query) > 0 {
+		op.path += "?" + query.Encode()
+	}
+	return op, nil
+}
+
+// newRequest builds the operation's request to the API at baseURL
+func (op AdminOperation) newRequest(ctx context.Context, baseURL string) (*http.Request, error) {
+	var body io.Reader
+	if op.body != nil {
+		data, err := json.Marshal(op.body)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	r, err := http.NewRequestWithContext(ctx, op.method, strings.TrimSuffix(baseURL, "/")+versionedPath(apiV1, op.path), body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Accept", "application/json")
+	if op.body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return r, nil
+}
+
+// RunAdminRemote sends the operation to the instance at baseURL with token
+func RunAdminRemote(ctx context.Context, op AdminOperation, baseURL, token string) error {
+	if token == "" {
+		return errors.New("admin -api needs an admin token, from -token or " + AdminTokenEnv)
+	}
+	r, err := op.newRequest(ctx, baseURL)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	response := &bufferedResponse{header: resp.Header, status: resp.StatusCode}
+	if _, err := io.Copy(&response.body, resp.Body); err != nil {
+		return err
+	}
+	return printAdminResponse(response)
+}
+
+// RunAdminDirect serves the operation over the stores and clients of deps, as
+// an admin, without the API: where the API would authenticate the caller, the
+// command is trusted as much as the configuration it was given
+func RunAdminDirect(ctx context.Context, op AdminOperation, cfg config.Config, deps ServerDeps) error {
+	h := &handler{
+		config:     cfg,
+		users:      deps.Users,
+		pictures:   deps.Pictures,
+		apiKeys:    store.TracedAPIKeyStore{Next: deps.Stores.APIKeys},
+		blobs:      deps.Blobs,
+		events:     deps.Events,
+		serviceBus: deps.ServiceBus,
+		links:      newPictureLinks(cfg),
+	}
+	ctx = context.WithValue(ctx, principalKey, Principal{Admin: true, Subject: adminCommandActor})
+	r, err := op.newRequest(ctx, "")
+	if err != nil {
+		return err
+	}
+	r = mux.SetURLVars(r, op.vars)
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op.serve(h, w, r)
+	})
+	if op.tenanted {
+		handler = tenantMiddleware(h.config)(handler)
+	}
+	return printAdminResponse(serveInternally(handler, r))
+}
+
+// printAdminResponse writes a response's body to stdout, indented, or returns
+// the problem it describes
+func printAdminResponse(resp *bufferedResponse) error {
+	if resp.failed() {
+		problem := resp.problem()
+		return fmt.Errorf("%d %s: %s", problem.Status, http.StatusText(problem.Status), problem.Detail)
+	}
+	if resp.body.Len() == 0 {
+		return nil
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, bytes.TrimSpace(resp.body.Bytes()), "", "  "); err != nil {
+		out.Reset()
+		out.Write(resp.body.Bytes())
+	}
+	out.WriteByte('\n')
+	_, err := os.Stdout.Write(out.Bytes())
+	return err
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+// Scopes a managed API key can be limited to
+const (
+	scopeUsersRead  = "users:read"  // GET and HEAD on /users
+	scopeUsersWrite = "users:write" // Every other method on /users
+)
+
+var apiKeyScopes = []string{scopeUsersRead, scopeUsersWrite}
+
+// Managed keys look like "usk_<43 base64url characters>"; the prefix makes leaked
+// keys easy to grep for, and the first few characters identify a key in listings
+const (
+	apiKeyPrefix       = "usk_"
+	apiKeyRandomBytes  = 32
+	apiKeyDisplayChars = 12
+	apiKeyCacheTTL     = 30 * time.Second // Also bounds how long a revoked key keeps working
+)
+
+// Body of POST /admin/api-keys
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`           // Defaults to every scope
+	Tenant string   `json:"tenant,omitempty"` // Required with tenancy enabled
+}
+
+// Response of POST /admin/api-keys, the only time the key itself is returned
+type mintedAPIKey struct {
+	store.APIKey
+	Key string `json:"key"`
+}
+
+// hashToken derives the value stored for an API key or refresh token. They are
+// random, so a plain SHA-256 is enough; there's nothing to brute-force.
+func hashToken(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// apiKeyVerifier looks up X-API-Key values, briefly caching the keys it finds
+type apiKeyVerifier struct {
+	store store.APIKeyStore
+
+	mu    sync.Mutex
+	cache map[string]cachedAPIKey // By key hash
+}
+
+type cachedAPIKey struct {
+	key     store.APIKey
+	expires time.Time
+}
+
+func newAPIKeyVerifier(store store.APIKeyStore) *apiKeyVerifier {
+	return &apiKeyVerifier{store: store, cache: make(map[string]cachedAPIKey)}
+}
+
+// managedAPIKeysExist reports whether any managed key is unrevoked, which puts
+// /users behind auth even with nothing configured. Keys minted by the admin
+// command while no auth is on count from the next start. When the store can't
+// tell, auth stays on rather than opening every route.
+func managedAPIKeysExist(keys store.APIKeyStore) bool {
+	all, err := keys.ListAPIKeys(context.Background())
+	if err != nil {
+		slog.Error("Failed to list API keys; requiring auth on /users", "error", err)
+		return true
+	}
+	return slices.ContainsFunc(all, func(key store.APIKey) bool { return key.RevokedAt == nil })
+}
+
+// verify returns the principal for a managed key, or ErrAPIKeyNotFound
+func (v *apiKeyVerifier) verify(ctx context.Context, token string) (Principal, error) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return Principal{}, store.ErrAPIKeyNotFound
+	}
+	hash := hashToken(token)
+	cacheKey := string(hash)
+
+	v.mu.Lock()
+	cached, ok := v.cache[cacheKey]
+	v.mu.Unlock()
+	if !ok || time.Now().After(cached.expires) {
+		// Only found keys are cached, so random guesses can't grow the cache
+		key, err := v.store.LookupAPIKey(ctx, hash)
+		if err != nil {
+			return Principal{}, err
+		}
+		cached = cachedAPIKey{key: key, expires: time.Now().Add(apiKeyCacheTTL)}
+		v.mu.Lock()
+		for k, entry := range v.cache {
+			if time.Now().After(entry.expires) {
+				delete(v.cache, k)
+			}
+		}
+		v.cache[cacheKey] = cached
+		v.mu.Unlock()
+	}
+	return Principal{Subject: "api-key:" + strconv.FormatInt(cached.key.ID, 10), Scopes: cached.key.Scopes, Tenant: cached.key.Tenant}, nil
+}
+
+// requireScopes rejects callers limited to scopes that don't cover the request:
+// users:read for GET and HEAD, users:write for everything else
+func requireScopes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scopes := principalFromContext(r.Context()).Scopes
+		needed := scopeUsersWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			needed = scopeUsersRead
+		}
+		if scopes != nil && !slices.Contains(scopes, needed) {
+			writeProblem(w, r, http.StatusForbidden, msgAPIKeyLacksScope.with(needed))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// API to Mint an API Key (POST /admin/api-keys)
+func (h *handler) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if rejectOversizedBody(w, r, err) {
+			return
+		}
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 255 {
+		writeProblem(w, r, http.StatusBadRequest, msgAPIKeyNameInvalid)
+		return
+	}
+	if req.Scopes == nil {
+		req.Scopes = apiKeyScopes
+	}
+	if len(req.Scopes) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, msgScopesEmpty)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			writeProblem(w, r, http.StatusBadRequest, msgUnknownScope.with(scope, strings.Join(apiKeyScopes, " or ")))
+			return
+		}
+	}
+	switch {
+	case !h.config.Tenancy.Enabled && req.Tenant != "":
+		writeProblem(w, r, http.StatusBadRequest, msgTenantNeedsTenancy)
+		return
+	case h.config.Tenancy.Enabled && !config.TenantIDPattern.MatchString(req.Tenant):
+		writeProblem(w, r, http.StatusBadRequest, msgAPIKeyTenantRequired)
+		return
+	}
+
+	random := make([]byte, apiKeyRandomBytes)
+	if _, err := rand.Read(random); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorGeneratingKey)
+		return
+	}
+	secret := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+	key, err := h.apiKeys.CreateAPIKey(r.Context(), store.APIKey{Name: req.Name, Prefix: secret[:apiKeyDisplayChars], Scopes: slices.Compact(slices.Sorted(slices.Values(req.Scopes))), Tenant: req.Tenant}, hashToken(secret))
+	if err != nil {
+		dbError(w, r, err, msgErrorSavingAPIKey)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(mintedAPIKey{APIKey: key, Key: secret})
+}
+
+// API to List API Keys (GET /admin/api-keys)
+func (h *handler) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	list, err := h.apiKeys.ListAPIKeys(r.Context())
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingAPIKeys)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// API to Revoke an API Key (DELETE /admin/api-keys/{id})
+func (h *handler) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidAPIKeyID)
+		return
+	}
+	err = h.apiKeys.RevokeAPIKey(r.Context(), id)
+	if errors.Is(err, store.ErrAPIKeyNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgAPIKeyNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorRevokingAPIKey)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azappconfig"
+
+	"user/user/config"
+)
+
+// How long reading App Configuration may take, at startup and on each poll
+const appConfigTimeout = 10 * time.Second
+
+// Settings App Configuration may change while the service runs, by path
+// prefix. The rest are read once at startup, so setting them there has no
+// effect but a warning.
+var hotReloadable = []string{"cors.", "rate_limit.", "features."}
+
+// AppConfigWatcher layers the hot-reloadable settings kept in Azure App
+// Configuration over the ones the service started with. A setting's key is
+// the prefix and its path, with dots or colons, e.g. usersvc:cors:allowed_origins;
+// values are written as the USERSVC_ variables are.
+type AppConfigWatcher struct {
+	client    *azappconfig.Client // nil without App Configuration
+	base      config.Config       // From the config file, the environment and Key Vault
+	selector  azappconfig.SettingSelector
+	flags     *azappconfig.SettingSelector // Of the feature manager's flags, with app_configuration.feature_flags
+	prefix    string
+	applied   map[string]string // The keys and values of the snapshot in effect
+	listeners []func(config.Config)
+	// The settings in effect. A change from App Configuration swaps in a
+	// whole new snapshot, so a reader never sees half of one.
+	live atomic.Pointer[config.Config]
+}
+
+// NewAppConfigWatcher makes config the live snapshot, then reads App
+// Configuration over it when one is configured
+func NewAppConfigWatcher(cfg config.Config) (*AppConfigWatcher, error) {
+	w := &AppConfigWatcher{base: cfg, prefix: cfg.AppConfiguration.KeyPrefix}
+	w.live.Store(&cfg)
+	settings := cfg.AppConfiguration
+	var err error
+	switch {
+	case settings.ConnectionString != "":
+		w.client, err = azappconfig.NewClientFromConnectionString(settings.ConnectionString, nil)
+	case settings.Endpoint != "":
+		credential, credErr := config.AzureCredential()
+		if credErr != nil {
+			return nil, fmt.Errorf("failed to get an Azure credential for App Configuration: %w", credErr)
+		}
+		w.client, err = azappconfig.NewClient(settings.Endpoint, credential, nil)
+	default:
+		return w, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the App Configuration client: %w", err)
+	}
+	w.selector = azappconfig.SettingSelector{
+		KeyFilter: toPtr(w.prefix + "*"),
+		Fields:    []azappconfig.SettingFields{azappconfig.SettingFieldsKey, azappconfig.SettingFieldsValue},
+	}
+	if settings.Label != "" {
+		w.selector.LabelFilter = toPtr(settings.Label)
+	}
+	if settings.FeatureFlags {
+		w.flags = &azappconfig.SettingSelector{KeyFilter: toPtr(appConfigFeatureFlagPrefix + "*"), LabelFilter: w.selector.LabelFilter, Fields: w.selector.Fields}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), appConfigTimeout)
+	defer cancel()
+	if err := w.reload(ctx); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Current is the snapshot of the settings in effect; callers must not modify it
+func (w *AppConfigWatcher) Current() *config.Config {
+	return w.live.Load()
+}
+
+// onChange has fn called with each new snapshot
+func (w *AppConfigWatcher) onChange(fn func(config.Config)) {
+	w.listeners = append(w.listeners, fn)
+}
+
+// run polls App Configuration every interval until ctx is done
+func (w *AppConfigWatcher) run(ctx context.Context, interval time.Duration) {
+	if w.client == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pollCtx, cancel := context.WithTimeout(ctx, appConfigTimeout)
+			if err := w.reload(pollCtx); err != nil && ctx.Err() == nil {
+				// The snapshot in effect stays until the settings are fixed
+				slog.Warn("Failed to apply App Configuration; keeping the settings in effect", "error", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// reload reads the settings and, if they changed, swaps in a snapshot with
+// them. A snapshot that fails validation is not swapped in. Flags of the
+// feature manager replace the features settings of the same name.
+func (w *AppConfigWatcher) reload(ctx context.Context) error {
+	values := map[string]string{}
+	if err := w.list(ctx, w.selector, values); err != nil {
+		return err
+	}
+	if w.flags != nil {
+		if err := w.list(ctx, *w.flags, values); err != nil {
+			return err
+		}
+	}
+	if w.applied != nil && maps.Equal(values, w.applied) {
+		return nil
+	}
+
+	cfg := w.base
+	flags := map[string]config.FeatureFlag{}
+	for key, value := range values {
+		if name, ok := strings.CutPrefix(key, appConfigFeatureFlagPrefix); ok {
+			flag, err := parseAppConfigFeatureFlag(name, value)
+			if err != nil {
+				return fmt.Errorf("App Configuration feature flag %s: %w", name, err)
+			}
+			flags[name] = flag
+			continue
+		}
+		path := strings.ReplaceAll(strings.TrimPrefix(key, w.prefix), ":", ".")
+		if !isHotReloadable(path) {
+			slog.Warn("App Configuration key ignored; only cors, rate_limit and features settings are read from it", "key", key)
+			continue
+		}
+		if err := setConfigPath(reflect.ValueOf(&cfg).Elem(), strings.Split(path, "."), value); err != nil {
+			return fmt.Errorf("App Configuration key %s: %w", key, err)
+		}
+	}
+	if len(flags) > 0 {
+		features := maps.Clone(cfg.Features)
+		if features == nil {
+			features = map[string]config.FeatureFlag{}
+		}
+		maps.Copy(features, flags)
+		cfg.Features = features
+	}
+	config.ApplyDefaults(&cfg)
+	if err := ValidateConfig(cfg); err != nil {
+		return err
+	}
+	w.live.Store(&cfg)
+	if w.applied != nil {
+		slog.Info("Applied changed App Configuration settings", "keys", len(values))
+	}
+	w.applied = values
+	for _, fn := range w.listeners {
+		fn(cfg)
+	}
+	return nil
+}
+
+// list adds the keys and values selector selects to values
+func (w *AppConfigWatcher) list(ctx context.Context, selector azappconfig.SettingSelector, values map[string]string) error {
+	pager := w.client.NewListSettingsPager(selector, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read App Configuration: %w", err)
+		}
+		for _, setting := range page.Settings {
+			if setting.Key != nil && setting.Value != nil {
+				values[*setting.Key] = *setting.Value
+			}
+		}
+	}
+	return nil
+}
+
+func isHotReloadable(path string) bool {
+	for _, prefix := range hotReloadable {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// setConfigPath sets the setting at path in the struct v, parsing value as
+// applyConfigEnv does. The rest of the path after a map is a key of it; the map
+// is copied first so the snapshot it came from is left as it was.
+func setConfigPath(v reflect.Value, path []string, value string) error {
+	for i, name := range path {
+		switch v.Kind() {
+		case reflect.Struct:
+			field, ok := configField(v, name)
+			if !ok {
+				return fmt.Errorf("there's no setting %s", strings.Join(path[:i+1], "."))
+			}
+			v = field
+		case reflect.Map:
+			// The key is the rest of the path, dots and all
+			entry := reflect.New(v.Type().Elem()).Elem()
+			if err := config.SetConfigValue(entry, value); err != nil {
+				return err
+			}
+			copied := reflect.MakeMap(v.Type())
+			for iter := v.MapRange(); iter.Next(); {
+				copied.SetMapIndex(iter.Key(), iter.Value())
+			}
+			copied.SetMapIndex(reflect.ValueOf(strings.Join(path[i:], ".")).Convert(v.Type().Key()), entry)
+			v.Set(copied)
+			return nil
+		default:
+			return fmt.Errorf("there's no setting %s", strings.Join(path[:i+1], "."))
+		}
+	}
+	if v.Kind() == reflect.Struct {
+		return errors.New("set the settings in it one by one")
+	}
+	return config.SetConfigValue(v, value)
+}
+
+// configField is the field of the struct v with the JSON name name
+func configField(v reflect.Value, name string) (reflect.Value, bool) {
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == name && field.IsExported() {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
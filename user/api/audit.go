@@ -0,0 +1,314 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"user/user/events"
+	"user/user/store"
+)
+
+// Audited actions besides the event types they share with Service Bus
+const (
+	auditUserRestored = "user.restored"
+	auditUserUnlocked = "user.unlocked"
+	auditUserPurged   = "user.purged"
+	auditUserVerified = "user.email_verified"
+)
+
+// Longest actor and request ID stored, as the columns hold
+const maxAuditFieldLength = 255
+
+// User fields that change on every write, left out of the changes of an event
+var auditIgnoredFields = map[string]bool{"version": true, "updatedAt": true}
+
+// Response of GET /audit
+type AuditPage struct {
+	Events     []store.AuditEvent `json:"events"`
+	NextCursor string             `json:"nextCursor,omitempty"`
+}
+
+// AuditedUserStore wraps a UserStore, recording every change to a user in the
+// audit log once it succeeded. Logins and the users the queue consumer mirrors
+// aren't recorded: neither is a change anyone made to the user. A failure to
+// record is logged rather than undoing the change.
+type AuditedUserStore struct {
+	store.UserStore
+	Audit store.AuditStore
+}
+
+// record stores the events for changes that just succeeded
+func (s AuditedUserStore) record(ctx context.Context, events ...store.AuditEvent) {
+	if len(events) == 0 {
+		return
+	}
+	actor, requestID := auditActor(ctx), truncate(requestIDFromContext(ctx), maxAuditFieldLength)
+	for i := range events {
+		events[i].Actor, events[i].RequestID = actor, requestID
+	}
+	if err := s.Audit.RecordAuditEvents(context.WithoutCancel(ctx), events); err != nil {
+		slog.ErrorContext(ctx, "Error recording audit events", "action", events[0].Action, "user_id", events[0].UserID, "count", len(events), "error", err)
+	}
+}
+
+// newAuditEvent describes a change to the user from before to after, either of
+// which may be nil
+func newAuditEvent(action string, before, after *store.User) store.AuditEvent {
+	event := store.AuditEvent{Action: action, Before: before, After: after}
+	for _, user := range []*store.User{before, after} {
+		if user != nil {
+			event.TenantID, event.UserID = user.TenantID, user.ID
+		}
+	}
+	return event
+}
+
+// previous fetches a user about to be changed, for the event's before state;
+// nil if that fails, which leaves the change to report the error
+func (s AuditedUserStore) previous(ctx context.Context, tenant string, id int64) *store.User {
+	user, err := s.UserStore.GetUser(ctx, tenant, id)
+	if err != nil {
+		return nil
+	}
+	return &user
+}
+
+func (s AuditedUserStore) CreateUser(ctx context.Context, user store.User) (store.User, error) {
+	created, err := s.UserStore.CreateUser(ctx, user)
+	if err == nil {
+		s.record(ctx, newAuditEvent(events.UserCreated, nil, &created))
+	}
+	return created, err
+}
+
+func (s AuditedUserStore) BulkCreateUsers(ctx context.Context, tenant string, users []store.User, results []store.BulkResult, atomic bool) error {
+	if err := s.UserStore.BulkCreateUsers(ctx, tenant, users, results, atomic); err != nil {
+		return err
+	}
+	var batch []store.AuditEvent
+	for i, result := range results {
+		if result.ID == 0 {
+			continue
+		}
+		created := users[i]
+		created.ID, created.TenantID = result.ID, tenant
+		batch = append(batch, newAuditEvent(events.UserCreated, nil, &created))
+	}
+	s.record(ctx, batch...)
+	return nil
+}
+
+func (s AuditedUserStore) UpdateUser(ctx context.Context, tenant string, id int64, changes store.UserChanges) (store.User, error) {
+	before := s.previous(ctx, tenant, id)
+	user, err := s.UserStore.UpdateUser(ctx, tenant, id, changes)
+	if err == nil {
+		s.record(ctx, newAuditEvent(events.UserUpdated, before, &user))
+	}
+	return user, err
+}
+
+func (s AuditedUserStore) UpsertUserByEmail(ctx context.Context, user store.User) (store.User, bool, error) {
+	var before *store.User
+	if previous, err := s.UserStore.GetUserByEmail(ctx, user.TenantID, user.Email); err == nil {
+		before = &previous
+	}
+	saved, created, err := s.UserStore.UpsertUserByEmail(ctx, user)
+	switch {
+	case err != nil:
+	case created:
+		s.record(ctx, newAuditEvent(events.UserCreated, nil, &saved))
+	default:
+		s.record(ctx, newAuditEvent(events.UserUpdated, before, &saved))
+	}
+	return saved, created, err
+}
+
+func (s AuditedUserStore) DeleteUser(ctx context.Context, tenant string, id int64, hard bool) error {
+	before := s.previous(ctx, tenant, id)
+	if err := s.UserStore.DeleteUser(ctx, tenant, id, hard); err != nil {
+		return err
+	}
+	var after *store.User
+	if before != nil && !hard {
+		deleted := *before
+		deleted.DeletedAt = toPtr(time.Now().UTC())
+		after = &deleted
+	}
+	event := newAuditEvent(events.UserDeleted, before, after)
+	event.TenantID, event.UserID = tenant, id
+	s.record(ctx, event)
+	return nil
+}
+
+func (s AuditedUserStore) RestoreUser(ctx context.Context, tenant string, id int64) (store.User, error) {
+	user, err := s.UserStore.RestoreUser(ctx, tenant, id)
+	if err == nil {
+		s.record(ctx, newAuditEvent(auditUserRestored, nil, &user))
+	}
+	return user, err
+}
+
+func (s AuditedUserStore) VerifyEmail(ctx context.Context, tenant string, id int64, email string) (store.User, error) {
+	before := s.previous(ctx, tenant, id)
+	user, err := s.UserStore.VerifyEmail(ctx, tenant, id, email)
+	if err == nil && before != nil && before.EmailVerifiedAt == nil {
+		s.record(ctx, newAuditEvent(auditUserVerified, before, &user))
+	}
+	return user, err
+}
+
+func (s AuditedUserStore) LockUser(ctx context.Context, id int64) (store.User, error) {
+	user, err := s.UserStore.LockUser(ctx, id)
+	if err == nil {
+		// Only unlocked users are locked, so the user was as now but unlocked
+		before := user
+		before.LockedAt = nil
+		s.record(ctx, newAuditEvent(events.UserLocked, &before, &user))
+	}
+	return user, err
+}
+
+func (s AuditedUserStore) UnlockUser(ctx context.Context, tenant string, id int64) (store.User, error) {
+	before := s.previous(ctx, tenant, id)
+	user, err := s.UserStore.UnlockUser(ctx, tenant, id)
+	if err == nil {
+		s.record(ctx, newAuditEvent(auditUserUnlocked, before, &user))
+	}
+	return user, err
+}
+
+func (s AuditedUserStore) ErasePersonalData(ctx context.Context, tenant string, id int64) (store.User, store.User, error) {
+	before, after, err := s.UserStore.ErasePersonalData(ctx, tenant, id)
+	if err == nil {
+		// Keeping the user as they were would defeat the erasure
+		s.record(ctx, newAuditEvent(events.UserErased, nil, &after))
+	}
+	return before, after, err
+}
+
+func (s AuditedUserStore) PurgeDeletedUsers(ctx context.Context, cutoff time.Time, limit int) ([]store.User, error) {
+	users, err := s.UserStore.PurgeDeletedUsers(ctx, cutoff, limit)
+	events := make([]store.AuditEvent, len(users))
+	for i := range users {
+		events[i] = newAuditEvent(auditUserPurged, &users[i], nil)
+	}
+	s.record(ctx, events...)
+	return users, err
+}
+
+// auditActor names who is making a change: the authenticated caller, anonymous
+// for requests without one, or system for background work
+func auditActor(ctx context.Context) string {
+	principal, ok := ctx.Value(principalKey).(Principal)
+	switch {
+	case ok && principal.Subject != "":
+		return truncate(principal.Subject, maxAuditFieldLength)
+	case ok && principal.Admin:
+		return "admin-api-key"
+	case ok:
+		return "api-key"
+	case requestIDFromContext(ctx) != "":
+		return "anonymous"
+	}
+	return "system"
+}
+
+// auditChanges lists the fields that differ between an event's before and after
+// states, by their JSON names; nil unless both are known
+func auditChanges(before, after *store.User) map[string]store.FieldChange {
+	if before == nil || after == nil {
+		return nil
+	}
+	from, to := userFields(*before), userFields(*after)
+	changes := map[string]store.FieldChange{}
+	for name := range to {
+		if !auditIgnoredFields[name] && !reflect.DeepEqual(from[name], to[name]) {
+			changes[name] = store.FieldChange{From: from[name], To: to[name]}
+		}
+	}
+	for name := range from {
+		if _, ok := to[name]; !ok && !auditIgnoredFields[name] {
+			changes[name] = store.FieldChange{From: from[name]}
+		}
+	}
+	return changes
+}
+
+// userFields returns the members of a user's JSON representation
+func userFields(user store.User) map[string]any {
+	var fields map[string]any
+	data, _ := json.Marshal(user)
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// API to List Audit Events (GET /audit[?tenant=&user_id=&actor=&action=&since=&until=&limit=&cursor=])
+//
+// Newest first, across every tenant unless tenant is given.
+func (h *handler) listAuditEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	filter := store.AuditFilter{TenantID: query.Get("tenant"), Actor: query.Get("actor"), Action: query.Get("action")}
+	if param := query.Get("user_id"); param != "" {
+		filter.UserID, err = strconv.ParseInt(param, 10, 64)
+		if err != nil || filter.UserID <= 0 {
+			writeProblem(w, r, http.StatusBadRequest, msgPositiveInteger.with("user_id"))
+			return
+		}
+	}
+	for _, param := range []struct {
+		name string
+		dest *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if value := query.Get(param.name); value != "" {
+			if *param.dest, err = time.Parse(time.RFC3339, value); err != nil {
+				writeProblem(w, r, http.StatusBadRequest, msgTimestampInvalid.with(param.name))
+				return
+			}
+		}
+	}
+	var beforeID int64
+	if token := query.Get("cursor"); token != "" {
+		cursor, err := decodeCursor(token)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+			return
+		}
+		beforeID = cursor.ID
+	}
+
+	// Fetch one extra event to learn whether another page follows
+	events, err := h.audit.ListAuditEvents(r.Context(), filter, beforeID, limit+1)
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingAudit)
+		return
+	}
+	page := AuditPage{Events: events}
+	if len(events) > limit {
+		page.Events = events[:limit]
+		page.NextCursor = encodeCursor(pageCursor{ID: page.Events[limit-1].ID})
+	}
+	if page.Events == nil {
+		page.Events = []store.AuditEvent{}
+	}
+	for i := range page.Events {
+		page.Events[i].Changes = auditChanges(page.Events[i].Before, page.Events[i].After)
+	}
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+
+	"user/user/store"
+)
+
+const principalKey contextKey = "principal"
+
+// Principal describes the authenticated caller
+type Principal struct {
+	Admin   bool
+	Subject string        // JWT sub claim, or "api-key:<id>" for managed keys; empty for configured keys
+	Claims  jwt.MapClaims // All JWT claims; nil otherwise
+	Scopes  []string      // What a managed key may do; nil for callers not limited to scopes
+	UserID  int64         // The caller's own user, for JWT callers with a matching record
+	KeyHash string        // Hash of the configured key presented, for configured keys; empty otherwise
+	Tenant  string        // Tenant the credential is bound to; empty for credentials bound to none
+
+	TwoFactorAt time.Time // When the session last passed a two-factor check; zero if never
+}
+
+// authenticators are the credentials bearerAuthMiddleware accepts; nil
+// verifiers are turned off
+type authenticators struct {
+	apiKeys    []string            // Configured keys
+	adminKeys  []string            // Configured keys that also grant admin rights
+	tenantKeys map[string][]string // Configured keys bound to a tenant, by tenant
+	jwts       *jwtVerifier
+	managed    *apiKeyVerifier
+	sessions   *sessionManager
+	guard      *bruteForceGuard // Counts the failures
+}
+
+// bearerAuthMiddleware requires an Authorization: Bearer token that is one of
+// the configured keys, an access token from /auth/login, or a JWT the verifier
+// accepts, or else an X-API-Key header carrying a managed key. Callers
+// presenting an admin key or a token with the admin role are marked as admins.
+func bearerAuthMiddleware(auth authenticators) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key := r.Header.Get("X-API-Key"); key != "" && auth.managed != nil {
+				principal, err := auth.managed.verify(r.Context(), key)
+				if errors.Is(err, store.ErrAPIKeyNotFound) {
+					auth.guard.fail(r, 0)
+					unauthorized(w, r)
+					return
+				}
+				if err != nil {
+					dbError(w, r, err, msgErrorCheckingAPIKey)
+					return
+				}
+				next.ServeHTTP(w, withPrincipal(r, principal))
+				return
+			}
+
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || token == "" {
+				unauthorized(w, r)
+				return
+			}
+			if looksLikeJWT(token) && (auth.sessions != nil || auth.jwts != nil) {
+				var principal Principal
+				err := errors.New("no verifier accepted the token")
+				if auth.sessions != nil {
+					principal, err = auth.sessions.verify(token)
+				}
+				if errors.Is(err, errTwoFactorPending) {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="users", error="insufficient_user_authentication"`)
+					writeProblem(w, r, http.StatusUnauthorized, msgTwoFactorRequired)
+					return
+				}
+				if err != nil && auth.jwts != nil {
+					principal, err = auth.jwts.verify(r.Context(), token)
+				}
+				if err != nil {
+					slog.DebugContext(r.Context(), "Rejected bearer JWT", "error", err)
+					auth.guard.fail(r, 0)
+					w.Header().Set("WWW-Authenticate", `Bearer realm="users", error="invalid_token"`)
+					writeProblem(w, r, http.StatusUnauthorized, msgUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, withPrincipal(r, principal))
+				return
+			}
+			// Check every list so timing doesn't reveal which one matched
+			isAdmin := validAPIKey(token, auth.adminKeys)
+			isUser := validAPIKey(token, auth.apiKeys)
+			var tenant string
+			for _, t := range slices.Sorted(maps.Keys(auth.tenantKeys)) {
+				if validAPIKey(token, auth.tenantKeys[t]) {
+					tenant = t
+				}
+			}
+			if !isAdmin && !isUser && tenant == "" {
+				auth.guard.fail(r, 0)
+				unauthorized(w, r)
+				return
+			}
+			next.ServeHTTP(w, withPrincipal(r, Principal{Admin: isAdmin, KeyHash: configuredKeyHash(token), Tenant: tenant}))
+		})
+	}
+}
+
+// configuredKeyHash identifies a configured key without keeping the key itself
+func configuredKeyHash(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:16])
+}
+
+// credential identifies the credential the caller presented, the same on
+// every request made with it: its subject, or the hash of a configured key.
+// It is empty for unauthenticated callers.
+func (p Principal) credential() string {
+	if p.Subject != "" {
+		return p.Subject
+	}
+	if p.KeyHash != "" {
+		return "key:" + p.KeyHash
+	}
+	return ""
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="users"`)
+	writeProblem(w, r, http.StatusUnauthorized, msgUnauthorized)
+}
+
+// validAPIKey compares the token against every key in constant time
+func validAPIKey(token string, apiKeys []string) bool {
+	valid := 0
+	for _, key := range apiKeys {
+		valid |= subtle.ConstantTimeCompare([]byte(token), []byte(key))
+	}
+	return token != "" && valid == 1
+}
+
+// requireAdmin rejects authenticated callers that aren't admins
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !principalFromContext(r.Context()).Admin {
+			writeProblem(w, r, http.StatusForbidden, msgAdminRequired)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// principalFromContext returns the caller stored by bearerAuthMiddleware
+func principalFromContext(ctx context.Context) Principal {
+	principal, _ := ctx.Value(principalKey).(Principal)
+	return principal
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"user/user/config"
+	"user/user/fakes"
+	"user/user/store"
+)
+
+// Password of the user newAuthTestServer stores
+const testPassword = "correct horse battery staple"
+
+// newAuthTestServer builds the server with sessions and password logins over
+// the in-memory stores, holding one user, alice@example.com, with testPassword.
+// configure adjusts the config first.
+func newAuthTestServer(t *testing.T, configure func(cfg *config.Config)) (*Server, store.Stores, store.User) {
+	t.Helper()
+	var cfg config.Config
+	config.ApplyDefaults(&cfg)
+	cfg.Auth.Sessions.Secret = strings.Repeat("s", 32)
+	configure(&cfg)
+	backend := store.NewMemoryStores()
+	user := storeTestUser(t, backend.Users, "Alice", "alice@example.com")
+	hash, err := hashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Credentials.SetPasswordHash(context.Background(), user.ID, hash); err != nil {
+		t.Fatal(err)
+	}
+	return newTestServerOver(t, cfg, backend, fakes.NewBlobStorage(), fakes.NewPublisher(cfg)), backend, user
+}
+
+// loginBody is a POST /auth/login body for alice@example.com
+func loginBody(password string) string {
+	body, _ := json.Marshal(passwordLoginRequest{Email: "alice@example.com", Password: password})
+	return string(body)
+}
+
+// decodeTokens reads the tokens of a successful login or refresh
+func decodeTokens(t *testing.T, body []byte) sessionTokens {
+	t.Helper()
+	var tokens sessionTokens
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("tokens = %+v, want an access and a refresh token", tokens)
+	}
+	return tokens
+}
+
+func TestPasswordLogin(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "right password", body: loginBody(testPassword), status: http.StatusOK},
+		{name: "wrong password", body: loginBody("wrong password"), status: http.StatusUnauthorized},
+		{name: "unknown email", body: `{"email":"bob@example.com","password":"` + testPassword + `"}`, status: http.StatusUnauthorized},
+		{name: "no password", body: `{"email":"alice@example.com"}`, status: http.StatusBadRequest},
+		{name: "malformed body", body: `{"email":`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _, _ := newAuthTestServer(t, func(cfg *config.Config) {})
+
+			rec := serveTest(server.router, http.MethodPost, "/v1/auth/login", "application/json", tt.body, nil)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			decodeTokens(t, rec.Body.Bytes())
+			if cache := rec.Header().Get("Cache-Control"); cache != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", cache)
+			}
+		})
+	}
+}
+
+func TestLockout(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxFailures   int
+		maxIPFailures int
+		failures      int
+		status        int // Of the right password after the failures
+		locked        bool
+	}{
+		{name: "below the threshold", maxFailures: 3, maxIPFailures: 100, failures: 2, status: http.StatusOK},
+		{name: "account locked", maxFailures: 3, maxIPFailures: 100, failures: 3, status: http.StatusLocked, locked: true},
+		// The IP is turned away before its password is checked, so the account isn't locked
+		{name: "IP blocked", maxFailures: 100, maxIPFailures: 3, failures: 3, status: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, backend, user := newAuthTestServer(t, func(cfg *config.Config) {
+				cfg.Auth.Lockout.MaxFailures = tt.maxFailures
+				cfg.Auth.Lockout.MaxIPFailures = tt.maxIPFailures
+			})
+			for range tt.failures {
+				if rec := serveTest(server.router, http.MethodPost, "/v1/auth/login", "application/json", loginBody("wrong password"), nil); rec.Code != http.StatusUnauthorized {
+					t.Fatalf("failed login status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+				}
+			}
+
+			rec := serveTest(server.router, http.MethodPost, "/v1/auth/login", "application/json", loginBody(testPassword), nil)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+				t.Error("no Retry-After")
+			}
+			stored, err := backend.Users.GetUser(context.Background(), "", user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if locked := stored.LockedAt != nil; locked != tt.locked {
+				t.Errorf("locked = %v, want %v", locked, tt.locked)
+			}
+		})
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	server, _, _ := newAuthTestServer(t, func(cfg *config.Config) {})
+	rec := serveTest(server.router, http.MethodPost, "/v1/auth/login", "application/json", loginBody(testPassword), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	first := decodeTokens(t, rec.Body.Bytes()).RefreshToken
+	refreshBody := func(token string) string { return `{"refreshToken":"` + token + `"}` }
+
+	rec = serveTest(server.router, http.MethodPost, "/v1/auth/refresh", "application/json", refreshBody(first), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	second := decodeTokens(t, rec.Body.Bytes()).RefreshToken
+	if second == first {
+		t.Fatal("refresh returned the refresh token it was given")
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		// Each refresh token works once
+		{name: "used token", token: first, status: http.StatusUnauthorized},
+		{name: "unknown token", token: refreshTokenPrefix + "unknown", status: http.StatusUnauthorized},
+		{name: "not a refresh token", token: "unknown", status: http.StatusBadRequest},
+		{name: "replacement token", token: second, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveTest(server.router, http.MethodPost, "/v1/auth/refresh", "application/json", refreshBody(tt.token), nil)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestCredentialsRequired(t *testing.T) {
+	server, backend, user := newAuthTestServer(t, func(cfg *config.Config) {})
+	other := storeTestUser(t, backend.Users, "Bob", "bob@example.com")
+	rec := serveTest(server.router, http.MethodPost, "/v1/auth/login", "application/json", loginBody(testPassword), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	session := "Bearer " + decodeTokens(t, rec.Body.Bytes()).AccessToken
+	readOnly := store.APIKey{Name: "reader", Prefix: "usk_reader", Scopes: []string{scopeUsersRead}}
+	if _, err := backend.APIKeys.CreateAPIKey(context.Background(), readOnly, hashToken(apiKeyPrefix+"reader")); err != nil {
+		t.Fatal(err)
+	}
+
+	own, others := "/v1/users/"+strconv.FormatInt(user.ID, 10), "/v1/users/"+strconv.FormatInt(other.ID, 10)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+		status int
+	}{
+		{name: "no credentials", method: http.MethodGet, path: own, status: http.StatusUnauthorized},
+		{name: "unknown bearer token", method: http.MethodGet, path: own, header: http.Header{"Authorization": {"Bearer unknown"}}, status: http.StatusUnauthorized},
+		{name: "unknown API key", method: http.MethodGet, path: own, header: http.Header{"X-Api-Key": {apiKeyPrefix + "unknown"}}, status: http.StatusUnauthorized},
+		{name: "admin route without credentials", method: http.MethodGet, path: "/v1/admin/api-keys", status: http.StatusUnauthorized},
+		{name: "session reading its user", method: http.MethodGet, path: own, header: http.Header{"Authorization": {session}}, status: http.StatusOK},
+		{name: "session reading another user", method: http.MethodGet, path: others, header: http.Header{"Authorization": {session}}, status: http.StatusForbidden},
+		{name: "session on an admin route", method: http.MethodGet, path: "/v1/admin/api-keys", header: http.Header{"Authorization": {session}}, status: http.StatusForbidden},
+		{name: "read-only key reading", method: http.MethodGet, path: others, header: http.Header{"X-Api-Key": {apiKeyPrefix + "reader"}}, status: http.StatusOK},
+		{name: "read-only key writing", method: http.MethodDelete, path: others, header: http.Header{"X-Api-Key": {apiKeyPrefix + "reader"}}, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveTest(server.router, tt.method, tt.path, "", "", tt.header)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate challenge")
+			}
+		})
+	}
+}
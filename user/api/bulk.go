@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+)
+
+// Rows inserted per transaction when a bulk import needn't be atomic, so a large
+// batch doesn't hold its locks until the last row
+const bulkChunkSize = 500
+
+// bulkFailure is the message and problem code describing why a row failed
+func bulkFailure(err error) (Message, string) {
+	var message Message
+	switch {
+	case errors.Is(err, store.ErrDuplicateEmail):
+		return msgEmailExists, problemCodeEmailTaken
+	case errors.As(err, &message):
+		return message, ""
+	}
+	return msgInsertFailed, ""
+}
+
+// validateBulkUser checks a single imported row before it is inserted
+func validateBulkUser(user store.User, cfg config.Config) error {
+	if err := validateName(strings.TrimSpace(user.Name), cfg.Validation.MaxNameLength); err != nil {
+		return msgFieldMessage.with("name", err)
+	}
+	if err := validateEmail(strings.TrimSpace(user.Email)); err != nil {
+		return msgFieldMessage.with("email", err)
+	}
+	if user.Link != "" {
+		if err := validatePhotoURL(user.Link, cfg.Validation.MaxLinkLength); err != nil {
+			return err
+		}
+	}
+	if err := validateMetadata(user.Metadata); err != nil {
+		return msgFieldMessage.with("metadata", err)
+	}
+	return nil
+}
+
+// API to Import Users in Bulk (POST /users/bulk[?atomic=true], POST /users:batch)
+//
+// Rows that fail validation or insertion are reported without failing the rest,
+// unless atomic is set. Otherwise the rows go in chunks of their own
+// transaction, and a database failure keeps the chunks already committed.
+func (h *handler) bulkCreateUsers(w http.ResponseWriter, r *http.Request) {
+	atomic := r.URL.Query().Get("atomic") == "true"
+	tenant := tenantFromContext(r.Context())
+
+	var users []store.User
+	if err := json.NewDecoder(r.Body).Decode(&users); err != nil {
+		if rejectOversizedBody(w, r, err) {
+			return
+		}
+		writeProblem(w, r, http.StatusBadRequest, msgBulkNotArray)
+		return
+	}
+	if len(users) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, msgNoUsersSupplied)
+		return
+	}
+	if len(users) > h.config.Bulk.MaxBatchSize {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, msgTooManyUsers.with(h.config.Bulk.MaxBatchSize))
+		return
+	}
+
+	results := make([]store.BulkResult, len(users))
+	for i, user := range users {
+		results[i].Index = i
+		results[i].Err = validateBulkUser(user, h.config)
+	}
+	chunk := bulkChunkSize
+	if atomic {
+		chunk = len(users)
+	}
+	for start := 0; start < len(users); start += chunk {
+		end := min(start+chunk, len(users))
+		if err := h.users.BulkCreateUsers(store.WithOutboxEvent(r.Context(), events.UserCreated), tenant, users[start:end], results[start:end], atomic); err != nil {
+			if start > 0 {
+				dbError(w, r, err, msgErrorImportingUsersFrom.with(start))
+			} else {
+				dbError(w, r, err, msgErrorImportingUsers)
+			}
+			return
+		}
+	}
+
+	// Errors are translated as problems are, into the request's Accept-Language
+	lang := acceptedLanguage(r)
+	failed := 0
+	for i, result := range results {
+		if result.Failed() {
+			failed++
+			failure, code := bulkFailure(result.Err)
+			results[i].Error, results[i].Code = failure.in(lang), code
+		}
+	}
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+
+	// In atomic mode any failure has discarded the whole batch
+	if atomic && failed > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]any{"created": 0, "failed": failed, "results": results})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"created": len(users) - failed, "failed": failed, "results": results})
+}
@@ -0,0 +1,338 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+
+	"user/user/config"
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// How long a cache call may take before the read goes to the database instead
+const cacheTimeout = 250 * time.Millisecond
+
+// Kinds of cached reads, the kind label of cache_requests_total
+const (
+	cacheKindUser  = "user"
+	cacheKindList  = "list"
+	cacheKindCount = "count"
+)
+
+// Cache keeps encoded reads of the store for a while, shared by every instance
+type Cache interface {
+	// Get returns the value stored under key, and false when there is none
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value under key for ttl, or until evicted for a ttl of 0
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Close() error
+}
+
+// NewCache connects to the cache.redis_url configured, or returns nil when
+// caching is off
+func NewCache(cfg config.Config) (Cache, error) {
+	if cfg.Cache.RedisURL == "" {
+		return nil, nil
+	}
+	options, err := redis.ParseURL(cfg.Cache.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	// Calls give up at their context's deadline, so a slow cache costs at most cacheTimeout
+	options.ContextTimeoutEnabled = true
+	return redisCache{client: redis.NewClient(options)}, nil
+}
+
+// redisCache is the Cache kept in Redis, such as Azure Cache for Redis
+type redisCache struct {
+	client *redis.Client
+}
+
+func (c redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
+
+func (c redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (c redisCache) Close() error {
+	return c.client.Close()
+}
+
+// CachedUserStore wraps a UserStore, answering user reads and listings from
+// the cache while they are fresh. Entries are keyed by their tenant's
+// generation, which every change to one of its users moves on, so a change on
+// any instance invalidates all of the tenant's entries at once; an entry
+// written by a read that raced the change sits under the old generation and is
+// never read. Concurrent misses of one key share one database read. When the
+// cache is down, or can't be invalidated, reads go to the database and
+// entries last at most their TTL.
+type CachedUserStore struct {
+	store.UserStore
+	cache   Cache
+	prefix  string
+	userTTL time.Duration
+	listTTL time.Duration
+	flights *singleflight.Group
+}
+
+func NewCachedUserStore(cfg config.Config, store store.UserStore, cache Cache) CachedUserStore {
+	return CachedUserStore{
+		UserStore: store,
+		cache:     cache,
+		prefix:    cfg.Cache.KeyPrefix,
+		userTTL:   config.Seconds(cfg.Cache.UserTTLSeconds),
+		listTTL:   config.Seconds(cfg.Cache.ListTTLSeconds),
+		flights:   &singleflight.Group{},
+	}
+}
+
+func (s CachedUserStore) generationKey(tenant string) string {
+	return s.prefix + "gen:" + tenant
+}
+
+// generation is the tenant's current generation, starting a new one if the
+// cache has none, e.g. after evicting it
+func (s CachedUserStore) generation(ctx context.Context, tenant string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, cacheTimeout)
+	defer cancel()
+	generation, ok, err := s.cache.Get(ctx, s.generationKey(tenant))
+	if err != nil || ok {
+		return string(generation), err
+	}
+	return s.newGeneration(ctx, tenant)
+}
+
+// newGeneration moves the tenant on to a new generation. Two instances doing
+// so at once both leave a generation no entry was written under.
+func (s CachedUserStore) newGeneration(ctx context.Context, tenant string) (string, error) {
+	generation := strconv.FormatInt(time.Now().UnixNano(), 36)
+	return generation, s.cache.Set(ctx, s.generationKey(tenant), []byte(generation), 0)
+}
+
+// invalidate drops the cached reads of the tenants, after a change to their users
+func (s CachedUserStore) invalidate(ctx context.Context, tenants ...string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cacheTimeout)
+	defer cancel()
+	for _, tenant := range tenants {
+		if _, err := s.newGeneration(ctx, tenant); err != nil {
+			slog.WarnContext(ctx, "Failed to invalidate the user cache; its entries last until they expire", "tenant", tenant, "error", err)
+		}
+	}
+}
+
+// cached answers a read of kind from the cache, or with load and then caches
+// it for ttl. args identify the read within the tenant.
+func cached[T any](ctx context.Context, s CachedUserStore, kind, tenant string, args any, ttl time.Duration, load func(context.Context) (T, error)) (T, error) {
+	generation, err := s.generation(ctx, tenant)
+	if err != nil {
+		telemetry.CacheRequestsTotal.WithLabelValues(kind, "error").Inc()
+		slog.WarnContext(ctx, "Cache unavailable; reading from the database", "error", err)
+		return load(ctx)
+	}
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return load(ctx)
+	}
+	sum := sha256.Sum256(encoded)
+	key := fmt.Sprintf("%s%s:%s:%s:%s", s.prefix, kind, tenant, generation, hex.EncodeToString(sum[:]))
+
+	getCtx, cancel := context.WithTimeout(ctx, cacheTimeout)
+	data, ok, err := s.cache.Get(getCtx, key)
+	cancel()
+	if ok {
+		var value T
+		if err := json.Unmarshal(data, &value); err == nil {
+			telemetry.CacheRequestsTotal.WithLabelValues(kind, "hit").Inc()
+			return value, nil
+		}
+	}
+	if err != nil {
+		telemetry.CacheRequestsTotal.WithLabelValues(kind, "error").Inc()
+	} else {
+		telemetry.CacheRequestsTotal.WithLabelValues(kind, "miss").Inc()
+	}
+
+	// The read outlives the request that started it if others are waiting on it
+	value, err, _ := s.flights.Do(key, func() (any, error) {
+		value, err := load(context.WithoutCancel(ctx))
+		if err != nil {
+			return value, err
+		}
+		if data, err := json.Marshal(value); err == nil {
+			setCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cacheTimeout)
+			if err := s.cache.Set(setCtx, key, data, ttl); err != nil {
+				slog.WarnContext(ctx, "Failed to cache a read", "kind", kind, "error", err)
+			}
+			cancel()
+		}
+		return value, nil
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return value.(T), nil
+}
+
+func (s CachedUserStore) ListUsers(ctx context.Context, tenant string, filter store.UserFilter, sort store.UserSort) ([]store.User, error) {
+	return cached(ctx, s, cacheKindList, tenant, []any{filter, sort}, s.listTTL, func(ctx context.Context) ([]store.User, error) {
+		return s.UserStore.ListUsers(ctx, tenant, filter, sort)
+	})
+}
+
+func (s CachedUserStore) ListUsersAfter(ctx context.Context, tenant string, after store.User, limit int, filter store.UserFilter, sort store.UserSort) ([]store.User, error) {
+	// Only the ID and sort key of after matter
+	args := []any{after.ID, after.Name, after.CreatedAt, limit, filter, sort}
+	return cached(ctx, s, cacheKindList, tenant, args, s.listTTL, func(ctx context.Context) ([]store.User, error) {
+		return s.UserStore.ListUsersAfter(ctx, tenant, after, limit, filter, sort)
+	})
+}
+
+func (s CachedUserStore) CountUsers(ctx context.Context, tenant string, filter store.UserFilter) (int64, error) {
+	return cached(ctx, s, cacheKindCount, tenant, filter, s.listTTL, func(ctx context.Context) (int64, error) {
+		return s.UserStore.CountUsers(ctx, tenant, filter)
+	})
+}
+
+func (s CachedUserStore) GetUser(ctx context.Context, tenant string, id int64) (store.User, error) {
+	return cached(ctx, s, cacheKindUser, tenant, id, s.userTTL, func(ctx context.Context) (store.User, error) {
+		return s.UserStore.GetUser(ctx, tenant, id)
+	})
+}
+
+func (s CachedUserStore) CreateUser(ctx context.Context, user store.User) (store.User, error) {
+	created, err := s.UserStore.CreateUser(ctx, user)
+	if err == nil {
+		s.invalidate(ctx, created.TenantID)
+	}
+	return created, err
+}
+
+func (s CachedUserStore) BulkCreateUsers(ctx context.Context, tenant string, users []store.User, results []store.BulkResult, atomic bool) error {
+	err := s.UserStore.BulkCreateUsers(ctx, tenant, users, results, atomic)
+	s.invalidate(ctx, tenant)
+	return err
+}
+
+func (s CachedUserStore) UpdateUser(ctx context.Context, tenant string, id int64, changes store.UserChanges) (store.User, error) {
+	user, err := s.UserStore.UpdateUser(ctx, tenant, id, changes)
+	if err == nil {
+		s.invalidate(ctx, tenant)
+	}
+	return user, err
+}
+
+func (s CachedUserStore) TouchUser(ctx context.Context, tenant string, id int64) (time.Time, error) {
+	at, err := s.UserStore.TouchUser(ctx, tenant, id)
+	if err == nil {
+		s.invalidate(ctx, tenant)
+	}
+	return at, err
+}
+
+func (s CachedUserStore) UpsertUser(ctx context.Context, user store.User) error {
+	err := s.UserStore.UpsertUser(ctx, user)
+	if err == nil {
+		s.invalidate(ctx, user.TenantID)
+	}
+	return err
+}
+
+func (s CachedUserStore) UpsertUserByEmail(ctx context.Context, user store.User) (store.User, bool, error) {
+	saved, created, err := s.UserStore.UpsertUserByEmail(ctx, user)
+	if err == nil {
+		s.invalidate(ctx, user.TenantID)
+	}
+	return saved, created, err
+}
+
+func (s CachedUserStore) DeleteUser(ctx context.Context, tenant string, id int64, hard bool) error {
+	err := s.UserStore.DeleteUser(ctx, tenant, id, hard)
+	if err == nil {
+		s.invalidate(ctx, tenant)
+	}
+	return err
+}
+
+func (s CachedUserStore) ErasePersonalData(ctx context.Context, tenant string, id int64) (store.User, store.User, error) {
+	before, after, err := s.UserStore.ErasePersonalData(ctx, tenant, id)
+	if err == nil {
+		s.invalidate(ctx, tenant)
+	}
+	return before, after, err
+}
+
+func (s CachedUserStore) PurgeDeletedUsers(ctx context.Context, cutoff time.Time, limit int) ([]store.User, error) {
+	purged, err := s.UserStore.PurgeDeletedUsers(ctx, cutoff, limit)
+	tenants := map[string]bool{}
+	for _, user := range purged {
+		if !tenants[user.TenantID] {
+			tenants[user.TenantID] = true
+			s.invalidate(ctx, user.TenantID)
+		}
+	}
+	return purged, err
+}
+
+func (s CachedUserStore) RestoreUser(ctx context.Context, tenant string, id int64) (store.User, error) {
+	user, err := s.UserStore.RestoreUser(ctx, tenant, id)
+	if err == nil {
+		s.invalidate(ctx, tenant)
+	}
+	return user, err
+}
+
+func (s CachedUserStore) VerifyEmail(ctx context.Context, tenant string, id int64, email string) (store.User, error) {
+	user, err := s.UserStore.VerifyEmail(ctx, tenant, id, email)
+	if err == nil {
+		s.invalidate(ctx, tenant)
+	}
+	return user, err
+}
+
+func (s CachedUserStore) LockUser(ctx context.Context, id int64) (store.User, error) {
+	user, err := s.UserStore.LockUser(ctx, id)
+	if err == nil {
+		s.invalidate(ctx, user.TenantID)
+	}
+	return user, err
+}
+
+func (s CachedUserStore) UnlockUser(ctx context.Context, tenant string, id int64) (store.User, error) {
+	user, err := s.UserStore.UnlockUser(ctx, tenant, id)
+	if err == nil {
+		s.invalidate(ctx, tenant)
+	}
+	return user, err
+}
+
+// warmCache reads the default first page of users of each tenant, and their
+// count, through store, so with the cache in front the first requests after a
+// deploy or an eviction are hits. It stops at the first read that fails.
+func warmCache(ctx context.Context, userStore store.UserStore, tenants []string) error {
+	for _, tenant := range tenants {
+		if _, err := userStore.ListUsersAfter(ctx, tenant, store.User{}, defaultPageSize+1, store.UserFilter{}, store.UserSort{}); err != nil {
+			return fmt.Errorf("tenant %q: %w", tenant, err)
+		}
+		if _, err := userStore.CountUsers(ctx, tenant, store.UserFilter{}); err != nil {
+			return fmt.Errorf("tenant %q: %w", tenant, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"user/user/blob"
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// Blob cleanup tuning
+const (
+	cleanupPageSize = 1000
+	// Blobs this recent may belong to a create still in flight, whose row isn't committed yet
+	cleanupGracePeriod = time.Hour
+)
+
+// Outcome of POST /admin/cleanup-blobs, and of each scheduled run
+type BlobCleanupReport struct {
+	DryRun         bool     `json:"dryRun"`
+	Scanned        int      `json:"scanned"`
+	Orphans        []string `json:"orphans"` // Container-qualified names, e.g. profile-pictures/a.jpg
+	OrphanBytes    int64    `json:"orphanBytes"`
+	Deleted        int      `json:"deleted"`
+	ReclaimedBytes int64    `json:"reclaimedBytes"`
+	Failed         []string `json:"failed,omitempty"`
+}
+
+// API to Delete Orphaned Pictures (POST /admin/cleanup-blobs[?dry_run=true])
+//
+// Lists the picture and thumbnail containers page by page and deletes blobs no
+// user row links to, soft-deleted users included since they may be restored.
+func (h *handler) cleanupBlobs(w http.ResponseWriter, r *http.Request) {
+	report, err := collectOrphanedBlobs(r.Context(), h.blobs, h.users, h.pictures, h.config.Azure.PicturesContainer, r.URL.Query().Get("dry_run") == "true")
+	if err != nil {
+		dependencyError(w, r, err, http.StatusInternalServerError, msgErrorCleaningUpBlobs)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// runBlobCleanup collects orphaned blobs every interval until ctx is
+// cancelled, only reporting them in dry-run mode. Instances may collect
+// concurrently: each blob is deleted by whichever gets to it first.
+func runBlobCleanup(ctx context.Context, blobs blob.Storage, userStore store.UserStore, pictures store.PictureStore, picturesContainer string, interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// Errors are logged and the rest left to the next run
+		collectOrphanedBlobs(ctx, blobs, userStore, pictures, picturesContainer, dryRun)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectOrphanedBlobs deletes, or in dry-run mode reports, the blobs no user
+// links to, pictures being in picturesContainer, counting them in the blob
+// cleanup metrics
+func collectOrphanedBlobs(ctx context.Context, blobs blob.Storage, userStore store.UserStore, pictures store.PictureStore, picturesContainer string, dryRun bool) (BlobCleanupReport, error) {
+	report := BlobCleanupReport{DryRun: dryRun, Orphans: []string{}}
+
+	containers := []struct {
+		name string
+		link func(string) string
+		// forget drops the pictures row of a deleted orphan, so no upload goes on to share it
+		forget func(context.Context, string) error
+	}{
+		{picturesContainer, func(name string) string { return blob.Link(picturesContainer, name) }, pictures.ForgetPicture},
+		{blob.ThumbnailsContainer, thumbnailLink, nil},
+	}
+	for _, container := range containers {
+		if err := cleanupContainer(ctx, blobs, userStore, container.name, container.link, container.forget, &report); err != nil {
+			slog.ErrorContext(ctx, "Error cleaning up blobs", "container", container.name, "error", err)
+			return report, err
+		}
+	}
+
+	slog.InfoContext(ctx, "Blob cleanup finished", "dry_run", report.DryRun, "scanned", report.Scanned, "orphans", len(report.Orphans),
+		"orphan_bytes", report.OrphanBytes, "deleted", report.Deleted, "reclaimed_bytes", report.ReclaimedBytes)
+	return report, nil
+}
+
+// cleanupContainer checks one container a page at a time, so memory stays flat
+// however many blobs it holds
+func cleanupContainer(ctx context.Context, blobs blob.Storage, userStore store.UserStore, container string, link func(string) string, forget func(context.Context, string) error, report *BlobCleanupReport) error {
+	cutoff := time.Now().Add(-cleanupGracePeriod)
+	return blobs.List(ctx, container, cleanupPageSize, func(page []blob.Properties) error {
+		var names, links []string
+		var sizes []int64
+		for _, item := range page {
+			report.Scanned++
+			if item.Name == "" || item.LastModified.IsZero() || item.LastModified.After(cutoff) {
+				continue
+			}
+			names = append(names, item.Name)
+			links = append(links, link(item.Name))
+			sizes = append(sizes, item.ContentLength)
+		}
+
+		referenced, err := userStore.ReferencedLinks(ctx, links)
+		if err != nil {
+			return err
+		}
+		for i, name := range names {
+			if referenced[links[i]] {
+				continue
+			}
+			report.Orphans = append(report.Orphans, links[i])
+			report.OrphanBytes += sizes[i]
+			if report.DryRun {
+				telemetry.BlobCleanupOrphansTotal.WithLabelValues("reported").Inc()
+				continue
+			}
+			if forget != nil {
+				if err := forget(ctx, name); err != nil {
+					slog.ErrorContext(ctx, "Error forgetting orphaned picture", "container", container, "blob", name, "error", err)
+					report.Failed = append(report.Failed, links[i])
+					telemetry.BlobCleanupOrphansTotal.WithLabelValues("failure").Inc()
+					continue
+				}
+			}
+			err := blobs.Delete(ctx, container, name)
+			if errors.Is(err, blob.ErrNotFound) {
+				// Another instance got to it first
+				continue
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "Error deleting orphaned blob", "container", container, "blob", name, "error", err)
+				report.Failed = append(report.Failed, links[i])
+				telemetry.BlobCleanupOrphansTotal.WithLabelValues("failure").Inc()
+				continue
+			}
+			report.Deleted++
+			report.ReclaimedBytes += sizes[i]
+			telemetry.BlobCleanupOrphansTotal.WithLabelValues("deleted").Inc()
+			telemetry.BlobCleanupReclaimedBytesTotal.Add(float64(sizes[i]))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Media types whose content is already compressed, so compressing it again
+// only costs CPU. Any image, audio or video type counts too.
+var compressedMediaTypes = []string{"application/zip", "application/gzip", "application/x-gzip", "application/zstd", "application/pdf"}
+
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() any { return zlib.NewWriter(nil) }}
+)
+
+// compressionMiddleware compresses response bodies of at least minBytes with
+// gzip or deflate, whichever Accept-Encoding prefers. Smaller bodies, ones the
+// handler already encoded and already compressed media such as images are sent
+// as they are. Bodies are held back until minBytes arrive or the handler
+// flushes, so streamed responses are compressed as they go.
+func compressionMiddleware(minBytes int) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := preferredEncoding(r.Header.Get("Accept-Encoding"))
+			if encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minBytes: minBytes, status: http.StatusOK}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// preferredEncoding returns gzip or deflate, whichever the Accept-Encoding
+// header rates higher with gzip winning ties, or "" if it accepts neither
+func preferredEncoding(header string) string {
+	best, bestQuality := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		if quality := codingQuality(header, coding); quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
+	}
+	return best
+}
+
+// codingQuality returns the q value Accept-Encoding gives coding, preferring
+// an exact entry over *
+func codingQuality(header, coding string) float64 {
+	quality, exact, found := 0.0, false, false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != coding && (name != "*" || exact) {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		if name == coding {
+			quality, exact, found = q, true, true
+		} else if !found {
+			quality, found = q, true
+		}
+	}
+	return quality
+}
+
+// compressWriter holds back a response until it can tell whether compressing
+// is worth it, then sends it through the compressor or as it is
+type compressWriter struct {
+	http.ResponseWriter
+	encoding   string
+	minBytes   int
+	status     int
+	pending    []byte
+	decided    bool
+	compressor io.WriteCloser // Nil unless compressing
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	// Informational responses go out at once; the final one waits for the body
+	if status >= 100 && status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.decided {
+		if cw.compressor != nil {
+			return cw.compressor.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.pending = append(cw.pending, p...)
+	if len(cw.pending) >= cw.minBytes {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide sends the status and held-back body, compressing them when large is
+// set and the response is worth compressing
+func (cw *compressWriter) decide(large bool) error {
+	cw.decided = true
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.pending) > 0 {
+		// Sniff now, as net/http would, before the body is compressed
+		header.Set("Content-Type", http.DetectContentType(cw.pending))
+	}
+	if large && cw.compressible() {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+		if cw.encoding == "gzip" {
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(cw.ResponseWriter)
+			cw.compressor = gz
+		} else {
+			zw := zlibWriters.Get().(*zlib.Writer)
+			zw.Reset(cw.ResponseWriter)
+			cw.compressor = zw
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	pending := cw.pending
+	cw.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	var err error
+	if cw.compressor != nil {
+		_, err = cw.compressor.Write(pending)
+	} else {
+		_, err = cw.ResponseWriter.Write(pending)
+	}
+	return err
+}
+
+// compressible reports whether the response may be compressed
+func (cw *compressWriter) compressible() bool {
+	header := cw.Header()
+	if header.Get("Content-Encoding") != "" || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	major, _, _ := strings.Cut(mediaType, "/")
+	if major == "image" || major == "audio" || major == "video" {
+		return false
+	}
+	for _, compressed := range compressedMediaTypes {
+		if mediaType == compressed {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush sends what was written so far, which means starting to compress when
+// the response allows it, however little has been written
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if flusher, ok := cw.compressor.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close sends anything still held back and finishes the compressed stream
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		cw.decide(len(cw.pending) >= cw.minBytes)
+	}
+	switch compressor := cw.compressor.(type) {
+	case *gzip.Writer:
+		compressor.Close()
+		gzipWriters.Put(compressor)
+	case *zlib.Writer:
+		compressor.Close()
+		zlibWriters.Put(compressor)
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"user/user/store"
+)
+
+// etagForBody computes a strong ETag over an encoded response body, so each
+// representation of a resource gets its own
+func etagForBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// userETag identifies a version of a user; it is the row's version, which every
+// write bumps
+func userETag(user store.User) string {
+	return `"` + strconv.FormatInt(user.Version, 10) + `"`
+}
+
+// versionFromETag parses an ETag produced by userETag
+func versionFromETag(etag string) (int64, bool) {
+	unquoted, ok := strings.CutPrefix(etag, `"`)
+	if !ok {
+		return 0, false
+	}
+	unquoted, ok = strings.CutSuffix(unquoted, `"`)
+	if !ok {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	return version, err == nil && version > 0
+}
+
+// requireVersion reads the version an update expects to replace, from If-Match or
+// else the body's version field. Updates without either get 428, so they can never
+// overwrite a change they didn't see. If-Match takes the first strong tag of a list,
+// skipping weak ones, and "*" matches whatever version current reports. Returns
+// false after writing the error response.
+func requireVersion(w http.ResponseWriter, r *http.Request, bodyVersion *int64, current func() (int64, bool)) (int64, bool) {
+	if header := strings.TrimSpace(r.Header.Get("If-Match")); header != "" {
+		for _, candidate := range strings.Split(header, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" {
+				return current()
+			}
+			if strings.HasPrefix(candidate, "W/") {
+				continue
+			}
+			if version, ok := versionFromETag(candidate); ok {
+				return version, true
+			}
+		}
+		writeProblem(w, r, http.StatusPreconditionFailed, msgIfMatchInvalid)
+		return 0, false
+	}
+	if bodyVersion != nil && *bodyVersion > 0 {
+		return *bodyVersion, true
+	}
+	writeProblem(w, r, http.StatusPreconditionRequired, msgVersionRequired)
+	return 0, false
+}
+
+// staleUpdate rejects an update made against an outdated version of the user:
+// 412 when the version came from If-Match, whose precondition failed, or 409 for
+// the body's version field
+func staleUpdate(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusConflict
+	if strings.TrimSpace(r.Header.Get("If-Match")) != "" {
+		status = http.StatusPreconditionFailed
+	}
+	writeProblem(w, r, status, msgStaleUpdate)
+}
+
+// ifNoneMatch reports whether the request's If-None-Match matches etag, meaning
+// the client's cached copy is current. Uses weak comparison, as RFC 9110 requires.
+func ifNoneMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch enforces If-Match preconditions for a write against the resource's
+// current ETag. With required set, writes without If-Match get 428. Returns false
+// after writing the error response when the write must not proceed.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, currentETag string, required bool) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if required {
+			writeProblem(w, r, http.StatusPreconditionRequired, msgIfMatchRequired)
+			return false
+		}
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		// If-Match uses strong comparison, so weak tags never match
+		if candidate == "*" || candidate == currentETag {
+			return true
+		}
+	}
+	writeProblem(w, r, http.StatusPreconditionFailed, msgResourceModified)
+	return false
+}
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// Consumer tuning
+const (
+	consumerErrorBackoff   = 5 * time.Second
+	settlementTimeout      = 10 * time.Second
+	deadLetterBadPayload   = "InvalidPayload"
+	deadLetterUnknownEvent = "UnknownEventType"
+	deadLetterMaxAttempts  = "MaxAttemptsExceeded"
+)
+
+// MessageHandler processes the messages the consumer receives. Returning nil
+// completes the message; a *deadLetterError dead-letters it at once, and any
+// other error abandons it for redelivery until it has been attempted
+// consumer.max_attempts times.
+type MessageHandler interface {
+	HandleMessage(ctx context.Context, msg *azservicebus.ReceivedMessage) error
+}
+
+// deadLetterError is a failure redelivering can't fix
+type deadLetterError struct {
+	Reason      string
+	Description string
+}
+
+func (e *deadLetterError) Error() string {
+	return e.Reason + ": " + e.Description
+}
+
+// runConsumer receives messages from the user queue with consumer.receivers
+// receivers and hands them to handler until ctx is cancelled
+func runConsumer(ctx context.Context, client *azservicebus.Client, cfg config.Config, handler MessageHandler) error {
+	var wg sync.WaitGroup
+	errs := make([]error, cfg.Consumer.Receivers)
+	for i := range cfg.Consumer.Receivers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = runReceiver(ctx, client, cfg, handler, i)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// runReceiver is one of runConsumer's receivers. Each asks for up to
+// consumer.prefetch messages at a time, settling them in turn.
+func runReceiver(ctx context.Context, client *azservicebus.Client, cfg config.Config, handler MessageHandler, index int) error {
+	receiver, err := client.NewReceiverForQueue(config.UserQueueName, nil)
+	if err != nil {
+		return err
+	}
+	defer receiver.Close(context.Background())
+
+	slog.Info("Service Bus consumer started", "queue", config.UserQueueName, "receiver", index)
+	for {
+		messages, err := receiver.ReceiveMessages(ctx, cfg.Consumer.Prefetch, nil)
+		if ctx.Err() != nil {
+			slog.Info("Service Bus consumer stopped", "receiver", index)
+			return nil
+		}
+		if err != nil {
+			slog.Error("Error receiving from Service Bus", "error", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(consumerErrorBackoff):
+			}
+			continue
+		}
+
+		for _, msg := range messages {
+			processMessage(receiver, handler, msg, cfg.Consumer.MaxAttempts)
+		}
+	}
+}
+
+// processMessage hands one message to handler and settles it by the outcome
+func processMessage(receiver *azservicebus.Receiver, handler MessageHandler, msg *azservicebus.ReceivedMessage, maxAttempts int) {
+	// Settle even when shutdown has begun, so in-flight messages aren't redelivered needlessly
+	ctx, cancel := context.WithTimeout(context.Background(), settlementTimeout)
+	defer cancel()
+
+	// Continue the publisher's trace
+	ctx, span := telemetry.Tracer.Start(telemetry.ExtractTraceContext(ctx, msg.ApplicationProperties), "servicebus process",
+		trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attribute.String("messaging.message.id", msg.MessageID)))
+	defer span.End()
+
+	err := handler.HandleMessage(ctx, msg)
+	var permanent *deadLetterError
+	switch {
+	case err == nil:
+		if err := receiver.CompleteMessage(ctx, msg, nil); err != nil {
+			slog.Error("Error completing message", "message_id", msg.MessageID, "error", err)
+		}
+	case errors.As(err, &permanent):
+		deadLetter(ctx, receiver, msg, permanent.Reason, permanent.Description)
+	default:
+		slog.Error("Error processing message", "message_id", msg.MessageID, "attempt", msg.DeliveryCount, "error", err)
+		if int(msg.DeliveryCount) >= maxAttempts {
+			deadLetter(ctx, receiver, msg, deadLetterMaxAttempts, err.Error())
+			return
+		}
+		if err := receiver.AbandonMessage(ctx, msg, nil); err != nil {
+			slog.Error("Error abandoning message", "message_id", msg.MessageID, "error", err)
+		}
+	}
+}
+
+// userEventHandler persists the user events published to the queue
+type userEventHandler struct {
+	store store.UserStore
+}
+
+func (h userEventHandler) HandleMessage(ctx context.Context, msg *azservicebus.ReceivedMessage) error {
+	eventType, _ := msg.ApplicationProperties["eventType"].(string)
+	if eventType == "" {
+		// Messages published before event types were added are creations
+		eventType = events.UserCreated
+	}
+	if eventType == events.UserUpdated || eventType == events.UserDeleted || eventType == events.UserLocked || eventType == events.UserErased {
+		// The publisher applied the change before sending it, and replaying a
+		// possibly out-of-order event could undo a newer one
+		return nil
+	}
+	if eventType != events.UserCreated {
+		return &deadLetterError{Reason: deadLetterUnknownEvent, Description: "unsupported event type " + eventType}
+	}
+
+	var user store.User
+	data, err := events.MessageData(msg)
+	if err == nil {
+		err = json.Unmarshal(data, &user)
+	}
+	if err != nil {
+		return &deadLetterError{Reason: deadLetterBadPayload, Description: err.Error()}
+	}
+	if user.Name == "" || user.Email == "" {
+		return &deadLetterError{Reason: deadLetterBadPayload, Description: "name and email are required"}
+	}
+	if err := h.store.UpsertUser(ctx, user); err != nil {
+		return fmt.Errorf("failed to persist user event: %w", err)
+	}
+	return nil
+}
+
+func deadLetter(ctx context.Context, receiver *azservicebus.Receiver, msg *azservicebus.ReceivedMessage, reason, description string) {
+	slog.Warn("Dead-lettering message", "message_id", msg.MessageID, "reason", reason, "description", description)
+	err := receiver.DeadLetterMessage(ctx, msg, &azservicebus.DeadLetterOptions{
+		Reason:           &reason,
+		ErrorDescription: &description,
+	})
+	if err != nil {
+		slog.Error("Error dead-lettering message", "message_id", msg.MessageID, "error", err)
+	}
+}
+
+// RunConsumerMode runs the binary as a worker for the worker command: it consumes
+// the user queue until SIGINT or SIGTERM, serving no API, and returns why the
+// consumer stopped early
+func RunConsumerMode(cfg config.Config, client *azservicebus.Client, userStore store.UserStore, shutdownTracing func(context.Context) error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	slog.Info("Running as a consumer", "receivers", cfg.Consumer.Receivers, "prefetch", cfg.Consumer.Prefetch)
+	consumerErr := runConsumer(ctx, client, cfg, userEventHandler{store: userStore})
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Seconds(cfg.Server.ShutdownTimeoutSeconds))
+	defer cancel()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
+	return consumerErr
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/cors"
+
+	"user/user/config"
+)
+
+// Response headers browsers may read, which clients of the API rely on
+var corsExposedHeaders = []string{"ETag", "Location", "X-Request-ID", "Retry-After", "Allow", "Accept-Patch", "Deprecation", "Link", "Idempotent-Replayed", "X-Total-Count"}
+
+// newCORSHandler applies config.CORS to browser requests. The tenant header is
+// always allowed, as tenants can't be picked without it.
+func newCORSHandler(cfg config.Config) *cors.Cors {
+	return cors.New(cors.Options{
+		AllowedOrigins:   cfg.CORS.AllowedOrigins,
+		AllowedMethods:   cfg.CORS.AllowedMethods,
+		AllowedHeaders:   append(append([]string{}, cfg.CORS.AllowedHeaders...), cfg.Tenancy.Header),
+		ExposedHeaders:   corsExposedHeaders,
+		AllowCredentials: *cfg.CORS.AllowCredentials,
+		MaxAge:           cfg.CORS.MaxAgeSeconds,
+	})
+}
+
+// liveCORS applies the cors settings in effect, rebuilt with each snapshot
+// App Configuration swaps in
+type liveCORS struct {
+	current atomic.Pointer[cors.Cors]
+}
+
+func newLiveCORS(cfg config.Config) *liveCORS {
+	c := &liveCORS{}
+	c.update(cfg)
+	return c
+}
+
+func (c *liveCORS) update(cfg config.Config) {
+	c.current.Store(newCORSHandler(cfg))
+}
+
+func (c *liveCORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.current.Load().Handler(next).ServeHTTP(w, r)
+	})
+}
+
+// corsProblems lists what is wrong with the cors settings
+func corsProblems(cfg config.Config) []string {
+	var problems []string
+	for _, origin := range cfg.CORS.AllowedOrigins {
+		if origin == "*" {
+			if *cfg.CORS.AllowCredentials {
+				problems = append(problems, `cors.allowed_origins may not be "*" while cors.allow_credentials is on; list the origins`)
+			}
+			continue
+		}
+		if err := checkCORSOrigin(origin); err != nil {
+			problems = append(problems, fmt.Sprintf("cors.allowed_origins has %q: %v", origin, err))
+		}
+	}
+	for _, method := range cfg.CORS.AllowedMethods {
+		if method != strings.ToUpper(method) || !isHTTPToken(method) {
+			problems = append(problems, fmt.Sprintf("cors.allowed_methods has %q, which isn't an upper-case HTTP method", method))
+		}
+	}
+	for _, header := range cfg.CORS.AllowedHeaders {
+		if !isHTTPToken(header) {
+			problems = append(problems, fmt.Sprintf("cors.allowed_headers has %q, which isn't a header name", header))
+		}
+	}
+	if cfg.CORS.MaxAgeSeconds < 0 {
+		problems = append(problems, fmt.Sprintf("cors.max_age_seconds may not be negative, got %d", cfg.CORS.MaxAgeSeconds))
+	}
+	return problems
+}
+
+// checkCORSOrigin makes sure an origin is a scheme and host, with a port at
+// most, and a wildcard only standing for subdomains, as in https://*.example.com
+func checkCORSOrigin(origin string) error {
+	if strings.Count(origin, "*") > 1 {
+		return fmt.Errorf("only one wildcard is supported")
+	}
+	u, err := url.Parse(strings.Replace(origin, "*", "wildcard", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("want http(s)://host[:port]")
+	}
+	if u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("an origin has no path, query or credentials")
+	}
+	if strings.Contains(origin, "*") && !strings.HasPrefix(u.Host, "wildcard.") {
+		return fmt.Errorf("a wildcard may only stand for subdomains, as in https://*.example.com")
+	}
+	return nil
+}
+
+// isHTTPToken reports whether s is a token as HTTP methods and header names are (RFC 9110)
+func isHTTPToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
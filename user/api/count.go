@@ -0,0 +1,21 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// API to Count Users (GET /users/count[?q=])
+func (h *handler) countUsers(w http.ResponseWriter, r *http.Request) {
+	filter, ok := userFilter(w, r)
+	if !ok {
+		return
+	}
+
+	count, err := h.users.CountUsers(r.Context(), tenantFromContext(r.Context()), filter)
+	if err != nil {
+		dbError(w, r, err, msgErrorCountingUsers)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int64{"count": count})
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"user/user/blob"
+	"user/user/resilience"
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// Response of GET /users/{id}/export?stage=true
+type stagedDataExport struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// API to Export a User's Data (GET /users/{id}/export[?stage=true])
+//
+// Streams a ZIP of everything held about the user: user.json with their record,
+// audit.json with its history, newest first, and their picture and thumbnail
+// when stored here. Nothing is buffered, so a failure partway through can only
+// cut the download short. With stage=true the ZIP is uploaded to blob storage
+// instead and the response links to it for a limited time; clearing out old
+// exports is left to the storage account's lifecycle policy.
+func (h *handler) exportUserData(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	user, err := h.users.GetUser(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+
+	filename := fmt.Sprintf("user-%d-%s.zip", user.ID, time.Now().UTC().Format("20060102-150405"))
+	if r.URL.Query().Get("stage") == "true" {
+		staged, err := h.stageDataExport(r.Context(), user, filename)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error staging data export", "user_id", user.ID, "error", err)
+			dependencyError(w, r, err, http.StatusInternalServerError, msgErrorStagingExport)
+			return
+		}
+		json.NewEncoder(w).Encode(staged)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	if err := h.writeDataExport(r.Context(), w, user); err != nil {
+		// Headers are long gone by now, and the unfinished ZIP won't open
+		slog.ErrorContext(r.Context(), "Data export ended early", "user_id", user.ID, "error", err)
+	}
+}
+
+// stageDataExport streams the user's ZIP into the data exports container and
+// returns a read-only SAS URL for it
+func (h *handler) stageDataExport(ctx context.Context, user store.User, filename string) (stagedDataExport, error) {
+	archive, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(h.writeDataExport(ctx, pw, user))
+	}()
+	ctx, span := telemetry.StartSpan(ctx, "blob upload", attribute.String("blob.container", blob.DataExportsContainer), attribute.String("blob.name", filename))
+	err := resilience.WithBulkhead(ctx, resilience.DependencyBlob, func() error {
+		return h.blobs.Upload(ctx, blob.DataExportsContainer, filename, archive, blob.Headers{
+			ContentType:        "application/zip",
+			ContentDisposition: `attachment; filename="` + filename + `"`,
+		}, nil)
+	})
+	// Unblocks the writer should the upload give up first
+	archive.CloseWithError(err)
+	telemetry.EndSpan(span, err)
+	if err != nil {
+		return stagedDataExport{}, fmt.Errorf("failed to upload data export: %w", err)
+	}
+
+	expiresAt := time.Now().Add(time.Duration(h.config.DataExport.LinkMinutes) * time.Minute).UTC()
+	signer, err := h.blobs.Signer(ctx, expiresAt)
+	if err != nil {
+		return stagedDataExport{}, fmt.Errorf("failed to get user delegation key: %w", err)
+	}
+	url, err := signer.Sign(blob.DataExportsContainer, filename)
+	if err != nil {
+		return stagedDataExport{}, fmt.Errorf("failed to sign data export link: %w", err)
+	}
+	return stagedDataExport{URL: url, ExpiresAt: expiresAt}, nil
+}
+
+// writeDataExport writes the ZIP of the user's data to out
+func (h *handler) writeDataExport(ctx context.Context, out io.Writer, user store.User) error {
+	archive := zip.NewWriter(out)
+
+	entry, err := archive.Create("user.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(h.links.user(user)); err != nil {
+		return err
+	}
+
+	entry, err = archive.Create("audit.json")
+	if err != nil {
+		return err
+	}
+	if err := writeAuditHistory(ctx, entry, user, h.audit); err != nil {
+		return err
+	}
+
+	// Pictures linked from elsewhere aren't held here, and user.json has their link
+	if name, ok := blob.NameFromLink(h.config.Azure.PicturesContainer, user.Link); ok {
+		if err := copyBlobToArchive(ctx, h.blobs, archive, h.config.Azure.PicturesContainer, name, "photo/"+name); err != nil {
+			return err
+		}
+	}
+	if name, ok := thumbnailNameFromLink(user.ThumbnailLink); ok {
+		if err := copyBlobToArchive(ctx, h.blobs, archive, blob.ThumbnailsContainer, name, "thumbnail/"+name); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// writeAuditHistory writes the user's audit events as a JSON array, a page at a time
+func writeAuditHistory(ctx context.Context, out io.Writer, user store.User, audit store.AuditStore) error {
+	filter := store.AuditFilter{TenantID: user.TenantID, UserID: user.ID}
+	if _, err := io.WriteString(out, "["); err != nil {
+		return err
+	}
+	var beforeID int64
+	count := 0
+	for {
+		events, err := audit.ListAuditEvents(ctx, filter, beforeID, maxPageSize)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			event.Changes = auditChanges(event.Before, event.After)
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				data = append([]byte(","), data...)
+			}
+			if _, err := out.Write(data); err != nil {
+				return err
+			}
+			count++
+		}
+		if len(events) < maxPageSize {
+			break
+		}
+		beforeID = events[len(events)-1].ID
+	}
+	_, err := io.WriteString(out, "]\n")
+	return err
+}
+
+// copyBlobToArchive adds a blob to the archive as entry, uncompressed since
+// images already are. A blob that is missing is left out.
+func copyBlobToArchive(ctx context.Context, blobs blob.Storage, archive *zip.Writer, containerName, name, entry string) error {
+	body, err := blob.Download(ctx, blobs, containerName, name)
+	if errors.Is(err, blob.ErrNotFound) {
+		slog.WarnContext(ctx, "Blob missing from data export", "container", containerName, "blob", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: entry, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, body)
+	return err
+}
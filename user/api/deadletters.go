@@ -0,0 +1,337 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/gorilla/mux"
+
+	"user/user/config"
+	"user/user/resilience"
+)
+
+// ErrNoServiceBus is returned for work only a Service Bus namespace can do,
+// such as reading dead letters, with azure.service_bus_driver memory
+var ErrNoServiceBus = errors.New("Service Bus is off: azure.service_bus_driver is memory")
+
+// Page size limits for GET /admin/deadletters
+const (
+	defaultDeadLetterPeek = 50
+	maxDeadLetterPeek     = 250
+)
+
+// Dead letter settlement tuning. Requeuing or purging one message receives
+// messages until it turns up, holding the others' locks meanwhile so none is
+// seen twice, so a scan stops at maxDeadLetterScan messages.
+const (
+	deadLetterReceiveBatch = 50
+	deadLetterReceiveWait  = 5 * time.Second // An empty receive this long means the subqueue is drained
+	maxDeadLetterScan      = 1000
+)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// A dead-lettered message as reported to admins
+type DeadLetter struct {
+	SequenceNumber int64           `json:"sequenceNumber"` // Identifies the message to view, requeue or purge
+	MessageID      string          `json:"messageId"`
+	EnqueuedAt     *time.Time      `json:"enqueuedAt,omitempty"`
+	DeliveryCount  uint32          `json:"deliveryCount"`
+	Reason         string          `json:"reason,omitempty"`
+	Description    string          `json:"description,omitempty"`
+	EventType      string          `json:"eventType,omitempty"`
+	Body           json.RawMessage `json:"body"`
+}
+
+// Outcome of requeuing or purging dead letters
+type DeadLetterSettlement struct {
+	Requeued int `json:"requeued,omitempty"`
+	Purged   int `json:"purged,omitempty"`
+}
+
+// newDeadLetterReceiver opens the user queue's dead-letter subqueue
+func (h *handler) newDeadLetterReceiver() (*azservicebus.Receiver, error) {
+	if h.serviceBus == nil {
+		return nil, ErrNoServiceBus
+	}
+	return h.serviceBus.NewReceiverForQueue(config.UserQueueName, &azservicebus.ReceiverOptions{
+		SubQueue: azservicebus.SubQueueDeadLetter,
+	})
+}
+
+// peekDeadLetters returns up to max dead letters from sequence number from on,
+// leaving them in place
+func (h *handler) peekDeadLetters(ctx context.Context, from int64, max int) ([]DeadLetter, error) {
+	receiver, err := h.newDeadLetterReceiver()
+	if err != nil {
+		return nil, err
+	}
+	defer receiver.Close(context.WithoutCancel(ctx))
+
+	options := &azservicebus.PeekMessagesOptions{}
+	if from > 0 {
+		options.FromSequenceNumber = &from
+	}
+	messages, err := receiver.PeekMessages(ctx, max, options)
+	if err != nil {
+		return nil, err
+	}
+	deadLetters := make([]DeadLetter, 0, len(messages))
+	for _, msg := range messages {
+		deadLetters = append(deadLetters, toDeadLetter(msg))
+	}
+	return deadLetters, nil
+}
+
+// getDeadLetter returns the dead letter with this sequence number, or
+// ErrDeadLetterNotFound
+func (h *handler) getDeadLetter(ctx context.Context, sequence int64) (DeadLetter, error) {
+	deadLetters, err := h.peekDeadLetters(ctx, sequence, 1)
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	// Peeking starts at the next message when this one is gone
+	if len(deadLetters) == 0 || deadLetters[0].SequenceNumber != sequence {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return deadLetters[0], nil
+}
+
+// requeueDeadLetters sends up to max dead letters back to the user queue, or
+// only the one with sequence number sequence when it isn't 0. The copy keeps
+// the original's body and properties, so the consumer handles it as it was
+// published.
+func (h *handler) requeueDeadLetters(ctx context.Context, sequence int64, max int) (int, error) {
+	return h.settleDeadLetters(ctx, sequence, max, func(ctx context.Context, receiver *azservicebus.Receiver, msg *azservicebus.ReceivedMessage) error {
+		requeued := &azservicebus.Message{
+			Body:                  msg.Body,
+			ApplicationProperties: maps.Clone(msg.ApplicationProperties),
+			ContentType:           msg.ContentType,
+			CorrelationID:         msg.CorrelationID,
+			MessageID:             &msg.MessageID,
+			Subject:               msg.Subject,
+		}
+		err := resilience.WithBulkhead(ctx, resilience.DependencyServiceBus, func() error {
+			return resilience.WithRetry(ctx, resilience.DependencyServiceBus, func() error {
+				return h.events.Send(ctx, config.UserQueueName, requeued)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		// Sent already, so a failure here leaves a duplicate for the consumer rather than losing the message
+		return receiver.CompleteMessage(ctx, msg, nil)
+	})
+}
+
+// purgeDeadLetters deletes up to max dead letters for good, or only the one
+// with sequence number sequence when it isn't 0
+func (h *handler) purgeDeadLetters(ctx context.Context, sequence int64, max int) (int, error) {
+	return h.settleDeadLetters(ctx, sequence, max, func(ctx context.Context, receiver *azservicebus.Receiver, msg *azservicebus.ReceivedMessage) error {
+		return receiver.CompleteMessage(ctx, msg, nil)
+	})
+}
+
+// settleDeadLetters receives dead letters and settles up to max of them, or
+// only the one with sequence number sequence when it isn't 0, returning how
+// many were. Messages passed over are abandoned back in place once done.
+func (h *handler) settleDeadLetters(ctx context.Context, sequence int64, max int, settle func(context.Context, *azservicebus.Receiver, *azservicebus.ReceivedMessage) error) (int, error) {
+	receiver, err := h.newDeadLetterReceiver()
+	if err != nil {
+		return 0, err
+	}
+	cleanupCtx := context.WithoutCancel(ctx)
+	defer receiver.Close(cleanupCtx)
+
+	var skipped []*azservicebus.ReceivedMessage
+	defer func() {
+		for _, msg := range skipped {
+			if err := receiver.AbandonMessage(cleanupCtx, msg, nil); err != nil {
+				slog.ErrorContext(ctx, "Error abandoning dead letter", "sequence_number", deref(msg.SequenceNumber), "error", err)
+			}
+		}
+	}()
+
+	settled, scanned := 0, 0
+	for settled < max && scanned < maxDeadLetterScan {
+		receiveCtx, cancel := context.WithTimeout(ctx, deadLetterReceiveWait)
+		messages, err := receiver.ReceiveMessages(receiveCtx, min(deadLetterReceiveBatch, maxDeadLetterScan-scanned), nil)
+		cancel()
+		drained := err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded)
+		if err != nil && !drained {
+			skipped = append(skipped, messages...)
+			return settled, err
+		}
+		for i, msg := range messages {
+			scanned++
+			if settled == max || (sequence != 0 && deref(msg.SequenceNumber) != sequence) {
+				skipped = append(skipped, msg)
+				continue
+			}
+			if err := settle(ctx, receiver, msg); err != nil {
+				skipped = append(skipped, messages[i:]...)
+				return settled, err
+			}
+			settled++
+		}
+		if drained || len(messages) == 0 {
+			break
+		}
+	}
+	if sequence != 0 && settled == 0 {
+		return 0, ErrDeadLetterNotFound
+	}
+	return settled, nil
+}
+
+// parseDeadLetterMax reads the max query parameter, capped at limit. On
+// failure it writes the error response.
+func parseDeadLetterMax(w http.ResponseWriter, r *http.Request, fallback, limit int) (int, bool) {
+	param := r.URL.Query().Get("max")
+	if param == "" {
+		return fallback, true
+	}
+	n, err := strconv.Atoi(param)
+	if err != nil || n <= 0 {
+		writeProblem(w, r, http.StatusBadRequest, msgPositiveInteger.with("max"))
+		return 0, false
+	}
+	return min(n, limit), true
+}
+
+// parseSequenceNumber reads the {sequence} route variable
+func parseSequenceNumber(r *http.Request) (int64, error) {
+	sequence, err := strconv.ParseInt(mux.Vars(r)["sequence"], 10, 64)
+	if err != nil || sequence <= 0 {
+		return 0, msgInvalidSequenceNumber
+	}
+	return sequence, nil
+}
+
+// API to Inspect Dead-Lettered Messages (GET /admin/deadletters?max=&from=)
+func (h *handler) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	max, ok := parseDeadLetterMax(w, r, defaultDeadLetterPeek, maxDeadLetterPeek)
+	if !ok {
+		return
+	}
+	var from int64
+	if param := r.URL.Query().Get("from"); param != "" {
+		n, err := strconv.ParseInt(param, 10, 64)
+		if err != nil || n <= 0 {
+			writeProblem(w, r, http.StatusBadRequest, msgFromInvalid)
+			return
+		}
+		from = n
+	}
+
+	// Peeking leaves the messages in place for later replay or purging
+	deadLetters, err := h.peekDeadLetters(r.Context(), from, max)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error peeking dead letters", "error", err)
+		dependencyError(w, r, err, http.StatusInternalServerError, msgErrorReadingDeadLetters)
+		return
+	}
+	json.NewEncoder(w).Encode(deadLetters)
+}
+
+// API to View a Dead-Lettered Message (GET /admin/deadletters/{sequence})
+func (h *handler) getDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	sequence, err := parseSequenceNumber(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	deadLetter, err := h.getDeadLetter(r.Context(), sequence)
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgDeadLetterNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error peeking dead letter", "sequence_number", sequence, "error", err)
+		dependencyError(w, r, err, http.StatusInternalServerError, msgErrorReadingDeadLetters)
+		return
+	}
+	json.NewEncoder(w).Encode(deadLetter)
+}
+
+// API to Requeue Dead-Lettered Messages (POST /admin/deadletters/requeue?max=
+// and POST /admin/deadletters/{sequence}/requeue)
+func (h *handler) requeueDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	settleDeadLettersHandler(w, r, "requeue", h.requeueDeadLetters)
+}
+
+// API to Purge Dead-Lettered Messages (DELETE /admin/deadletters?max= and
+// DELETE /admin/deadletters/{sequence})
+func (h *handler) purgeDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	settleDeadLettersHandler(w, r, "purge", h.purgeDeadLetters)
+}
+
+// settleDeadLettersHandler serves the requeue and purge endpoints, for the
+// message in the route or else up to max of them
+func settleDeadLettersHandler(w http.ResponseWriter, r *http.Request, action string, settle func(context.Context, int64, int) (int, error)) {
+	var sequence int64
+	max := 1
+	if _, ok := mux.Vars(r)["sequence"]; ok {
+		var err error
+		if sequence, err = parseSequenceNumber(r); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+			return
+		}
+	} else {
+		var ok bool
+		if max, ok = parseDeadLetterMax(w, r, maxDeadLetterScan, maxDeadLetterScan); !ok {
+			return
+		}
+	}
+
+	settled, err := settle(r.Context(), sequence, max)
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgDeadLetterNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error settling dead letters", "action", action, "sequence_number", sequence, "settled", settled, "error", err)
+		dependencyError(w, r, err, http.StatusInternalServerError, msgErrorSettlingDeadLetters)
+		return
+	}
+	slog.InfoContext(r.Context(), "Settled dead letters", "action", action, "sequence_number", sequence, "count", settled)
+
+	var result DeadLetterSettlement
+	if action == "requeue" {
+		result.Requeued = settled
+	} else {
+		result.Purged = settled
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func toDeadLetter(msg *azservicebus.ReceivedMessage) DeadLetter {
+	dl := DeadLetter{
+		SequenceNumber: deref(msg.SequenceNumber),
+		MessageID:      msg.MessageID,
+		EnqueuedAt:     msg.EnqueuedTime,
+		DeliveryCount:  msg.DeliveryCount,
+	}
+	if msg.DeadLetterReason != nil {
+		dl.Reason = *msg.DeadLetterReason
+	}
+	if msg.DeadLetterErrorDescription != nil {
+		dl.Description = *msg.DeadLetterErrorDescription
+	}
+	dl.EventType, _ = msg.ApplicationProperties["eventType"].(string)
+
+	// Bodies that aren't JSON (the usual cause of dead-lettering) are returned as strings
+	if json.Valid(msg.Body) {
+		dl.Body = msg.Body
+	} else {
+		dl.Body, _ = json.Marshal(string(msg.Body))
+	}
+	return dl
+}
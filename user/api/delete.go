@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+)
+
+// includeDeleted reads the admin-only include_deleted query parameter.
+// On failure it writes the error response and returns ok=false.
+func includeDeleted(w http.ResponseWriter, r *http.Request) (include bool, ok bool) {
+	if r.URL.Query().Get("include_deleted") != "true" {
+		return false, true
+	}
+	if !principalFromContext(r.Context()).Admin {
+		writeProblem(w, r, http.StatusForbidden, msgOnlyAdminsListDeleted)
+		return false, false
+	}
+	return true, true
+}
+
+// API to Delete a User (DELETE /users/{id})
+func (h *handler) deleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+
+	// Fetched for the If-Match check, the event payload and the blobs to remove
+	tenant := tenantFromContext(r.Context())
+	user, err := h.users.GetUser(r.Context(), tenant, id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+	if (h.config.Concurrency.Required || r.Header.Get("If-Match") != "") && !checkIfMatch(w, r, userETag(user), h.config.Concurrency.Required) {
+		return
+	}
+	if !requireRecentTwoFactor(w, r, h.sessions, id) {
+		return
+	}
+
+	hard := h.config.Deletion.Mode == config.DeletionModeHard
+	err = h.users.DeleteUser(store.WithOutboxEvent(r.Context(), events.UserDeleted), tenant, id, hard)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorDeletingUser)
+		return
+	}
+
+	// A soft-deleted user may be restored, so its picture is kept until then
+	if hard {
+		deleteReplacedPhoto(r.Context(), h.blobs, h.pictures, h.config.Azure.PicturesContainer, user)
+	}
+
+	h.webhooks.notify(r.Context(), events.UserDeleted, user)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// API to Restore a Soft-Deleted User (POST /users/{id}/restore)
+func (h *handler) restoreUser(w http.ResponseWriter, r *http.Request) {
+	if !principalFromContext(r.Context()).Admin {
+		writeProblem(w, r, http.StatusForbidden, msgOnlyAdminsRestore)
+		return
+	}
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+
+	user, err := h.users.RestoreUser(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgDeletedUserNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrDuplicateEmail) {
+		writeEmailTaken(w, r, msgEmailTakenSince)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorRestoringUser)
+		return
+	}
+	json.NewEncoder(w).Encode(h.links.user(user))
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+// APIs other than REST (gRPC, GraphQL) are served by handing each operation to
+// the /v1 route it mirrors, so every API shares the same handlers, middleware
+// and storage: auth, tenancy, rate limits, validation, blob uploads and events
+// all behave alike.
+
+// serveInternally serves r, a request built on behalf of another API, through
+// router and returns the buffered response
+func serveInternally(router http.Handler, r *http.Request) *bufferedResponse {
+	resp := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	router.ServeHTTP(resp, r)
+	return resp
+}
+
+// bufferedResponse collects the response to a request served internally
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if !b.wrote {
+		b.status = status
+		b.wrote = true
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// The calling API's own deadline applies rather than the connection's, so
+// extending one for uploads is a no-op
+func (b *bufferedResponse) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (b *bufferedResponse) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// failed reports whether the response is an error, described by problem()
+func (b *bufferedResponse) failed() bool {
+	return b.status >= 400
+}
+
+// problem decodes an error response, falling back to the status text for
+// bodies that aren't problems
+func (b *bufferedResponse) problem() Problem {
+	var problem Problem
+	if json.Unmarshal(b.body.Bytes(), &problem) != nil || problem.Detail == "" {
+		problem.Detail = http.StatusText(b.status)
+	}
+	problem.Status = b.status
+	return problem
+}
+
+// newCreateUserForm encodes the multipart body of POST /users. The picture is
+// either photoURL or, when photo is not nil, a file named photoFilename.
+func newCreateUserForm(name, email, photoURL, photoFilename string, photo io.Reader) (body *bytes.Buffer, contentType string, err error) {
+	body = &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("name", name)
+	form.WriteField("email", email)
+	if photoURL != "" {
+		form.WriteField("photo_url", photoURL)
+	}
+	if photo != nil {
+		part, err := form.CreateFormFile("photo", photoFilename)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := io.Copy(part, photo); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return nil, "", err
+	}
+	return body, form.FormDataContentType(), nil
+}
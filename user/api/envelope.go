@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"user/user/store"
+)
+
+// Profile of application/json asking for the enveloped format, as
+// Accept: application/json; profile="urn:usersvc:envelope". ?envelope=true asks
+// the same.
+const envelopeProfile = "urn:usersvc:envelope"
+
+// Envelope is the enveloped format of users and their listings: the usual body
+// as data, with what describes it in meta and where to go from it in links
+type Envelope struct {
+	Data  any                     `json:"data"`
+	Meta  EnvelopeMeta            `json:"meta"`
+	Links map[string]EnvelopeLink `json:"links"`
+}
+
+// EnvelopeMeta describes a listing
+type EnvelopeMeta struct {
+	Total *int64 `json:"total,omitempty"` // Users matching the filters across all pages
+	Limit int    `json:"limit,omitempty"` // Page size, for paginated listings
+}
+
+// EnvelopeLink is a request a client can make from a response
+type EnvelopeLink struct {
+	Href   string `json:"href"`
+	Method string `json:"method"`
+}
+
+// A user of an enveloped listing, with its own links
+type envelopedUser struct {
+	store.User
+	Links map[string]EnvelopeLink `json:"links"`
+}
+
+// wantsEnvelope reports whether the request asks for the enveloped format
+func wantsEnvelope(r *http.Request) bool {
+	if r.URL.Query().Get("envelope") == "true" {
+		return true
+	}
+	for _, part := range r.Header.Values("Accept") {
+		for _, acceptRange := range strings.Split(part, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(acceptRange))
+			if err != nil || mediaType != "application/json" || params["profile"] != envelopeProfile {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// userLinks are the links of the user with id: to it, its picture, and its
+// update and deletion
+func userLinks(id int64) map[string]EnvelopeLink {
+	self := versionedPath(apiV1, "/users/"+strconv.FormatInt(id, 10))
+	return map[string]EnvelopeLink{
+		"self":   {Href: self, Method: http.MethodGet},
+		"photo":  {Href: self + "/photo", Method: http.MethodGet},
+		"update": {Href: self, Method: http.MethodPatch},
+		"delete": {Href: self, Method: http.MethodDelete},
+	}
+}
+
+// envelopeEncoder renders users and their listings as an Envelope. Unlike the
+// encoders of responseEncoders it needs the request, to link the listing's
+// pages, so negotiateEncoder picks it itself when the request asks for it.
+type envelopeEncoder struct {
+	r *http.Request
+}
+
+func (envelopeEncoder) mediaType() string {
+	return `application/json; profile="` + envelopeProfile + `"`
+}
+
+func (envelopeEncoder) supports(v any) bool {
+	switch v.(type) {
+	case store.User, []store.User, UserPage, []sparseUser, sparseUserPage:
+		return true
+	}
+	return false
+}
+
+func (e envelopeEncoder) encode(v any) ([]byte, error) {
+	var envelope Envelope
+	switch v := v.(type) {
+	case store.User:
+		envelope = Envelope{Data: v, Links: userLinks(v.ID)}
+	case []store.User:
+		envelope = e.listing(envelopedUsers(v), int64(len(v)), false, "", "")
+	case UserPage:
+		envelope = e.listing(envelopedUsers(v.Users), v.Total, true, v.NextCursor, v.PrevCursor)
+	case []sparseUser:
+		users, err := envelopedSparseUsers(v)
+		if err != nil {
+			return nil, err
+		}
+		envelope = e.listing(users, int64(len(v)), false, "", "")
+	case sparseUserPage:
+		users, err := envelopedSparseUsers(v.Users)
+		if err != nil {
+			return nil, err
+		}
+		envelope = e.listing(users, v.Total, true, v.NextCursor, v.PrevCursor)
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return append(body, '\n'), nil
+}
+
+// listing envelopes a list of users, linking the pages before and after it
+// when there are
+func (e envelopeEncoder) listing(data any, total int64, paged bool, next, prev string) Envelope {
+	envelope := Envelope{Data: data, Meta: EnvelopeMeta{Total: &total}, Links: map[string]EnvelopeLink{
+		"self": {Href: e.pageURL(e.r.URL.Query().Get("cursor")), Method: http.MethodGet},
+	}}
+	if paged {
+		envelope.Meta.Limit, _ = parseLimit(e.r.URL.Query().Get("limit"))
+	}
+	if next != "" {
+		envelope.Links["next"] = EnvelopeLink{Href: e.pageURL(next), Method: http.MethodGet}
+	}
+	if prev != "" {
+		envelope.Links["prev"] = EnvelopeLink{Href: e.pageURL(prev), Method: http.MethodGet}
+	}
+	return envelope
+}
+
+// pageURL is the request's URL with its cursor replaced by cursor, or without
+// one when it is empty
+func (e envelopeEncoder) pageURL(cursor string) string {
+	query := e.r.URL.Query()
+	if cursor == "" {
+		query.Del("cursor")
+	} else {
+		query.Set("cursor", cursor)
+	}
+	if len(query) == 0 {
+		return e.r.URL.Path
+	}
+	return e.r.URL.Path + "?" + query.Encode()
+}
+
+func envelopedUsers(users []store.User) []envelopedUser {
+	enveloped := make([]envelopedUser, len(users))
+	for i, user := range users {
+		enveloped[i] = envelopedUser{User: user, Links: userLinks(user.ID)}
+	}
+	return enveloped
+}
+
+// envelopedSparseUsers adds each sparse user's links, which only those whose
+// fields include their id can have
+func envelopedSparseUsers(users []sparseUser) ([]sparseUser, error) {
+	enveloped := make([]sparseUser, len(users))
+	for i, user := range users {
+		enveloped[i] = user
+		var id int64
+		if user["id"] == nil || json.Unmarshal(user["id"], &id) != nil {
+			continue
+		}
+		links, err := json.Marshal(userLinks(id))
+		if err != nil {
+			return nil, err
+		}
+		enveloped[i] = sparseUser{"links": links}
+		for field, value := range user {
+			enveloped[i][field] = value
+		}
+	}
+	return enveloped, nil
+}
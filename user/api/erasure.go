@@ -0,0 +1,42 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"user/user/events"
+	"user/user/store"
+)
+
+// API to Erase a User's Personal Data (DELETE /users/{id}/personal-data)
+//
+// Irreversibly anonymizes the user, live or soft-deleted, deletes their
+// pictures and leaves a tombstone row that can't be restored, then publishes
+// user.erased so consumers of the queue purge their copies too. Responses
+// replayed for Idempotency-Keys may still hold the data until they expire.
+func (h *handler) erasePersonalData(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	if !requireRecentTwoFactor(w, r, h.sessions, id) {
+		return
+	}
+
+	before, _, err := h.users.ErasePersonalData(store.WithOutboxEvent(r.Context(), events.UserErased), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFoundOrErased)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorErasingUser)
+		return
+	}
+
+	// The data is already gone from the database, so failures from here on are
+	// logged; cleanup-blobs finds any picture left behind
+	deleteReplacedPhoto(r.Context(), h.blobs, h.pictures, h.config.Azure.PicturesContainer, before)
+
+	w.WriteHeader(http.StatusNoContent)
+}
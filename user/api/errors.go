@@ -0,0 +1,155 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"user/user/resilience"
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// dbError writes the response for a failed database call: 504 when the query ran
+// past its deadline, 503 while the database's breaker is open, otherwise a 500
+// carrying msg.
+func dbError(w http.ResponseWriter, r *http.Request, err error, msg Message) {
+	if errors.Is(err, resilience.ErrCircuitOpen) {
+		slog.WarnContext(r.Context(), "Database unavailable", "query", msg.String(), "error", err)
+		writeProblem(w, r, http.StatusServiceUnavailable, msgDatabaseUnavailable)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.WarnContext(r.Context(), "Slow query timed out", "query", msg.String(), "timeout", store.QueryTimeout, "error", err)
+		writeProblem(w, r, http.StatusGatewayTimeout, msgDatabaseTimedOut)
+		return
+	}
+	slog.ErrorContext(r.Context(), msg.String(), "error", err)
+	writeProblem(w, r, http.StatusInternalServerError, msg)
+}
+
+// Media type of every error response (RFC 7807)
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object, the body of every error response
+type Problem struct {
+	Type      string       `json:"type"`  // Always about:blank: the status says what kind of problem it is
+	Title     string       `json:"title"` // The status text, in the language of the detail
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`    // What went wrong with this request
+	Code      string       `json:"code,omitempty"`      // Machine-readable cause, for the problems clients act on, e.g. email_taken
+	TraceID   string       `json:"traceId,omitempty"`   // Trace to quote when reporting the error, if sampled
+	RequestID string       `json:"requestId,omitempty"` // X-Request-ID, found in the logs
+	Fields    []FieldError `json:"fields,omitempty"`    // Invalid fields, for 422s from validation
+}
+
+// Codes of the problems clients act on
+const problemCodeEmailTaken = "email_taken" // 409: another live user of the tenant has the email
+
+// writeEmailTaken responds 409 to a change that would give two live users of
+// the tenant the same email, which ux_users_tenant_email refuses
+func writeEmailTaken(w http.ResponseWriter, r *http.Request, detail Message) {
+	writeProblemDetails(w, r, http.StatusConflict, detail, problemCodeEmailTaken, nil)
+}
+
+// writeProblem responds with status and a problem whose detail is the message
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail Message) {
+	writeProblemDetails(w, r, status, detail, "", nil)
+}
+
+// writeProblemDetails responds with a problem of status, filling in its type,
+// title and the request's correlation IDs. The title, detail and field
+// messages are translated into the language of the request's Accept-Language;
+// the code and field names aren't.
+func writeProblemDetails(w http.ResponseWriter, r *http.Request, status int, detail Message, code string, fields validationErrors) {
+	lang := acceptedLanguage(r)
+	problem := Problem{
+		Type:   "about:blank",
+		Title:  statusTitle(status).in(lang),
+		Status: status,
+		Detail: detail.in(lang),
+		Code:   code,
+	}
+	for _, field := range fields {
+		problem.Fields = append(problem.Fields, FieldError{Field: field.field, Message: field.message.in(lang)})
+	}
+	problem.TraceID = telemetry.TraceIDFromContext(r.Context())
+	problem.RequestID = requestIDFromContext(r.Context())
+
+	// As http.Error does, drop headers describing a body that's being replaced
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// rejectOversizedBody responds 413 if err came from reading past the request body
+// limit, reporting whether it did
+func rejectOversizedBody(w http.ResponseWriter, r *http.Request, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	writeProblem(w, r, http.StatusRequestEntityTooLarge, msgBodyTooLarge)
+	return true
+}
+
+// Seconds clients are asked to wait after a 503 for a saturated or unavailable dependency
+const unavailableRetryAfter = "5"
+
+// dependencyError writes the response for a failed call to blob storage, Service
+// Bus or another dependency: 504 when the request ran past its deadline, 503
+// with a Retry-After while the dependency is saturated or behind an open circuit
+// breaker, otherwise status carrying msg. The caller logs the error.
+func dependencyError(w http.ResponseWriter, r *http.Request, err error, status int, msg Message) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(r.Context().Err(), context.DeadlineExceeded):
+		writeProblem(w, r, http.StatusGatewayTimeout, msgDependencyTimedOut.with(msg))
+	case errors.Is(err, resilience.ErrSaturated):
+		w.Header().Set("Retry-After", unavailableRetryAfter)
+		writeProblem(w, r, http.StatusServiceUnavailable, msgDependencySaturated.with(msg))
+	case errors.Is(err, resilience.ErrCircuitOpen):
+		w.Header().Set("Retry-After", unavailableRetryAfter)
+		writeProblem(w, r, http.StatusServiceUnavailable, msgDependencyUnavailable.with(msg))
+	case errors.Is(err, ErrNoServiceBus):
+		writeProblem(w, r, http.StatusNotImplemented, msgDependencyNoServiceBus.with(msg))
+	default:
+		writeProblem(w, r, status, msg)
+	}
+}
+
+// Methods probed when working out a path's Allow header
+var routableMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// unmatchedRoute answers requests no route serves: 405 with an Allow header when
+// the path exists under other methods, otherwise a JSON 404. It backs both the
+// router's NotFoundHandler and MethodNotAllowedHandler, because mux reports some
+// method mismatches within subrouters as not found.
+func unmatchedRoute(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, method := range routableMethods {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			var match mux.RouteMatch
+			if router.Match(probe, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
+		}
+		if len(allowed) == 0 {
+			writeProblem(w, r, http.StatusNotFound, msgNoRoute.with(r.URL.Path))
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeProblem(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed.with(r.Method))
+	}
+}
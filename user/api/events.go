@@ -0,0 +1,257 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+)
+
+// Events a client may fall behind by before it is dropped, to resume with
+// Last-Event-ID once it reconnects
+const eventSubscriberBuffer = 64
+
+// streamEvent is a user event as GET /events sends it
+type streamEvent struct {
+	ID       int64
+	Type     string
+	TenantID string
+	Data     []byte // The user's JSON
+}
+
+// eventStream fans user events out to the clients of GET /events, keeping the
+// latest ones for clients that reconnect. A nil eventStream drops events.
+type eventStream struct {
+	mu          sync.Mutex
+	nextID      int64
+	recent      []streamEvent // Oldest first
+	size        int
+	subscribers map[chan streamEvent]struct{}
+	closed      bool
+}
+
+func newEventStream(cfg config.Config) *eventStream {
+	return &eventStream{
+		// Starting from the clock, IDs a client saw before a restart are older than any after it
+		nextID:      time.Now().UnixMicro(),
+		size:        cfg.EventStream.BufferSize,
+		subscribers: map[chan streamEvent]struct{}{},
+	}
+}
+
+// publish sends an event to every client. Clients whose buffer is full are
+// dropped rather than waited for.
+func (s *eventStream) publish(eventType string, user store.User) {
+	if s == nil {
+		return
+	}
+	data, err := json.Marshal(user)
+	if err != nil {
+		slog.Error("Error encoding stream event", "user_id", user.ID, "error", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	event := streamEvent{ID: s.nextID, Type: eventType, TenantID: user.TenantID, Data: data}
+	s.recent = append(s.recent, event)
+	if len(s.recent) > s.size {
+		s.recent = slices.Delete(s.recent, 0, len(s.recent)-s.size)
+	}
+	for events := range s.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(s.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// subscribe registers a client, returning the kept events after lastID and the
+// channel of the ones to come. complete is false when events after lastID were
+// already let go of. A zero lastID asks for new events only.
+func (s *eventStream) subscribe(lastID int64) (missed []streamEvent, complete bool, events chan streamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	complete = true
+	if lastID != 0 {
+		oldest := s.nextID + 1
+		if len(s.recent) > 0 {
+			oldest = s.recent[0].ID
+		}
+		complete = lastID >= oldest-1
+		for _, event := range s.recent {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+	events = make(chan streamEvent, eventSubscriberBuffer)
+	if s.closed {
+		close(events)
+		return missed, complete, events
+	}
+	s.subscribers[events] = struct{}{}
+	return missed, complete, events
+}
+
+// unsubscribe removes a client, unless publish already dropped it
+func (s *eventStream) unsubscribe(events chan streamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscribers[events]; ok {
+		delete(s.subscribers, events)
+		close(events)
+	}
+}
+
+// close ends every client's stream, as the server won't shut down while they last
+func (s *eventStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for events := range s.subscribers {
+		delete(s.subscribers, events)
+		close(events)
+	}
+}
+
+// runEventFeed publishes the user events read from the configured Service Bus
+// subscription to the stream until ctx is cancelled. Events are only streamed,
+// so they're deleted as they are received.
+func runEventFeed(ctx context.Context, client *azservicebus.Client, cfg config.Config, stream *eventStream) error {
+	receiver, err := client.NewReceiverForSubscription(cfg.EventStream.Topic, cfg.EventStream.Subscription,
+		&azservicebus.ReceiverOptions{ReceiveMode: azservicebus.ReceiveModeReceiveAndDelete})
+	if err != nil {
+		return err
+	}
+	defer receiver.Close(context.Background())
+
+	slog.Info("Event stream feed started", "topic", cfg.EventStream.Topic, "subscription", cfg.EventStream.Subscription)
+	for {
+		messages, err := receiver.ReceiveMessages(ctx, config.ConsumerBatchSize, nil)
+		if ctx.Err() != nil {
+			slog.Info("Event stream feed stopped")
+			return nil
+		}
+		if err != nil {
+			slog.Error("Error receiving stream events from Service Bus", "error", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(consumerErrorBackoff):
+			}
+			continue
+		}
+
+		for _, msg := range messages {
+			eventType, _ := msg.ApplicationProperties["eventType"].(string)
+			eventType = cmp.Or(eventType, events.UserCreated)
+			if !slices.Contains(webhookEventTypes, eventType) {
+				continue
+			}
+			var user store.User
+			data, err := events.MessageData(msg)
+			if err == nil {
+				err = json.Unmarshal(data, &user)
+			}
+			if err != nil {
+				slog.Error("Invalid stream event payload", "message_id", msg.MessageID, "error", err)
+				continue
+			}
+			stream.publish(eventType, user)
+		}
+	}
+}
+
+// API to Stream User Events (GET /events)
+//
+// A text/event-stream of the tenant's user.created, user.updated and
+// user.deleted events, each carrying the user's JSON. Clients reconnecting with
+// Last-Event-ID get the events they missed, or a stream.reset event when those
+// are no longer kept, telling them to fetch the users afresh.
+func (h *handler) streamEvents(w http.ResponseWriter, r *http.Request) {
+	heartbeat := config.Seconds(h.config.EventStream.HeartbeatSeconds)
+	var lastID int64
+	if param := cmp.Or(r.Header.Get("Last-Event-ID"), r.URL.Query().Get("lastEventId")); param != "" {
+		id, err := strconv.ParseInt(param, 10, 64)
+		if err != nil || id < 0 {
+			writeProblem(w, r, http.StatusBadRequest, msgLastEventIDInvalid)
+			return
+		}
+		lastID = id
+	}
+
+	// The stream outlasts the server's timeouts; each write gets a deadline of
+	// its own instead, so connections to vanished clients still end
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		slog.WarnContext(r.Context(), "Could not lift read deadline", "error", err)
+	}
+	send := func(format string, args ...any) bool {
+		rc.SetWriteDeadline(time.Now().Add(2 * heartbeat))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	tenant := tenantFromContext(r.Context())
+	sendEvent := func(event streamEvent) bool {
+		if event.TenantID != tenant {
+			return true
+		}
+		return send("id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	}
+
+	missed, complete, events := h.stream.subscribe(lastID)
+	defer h.stream.unsubscribe(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // Keeps nginx from holding events back
+	w.WriteHeader(http.StatusOK)
+	if !send(": connected\n\n") {
+		return
+	}
+	if !complete && !send("event: stream.reset\ndata: {}\n\n") {
+		return
+	}
+	for _, event := range missed {
+		if !sendEvent(event) {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if !send(": heartbeat\n\n") {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				// Dropped for falling behind; the client resumes from its last ID
+				return
+			}
+			if !sendEvent(event) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"user/user/store"
+)
+
+// Request body for POST /users/exists
+type emailExistsRequest struct {
+	Emails []string `json:"emails"`
+}
+
+// API to Check Which Emails Are Registered (POST /users/exists)
+func (h *handler) checkEmailsExist(w http.ResponseWriter, r *http.Request) {
+	if ok, retryAfter := h.emailLookups.reserve(clientIP(r, h.config)); !ok {
+		rejectRateLimited(w, r, retryAfter)
+		return
+	}
+
+	var req emailExistsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if rejectOversizedBody(w, r, err) {
+			return
+		}
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		return
+	}
+
+	// Normalize and de-duplicate, keeping the caller's order
+	var emails []string
+	seen := make(map[string]bool)
+	for _, email := range req.Emails {
+		email = store.NormalizeEmail(email)
+		if email == "" || seen[email] {
+			continue
+		}
+		seen[email] = true
+		emails = append(emails, email)
+	}
+	if len(emails) > h.config.EmailLookup.MaxEmails {
+		writeProblem(w, r, http.StatusBadRequest, msgTooManyEmails.with(h.config.EmailLookup.MaxEmails))
+		return
+	}
+
+	found, err := h.users.ExistingEmails(r.Context(), tenantFromContext(r.Context()), emails)
+	if err != nil {
+		dbError(w, r, err, msgErrorCheckingEmails)
+		return
+	}
+	exists := []string{}
+	for _, email := range emails {
+		if found[email] {
+			exists = append(exists, email)
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string][]string{"exists": exists})
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"user/user/config"
+)
+
+// Feature flags the service checks
+const (
+	featureAsyncCreation = "async_creation" // POST /users honours Prefer: respond-async; off, it creates the user before answering
+	featureSearchIndex   = "search_index"   // GET /users/search asks search_index first; off, the database answers
+)
+
+// Whether each flag is on while features doesn't set it; flags not listed are
+// off. The flags above guard behaviour that has shipped, so they default on
+// and are turned off where it misbehaves.
+var featureDefaults = map[string]bool{
+	featureAsyncCreation: true,
+	featureSearchIndex:   true,
+}
+
+// Key prefix of the flags of App Configuration's feature manager
+const appConfigFeatureFlagPrefix = ".appconfig.featureflag/"
+
+// Filters of App Configuration feature flags that map onto a FeatureFlag
+const (
+	appConfigTargetingFilter  = "Microsoft.Targeting"
+	appConfigPercentageFilter = "Microsoft.Percentage"
+)
+
+// featureEnabled reports whether the feature flag features.<name> is on for
+// the tenant of ctx, in the settings in effect
+func (w *AppConfigWatcher) featureEnabled(ctx context.Context, name string) bool {
+	flag, ok := w.Current().Features[name]
+	if !ok {
+		return featureDefaults[name]
+	}
+	return flag.EnabledFor(name, tenantFromContext(ctx))
+}
+
+// featureProblems checks the settings of each flag
+func featureProblems(cfg config.Config) []string {
+	var problems []string
+	for name, flag := range cfg.Features {
+		if flag.RolloutPercentage < 0 || flag.RolloutPercentage > 100 {
+			problems = append(problems, fmt.Sprintf("features.%s.rollout_percentage must be between 0 and 100", name))
+		}
+	}
+	return problems
+}
+
+// appConfigFeatureFlag is a flag as App Configuration's feature manager stores it
+type appConfigFeatureFlag struct {
+	Enabled    bool `json:"enabled"`
+	Conditions struct {
+		RequirementType string `json:"requirement_type"` // Any (default) or All of the filters
+		ClientFilters   []struct {
+			Name       string          `json:"name"`
+			Parameters json.RawMessage `json:"parameters"`
+		} `json:"client_filters"`
+	} `json:"conditions"`
+}
+
+// Parameters of the Microsoft.Targeting filter. Users and groups both name
+// tenants, as flags are rolled out to whole tenants; a group is taken when its
+// own percentage is above zero.
+type appConfigTargeting struct {
+	Audience struct {
+		Users  []string `json:"Users"`
+		Groups []struct {
+			Name              string `json:"Name"`
+			RolloutPercentage int    `json:"RolloutPercentage"`
+		} `json:"Groups"`
+		DefaultRolloutPercentage int `json:"DefaultRolloutPercentage"`
+		Exclusion                struct {
+			Users  []string `json:"Users"`
+			Groups []string `json:"Groups"`
+		} `json:"Exclusion"`
+	} `json:"Audience"`
+}
+
+// parseAppConfigFeatureFlag reads a feature manager flag as a FeatureFlag. A
+// flag without filters is on for every tenant; one with a filter this service
+// can't evaluate, such as a time window, is off.
+func parseAppConfigFeatureFlag(name, value string) (config.FeatureFlag, error) {
+	var stored appConfigFeatureFlag
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return config.FeatureFlag{}, err
+	}
+	flag := config.FeatureFlag{Enabled: stored.Enabled}
+	filters := stored.Conditions.ClientFilters
+	if len(filters) == 0 {
+		flag.RolloutPercentage = 100
+		return flag, nil
+	}
+	if len(filters) > 1 && strings.EqualFold(stored.Conditions.RequirementType, "All") {
+		slog.Warn("Feature flag requires all of its filters, which isn't supported; it is off", "flag", name)
+		return config.FeatureFlag{}, nil
+	}
+	// Any filter turns the flag on for a tenant, so their audiences add up
+	for _, filter := range filters {
+		switch filter.Name {
+		case appConfigTargetingFilter:
+			var targeting appConfigTargeting
+			if err := json.Unmarshal(filter.Parameters, &targeting); err != nil {
+				return config.FeatureFlag{}, fmt.Errorf("%s parameters: %w", filter.Name, err)
+			}
+			audience := targeting.Audience
+			flag.Tenants = append(flag.Tenants, audience.Users...)
+			for _, group := range audience.Groups {
+				if group.RolloutPercentage > 0 {
+					flag.Tenants = append(flag.Tenants, group.Name)
+				}
+			}
+			flag.ExcludedTenants = append(flag.ExcludedTenants, audience.Exclusion.Users...)
+			flag.ExcludedTenants = append(flag.ExcludedTenants, audience.Exclusion.Groups...)
+			flag.RolloutPercentage = max(flag.RolloutPercentage, audience.DefaultRolloutPercentage)
+		case appConfigPercentageFilter:
+			var percentage struct {
+				Value int `json:"Value"`
+			}
+			if err := json.Unmarshal(filter.Parameters, &percentage); err != nil {
+				return config.FeatureFlag{}, fmt.Errorf("%s parameters: %w", filter.Name, err)
+			}
+			flag.RolloutPercentage = max(flag.RolloutPercentage, percentage.Value)
+		default:
+			slog.Warn("Feature flag filter isn't supported; the flag is off", "flag", name, "filter", filter.Name)
+			return config.FeatureFlag{}, nil
+		}
+	}
+	flag.RolloutPercentage = min(flag.RolloutPercentage, 100)
+	return flag, nil
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"user/user/store"
+)
+
+// Fields GET /users?fields= may pick, by their JSON names
+var sparseUserFields = []string{
+	"id", "name", "email", "link", "thumbnailLink", "createdAt", "tenantId", "deletedAt",
+	"updatedAt", "version", "lastLoginAt", "roles", "lockedAt", "metadata", "emailVerifiedAt", "thumbnails",
+}
+
+// A user with only the requested fields
+type sparseUser map[string]json.RawMessage
+
+// sparseUserPage is a UserPage of sparse users
+type sparseUserPage struct {
+	Users      []sparseUser `json:"users"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+	PrevCursor string       `json:"prevCursor,omitempty"`
+	Total      int64        `json:"total"`
+}
+
+// sparseFields reads the fields query parameter, a comma-separated list of the
+// user fields a listing returns. No list means every field. On failure it
+// writes the error response.
+func sparseFields(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	param := r.URL.Query().Get("fields")
+	if param == "" {
+		return nil, true
+	}
+	var fields []string
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if !slices.Contains(sparseUserFields, field) {
+			writeProblem(w, r, http.StatusBadRequest, msgUnknownField.with(field, strings.Join(sparseUserFields, ", ")))
+			return nil, false
+		}
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields, true
+}
+
+// sparseUsers trims each user to the fields. Only JSON represents the result,
+// so requests for other formats get a 406.
+func sparseUsers(users []store.User, fields []string) ([]sparseUser, error) {
+	sparse := make([]sparseUser, len(users))
+	for i, user := range users {
+		data, err := json.Marshal(user)
+		if err != nil {
+			return nil, err
+		}
+		var all sparseUser
+		if err := json.Unmarshal(data, &all); err != nil {
+			return nil, err
+		}
+		sparse[i] = sparseUser{}
+		for _, field := range fields {
+			// Fields left out when empty stay out
+			if value, ok := all[field]; ok {
+				sparse[i][field] = value
+			}
+		}
+	}
+	return sparse, nil
+}
@@ -0,0 +1,505 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/graph-gophers/graphql-go"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+const graphQLRequestKey contextKey = "graphQLRequest"
+
+// Schema of POST /graphql. It mirrors the /v1/users routes the resolvers call.
+const graphQLSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+scalar Time
+
+# A file part of a multipart request, as the GraphQL multipart request spec sends it
+scalar Upload
+
+type Query {
+	# A live user, or null if there is none with this ID
+	user(id: ID!): User
+	# A page of the tenant's users; pass nextCursor as after for the next one
+	users(first: Int, after: String, search: String, email: String, activeSince: Time, createdAfter: Time, sort: UserSortField, order: SortOrder, includeDeleted: Boolean): UserPage!
+}
+
+type Mutation {
+	# Creates a user from exactly one of photo, photoBase64 or photoUrl
+	createUser(input: CreateUserInput!): User!
+}
+
+enum UserSortField {
+	ID
+	NAME
+	CREATED_AT
+}
+
+enum SortOrder {
+	ASC
+	DESC
+}
+
+input CreateUserInput {
+	name: String!
+	email: String!
+	photo: Upload
+	photoBase64: String
+	# File name of photoBase64, kept with the stored picture
+	photoFilename: String
+	photoUrl: String
+}
+
+type User {
+	id: ID!
+	name: String!
+	email: String!
+	link: String!
+	thumbnailLink: String
+	createdAt: Time!
+	tenantId: String
+	deletedAt: Time
+	updatedAt: Time!
+	# Changes on every write; a 64-bit number, so sent as a string
+	version: String!
+	lastLoginAt: Time
+	roles: [String!]!
+	lockedAt: Time
+}
+
+type UserPage {
+	users: [User!]!
+	nextCursor: String
+}
+`
+
+// Nesting allowed in a query; the schema itself is only a few levels deep
+const graphQLMaxDepth = 8
+
+// newGraphQLSchema parses the schema with resolvers that serve each field
+// through router, as serveInternally describes
+func newGraphQLSchema(cfg config.Config, router http.Handler) *graphql.Schema {
+	resolver := &graphQLResolver{
+		router: router,
+		// Credentials, tenant and client address, the same as a REST call carries
+		forwardHeaders: []string{"Authorization", "X-API-Key", "X-Forwarded-For", cfg.Tenancy.Header},
+	}
+	return graphql.MustParseSchema(graphQLSchema, resolver, graphql.MaxDepth(graphQLMaxDepth))
+}
+
+// Body of a GraphQL request
+type graphQLParams struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+}
+
+// API to Query and Create Users with GraphQL (POST /graphql)
+//
+// Takes a JSON body, or a multipart one following the GraphQL multipart request
+// spec to upload createUser's photo. Each field is authorized like the REST
+// route it mirrors, so errors carry that route's status in their extensions.
+func serveGraphQL(w http.ResponseWriter, r *http.Request, schema *graphql.Schema) {
+	var params graphQLParams
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json", "":
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			if !rejectOversizedBody(w, r, err) {
+				writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+			}
+			return
+		}
+	case "multipart/form-data":
+		if !parseUploadForm(w, r) {
+			return
+		}
+		var err error
+		params, err = graphQLMultipartParams(r.MultipartForm)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+			return
+		}
+	default:
+		writeProblem(w, r, http.StatusUnsupportedMediaType, msgGraphQLContentType)
+		return
+	}
+	if params.Query == "" {
+		writeProblem(w, r, http.StatusBadRequest, msgParamRequired.with("query"))
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), graphQLRequestKey, r)
+	response := schema.Exec(ctx, params.Query, params.OperationName, params.Variables)
+	json.NewEncoder(w).Encode(response)
+}
+
+// graphQLMultipartParams reads a multipart GraphQL request: the operations field
+// holds the usual JSON body, and map names the variables each file part fills
+func graphQLMultipartParams(form *multipart.Form) (graphQLParams, error) {
+	var params graphQLParams
+	if len(form.Value["operations"]) != 1 || json.Unmarshal([]byte(form.Value["operations"][0]), &params) != nil {
+		return params, msgGraphQLOperationsInvalid
+	}
+	var fileMap map[string][]string
+	if len(form.Value["map"]) != 1 || json.Unmarshal([]byte(form.Value["map"][0]), &fileMap) != nil {
+		return params, msgGraphQLMapInvalid
+	}
+	for part, paths := range fileMap {
+		if len(form.File[part]) != 1 {
+			return params, msgGraphQLMapMissingPart.with(part)
+		}
+		for _, path := range paths {
+			if err := setGraphQLVariable(params.Variables, path, form.File[part][0]); err != nil {
+				return params, err
+			}
+		}
+	}
+	return params, nil
+}
+
+// setGraphQLVariable sets the variable at a dotted path such as
+// variables.input.photo, whose objects must already exist
+func setGraphQLVariable(variables map[string]any, path string, value any) error {
+	keys := strings.Split(path, ".")
+	if len(keys) < 2 || keys[0] != "variables" {
+		return msgGraphQLMapPathPrefix.with(path)
+	}
+	object := variables
+	for _, key := range keys[1 : len(keys)-1] {
+		next, ok := object[key].(map[string]any)
+		if !ok {
+			return msgGraphQLMapPathUnknown.with(path)
+		}
+		object = next
+	}
+	if object == nil {
+		return msgGraphQLMapPathUnknown.with(path)
+	}
+	object[keys[len(keys)-1]] = value
+	return nil
+}
+
+// graphQLUpload is an Upload scalar, set by graphQLMultipartParams
+type graphQLUpload struct {
+	header *multipart.FileHeader
+}
+
+func (graphQLUpload) ImplementsGraphQLType(name string) bool {
+	return name == "Upload"
+}
+
+func (u *graphQLUpload) UnmarshalGraphQL(input any) error {
+	header, ok := input.(*multipart.FileHeader)
+	if !ok {
+		return msgGraphQLUploadNotFile
+	}
+	u.header = header
+	return nil
+}
+
+// graphQLError is a problem from the route a field was served by
+type graphQLError struct {
+	problem Problem
+}
+
+func (e graphQLError) Error() string {
+	return e.problem.Detail
+}
+
+// Extensions carries the problem's status, as a code such as NOT_FOUND and a
+// number, the problem's own code as reason, and any invalid fields
+func (e graphQLError) Extensions() map[string]any {
+	extensions := map[string]any{
+		"code":   strings.ToUpper(strings.ReplaceAll(http.StatusText(e.problem.Status), " ", "_")),
+		"status": e.problem.Status,
+	}
+	if e.problem.Code != "" {
+		extensions["reason"] = e.problem.Code
+	}
+	if len(e.problem.Fields) > 0 {
+		extensions["fields"] = e.problem.Fields
+	}
+	if e.problem.RequestID != "" {
+		extensions["requestId"] = e.problem.RequestID
+	}
+	return extensions
+}
+
+// badGraphQLInput reports an argument that can't be turned into a request, in
+// the language of the GraphQL request as problems from its fields' routes are
+func badGraphQLInput(ctx context.Context, message Message) graphQLError {
+	lang := defaultLanguage
+	if outer, _ := ctx.Value(graphQLRequestKey).(*http.Request); outer != nil {
+		lang = acceptedLanguage(outer)
+	}
+	return graphQLError{Problem{Status: http.StatusBadRequest, Detail: message.in(lang)}}
+}
+
+// graphQLResolver resolves the Query and Mutation fields
+type graphQLResolver struct {
+	router         http.Handler
+	forwardHeaders []string
+}
+
+func (g *graphQLResolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*graphQLUser, error) {
+	id, err := strconv.ParseInt(string(args.ID), 10, 64)
+	if err != nil || id <= 0 {
+		return nil, badGraphQLInput(ctx, msgPositiveInteger.with("id"))
+	}
+	var user store.User
+	err = g.call(ctx, http.MethodGet, "/users/"+strconv.FormatInt(id, 10), "", nil, &user)
+	var notFound graphQLError
+	if errors.As(err, &notFound) && notFound.problem.Status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &graphQLUser{user}, nil
+}
+
+type graphQLUsersArgs struct {
+	First          *int32
+	After          *string
+	Search         *string
+	Email          *string
+	ActiveSince    *graphql.Time
+	CreatedAfter   *graphql.Time
+	Sort           *string
+	Order          *string
+	IncludeDeleted *bool
+}
+
+// Query values of the UserSortField enum
+var graphQLSortFields = map[string]string{"ID": store.SortByID, "NAME": store.SortByName, "CREATED_AT": store.SortByCreatedAt}
+
+func (g *graphQLResolver) Users(ctx context.Context, args graphQLUsersArgs) (*graphQLUserPage, error) {
+	query := url.Values{"limit": {strconv.Itoa(defaultPageSize)}}
+	if args.First != nil {
+		if *args.First <= 0 {
+			return nil, badGraphQLInput(ctx, msgPositiveInteger.with("first"))
+		}
+		query.Set("limit", strconv.Itoa(int(*args.First)))
+	}
+	if args.After != nil {
+		query.Set("cursor", *args.After)
+	}
+	if args.Search != nil {
+		query.Set("q", *args.Search)
+	}
+	if args.Email != nil {
+		query.Set("email", *args.Email)
+	}
+	if args.ActiveSince != nil {
+		query.Set("active_since", args.ActiveSince.UTC().Format(time.RFC3339))
+	}
+	if args.CreatedAfter != nil {
+		query.Set("createdAfter", args.CreatedAfter.UTC().Format(time.RFC3339))
+	}
+	if args.Sort != nil {
+		query.Set("sort", graphQLSortFields[*args.Sort])
+	}
+	if args.Order != nil {
+		query.Set("order", strings.ToLower(*args.Order))
+	}
+	if args.IncludeDeleted != nil && *args.IncludeDeleted {
+		query.Set("include_deleted", "true")
+	}
+
+	var page UserPage
+	if err := g.call(ctx, http.MethodGet, "/users?"+query.Encode(), "", nil, &page); err != nil {
+		return nil, err
+	}
+	return &graphQLUserPage{page}, nil
+}
+
+type graphQLCreateUserArgs struct {
+	Input struct {
+		Name          string
+		Email         string
+		Photo         *graphQLUpload
+		PhotoBase64   *string
+		PhotoFilename *string
+		PhotoURL      *string
+	}
+}
+
+func (g *graphQLResolver) CreateUser(ctx context.Context, args graphQLCreateUserArgs) (*graphQLUser, error) {
+	input := args.Input
+	var photoURL, filename string
+	var photo io.Reader
+	switch {
+	case input.Photo != nil:
+		file, err := input.Photo.header.Open()
+		if err != nil {
+			return nil, badGraphQLInput(ctx, msgFieldMessage.with("photo", msgUnreadable))
+		}
+		defer file.Close()
+		photo, filename = file, input.Photo.header.Filename
+	case input.PhotoBase64 != nil:
+		data, err := base64.StdEncoding.DecodeString(*input.PhotoBase64)
+		if err != nil {
+			return nil, badGraphQLInput(ctx, msgGraphQLPhotoNotBase64)
+		}
+		if input.PhotoFilename == nil || *input.PhotoFilename == "" {
+			return nil, badGraphQLInput(ctx, msgGraphQLPhotoFilenameRequired)
+		}
+		photo, filename = bytes.NewReader(data), *input.PhotoFilename
+	case input.PhotoURL != nil:
+		photoURL = *input.PhotoURL
+	}
+	body, contentType, err := newCreateUserForm(input.Name, input.Email, photoURL, filename, photo)
+	if err != nil {
+		return nil, badGraphQLInput(ctx, msgFieldMessage.with("photo", msgUnreadable))
+	}
+
+	var created struct {
+		User store.User `json:"user"`
+	}
+	if err := g.call(ctx, http.MethodPost, "/users", contentType, body, &created); err != nil {
+		return nil, err
+	}
+	return &graphQLUser{created.User}, nil
+}
+
+// call serves the /v1 request for a field on behalf of the GraphQL request,
+// and decodes a successful response into out. Problems are returned as
+// graphQLErrors.
+func (g *graphQLResolver) call(ctx context.Context, method, path, contentType string, body io.Reader, out any) error {
+	outer, _ := ctx.Value(graphQLRequestKey).(*http.Request)
+	if outer == nil {
+		return errors.New("no GraphQL request in context")
+	}
+	r, err := http.NewRequestWithContext(ctx, method, versionedPath(apiV1, path), body)
+	if err != nil {
+		return err
+	}
+	for _, key := range g.forwardHeaders {
+		if values := outer.Header.Values(key); len(values) > 0 {
+			r.Header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+	r.Header.Set(requestIDHeader, requestIDFromContext(ctx))
+	r.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	r.RemoteAddr = outer.RemoteAddr
+
+	resp := serveInternally(g.router, r)
+	if resp.failed() {
+		return graphQLError{resp.problem()}
+	}
+	return json.Unmarshal(resp.body.Bytes(), out)
+}
+
+// graphQLUser resolves the User type
+type graphQLUser struct {
+	user store.User
+}
+
+func (u *graphQLUser) ID() graphql.ID {
+	return graphql.ID(strconv.FormatInt(u.user.ID, 10))
+}
+
+func (u *graphQLUser) Name() string {
+	return u.user.Name
+}
+
+func (u *graphQLUser) Email() string {
+	return u.user.Email
+}
+
+func (u *graphQLUser) Link() string {
+	return u.user.Link
+}
+
+func (u *graphQLUser) ThumbnailLink() *string {
+	return optionalString(u.user.ThumbnailLink)
+}
+
+func (u *graphQLUser) CreatedAt() graphql.Time {
+	return graphql.Time{Time: u.user.CreatedAt}
+}
+
+func (u *graphQLUser) TenantID() *string {
+	return optionalString(u.user.TenantID)
+}
+
+func (u *graphQLUser) DeletedAt() *graphql.Time {
+	return optionalTime(u.user.DeletedAt)
+}
+
+func (u *graphQLUser) UpdatedAt() graphql.Time {
+	return graphql.Time{Time: u.user.UpdatedAt}
+}
+
+func (u *graphQLUser) Version() string {
+	return strconv.FormatInt(u.user.Version, 10)
+}
+
+func (u *graphQLUser) LastLoginAt() *graphql.Time {
+	return optionalTime(u.user.LastLoginAt)
+}
+
+func (u *graphQLUser) Roles() []string {
+	if u.user.Roles == nil {
+		return []string{}
+	}
+	return u.user.Roles
+}
+
+func (u *graphQLUser) LockedAt() *graphql.Time {
+	return optionalTime(u.user.LockedAt)
+}
+
+// graphQLUserPage resolves the UserPage type
+type graphQLUserPage struct {
+	page UserPage
+}
+
+func (p *graphQLUserPage) Users() []*graphQLUser {
+	users := make([]*graphQLUser, 0, len(p.page.Users))
+	for _, user := range p.page.Users {
+		users = append(users, &graphQLUser{user})
+	}
+	return users
+}
+
+func (p *graphQLUserPage) NextCursor() *string {
+	return optionalString(p.page.NextCursor)
+}
+
+// optionalString returns nil for an empty string, which GraphQL sends as null
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func optionalTime(t *time.Time) *graphql.Time {
+	if t == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *t}
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+
+	"user/user/store"
+)
+
+// Upper bound of the user_groups.description column
+const maxGroupDescriptionLength = 1000
+
+// Body of POST /groups
+type groupRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// Body of POST /groups/{id}/members
+type groupMemberRequest struct {
+	UserID int64 `json:"userId"`
+}
+
+// API to Create a Group (POST /groups)
+func (h *handler) createGroup(w http.ResponseWriter, r *http.Request) {
+	var req groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return
+	}
+	group := store.Group{
+		TenantID:    tenantFromContext(r.Context()),
+		Name:        strings.TrimSpace(req.Name),
+		Description: strings.TrimSpace(req.Description),
+	}
+	var errs validationErrors
+	errs.check("name", validateName(group.Name, h.config.Validation.MaxNameLength))
+	if utf8.RuneCountInString(group.Description) > maxGroupDescriptionLength {
+		errs.check("description", msgMaxLength.with(maxGroupDescriptionLength))
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	group, err := h.groups.CreateGroup(r.Context(), group)
+	if errors.Is(err, store.ErrDuplicateGroup) {
+		writeProblem(w, r, http.StatusConflict, msgGroupNameTaken)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorSavingGroup)
+		return
+	}
+	w.Header().Set("Location", r.URL.Path+"/"+strconv.FormatInt(group.ID, 10))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+// API to Add a Member to a Group (POST /groups/{id}/members)
+//
+// Adding a user who already is a member succeeds without changing anything.
+func (h *handler) addGroupMember(w http.ResponseWriter, r *http.Request) {
+	groupID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || groupID <= 0 {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidGroupID)
+		return
+	}
+	var req groupMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return
+	}
+	if req.UserID <= 0 {
+		writeProblem(w, r, http.StatusBadRequest, msgPositiveInteger.with("userId"))
+		return
+	}
+
+	err = h.groups.AddGroupMember(r.Context(), tenantFromContext(r.Context()), groupID, req.UserID)
+	if errors.Is(err, store.ErrGroupNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgGroupNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusUnprocessableEntity, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorAddingGroupMember)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// API to List a User's Groups (GET /users/{id}/groups)
+func (h *handler) listUserGroups(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	tenant := tenantFromContext(r.Context())
+	_, err = h.users.GetUser(r.Context(), tenant, id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+
+	list, err := h.groups.ListUserGroups(r.Context(), tenant, id)
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingGroups)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,276 @@
+package api
+
+//go:generate protoc -I.. --go_out=.. --go_opt=paths=source_relative --go-grpc_out=.. --go-grpc_opt=paths=source_relative ../userpb/user.proto
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"user/user/config"
+	"user/user/store"
+	"user/user/userpb"
+)
+
+// grpcUserService serves UserService by handing each call to the /v1 route it
+// mirrors, as serveInternally describes
+type grpcUserService struct {
+	userpb.UnimplementedUserServiceServer
+	router          http.Handler
+	forwardMetadata []string // Metadata keys carried over as headers
+}
+
+// newGRPCServer returns a gRPC server for UserService, backed by router, over
+// TLS when tlsConfig isn't nil. Messages may be as large as an upload, since
+// CreateUser carries the picture.
+func newGRPCServer(cfg config.Config, router http.Handler, tlsConfig *tls.Config) *grpc.Server {
+	options := []grpc.ServerOption{grpc.MaxRecvMsgSize(int(cfg.Server.MaxUploadBytes))}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	userpb.RegisterUserServiceServer(server, &grpcUserService{
+		router: router,
+		// Only what a client may set: X-Forwarded-For and the like would let it
+		// pose as someone else to the rate limits and the audit log
+		forwardMetadata: []string{"authorization", "x-api-key", strings.ToLower(cfg.Tenancy.Header), "idempotency-key", "accept-language"},
+	})
+	return server
+}
+
+// stopGRPCServer lets in-flight calls finish, cutting them off once ctx is done
+func stopGRPCServer(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		server.Stop()
+	}
+}
+
+func (s *grpcUserService) CreateUser(ctx context.Context, req *userpb.CreateUserRequest) (*userpb.User, error) {
+	var photo io.Reader
+	if data, ok := req.GetPhoto().(*userpb.CreateUserRequest_PhotoData); ok {
+		if req.GetPhotoFilename() == "" {
+			return nil, status.Error(codes.InvalidArgument, "photo_filename is required with photo_data")
+		}
+		photo = bytes.NewReader(data.PhotoData)
+	}
+	body, contentType, err := newCreateUserForm(req.GetName(), req.GetEmail(), req.GetPhotoUrl(), req.GetPhotoFilename(), photo)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error encoding user")
+	}
+
+	var created struct {
+		User store.User `json:"user"`
+	}
+	if err := s.call(ctx, http.MethodPost, "/users", contentType, body, nil, &created); err != nil {
+		return nil, err
+	}
+	return userToProto(created.User), nil
+}
+
+func (s *grpcUserService) GetUser(ctx context.Context, req *userpb.GetUserRequest) (*userpb.User, error) {
+	var user store.User
+	if err := s.call(ctx, http.MethodGet, userPath(req.GetId()), "", nil, nil, &user); err != nil {
+		return nil, err
+	}
+	return userToProto(user), nil
+}
+
+func (s *grpcUserService) ListUsers(ctx context.Context, req *userpb.ListUsersRequest) (*userpb.ListUsersResponse, error) {
+	if req.GetPageSize() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "page_size must not be negative")
+	}
+	query := url.Values{"limit": {strconv.Itoa(defaultPageSize)}}
+	if req.GetPageSize() > 0 {
+		query.Set("limit", strconv.Itoa(int(req.GetPageSize())))
+	}
+	if req.GetPageToken() != "" {
+		query.Set("cursor", req.GetPageToken())
+	}
+	if req.GetQuery() != "" {
+		query.Set("q", req.GetQuery())
+	}
+
+	var page UserPage
+	if err := s.call(ctx, http.MethodGet, "/users?"+query.Encode(), "", nil, nil, &page); err != nil {
+		return nil, err
+	}
+	return usersToProto(page), nil
+}
+
+func (s *grpcUserService) UpdateUser(ctx context.Context, req *userpb.UpdateUserRequest) (*userpb.User, error) {
+	patch := userPatch{Name: req.Name, Email: req.Email}
+	if req.GetVersion() != 0 {
+		patch.Version = &req.Version
+	}
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error encoding update")
+	}
+
+	var user store.User
+	if err := s.call(ctx, http.MethodPatch, userPath(req.GetId()), mergePatchContentType, bytes.NewReader(body), nil, &user); err != nil {
+		return nil, err
+	}
+	return userToProto(user), nil
+}
+
+func (s *grpcUserService) DeleteUser(ctx context.Context, req *userpb.DeleteUserRequest) (*emptypb.Empty, error) {
+	header := http.Header{}
+	if req.GetVersion() != 0 {
+		header.Set("If-Match", userETag(store.User{Version: req.GetVersion()}))
+	}
+	if err := s.call(ctx, http.MethodDelete, userPath(req.GetId()), "", nil, header, nil); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func userPath(id int64) string {
+	return "/users/" + strconv.FormatInt(id, 10)
+}
+
+// call serves the /v1 request for a gRPC call, carrying over the metadata of
+// forwardMetadata as headers, and decodes a successful response into out, if not nil. Problems are
+// returned as status errors.
+func (s *grpcUserService) call(ctx context.Context, method, path, contentType string, body io.Reader, header http.Header, out any) error {
+	r, err := http.NewRequestWithContext(ctx, method, versionedPath(apiV1, path), body)
+	if err != nil {
+		return status.Error(codes.Internal, "Error building request")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range s.forwardMetadata {
+		for _, value := range md.Get(key) {
+			r.Header.Add(key, value)
+		}
+	}
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	// Calls always need a body to decode, so a conditional GET's 304 won't do
+	r.Header.Del("If-None-Match")
+	r.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	resp := serveInternally(s.router, r)
+	if resp.failed() {
+		return problemStatus(ctx, resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.body.Bytes(), out); err != nil {
+		return status.Error(codes.Internal, "Error decoding response")
+	}
+	return nil
+}
+
+// problemStatus turns a problem response into a status error, listing invalid
+// fields as BadRequest details and passing Retry-After on as trailer metadata
+func problemStatus(ctx context.Context, resp *bufferedResponse) error {
+	problem := resp.problem()
+	if retryAfter := resp.header.Get("Retry-After"); retryAfter != "" {
+		grpc.SetTrailer(ctx, metadata.Pairs("retry-after", retryAfter))
+	}
+
+	st := status.New(grpcCode(resp.status), problem.Detail)
+	if len(problem.Fields) > 0 {
+		details := &errdetails.BadRequest{}
+		for _, field := range problem.Fields {
+			details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: field.Field, Description: field.Message})
+		}
+		if withDetails, err := st.WithDetails(details); err == nil {
+			st = withDetails
+		}
+	}
+	return st.Err()
+}
+
+// grpcCode maps an HTTP error status to the closest gRPC code
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden, http.StatusLocked:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusPreconditionFailed, http.StatusPreconditionRequired:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	if httpStatus >= 500 {
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+// userToProto converts a user to its UserService message
+func userToProto(user store.User) *userpb.User {
+	msg := &userpb.User{
+		Id:            user.ID,
+		Name:          user.Name,
+		Email:         user.Email,
+		Link:          user.Link,
+		ThumbnailLink: user.ThumbnailLink,
+		CreatedAt:     protoTime(user.CreatedAt),
+		TenantId:      user.TenantID,
+		UpdatedAt:     protoTime(user.UpdatedAt),
+		Version:       user.Version,
+		Roles:         user.Roles,
+	}
+	if user.LastLoginAt != nil {
+		msg.LastLoginAt = protoTime(*user.LastLoginAt)
+	}
+	if user.LockedAt != nil {
+		msg.LockedAt = protoTime(*user.LockedAt)
+	}
+	return msg
+}
+
+// protoTime converts t, leaving zero times unset
+func protoTime(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"user/user/config"
+	"user/user/resilience"
+)
+
+// How long each readiness check may take before its dependency counts as down
+const readinessCheckTimeout = 2 * time.Second
+
+// ReadinessCheck is the outcome of checking one dependency
+type ReadinessCheck struct {
+	Status     string `json:"status"` // up or down
+	DurationMs int64  `json:"durationMs"`
+}
+
+// Readiness is the body of GET /readyz
+type Readiness struct {
+	Status string                    `json:"status"` // ok, or unavailable when any check is down
+	Checks map[string]ReadinessCheck `json:"checks"` // By dependency: sql, blob and service_bus
+}
+
+// readinessChecks reaches each dependency the way requests do: a ping of the
+// pool, the picture container's properties, and a batch opened on the user
+// queue's sender, which attaches its link
+func readinessChecks(cfg config.Config, deps ServerDeps) map[string]func(ctx context.Context) error {
+	checks := map[string]func(ctx context.Context) error{
+		resilience.DependencyBlob: func(ctx context.Context) error {
+			return deps.Blobs.CheckContainer(ctx, cfg.Azure.PicturesContainer)
+		},
+		resilience.DependencyServiceBus: func(ctx context.Context) error {
+			return deps.Events.Check(ctx)
+		},
+	}
+	// The in-memory store, with database.driver memory, is always ready
+	if deps.DB != nil {
+		checks[resilience.DependencySQL] = func(ctx context.Context) error {
+			return deps.DB.PingContext(ctx)
+		}
+	}
+	return checks
+}
+
+// Readiness probe (GET /readyz)
+//
+// The dependencies are checked in parallel, each within readinessCheckTimeout,
+// and the response is 503 if any of them is down so the instance is taken out
+// of rotation. Failures are logged rather than returned, since the probe is
+// open to anyone.
+func readyz(checks map[string]func(ctx context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		readiness := Readiness{Status: "ok", Checks: map[string]ReadinessCheck{}}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for dependency, check := range checks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+				defer cancel()
+				start := time.Now()
+				err := check(ctx)
+				result := ReadinessCheck{Status: "up", DurationMs: time.Since(start).Milliseconds()}
+				if err != nil {
+					slog.WarnContext(r.Context(), "Readiness check failed", "dependency", dependency, "error", err)
+					result.Status = "down"
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				readiness.Checks[dependency] = result
+				if err != nil {
+					readiness.Status = "unavailable"
+				}
+			}()
+		}
+		wg.Wait()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if readiness.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(readiness)
+	}
+}
+
+// Liveness probe (GET /healthz, GET /livez)
+func healthz(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"cmp"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Message catalogs, one per language as locales/<language>.json. Each maps the
+// IDs of messages to their translation.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// Language messages are written in, and answered in when the request accepts
+// none of the catalogs' languages
+const defaultLanguage = "en"
+
+// Message is something the service tells clients, in a problem's title or
+// detail, a field error or a bulk import result. It is written in English and
+// translated by its ID. Values given with it are formatted into its text, or
+// its translation, in the order of their verbs; they are translated in turn
+// only when they are Messages, so user input is written as it came.
+//
+// Messages are errors too, so the helpers that validate and parse requests
+// can return them for their callers to respond with.
+type Message struct {
+	id   string
+	args []any
+}
+
+// English text of every message, by ID
+var messageTexts = map[string]string{}
+
+// newMessage declares the message with id, in English as text. Messages are
+// declared once, as package variables, so that messageTexts has every message
+// the service can write.
+func newMessage(id, text string) Message {
+	if _, ok := messageTexts[id]; ok {
+		panic("message " + id + " is declared twice")
+	}
+	messageTexts[id] = text
+	return Message{id: id}
+}
+
+// with returns the message with args for the verbs of its text
+func (m Message) with(args ...any) Message {
+	return Message{id: m.id, args: args}
+}
+
+// in returns the message in lang, falling back to the English it was written
+// in when lang has no catalog or its catalog lacks the message
+func (m Message) in(lang string) string {
+	text, ok := catalogs[lang][m.id]
+	if !ok {
+		text = messageTexts[m.id]
+	}
+	if len(m.args) == 0 {
+		return text
+	}
+	args := make([]any, len(m.args))
+	for i, arg := range m.args {
+		if message, ok := arg.(Message); ok {
+			arg = message.in(lang)
+		}
+		args[i] = arg
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// String returns the message in English, as it is logged
+func (m Message) String() string {
+	return m.in(defaultLanguage)
+}
+
+func (m Message) Error() string {
+	return m.String()
+}
+
+// messageOf returns the Message err is or wraps, or msgInvalidRequest for an
+// error that has none to tell the client
+func messageOf(err error) Message {
+	var message Message
+	if errors.As(err, &message) {
+		return message
+	}
+	return msgInvalidRequest
+}
+
+// Titles of problems by status, their status text as messages with IDs such
+// as status_404
+var statusTitles = newStatusTitles()
+
+func newStatusTitles() map[int]Message {
+	titles := map[int]Message{}
+	for status := 400; status < 600; status++ {
+		if text := http.StatusText(status); text != "" {
+			titles[status] = newMessage("status_"+strconv.Itoa(status), text)
+		}
+	}
+	return titles
+}
+
+// statusTitle returns the title of a problem with status
+func statusTitle(status int) Message {
+	if title, ok := statusTitles[status]; ok {
+		return title
+	}
+	return statusTitles[http.StatusInternalServerError]
+}
+
+// Catalogs by language, loaded once from localeFiles
+var catalogs = mustLoadCatalogs()
+
+// mustLoadCatalogs reads the embedded catalogs. They are part of the binary,
+// so one that doesn't parse is a bug and stops the service from starting.
+func mustLoadCatalogs() map[string]map[string]string {
+	catalogs, err := loadCatalogs(localeFiles)
+	if err != nil {
+		panic("message catalogs: " + err.Error())
+	}
+	return catalogs
+}
+
+func loadCatalogs(files fs.FS) (map[string]map[string]string, error) {
+	names, err := fs.Glob(files, "locales/*.json")
+	if err != nil {
+		return nil, err
+	}
+	catalogs := map[string]map[string]string{}
+	for _, name := range names {
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, err
+		}
+		var translations map[string]string
+		if err := json.Unmarshal(data, &translations); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		catalogs[strings.TrimSuffix(path.Base(name), ".json")] = translations
+	}
+	return catalogs, nil
+}
+
+// acceptedLanguage picks the language to answer the request in from its
+// Accept-Language header: the first of the ranges, most preferred first, that
+// names a catalog's language, trying a regional range's language after the
+// range itself (de-AT, then de). English is the default.
+func acceptedLanguage(r *http.Request) string {
+	type languageRange struct {
+		tag     string
+		quality float64
+	}
+	var ranges []languageRange
+	for _, part := range strings.Split(strings.Join(r.Header.Values("Accept-Language"), ","), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if tag == "" || quality <= 0 {
+			continue
+		}
+		ranges = append(ranges, languageRange{strings.ToLower(tag), quality})
+	}
+	slices.SortStableFunc(ranges, func(a, b languageRange) int { return cmp.Compare(b.quality, a.quality) })
+
+	for _, accepted := range ranges {
+		for tag := accepted.tag; tag != ""; {
+			if tag == defaultLanguage || catalogs[tag] != nil {
+				return tag
+			}
+			i := strings.LastIndex(tag, "-")
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	return defaultLanguage
+}
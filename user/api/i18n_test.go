@@ -0,0 +1,113 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+// Verbs standing for a value in a message's text
+var messageVerb = regexp.MustCompile(`%[dsqv]`)
+
+// Every message is declared as a package variable, so by the time tests run
+// messageTexts holds each one the service can write
+func TestCatalogsTranslateEveryMessage(t *testing.T) {
+	if len(catalogs) == 0 {
+		t.Fatal("no catalogs loaded")
+	}
+	for lang, catalog := range catalogs {
+		for id, text := range messageTexts {
+			translation, ok := catalog[id]
+			if !ok {
+				t.Errorf("%s: no translation of %s (%q)", lang, id, text)
+				continue
+			}
+			if verbs, translated := messageVerb.FindAllString(text, -1), messageVerb.FindAllString(translation, -1); !slices.Equal(verbs, translated) {
+				t.Errorf("%s: %s has values %q, want %q as in %q", lang, id, translated, verbs, text)
+			}
+		}
+		for id := range catalog {
+			if _, ok := messageTexts[id]; !ok {
+				t.Errorf("%s: %s is no message the service writes", lang, id)
+			}
+		}
+	}
+}
+
+func TestMessageIn(t *testing.T) {
+	tests := []struct {
+		name    string
+		message Message
+		lang    string
+		want    string
+	}{
+		{name: "English", message: msgUserNotFound, lang: defaultLanguage, want: "User not found"},
+		{name: "translated", message: msgUserNotFound, lang: "de", want: "Benutzer nicht gefunden"},
+		{name: "no catalog", message: msgUserNotFound, lang: "pt", want: "User not found"},
+		{name: "value", message: msgMaxLength.with(64), lang: "de", want: "darf höchstens 64 Zeichen lang sein"},
+		{name: "message value", message: msgDependencyTimedOut.with(msgErrorFetchingUsers), lang: "de", want: "Fehler beim Abrufen der Benutzer: Zeitüberschreitung"},
+		// A path that reads like a message stays as the client sent it
+		{name: "user input", message: msgNoRoute.with("User not found"), lang: "de", want: "Keine Route für User not found"},
+		{name: "verb in user input", message: msgNoRoute.with("/%s%d"), lang: "de", want: "Keine Route für /%s%d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.message.in(tt.lang); got != tt.want {
+				t.Errorf("in(%q) = %q, want %q", tt.lang, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProblemsInRequestLanguage(t *testing.T) {
+	tests := []struct {
+		name          string
+		acceptLang    string
+		write         func(w http.ResponseWriter, r *http.Request)
+		wantLang      string
+		wantTitle     string
+		wantDetail    string
+		wantFieldText string
+	}{
+		{name: "default", write: func(w http.ResponseWriter, r *http.Request) {
+			writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		}, wantLang: "en", wantTitle: "Not Found", wantDetail: "User not found"},
+		{name: "regional range", acceptLang: "de-AT, en;q=0.5", write: func(w http.ResponseWriter, r *http.Request) {
+			writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		}, wantLang: "de", wantTitle: "Nicht gefunden", wantDetail: "Benutzer nicht gefunden"},
+		{name: "preferred by quality", acceptLang: "de;q=0.2, fr", write: func(w http.ResponseWriter, r *http.Request) {
+			writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		}, wantLang: "fr", wantTitle: "Introuvable", wantDetail: "Utilisateur introuvable"},
+		{name: "field messages", acceptLang: "de", write: func(w http.ResponseWriter, r *http.Request) {
+			var errs validationErrors
+			errs.check("email", validateEmail("bob"))
+			writeValidationErrors(w, r, errs)
+		}, wantLang: "de", wantTitle: "Nicht verarbeitbare Anfrage", wantDetail: "Validierung fehlgeschlagen", wantFieldText: "muss eine gültige E-Mail-Adresse sein"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptLang != "" {
+				req.Header.Set("Accept-Language", tt.acceptLang)
+			}
+			rec := httptest.NewRecorder()
+			tt.write(rec, req)
+
+			if lang := rec.Header().Get("Content-Language"); lang != tt.wantLang {
+				t.Errorf("Content-Language = %q, want %q", lang, tt.wantLang)
+			}
+			problem := decodeProblem(t, rec)
+			if problem.Title != tt.wantTitle || problem.Detail != tt.wantDetail {
+				t.Errorf("title, detail = %q, %q; want %q, %q", problem.Title, problem.Detail, tt.wantTitle, tt.wantDetail)
+			}
+			if tt.wantFieldText == "" {
+				return
+			}
+			if len(problem.Fields) != 1 || problem.Fields[0].Message != tt.wantFieldText {
+				t.Errorf("fields = %+v, want one saying %q", problem.Fields, tt.wantFieldText)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"user/user/store"
+)
+
+// Longest Idempotency-Key accepted
+const maxIdempotencyKeyLength = 255
+
+// Response headers stored with an idempotent response and replayed with it
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// idempotencyMiddleware makes retrying a request with an Idempotency-Key header
+// safe: the first request with a key runs and its response is kept for ttl, and
+// retries with the key get that response back instead of running again, so they
+// don't upload or publish anything twice. Keys are per tenant and caller, and
+// identify the request on their own: reusing one for a different request replays
+// the first response too. Server errors aren't kept, so a request that failed
+// may be retried with the same key. A request holds its key for at most lease
+// before a retry may take it over, in case the instance running it died.
+func idempotencyMiddleware(userStore store.IdempotencyStore, ttl, lease time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				writeProblem(w, r, http.StatusBadRequest, msgIdempotencyKeyLength)
+				return
+			}
+
+			ctx := r.Context()
+			hash := idempotencyKeyHash(tenantFromContext(ctx), principalFromContext(ctx).credential(), key)
+			stored, err := userStore.ReserveIdempotencyKey(ctx, hash, time.Now().Add(lease))
+			if errors.Is(err, store.ErrIdempotencyKeyInUse) {
+				w.Header().Set("Retry-After", "1")
+				writeProblem(w, r, http.StatusConflict, msgIdempotencyKeyInUse)
+				return
+			}
+			if err != nil {
+				dbError(w, r, err, msgErrorIdempotencyKey)
+				return
+			}
+			if stored != nil {
+				for name, values := range stored.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+				return
+			}
+
+			// The key is released unless the response gets stored, panics included
+			kept := false
+			defer func() {
+				if kept {
+					return
+				}
+				if err := userStore.ReleaseIdempotencyKey(context.WithoutCancel(ctx), hash); err != nil {
+					slog.ErrorContext(ctx, "Error releasing idempotency key", "error", err)
+				}
+			}()
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			if rec.status >= 500 {
+				return
+			}
+
+			response := store.IdempotentResponse{Status: rec.status, Header: http.Header{}, Body: rec.body.Bytes()}
+			for _, name := range replayedHeaders {
+				if values := w.Header().Values(name); len(values) > 0 {
+					response.Header[name] = values
+				}
+			}
+			// A key that can't be stored stays reserved until its lease runs out,
+			// rather than letting a retry repeat what this request did
+			kept = true
+			if err := userStore.CompleteIdempotencyKey(context.WithoutCancel(ctx), hash, response, time.Now().Add(ttl)); err != nil {
+				slog.ErrorContext(ctx, "Error storing idempotent response", "error", err)
+			}
+		})
+	}
+}
+
+// idempotencyKeyHash identifies key among those of every tenant and caller,
+// the caller being the credential it presented, so holders of different
+// configured keys don't share keys
+func idempotencyKeyHash(tenant, caller, key string) []byte {
+	sum := sha256.Sum256([]byte(tenant + "\x00" + caller + "\x00" + key))
+	return sum[:]
+}
+
+// responseRecorder captures the status and body written by a handler while
+// passing them on
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
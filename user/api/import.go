@@ -0,0 +1,275 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"user/user/events"
+	"user/user/store"
+)
+
+// CSV import tuning
+const (
+	importBatchSize         = 500  // Rows inserted per transaction, and between progress updates
+	maxImportErrorsReported = 1000 // Failed rows listed in the response; the counts cover them all
+)
+
+// Columns an import CSV may have, found by the names in its header row
+var importCSVColumns = []string{"name", "email", "link", "metadata"}
+
+// One row of a CSV import that wasn't imported
+type importRowError struct {
+	Line  int    `json:"line"` // Line of the CSV, the header being line 1
+	Email string `json:"email,omitempty"`
+	Error string `json:"error"`
+}
+
+// importColumns maps the known columns in a CSV header to their indexes,
+// requiring name and email
+func importColumns(header []string) (map[string]int, error) {
+	columns := map[string]int{}
+	for i, name := range header {
+		if i == 0 {
+			// Spreadsheets like to start their CSVs with a byte order mark
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(importCSVColumns, name) {
+			return nil, msgUnknownColumn.with(name, strings.Join(importCSVColumns, ", "))
+		}
+		if _, ok := columns[name]; ok {
+			return nil, msgDuplicateColumn.with(name)
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, msgNameColumnRequired
+	}
+	if _, ok := columns["email"]; !ok {
+		return nil, msgEmailColumnRequired
+	}
+	return columns, nil
+}
+
+// openImportCSV returns the CSV of an import and its file name, if any: the body
+// itself for text/csv, or the file part of a multipart form, read as it arrives
+func openImportCSV(r *http.Request) (io.Reader, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return r.Body, "", nil
+	case "multipart/form-data":
+		parts, err := r.MultipartReader()
+		if err != nil {
+			return nil, "", err
+		}
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				return nil, "", msgNoFilePart
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			if part.FormName() == "file" {
+				return part, truncate(part.FileName(), 255), nil
+			}
+		}
+	}
+	return nil, "", msgImportContentType
+}
+
+// API to Import Users from CSV (POST /users/import)
+//
+// Takes a CSV with a header row naming its columns, of which name and email are
+// required, as the body or the file of a multipart form. Rows are read as they
+// arrive and inserted in batches, so files of any size take little memory. Bad
+// rows are skipped and reported; the import job records the progress for GET
+// /users/import/{id} meanwhile.
+func (h *handler) importUsers(w http.ResponseWriter, r *http.Request) {
+	body, filename, err := openImportCSV(r)
+	if err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		}
+		return
+	}
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		writeProblem(w, r, http.StatusBadRequest, msgCSVEmpty)
+		return
+	}
+	if err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidCSVHeader.with(err.Error()))
+		}
+		return
+	}
+	columns, err := importColumns(header)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidCSVHeader.with(messageOf(err)))
+		return
+	}
+
+	tenant := tenantFromContext(r.Context())
+	job, err := h.importJobs.CreateImportJob(r.Context(), store.ImportJob{TenantID: tenant, Status: store.ImportRunning, Filename: filename})
+	if err != nil {
+		dbError(w, r, err, msgErrorCreatingImportJob)
+		return
+	}
+	// The job is settled even if the client goes away
+	jobCtx := context.WithoutCancel(r.Context())
+	var rowErrors []importRowError
+	reject := func(line int, email, message string) {
+		job.Failed++
+		if len(rowErrors) < maxImportErrorsReported {
+			rowErrors = append(rowErrors, importRowError{Line: line, Email: email, Error: message})
+		}
+	}
+	var batch []store.User
+	var lines []int
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		results := make([]store.BulkResult, len(batch))
+		if err := h.users.BulkCreateUsers(store.WithOutboxEvent(r.Context(), events.UserCreated), tenant, batch, results, false); err != nil {
+			return err
+		}
+		for i, result := range results {
+			if result.Failed() {
+				failure, _ := bulkFailure(result.Err)
+				reject(lines[i], batch[i].Email, failure.String())
+			} else {
+				job.Created++
+			}
+		}
+		batch, lines = batch[:0], lines[:0]
+		if err := h.importJobs.UpdateImportJob(jobCtx, job); err != nil {
+			slog.WarnContext(r.Context(), "Error saving import progress", "job_id", job.ID, "error", err)
+		}
+		return nil
+	}
+	fail := func(err error, message string) {
+		slog.ErrorContext(r.Context(), "Import failed", "job_id", job.ID, "error", err)
+		job.Status, job.Error = store.ImportFailed, message
+		if err := h.importJobs.UpdateImportJob(jobCtx, job); err != nil {
+			slog.ErrorContext(r.Context(), "Error saving failed import", "job_id", job.ID, "error", err)
+		}
+	}
+
+	field := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			job.Rows++
+			reject(parseErr.StartLine, "", parseErr.Err.Error())
+			continue
+		}
+		if err != nil {
+			fail(err, "Reading the upload failed after "+strconv.Itoa(job.Rows)+" rows")
+			if !rejectOversizedBody(w, r, err) {
+				writeProblem(w, r, http.StatusBadRequest, msgErrorReadingCSV)
+			}
+			return
+		}
+		job.Rows++
+		line, _ := reader.FieldPos(0)
+
+		user := store.User{Name: field(record, "name"), Email: field(record, "email"), Link: field(record, "link"), TenantID: tenant}
+		user.Metadata, err = parseMetadataForm(field(record, "metadata"))
+		if err != nil {
+			reject(line, user.Email, "metadata "+err.Error())
+			continue
+		}
+		if err := validateBulkUser(user, h.config); err != nil {
+			reject(line, user.Email, err.Error())
+			continue
+		}
+		batch, lines = append(batch, user), append(lines, line)
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				fail(err, "Inserting users failed after "+strconv.Itoa(job.Rows)+" rows")
+				dbError(w, r, err, msgErrorImportingUsers)
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		fail(err, "Inserting users failed after "+strconv.Itoa(job.Rows)+" rows")
+		dbError(w, r, err, msgErrorImportingUsers)
+		return
+	}
+
+	job.Status = store.ImportCompleted
+	if err := h.importJobs.UpdateImportJob(jobCtx, job); err != nil {
+		slog.ErrorContext(r.Context(), "Error saving finished import", "job_id", job.ID, "error", err)
+	}
+	if rowErrors == nil {
+		rowErrors = []importRowError{}
+	}
+	// Rows failing the insert are only known a batch later than the rest
+	slices.SortFunc(rowErrors, func(a, b importRowError) int { return cmp.Compare(a.Line, b.Line) })
+	json.NewEncoder(w).Encode(map[string]any{
+		"job":             job,
+		"errors":          rowErrors,
+		"errorsTruncated": job.Failed > len(rowErrors),
+	})
+}
+
+// API to Check an Import (GET /users/import/{id})
+func (h *handler) getImportJob(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidImportJobID)
+		return
+	}
+	job, err := h.importJobs.GetImportJob(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrImportNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgImportJobNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingImportJob)
+		return
+	}
+	json.NewEncoder(w).Encode(job)
+}
+
+// API to List Imports (GET /users/import[?limit=])
+//
+// Newest first, running ones included.
+func (h *handler) listImportJobs(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	list, err := h.importJobs.ListImportJobs(r.Context(), tenantFromContext(r.Context()), limit)
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingImportJobs)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+// Allowance for clock skew before an unfinished job counts as interrupted
+const creationJobGrace = time.Minute
+
+// prefersAsync reports whether the request asks not to wait for the outcome,
+// with Prefer: respond-async (RFC 7240)
+func prefersAsync(r *http.Request) bool {
+	for _, value := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(value, ",") {
+			token, _, _ := strings.Cut(preference, ";")
+			if strings.EqualFold(strings.TrimSpace(token), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// creationQueue creates users in the background on a fixed pool of workers.
+// Jobs live only in memory until a worker takes them; one an instance didn't
+// get to before it stopped is reported failed once its time is up.
+type creationQueue struct {
+	jobs    store.CreationJobStore
+	create  func(w http.ResponseWriter, r *http.Request, input newUserInput) // createUserFrom, bound to its stores
+	tasks   chan creationTask
+	timeout time.Duration // From a job's creation to its end, its wait for a worker included
+}
+
+// creationTask is a job waiting for a worker, with the request it came from
+type creationTask struct {
+	job      store.CreationJob
+	r        *http.Request // Detached from the connection, which is gone by the time it runs
+	input    newUserInput
+	deadline time.Time
+}
+
+func newCreationQueue(cfg config.Config, jobs store.CreationJobStore, create func(w http.ResponseWriter, r *http.Request, input newUserInput)) *creationQueue {
+	return &creationQueue{
+		jobs:    jobs,
+		create:  create,
+		tasks:   make(chan creationTask, cfg.AsyncCreation.QueueSize),
+		timeout: config.Seconds(cfg.Server.UploadTimeoutSeconds),
+	}
+}
+
+// run works through queued creations until ctx is done, finishing the one in hand
+func (q *creationQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case task := <-q.tasks:
+			q.process(task)
+		}
+	}
+}
+
+// process runs one creation and records its outcome on the job
+func (q *creationQueue) process(task creationTask) {
+	ctx, cancel := context.WithDeadline(task.r.Context(), task.deadline)
+	defer cancel()
+	job := task.job
+	if ctx.Err() != nil {
+		q.finish(ctx, job, store.JobFailed, nil, "Timed out waiting for a worker")
+		return
+	}
+	job.Status = store.JobRunning
+	if err := q.jobs.UpdateCreationJob(ctx, job); err != nil {
+		slog.WarnContext(ctx, "Error marking creation job running", "job_id", job.ID, "error", err)
+	}
+
+	rec := &jobResponse{header: http.Header{}}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			slog.ErrorContext(ctx, "Creation job panicked", "job_id", job.ID, "panic", recovered, "stack", string(debug.Stack()))
+			q.finish(ctx, job, store.JobFailed, nil, "Internal server error")
+		}
+	}()
+	q.create(rec, task.r.WithContext(ctx), task.input)
+	status, userID, message := rec.outcome()
+	q.finish(ctx, job, status, userID, message)
+}
+
+// finish saves a job's outcome, even past its deadline
+func (q *creationQueue) finish(ctx context.Context, job store.CreationJob, status string, userID *int64, message string) {
+	job.Status, job.UserID, job.Error = status, userID, message
+	if err := q.jobs.UpdateCreationJob(context.WithoutCancel(ctx), job); err != nil {
+		slog.ErrorContext(ctx, "Error saving finished creation job", "job_id", job.ID, "status", status, "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "Creation job finished", "job_id", job.ID, "status", status, "user_id", deref(userID), "error", message)
+}
+
+// jobResponse collects the response the create steps write, which becomes the
+// job's outcome
+type jobResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *jobResponse) Header() http.Header {
+	return rec.header
+}
+
+func (rec *jobResponse) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+}
+
+func (rec *jobResponse) Write(p []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(p)
+}
+
+// outcome reads the job's status, user and error from the response: the user
+// created on success, the problem's detail otherwise
+func (rec *jobResponse) outcome() (string, *int64, string) {
+	if rec.status < 300 {
+		var created struct {
+			User struct {
+				ID int64 `json:"id"`
+			} `json:"user"`
+		}
+		if err := json.Unmarshal(rec.body.Bytes(), &created); err != nil || created.User.ID == 0 {
+			return store.JobFailed, nil, "The user's ID couldn't be read from the result"
+		}
+		return store.JobSucceeded, &created.User.ID, ""
+	}
+	var problem Problem
+	json.Unmarshal(rec.body.Bytes(), &problem)
+	return store.JobFailed, nil, cmp.Or(problem.Detail, http.StatusText(rec.status))
+}
+
+// API to Create a User in the Background (POST /users with Prefer: respond-async)
+//
+// The input is read and validated as for createUser, so a bad request still
+// fails at once. The rest, uploading and scanning the photo included, is left
+// to a creation worker, and the 202 points at GET /jobs/{id} for the outcome.
+// A full queue is answered 503 with a Retry-After.
+func (h *handler) createUserAsync(w http.ResponseWriter, r *http.Request) {
+	input, ok := readNewUser(w, r, h.config)
+	if !ok {
+		return
+	}
+	if input.Photo != nil {
+		// The form, and any temporary file behind it, is gone once the handler returns
+		data, err := io.ReadAll(input.Photo)
+		if closer, ok := input.Photo.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidFileUpload)
+			return
+		}
+		input.Photo = bytes.NewReader(data)
+	}
+
+	job, err := h.creations.jobs.CreateCreationJob(r.Context(), store.CreationJob{TenantID: tenantFromContext(r.Context()), Status: store.JobPending})
+	if err != nil {
+		dbError(w, r, err, msgErrorCreatingJob)
+		return
+	}
+	// The request keeps its tenant, caller and trace for the worker
+	detached := r.Clone(context.WithoutCancel(r.Context()))
+	detached.Body = http.NoBody
+	select {
+	case h.creations.tasks <- creationTask{job: job, r: detached, input: input, deadline: time.Now().Add(h.creations.timeout)}:
+	default:
+		h.creations.finish(r.Context(), job, store.JobFailed, nil, "Too many creations were queued")
+		w.Header().Set("Retry-After", unavailableRetryAfter)
+		writeProblem(w, r, http.StatusServiceUnavailable, msgTooManyCreations)
+		return
+	}
+
+	w.Header().Set("Location", versionedPath(apiV1, "/jobs/"+strconv.FormatInt(job.ID, 10)))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// API to Check a Creation Job (GET /jobs/{id})
+//
+// A job still unfinished well after its deadline was lost with the instance
+// working it, and is reported failed.
+func (h *handler) getCreationJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["job"], 10, 64)
+	if err != nil || id <= 0 {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidJobID)
+		return
+	}
+	job, err := h.creations.jobs.GetCreationJob(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrJobNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgJobNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingJob)
+		return
+	}
+	if (job.Status == store.JobPending || job.Status == store.JobRunning) && time.Since(job.CreatedAt) > h.creations.timeout+creationJobGrace {
+		job.Status, job.Error = store.JobFailed, "Interrupted before it finished"
+	}
+	json.NewEncoder(w).Encode(job)
+}
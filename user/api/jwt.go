@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"user/user/config"
+)
+
+// JWKS caching
+const (
+	jwksMaxAge       = time.Hour        // Keys are refetched at least this often
+	jwksMinRefresh   = time.Minute      // An unknown kid refetches no more often than this
+	jwksFetchTimeout = 10 * time.Second // Bound on a single JWKS request
+	jwtLeeway        = 30 * time.Second // Clock skew tolerated on exp and nbf
+)
+
+// Signing algorithms accepted on bearer JWTs; symmetric ones are never valid
+// against published keys
+var jwtAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// jwtVerifier validates bearer JWTs against the configured issuers and audiences,
+// using the signing keys published at a JWKS URL
+type jwtVerifier struct {
+	issuers   []string // Any of these is accepted
+	audiences []string // The token must be for one of these
+	jwksURL   string
+	adminRole string
+	client    *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]any // Public keys by kid
+	fetched time.Time
+}
+
+func newJWTVerifier(cfg config.Config) *jwtVerifier {
+	return &jwtVerifier{
+		issuers:   []string{cfg.Auth.JWT.Issuer},
+		audiences: []string{cfg.Auth.JWT.Audience},
+		jwksURL:   cfg.Auth.JWT.JWKSURL,
+		adminRole: cfg.Auth.JWT.AdminRole,
+		client:    &http.Client{Timeout: jwksFetchTimeout},
+	}
+}
+
+// Microsoft identity platform endpoint Entra ID tokens are issued from
+const entraAuthority = "https://login.microsoftonline.com/"
+
+// newEntraVerifier validates Entra ID access tokens issued by the configured
+// tenant for the configured app registration. Both v1 and v2 tokens are
+// accepted, since which one a client gets depends on the API's manifest.
+func newEntraVerifier(cfg config.Config) *jwtVerifier {
+	tenant, clientID := cfg.Auth.Entra.TenantID, cfg.Auth.Entra.ClientID
+	return &jwtVerifier{
+		issuers:   []string{entraAuthority + tenant + "/v2.0", "https://sts.windows.net/" + tenant + "/"},
+		audiences: []string{clientID, "api://" + clientID},
+		jwksURL:   entraAuthority + tenant + "/discovery/v2.0/keys",
+		adminRole: cfg.Auth.Entra.AdminRole,
+		client:    &http.Client{Timeout: jwksFetchTimeout},
+	}
+}
+
+// verify checks the token's signature and registered claims, returning the
+// principal it describes
+func (v *jwtVerifier) verify(ctx context.Context, token string) (Principal, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, kid)
+	},
+		jwt.WithValidMethods(jwtAlgorithms),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway),
+	)
+	if err != nil {
+		return Principal{}, err
+	}
+	if issuer, _ := claims.GetIssuer(); !slices.Contains(v.issuers, issuer) {
+		return Principal{}, fmt.Errorf("unexpected issuer %q", issuer)
+	}
+	audiences, _ := claims.GetAudience()
+	if !slices.ContainsFunc(audiences, func(aud string) bool { return slices.Contains(v.audiences, aud) }) {
+		return Principal{}, fmt.Errorf("token is not for this audience")
+	}
+
+	subject, _ := claims.GetSubject()
+	principal := Principal{Subject: subject, Claims: claims}
+	if v.adminRole != "" {
+		roles, _ := claims["roles"].([]any)
+		principal.Admin = slices.Contains(roles, any(v.adminRole))
+	}
+	return principal, nil
+}
+
+// key returns the public key with the given kid, refetching the key set when
+// it is stale or doesn't know the kid yet
+func (v *jwtVerifier) key(ctx context.Context, kid string) (any, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.keys[kid]
+	age := time.Since(v.fetched)
+	if (!ok && age > jwksMinRefresh) || age > jwksMaxAge {
+		keys, err := v.fetch(ctx)
+		if err != nil {
+			// Keep using the keys we have rather than locking everyone out
+			slog.ErrorContext(ctx, "Error fetching JWKS", "url", v.jwksURL, "error", err)
+		} else {
+			v.keys, v.fetched = keys, time.Now()
+			key, ok = keys[kid]
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// A JSON Web Key, with the members needed for RSA and EC public keys
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch downloads the key set, skipping keys that aren't usable signing keys
+func (v *jwtVerifier) fetch(ctx context.Context) (map[string]any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			slog.WarnContext(ctx, "Skipping JWKS key", "kid", jwk.Kid, "error", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// publicKey decodes the RSA or EC public key the JWK describes
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// decodeJWKInt decodes a base64url unsigned big-endian integer
+func decodeJWKInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// looksLikeJWT reports whether a bearer token has the three-part compact JWS
+// shape, as opposed to an opaque API key
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
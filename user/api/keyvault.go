@@ -0,0 +1,263 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+
+	"user/user/config"
+)
+
+// Settings given as keyvault://<vault>/<secret>[/<version>] are read from Key
+// Vault at startup, in place of putting the secret itself in config.json or
+// the environment. <vault> is the vault's name, or its host outside the
+// public cloud; without a version the secret's current one is used.
+const keyVaultScheme = "keyvault://"
+
+// How long reading the referenced secrets may take at startup, and each refresh
+const keyVaultTimeout = 30 * time.Second
+
+// secretRef is a parsed keyvault:// reference
+type secretRef struct {
+	vault   string
+	name    string
+	version string
+}
+
+func parseSecretRef(s string) (secretRef, error) {
+	parts := strings.Split(strings.TrimPrefix(s, keyVaultScheme), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return secretRef{}, fmt.Errorf("want %s<vault>/<secret>[/<version>], got %q", keyVaultScheme, s)
+	}
+	ref := secretRef{vault: parts[0], name: parts[1]}
+	if len(parts) == 3 {
+		ref.version = parts[2]
+	}
+	return ref, nil
+}
+
+// vaultURL is the vault's address, on the public cloud unless given as a host
+func (r secretRef) vaultURL() string {
+	if strings.Contains(r.vault, ".") {
+		return "https://" + r.vault
+	}
+	return "https://" + r.vault + ".vault.azure.net"
+}
+
+// SecretsProvider reads the keyvault:// references in the configuration with
+// the service's identity, as azure.auth default_credential does, so a managed
+// identity needs only get permission on the secrets. Each secret is read once
+// however many settings name it.
+type SecretsProvider struct {
+	mu       sync.Mutex
+	clients  map[string]*azsecrets.Client // By vault URL
+	cache    map[secretRef]string
+	settings map[string]secretRef          // By setting path, e.g. database.connection_string
+	onRotate map[string]func(value string) // By setting path, for settings that take a new value without a restart
+}
+
+// ResolveSecrets replaces each keyvault:// setting in config with the secret
+// it names, returning the provider that keeps them fresh
+func ResolveSecrets(cfg *config.Config) (*SecretsProvider, error) {
+	p := &SecretsProvider{
+		clients:  map[string]*azsecrets.Client{},
+		cache:    map[secretRef]string{},
+		settings: map[string]secretRef{},
+		onRotate: map[string]func(string){},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), keyVaultTimeout)
+	defer cancel()
+	if err := p.resolve(ctx, reflect.ValueOf(cfg).Elem(), ""); err != nil {
+		return nil, err
+	}
+	if len(p.settings) > 0 {
+		slog.Info("Read settings from Key Vault", "settings", len(p.settings), "secrets", len(p.cache))
+	}
+	return p, nil
+}
+
+// resolve replaces the references in v, a setting at path or a group of them
+func (p *SecretsProvider) resolve(ctx context.Context, v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.String:
+		if !strings.HasPrefix(v.String(), keyVaultScheme) {
+			return nil
+		}
+		ref, err := parseSecretRef(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		value, err := p.get(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		p.settings[path] = ref
+		v.SetString(value)
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return p.resolve(ctx, v.Elem(), path)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "" || name == "-" || !field.IsExported() {
+				continue
+			}
+			if err := p.resolve(ctx, v.Field(i), joinSettingPath(path, name)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			if err := p.resolve(ctx, v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Map values can't be set in place, so each is copied, resolved and put back
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			if err := p.resolve(ctx, value, joinSettingPath(path, fmt.Sprint(key.Interface()))); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	}
+	return nil
+}
+
+func joinSettingPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// get returns the secret ref names, reading it from its vault unless it has been already
+func (p *SecretsProvider) get(ctx context.Context, ref secretRef) (string, error) {
+	p.mu.Lock()
+	value, ok := p.cache[ref]
+	p.mu.Unlock()
+	if ok {
+		return value, nil
+	}
+	value, err := p.read(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	p.cache[ref] = value
+	p.mu.Unlock()
+	return value, nil
+}
+
+// read fetches the secret ref names from Key Vault, bypassing the cache
+func (p *SecretsProvider) read(ctx context.Context, ref secretRef) (string, error) {
+	client, err := p.client(ref.vaultURL())
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.GetSecret(ctx, ref.name, ref.version, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %s from %s: %w", ref.name, ref.vault, err)
+	}
+	if resp.Value == nil {
+		return "", fmt.Errorf("secret %s in %s has no value", ref.name, ref.vault)
+	}
+	return *resp.Value, nil
+}
+
+func (p *SecretsProvider) client(vaultURL string) (*azsecrets.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if client, ok := p.clients[vaultURL]; ok {
+		return client, nil
+	}
+	credential, err := config.AzureCredential()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get an Azure credential for Key Vault: %w", err)
+	}
+	client, err := azsecrets.NewClient(vaultURL, credential, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the Key Vault client for %s: %w", vaultURL, err)
+	}
+	p.clients[vaultURL] = client
+	return client, nil
+}
+
+// HandleRotation has fn apply a new value of the setting at path once its
+// secret rotates. Other settings only take a rotated secret on restart.
+func (p *SecretsProvider) HandleRotation(path string, fn func(value string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onRotate[path] = fn
+}
+
+// run reads unversioned references again every interval until ctx is done, so
+// secrets rotated in Key Vault reach the settings that can take them
+func (p *SecretsProvider) run(ctx context.Context, interval time.Duration) {
+	if len(p.settings) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.refresh(ctx)
+		}
+	}
+}
+
+// refresh rereads each unversioned secret once, calling the rotation handlers
+// of the settings whose secret changed
+func (p *SecretsProvider) refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, keyVaultTimeout)
+	defer cancel()
+	read := map[secretRef]bool{}
+	changed := map[secretRef]string{}
+	for _, ref := range p.settings {
+		if read[ref] || ref.version != "" {
+			continue
+		}
+		read[ref] = true
+		value, err := p.read(ctx, ref)
+		if err != nil {
+			// The value read last stays in use until a refresh succeeds
+			slog.Warn("Failed to refresh a Key Vault secret", "vault", ref.vault, "secret", ref.name, "error", err)
+			continue
+		}
+		p.mu.Lock()
+		previous := p.cache[ref]
+		p.cache[ref] = value
+		p.mu.Unlock()
+		if value != previous {
+			changed[ref] = value
+		}
+	}
+	for path, ref := range p.settings {
+		value, ok := changed[ref]
+		if !ok {
+			continue
+		}
+		p.mu.Lock()
+		fn := p.onRotate[path]
+		p.mu.Unlock()
+		if fn == nil {
+			slog.Warn("Key Vault secret rotated; restart to apply it", "setting", path, "secret", ref.name)
+			continue
+		}
+		slog.Info("Key Vault secret rotated", "setting", path, "secret", ref.name)
+		fn(value)
+	}
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"user/user/telemetry"
+)
+
+// Request classes capped separately, also the values of the class label
+const (
+	requestClassAll    = "all"    // Every request but the probes and /metrics
+	requestClassUpload = "upload" // Photo uploads and other requests with a large body
+)
+
+// inFlightCap sheds requests beyond a number in flight, answering 503 at once
+// rather than queueing them until latency collapses for everyone
+type inFlightCap struct {
+	class string
+	slots chan struct{}
+}
+
+func newInFlightCap(class string, limit int) *inFlightCap {
+	telemetry.HTTPInFlightRequests.WithLabelValues(class).Set(0)
+	return &inFlightCap{class: class, slots: make(chan struct{}, limit)}
+}
+
+// middleware runs the request in one of the cap's slots, or sheds it if they
+// are all taken. Probes and /metrics are never shed, so an overloaded instance
+// is neither restarted nor lost from view.
+func (c *inFlightCap) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if untracedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case c.slots <- struct{}{}:
+		default:
+			telemetry.HTTPShedRequestsTotal.WithLabelValues(c.class).Inc()
+			w.Header().Set("Retry-After", unavailableRetryAfter)
+			writeProblem(w, r, http.StatusServiceUnavailable, msgServerAtCapacity)
+			return
+		}
+		telemetry.HTTPInFlightRequests.WithLabelValues(c.class).Inc()
+		defer func() {
+			<-c.slots
+			telemetry.HTTPInFlightRequests.WithLabelValues(c.class).Dec()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shedBeyond caps a class of requests at limit in flight; 0 leaves them uncapped
+func shedBeyond(class string, limit int) mux.MiddlewareFunc {
+	if limit <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return newInFlightCap(class, limit).middleware
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+)
+
+// bruteForceGuard counts failed authentication attempts in the database, so
+// every instance sees them, locking accounts and blocking source IPs that fail
+// too often. Blocked IPs are remembered locally so checking them costs no query.
+type bruteForceGuard struct {
+	failures store.AuthFailureStore
+	store    store.UserStore
+	config   config.Config
+	window   time.Duration
+
+	mu      sync.Mutex
+	blocked map[string]time.Time // When each blocked IP may try again
+}
+
+func newBruteForceGuard(cfg config.Config, failures store.AuthFailureStore, store store.UserStore) *bruteForceGuard {
+	return &bruteForceGuard{
+		failures: failures,
+		store:    store,
+		config:   cfg,
+		window:   time.Duration(cfg.Auth.Lockout.WindowMinutes) * time.Minute,
+		blocked:  make(map[string]time.Time),
+	}
+}
+
+// retryAfter reports how long ip remains blocked; 0 if it isn't
+func (g *bruteForceGuard) retryAfter(ip string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until, ok := g.blocked[ip]
+	if !ok {
+		return 0
+	}
+	if time.Now().After(until) {
+		delete(g.blocked, ip)
+		return 0
+	}
+	return time.Until(until)
+}
+
+// fail records a failed attempt from the request's IP, and against userID when
+// it is not 0. Past the thresholds the IP is blocked and the account locked,
+// which revokes its sessions and publishes user.locked. Errors are only logged,
+// so a struggling database doesn't change what the caller sees.
+func (g *bruteForceGuard) fail(r *http.Request, userID int64) {
+	ctx := r.Context()
+	ip := clientIP(r, g.config)
+	counts, err := g.failures.RecordAuthFailure(ctx, userID, ip, time.Now().Add(-g.window))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording failed authentication", "ip", ip, "error", err)
+		return
+	}
+
+	if counts.IP >= g.config.Auth.Lockout.MaxIPFailures {
+		g.mu.Lock()
+		for blockedIP, until := range g.blocked {
+			if time.Now().After(until) {
+				delete(g.blocked, blockedIP)
+			}
+		}
+		g.blocked[ip] = time.Now().Add(g.window)
+		g.mu.Unlock()
+		slog.WarnContext(ctx, "Blocking IP after repeated failed authentication", "ip", ip, "failures", counts.IP)
+	}
+	if userID != 0 && counts.User >= g.config.Auth.Lockout.MaxFailures {
+		g.lock(ctx, userID, counts.User)
+	}
+}
+
+// lock locks the account unless it already is
+func (g *bruteForceGuard) lock(ctx context.Context, userID int64, failures int) {
+	_, err := g.store.LockUser(store.WithOutboxEvent(ctx, events.UserLocked), userID)
+	if errors.Is(err, store.ErrUserNotFound) {
+		return // Already locked, or gone
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error locking user", "user_id", userID, "error", err)
+		return
+	}
+	slog.WarnContext(ctx, "Locked user after repeated failed authentication", "user_id", userID, "failures", failures)
+}
+
+// middleware rejects requests from blocked IPs before any credential is checked
+func (g *bruteForceGuard) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := g.retryAfter(clientIP(r, g.config)); wait > 0 {
+			rejectRateLimited(w, r, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accountLocked rejects a sign-in for a locked user
+func accountLocked(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusLocked, msgAccountLocked)
+}
+
+// API to Unlock a User (POST /users/{id}/unlock)
+//
+// Also forgets the account's failed attempts, so it starts with a clean slate.
+func (h *handler) unlockUser(w http.ResponseWriter, r *http.Request) {
+	if !principalFromContext(r.Context()).Admin {
+		writeProblem(w, r, http.StatusForbidden, msgOnlyAdminsUnlock)
+		return
+	}
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+
+	user, err := h.users.UnlockUser(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgLockedUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorUnlockingUser)
+		return
+	}
+	json.NewEncoder(w).Encode(h.links.user(user))
+}
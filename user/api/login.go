@@ -0,0 +1,30 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"user/user/store"
+)
+
+// API to Record a Login (POST /users/{id}/touch)
+func (h *handler) touchUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+
+	lastLoginAt, err := h.users.TouchUser(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorRecordingLogin)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]time.Time{"lastLoginAt": lastLoginAt})
+}
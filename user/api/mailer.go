@@ -0,0 +1,206 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+
+	"user/user/config"
+)
+
+// Mail provider APIs
+const (
+	acsEmailAPIVersion = "2023-03-31"
+	acsTokenScope      = "https://communication.azure.com/.default"
+	sendGridSendURL    = "https://api.sendgrid.com/v3/mail/send"
+	mailSendTimeout    = 30 * time.Second
+)
+
+// ErrMailRejected marks a message the provider refused for good, which sending
+// again won't change
+var ErrMailRejected = errors.New("mail rejected")
+
+// MailMessage is a plain-text email
+type MailMessage struct {
+	ID      string // Same for every attempt at the message, so providers that can drop repeats do; optional
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails to users
+type Mailer interface {
+	Send(ctx context.Context, message MailMessage) error
+}
+
+// newMailer returns the mailer config.Mail.Provider names
+func newMailer(cfg config.Config) Mailer {
+	client := &http.Client{Timeout: mailSendTimeout}
+	switch cfg.Mail.Provider {
+	case config.MailProviderSMTP:
+		return smtpMailer{config: cfg}
+	case config.MailProviderACS:
+		return acsMailer{config: cfg, client: client}
+	case config.MailProviderSendGrid:
+		return sendGridMailer{config: cfg, client: client}
+	}
+	return logMailer{}
+}
+
+// logMailer only logs the messages it is given, for development and for
+// deployments that don't send mail yet
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, message MailMessage) error {
+	slog.InfoContext(ctx, "Mail not sent, as mail.provider is log", "to", message.To, "subject", message.Subject, "body", message.Body)
+	return nil
+}
+
+// smtpMailer sends messages through the configured SMTP relay, with STARTTLS
+// when the server offers it
+type smtpMailer struct {
+	config config.Config
+}
+
+func (m smtpMailer) Send(ctx context.Context, message MailMessage) error {
+	settings := m.config.Mail.SMTP
+	var auth smtp.Auth
+	if settings.Username != "" {
+		auth = smtp.PlainAuth("", settings.Username, settings.Password, settings.Host)
+	}
+	// Header injection is ruled out, as emails are validated and subjects are ours
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		m.config.Mail.From, message.To, message.Subject, strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	addr := net.JoinHostPort(settings.Host, strconv.Itoa(settings.Port))
+	if err := smtp.SendMail(addr, auth, m.config.Mail.From, []string{message.To}, []byte(body)); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return nil
+}
+
+// acsMailer sends messages through an Azure Communication Services Email
+// resource, signing requests with its access key or, without a connection
+// string, with a token for the service's identity
+type acsMailer struct {
+	config config.Config
+	client *http.Client
+}
+
+func (m acsMailer) Send(ctx context.Context, message MailMessage) error {
+	endpoint, accessKey := m.config.Mail.ACS.Endpoint, ""
+	if s := m.config.Mail.ACS.ConnectionString; s != "" {
+		parts := config.ParseAzureConnectionString(s)
+		endpoint, accessKey = parts["endpoint"], parts["accesskey"]
+	}
+	body, err := json.Marshal(map[string]any{
+		"senderAddress": m.config.Mail.From,
+		"recipients":    map[string]any{"to": []map[string]string{{"address": message.To}}},
+		"content":       map[string]string{"subject": message.Subject, "plainText": message.Body},
+	})
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/emails:send?api-version="+acsEmailAPIVersion, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if message.ID != "" {
+		// Retries of a message are dropped once one was accepted
+		r.Header.Set("repeatability-request-id", message.ID)
+		r.Header.Set("repeatability-first-sent", time.Now().UTC().Format(http.TimeFormat))
+	}
+	if accessKey != "" {
+		if err := signACSRequest(r, body, accessKey); err != nil {
+			return err
+		}
+	} else {
+		credential, err := config.AzureCredential()
+		if err != nil {
+			return err
+		}
+		token, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{acsTokenScope}})
+		if err != nil {
+			return fmt.Errorf("failed to get a token for Communication Services: %w", err)
+		}
+		r.Header.Set("Authorization", "Bearer "+token.Token)
+	}
+	return sendMailRequest(m.client, r, "Communication Services")
+}
+
+// signACSRequest signs a request with a Communication Services access key:
+// an HMAC-SHA256 over the method, path, date, host and body hash
+func signACSRequest(r *http.Request, body []byte, accessKey string) error {
+	key, err := base64.StdEncoding.DecodeString(accessKey)
+	if err != nil {
+		return errors.New("mail.acs.connection_string has an invalid accesskey")
+	}
+	date := time.Now().UTC().Format(http.TimeFormat)
+	sum := sha256.Sum256(body)
+	contentHash := base64.StdEncoding.EncodeToString(sum[:])
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n" + date + ";" + r.URL.Host + ";" + contentHash))
+	r.Header.Set("x-ms-date", date)
+	r.Header.Set("x-ms-content-sha256", contentHash)
+	r.Header.Set("Authorization", "HMAC-SHA256 SignedHeaders=x-ms-date;host;x-ms-content-sha256&Signature="+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// sendGridMailer sends messages through SendGrid with its API key
+type sendGridMailer struct {
+	config config.Config
+	client *http.Client
+}
+
+func (m sendGridMailer) Send(ctx context.Context, message MailMessage) error {
+	body, err := json.Marshal(map[string]any{
+		"personalizations": []map[string]any{{"to": []map[string]string{{"email": message.To}}}},
+		"from":             map[string]string{"email": m.config.Mail.From},
+		"subject":          message.Subject,
+		"content":          []map[string]string{{"type": "text/plain", "value": message.Body}},
+	})
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, sendGridSendURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+m.config.Mail.SendGrid.APIKey)
+	return sendMailRequest(m.client, r, "SendGrid")
+}
+
+// sendMailRequest makes a provider's send request. Refusals other than
+// throttling and timeouts are ErrMailRejected; the rest may pass on a retry.
+func sendMailRequest(client *http.Client, r *http.Request, provider string) error {
+	resp, err := client.Do(r)
+	if err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("%s answered %d: %s", provider, resp.StatusCode, bytes.TrimSpace(detail))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+		return fmt.Errorf("%w: %w", ErrMailRejected, err)
+	}
+	return fmt.Errorf("failed to send mail: %w", err)
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+
+	"user/user/blob"
+	"user/user/config"
+	"user/user/telemetry"
+)
+
+// Data sent to clamd per INSTREAM chunk
+const clamAVChunkBytes = 64 << 10
+
+// ScanVerdict is what a scanner made of an upload
+type ScanVerdict struct {
+	Infected  bool
+	Signature string // What was found, when infected
+}
+
+// Scanner checks uploaded files for malware before they are stored. Backends
+// that scan blobs after the fact, like Defender for Storage, would poll for the
+// verdict here.
+type Scanner interface {
+	Scan(ctx context.Context, file io.Reader) (ScanVerdict, error)
+}
+
+// NewScanner returns the scanner config.MalwareScan.Provider names
+func NewScanner(cfg config.Config) Scanner {
+	if cfg.MalwareScan.Provider == config.ScanProviderClamAV {
+		return clamAVScanner{
+			address: cfg.MalwareScan.ClamAV.Address,
+			timeout: time.Duration(cfg.MalwareScan.ClamAV.TimeoutSeconds) * time.Second,
+		}
+	}
+	return noScanner{}
+}
+
+// noScanner passes every upload, for deployments that don't scan
+type noScanner struct{}
+
+func (noScanner) Scan(context.Context, io.Reader) (ScanVerdict, error) {
+	return ScanVerdict{}, nil
+}
+
+// clamAVScanner streams uploads to a clamd daemon with its INSTREAM command
+type clamAVScanner struct {
+	address string
+	timeout time.Duration
+}
+
+func (s clamAVScanner) Scan(ctx context.Context, file io.Reader) (ScanVerdict, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return ScanVerdict{}, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanVerdict{}, fmt.Errorf("failed to send to clamd: %w", err)
+	}
+	// Each chunk is prefixed with its length, and a zero length ends the stream
+	chunk := make([]byte, 4+clamAVChunkBytes)
+	for {
+		n, err := io.ReadFull(file, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return ScanVerdict{}, fmt.Errorf("failed to send to clamd: %w", err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return ScanVerdict{}, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanVerdict{}, fmt.Errorf("failed to send to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return ScanVerdict{}, fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	// "stream: OK", "stream: <signature> FOUND" or "<reason> ERROR"
+	result := strings.TrimPrefix(string(bytes.TrimSuffix(reply, []byte{0})), "stream: ")
+	switch {
+	case result == "OK":
+		return ScanVerdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return ScanVerdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return ScanVerdict{}, fmt.Errorf("clamd could not scan the upload: %s", result)
+	}
+}
+
+// scanPhoto runs an upload past the malware scanner before it is stored,
+// putting it in quarantine if flagged. On rejection or failure it writes the
+// error response.
+func (h *handler) scanPhoto(w http.ResponseWriter, r *http.Request, file io.ReadSeeker, original string) bool {
+	switch h.scanner.(type) {
+	case nil, noScanner:
+		return true
+	}
+	ctx, span := telemetry.StartSpan(r.Context(), "malware scan")
+	verdict, err := h.scanner.Scan(ctx, file)
+	span.SetAttributes(attribute.Bool("scan.infected", verdict.Infected))
+	telemetry.EndSpan(span, err)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		telemetry.UploadScansTotal.WithLabelValues("failure").Inc()
+		slog.ErrorContext(r.Context(), "Error scanning upload", "error", err)
+		dependencyError(w, r, err, http.StatusBadGateway, msgErrorScanningUpload)
+		return false
+	}
+	if !verdict.Infected {
+		telemetry.UploadScansTotal.WithLabelValues("clean").Inc()
+		return true
+	}
+
+	telemetry.UploadScansTotal.WithLabelValues("infected").Inc()
+	name := tenantBlobName(tenantFromContext(r.Context()), uuid.NewString())
+	if _, err := blob.Upload(context.WithoutCancel(r.Context()), h.blobs, blob.QuarantineContainer, file, name, original, "application/octet-stream"); err != nil {
+		slog.ErrorContext(r.Context(), "Error quarantining flagged upload", "signature", verdict.Signature, "error", err)
+	}
+	slog.WarnContext(r.Context(), "Upload flagged by malware scan", "signature", verdict.Signature, "container", blob.QuarantineContainer, "blob", name)
+	writeProblem(w, r, http.StatusUnprocessableEntity, msgUploadFlagged)
+	return false
+}
@@ -0,0 +1,322 @@
+package api
+
+// Messages the service writes to clients, by what they are about. Each is
+// translated by its ID in locales/<language>.json; i18n_test.go checks every
+// catalog has every message declared here.
+
+// Requests in general
+var (
+	msgInvalidRequest       = newMessage("invalid_request", "Invalid request")
+	msgInvalidJSON          = newMessage("invalid_json", "Invalid JSON body")
+	msgBodyTooLarge         = newMessage("body_too_large", "Request body too large")
+	msgErrorReadingBody     = newMessage("error_reading_body", "Error reading body")
+	msgInvalidFileUpload    = newMessage("invalid_file_upload", "Invalid file upload")
+	msgInvalidFormData      = newMessage("invalid_form_data", "Invalid form data")
+	msgMissingHeader        = newMessage("missing_header", "Missing %s header")
+	msgContentTypeMustBe    = newMessage("content_type_must_be", "Content-Type must be %s")
+	msgNoRoute              = newMessage("no_route", "No route for %s")
+	msgMethodNotAllowed     = newMessage("method_not_allowed", "Method %s not allowed")
+	msgAcceptableFormats    = newMessage("acceptable_formats", "Acceptable formats are %s")
+	msgInternalError        = newMessage("internal_error", "Internal server error")
+	msgServerAtCapacity     = newMessage("server_at_capacity", "Server is at capacity; retry later")
+	msgTooManyRequests      = newMessage("too_many_requests", "Too many requests")
+	msgParamRequired        = newMessage("param_required", "%s is required")
+	msgPositiveInteger      = newMessage("positive_integer", "%s must be a positive integer")
+	msgTimestampInvalid     = newMessage("timestamp_invalid", "%s must be an RFC 3339 timestamp")
+	msgFieldMessage         = newMessage("field_message", "%s %s") // A field's name, then a field message about it
+	msgInvalidCursor        = newMessage("invalid_cursor", "invalid cursor")
+	msgCursorOtherSort      = newMessage("cursor_other_sort", "cursor was issued for a different sort")
+	msgCursorVersion        = newMessage("cursor_version_unsupported", "unsupported cursor version")
+	msgSortInvalid          = newMessage("sort_invalid", "sort must be one of id, name or createdAt")
+	msgOrderInvalid         = newMessage("order_invalid", "order must be asc or desc")
+	msgUnknownField         = newMessage("unknown_field", "Unknown field %q; fields are %s")
+	msgLastEventIDInvalid   = newMessage("last_event_id_invalid", "Last-Event-ID must be an event ID")
+	msgIdempotencyKeyLength = newMessage("idempotency_key_too_long", "Idempotency-Key must be at most 255 characters")
+	msgIdempotencyKeyInUse  = newMessage("idempotency_key_in_use", "A request with this Idempotency-Key is still in progress")
+	msgErrorIdempotencyKey  = newMessage("error_checking_idempotency_key", "Error checking idempotency key")
+)
+
+// Failed dependencies, each about the message of what failed
+var (
+	msgDatabaseUnavailable    = newMessage("database_unavailable", "Database unavailable")
+	msgDatabaseTimedOut       = newMessage("database_timed_out", "Database timed out")
+	msgDependencyTimedOut     = newMessage("dependency_timed_out", "%s: timed out")
+	msgDependencySaturated    = newMessage("dependency_saturated", "%s: too many requests in progress; retry later")
+	msgDependencyUnavailable  = newMessage("dependency_unavailable", "%s: the service is unavailable; retry later")
+	msgDependencyNoServiceBus = newMessage("dependency_no_service_bus", "%s: Service Bus is off: azure.service_bus_driver is memory")
+)
+
+// Conditional requests
+var (
+	msgIfMatchInvalid   = newMessage("if_match_invalid", "If-Match must hold an ETag returned by this API")
+	msgIfMatchRequired  = newMessage("if_match_required", "If-Match header required")
+	msgVersionRequired  = newMessage("version_required", "If-Match header or version field required")
+	msgStaleUpdate      = newMessage("stale_update", "User was modified since it was read; fetch it again and retry")
+	msgResourceModified = newMessage("resource_modified", "Resource has been modified")
+)
+
+// Authentication and access
+var (
+	msgUnauthorized            = newMessage("unauthorized", "Unauthorized")
+	msgAdminRequired           = newMessage("admin_required", "Admin access required")
+	msgTwoFactorRequired       = newMessage("two_factor_required", "Two-factor code required; verify it at /v1/auth/2fa")
+	msgRecentTwoFactorRequired = newMessage("recent_two_factor_required", "This change needs a two-factor code verified at /v1/auth/2fa within the last %d minutes")
+	msgErrorCheckingAPIKey     = newMessage("error_checking_api_key", "Error checking API key")
+	msgAPIKeyLacksScope        = newMessage("api_key_lacks_scope", "API key lacks the %s scope")
+	msgErrorFetchingCaller     = newMessage("error_fetching_caller", "Error fetching caller")
+	msgOnlyAdminsAccessOthers  = newMessage("only_admins_access_other_users", "Only admins may access other users")
+	msgOnlyAdminsDelete        = newMessage("only_admins_delete_users", "Only admins may delete users")
+	msgOwnUserOnly             = newMessage("own_user_only", "You may only access your own user")
+	msgAccountLocked           = newMessage("account_locked", "Account locked after repeated failed sign-ins; ask an admin to unlock it")
+	msgOnlyAdminsUnlock        = newMessage("only_admins_unlock_users", "Only admins may unlock users")
+	msgLockedUserNotFound      = newMessage("locked_user_not_found", "Locked user not found")
+	msgErrorUnlockingUser      = newMessage("error_unlocking_user", "Error unlocking user")
+	msgTenantMismatch          = newMessage("tenant_mismatch", "%s doesn't match the credential's tenant")
+	msgCredentialUnbound       = newMessage("credential_unbound", "The credential isn't bound to a tenant")
+	msgOnlyAdminsSelectTenant  = newMessage("only_admins_select_tenant", "Only admins may select a tenant")
+	msgInvalidTenantID         = newMessage("invalid_tenant_id", "Invalid tenant ID")
+	msgLoginTenantMismatch     = newMessage("login_tenant_mismatch", "The token's tenant isn't the one logged into")
+)
+
+// API keys
+var (
+	msgAPIKeyNameInvalid    = newMessage("api_key_name_invalid", "name is required and must be at most 255 characters")
+	msgScopesEmpty          = newMessage("scopes_empty", "scopes must not be empty")
+	msgUnknownScope         = newMessage("unknown_scope", "Unknown scope %s; expected %s")
+	msgTenantNeedsTenancy   = newMessage("tenant_needs_tenancy", "tenant needs tenancy enabled")
+	msgAPIKeyTenantRequired = newMessage("api_key_tenant_required", "tenant is required and must be a valid tenant ID")
+	msgErrorGeneratingKey   = newMessage("error_generating_key", "Error generating key")
+	msgErrorSavingAPIKey    = newMessage("error_saving_api_key", "Error saving API key")
+	msgErrorFetchingAPIKeys = newMessage("error_fetching_api_keys", "Error fetching API keys")
+	msgInvalidAPIKeyID      = newMessage("invalid_api_key_id", "invalid api key id")
+	msgAPIKeyNotFound       = newMessage("api_key_not_found", "API key not found or already revoked")
+	msgErrorRevokingAPIKey  = newMessage("error_revoking_api_key", "Error revoking API key")
+)
+
+// Sessions and sign-in
+var (
+	msgErrorGeneratingRefreshToken = newMessage("error_generating_refresh_token", "Error generating refresh token")
+	msgErrorSavingSession          = newMessage("error_saving_session", "Error saving session")
+	msgRefreshTokenInvalid         = newMessage("refresh_token_invalid", "Refresh token is invalid, expired or revoked")
+	msgErrorRefreshingSession      = newMessage("error_refreshing_session", "Error refreshing session")
+	msgErrorRevokingSession        = newMessage("error_revoking_session", "Error revoking session")
+	msgErrorSigningAccessToken     = newMessage("error_signing_access_token", "Error signing access token")
+	msgSessionExpired              = newMessage("session_expired", "Session expired or was revoked")
+	msgErrorUpdatingSession        = newMessage("error_updating_session", "Error updating session")
+	msgCredentialsRequired         = newMessage("credentials_required", "email and password are required")
+	msgErrorFetchingCredentials    = newMessage("error_fetching_credentials", "Error fetching credentials")
+	msgWrongPassword               = newMessage("wrong_password", "Wrong email or password")
+	msgUnknownLoginProvider        = newMessage("unknown_login_provider", "Unknown login provider")
+	msgErrorGeneratingLoginState   = newMessage("error_generating_login_state", "Error generating login state")
+	msgLoginExpired                = newMessage("login_expired", "Login expired or was started elsewhere; try again")
+	msgLoginFailed                 = newMessage("login_failed", "Login failed")
+	msgLoginNotCompleted           = newMessage("login_not_completed", "Login was not completed: %s")
+	msgErrorFetchingProfile        = newMessage("error_fetching_profile", "Error fetching profile from %s")
+	msgNoVerifiedEmail             = newMessage("no_verified_email", "The %s account has no verified email")
+	msgErrorProvisioningUser       = newMessage("error_provisioning_user", "Error provisioning user")
+)
+
+// Passwords
+var (
+	msgOnlySelfOrAdminSetPassword = newMessage("only_self_or_admin_set_password", "Only the user or an admin may set their password")
+	msgCurrentPasswordWrong       = newMessage("current_password_wrong", "currentPassword is wrong")
+	msgErrorHashingPassword       = newMessage("error_hashing_password", "Error hashing password")
+	msgErrorSavingPassword        = newMessage("error_saving_password", "Error saving password")
+	msgInvalidResetLink           = newMessage("invalid_reset_link", "Invalid or expired reset link")
+	msgErrorCheckingResetLink     = newMessage("error_checking_reset_link", "Error checking reset link")
+	msgErrorResettingPassword     = newMessage("error_resetting_password", "Error resetting password")
+	msgPasswordTooCommon          = newMessage("password_too_common", "is too common")
+	msgPasswordContainsEmail      = newMessage("password_contains_email", "must not contain the email address")
+)
+
+// Two-factor authentication
+var (
+	msgOnlySelfTwoFactor              = newMessage("only_self_two_factor", "Only the user may manage their own two-factor authentication")
+	msgErrorGeneratingSecret          = newMessage("error_generating_secret", "Error generating secret")
+	msgTwoFactorAlreadyEnabled        = newMessage("two_factor_already_enabled", "Two-factor authentication is already enabled")
+	msgErrorSavingTwoFactorSecret     = newMessage("error_saving_two_factor_secret", "Error saving two-factor secret")
+	msgStartEnrollmentFirst           = newMessage("start_enrollment_first", "Start two-factor enrollment first")
+	msgErrorFetchingTwoFactorSecret   = newMessage("error_fetching_two_factor_secret", "Error fetching two-factor secret")
+	msgInvalidCode                    = newMessage("invalid_code", "Invalid code")
+	msgErrorGeneratingRecoveryCodes   = newMessage("error_generating_recovery_codes", "Error generating recovery codes")
+	msgErrorEnablingTwoFactor         = newMessage("error_enabling_two_factor", "Error enabling two-factor authentication")
+	msgTwoFactorNotEnabled            = newMessage("two_factor_not_enabled", "Two-factor authentication is not enabled for this user")
+	msgCodeRequired                   = newMessage("code_required", "code or recoveryCode is required")
+	msgInvalidOrUsedCode              = newMessage("invalid_or_used_code", "Invalid or already used code")
+	msgErrorCheckingTwoFactorCode     = newMessage("error_checking_two_factor_code", "Error checking two-factor code")
+	msgErrorCheckingTwoFactorEnrolled = newMessage("error_checking_two_factor_enrollment", "Error checking two-factor enrollment")
+)
+
+// Email verification and notifications
+var (
+	msgEmailNotVerified              = newMessage("email_not_verified", "Email not verified; follow the link sent to it first")
+	msgInvalidVerificationLink       = newMessage("invalid_verification_link", "Invalid or expired verification link")
+	msgVerificationLinkStale         = newMessage("verification_link_stale", "This verification link is no longer valid")
+	msgErrorVerifyingEmail           = newMessage("error_verifying_email", "Error verifying email")
+	msgErrorFetchingSuppressedEmails = newMessage("error_fetching_suppressed_emails", "Error fetching suppressed emails")
+	msgErrorSuppressingEmail         = newMessage("error_suppressing_email", "Error suppressing email")
+	msgEmailNotSuppressed            = newMessage("email_not_suppressed", "Email is not suppressed")
+	msgErrorLiftingSuppression       = newMessage("error_lifting_suppression", "Error lifting email suppression")
+)
+
+// Users
+var (
+	msgUserNotFound           = newMessage("user_not_found", "User not found")
+	msgInvalidUserID          = newMessage("invalid_user_id", "invalid user id")
+	msgErrorFetchingUser      = newMessage("error_fetching_user", "Error fetching user")
+	msgErrorFetchingUsers     = newMessage("error_fetching_users", "Error fetching users")
+	msgErrorCountingUsers     = newMessage("error_counting_users", "Error counting users")
+	msgErrorSavingUser        = newMessage("error_saving_user", "Error saving user")
+	msgErrorUpdatingUser      = newMessage("error_updating_user", "Error updating user")
+	msgEmailTaken             = newMessage("email_taken", "A user with this email already exists")
+	msgEmailTakenSince        = newMessage("email_taken_since", "Another user now has this email")
+	msgValidationFailed       = newMessage("validation_failed", "Validation failed")
+	msgOnlyAdminsChangeRoles  = newMessage("only_admins_change_roles", "Only admins may change roles")
+	msgNoUpdatableFields      = newMessage("no_updatable_fields", "No updatable fields supplied (name, email, roles, metadata)")
+	msgFieldNotRemovable      = newMessage("field_not_removable", "%s cannot be removed")
+	msgUnknownRole            = newMessage("unknown_role", "Unknown role %s")
+	msgOnlyAdminsListDeleted  = newMessage("only_admins_list_deleted", "Only admins may list deleted users")
+	msgErrorDeletingUser      = newMessage("error_deleting_user", "Error deleting user")
+	msgOnlyAdminsRestore      = newMessage("only_admins_restore_users", "Only admins may restore users")
+	msgDeletedUserNotFound    = newMessage("deleted_user_not_found", "Deleted user not found")
+	msgErrorRestoringUser     = newMessage("error_restoring_user", "Error restoring user")
+	msgUserNotFoundOrErased   = newMessage("user_not_found_or_erased", "User not found or already erased")
+	msgErrorErasingUser       = newMessage("error_erasing_user", "Error erasing user")
+	msgErrorFetchingActivity  = newMessage("error_fetching_activity", "Error fetching activity")
+	msgErrorRecordingLogin    = newMessage("error_recording_login", "Error recording login")
+	msgErrorCheckingEmails    = newMessage("error_checking_emails", "Error checking emails")
+	msgTooManyEmails          = newMessage("too_many_emails", "At most %d emails may be checked per request")
+	msgErrorStagingExport     = newMessage("error_staging_data_export", "Error staging data export")
+	msgExportFormatInvalid    = newMessage("export_format_invalid", "format must be csv, json or ndjson")
+	msgErrorExportingUsers    = newMessage("error_exporting_users", "Error exporting users")
+	msgErrorSearchingUsers    = newMessage("error_searching_users", "Error searching users")
+	msgSearchIndexDown        = newMessage("search_index_unavailable", "Search index unavailable")
+	msgErrorApplyingRetention = newMessage("error_applying_retention", "Error applying retention rules")
+	msgErrorCleaningUpBlobs   = newMessage("error_cleaning_up_blobs", "Error cleaning up blobs")
+	msgInvalidMetadataKey     = newMessage("invalid_metadata_key", "Invalid metadata key %s")
+	msgErrorFetchingAudit     = newMessage("error_fetching_audit_events", "Error fetching audit events")
+)
+
+// Field messages, about the field they are reported for
+var (
+	msgRequired              = newMessage("required", "is required")
+	msgInvalidUTF8           = newMessage("invalid_utf8", "must be valid UTF-8")
+	msgMinLength             = newMessage("min_length", "must be at least %d characters")
+	msgMaxLength             = newMessage("max_length", "must be at most %d characters")
+	msgMaxBytes              = newMessage("max_bytes", "must be at most %d bytes")
+	msgControlCharacters     = newMessage("control_characters", "must not contain control characters")
+	msgInvalidEmail          = newMessage("invalid_email", "must be a valid email address")
+	msgUnreadable            = newMessage("unreadable", "could not be read")
+	msgNotBase64             = newMessage("not_base64", "must be standard base64")
+	msgContentTypeNotAllowed = newMessage("content_type_not_allowed", "must be one of %s, got %s")
+	msgFilenameInvalid       = newMessage("filename_invalid", "filename too long or invalid: %s")
+	msgPhotoRequired         = newMessage("photo_required", "is required unless photo_url is given")
+	msgPhotoWithPhotoURL     = newMessage("photo_with_photo_url", "must not be given with photo_url")
+	msgPhotoFilenameRequired = newMessage("photo_filename_required", "is required with photo_base64 and must be a plain file name")
+	msgLinkTooLong           = newMessage("link_too_long", "link must be at most %d characters")
+	msgLinkInvalidUTF8       = newMessage("link_invalid_utf8", "link must be valid UTF-8")
+	msgLinkControlCharacters = newMessage("link_control_characters", "link must not contain control characters")
+	msgPhotoURLInvalid       = newMessage("photo_url_invalid", "invalid photo_url: %s")
+	msgPhotoURLNotAbsolute   = newMessage("photo_url_not_absolute", "invalid photo_url: must be an absolute URL")
+	msgPhotoURLScheme        = newMessage("photo_url_scheme", "invalid photo_url: scheme must be http or https")
+	msgTooManyEntries        = newMessage("too_many_entries", "must have at most %d entries")
+	msgMetadataKeyInvalid    = newMessage("metadata_key_invalid", "key %q must be 1 to 64 letters, digits, _ or -")
+	msgMetadataValueUTF8     = newMessage("metadata_value_invalid_utf8", "value of %s must be valid UTF-8")
+	msgMetadataValueTooLong  = newMessage("metadata_value_too_long", "value of %s must be at most %d characters")
+	msgMetadataNotObject     = newMessage("metadata_not_object", "must be a JSON object of strings")
+	msgChunksOutOfRange      = newMessage("chunks_out_of_range", "must be between 1 and %d")
+	msgWebhookURLInvalid     = newMessage("webhook_url_invalid", "must be an absolute http or https URL")
+	msgUnknownEvents         = newMessage("unknown_events", "must be among %s")
+)
+
+// Bulk imports, CSV imports and creation jobs
+var (
+	msgBulkNotArray            = newMessage("bulk_not_array", "Invalid JSON body: expected an array of users")
+	msgNoUsersSupplied         = newMessage("no_users_supplied", "No users supplied")
+	msgTooManyUsers            = newMessage("too_many_users", "At most %d users may be imported per request")
+	msgErrorImportingUsers     = newMessage("error_importing_users", "Error importing users")
+	msgErrorImportingUsersFrom = newMessage("error_importing_users_from", "Error importing users; rows before index %d were imported")
+	msgEmailExists             = newMessage("email_exists", "email already exists")
+	msgInsertFailed            = newMessage("insert_failed", "insert failed")
+	msgCSVEmpty                = newMessage("csv_empty", "The CSV is empty")
+	msgInvalidCSVHeader        = newMessage("invalid_csv_header", "Invalid CSV header: %s")
+	msgUnknownColumn           = newMessage("unknown_column", "unknown column %q; columns are %s")
+	msgDuplicateColumn         = newMessage("duplicate_column", "column %q appears twice")
+	msgNameColumnRequired      = newMessage("name_column_required", "a name column is required")
+	msgEmailColumnRequired     = newMessage("email_column_required", "an email column is required")
+	msgNoFilePart              = newMessage("no_file_part", "the form has no file part")
+	msgImportContentType       = newMessage("import_content_type", "Content-Type must be text/csv or multipart/form-data")
+	msgErrorReadingCSV         = newMessage("error_reading_csv", "Error reading the upload")
+	msgErrorCreatingImportJob  = newMessage("error_creating_import_job", "Error creating import job")
+	msgInvalidImportJobID      = newMessage("invalid_import_job_id", "invalid import job id")
+	msgImportJobNotFound       = newMessage("import_job_not_found", "Import job not found")
+	msgErrorFetchingImportJob  = newMessage("error_fetching_import_job", "Error fetching import job")
+	msgErrorFetchingImportJobs = newMessage("error_fetching_import_jobs", "Error fetching import jobs")
+	msgErrorCreatingJob        = newMessage("error_creating_creation_job", "Error creating creation job")
+	msgTooManyCreations        = newMessage("too_many_creations", "Too many creations in progress; retry later")
+	msgInvalidJobID            = newMessage("invalid_job_id", "invalid job id")
+	msgJobNotFound             = newMessage("job_not_found", "Job not found")
+	msgErrorFetchingJob        = newMessage("error_fetching_job", "Error fetching job")
+)
+
+// Pictures and their uploads
+var (
+	msgNoThumbnailSize         = newMessage("no_thumbnail_size", "No thumbnail of this size; sizes are the keys of the user's thumbnails")
+	msgUserHasNoPicture        = newMessage("user_has_no_picture", "User has no picture")
+	msgPictureNotFound         = newMessage("picture_not_found", "Picture not found")
+	msgErrorReadingPicture     = newMessage("error_reading_picture", "Error reading picture")
+	msgErrorDownloadingPicture = newMessage("error_downloading_picture", "Error downloading picture")
+	msgErrorLookingUpPicture   = newMessage("error_looking_up_picture", "Error looking up picture")
+	msgErrorUploadingFile      = newMessage("error_uploading_file", "Error uploading file")
+	msgErrorRecordingPicture   = newMessage("error_recording_picture", "Error recording picture")
+	msgErrorSigningLinks       = newMessage("error_signing_picture_links", "Error signing picture links")
+	msgErrorScanningUpload     = newMessage("error_scanning_upload", "Error scanning upload")
+	msgUploadFlagged           = newMessage("upload_flagged", "The upload was flagged by the malware scan")
+	msgErrorReadingUpload      = newMessage("error_reading_upload", "Error reading upload")
+	msgContentMD5Invalid       = newMessage("content_md5_invalid", "Content-MD5 must be the base64 MD5 of the chunk")
+	msgErrorReadingChunk       = newMessage("error_reading_chunk", "Error reading chunk")
+	msgChunkEmpty              = newMessage("chunk_empty", "The chunk is empty")
+	msgChunkMD5Mismatch        = newMessage("chunk_md5_mismatch", "The chunk doesn't match its Content-MD5; send it again")
+	msgChunkIndexTooHigh       = newMessage("chunk_index_too_high", "chunk index must be below %d")
+	msgChunkMissing            = newMessage("chunk_missing", "Chunk %d hasn't been received")
+	msgErrorStoringChunk       = newMessage("error_storing_chunk", "Error storing chunk")
+	msgErrorJoiningChunks      = newMessage("error_joining_chunks", "Error joining chunks")
+)
+
+// Groups and webhooks
+var (
+	msgGroupNameTaken                 = newMessage("group_name_taken", "A group with this name already exists")
+	msgErrorSavingGroup               = newMessage("error_saving_group", "Error saving group")
+	msgInvalidGroupID                 = newMessage("invalid_group_id", "invalid group id")
+	msgGroupNotFound                  = newMessage("group_not_found", "Group not found")
+	msgErrorAddingGroupMember         = newMessage("error_adding_group_member", "Error adding group member")
+	msgErrorFetchingGroups            = newMessage("error_fetching_groups", "Error fetching groups")
+	msgErrorSavingWebhook             = newMessage("error_saving_webhook", "Error saving webhook")
+	msgErrorFetchingWebhooks          = newMessage("error_fetching_webhooks", "Error fetching webhooks")
+	msgInvalidWebhookID               = newMessage("invalid_webhook_id", "invalid webhook id")
+	msgWebhookNotFound                = newMessage("webhook_not_found", "Webhook not found")
+	msgErrorDeletingWebhook           = newMessage("error_deleting_webhook", "Error deleting webhook")
+	msgErrorFetchingWebhookDeliveries = newMessage("error_fetching_webhook_deliveries", "Error fetching webhook deliveries")
+)
+
+// Dead letters
+var (
+	msgFromInvalid              = newMessage("from_invalid", "from must be a positive sequence number")
+	msgInvalidSequenceNumber    = newMessage("invalid_sequence_number", "invalid sequence number")
+	msgErrorReadingDeadLetters  = newMessage("error_reading_dead_letters", "Error reading dead letters")
+	msgDeadLetterNotFound       = newMessage("dead_letter_not_found", "Dead letter not found")
+	msgErrorSettlingDeadLetters = newMessage("error_settling_dead_letters", "Error settling dead letters")
+)
+
+// GraphQL
+var (
+	msgGraphQLContentType           = newMessage("graphql_content_type", "Content-Type must be application/json or multipart/form-data")
+	msgGraphQLOperationsInvalid     = newMessage("graphql_operations_invalid", "operations must be a JSON GraphQL request")
+	msgGraphQLMapInvalid            = newMessage("graphql_map_invalid", "map must be a JSON object of file part names to variable paths")
+	msgGraphQLMapMissingPart        = newMessage("graphql_map_missing_part", "map names file part %s, which is missing")
+	msgGraphQLMapPathPrefix         = newMessage("graphql_map_path_prefix", "map path %s must start with variables.")
+	msgGraphQLMapPathUnknown        = newMessage("graphql_map_path_unknown", "map path %s does not name a variable")
+	msgGraphQLUploadNotFile         = newMessage("graphql_upload_not_file", "Upload must be sent as a multipart file part")
+	msgGraphQLPhotoNotBase64        = newMessage("graphql_photo_not_base64", "photoBase64 must be base64-encoded")
+	msgGraphQLPhotoFilenameRequired = newMessage("graphql_photo_filename_required", "photoFilename is required with photoBase64")
+)
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"user/user/store"
+)
+
+// Limits on a user's metadata, keeping the column small enough to filter on
+const (
+	maxMetadataEntries     = 50
+	maxMetadataValueLength = 512
+)
+
+// Query parameters starting with this filter users by a metadata value
+const metadataFilterPrefix = "metadata."
+
+// Metadata keys are also JSON paths in queries, so they're kept to plain names
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// validateMetadata checks the keys and values of a user's metadata
+func validateMetadata(metadata store.UserMetadata) error {
+	if len(metadata) > maxMetadataEntries {
+		return msgTooManyEntries.with(maxMetadataEntries)
+	}
+	for key, value := range metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return msgMetadataKeyInvalid.with(key)
+		}
+		if !utf8.ValidString(value) {
+			return msgMetadataValueUTF8.with(key)
+		}
+		if utf8.RuneCountInString(value) > maxMetadataValueLength {
+			return msgMetadataValueTooLong.with(key, maxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+// parseMetadataForm decodes the metadata field of a form, a JSON object of
+// strings; absent or empty means no metadata
+func parseMetadataForm(value string) (store.UserMetadata, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var metadata store.UserMetadata
+	if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+		return nil, msgMetadataNotObject
+	}
+	return metadata, validateMetadata(metadata)
+}
+
+// mergeMetadata applies a merge patch of the metadata to current: null
+// removes a key, a string sets it
+func mergeMetadata(current store.UserMetadata, patch map[string]*string) store.UserMetadata {
+	merged := maps.Clone(current)
+	if merged == nil {
+		merged = store.UserMetadata{}
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = *value
+		}
+	}
+	return merged
+}
+
+// metadataFilter reads the metadata.<key>=<value> query parameters of a
+// listing. On failure it writes the error response.
+func metadataFilter(w http.ResponseWriter, r *http.Request) (map[string]string, bool) {
+	var filter map[string]string
+	for param, values := range r.URL.Query() {
+		key, ok := strings.CutPrefix(param, metadataFilterPrefix)
+		if !ok {
+			continue
+		}
+		if !metadataKeyPattern.MatchString(key) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidMetadataKey.with(key))
+			return nil, false
+		}
+		if filter == nil {
+			filter = map[string]string{}
+		}
+		filter[key] = values[0]
+	}
+	return filter, true
+}
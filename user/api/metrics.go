@@ -0,0 +1,66 @@
+package api
+
+import (
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// RegisterMetrics registers all collectors with the default Prometheus registry;
+// db is nil without a database, replica without a read replica
+func RegisterMetrics(db *sql.DB, replica *store.ReadReplica) {
+	// The default Go collector only has the classic runtime stats; this one adds
+	// the GC, memory and scheduler metrics of runtime/metrics
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.MustRegister(collectors.NewGoCollector(collectors.WithGoCollectorRuntimeMetrics(
+		collectors.MetricsGC, collectors.MetricsMemory, collectors.MetricsScheduler)))
+	prometheus.MustRegister(
+		telemetry.HTTPRequestsTotal,
+		telemetry.HTTPRequestDuration,
+		telemetry.HTTPPanicsTotal,
+		telemetry.HTTPInFlightRequests,
+		telemetry.HTTPShedRequestsTotal,
+		telemetry.DBQueryDuration,
+		telemetry.BlobUploadsTotal,
+		telemetry.BlobUploadDuration,
+		telemetry.BlobUploadBytes,
+		telemetry.ServiceBusPublishesTotal,
+		telemetry.DependencyRetriesTotal,
+		telemetry.CircuitBreakerState,
+		telemetry.DependencyInFlight,
+		telemetry.DependencyQueueDepth,
+		telemetry.DependencyRejectionsTotal,
+		telemetry.UploadScansTotal,
+		telemetry.BlobCleanupOrphansTotal,
+		telemetry.BlobCleanupReclaimedBytesTotal,
+		telemetry.CacheRequestsTotal,
+		telemetry.MailNotificationsTotal,
+		telemetry.ScheduledJobRunsTotal,
+		telemetry.ScheduledJobDuration,
+		telemetry.RetentionRecordsTotal,
+	)
+	// There is no pool with database.driver memory
+	if db != nil {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "db_open_connections",
+			Help: "Open connections to the database, in use and idle.",
+		}, func() float64 {
+			return float64(db.Stats().OpenConnections)
+		}))
+	}
+	if replica != nil {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "db_replica_healthy",
+			Help: "1 while reads go to the read replica, 0 while they fall back to the primary.",
+		}, func() float64 {
+			if replica.Healthy.Load() {
+				return 1
+			}
+			return 0
+		}))
+	}
+}
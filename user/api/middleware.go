@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"user/user/telemetry"
+)
+
+// statusRecorder captures the status code written by a handler, and how many
+// body bytes it wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// loggingMiddleware writes each request's access log line and records its
+// request metrics
+func loggingMiddleware(accessLog *accessLogger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			r, entry := accessLog.start(r)
+			next.ServeHTTP(rec, r)
+			elapsed := time.Since(start)
+
+			handler := r.URL.Path
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					handler = tmpl
+				}
+			}
+			code := strconv.Itoa(rec.status)
+			telemetry.HTTPRequestsTotal.WithLabelValues(handler, code).Inc()
+			telemetry.HTTPRequestDuration.WithLabelValues(handler, code).Observe(elapsed.Seconds())
+
+			accessLog.log(r, entry, handler, rec.status, rec.bytes, elapsed)
+		})
+	}
+}
+
+// recoveryMiddleware turns a panic in a handler into a 500, logging it with its
+// stack trace and counting it, rather than letting the connection drop
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered) // A deliberate abort, which the server handles quietly
+			}
+			handler := r.URL.Path
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					handler = tmpl
+				}
+			}
+			telemetry.HTTPPanicsTotal.WithLabelValues(handler).Inc()
+			slog.ErrorContext(r.Context(), "Handler panicked", "method", r.Method, "path", handler, "panic", recovered, "stack", string(debug.Stack()))
+			writeProblem(w, r, http.StatusInternalServerError, msgInternalError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// timedHandler is a route's handler with a request timeout of its own, which
+// routeTimeoutMiddleware applies in place of the default
+type timedHandler struct {
+	http.Handler
+	timeout time.Duration // 0 for none
+}
+
+// withTimeout gives a route its own request timeout; 0 lifts it, for streams
+func withTimeout(timeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return timedHandler{Handler: next, timeout: timeout}
+	}
+}
+
+// routeTimeoutMiddleware bounds each request's context by its route's timeout,
+// so the queries and dependency calls it makes give up once it's over and the
+// handler answers 504. The timeout is set in server.route_timeouts by method
+// and route template, else by the route itself, else it is fallback.
+func routeTimeoutMiddleware(fallback time.Duration, overrides map[string]time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := fallback
+			if route := mux.CurrentRoute(r); route != nil {
+				if timed, ok := route.GetHandler().(timedHandler); ok {
+					timeout = timed.timeout
+				}
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					if override, ok := overrides[r.Method+" "+tmpl]; ok {
+						timeout = override
+					}
+				}
+			}
+			if timeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// extendDeadlines gives a route longer read and write deadlines than the server
+// defaults, for large uploads and long downloads, and a request timeout to match
+func extendDeadlines(timeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return timedHandler{timeout: timeout, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(w)
+			deadline := time.Now().Add(timeout)
+			if err := rc.SetReadDeadline(deadline); err != nil {
+				slog.WarnContext(r.Context(), "Could not extend read deadline", "error", err)
+			}
+			if err := rc.SetWriteDeadline(deadline); err != nil {
+				slog.WarnContext(r.Context(), "Could not extend write deadline", "error", err)
+			}
+			next.ServeHTTP(w, r)
+		})}
+	}
+}
+
+type contextKey string
+
+const originalBodyKey contextKey = "originalBody"
+
+// maxBodyMiddleware caps every request body at limit bytes. Reading past it fails
+// with *http.MaxBytesError, which handlers turn into a 413.
+func maxBodyMiddleware(limit int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), originalBodyKey, r.Body)
+			r = r.WithContext(ctx)
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// raiseBodyLimit replaces the global body limit with a larger one for a route
+func raiseBodyLimit(limit int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if body, ok := r.Context().Value(originalBodyKey).(io.ReadCloser); ok {
+				r.Body = http.MaxBytesReader(w, body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+const requestIDKey contextKey = "requestID"
+
+// Header used to propagate correlation IDs
+const requestIDHeader = "X-Request-ID"
+
+// Paths hit by infrastructure that never carries correlation IDs
+var untracedPaths = map[string]bool{
+	"/metrics": true,
+	"/healthz": true,
+	"/livez":   true,
+	"/readyz":  true,
+}
+
+// Correlation IDs accepted from callers: short, and only characters that are
+// safe to echo in headers and logs
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:\-]{1,128}$`)
+
+// requestIDMiddleware attaches a correlation ID to every request, taking it from
+// X-Request-ID when present and well formed, and generating one otherwise.
+// When required is set, requests without one are rejected.
+func requestIDMiddleware(required bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(requestIDHeader)
+			if id == "" {
+				if required && !untracedPaths[r.URL.Path] {
+					writeProblem(w, r, http.StatusBadRequest, msgMissingHeader.with(requestIDHeader))
+					return
+				}
+				id = newRequestID()
+			} else if !requestIDPattern.MatchString(id) {
+				id = newRequestID()
+			}
+			w.Header().Set(requestIDHeader, id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+		})
+	}
+}
+
+// requestIDFromContext returns the correlation ID stored by requestIDMiddleware
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"user/user/store"
+	"user/user/userpb"
+)
+
+// A responseEncoder renders response bodies in one media type
+type responseEncoder interface {
+	mediaType() string
+	// supports reports whether the format has a representation for v
+	supports(v any) bool
+	encode(v any) ([]byte, error)
+}
+
+// Formats GET responses can be negotiated into with the Accept header, the
+// default first. A new format only needs its encoder listed here.
+var responseEncoders = []responseEncoder{
+	jsonEncoder{},
+	xmlEncoder{},
+	protobufEncoder{},
+}
+
+// negotiateEncoder picks the encoder for v that the Accept header rates
+// highest, preferring earlier ones on ties, and marks the response as varying
+// by Accept. A request asking for the enveloped format gets it whatever else
+// it accepts. On failure it writes a 406 and returns false.
+func negotiateEncoder(w http.ResponseWriter, r *http.Request, v any) (responseEncoder, bool) {
+	if envelope := (envelopeEncoder{r: r}); envelope.supports(v) && wantsEnvelope(r) {
+		w.Header().Add("Vary", "Accept")
+		return envelope, true
+	}
+	accept := strings.Join(r.Header.Values("Accept"), ",")
+	var best responseEncoder
+	var bestQuality float64
+	var offered []string
+	for _, encoder := range responseEncoders {
+		if !encoder.supports(v) {
+			continue
+		}
+		offered = append(offered, encoder.mediaType())
+		if quality := acceptQuality(accept, encoder.mediaType()); quality > bestQuality {
+			best, bestQuality = encoder, quality
+		}
+	}
+	w.Header().Add("Vary", "Accept")
+	if best == nil {
+		writeProblem(w, r, http.StatusNotAcceptable, msgAcceptableFormats.with(strings.Join(offered, ", ")))
+		return nil, false
+	}
+	return best, true
+}
+
+// acceptQuality returns the q value an Accept header gives mediaType, taken
+// from the most specific range that matches it. Every type is acceptable when
+// there is no header.
+func acceptQuality(accept, mediaType string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		acceptRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		rangeSpecificity := -1
+		switch acceptRange {
+		case mediaType:
+			rangeSpecificity = 2
+		case major + "/*":
+			rangeSpecificity = 1
+		case "*/*":
+			rangeSpecificity = 0
+		}
+		if rangeSpecificity <= specificity {
+			continue
+		}
+		q := 1.0
+		if param, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(param, 64); err == nil {
+				q = parsed
+			}
+		}
+		quality, specificity = q, rangeSpecificity
+	}
+	return quality
+}
+
+// writeEncoded writes v as the response body in the encoder's format
+func writeEncoded(w http.ResponseWriter, encoder responseEncoder, v any) error {
+	body, err := encoder.encode(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", encoder.mediaType())
+	_, err = w.Write(body)
+	return err
+}
+
+// writeNegotiatedWithETag writes v in the format the request accepts, tagged
+// with a weak ETag of that encoding. The tag is weak because compression may
+// change the bytes on the wire. Like GET /users/{id}, clients must revalidate
+// cached copies, and a matching If-None-Match gets a 304 with no body.
+func writeNegotiatedWithETag(w http.ResponseWriter, r *http.Request, v any) error {
+	encoder, ok := negotiateEncoder(w, r, v)
+	if !ok {
+		return nil
+	}
+	body, err := encoder.encode(v)
+	if err != nil {
+		return err
+	}
+	etag := "W/" + etagForBody(body)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if ifNoneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Type", encoder.mediaType())
+	_, err = w.Write(body)
+	return err
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) mediaType() string {
+	return "application/json"
+}
+
+func (jsonEncoder) supports(any) bool {
+	return true
+}
+
+func (jsonEncoder) encode(v any) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(body, '\n'), nil
+}
+
+// xmlEncoder renders users, lists of them and pages, with each user a <user>
+// element whose children are named like the JSON members
+type xmlEncoder struct{}
+
+func (xmlEncoder) mediaType() string {
+	return "application/xml"
+}
+
+func (xmlEncoder) supports(v any) bool {
+	switch v.(type) {
+	case store.User, []store.User, UserPage:
+		return true
+	}
+	return false
+}
+
+func (xmlEncoder) encode(v any) ([]byte, error) {
+	var root string
+	switch list := v.(type) {
+	case store.User:
+		root = "user"
+	case []store.User:
+		root = "users"
+		v = struct {
+			Users []store.User `xml:"user"`
+		}{list}
+	case UserPage:
+		root = "userPage"
+	}
+	body := bytes.NewBufferString(xml.Header)
+	if err := xml.NewEncoder(body).EncodeElement(v, xml.StartElement{Name: xml.Name{Local: root}}); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// protobufEncoder renders users as the UserService messages: a User, or a
+// ListUsersResponse for lists and pages
+type protobufEncoder struct{}
+
+func (protobufEncoder) mediaType() string {
+	return "application/x-protobuf"
+}
+
+func (protobufEncoder) supports(v any) bool {
+	switch v.(type) {
+	case store.User, []store.User, UserPage:
+		return true
+	}
+	return false
+}
+
+func (protobufEncoder) encode(v any) ([]byte, error) {
+	var msg proto.Message
+	switch v := v.(type) {
+	case store.User:
+		msg = userToProto(v)
+	case []store.User:
+		msg = usersToProto(UserPage{Users: v})
+	case UserPage:
+		msg = usersToProto(v)
+	}
+	return proto.Marshal(msg)
+}
+
+func usersToProto(page UserPage) *userpb.ListUsersResponse {
+	msg := &userpb.ListUsersResponse{NextPageToken: page.NextCursor}
+	for _, user := range page.Users {
+		msg.Users = append(msg.Users, userToProto(user))
+	}
+	return msg
+}
@@ -0,0 +1,346 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// Mail notification tuning
+const (
+	notificationQueueSize   = 256
+	notificationBaseDelay   = time.Second
+	maxSuppressionReasonLen = 255
+)
+
+// Files of mail.notifications.template_dir replacing the built-in templates,
+// by the event they're sent on
+var notificationTemplateFiles = map[string]string{
+	events.UserCreated: "welcome.tmpl",
+	events.UserUpdated: "profile_changed.tmpl",
+}
+
+// Built-in notification templates, by event. Each defines the subject and the
+// plain-text body, executed with a mailTemplateData.
+var defaultNotificationTemplates = map[string]string{
+	events.UserCreated: `{{define "subject"}}Welcome, {{.User.Name}}{{end}}
+{{define "body"}}Hello {{.User.Name}},
+
+Your account has been created with this email address, {{.User.Email}}.
+{{end}}`,
+	events.UserUpdated: `{{define "subject"}}Your profile was changed{{end}}
+{{define "body"}}Hello {{.User.Name}},
+
+Your profile was changed at {{.User.UpdatedAt.Format "2006-01-02 15:04 MST"}}. If you didn't change it, contact your administrator.
+{{end}}`,
+}
+
+// Body of PUT /admin/mail/suppressions/{email}
+type suppressionRequest struct {
+	Reason string `json:"reason"`
+}
+
+// mailTemplateData is what notification templates are executed with
+type mailTemplateData struct {
+	User      store.User
+	EventType string
+}
+
+// A notification email waiting to be sent
+type notification struct {
+	ID        string // Of the outbox event, so providers drop the repeats of a redelivered event
+	EventType string
+	User      store.User
+	Trace     trace.SpanContext // Of the request that made the change
+}
+
+// loadNotificationTemplates parses the notification templates, those in dir
+// replacing the built-in ones; an empty dir keeps them all
+func loadNotificationTemplates(dir string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	for eventType, text := range defaultNotificationTemplates {
+		name := notificationTemplateFiles[eventType]
+		if dir != "" {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+			if err == nil {
+				text = string(data)
+			}
+		}
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range []string{"subject", "body"} {
+			if tmpl.Lookup(part) == nil {
+				return nil, fmt.Errorf("%s doesn't define %s", name, part)
+			}
+		}
+		templates[eventType] = tmpl
+	}
+	return templates, nil
+}
+
+// templateProblems checks the templates in mail.notifications.template_dir parse
+func templateProblems(cfg config.Config) []string {
+	if dir := cfg.Mail.Notifications.TemplateDir; dir != "" {
+		if _, err := loadNotificationTemplates(dir); err != nil {
+			return []string{fmt.Sprintf("mail.notifications.template_dir: %v", err)}
+		}
+	}
+	return nil
+}
+
+// lifecycleNotifier emails users about their account from the outbox
+// dispatcher: a welcome on user.created and a notice on user.updated, as
+// enabled in mail.notifications. An event is only notified once it was
+// published, so each is sent about once however many instances dispatch; a
+// redelivered event is sent again unless the provider drops repeats. A nil
+// lifecycleNotifier sends nothing.
+type lifecycleNotifier struct {
+	mailer       Mailer
+	suppressions store.MailSuppressionStore
+	templates    map[string]*template.Template // By event type, only those enabled
+	maxAttempts  int
+
+	mu     sync.RWMutex // Guards sends to queue against close
+	closed bool
+	queue  chan notification
+}
+
+// newLifecycleNotifier returns the notifier configured in mail.notifications,
+// or nil when no notification is enabled
+func newLifecycleNotifier(cfg config.Config, mailer Mailer, suppressions store.MailSuppressionStore) *lifecycleNotifier {
+	settings := cfg.Mail.Notifications
+	if !settings.Welcome && !settings.ProfileChanges {
+		return nil
+	}
+	// Checked by ValidateConfig, but the files may have changed since
+	templates, err := loadNotificationTemplates(settings.TemplateDir)
+	if err != nil {
+		slog.Error("Mail notifications are off: failed to load the templates", "template_dir", settings.TemplateDir, "error", err)
+		return nil
+	}
+	if !settings.Welcome {
+		delete(templates, events.UserCreated)
+	}
+	if !settings.ProfileChanges {
+		delete(templates, events.UserUpdated)
+	}
+	return &lifecycleNotifier{
+		mailer:       mailer,
+		suppressions: suppressions,
+		templates:    templates,
+		maxAttempts:  settings.MaxAttempts,
+		queue:        make(chan notification, notificationQueueSize),
+	}
+}
+
+// run sends queued notifications until the queue is closed and drained. Once
+// ctx is cancelled, failed sends are no longer retried.
+func (n *lifecycleNotifier) run(ctx context.Context) {
+	for message := range n.queue {
+		n.send(ctx, message)
+	}
+}
+
+// close stops accepting notifications; workers exit after draining the queue
+func (n *lifecycleNotifier) close() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	close(n.queue)
+}
+
+// notify queues the email for a published event, if its type is notified.
+// Deleted users aren't emailed. Notifications are dropped, and logged, when
+// the queue is full.
+func (n *lifecycleNotifier) notify(ctx context.Context, event events.OutboxEvent) {
+	if n == nil || n.templates[event.EventType] == nil {
+		return
+	}
+	var user store.User
+	if err := json.Unmarshal(event.Body, &user); err != nil {
+		slog.ErrorContext(ctx, "Error decoding user of notified event", "event_type", event.EventType, "user_id", event.UserID, "error", err)
+		return
+	}
+	if user.DeletedAt != nil || user.Email == "" {
+		return
+	}
+	message := notification{
+		ID:        event.MessageID,
+		EventType: event.EventType,
+		User:      user,
+		Trace:     trace.SpanContextFromContext(telemetry.ExtractTraceContext(ctx, event.TraceContext)),
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closed {
+		slog.WarnContext(ctx, "Mail notifications shut down, dropping email", "event_type", event.EventType, "user_id", user.ID)
+		return
+	}
+	select {
+	case n.queue <- message:
+	default:
+		slog.ErrorContext(ctx, "Mail notification queue full, dropping email", "event_type", event.EventType, "user_id", user.ID)
+	}
+}
+
+// send renders a notification and mails it, unless its address is
+// suppressed, retrying with exponential backoff. Rejected messages aren't
+// retried.
+func (n *lifecycleNotifier) send(ctx context.Context, message notification) {
+	logger := slog.With("event_type", message.EventType, "user_id", message.User.ID)
+	mail, err := n.render(message)
+	if err != nil {
+		telemetry.MailNotificationsTotal.WithLabelValues(message.EventType, "failure").Inc()
+		logger.Error("Error rendering notification email", "error", err)
+		return
+	}
+	delay := notificationBaseDelay
+	for attempt := 1; ; attempt++ {
+		suppressed, err := n.attempt(message, mail)
+		switch {
+		case suppressed:
+			telemetry.MailNotificationsTotal.WithLabelValues(message.EventType, "suppressed").Inc()
+			logger.Info("Notification email suppressed")
+			return
+		case err == nil:
+			telemetry.MailNotificationsTotal.WithLabelValues(message.EventType, "sent").Inc()
+			logger.Info("Notification email sent", "attempt", attempt)
+			return
+		case errors.Is(err, ErrMailRejected):
+			telemetry.MailNotificationsTotal.WithLabelValues(message.EventType, "rejected").Inc()
+			logger.Error("Notification email rejected", "attempts", attempt, "error", err)
+			return
+		case attempt >= n.maxAttempts:
+			telemetry.MailNotificationsTotal.WithLabelValues(message.EventType, "failure").Inc()
+			logger.Error("Notification email failed", "attempts", attempt, "error", err)
+			return
+		}
+		logger.Warn("Notification email failed, retrying", "attempt", attempt, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			telemetry.MailNotificationsTotal.WithLabelValues(message.EventType, "failure").Inc()
+			logger.Error("Notification email abandoned on shutdown", "attempts", attempt)
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// attempt makes one try at a notification, checking the suppression list
+// first so an address suppressed meanwhile isn't mailed. Its span carries on
+// the trace of the change.
+func (n *lifecycleNotifier) attempt(message notification, mail MailMessage) (suppressed bool, err error) {
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), message.Trace)
+	ctx, span := telemetry.StartSpan(ctx, "mail send", attribute.String("event.type", message.EventType), attribute.Int64("user.id", message.User.ID))
+	defer func() { telemetry.EndSpan(span, err) }()
+	suppressed, err = n.suppressions.IsEmailSuppressed(ctx, mail.To)
+	if err != nil || suppressed {
+		return suppressed, err
+	}
+	return false, n.mailer.Send(ctx, mail)
+}
+
+// render executes the event's template for the user
+func (n *lifecycleNotifier) render(message notification) (MailMessage, error) {
+	tmpl := n.templates[message.EventType]
+	data := mailTemplateData{User: message.User, EventType: message.EventType}
+	var subject, body strings.Builder
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return MailMessage{}, err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return MailMessage{}, err
+	}
+	return MailMessage{
+		ID:      message.ID,
+		To:      message.User.Email,
+		Subject: strings.Join(strings.Fields(subject.String()), " "), // On one line, as a header must be
+		Body:    body.String(),
+	}, nil
+}
+
+// API to List Suppressed Emails (GET /admin/mail/suppressions)
+func (h *handler) listMailSuppressions(w http.ResponseWriter, r *http.Request) {
+	list, err := h.suppressions.ListMailSuppressions(r.Context())
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingSuppressedEmails)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// API to Suppress an Email (PUT /admin/mail/suppressions/{email})
+//
+// Notification emails are no longer sent to the address, in any tenant.
+// Verification and password reset emails still are, as the user asked for
+// those. Suppressing an address again replaces its reason.
+func (h *handler) suppressEmail(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimSpace(mux.Vars(r)["email"])
+	if err := validateEmail(email); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, msgFieldMessage.with("email", err))
+		return
+	}
+	var req suppressionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			if !rejectOversizedBody(w, r, err) {
+				writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+			}
+			return
+		}
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if len(req.Reason) > maxSuppressionReasonLen {
+		writeProblem(w, r, http.StatusBadRequest, msgFieldMessage.with("reason", msgMaxLength.with(maxSuppressionReasonLen)))
+		return
+	}
+	suppression, err := h.suppressions.SuppressEmail(r.Context(), store.MailSuppression{Email: email, Reason: req.Reason})
+	if err != nil {
+		dbError(w, r, err, msgErrorSuppressingEmail)
+		return
+	}
+	json.NewEncoder(w).Encode(suppression)
+}
+
+// API to Lift an Email's Suppression (DELETE /admin/mail/suppressions/{email})
+func (h *handler) unsuppressEmail(w http.ResponseWriter, r *http.Request) {
+	err := h.suppressions.UnsuppressEmail(r.Context(), strings.TrimSpace(mux.Vars(r)["email"]))
+	if errors.Is(err, store.ErrNotSuppressed) {
+		writeProblem(w, r, http.StatusNotFound, msgEmailNotSuppressed)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorLiftingSuppression)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
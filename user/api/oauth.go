@@ -0,0 +1,273 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+)
+
+// How long a user has to finish signing in at the provider
+const oauthStateTTL = 10 * time.Minute
+
+// oauthProfile is what a provider tells us about the account that signed in
+type oauthProfile struct {
+	Subject       string // The provider's stable account ID
+	Name          string
+	Email         string
+	EmailVerified bool
+	AvatarURL     string
+}
+
+// oauthProvider is a configured social login provider
+type oauthProvider struct {
+	name    string
+	config  *oauth2.Config
+	profile func(ctx context.Context, client *http.Client) (oauthProfile, error)
+}
+
+// newOAuthProviders builds the configured providers, keyed by name
+func newOAuthProviders(cfg config.Config) map[string]*oauthProvider {
+	providers := make(map[string]*oauthProvider)
+	for name, credentials := range cfg.OAuth.Providers {
+		provider := &oauthProvider{name: name, config: &oauth2.Config{
+			ClientID:     credentials.ClientID,
+			ClientSecret: credentials.ClientSecret,
+			RedirectURL:  strings.TrimSuffix(cfg.OAuth.BaseURL, "/") + oauthCallbackPath(name),
+		}}
+		switch name {
+		case config.OAuthProviderGoogle:
+			provider.config.Endpoint = endpoints.Google
+			provider.config.Scopes = []string{"openid", "email", "profile"}
+			provider.profile = googleProfile
+		case config.OAuthProviderGitHub:
+			provider.config.Endpoint = endpoints.GitHub
+			provider.config.Scopes = []string{"read:user", "user:email"}
+			provider.profile = githubProfile
+		default:
+			continue // Rejected by config.Validate
+		}
+		providers[name] = provider
+	}
+	return providers
+}
+
+// googleProfile reads the signed-in account from Google's OpenID Connect userinfo endpoint
+func googleProfile(ctx context.Context, client *http.Client) (oauthProfile, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Picture       string `json:"picture"`
+	}
+	if err := getJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &info); err != nil {
+		return oauthProfile{}, err
+	}
+	return oauthProfile{Subject: info.Sub, Name: info.Name, Email: info.Email, EmailVerified: info.EmailVerified, AvatarURL: info.Picture}, nil
+}
+
+// githubProfile reads the signed-in account from the GitHub API. The profile's
+// public email may be unset or unverified, so the primary verified email is
+// looked up separately.
+func githubProfile(ctx context.Context, client *http.Client) (oauthProfile, error) {
+	var account struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &account); err != nil {
+		return oauthProfile{}, err
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return oauthProfile{}, err
+	}
+
+	profile := oauthProfile{Subject: strconv.FormatInt(account.ID, 10), Name: account.Name, AvatarURL: account.AvatarURL}
+	if profile.Name == "" {
+		profile.Name = account.Login
+	}
+	for _, email := range emails {
+		if email.Primary {
+			profile.Email, profile.EmailVerified = email.Email, email.Verified
+		}
+	}
+	return profile, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// oauthCallbackPath is where a provider sends the browser back. It is versioned
+// so the state cookie's path matches however the login was started.
+func oauthCallbackPath(provider string) string {
+	return versionedPath(apiV1, "/auth/"+provider+"/callback")
+}
+
+// oauthStateCookie names the cookie carrying a provider's login state and PKCE verifier
+func oauthStateCookie(provider string) string {
+	return "oauth_" + provider
+}
+
+// API to Start a Social Login (GET /auth/{provider}/login)
+//
+// Redirects to the provider. The state and PKCE verifier travel in a short-lived
+// cookie scoped to the callback, so no server-side storage is needed.
+func (h *handler) oauthLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, msgUnknownLoginProvider)
+		return
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorGeneratingLoginState)
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(random)
+	verifier := oauth2.GenerateVerifier()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie(provider.name),
+		Value:    state + "." + verifier,
+		Path:     oauthCallbackPath(provider.name),
+		MaxAge:   int(oauthStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(provider.config.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+// API to Finish a Social Login (GET /auth/{provider}/callback)
+//
+// Exchanges the code, provisions a user on first login and links the provider
+// account to it, then starts a session as /auth/login does.
+func (h *handler) oauthCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, msgUnknownLoginProvider)
+		return
+	}
+
+	cookie, err := r.Cookie(oauthStateCookie(provider.name))
+	state, verifier, _ := strings.Cut(cookieValue(cookie, err), ".")
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie(provider.name), Path: oauthCallbackPath(provider.name), MaxAge: -1})
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(r.URL.Query().Get("state"))) != 1 {
+		writeProblem(w, r, http.StatusBadRequest, msgLoginExpired)
+		return
+	}
+	if reason := r.URL.Query().Get("error"); reason != "" {
+		writeProblem(w, r, http.StatusUnauthorized, msgLoginNotCompleted.with(reason))
+		return
+	}
+
+	token, err := provider.config.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error exchanging OAuth code", "provider", provider.name, "error", err)
+		writeProblem(w, r, http.StatusUnauthorized, msgLoginFailed)
+		return
+	}
+	profile, err := provider.profile(r.Context(), provider.config.Client(r.Context(), token))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error fetching OAuth profile", "provider", provider.name, "error", err)
+		writeProblem(w, r, http.StatusBadGateway, msgErrorFetchingProfile.with(provider.name))
+		return
+	}
+	if profile.Subject == "" || profile.Email == "" || !profile.EmailVerified {
+		writeProblem(w, r, http.StatusForbidden, msgNoVerifiedEmail.with(provider.name))
+		return
+	}
+
+	user, err := provisionOAuthUser(r.Context(), h.config, h.users, h.webhooks, provider.name, profile)
+	if err != nil {
+		dbError(w, r, err, msgErrorProvisioningUser)
+		return
+	}
+	if user.LockedAt != nil {
+		accountLocked(w, r)
+		return
+	}
+	startSession(w, r, h.sessions, store.Session{Subject: provider.name + ":" + profile.Subject, Email: user.Email, UserID: user.ID, Tenant: user.TenantID})
+}
+
+// provisionOAuthUser returns the user linked to the provider account, linking
+// the user with the same email or creating one if there is none yet
+func provisionOAuthUser(ctx context.Context, cfg config.Config, userStore store.UserStore, webhooks *webhookDispatcher, provider string, profile oauthProfile) (store.User, error) {
+	user, err := userStore.GetUserByIdentity(ctx, provider, profile.Subject)
+	if !errors.Is(err, store.ErrUserNotFound) {
+		return user, err
+	}
+
+	tenant := cfg.OAuth.Tenant
+	user, err = userStore.GetUserByEmail(ctx, tenant, profile.Email)
+	if errors.Is(err, store.ErrUserNotFound) {
+		// The provider verified the email, which is as good as our own link
+		user = store.User{Name: profile.Name, Email: profile.Email, TenantID: tenant, EmailVerifiedAt: toPtr(time.Now().UTC())}
+		if user.Name == "" {
+			user.Name, _, _ = strings.Cut(profile.Email, "@")
+		}
+		if validatePhotoURL(profile.AvatarURL, cfg.Validation.MaxLinkLength) == nil {
+			user.Link = profile.AvatarURL
+		}
+		user, err = userStore.CreateUser(store.WithOutboxEvent(ctx, events.UserCreated), user)
+		if err == nil {
+			webhooks.notify(ctx, events.UserCreated, user)
+		} else if errors.Is(err, store.ErrDuplicateEmail) {
+			// A concurrent first login created it
+			user, err = userStore.GetUserByEmail(ctx, tenant, profile.Email)
+		}
+	}
+	if err != nil {
+		return user, err
+	}
+	if user.EmailVerifiedAt == nil {
+		if user, err = userStore.VerifyEmail(ctx, tenant, user.ID, user.Email); err != nil {
+			return user, err
+		}
+	}
+	return user, userStore.LinkIdentity(ctx, user.ID, provider, profile.Subject)
+}
+
+func cookieValue(cookie *http.Cookie, err error) string {
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
@@ -0,0 +1,1302 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+// schemaFor derives a JSON Schema for t from its Go type and json tags
+func schemaFor(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemaFor(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]any{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if !field.IsExported() || tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaFor(field.Type)
+			// Pointer fields may be absent, so only plain fields without omitempty are required
+			if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]any{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]any{}
+}
+
+func ref(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+func jsonResponse(description string, schema map[string]any) map[string]any {
+	return map[string]any{"description": description, "content": jsonContent(schema)}
+}
+
+// negotiatedResponse documents a body the Accept header may ask for in any of
+// the responseEncoders' formats, or enveloped; the XML and protobuf ones mirror
+// the schema
+func negotiatedResponse(description string, schema map[string]any) map[string]any {
+	content := map[string]any{}
+	for _, encoder := range responseEncoders {
+		if encoder.mediaType() == "application/x-protobuf" {
+			content[encoder.mediaType()] = map[string]any{"schema": map[string]any{"type": "string", "format": "binary", "description": "users.v1.User, or users.v1.ListUsersResponse for lists and pages"}}
+			continue
+		}
+		content[encoder.mediaType()] = map[string]any{"schema": schema}
+	}
+	envelope := schemaFor(reflect.TypeOf(Envelope{}))
+	envelope["properties"].(map[string]any)["data"] = map[string]any{
+		"description": "The body of the plain format; in listings, each user also has links of its own",
+		"allOf":       []any{schema},
+	}
+	content[envelopeEncoder{}.mediaType()] = map[string]any{"schema": envelope}
+	return map[string]any{"description": description, "content": content}
+}
+
+// withHeaders documents the headers a response carries
+func withHeaders(response map[string]any, headers map[string]any) map[string]any {
+	response["headers"] = headers
+	return response
+}
+
+// errorResponse documents the problem details written by writeProblem
+func errorResponse(description string) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     map[string]any{problemContentType: map[string]any{"schema": ref("Problem")}},
+		"headers":     map[string]any{"Content-Language": map[string]any{"description": "Language of the title and messages, from Accept-Language", "schema": map[string]any{"type": "string"}}},
+	}
+}
+
+func queryParam(name, description string, schema map[string]any) map[string]any {
+	return map[string]any{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+// Either scheme authenticates /users requests
+var userSecurity = []any{map[string]any{"bearerAuth": []string{}}, map[string]any{"apiKeyAuth": []string{}}}
+
+// Admin routes take admin API keys or tokens with the admin role
+var adminSecurity = []any{map[string]any{"bearerAuth": []string{}}}
+
+var providerParam = map[string]any{
+	"name": "provider", "in": "path", "required": true,
+	"schema": map[string]any{"type": "string", "enum": []string{config.OAuthProviderGoogle, config.OAuthProviderGitHub}},
+}
+
+var userIDParam = map[string]any{
+	"name": "id", "in": "path", "required": true,
+	"schema": map[string]any{"type": "integer", "format": "int64"},
+}
+
+var deadLetterParam = map[string]any{
+	"name": "sequence", "in": "path", "required": true, "description": "The dead letter's sequence number",
+	"schema": map[string]any{"type": "integer", "format": "int64"},
+}
+
+var photoUploadParam = map[string]any{
+	"name": "upload", "in": "path", "required": true,
+	"schema": map[string]any{"type": "string", "pattern": "^[0-9a-f]{32}$"},
+}
+
+var photoForm = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"photo":   map[string]any{"type": "string", "format": "binary"},
+		"version": map[string]any{"type": "integer", "description": "Alternative to If-Match"},
+	},
+	"required": []string{"photo"},
+}
+
+// buildOpenAPISpec describes every route New registers. API paths are
+// written unversioned and documented under /v1, where they are served; the
+// unversioned forms still work but are deprecated.
+func buildOpenAPISpec() map[string]any {
+	spec := buildUnversionedSpec()
+	paths := map[string]any{}
+	for path, item := range spec["paths"].(map[string]any) {
+		if isLegacyAPIPath(path) {
+			path = versionedPath(apiV1, path)
+		}
+		paths[path] = item
+	}
+	spec["paths"] = paths
+	return spec
+}
+
+func buildUnversionedSpec() map[string]any {
+	str := map[string]any{"type": "string"}
+	ifNoneMatchParam := map[string]any{"name": "If-None-Match", "in": "header", "description": "ETag of a cached copy", "schema": str}
+	envelopeParam := queryParam("envelope", `Return the enveloped format of data, meta and links, as Accept: application/json; profile="`+envelopeProfile+`" does`, map[string]any{"type": "boolean"})
+	notModifiedResponse := map[string]any{"description": "Cached copy is current"}
+	const conditionalGetDescription = "Responses carry an ETag and Cache-Control: private, no-cache. Revalidate a cached copy by sending its ETag in If-None-Match; 304 means it is still current."
+	const metadataFilterDescription = "metadata.<key>=<value> query parameters, any number of them, only match users whose metadata has each key set to that value."
+	integer := map[string]any{"type": "integer"}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "User Service API",
+			"version":     "1.0.0",
+			"description": "Callers signing in with a JWT who aren't admins get 403 everywhere except GET, PUT and PATCH on their own /users/{id} and its photo and touch routes. API key callers are not restricted this way. A request still running when its route's timeout (server.request_timeout_seconds unless set otherwise) runs out gets 504. The titles and messages of error responses are translated into German or French when Accept-Language asks for them, and are English otherwise; Content-Language names the language.",
+		},
+		"components": map[string]any{
+			"schemas": map[string]any{
+				"User":                 schemaFor(reflect.TypeOf(store.User{})),
+				"UserPage":             schemaFor(reflect.TypeOf(UserPage{})),
+				"BulkResult":           schemaFor(reflect.TypeOf(store.BulkResult{})),
+				"Problem":              schemaFor(reflect.TypeOf(Problem{})),
+				"APIKey":               schemaFor(reflect.TypeOf(store.APIKey{})),
+				"DeadLetter":           schemaFor(reflect.TypeOf(DeadLetter{})),
+				"DeadLetterSettlement": schemaFor(reflect.TypeOf(DeadLetterSettlement{})),
+				"Tokens":               schemaFor(reflect.TypeOf(sessionTokens{})),
+				"Group":                schemaFor(reflect.TypeOf(store.Group{})),
+				"Webhook":              schemaFor(reflect.TypeOf(store.Webhook{})),
+				"ImportJob":            schemaFor(reflect.TypeOf(store.ImportJob{})),
+				"CreationJob":          schemaFor(reflect.TypeOf(store.CreationJob{})),
+				"Readiness":            schemaFor(reflect.TypeOf(Readiness{})),
+				"MailSuppression":      schemaFor(reflect.TypeOf(store.MailSuppression{})),
+			},
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "description": "An API key, or a JWT or Entra ID access token when either is configured"},
+				"apiKeyAuth": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key", "description": "A key minted by an admin; read-only keys may only GET"},
+			},
+		},
+		"paths": map[string]any{
+			"/users": map[string]any{
+				"get": map[string]any{
+					"summary":     "List users",
+					"description": metadataFilterDescription + " " + conditionalGetDescription,
+					"security":    userSecurity,
+					"parameters": []any{
+						ifNoneMatchParam,
+						envelopeParam,
+						queryParam("limit", "Page size; enables pagination", integer),
+						queryParam("cursor", "Opaque cursor from a previous page's nextCursor or prevCursor", str),
+						queryParam("q", "Only users whose name or email contains this text", str),
+						queryParam("active_since", "Only users who logged in at or after this RFC 3339 time", map[string]any{"type": "string", "format": "date-time"}),
+						queryParam("email", "Only the user with this email, compared case-insensitively", str),
+						queryParam("createdAfter", "Only users created after this RFC 3339 time", map[string]any{"type": "string", "format": "date-time"}),
+						queryParam("sort", "Field to sort by; ties are ordered by id", map[string]any{"type": "string", "enum": []string{store.SortByID, store.SortByName, store.SortByCreatedAt}, "default": store.SortByID}),
+						queryParam("order", "Sort direction", map[string]any{"type": "string", "enum": []string{"asc", "desc"}, "default": "asc"}),
+						queryParam("include_deleted", "Include soft-deleted users (admins only)", map[string]any{"type": "boolean"}),
+						queryParam("fields", "Comma-separated user fields to return, leaving out the rest; only JSON can be returned then", map[string]any{"type": "string", "example": "id,name,email"}),
+					},
+					"responses": map[string]any{
+						"200": withHeaders(negotiatedResponse(fmt.Sprintf("The first %d users, or a UserPage when limit or cursor is given", defaultPageSize), map[string]any{
+							"oneOf": []any{map[string]any{"type": "array", "items": ref("User")}, ref("UserPage")},
+						}), map[string]any{
+							"X-Total-Count": map[string]any{"description": "Users matching the filters across all pages", "schema": integer},
+							"Link":          map[string]any{"description": `Without limit or cursor, the page after the first as rel="next", when there is one`, "schema": str},
+						}),
+						"304": notModifiedResponse,
+						"400": errorResponse("Invalid query parameters"),
+						"401": errorResponse("Missing or invalid bearer token"),
+						"406": errorResponse("No acceptable format"),
+					},
+				},
+				"post": map[string]any{
+					"summary":     "Create a user",
+					"description": "Retries sent with the same Idempotency-Key within the configured TTL get the first response back, marked Idempotent-Replayed: true, instead of creating the user again. Server errors aren't replayed. With Prefer: respond-async the input is validated and the user is then created in the background, to be polled at the job in Location.",
+					"security":    userSecurity,
+					"parameters": []any{map[string]any{
+						"name": "Idempotency-Key", "in": "header", "description": "Unique per logical request, at most 255 characters", "schema": str,
+					}, map[string]any{
+						"name": "Prefer", "in": "header", "description": "respond-async to get a 202 and a creation job instead of waiting, unless the async_creation feature flag is off for the tenant", "schema": str,
+					}},
+					"requestBody": map[string]any{
+						"required": true,
+						"content": map[string]any{"multipart/form-data": map[string]any{"schema": map[string]any{
+							"type": "object",
+							"properties": map[string]any{
+								"name":      str,
+								"email":     str,
+								"photo":     map[string]any{"type": "string", "format": "binary"},
+								"photo_url": map[string]any{"type": "string", "format": "uri", "description": "Existing picture URL, used instead of uploading photo"},
+								"metadata":  map[string]any{"type": "string", "description": "JSON object of string attributes"},
+								"password":  map[string]any{"type": "string", "format": "password", "description": "Optional local password for POST /auth/login"},
+							},
+						}},
+							"application/json": map[string]any{"schema": schemaFor(reflect.TypeOf(createUserRequest{}))},
+						},
+					},
+					"responses": map[string]any{
+						"200": jsonResponse("User created", map[string]any{
+							"type":       "object",
+							"properties": map[string]any{"message": str, "profile_pic_url": str, "thumbnail_url": str, "thumbnail_urls": map[string]any{"type": "object", "additionalProperties": str}, "profile_pic_md5": str, "user": ref("User")},
+						}),
+						"400": errorResponse("Invalid JSON body or Idempotency-Key"),
+						"409": errorResponse("Email already taken, with code email_taken, or a request with this Idempotency-Key is still in progress"),
+						"413": errorResponse("Request body too large, photo included"),
+						"202": withHeaders(jsonResponse("Creation job queued, with Prefer: respond-async", ref("CreationJob")), map[string]any{"Location": map[string]any{"schema": str}}),
+						"422": errorResponse("Invalid name, email, photo, photo_url, photo_base64, photo_filename, metadata or password, listed per field, or a photo flagged by the malware scan"),
+						"500": errorResponse("Upload or database failure"),
+						"503": errorResponse("Too many uploads, or background creations, in progress, or storage unavailable; retry after Retry-After"),
+					},
+				},
+			},
+			"/jobs/{id}": map[string]any{
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "integer", "format": "int64"}}},
+				"get": map[string]any{
+					"summary":     "Check a background creation",
+					"description": "A succeeded job has the ID of the user created; a failed one says why.",
+					"security":    userSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("The creation job", ref("CreationJob")),
+						"404": errorResponse("Job not found"),
+					},
+				},
+			},
+			"/users/search": map[string]any{
+				"get": map[string]any{
+					"summary":     "Search users by name or email",
+					"description": "Exact matches come first, then prefix matches, then other substring matches, each in ID order. " + conditionalGetDescription,
+					"security":    userSecurity,
+					"parameters": []any{
+						ifNoneMatchParam,
+						map[string]any{"name": "q", "in": "query", "required": true, "description": "Text to look for in names and emails", "schema": str},
+						envelopeParam,
+						queryParam("limit", "Page size", integer),
+						queryParam("cursor", "Opaque cursor from a previous page's nextCursor", str),
+					},
+					"responses": map[string]any{
+						"200": negotiatedResponse("A page of matching users", ref("UserPage")),
+						"304": notModifiedResponse,
+						"400": errorResponse("Missing q or invalid paging parameters"),
+						"401": errorResponse("Missing or invalid bearer token"),
+						"406": errorResponse("No acceptable format"),
+					},
+				},
+			},
+			"/users/by-email/{email}": map[string]any{
+				"parameters": []any{map[string]any{
+					"name": "email", "in": "path", "required": true, "description": "Compared case-insensitively",
+					"schema": map[string]any{"type": "string", "format": "email"},
+				}},
+				"put": map[string]any{
+					"summary":     "Create or update the user with an email",
+					"description": "Idempotent, for syncing from another system: updates the live user with the email, or creates them. Publishes a user.updated or user.created event. The picture and metadata are only replaced if sent.",
+					"security":    userSecurity,
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(upsertUserRequest{})))},
+					"responses": map[string]any{
+						"200": jsonResponse("Updated user", ref("User")),
+						"201": withHeaders(jsonResponse("Created user", ref("User")), map[string]any{"Location": map[string]any{"schema": str}}),
+						"400": errorResponse("Invalid JSON body"),
+						"409": errorResponse("Email taken by a user created at the same time, with code email_taken"),
+						"422": errorResponse("Invalid email, name, photo_url or metadata, listed per field"),
+					},
+				},
+			},
+			"/users/count": map[string]any{
+				"get": map[string]any{
+					"summary":     "Count users",
+					"description": metadataFilterDescription,
+					"security":    userSecurity,
+					"parameters": []any{
+						queryParam("q", "Only count users whose name or email contains this text", str),
+						queryParam("active_since", "Only count users who logged in at or after this RFC 3339 time", map[string]any{"type": "string", "format": "date-time"}),
+						queryParam("email", "Only count the user with this email, compared case-insensitively", str),
+						queryParam("createdAfter", "Only count users created after this RFC 3339 time", map[string]any{"type": "string", "format": "date-time"}),
+						queryParam("include_deleted", "Include soft-deleted users (admins only)", map[string]any{"type": "boolean"}),
+					},
+					"responses": map[string]any{
+						"200": jsonResponse("Number of matching users", map[string]any{
+							"type":       "object",
+							"properties": map[string]any{"count": integer},
+						}),
+						"401": errorResponse("Missing or invalid bearer token"),
+					},
+				},
+			},
+			"/users/exists": map[string]any{
+				"post": map[string]any{
+					"summary":     "Check which emails are registered",
+					"security":    userSecurity,
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(emailExistsRequest{})))},
+					"responses": map[string]any{
+						"200": jsonResponse("The registered subset of the emails", map[string]any{
+							"type":       "object",
+							"properties": map[string]any{"exists": map[string]any{"type": "array", "items": str}},
+						}),
+						"400": errorResponse("Invalid body or too many emails"),
+						"413": errorResponse("Request body too large"),
+						"429": errorResponse("Rate limit exceeded"),
+					},
+				},
+			},
+			"/users/export": map[string]any{
+				"get": map[string]any{
+					"summary":     "Download all users as CSV, a JSON array or newline-delimited JSON",
+					"description": metadataFilterDescription,
+					"security":    userSecurity,
+					"parameters": []any{
+						queryParam("format", "csv (default), json or ndjson", map[string]any{"type": "string", "enum": []string{"csv", "json", "ndjson"}}),
+						queryParam("q", "Only export users whose name or email contains this text", str),
+						queryParam("active_since", "Only export users who logged in at or after this RFC 3339 time", map[string]any{"type": "string", "format": "date-time"}),
+						queryParam("email", "Only export the user with this email, compared case-insensitively", str),
+						queryParam("createdAfter", "Only export users created after this RFC 3339 time", map[string]any{"type": "string", "format": "date-time"}),
+						queryParam("include_deleted", "Include soft-deleted users (admins only)", map[string]any{"type": "boolean"}),
+					},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "Streamed export, served as an attachment",
+							"content": map[string]any{
+								"text/csv":             map[string]any{"schema": str},
+								"application/json":     map[string]any{"schema": map[string]any{"type": "array", "items": ref("User")}},
+								"application/x-ndjson": map[string]any{"schema": ref("User")},
+							},
+						},
+						"400": errorResponse("Unknown format"),
+					},
+				},
+			},
+			"/users/bulk": map[string]any{
+				"post": map[string]any{
+					"summary":     "Import users in bulk",
+					"security":    userSecurity,
+					"parameters":  []any{queryParam("atomic", "Roll back the whole batch if any row fails", map[string]any{"type": "boolean"})},
+					"requestBody": map[string]any{"required": true, "content": jsonContent(map[string]any{"type": "array", "items": ref("User")})},
+					"responses": map[string]any{
+						"200": jsonResponse("Per-row results", map[string]any{
+							"type": "object",
+							"properties": map[string]any{
+								"created": integer, "failed": integer,
+								"results": map[string]any{"type": "array", "items": ref("BulkResult")},
+							},
+						}),
+						"413": errorResponse("Body or batch exceeds the configured maximum"),
+						"422": errorResponse("Atomic import rolled back because a row failed"),
+					},
+				},
+			},
+			"/users:batch": map[string]any{
+				"post": map[string]any{
+					"summary":     "Create users in bulk, with a result per user",
+					"description": "The same as POST /users/bulk, inserting in chunks of 500 per transaction unless atomic. Retries with the same Idempotency-Key get the first response back.",
+					"security":    userSecurity,
+					"parameters": []any{
+						queryParam("atomic", "Roll back the whole batch if any row fails", map[string]any{"type": "boolean"}),
+						map[string]any{"name": "Idempotency-Key", "in": "header", "description": "Unique per logical request, at most 255 characters", "schema": str},
+					},
+					"requestBody": map[string]any{"required": true, "content": jsonContent(map[string]any{"type": "array", "items": ref("User")})},
+					"responses": map[string]any{
+						"200": jsonResponse("Per-row results", map[string]any{
+							"type": "object",
+							"properties": map[string]any{
+								"created": integer, "failed": integer,
+								"results": map[string]any{"type": "array", "items": ref("BulkResult")},
+							},
+						}),
+						"409": errorResponse("A request with this Idempotency-Key is still in progress"),
+						"413": errorResponse("Body or batch exceeds the configured maximum"),
+						"422": errorResponse("Atomic import rolled back because a row failed"),
+					},
+				},
+			},
+			"/users/import": map[string]any{
+				"post": map[string]any{
+					"summary":     "Import users from a CSV",
+					"description": "The header row names the columns: name and email, which are required, and link and metadata (a JSON object). Rows are inserted in batches as they arrive; rows that fail are skipped and reported.",
+					"security":    userSecurity,
+					"requestBody": map[string]any{
+						"required": true,
+						"content": map[string]any{
+							"text/csv": map[string]any{"schema": str},
+							"multipart/form-data": map[string]any{"schema": map[string]any{
+								"type":       "object",
+								"required":   []string{"file"},
+								"properties": map[string]any{"file": map[string]any{"type": "string", "format": "binary"}},
+							}},
+						},
+					},
+					"responses": map[string]any{
+						"200": jsonResponse("The finished import job and the rows that failed", map[string]any{
+							"type": "object",
+							"properties": map[string]any{
+								"job": ref("ImportJob"),
+								"errors": map[string]any{"type": "array", "items": map[string]any{
+									"type":       "object",
+									"properties": map[string]any{"line": integer, "email": str, "error": str},
+								}},
+								"errorsTruncated": map[string]any{"type": "boolean", "description": "Whether more rows failed than are listed"},
+							},
+						}),
+						"400": errorResponse("Not a CSV, or an invalid header"),
+						"413": errorResponse("Upload exceeds the configured maximum"),
+					},
+				},
+				"get": map[string]any{
+					"summary":    "List import jobs, newest first",
+					"security":   userSecurity,
+					"parameters": []any{queryParam("limit", "How many jobs", integer)},
+					"responses": map[string]any{
+						"200": jsonResponse("Import jobs", map[string]any{"type": "array", "items": ref("ImportJob")}),
+					},
+				},
+			},
+			"/users/import/{id}": map[string]any{
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "integer", "format": "int64"}}},
+				"get": map[string]any{
+					"summary":  "Check the progress of an import",
+					"security": userSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("The import job", ref("ImportJob")),
+						"404": errorResponse("Import job not found"),
+					},
+				},
+			},
+			"/users/{id}": map[string]any{
+				"parameters": []any{userIDParam},
+				"get": map[string]any{
+					"summary":     "Get a user",
+					"description": conditionalGetDescription,
+					"security":    userSecurity,
+					"parameters":  []any{ifNoneMatchParam, envelopeParam},
+					"responses": map[string]any{
+						"200": negotiatedResponse("The user", ref("User")),
+						"304": notModifiedResponse,
+						"404": errorResponse("User not found"),
+						"406": errorResponse("No acceptable format"),
+					},
+				},
+				"put": map[string]any{
+					"summary":     "Replace a user's fields",
+					"description": "Publishes a user.updated event. The picture is only replaced if photo or photo_url is sent.",
+					"security":    userSecurity,
+					"requestBody": map[string]any{
+						"required": true,
+						"content": map[string]any{"multipart/form-data": map[string]any{"schema": map[string]any{
+							"type":     "object",
+							"required": []string{"name", "email"},
+							"properties": map[string]any{
+								"name":      str,
+								"email":     str,
+								"photo":     map[string]any{"type": "string", "format": "binary"},
+								"photo_url": map[string]any{"type": "string", "format": "uri", "description": "Existing picture URL, used instead of uploading photo"},
+								"metadata":  map[string]any{"type": "string", "description": "JSON object of string attributes, replacing the user's; left unchanged if absent"},
+								"version":   map[string]any{"type": "integer", "description": "Alternative to If-Match"},
+							},
+						}}},
+					},
+					"responses": map[string]any{
+						"200": jsonResponse("Updated user", ref("User")),
+						"404": errorResponse("User not found"),
+						"409": errorResponse("Email taken, or the user changed since the given version"),
+						"412": errorResponse("The user changed since the If-Match ETag, or it is not one from this API"),
+						"413": errorResponse("Request body too large, photo included"),
+						"422": errorResponse("Invalid name, email, photo, photo_url or metadata, listed per field, or a photo flagged by the malware scan"),
+						"428": errorResponse("Neither If-Match nor version supplied"),
+					},
+				},
+				"patch": map[string]any{
+					"summary":     "Update some of a user's fields",
+					"description": "The body is a JSON Merge Patch (RFC 7396); only the members present are changed. application/json is accepted too.",
+					"security":    userSecurity,
+					"requestBody": map[string]any{"required": true, "content": map[string]any{
+						mergePatchContentType: map[string]any{"schema": schemaFor(reflect.TypeOf(userPatch{}))},
+						"application/json":    map[string]any{"schema": schemaFor(reflect.TypeOf(userPatch{}))},
+					}},
+					"responses": map[string]any{
+						"200": jsonResponse("The updated user", ref("User")),
+						"400": errorResponse("No updatable fields, or null for name or email"),
+						"404": errorResponse("User not found"),
+						"413": errorResponse("Request body too large"),
+						"415": errorResponse("Content-Type is not a merge patch or JSON"),
+						"409": errorResponse("Email already taken, or the user changed since the given version"),
+						"412": errorResponse("The user changed since the If-Match ETag, or it is not one from this API"),
+						"422": errorResponse("Invalid name, email or metadata, listed per field"),
+						"428": errorResponse("Neither If-Match nor version supplied"),
+					},
+				},
+				"delete": map[string]any{
+					"summary":     "Delete a user (soft or hard, per configuration)",
+					"description": "Publishes a user.deleted event. A hard delete also removes the profile picture and thumbnail; a soft delete keeps them for a restore, until the user is purged after the configured retention period.",
+					"security":    userSecurity,
+					"responses": map[string]any{
+						"204": map[string]any{"description": "User deleted"},
+						"404": errorResponse("User not found"),
+						"412": errorResponse("If-Match did not match the current ETag"),
+						"428": errorResponse("If-Match required"),
+					},
+				},
+			},
+			"/users/{id}/groups": map[string]any{
+				"parameters": []any{userIDParam},
+				"get": map[string]any{
+					"summary":  "List the groups a user belongs to",
+					"security": userSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("The user's groups in ID order", map[string]any{"type": "array", "items": ref("Group")}),
+						"404": errorResponse("User not found"),
+					},
+				},
+			},
+			"/users/{id}/activity": map[string]any{
+				"parameters": []any{userIDParam},
+				"get": map[string]any{
+					"summary":  "List a user's activity, newest first: created, logins, email and picture changes",
+					"security": userSecurity,
+					"parameters": []any{
+						queryParam("limit", "Page size", integer),
+						queryParam("cursor", "Opaque cursor from a previous page's nextCursor", str),
+					},
+					"responses": map[string]any{
+						"200": jsonResponse("A page of the user's activity", schemaFor(reflect.TypeOf(ActivityPage{}))),
+						"400": errorResponse("Invalid query parameters"),
+						"404": errorResponse("User not found"),
+					},
+				},
+			},
+			"/groups": map[string]any{
+				"post": map[string]any{
+					"summary":     "Create a group (admins only)",
+					"security":    adminSecurity,
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(groupRequest{})))},
+					"responses": map[string]any{
+						"201": jsonResponse("Created group", ref("Group")),
+						"400": errorResponse("Invalid JSON body"),
+						"409": errorResponse("A group with this name already exists"),
+						"422": errorResponse("Invalid name or description, listed per field"),
+					},
+				},
+			},
+			"/groups/{id}/members": map[string]any{
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "integer", "format": "int64"}}},
+				"post": map[string]any{
+					"summary":     "Add a user to a group (admins only)",
+					"description": "Adding a user who already is a member changes nothing.",
+					"security":    adminSecurity,
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(groupMemberRequest{})))},
+					"responses": map[string]any{
+						"204": map[string]any{"description": "The user is a member"},
+						"400": errorResponse("Invalid group ID or userId"),
+						"404": errorResponse("Group not found"),
+						"422": errorResponse("User not found"),
+					},
+				},
+			},
+			"/webhooks": map[string]any{
+				"post": map[string]any{
+					"summary":     "Register a webhook for the tenant's user events (admins only)",
+					"description": "Each event is POSTed as the user's JSON with X-Event-Type, X-Delivery-ID and X-Signature, the hex HMAC-SHA256 of the body under the secret, and retried with exponential backoff until a 2xx.",
+					"security":    adminSecurity,
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(webhookRequest{})))},
+					"responses": map[string]any{
+						"201": jsonResponse("Registered webhook, with the secret shown only this once", ref("Webhook")),
+						"400": errorResponse("Invalid JSON body"),
+						"422": errorResponse("Invalid url, secret or events, listed per field"),
+					},
+				},
+				"get": map[string]any{
+					"summary":  "List the tenant's webhooks (admins only)",
+					"security": adminSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("Webhooks in ID order, without secrets", map[string]any{"type": "array", "items": ref("Webhook")}),
+					},
+				},
+			},
+			"/webhooks/{id}": map[string]any{
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "integer", "format": "int64"}}},
+				"delete": map[string]any{
+					"summary":  "Delete a webhook and its delivery log (admins only)",
+					"security": adminSecurity,
+					"responses": map[string]any{
+						"204": map[string]any{"description": "Webhook deleted"},
+						"404": errorResponse("Webhook not found"),
+					},
+				},
+			},
+			"/webhooks/{id}/deliveries": map[string]any{
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "integer", "format": "int64"}}},
+				"get": map[string]any{
+					"summary":    "List attempts to deliver to a webhook, newest first (admins only)",
+					"security":   adminSecurity,
+					"parameters": []any{queryParam("limit", "How many attempts", integer)},
+					"responses": map[string]any{
+						"200": jsonResponse("Delivery attempts", map[string]any{"type": "array", "items": schemaFor(reflect.TypeOf(store.WebhookAttempt{}))}),
+						"400": errorResponse("Invalid webhook ID or limit"),
+						"404": errorResponse("Webhook not found"),
+					},
+				},
+			},
+			"/users/{id}/export": map[string]any{
+				"parameters": []any{userIDParam},
+				"get": map[string]any{
+					"summary":     "Export everything held about a user",
+					"description": "A ZIP of user.json, audit.json and the user's picture and thumbnail when stored here, streamed as it is built. With stage=true it is uploaded to blob storage instead, and the response links to it until expiresAt.",
+					"security":    userSecurity,
+					"parameters":  []any{queryParam("stage", "Upload the ZIP and return a time-limited link to it", map[string]any{"type": "boolean"})},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "The ZIP, or its link when staged",
+							"content": map[string]any{
+								"application/zip":  map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+								"application/json": map[string]any{"schema": schemaFor(reflect.TypeOf(stagedDataExport{}))},
+							},
+						},
+						"404": errorResponse("User not found"),
+						"500": errorResponse("Staging the export failed"),
+					},
+				},
+			},
+			"/users/{id}/personal-data": map[string]any{
+				"parameters": []any{userIDParam},
+				"delete": map[string]any{
+					"summary":     "Erase a user's personal data (admins only)",
+					"description": "Irreversibly anonymizes the user, live or soft-deleted, deletes their pictures, sign-in identities and sessions, scrubs their audit history and leaves a tombstone that can't be restored. Publishes a user.erased event so consumers purge their copies.",
+					"security":    userSecurity,
+					"responses": map[string]any{
+						"204": map[string]any{"description": "Personal data erased"},
+						"403": errorResponse("Caller is not an admin"),
+						"404": errorResponse("User not found or already erased"),
+					},
+				},
+			},
+			"/users/{id}/touch": map[string]any{
+				"parameters": []any{userIDParam},
+				"post": map[string]any{
+					"summary":  "Record that a user logged in now",
+					"security": userSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("The stored login time", map[string]any{
+							"type":       "object",
+							"properties": map[string]any{"lastLoginAt": map[string]any{"type": "string", "format": "date-time"}},
+						}),
+						"404": errorResponse("User not found"),
+					},
+				},
+			},
+			"/users/{id}/restore": map[string]any{
+				"parameters": []any{userIDParam},
+				"post": map[string]any{
+					"summary":  "Restore a soft-deleted user (admins only)",
+					"security": userSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("Restored user", ref("User")),
+						"403": errorResponse("Caller is not an admin"),
+						"404": errorResponse("Deleted user not found"),
+						"409": errorResponse("Email now taken by another user"),
+					},
+				},
+			},
+			"/users/{id}/unlock": map[string]any{
+				"parameters": []any{userIDParam},
+				"post": map[string]any{
+					"summary":  "Unlock a user locked out after repeated failed sign-ins (admins only)",
+					"security": userSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("Unlocked user", ref("User")),
+						"403": errorResponse("Caller is not an admin"),
+						"404": errorResponse("Locked user not found"),
+					},
+				},
+			},
+			"/users/{id}/photo/sas": map[string]any{
+				"parameters": []any{userIDParam},
+				"get": map[string]any{
+					"summary":     "Issue fresh read-only SAS URLs for a user's picture and thumbnails",
+					"description": "For private containers, whose stored links clients can't read. Pictures hosted elsewhere keep their links.",
+					"security":    userSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("Signed links, working until expiresAt", map[string]any{
+							"type": "object",
+							"properties": map[string]any{
+								"url": str, "thumbnailUrl": str,
+								"thumbnails": map[string]any{"type": "object", "additionalProperties": str},
+								"expiresAt":  map[string]any{"type": "string", "format": "date-time"},
+							},
+						}),
+						"404": errorResponse("User, or their picture, not found"),
+					},
+				},
+			},
+			"/users/{id}/photo": map[string]any{
+				"parameters": []any{userIDParam},
+				"get": map[string]any{
+					"summary":     "Download a user's profile picture",
+					"description": "Pictures linked with photo_url are redirected to. Revalidate cached copies with If-None-Match.",
+					"security":    userSecurity,
+					"parameters": []any{
+						ifNoneMatchParam,
+						queryParam("size", "thumbnail, a size from the user's thumbnails, or left out for the original", str),
+					},
+					"responses": map[string]any{
+						"200": map[string]any{"description": "The picture", "content": map[string]any{"image/*": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}},
+						"302": map[string]any{"description": "The picture is hosted elsewhere"},
+						"304": notModifiedResponse,
+						"404": errorResponse("User, or their picture, not found"),
+						"502": errorResponse("Blob storage failed"),
+					},
+				},
+				"head": map[string]any{
+					"summary":     "Check a user's profile picture",
+					"description": "Pictures linked with photo_url are redirected to. Revalidate cached copies with If-None-Match.",
+					"security":    userSecurity,
+					"parameters": []any{
+						ifNoneMatchParam,
+						queryParam("size", "thumbnail, a size from the user's thumbnails, or left out for the original", str),
+					},
+					"responses": map[string]any{
+						"200": map[string]any{"description": "The picture's headers, without the picture", "content": map[string]any{"image/*": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}},
+						"302": map[string]any{"description": "The picture is hosted elsewhere"},
+						"304": notModifiedResponse,
+						"404": errorResponse("User, or their picture, not found"),
+						"502": errorResponse("Blob storage failed"),
+					},
+				},
+				"put": map[string]any{
+					"summary":     "Replace a user's profile picture",
+					"security":    userSecurity,
+					"requestBody": map[string]any{"required": true, "content": map[string]any{"multipart/form-data": map[string]any{"schema": photoForm}}},
+					"responses": map[string]any{
+						"200": jsonResponse("Photo replaced", map[string]any{
+							"type":       "object",
+							"properties": map[string]any{"message": str, "link": str, "thumbnailLink": str, "thumbnails": map[string]any{"type": "object", "additionalProperties": str}, "checksum": str},
+						}),
+						"404": errorResponse("User not found"),
+						"413": errorResponse("Request body too large, photo included"),
+						"409": errorResponse("The user changed since the given version"),
+						"412": errorResponse("The user changed since the If-Match ETag, or it is not one from this API"),
+						"422": errorResponse("Photo too large or not an accepted image type, or flagged by the malware scan"),
+						"428": errorResponse("Neither If-Match nor version supplied"),
+					},
+				},
+			},
+			"/users/{id}/photo/uploads": map[string]any{
+				"parameters": []any{userIDParam},
+				"post": map[string]any{
+					"summary":     "Start a chunked, resumable profile picture upload",
+					"description": "Send the chunks with PUT, in any order and as often as needed, then commit them. Chunks not committed within a week are discarded.",
+					"security":    userSecurity,
+					"responses": map[string]any{
+						"201": withHeaders(jsonResponse("Upload started", schemaFor(reflect.TypeOf(photoUpload{}))), map[string]any{"Location": map[string]any{"schema": str}}),
+						"404": errorResponse("User not found"),
+					},
+				},
+			},
+			"/users/{id}/photo/uploads/{upload}": map[string]any{
+				"parameters": []any{userIDParam, photoUploadParam},
+				"get": map[string]any{
+					"summary":  "List the chunks a picture upload received, to resume it",
+					"security": userSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("The upload and its chunks so far", schemaFor(reflect.TypeOf(photoUpload{}))),
+						"404": errorResponse("User not found"),
+					},
+				},
+			},
+			"/users/{id}/photo/uploads/{upload}/chunks/{index}": map[string]any{
+				"parameters": []any{userIDParam, photoUploadParam, map[string]any{"name": "index", "in": "path", "required": true, "schema": map[string]any{"type": "integer", "minimum": 0, "maximum": maxPhotoUploadChunks - 1}}},
+				"put": map[string]any{
+					"summary":     "Send one chunk of a picture upload, replacing any sent before at this index",
+					"description": "With a Content-MD5 header, chunks damaged on the way are refused.",
+					"security":    userSecurity,
+					"parameters":  []any{map[string]any{"name": "Content-MD5", "in": "header", "description": "Base64 MD5 of the chunk", "schema": str}},
+					"requestBody": map[string]any{"required": true, "content": map[string]any{"application/octet-stream": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}},
+					"responses": map[string]any{
+						"204": map[string]any{"description": "Chunk stored"},
+						"400": errorResponse("Empty chunk, bad index, or a chunk not matching its Content-MD5"),
+						"404": errorResponse("User not found"),
+						"413": errorResponse("Chunk larger than server.max_upload_bytes"),
+					},
+				},
+			},
+			"/users/{id}/photo/uploads/{upload}/commit": map[string]any{
+				"parameters": []any{userIDParam, photoUploadParam},
+				"post": map[string]any{
+					"summary":     "Join a picture upload's chunks and make it the user's profile picture",
+					"security":    userSecurity,
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(commitPhotoUploadRequest{})))},
+					"responses": map[string]any{
+						"200": jsonResponse("Photo replaced", map[string]any{
+							"type":       "object",
+							"properties": map[string]any{"message": str, "link": str, "thumbnailLink": str, "thumbnails": map[string]any{"type": "object", "additionalProperties": str}, "checksum": str},
+						}),
+						"400": errorResponse("Invalid JSON body"),
+						"404": errorResponse("User not found"),
+						"409": errorResponse("A chunk is missing, or the user changed since the given version"),
+						"412": errorResponse("The user changed since the If-Match ETag, or it is not one from this API"),
+						"422": errorResponse("Invalid filename or chunks, or the picture is too large or not an accepted image type, or flagged by the malware scan"),
+						"428": errorResponse("Neither If-Match nor version supplied"),
+					},
+				},
+			},
+			"/users/{id}/password": map[string]any{
+				"parameters": []any{userIDParam},
+				"put": map[string]any{
+					"summary":     "Set a user's local password",
+					"description": "Changing an existing password takes currentPassword, unless an admin sets it. Users with two-factor enabled must have verified a code recently.",
+					"security":    userSecurity,
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(passwordRequest{})))},
+					"responses": map[string]any{
+						"204": map[string]any{"description": "Password set"},
+						"400": errorResponse("Invalid JSON body"),
+						"403": errorResponse("Caller is neither this user nor an admin, currentPassword is wrong, or a recent two-factor verification is needed"),
+						"404": errorResponse("User not found"),
+						"422": errorResponse("Password too short, too long, too common or containing the email"),
+					},
+				},
+			},
+			"/users/{id}/2fa": map[string]any{
+				"parameters": []any{userIDParam},
+				"post": map[string]any{
+					"summary":  "Start TOTP two-factor enrollment for the caller's own user",
+					"security": userSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("New secret and its otpauth:// provisioning URI", schemaFor(reflect.TypeOf(totpEnrollment{}))),
+						"403": errorResponse("Caller is not this user"),
+						"404": errorResponse("User not found"),
+						"409": errorResponse("Two-factor authentication is already enabled"),
+					},
+				},
+			},
+			"/users/{id}/2fa/confirm": map[string]any{
+				"parameters": []any{userIDParam},
+				"post": map[string]any{
+					"summary":     "Enable two-factor authentication with a code from the enrolled secret",
+					"security":    userSecurity,
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(twoFactorRequest{})))},
+					"responses": map[string]any{
+						"200": jsonResponse("One-time recovery codes, shown only this once", map[string]any{
+							"type":       "object",
+							"properties": map[string]any{"recoveryCodes": map[string]any{"type": "array", "items": str}},
+						}),
+						"403": errorResponse("Caller is not this user"),
+						"409": errorResponse("Not enrolled, or already enabled"),
+						"422": errorResponse("Invalid code"),
+					},
+				},
+			},
+			"/auth/login": map[string]any{
+				"post": map[string]any{
+					"summary":     "Start a session with an identity provider token or a password",
+					"description": "Only served when auth.sessions is configured. An identity provider token, with auth.jwt or auth.entra configured, goes in Authorization: Bearer; without one the body carries the email and password. Users with two-factor enabled get a pending token, usable only at /auth/2fa.",
+					"security":    []any{map[string]any{"bearerAuth": []string{}}, map[string]any{}},
+					"requestBody": map[string]any{"content": jsonContent(schemaFor(reflect.TypeOf(passwordLoginRequest{})))},
+					"responses": map[string]any{
+						"200": jsonResponse("Access and refresh tokens", ref("Tokens")),
+						"400": errorResponse("Invalid JSON body, or email or password missing"),
+						"401": errorResponse("Invalid provider token, or wrong email or password"),
+						"403": errorResponse("Email not verified, when verification.require_for_login is set"),
+						"423": errorResponse("Account locked"),
+					},
+				},
+			},
+			"/auth/forgot-password": map[string]any{
+				"post": map[string]any{
+					"summary":     "Email a password reset link",
+					"description": "Only served when password_reset.enabled is set. Answers the same whether or not the email has an account; a user is sent at most password_reset.max_per_hour links an hour.",
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(forgotPasswordRequest{})))},
+					"responses": map[string]any{
+						"202": jsonResponse("Link sent if the email has an account", map[string]any{"type": "object", "properties": map[string]any{"message": str}}),
+						"400": errorResponse("Invalid JSON body"),
+						"422": errorResponse("Invalid email"),
+						"429": errorResponse("Rate limit exceeded, or too many failures from this IP"),
+					},
+				},
+			},
+			"/auth/reset-password": map[string]any{
+				"post": map[string]any{
+					"summary":     "Set a new password with the token of a reset link",
+					"description": "Only served when password_reset.enabled is set. The token works once; resetting also uses up the user's other links and ends their sessions.",
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(resetPasswordRequest{})))},
+					"responses": map[string]any{
+						"204": map[string]any{"description": "Password reset"},
+						"400": errorResponse("Invalid JSON body, or invalid, expired or used token"),
+						"422": errorResponse("Password too short, too long, too common or containing the email"),
+						"429": errorResponse("Rate limit exceeded, or too many failures from this IP"),
+					},
+				},
+			},
+			"/auth/{provider}/login": map[string]any{
+				"parameters": []any{providerParam},
+				"get": map[string]any{
+					"summary":     "Start a social login",
+					"description": "Only served for providers configured under oauth.providers. Redirects the browser to the provider.",
+					"responses": map[string]any{
+						"302": map[string]any{"description": "Redirect to the provider"},
+						"404": errorResponse("Unknown provider"),
+					},
+				},
+			},
+			"/auth/{provider}/callback": map[string]any{
+				"parameters": []any{providerParam},
+				"get": map[string]any{
+					"summary":     "Finish a social login",
+					"description": "Where the provider sends the browser back. Provisions a user on first login and starts a session.",
+					"parameters":  []any{queryParam("code", "Authorization code", str), queryParam("state", "State from the login redirect", str)},
+					"responses": map[string]any{
+						"200": jsonResponse("Access and refresh tokens", ref("Tokens")),
+						"400": errorResponse("Login expired or state mismatch"),
+						"401": errorResponse("Login refused or code exchange failed"),
+						"403": errorResponse("Provider account has no verified email"),
+						"423": errorResponse("Account locked"),
+					},
+				},
+			},
+			"/verify": map[string]any{
+				"get": map[string]any{
+					"summary":     "Verify a user's email",
+					"description": "Opened from the link emailed to new users and to changed emails. Following a link again changes nothing. Only served when verification.secret is configured.",
+					"parameters":  []any{queryParam("token", "Token from the emailed link", str)},
+					"responses": map[string]any{
+						"200": jsonResponse("Email verified", map[string]any{
+							"type":       "object",
+							"properties": map[string]any{"message": str, "email": str, "emailVerifiedAt": map[string]any{"type": "string", "format": "date-time"}},
+						}),
+						"400": errorResponse("Invalid or expired verification link"),
+						"410": errorResponse("The user is gone, or their email changed since the link was sent"),
+					},
+				},
+			},
+			"/auth/refresh": map[string]any{
+				"post": map[string]any{
+					"summary":     "Swap a refresh token for new tokens",
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(refreshRequest{})))},
+					"responses": map[string]any{
+						"200": jsonResponse("New access and refresh tokens; the old refresh token stops working", ref("Tokens")),
+						"400": errorResponse("Missing refresh token"),
+						"401": errorResponse("Refresh token invalid, expired or revoked"),
+					},
+				},
+			},
+			"/auth/logout": map[string]any{
+				"post": map[string]any{
+					"summary":     "End a session",
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(refreshRequest{})))},
+					"responses": map[string]any{
+						"204": map[string]any{"description": "Session ended, or already was"},
+						"400": errorResponse("Missing refresh token"),
+					},
+				},
+			},
+			"/auth/2fa": map[string]any{
+				"post": map[string]any{
+					"summary":     "Verify a two-factor code for the session",
+					"description": "Takes the session's access token, pending or not. Completes a pending login, or renews the recent verification deleting an account or changing its email needs.",
+					"security":    []any{map[string]any{"bearerAuth": []string{}}},
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(twoFactorRequest{})))},
+					"responses": map[string]any{
+						"200": jsonResponse("A new access token; keep the refresh token", ref("Tokens")),
+						"400": errorResponse("No code given, or two-factor is not enabled for the user"),
+						"401": errorResponse("Invalid token or code"),
+					},
+				},
+			},
+			"/admin/api-keys": map[string]any{
+				"get": map[string]any{
+					"summary":   "List managed API keys (admins only)",
+					"security":  adminSecurity,
+					"responses": map[string]any{"200": jsonResponse("Every key, revoked ones included", map[string]any{"type": "array", "items": ref("APIKey")})},
+				},
+				"post": map[string]any{
+					"summary":     "Mint a managed API key (admins only)",
+					"security":    adminSecurity,
+					"requestBody": map[string]any{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(apiKeyRequest{})))},
+					"responses": map[string]any{
+						"201": jsonResponse("The key, returned only this once", schemaFor(reflect.TypeOf(mintedAPIKey{}))),
+						"400": errorResponse("Missing name or unknown scope"),
+					},
+				},
+			},
+			"/admin/api-keys/{id}": map[string]any{
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": integer}},
+				"delete": map[string]any{
+					"summary":  "Revoke a managed API key (admins only)",
+					"security": adminSecurity,
+					"responses": map[string]any{
+						"204": map[string]any{"description": "Key revoked"},
+						"404": errorResponse("Key not found or already revoked"),
+					},
+				},
+			},
+			"/admin/deadletters": map[string]any{
+				"get": map[string]any{
+					"summary":  "Peek at dead-lettered events (admins only)",
+					"security": adminSecurity,
+					"parameters": []any{
+						queryParam("max", fmt.Sprintf("Messages to return, at most %d", maxDeadLetterPeek), integer),
+						queryParam("from", "Sequence number to start at, for the next page", integer),
+					},
+					"responses": map[string]any{
+						"200": jsonResponse("Dead-lettered messages, left in place", map[string]any{"type": "array", "items": ref("DeadLetter")}),
+						"400": errorResponse("max or from is not a positive integer"),
+					},
+				},
+				"delete": map[string]any{
+					"summary":    "Purge dead-lettered events for good (admins only)",
+					"security":   adminSecurity,
+					"parameters": []any{queryParam("max", fmt.Sprintf("Messages to purge, at most %d", maxDeadLetterScan), integer)},
+					"responses": map[string]any{
+						"200": jsonResponse("How many were purged", ref("DeadLetterSettlement")),
+						"400": errorResponse("max is not a positive integer"),
+					},
+				},
+			},
+			"/admin/deadletters/requeue": map[string]any{
+				"post": map[string]any{
+					"summary":    "Send dead-lettered events back to the user queue (admins only)",
+					"security":   adminSecurity,
+					"parameters": []any{queryParam("max", fmt.Sprintf("Messages to requeue, at most %d", maxDeadLetterScan), integer)},
+					"responses": map[string]any{
+						"200": jsonResponse("How many were requeued", ref("DeadLetterSettlement")),
+						"400": errorResponse("max is not a positive integer"),
+					},
+				},
+			},
+			"/admin/deadletters/{sequence}": map[string]any{
+				"parameters": []any{deadLetterParam},
+				"get": map[string]any{
+					"summary":  "View a dead-lettered event (admins only)",
+					"security": adminSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("The message, left in place", ref("DeadLetter")),
+						"404": errorResponse("Dead letter not found"),
+					},
+				},
+				"delete": map[string]any{
+					"summary":  "Purge a dead-lettered event for good (admins only)",
+					"security": adminSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("The message was purged", ref("DeadLetterSettlement")),
+						"404": errorResponse("Dead letter not found"),
+					},
+				},
+			},
+			"/admin/deadletters/{sequence}/requeue": map[string]any{
+				"parameters": []any{deadLetterParam},
+				"post": map[string]any{
+					"summary":  "Send a dead-lettered event back to the user queue (admins only)",
+					"security": adminSecurity,
+					"responses": map[string]any{
+						"200": jsonResponse("The message was requeued", ref("DeadLetterSettlement")),
+						"404": errorResponse("Dead letter not found"),
+					},
+				},
+			},
+			"/events": map[string]any{
+				"get": map[string]any{
+					"summary":     "Stream the tenant's user events (Server-Sent Events)",
+					"description": "Sends user.created, user.updated and user.deleted events, each with its ID and the user's JSON, plus a comment every event_stream.heartbeat_seconds. A client reconnecting with Last-Event-ID gets the events it missed, or a stream.reset event when they are no longer kept. Open to admins and API keys with users:read.",
+					"security":    userSecurity,
+					"parameters": []any{
+						map[string]any{"name": "Last-Event-ID", "in": "header", "description": "ID of the last event received", "schema": integer},
+						queryParam("lastEventId", "Last-Event-ID, for clients that can't set headers", integer),
+					},
+					"responses": map[string]any{
+						"200": map[string]any{"description": "The event stream", "content": map[string]any{"text/event-stream": map[string]any{"schema": str}}},
+						"400": errorResponse("Invalid Last-Event-ID"),
+						"403": errorResponse("Caller is not an admin, or their API key lacks users:read"),
+					},
+				},
+			},
+			"/audit": map[string]any{
+				"get": map[string]any{
+					"summary":     "List audit events (admins only)",
+					"description": "Every change to a user, newest first, across every tenant unless tenant is given. changes lists the fields that differ between before and after when both are known.",
+					"security":    adminSecurity,
+					"parameters": []any{
+						queryParam("tenant", "Only events in this tenant", str),
+						queryParam("user_id", "Only events for this user", integer),
+						queryParam("actor", "Only changes by this actor, e.g. a JWT subject or api-key:<id>", str),
+						queryParam("action", "Only this action, e.g. user.updated", str),
+						queryParam("since", "Only events at or after this RFC 3339 time", map[string]any{"type": "string", "format": "date-time"}),
+						queryParam("until", "Only events before this RFC 3339 time", map[string]any{"type": "string", "format": "date-time"}),
+						queryParam("limit", "Page size", integer),
+						queryParam("cursor", "Opaque cursor from a previous page's nextCursor", str),
+					},
+					"responses": map[string]any{
+						"200": jsonResponse("A page of events", schemaFor(reflect.TypeOf(AuditPage{}))),
+						"400": errorResponse("Invalid query parameters"),
+					},
+				},
+			},
+			"/admin/cleanup-blobs": map[string]any{
+				"post": map[string]any{
+					"summary":    "Delete pictures no user links to (admins only)",
+					"security":   adminSecurity,
+					"parameters": []any{queryParam("dry_run", "Only report the orphans", map[string]any{"type": "boolean"})},
+					"responses": map[string]any{
+						"200": jsonResponse("What was found and deleted", schemaFor(reflect.TypeOf(BlobCleanupReport{}))),
+					},
+				},
+			},
+			"/admin/retention": map[string]any{
+				"post": map[string]any{
+					"summary":    "Apply the retention rules now: delete inactive users and old audit events (admins only)",
+					"security":   adminSecurity,
+					"parameters": []any{queryParam("dry_run", "Only report what the rules match", map[string]any{"type": "boolean"})},
+					"responses": map[string]any{
+						"200": jsonResponse("What each rule found and removed", schemaFor(reflect.TypeOf(RetentionReport{}))),
+						"500": errorResponse("A rule failed"),
+					},
+				},
+			},
+			"/admin/mail/suppressions": map[string]any{
+				"get": map[string]any{
+					"summary":   "List emails notifications aren't sent to (admins only)",
+					"security":  adminSecurity,
+					"responses": map[string]any{"200": jsonResponse("Every suppressed email, in order", map[string]any{"type": "array", "items": ref("MailSuppression")})},
+				},
+			},
+			"/admin/mail/suppressions/{email}": map[string]any{
+				"parameters": []any{map[string]any{"name": "email", "in": "path", "required": true, "schema": str}},
+				"put": map[string]any{
+					"summary":     "Stop sending notification emails to an address, in every tenant (admins only)",
+					"security":    adminSecurity,
+					"requestBody": map[string]any{"content": jsonContent(schemaFor(reflect.TypeOf(suppressionRequest{})))},
+					"responses": map[string]any{
+						"200": jsonResponse("The address is suppressed", ref("MailSuppression")),
+						"400": errorResponse("Invalid email, or reason too long"),
+					},
+				},
+				"delete": map[string]any{
+					"summary":  "Send notification emails to an address again (admins only)",
+					"security": adminSecurity,
+					"responses": map[string]any{
+						"204": map[string]any{"description": "Suppression lifted"},
+						"404": errorResponse("The address isn't suppressed"),
+					},
+				},
+			},
+			"/metrics": map[string]any{
+				"get": map[string]any{
+					"summary":   "Prometheus metrics",
+					"responses": map[string]any{"200": map[string]any{"description": "Metrics in the Prometheus text format", "content": map[string]any{"text/plain": map[string]any{"schema": str}}}},
+				},
+			},
+			"/openapi.json": map[string]any{
+				"get": map[string]any{
+					"summary":   "This document",
+					"responses": map[string]any{"200": jsonResponse("OpenAPI 3 document", map[string]any{"type": "object"})},
+				},
+			},
+			"/graphql": map[string]any{
+				"post": map[string]any{
+					"summary":     "Query users or create one with GraphQL",
+					"description": "Fields are authorized like the /v1/users routes they mirror, whose status and invalid fields each error's extensions carry. Upload createUser's photo with a multipart request per the GraphQL multipart request spec.",
+					"security":    userSecurity,
+					"requestBody": map[string]any{
+						"required": true,
+						"content":  jsonContent(schemaFor(reflect.TypeOf(graphQLParams{}))),
+					},
+					"responses": map[string]any{
+						"200": jsonResponse("GraphQL response", map[string]any{
+							"type":       "object",
+							"properties": map[string]any{"data": map[string]any{"type": "object"}, "errors": map[string]any{"type": "array", "items": map[string]any{"type": "object"}}},
+						}),
+						"400": errorResponse("Invalid body or missing query"),
+						"415": errorResponse("Body is neither JSON nor multipart"),
+					},
+				},
+			},
+			"/docs": map[string]any{
+				"get": map[string]any{
+					"summary":   "Swagger UI for this document",
+					"responses": map[string]any{"200": map[string]any{"description": "HTML page", "content": map[string]any{"text/html": map[string]any{"schema": str}}}},
+				},
+			},
+			"/livez": map[string]any{
+				"get": map[string]any{
+					"summary":   "Liveness probe, same as /healthz",
+					"responses": map[string]any{"200": jsonResponse("Service is up", map[string]any{"type": "object", "properties": map[string]any{"status": str}})},
+				},
+			},
+			"/healthz": map[string]any{
+				"get": map[string]any{
+					"summary":   "Liveness probe",
+					"responses": map[string]any{"200": jsonResponse("Service is up", map[string]any{"type": "object", "properties": map[string]any{"status": str}})},
+				},
+			},
+			"/readyz": map[string]any{
+				"get": map[string]any{
+					"summary":     "Readiness probe, checking SQL, blob storage and Service Bus",
+					"description": "Each dependency is checked within 2 seconds and reported up or down with how long its check took.",
+					"responses": map[string]any{
+						"200": jsonResponse("Every dependency is up", ref("Readiness")),
+						"503": jsonResponse("A dependency is down", ref("Readiness")),
+					},
+				},
+			},
+		},
+	}
+}
+
+// API to Serve the OpenAPI Document (GET /openapi.json)
+func serveOpenAPISpec(spec []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	}
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+  <title>User Service API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>`
+
+// API to Serve Swagger UI (GET /docs)
+func serveDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
+
+// mustMarshalSpec renders the spec once at startup
+func mustMarshalSpec() []byte {
+	spec, err := json.Marshal(buildOpenAPISpec())
+	if err != nil {
+		fatal("Error building OpenAPI spec", "error", err)
+	}
+	return spec
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"user/user/events"
+	"user/user/resilience"
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// Outbox dispatcher tuning
+const (
+	outboxPollInterval = time.Second
+	outboxBatchSize    = 100
+	outboxLease        = time.Minute // Long enough to publish a batch; then another dispatcher may claim it
+	outboxMaxBackoff   = 5 * time.Minute
+)
+
+// runOutboxDispatcher relays outbox events to Service Bus until ctx is done.
+// Delivery is at least once: an event published but not yet deleted when the
+// dispatcher stops is published again, under the same message ID for duplicate
+// detection to drop. While Service Bus is down the events simply wait in the
+// outbox, and changes to users go on committing. Published events are handed
+// to notifier for the emails they call for.
+func runOutboxDispatcher(ctx context.Context, publisher events.Publisher, outbox store.OutboxStore, notifier *lifecycleNotifier) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		// Drain a backlog without waiting for the ticker between batches
+		for ctx.Err() == nil && dispatchOutbox(ctx, publisher, outbox, notifier) == outboxBatchSize {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flushOutbox relays the events left in the outbox at shutdown, until none are
+// due, Service Bus refuses them or ctx is done. Anything left goes out from the
+// next instance to run the dispatcher.
+func flushOutbox(ctx context.Context, publisher events.Publisher, outbox store.OutboxStore, notifier *lifecycleNotifier) {
+	slog.InfoContext(ctx, "Flushed outbox", "events", drainOutbox(ctx, publisher, outbox, notifier))
+}
+
+// drainOutbox dispatches batches until one comes back short, and returns how
+// many events it claimed
+func drainOutbox(ctx context.Context, publisher events.Publisher, outbox store.OutboxStore, notifier *lifecycleNotifier) int {
+	drained := 0
+	for ctx.Err() == nil {
+		claimed := dispatchOutbox(ctx, publisher, outbox, notifier)
+		drained += claimed
+		if claimed < outboxBatchSize {
+			break
+		}
+	}
+	return drained
+}
+
+// dispatchOutbox publishes one batch of outbox events, oldest first, and
+// returns how many it claimed. Events bound for the same queue or topic go out
+// together in as few Service Bus batches as fit; failed ones are retried with
+// backoff. Nothing is claimed while the Service Bus breaker is open, so events
+// don't run up attempts and backoff through an outage and instead go out as
+// soon as a trial send gets through.
+func dispatchOutbox(ctx context.Context, publisher events.Publisher, outbox store.OutboxStore, notifier *lifecycleNotifier) int {
+	if resilience.Breakers[resilience.DependencyServiceBus].Refusing() {
+		return 0
+	}
+	batch, err := outbox.ClaimOutboxEvents(ctx, outboxBatchSize, outboxLease)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error claiming outbox events", "error", err)
+		return 0
+	}
+	var destinations []string
+	byDestination := map[string][]events.OutboxEvent{}
+	for _, event := range batch {
+		name := publisher.Destination(event.EventType).Name()
+		if _, ok := byDestination[name]; !ok {
+			destinations = append(destinations, name)
+		}
+		byDestination[name] = append(byDestination[name], event)
+	}
+
+	for _, destination := range destinations {
+		pending := byDestination[destination]
+		for i, err := range publishOutboxEvents(ctx, publisher, destination, pending) {
+			event := pending[i]
+			if err != nil {
+				slog.ErrorContext(ctx, "Error sending event to Service Bus", "event_type", event.EventType, "user_id", event.UserID, "attempts", event.Attempts, "error", err)
+				retryAfter := outboxBackoff(event.Attempts)
+				if errors.Is(err, resilience.ErrCircuitOpen) {
+					retryAfter = 0 // Held back by the breaker instead, however long the outage lasts
+				}
+				if err := outbox.FailOutboxEvent(ctx, event.ID, err.Error(), retryAfter); err != nil {
+					slog.ErrorContext(ctx, "Error recording outbox failure", "outbox_id", event.ID, "error", err)
+				}
+				continue
+			}
+			notifier.notify(ctx, event)
+			if err := outbox.DeleteOutboxEvent(ctx, event.ID); err != nil {
+				// Sent again once the lease runs out, and dropped as a duplicate
+				slog.ErrorContext(ctx, "Error deleting published outbox event", "outbox_id", event.ID, "error", err)
+			}
+		}
+	}
+	return len(batch)
+}
+
+// outboxBackoff is how long an event waits after its nth failed attempt
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 20 {
+		return outboxMaxBackoff
+	}
+	return min(time.Second<<attempts, outboxMaxBackoff)
+}
+
+// publishOutboxEvents sends events to one destination, in order, and returns
+// each one's error. The span of the send links the requests that made the
+// changes, and each message carries its own request's trace for consumers.
+func publishOutboxEvents(ctx context.Context, publisher events.Publisher, destination string, batch []events.OutboxEvent) []error {
+	errs := make([]error, len(batch))
+	var messages []*azservicebus.Message
+	var indexes []int // Of each message's event
+	var links []trace.Link
+	for i, event := range batch {
+		message, err := outboxMessage(publisher, event)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		messages, indexes = append(messages, message), append(indexes, i)
+		links = append(links, trace.LinkFromContext(telemetry.ExtractTraceContext(ctx, event.TraceContext)))
+	}
+	if len(messages) == 0 {
+		return errs
+	}
+
+	ctx, span := telemetry.Tracer.Start(ctx, "servicebus publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithLinks(links...),
+		trace.WithAttributes(attribute.String("messaging.destination.name", destination), attribute.Int("messaging.batch.message_count", len(messages))))
+	sent, err := publisher.PublishBatch(ctx, destination, messages)
+	telemetry.EndSpan(span, err)
+	telemetry.ServiceBusPublishesTotal.WithLabelValues(resilience.ResultLabel(nil)).Add(float64(sent))
+	if err != nil {
+		telemetry.ServiceBusPublishesTotal.WithLabelValues(resilience.ResultLabel(err)).Add(float64(len(messages) - sent))
+		for _, i := range indexes[sent:] {
+			errs[i] = fmt.Errorf("failed to send message to service bus: %w", err)
+		}
+	}
+	if sent > 0 {
+		slog.Info("Events sent to Service Bus", "destination", destination, "count", sent)
+	}
+	return errs
+}
+
+// outboxMessage builds the Service Bus message for an outbox event, with
+// properties subscribers can filter on
+func outboxMessage(publisher events.Publisher, event events.OutboxEvent) (*azservicebus.Message, error) {
+	format, source := publisher.Encoding()
+	body, contentType, err := events.Encode(event, format, source)
+	if err != nil {
+		return nil, err
+	}
+	properties := map[string]any{
+		"eventType":     event.EventType,
+		"schemaVersion": event.SchemaVersion,
+		"userId":        event.UserID,
+	}
+	if event.TenantID != "" {
+		properties["tenantId"] = event.TenantID
+	}
+	telemetry.InjectTraceContext(telemetry.ExtractTraceContext(context.Background(), event.TraceContext), properties)
+	return &azservicebus.Message{
+		Body:                  body,
+		ContentType:           toPtr(contentType),
+		MessageID:             toPtr(event.MessageID),
+		Subject:               toPtr(event.EventType),
+		ApplicationProperties: properties,
+	}, nil
+}
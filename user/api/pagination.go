@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"user/user/store"
+)
+
+// Default and maximum page sizes for cursor pagination
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Current version of the cursor token format
+const cursorVersion = 1
+
+// pageCursor is the decoded form of the opaque cursor handed to clients.
+// Fields are kept short since the token travels in query strings.
+type pageCursor struct {
+	Version int    `json:"v"`
+	ID      int64  `json:"id"`
+	SortKey string `json:"k,omitempty"`
+	Sort    string `json:"s,omitempty"` // Sort the cursor was issued for, from sortToken
+	Back    bool   `json:"b,omitempty"` // Pages back towards the start, ending before ID
+}
+
+// sortToken identifies a sort in cursors; the default ID ascending order is
+// empty, as in cursors issued before sorting was added
+func sortToken(sort store.UserSort) string {
+	if (sort.Field == "" || sort.Field == store.SortByID) && !sort.Descending {
+		return ""
+	}
+	field := sort.Field
+	if field == "" {
+		field = store.SortByID
+	}
+	if sort.Descending {
+		return field + ":desc"
+	}
+	return field + ":asc"
+}
+
+// cursorFor builds the cursor that continues a listing after last
+func cursorFor(last store.User, sort store.UserSort) pageCursor {
+	c := pageCursor{ID: last.ID, Sort: sortToken(sort)}
+	switch sort.Field {
+	case store.SortByName:
+		c.SortKey = last.Name
+	case store.SortByCreatedAt:
+		c.SortKey = last.CreatedAt.UTC().Format(time.RFC3339Nano)
+	default:
+		c.SortKey = strconv.FormatInt(last.ID, 10)
+	}
+	return c
+}
+
+// cursorBefore builds the cursor that pages back from a listing's first user
+func cursorBefore(first store.User, sort store.UserSort) pageCursor {
+	c := cursorFor(first, sort)
+	c.Back = true
+	return c
+}
+
+// cursorAfter recovers the last user of the previous page from a cursor,
+// checking it was issued for the same sort
+func cursorAfter(c pageCursor, sort store.UserSort) (store.User, error) {
+	if c.Sort != sortToken(sort) {
+		return store.User{}, msgCursorOtherSort
+	}
+	after := store.User{ID: c.ID}
+	switch sort.Field {
+	case store.SortByName:
+		after.Name = c.SortKey
+	case store.SortByCreatedAt:
+		createdAt, err := time.Parse(time.RFC3339Nano, c.SortKey)
+		if err != nil {
+			return store.User{}, msgInvalidCursor
+		}
+		after.CreatedAt = createdAt
+	}
+	return after, nil
+}
+
+// encodeCursor turns a cursor into an opaque URL-safe token
+func encodeCursor(c pageCursor) string {
+	c.Version = cursorVersion
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses and validates a token produced by encodeCursor
+func decodeCursor(token string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, msgInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, msgInvalidCursor
+	}
+	if c.Version != cursorVersion {
+		return c, msgCursorVersion
+	}
+	if c.ID <= 0 {
+		return c, msgInvalidCursor
+	}
+	return c, nil
+}
+
+// parseLimit reads a page size parameter, applying the default and cap
+func parseLimit(param string) (int, error) {
+	if param == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit <= 0 {
+		return 0, msgPositiveInteger.with("limit")
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return limit, nil
+}
+
+// UserPage is the response body for a paginated user listing
+type UserPage struct {
+	Users      []store.User `json:"users" xml:"users>user"`
+	NextCursor string       `json:"nextCursor,omitempty" xml:"nextCursor,omitempty"`
+	PrevCursor string       `json:"prevCursor,omitempty" xml:"prevCursor,omitempty"` // Pages back to the users before these
+	Total      int64        `json:"total" xml:"total"`                               // Users matching the filters across all pages
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"user/user/store"
+)
+
+// Password rules. bcrypt ignores everything past 72 bytes, so longer passwords
+// are refused rather than silently truncated.
+const (
+	maxPasswordBytes = 72
+	passwordHashCost = 12
+)
+
+// Passwords too common to allow whatever their length; attackers try these first
+var commonPasswords = []string{
+	"123456789012", "1234567890123", "password1234", "passwordpassword", "qwertyuiopas",
+	"qwerty123456", "iloveyou1234", "letmein12345", "welcome12345", "administrator",
+	"changeme1234", "aaaaaaaaaaaa", "111111111111", "000000000000", "abcdefghijkl",
+}
+
+// Body of PUT /users/{id}/password
+type passwordRequest struct {
+	Password        string `json:"password"`
+	CurrentPassword string `json:"currentPassword,omitempty"` // Required to change an existing password, except for admins
+}
+
+// Body of a password POST /auth/login
+type passwordLoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// validatePassword checks a new password is long enough, fits bcrypt and isn't
+// trivially guessed from the user it protects
+func validatePassword(password string, user store.User, minLength int) error {
+	if utf8.RuneCountInString(password) < minLength {
+		return msgMinLength.with(minLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return msgMaxBytes.with(maxPasswordBytes)
+	}
+	if !utf8.ValidString(password) {
+		return msgInvalidUTF8
+	}
+	for _, c := range password {
+		if unicode.IsControl(c) {
+			return msgControlCharacters
+		}
+	}
+	lower := strings.ToLower(password)
+	if slices.Contains(commonPasswords, lower) || strings.Trim(lower, string([]rune(lower)[:1])) == "" {
+		return msgPasswordTooCommon
+	}
+	local, _, _ := strings.Cut(strings.ToLower(user.Email), "@")
+	if len(local) >= 4 && strings.Contains(lower, local) {
+		return msgPasswordContainsEmail
+	}
+	return nil
+}
+
+// hashPassword derives the hash stored for a password
+func hashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+}
+
+// decoyPasswordHash is compared against when there is no real hash to check,
+// so a login for an unknown email takes as long as one with a wrong password
+var decoyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := hashPassword("decoy password never matched")
+	return hash
+})
+
+// passwordMatches reports whether password is the one hash was made from; a
+// nil hash never matches but costs the same to check
+func passwordMatches(hash []byte, password string) bool {
+	if hash == nil {
+		bcrypt.CompareHashAndPassword(decoyPasswordHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// passwordLogin starts a session for a user signing in with their email and
+// password. Unknown emails, users without a password and wrong passwords get
+// the same answer. Wrong passwords count towards locking the account.
+func passwordLogin(w http.ResponseWriter, r *http.Request, sessions *sessionManager, userStore store.UserStore, credentials store.CredentialStore, guard *bruteForceGuard) {
+	var req passwordLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return
+	}
+	if req.Email == "" || req.Password == "" {
+		writeProblem(w, r, http.StatusBadRequest, msgCredentialsRequired)
+		return
+	}
+
+	user, err := userStore.GetUserByEmail(r.Context(), tenantFromContext(r.Context()), strings.TrimSpace(req.Email))
+	if err != nil && !errors.Is(err, store.ErrUserNotFound) {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+	var hash []byte
+	if user.ID != 0 {
+		hash, err = credentials.GetPasswordHash(r.Context(), user.ID)
+		if err != nil && !errors.Is(err, store.ErrNoPassword) {
+			dbError(w, r, err, msgErrorFetchingCredentials)
+			return
+		}
+	}
+	if !passwordMatches(hash, req.Password) {
+		if hash == nil {
+			guard.fail(r, 0)
+		} else {
+			guard.fail(r, user.ID)
+		}
+		writeProblem(w, r, http.StatusUnauthorized, msgWrongPassword)
+		return
+	}
+
+	// Only told once the password proved who is asking
+	if user.LockedAt != nil {
+		accountLocked(w, r)
+		return
+	}
+	if sessions.requireVerifiedEmail && user.EmailVerifiedAt == nil {
+		emailNotVerified(w, r)
+		return
+	}
+	startSession(w, r, sessions, store.Session{Subject: "password:" + strconv.FormatInt(user.ID, 10), Email: user.Email, UserID: user.ID, Tenant: user.TenantID})
+}
+
+// API to Set a User's Password (PUT /users/{id}/password)
+//
+// Only the user and admins may set it. Changing an existing password takes the
+// current one, unless an admin sets it.
+func (h *handler) setPassword(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	principal := principalFromContext(r.Context())
+	if !principal.Admin && (principal.UserID == 0 || principal.UserID != id) {
+		writeProblem(w, r, http.StatusForbidden, msgOnlySelfOrAdminSetPassword)
+		return
+	}
+	var req passwordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return
+	}
+	user, err := h.users.GetUser(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+	var errs validationErrors
+	errs.check("password", validatePassword(req.Password, user, h.config.Auth.Passwords.MinLength))
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	if !principal.Admin {
+		current, err := h.credentials.GetPasswordHash(r.Context(), id)
+		if err != nil && !errors.Is(err, store.ErrNoPassword) {
+			dbError(w, r, err, msgErrorFetchingCredentials)
+			return
+		}
+		if current != nil && !passwordMatches(current, req.CurrentPassword) {
+			h.guard.fail(r, id)
+			writeProblem(w, r, http.StatusForbidden, msgCurrentPasswordWrong)
+			return
+		}
+	}
+	if !requireRecentTwoFactor(w, r, h.sessions, id) {
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorHashingPassword)
+		return
+	}
+	if err := h.credentials.SetPasswordHash(r.Context(), id, hash); err != nil {
+		dbError(w, r, err, msgErrorSavingPassword)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
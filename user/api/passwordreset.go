@@ -0,0 +1,223 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+// Reset tokens are random and only stored hashed, like refresh tokens
+const (
+	passwordResetTokenPrefix      = "pwr_"
+	passwordResetTokenRandomBytes = 32
+)
+
+// How many forgot-password requests are looked into at once; more are dropped
+// rather than queued, as the caller can't tell either way
+const maxPendingPasswordResets = 16
+
+// Body of POST /auth/forgot-password
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// Body of POST /auth/reset-password
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// passwordResetter mails one-time links that let users who forgot their
+// password set a new one. A nil passwordResetter serves nothing.
+type passwordResetter struct {
+	store      store.PasswordResetStore
+	users      store.UserStore
+	mailer     Mailer
+	ttl        time.Duration
+	linkURL    string
+	maxPerHour int
+	minLength  int
+	pending    chan struct{}
+}
+
+// newPasswordResetter returns the resetter configured in config.PasswordReset,
+// or nil when password reset is off
+func newPasswordResetter(cfg config.Config, store store.PasswordResetStore, users store.UserStore, mailer Mailer) *passwordResetter {
+	if !cfg.PasswordReset.Enabled {
+		return nil
+	}
+	return &passwordResetter{
+		store:      store,
+		users:      users,
+		mailer:     mailer,
+		ttl:        time.Duration(cfg.PasswordReset.TTLMinutes) * time.Minute,
+		linkURL:    cfg.PasswordReset.LinkURL,
+		maxPerHour: cfg.PasswordReset.MaxPerHour,
+		minLength:  cfg.Auth.Passwords.MinLength,
+		pending:    make(chan struct{}, maxPendingPasswordResets),
+	}
+}
+
+// newPasswordResetToken returns a fresh random reset token
+func newPasswordResetToken() (string, error) {
+	random := make([]byte, passwordResetTokenRandomBytes)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return passwordResetTokenPrefix + base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// send mails a reset link to the tenant's user with this email, if there is one
+// and they weren't sent too many already. Failures are only logged, as the
+// caller is told the same either way.
+func (p *passwordResetter) send(ctx context.Context, tenant, email string) {
+	user, err := p.users.GetUserByEmail(ctx, tenant, email)
+	if errors.Is(err, store.ErrUserNotFound) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching user for password reset", "error", err)
+		return
+	}
+	n, err := p.store.CountPasswordResets(ctx, user.ID, time.Now().Add(-time.Hour))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error counting password resets", "user_id", user.ID, "error", err)
+		return
+	}
+	if n >= p.maxPerHour {
+		slog.WarnContext(ctx, "Too many password resets requested, not sending another", "user_id", user.ID)
+		return
+	}
+
+	token, err := newPasswordResetToken()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error generating password reset token", "error", err)
+		return
+	}
+	if err := p.store.CreatePasswordReset(ctx, user.ID, hashToken(token), time.Now().Add(p.ttl)); err != nil {
+		slog.ErrorContext(ctx, "Error saving password reset", "user_id", user.ID, "error", err)
+		return
+	}
+	u, err := url.Parse(p.linkURL)
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid password reset link", "link", p.linkURL, "error", err)
+		return
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+
+	err = p.mailer.Send(ctx, MailMessage{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body:    "Hello " + user.Name + ",\n\nSomeone asked to reset the password of your account. To choose a new one, open the link below. It works once, for " + strconv.Itoa(int(p.ttl.Minutes())) + " minutes.\n\n" + u.String() + "\n\nIf it wasn't you, ignore this email; your password stays as it is.\n",
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending password reset email", "user_id", user.ID, "error", err)
+	}
+}
+
+// API to Request a Password Reset (POST /auth/forgot-password)
+//
+// Answers the same whether or not the email belongs to a user, and before
+// looking it up, so neither the answer nor its timing tells which emails have
+// accounts.
+func (h *handler) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req forgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	var errs validationErrors
+	errs.check("email", validateEmail(email))
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	select {
+	case h.resetter.pending <- struct{}{}:
+		go func() {
+			defer func() { <-h.resetter.pending }()
+			h.resetter.send(context.WithoutCancel(r.Context()), tenantFromContext(r.Context()), email)
+		}()
+	default:
+		slog.WarnContext(r.Context(), "Too many password resets in progress, dropping request")
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If this email belongs to an account, a link to reset its password is on its way",
+	})
+}
+
+// API to Reset a Password (POST /auth/reset-password)
+//
+// Takes the token from a reset link and the new password. The token works once,
+// and the user's sessions end, so whoever knew the old password is signed out.
+// Invalid tokens count towards blocking the caller's IP.
+func (h *handler) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return
+	}
+	tokenHash := hashToken(req.Token)
+	tenant, id, err := h.resetter.store.LookupPasswordReset(r.Context(), tokenHash)
+	if errors.Is(err, store.ErrInvalidReset) {
+		h.guard.fail(r, 0)
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidResetLink)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorCheckingResetLink)
+		return
+	}
+	user, err := h.resetter.users.GetUser(r.Context(), tenant, id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidResetLink)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+	var errs validationErrors
+	errs.check("password", validatePassword(req.Password, user, h.resetter.minLength))
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorHashingPassword)
+		return
+	}
+	_, err = h.resetter.store.ResetPassword(r.Context(), tokenHash, hash)
+	if errors.Is(err, store.ErrInvalidReset) {
+		// Used up by a concurrent reset since the lookup
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidResetLink)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorResettingPassword)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
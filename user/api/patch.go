@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"user/user/events"
+	"user/user/store"
+)
+
+// Media type of an RFC 7396 JSON Merge Patch
+const mergePatchContentType = "application/merge-patch+json"
+
+// Body of PATCH /users/{id}, applied as a JSON Merge Patch; nil fields were
+// absent and are left unchanged
+type userPatch struct {
+	Name     *string            `json:"name"`
+	Email    *string            `json:"email"`
+	Roles    *[]string          `json:"roles"`    // Admins only
+	Metadata map[string]*string `json:"metadata"` // Merged into the user's; null removes a key, or all of them
+	Version  *int64             `json:"version"`  // Alternative to If-Match
+}
+
+// API to Partially Update a User (PATCH /users/{id})
+func (h *handler) patchUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+
+	// Plain JSON is still accepted from clients predating merge patch support
+	w.Header().Set("Accept-Patch", mergePatchContentType)
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != mergePatchContentType && mediaType != "application/json") {
+			writeProblem(w, r, http.StatusUnsupportedMediaType, msgContentTypeMustBe.with(mergePatchContentType))
+			return
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgErrorReadingBody)
+		}
+		return
+	}
+	var members map[string]json.RawMessage
+	var patch userPatch
+	if json.Unmarshal(body, &members) != nil || json.Unmarshal(body, &patch) != nil {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		return
+	}
+	// In a merge patch null removes a member, which name and email can't be
+	for _, field := range []string{"name", "email"} {
+		if raw, ok := members[field]; ok && bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			writeProblem(w, r, http.StatusBadRequest, msgFieldNotRemovable.with(field))
+			return
+		}
+	}
+	if raw, ok := members["roles"]; ok && bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		patch.Roles = &[]string{}
+	}
+
+	// Only the fields actually present are changed
+	var changes store.UserChanges
+	var errs validationErrors
+	if patch.Name != nil {
+		name := strings.TrimSpace(*patch.Name)
+		errs.check("name", validateName(name, h.config.Validation.MaxNameLength))
+		changes.Name = &name
+	}
+	if patch.Email != nil {
+		email := strings.TrimSpace(*patch.Email)
+		errs.check("email", validateEmail(email))
+		changes.Email = &email
+	}
+	if raw, ok := members["metadata"]; ok {
+		// Merged into the current metadata; should the user change meanwhile the
+		// update fails on its version, so the merge is never applied to stale data
+		var current store.UserMetadata
+		if !bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			user, err := h.users.GetUser(r.Context(), tenantFromContext(r.Context()), id)
+			if errors.Is(err, store.ErrUserNotFound) {
+				writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+				return
+			}
+			if err != nil {
+				dbError(w, r, err, msgErrorFetchingUser)
+				return
+			}
+			current = user.Metadata
+		}
+		metadata := mergeMetadata(current, patch.Metadata)
+		errs.check("metadata", validateMetadata(metadata))
+		changes.Metadata = &metadata
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	if changes.Email != nil && !requireRecentTwoFactor(w, r, h.sessions, id) {
+		return
+	}
+	if patch.Roles != nil {
+		if !principalFromContext(r.Context()).Admin {
+			writeProblem(w, r, http.StatusForbidden, msgOnlyAdminsChangeRoles)
+			return
+		}
+		roles := slices.Compact(slices.Sorted(slices.Values(*patch.Roles)))
+		for _, role := range roles {
+			if !slices.Contains(knownRoles, role) {
+				writeProblem(w, r, http.StatusBadRequest, msgUnknownRole.with(role))
+				return
+			}
+		}
+		changes.Roles = &roles
+	}
+	if changes == (store.UserChanges{}) {
+		writeProblem(w, r, http.StatusBadRequest, msgNoUpdatableFields)
+		return
+	}
+
+	// "*" patches whatever version is current, which takes a read
+	version, ok := requireVersion(w, r, patch.Version, func() (int64, bool) {
+		user, err := h.users.GetUser(r.Context(), tenantFromContext(r.Context()), id)
+		if errors.Is(err, store.ErrUserNotFound) {
+			writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+			return 0, false
+		}
+		if err != nil {
+			dbError(w, r, err, msgErrorFetchingUser)
+			return 0, false
+		}
+		return user.Version, true
+	})
+	if !ok {
+		return
+	}
+	changes.Version = version
+
+	user, err := h.users.UpdateUser(store.WithOutboxEvent(r.Context(), events.UserUpdated), tenantFromContext(r.Context()), id, changes)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrStaleVersion) {
+		staleUpdate(w, r)
+		return
+	}
+	if errors.Is(err, store.ErrDuplicateEmail) {
+		writeEmailTaken(w, r, msgEmailTaken)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorUpdatingUser)
+		return
+	}
+	h.webhooks.notify(r.Context(), events.UserUpdated, user)
+	// A new email, or the unverified one sent again, gets a fresh link
+	if changes.Email != nil {
+		h.verifier.send(r, user)
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	json.NewEncoder(w).Encode(h.links.user(user))
+}
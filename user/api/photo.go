@@ -0,0 +1,431 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"user/user/blob"
+	"user/user/store"
+)
+
+// Extensions of the blob keys of pictures, by their type
+var photoExtensions = map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif", "image/webp": ".webp"}
+
+// photoBlobName generates the key a user's new picture of the given type is
+// stored under: the tenant, the user's ID, a UUID and the type's extension, so
+// pictures the clients named alike don't overwrite each other. New users don't
+// have an ID yet and get the UUID alone. Types without a known extension keep
+// the filename's, reduced to letters and digits.
+func photoBlobName(tenant string, userID int64, filename, contentType string) string {
+	ext, ok := photoExtensions[contentType]
+	if !ok {
+		ext = strings.Map(func(c rune) rune {
+			if 'a' <= c && c <= 'z' || '0' <= c && c <= '9' {
+				return c
+			}
+			return -1
+		}, strings.ToLower(path.Ext(filename)))
+		if ext != "" {
+			ext = "." + truncate(ext, 10)
+		}
+	}
+	name := uuid.NewString() + ext
+	if userID != 0 {
+		name = fmt.Sprintf("%d/%s", userID, name)
+	}
+	return tenantBlobName(tenant, name)
+}
+
+// parseUserID reads the {id} route variable
+func parseUserID(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, msgInvalidUserID
+	}
+	return id, nil
+}
+
+// deleteReplacedPhoto lets go of the picture previous pointed at once replaced,
+// removing it and its thumbnails when no other user shares them. Re-uploading
+// the same picture took a reference of its own, so it is kept.
+func deleteReplacedPhoto(ctx context.Context, blobs blob.Storage, pictures store.PictureStore, picturesContainer string, previous store.User) {
+	cleanupCtx := context.WithoutCancel(ctx)
+	name, ok := blob.NameFromLink(picturesContainer, previous.Link)
+	if !ok {
+		// Linked from elsewhere with photo_url, or no picture at all
+		return
+	}
+	last, err := pictures.ReleasePicture(cleanupCtx, previous.TenantID, name)
+	if err != nil {
+		// Left for cleanup-blobs rather than risk deleting a shared picture
+		slog.ErrorContext(ctx, "Error releasing previous picture", "user_id", previous.ID, "blob", name, "error", err)
+		return
+	}
+	if !last {
+		return
+	}
+	if err := blob.Delete(cleanupCtx, blobs, picturesContainer, name); err != nil {
+		slog.ErrorContext(ctx, "Error deleting previous blob", "user_id", previous.ID, "blob", name, "error", err)
+	}
+	if name, ok := thumbnailNameFromLink(previous.ThumbnailLink); ok {
+		if err := blob.Delete(cleanupCtx, blobs, blob.ThumbnailsContainer, name); err != nil {
+			slog.ErrorContext(ctx, "Error deleting previous thumbnail", "user_id", previous.ID, "blob", name, "error", err)
+		}
+	}
+	for _, link := range previous.Thumbnails {
+		if name, ok := thumbnailNameFromLink(link); ok {
+			if err := blob.Delete(cleanupCtx, blobs, blob.ThumbnailsContainer, name); err != nil {
+				slog.ErrorContext(ctx, "Error deleting previous thumbnail", "user_id", previous.ID, "blob", name, "error", err)
+			}
+		}
+	}
+}
+
+// API to Get a User's Profile Picture (GET|HEAD /users/{id}/photo[?size=thumbnail|<pixels>])
+//
+// Streams the picture from blob storage, so clients needn't read the container
+// themselves, tagged with the blob's ETag for revalidation. Pictures linked from
+// elsewhere with photo_url are redirected to.
+func (h *handler) getUserPhoto(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	size := r.URL.Query().Get("size")
+	user, err := h.users.GetUser(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+
+	containerName, link := h.config.Azure.PicturesContainer, user.Link
+	name, ok := blob.NameFromLink(containerName, link)
+	switch size {
+	case "":
+	case "thumbnail":
+		containerName, link = blob.ThumbnailsContainer, user.ThumbnailLink
+		name, ok = thumbnailNameFromLink(link)
+	default:
+		variant, found := user.Thumbnails[size]
+		if !found {
+			writeProblem(w, r, http.StatusNotFound, msgNoThumbnailSize)
+			return
+		}
+		containerName, link = blob.ThumbnailsContainer, variant
+		name, ok = thumbnailNameFromLink(link)
+	}
+	if link == "" {
+		writeProblem(w, r, http.StatusNotFound, msgUserHasNoPicture)
+		return
+	}
+	if !ok {
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+
+	props, err := blob.Stat(r.Context(), h.blobs, containerName, name)
+	if errors.Is(err, blob.ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgPictureNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading picture", "user_id", id, "blob", name, "error", err)
+		dependencyError(w, r, err, http.StatusBadGateway, msgErrorReadingPicture)
+		return
+	}
+	etag := props.ETag
+	notModified := etag != "" && ifNoneMatch(r, etag)
+	var body io.ReadCloser
+	if r.Method != http.MethodHead && !notModified {
+		body, err = blob.Download(r.Context(), h.blobs, containerName, name)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error downloading picture", "user_id", id, "blob", name, "error", err)
+			dependencyError(w, r, err, http.StatusBadGateway, msgErrorDownloadingPicture)
+			return
+		}
+		defer body.Close()
+	}
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if !props.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", props.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", cmp.Or(props.ContentType, "image/jpeg"))
+	w.Header().Set("Content-Length", strconv.FormatInt(props.ContentLength, 10))
+	if body == nil {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		slog.WarnContext(r.Context(), "Picture download ended early", "user_id", id, "error", err)
+	}
+}
+
+// API to Replace a User's Profile Picture (PUT /users/{id}/photo)
+func (h *handler) updateUserPhoto(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+
+	// Look up the current picture so it can be removed once replaced
+	tenant := tenantFromContext(r.Context())
+	user, err := h.users.GetUser(r.Context(), tenant, id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+	if !parseUploadForm(w, r) {
+		return
+	}
+	if hasFormFile(r, "photo") {
+		var errs validationErrors
+		errs.check("photo", validatePhotoFile(r.MultipartForm.File["photo"][0], h.config))
+		if len(errs) > 0 {
+			writeValidationErrors(w, r, errs)
+			return
+		}
+	}
+	var bodyVersion *int64
+	if value := r.FormValue("version"); value != "" {
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			bodyVersion = &v
+		}
+	}
+	version, ok := requireVersion(w, r, bodyVersion, func() (int64, bool) { return user.Version, true })
+	if !ok {
+		return
+	}
+	if version != user.Version {
+		// Don't bother uploading a picture that can't be saved
+		staleUpdate(w, r)
+		return
+	}
+
+	photo, ok := h.uploadPhoto(w, r, id)
+	if !ok {
+		return
+	}
+	h.replaceUserPhoto(w, r, user, version, photo)
+}
+
+// replaceUserPhoto points the user at their newly stored picture, given the
+// version they were read at, and deletes the previous one
+func (h *handler) replaceUserPhoto(w http.ResponseWriter, r *http.Request, previous store.User, version int64, photo uploadedPhoto) {
+	user, err := h.users.UpdateUser(r.Context(), tenantFromContext(r.Context()), previous.ID, store.UserChanges{Version: version, Link: &photo.Link, ThumbnailLink: &photo.ThumbnailLink, Thumbnails: &photo.Thumbnails})
+	if err != nil {
+		h.discard(r.Context(), photo)
+		if errors.Is(err, store.ErrStaleVersion) {
+			staleUpdate(w, r)
+			return
+		}
+		if errors.Is(err, store.ErrUserNotFound) {
+			// Deleted between the lookup and the update
+			writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+			return
+		}
+		dbError(w, r, err, msgErrorUpdatingUser)
+		return
+	}
+
+	deleteReplacedPhoto(r.Context(), h.blobs, h.pictures, h.config.Azure.PicturesContainer, previous)
+
+	w.Header().Set("ETag", userETag(user))
+	link, thumbnailLink, thumbnails := h.responseLinks(r, photo, user.Version)
+	json.NewEncoder(w).Encode(map[string]any{
+		"message":       "Photo updated successfully",
+		"link":          link,
+		"thumbnailLink": thumbnailLink,
+		"thumbnails":    thumbnails,
+		"checksum":      photo.Checksum,
+	})
+}
+
+// A profile picture stored by uploadPhoto
+type uploadedPhoto struct {
+	Link          string
+	ThumbnailLink string // Empty when no thumbnail could be generated
+	Thumbnails    store.ThumbnailLinks
+	Blob          string
+	Checksum      string // Base64 MD5 of the uploaded picture
+	Tenant        string // Whose pictures the blob is counted among
+}
+
+// discard lets go of the picture p stored after a later step failed, deleting
+// its blobs unless another user shares them
+func (h *handler) discard(ctx context.Context, p uploadedPhoto) {
+	// Clean up even if the request was cancelled
+	ctx = context.WithoutCancel(ctx)
+	last, err := h.pictures.ReleasePicture(ctx, p.Tenant, p.Blob)
+	if err != nil {
+		// Left for cleanup-blobs rather than risk deleting a shared picture
+		slog.ErrorContext(ctx, "Error releasing orphaned picture", "blob", p.Blob, "error", err)
+		return
+	}
+	if last {
+		p.deleteBlobs(ctx, h.blobs, h.config.Azure.PicturesContainer)
+	}
+}
+
+// deleteBlobs deletes the picture's blob, in picturesContainer, and thumbnails
+func (p uploadedPhoto) deleteBlobs(ctx context.Context, blobs blob.Storage, picturesContainer string) {
+	if err := blob.Delete(ctx, blobs, picturesContainer, p.Blob); err != nil {
+		slog.ErrorContext(ctx, "Error deleting orphaned blob", "blob", p.Blob, "error", err)
+	}
+	if p.ThumbnailLink == "" {
+		return
+	}
+	if err := blob.Delete(ctx, blobs, blob.ThumbnailsContainer, p.Blob); err != nil {
+		slog.ErrorContext(ctx, "Error deleting orphaned thumbnail", "blob", p.Blob, "error", err)
+	}
+	for _, link := range p.Thumbnails {
+		name, _ := thumbnailNameFromLink(link)
+		if err := blob.Delete(ctx, blobs, blob.ThumbnailsContainer, name); err != nil {
+			slog.ErrorContext(ctx, "Error deleting orphaned thumbnail", "blob", name, "error", err)
+		}
+	}
+}
+
+// Form data kept in memory while parsing uploads; larger files spill to disk
+const multipartMemory = 8 << 20
+
+// parseUploadForm parses a multipart (or urlencoded) form body. On failure it
+// writes the error response.
+func parseUploadForm(w http.ResponseWriter, r *http.Request) bool {
+	err := r.ParseMultipartForm(multipartMemory)
+	if err == nil || errors.Is(err, http.ErrNotMultipart) {
+		return true
+	}
+	if !rejectOversizedBody(w, r, err) {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidFormData)
+	}
+	return false
+}
+
+// uploadPhoto uploads the multipart "photo" file, already checked with
+// validatePhotoFile, to blob storage along with its thumbnail. On failure it
+// writes the error response.
+func (h *handler) uploadPhoto(w http.ResponseWriter, r *http.Request, userID int64) (uploadedPhoto, bool) {
+	file, header, err := r.FormFile("photo")
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidFileUpload)
+		return uploadedPhoto{}, false
+	}
+	defer file.Close()
+	return h.storePhoto(w, r, file, header.Filename, userID)
+}
+
+// storePhoto uploads a picture, already checked with validatePhoto, to blob
+// storage under a key of its own, along with its thumbnail. original is the
+// client's filename for it, kept as metadata. Uploads are scanned for malware
+// first, and flagged ones rejected with 422. A picture the tenant already
+// stored, by SHA-256 of its content, is referenced instead of uploaded again.
+// On failure it writes the error response.
+func (h *handler) storePhoto(w http.ResponseWriter, r *http.Request, file io.ReadSeeker, original string, userID int64) (uploadedPhoto, bool) {
+	if !h.scanPhoto(w, r, file, original) {
+		return uploadedPhoto{}, false
+	}
+	tenant := tenantFromContext(r.Context())
+	hash := sha256.New()
+	_, err := io.Copy(hash, file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidFileUpload)
+		return uploadedPhoto{}, false
+	}
+	sum := hash.Sum(nil)
+	stored, err := h.pictures.AcquirePicture(r.Context(), tenant, sum)
+	if err == nil {
+		return storedPhoto(h.config.Azure.PicturesContainer, tenant, stored), true
+	}
+	if !errors.Is(err, store.ErrPictureNotFound) {
+		dbError(w, r, err, msgErrorLookingUpPicture)
+		return uploadedPhoto{}, false
+	}
+
+	// Stored with the type sniffed from its content, which validatePhoto vouched for
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidFileUpload)
+		return uploadedPhoto{}, false
+	}
+	contentType := http.DetectContentType(sniff[:n])
+	filename := photoBlobName(tenant, userID, original, contentType)
+
+	// Upload profile picture to Azure Blob Storage
+	link, checksum, err := blob.UploadAndLink(r.Context(), h.blobs, h.config.Azure.PicturesContainer, file, filename, original, contentType)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error uploading file to blob storage", "error", err)
+		dependencyError(w, r, err, http.StatusInternalServerError, msgErrorUploadingFile)
+		return uploadedPhoto{}, false
+	}
+	photo := uploadedPhoto{Link: link, Blob: filename, Checksum: checksum, Tenant: tenant}
+
+	// The full picture is enough to go on, so a missing thumbnail isn't an error
+	photo.ThumbnailLink, photo.Thumbnails, err = uploadThumbnails(r.Context(), h.blobs, file, filename, h.config)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Skipping thumbnail", "blob", filename, "error", err)
+	}
+
+	stored, added, err := h.pictures.AddPicture(r.Context(), tenant, store.StoredPicture{
+		SHA256: sum, Blob: filename, Checksum: checksum, ThumbnailLink: photo.ThumbnailLink, Thumbnails: photo.Thumbnails,
+	})
+	if err != nil {
+		photo.deleteBlobs(r.Context(), h.blobs, h.config.Azure.PicturesContainer)
+		dbError(w, r, err, msgErrorRecordingPicture)
+		return uploadedPhoto{}, false
+	}
+	if !added {
+		// The same picture was stored concurrently; share that one instead
+		photo.deleteBlobs(r.Context(), h.blobs, h.config.Azure.PicturesContainer)
+		return storedPhoto(h.config.Azure.PicturesContainer, tenant, stored), true
+	}
+	return photo, true
+}
+
+// storedPhoto is the uploadedPhoto for a picture stored earlier in container
+func storedPhoto(container, tenant string, picture store.StoredPicture) uploadedPhoto {
+	return uploadedPhoto{
+		Link:          blob.Link(container, picture.Blob),
+		ThumbnailLink: picture.ThumbnailLink,
+		Thumbnails:    picture.Thumbnails,
+		Blob:          picture.Blob,
+		Checksum:      picture.Checksum,
+		Tenant:        tenant,
+	}
+}
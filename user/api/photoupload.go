@@ -0,0 +1,311 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+
+	"user/user/blob"
+	"user/user/resilience"
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// Chunked upload limits. Azure discards blocks left uncommitted for a week,
+// which is how long an upload may be resumed.
+const (
+	photoChunkBytes      = 4 << 20 // Chunk size suggested to clients
+	maxPhotoUploadChunks = 10000   // Chunk indexes are 0-9999, as block IDs must all be the same length
+	photoUploadTTL       = 7 * 24 * time.Hour
+)
+
+// An upload started with POST /users/{id}/photo/uploads
+type photoUpload struct {
+	UploadID   string       `json:"uploadId"`
+	ChunkBytes int64        `json:"chunkBytes"` // Suggested size of each chunk but the last
+	MaxBytes   int64        `json:"maxBytes"`   // Largest picture accepted
+	ExpiresAt  time.Time    `json:"expiresAt"`
+	Chunks     []photoChunk `json:"chunks"` // Chunks received so far
+	Bytes      int64        `json:"bytes"`  // Their total size
+}
+
+// A chunk of a picture upload that was received
+type photoChunk struct {
+	Index int   `json:"index"`
+	Size  int64 `json:"size"`
+}
+
+// Body of POST /users/{id}/photo/uploads/{upload}/commit
+type commitPhotoUploadRequest struct {
+	Filename string `json:"filename"`
+	Chunks   int    `json:"chunks"` // Number of chunks, which must all have been received
+	Version  int64  `json:"version,omitempty"`
+}
+
+// photoUploadBlob is the blob staging an upload's chunks. Naming it after the
+// user keeps each upload to the user it was started for.
+func photoUploadBlob(r *http.Request) string {
+	return tenantBlobName(tenantFromContext(r.Context()), mux.Vars(r)["id"]+"/"+mux.Vars(r)["upload"])
+}
+
+// photoChunkBlockID is the block ID a chunk is staged under
+func photoChunkBlockID(index int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%04d", index)))
+}
+
+// stagedPhotoChunks lists the chunks an upload received, by index. An upload
+// nothing was sent to yet has none.
+func stagedPhotoChunks(ctx context.Context, blobs blob.Storage, staging string) (map[int]int64, error) {
+	ctx, span := telemetry.StartSpan(ctx, "blob block list", attribute.String("blob.container", blob.PhotoUploadsContainer))
+	blocks, err := blobs.UncommittedBlocks(ctx, blob.PhotoUploadsContainer, staging)
+	telemetry.EndSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	chunks := map[int]int64{}
+	for blockID, size := range blocks {
+		id, err := base64.StdEncoding.DecodeString(blockID)
+		if err != nil {
+			continue
+		}
+		if index, err := strconv.Atoi(string(id)); err == nil {
+			chunks[index] = size
+		}
+	}
+	return chunks, nil
+}
+
+// getUploadUser fetches the user an upload is for. On failure it writes the
+// error response.
+func getUploadUser(w http.ResponseWriter, r *http.Request, userStore store.UserStore) (store.User, bool) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return store.User{}, false
+	}
+	user, err := userStore.GetUser(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return store.User{}, false
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return store.User{}, false
+	}
+	return user, true
+}
+
+// API to Start a Chunked Picture Upload (POST /users/{id}/photo/uploads)
+//
+// For clients on unreliable networks: the picture is sent in chunks with PUT
+// /users/{id}/photo/uploads/{upload}/chunks/{index}, in any order and retried
+// as often as needed, then committed to replace the user's picture. GET on the
+// upload tells which chunks arrived, to resume after losing track.
+func (h *handler) startPhotoUpload(w http.ResponseWriter, r *http.Request) {
+	if _, ok := getUploadUser(w, r, h.users); !ok {
+		return
+	}
+	upload := photoUpload{
+		UploadID:   newRequestID(),
+		ChunkBytes: min(photoChunkBytes, h.config.Server.MaxUploadBytes),
+		MaxBytes:   h.config.Validation.MaxPhotoBytes,
+		ExpiresAt:  time.Now().Add(photoUploadTTL).UTC(),
+		Chunks:     []photoChunk{},
+	}
+	w.Header().Set("Location", r.URL.Path+"/"+upload.UploadID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(upload)
+}
+
+// API to Check a Chunked Picture Upload (GET /users/{id}/photo/uploads/{upload})
+func (h *handler) getPhotoUpload(w http.ResponseWriter, r *http.Request) {
+	if _, ok := getUploadUser(w, r, h.users); !ok {
+		return
+	}
+	chunks, err := stagedPhotoChunks(r.Context(), h.blobs, photoUploadBlob(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing upload chunks", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorReadingUpload)
+		return
+	}
+	upload := photoUpload{
+		UploadID:   mux.Vars(r)["upload"],
+		ChunkBytes: min(photoChunkBytes, h.config.Server.MaxUploadBytes),
+		MaxBytes:   h.config.Validation.MaxPhotoBytes,
+		Chunks:     []photoChunk{},
+	}
+	for _, index := range slices.Sorted(maps.Keys(chunks)) {
+		upload.Chunks = append(upload.Chunks, photoChunk{Index: index, Size: chunks[index]})
+		upload.Bytes += chunks[index]
+	}
+	json.NewEncoder(w).Encode(upload)
+}
+
+// API to Send a Picture Chunk (PUT /users/{id}/photo/uploads/{upload}/chunks/{index})
+//
+// The body is the chunk's bytes. A Content-MD5 header has Azure check they
+// arrived intact. Sending a chunk again replaces it.
+func (h *handler) uploadPhotoChunk(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil || index >= maxPhotoUploadChunks {
+		writeProblem(w, r, http.StatusBadRequest, msgChunkIndexTooHigh.with(maxPhotoUploadChunks))
+		return
+	}
+	var checksum []byte
+	if header := r.Header.Get("Content-MD5"); header != "" {
+		checksum, err = base64.StdEncoding.DecodeString(header)
+		if err != nil || len(checksum) != md5.Size {
+			writeProblem(w, r, http.StatusBadRequest, msgContentMD5Invalid)
+			return
+		}
+	}
+	if _, ok := getUploadUser(w, r, h.users); !ok {
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgErrorReadingChunk)
+		}
+		return
+	}
+	if len(data) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, msgChunkEmpty)
+		return
+	}
+
+	ctx, span := telemetry.StartSpan(r.Context(), "blob stage block", attribute.String("blob.container", blob.PhotoUploadsContainer), attribute.Int("chunk.index", index))
+	err = resilience.WithBulkhead(ctx, resilience.DependencyBlob, func() error {
+		return h.blobs.StageBlock(ctx, blob.PhotoUploadsContainer, photoUploadBlob(r), photoChunkBlockID(index), data, checksum)
+	})
+	telemetry.EndSpan(span, err)
+	if errors.Is(err, blob.ErrChecksumMismatch) {
+		writeProblem(w, r, http.StatusBadRequest, msgChunkMD5Mismatch)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error staging upload chunk", "chunk", index, "error", err)
+		dependencyError(w, r, err, http.StatusInternalServerError, msgErrorStoringChunk)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// API to Commit a Chunked Picture Upload (POST /users/{id}/photo/uploads/{upload}/commit)
+//
+// Joins chunks 0 to chunks-1 into the picture and replaces the user's with it,
+// like PUT /users/{id}/photo, taking the version from If-Match or the body.
+func (h *handler) commitPhotoUpload(w http.ResponseWriter, r *http.Request) {
+	var req commitPhotoUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return
+	}
+	req.Filename = strings.TrimSpace(req.Filename)
+	var errs validationErrors
+	if req.Filename == "" {
+		errs.check("filename", msgRequired)
+	}
+	if req.Chunks <= 0 || req.Chunks > maxPhotoUploadChunks {
+		errs.check("chunks", msgChunksOutOfRange.with(maxPhotoUploadChunks))
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	user, ok := getUploadUser(w, r, h.users)
+	if !ok {
+		return
+	}
+	version, ok := requireVersion(w, r, &req.Version, func() (int64, bool) { return user.Version, true })
+	if !ok {
+		return
+	}
+	if version != user.Version {
+		staleUpdate(w, r)
+		return
+	}
+
+	staging := photoUploadBlob(r)
+	chunks, err := stagedPhotoChunks(r.Context(), h.blobs, staging)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing upload chunks", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorReadingUpload)
+		return
+	}
+	blockIDs := make([]string, req.Chunks)
+	var size int64
+	for index := range req.Chunks {
+		chunkSize, ok := chunks[index]
+		if !ok {
+			writeProblem(w, r, http.StatusConflict, msgChunkMissing.with(index))
+			return
+		}
+		blockIDs[index] = photoChunkBlockID(index)
+		size += chunkSize
+	}
+	if size > h.config.Validation.MaxPhotoBytes {
+		errs.check("photo", msgMaxBytes.with(h.config.Validation.MaxPhotoBytes))
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	ctx, span := telemetry.StartSpan(r.Context(), "blob commit block list", attribute.String("blob.container", blob.PhotoUploadsContainer))
+	err = h.blobs.CommitBlocks(ctx, blob.PhotoUploadsContainer, staging, blockIDs)
+	telemetry.EndSpan(span, err)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error committing upload chunks", "error", err)
+		dependencyError(w, r, err, http.StatusInternalServerError, msgErrorJoiningChunks)
+		return
+	}
+	// The staged picture is copied into place below; committed, it can't be resumed anyway
+	defer func() {
+		ctx, span := telemetry.StartSpan(context.WithoutCancel(r.Context()), "blob delete", attribute.String("blob.container", blob.PhotoUploadsContainer))
+		err := h.blobs.Delete(ctx, blob.PhotoUploadsContainer, staging)
+		telemetry.EndSpan(span, err)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Error deleting staged upload", "error", err)
+		}
+	}()
+	ctx, span = telemetry.StartSpan(r.Context(), "blob download", attribute.String("blob.container", blob.PhotoUploadsContainer))
+	body, err := h.blobs.Download(ctx, blob.PhotoUploadsContainer, staging)
+	telemetry.EndSpan(span, err)
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(io.LimitReader(body, size))
+		body.Close()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading staged upload", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorReadingUpload)
+		return
+	}
+	errs.check("photo", validatePhoto(req.Filename, int64(len(data)), data[:min(len(data), 512)], h.config))
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	photo, ok := h.storePhoto(w, r, bytes.NewReader(data), req.Filename, user.ID)
+	if !ok {
+		return
+	}
+	h.replaceUserPhoto(w, r, user, version, photo)
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"user/user/blob"
+	"user/user/config"
+	"user/user/store"
+)
+
+// pictureLinks makes the links clients are given for stored pictures and
+// thumbnails
+type pictureLinks struct {
+	cdn       *url.URL // picture_links.cdn_base_url; nil serves clients the stored links
+	container string   // azure.pictures_container
+}
+
+func newPictureLinks(cfg config.Config) pictureLinks {
+	links := pictureLinks{container: cfg.Azure.PicturesContainer}
+	if cfg.PictureLinks.CDNBaseURL != "" {
+		links.cdn, _ = url.Parse(cfg.PictureLinks.CDNBaseURL)
+	}
+	return links
+}
+
+// link returns the link clients are given for a stored picture or thumbnail
+// link: its URL on the CDN when picture_links.cdn_base_url is set, versioned
+// so the edge doesn't keep serving a picture since replaced. Links to
+// elsewhere come back as they are.
+func (l pictureLinks) link(link string, version int64) string {
+	if l.cdn == nil {
+		return link
+	}
+	if _, ok := blob.NameFromLink(l.container, link); !ok {
+		if _, ok := thumbnailNameFromLink(link); !ok {
+			return link
+		}
+	}
+	u := l.cdn.JoinPath(link)
+	u.RawQuery = url.Values{"v": {strconv.FormatInt(version, 10)}}.Encode()
+	return u.String()
+}
+
+// user returns the user with the picture links clients are given, versioned
+// by the user's version
+func (l pictureLinks) user(u store.User) store.User {
+	if l.cdn == nil {
+		return u
+	}
+	u.Link = l.link(u.Link, u.Version)
+	u.ThumbnailLink = l.link(u.ThumbnailLink, u.Version)
+	if u.Thumbnails != nil {
+		thumbnails := store.ThumbnailLinks{}
+		for size, link := range u.Thumbnails {
+			thumbnails[size] = l.link(link, u.Version)
+		}
+		u.Thumbnails = thumbnails
+	}
+	return u
+}
+
+// users returns the users with the picture links clients are given
+func (l pictureLinks) users(users []store.User) []store.User {
+	if l.cdn == nil {
+		return users
+	}
+	public := make([]store.User, len(users))
+	for i, user := range users {
+		public[i] = l.user(user)
+	}
+	return public
+}
+
+// signedPicture holds read-only SAS URLs for a user's picture and thumbnails.
+// Pictures hosted elsewhere keep their links.
+type signedPicture struct {
+	URL          string            `json:"url"`
+	ThumbnailURL string            `json:"thumbnailUrl,omitempty"`
+	Thumbnails   map[string]string `json:"thumbnails,omitempty"`
+	ExpiresAt    time.Time         `json:"expiresAt"`
+}
+
+// signPictureLink returns a read-only SAS URL for a picture or thumbnail link
+// into our containers, pictures being in container. Other links come back as
+// they are.
+func signPictureLink(signer blob.Signer, container, link string) (string, error) {
+	name, ok := blob.NameFromLink(container, link)
+	if !ok {
+		container = blob.ThumbnailsContainer
+		name, ok = thumbnailNameFromLink(link)
+	}
+	if !ok {
+		return link, nil
+	}
+	return signer.Sign(container, name)
+}
+
+// signPicture signs the links of a picture and its thumbnails for the
+// configured lifetime
+func signPicture(ctx context.Context, blobs blob.Storage, link, thumbnailLink string, thumbnails store.ThumbnailLinks, cfg config.Config) (signedPicture, error) {
+	container := cfg.Azure.PicturesContainer
+	signed := signedPicture{ExpiresAt: time.Now().Add(time.Duration(cfg.PictureLinks.LinkMinutes) * time.Minute).UTC()}
+	signer, err := blobs.Signer(ctx, signed.ExpiresAt)
+	if err != nil {
+		return signedPicture{}, fmt.Errorf("failed to get user delegation key: %w", err)
+	}
+	if signed.URL, err = signPictureLink(signer, container, link); err != nil {
+		return signedPicture{}, fmt.Errorf("failed to sign picture link: %w", err)
+	}
+	if signed.ThumbnailURL, err = signPictureLink(signer, container, thumbnailLink); err != nil {
+		return signedPicture{}, fmt.Errorf("failed to sign thumbnail link: %w", err)
+	}
+	for size, variant := range thumbnails {
+		url, err := signPictureLink(signer, container, variant)
+		if err != nil {
+			return signedPicture{}, fmt.Errorf("failed to sign thumbnail link: %w", err)
+		}
+		if signed.Thumbnails == nil {
+			signed.Thumbnails = map[string]string{}
+		}
+		signed.Thumbnails[size] = url
+	}
+	return signed, nil
+}
+
+// responseLinks returns the links to answer the upload p with, for the user
+// at version: SAS URLs when picture_links.sas is set, since clients can't read a
+// private container by its paths, or else the links clients are given. A
+// failure to sign falls back to those, as the upload itself succeeded.
+func (h *handler) responseLinks(r *http.Request, p uploadedPhoto, version int64) (link, thumbnailLink string, thumbnails map[string]string) {
+	if !h.config.PictureLinks.SAS || p.Blob == "" {
+		public := h.links.user(store.User{Link: p.Link, ThumbnailLink: p.ThumbnailLink, Thumbnails: p.Thumbnails, Version: version})
+		return public.Link, public.ThumbnailLink, public.Thumbnails
+	}
+	signed, err := signPicture(r.Context(), h.blobs, p.Link, p.ThumbnailLink, p.Thumbnails, h.config)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Answering upload with stored links", "blob", p.Blob, "error", err)
+		return p.Link, p.ThumbnailLink, p.Thumbnails
+	}
+	return signed.URL, signed.ThumbnailURL, signed.Thumbnails
+}
+
+// API to Sign a User's Picture Links (GET /users/{id}/photo/sas)
+//
+// Issues fresh read-only SAS URLs for the user's picture and thumbnails, for
+// clients that can't read the containers directly or whose URLs expired.
+func (h *handler) getPhotoSAS(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	user, err := h.users.GetUser(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+	if user.Link == "" {
+		writeProblem(w, r, http.StatusNotFound, msgUserHasNoPicture)
+		return
+	}
+	signed, err := signPicture(r.Context(), h.blobs, user.Link, user.ThumbnailLink, user.Thumbnails, h.config)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error signing picture links", "user_id", id, "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorSigningLinks)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(signed)
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"user/user/blob"
+	"user/user/store"
+)
+
+// Purge tuning
+const (
+	purgeInterval  = time.Hour
+	purgeBatchSize = 500
+)
+
+// runPurge removes users soft-deleted more than retention ago, pictures
+// included, every purgeInterval until ctx is cancelled. Instances may purge
+// concurrently: each row is removed by whichever gets to it first.
+func runPurge(ctx context.Context, blobs blob.Storage, userStore store.UserStore, pictures store.PictureStore, picturesContainer string, retention time.Duration) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		purgeDeletedUsers(ctx, blobs, userStore, pictures, picturesContainer, time.Now().Add(-retention))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeDeletedUsers removes users soft-deleted before cutoff, in batches.
+// Errors are logged and the rest left to the next run; the one that stopped it
+// is returned.
+func purgeDeletedUsers(ctx context.Context, blobs blob.Storage, userStore store.UserStore, pictures store.PictureStore, picturesContainer string, cutoff time.Time) error {
+	purged := 0
+	var err error
+	for ctx.Err() == nil {
+		var users []store.User
+		users, err = userStore.PurgeDeletedUsers(ctx, cutoff, purgeBatchSize)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error purging deleted users", "error", err)
+			break
+		}
+		// The rows are gone, so pictures that fail to delete are left for cleanup-blobs
+		for _, user := range users {
+			deleteReplacedPhoto(ctx, blobs, pictures, picturesContainer, user)
+		}
+		purged += len(users)
+		if len(users) < purgeBatchSize {
+			break
+		}
+	}
+	if purged > 0 {
+		slog.InfoContext(ctx, "Purged deleted users", "count", purged, "deleted_before", cutoff)
+	}
+	return err
+}
@@ -0,0 +1,304 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+// How long a client's bucket may sit unused before it is evicted
+const rateLimiterIdleTTL = 10 * time.Minute
+
+// Fixed window the shared counters of rate_limit.distributed count over
+const sharedRateWindow = time.Minute
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// clientRateLimiter hands out a token bucket per client, keyed by whatever
+// identifies it: an IP, or a credential
+type clientRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*clientBucket
+	limit   rate.Limit
+	burst   int
+	done    chan struct{}
+}
+
+// newClientRateLimiter creates a limiter and starts evicting buckets idle for longer than idleTTL
+func newClientRateLimiter(limit rate.Limit, burst int, idleTTL time.Duration) *clientRateLimiter {
+	l := &clientRateLimiter{
+		buckets: make(map[string]*clientBucket),
+		limit:   limit,
+		burst:   burst,
+		done:    make(chan struct{}),
+	}
+	go l.evictIdle(idleTTL)
+	return l
+}
+
+// setLimit changes the limit and burst, of the clients' buckets too, keeping
+// the tokens they have left
+func (l *clientRateLimiter) setLimit(limit rate.Limit, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit == l.limit && burst == l.burst {
+		return
+	}
+	l.limit, l.burst = limit, burst
+	now := time.Now()
+	for _, bucket := range l.buckets {
+		bucket.limiter.SetLimitAt(now, limit)
+		bucket.limiter.SetBurstAt(now, burst)
+	}
+}
+
+// perWindow is how many requests a client may make over window
+func (l *clientRateLimiter) perWindow(window time.Duration) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return float64(l.limit)*window.Seconds() + float64(l.burst)
+}
+
+// stop ends the eviction of idle buckets, once the limiter is no longer used
+func (l *clientRateLimiter) stop() {
+	close(l.done)
+}
+
+// reserve takes a token for key. When none is available it reports how long
+// the client should wait before retrying.
+func (l *clientRateLimiter) reserve(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &clientBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = bucket
+	}
+	bucket.lastSeen = now
+	l.mu.Unlock()
+
+	reservation := bucket.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Second
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+func (l *clientRateLimiter) evictIdle(idleTTL time.Duration) {
+	ticker := time.NewTicker(idleTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		cutoff := time.Now().Add(-idleTTL)
+		l.mu.Lock()
+		for key, bucket := range l.buckets {
+			if bucket.lastSeen.Before(cutoff) {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rateLimits holds the limiter of every rate-limited route: the one set for
+// the route in rate_limit.routes, or the default one
+type rateLimits struct {
+	mu       sync.RWMutex // Guards routes and shared, which App Configuration may change
+	fallback *clientRateLimiter
+	routes   map[string]*clientRateLimiter // By method and route template
+	store    store.RateLimitStore
+	shared   store.RateLimitStore // store with rate_limit.distributed; nil otherwise
+	config   config.Config        // Whose server settings say where client IPs come from
+}
+
+func newRateLimits(cfg config.Config, store store.RateLimitStore) *rateLimits {
+	limits := &rateLimits{
+		fallback: newClientRateLimiter(rate.Limit(cfg.RateLimit.RequestsPerSecond), cfg.RateLimit.Burst, rateLimiterIdleTTL),
+		routes:   map[string]*clientRateLimiter{},
+		store:    store,
+	}
+	limits.update(cfg)
+	return limits
+}
+
+// update applies the rate_limit settings of a new snapshot. Clients keep their
+// buckets on routes whose limits stay, even if the numbers change.
+func (l *rateLimits) update(cfg config.Config) {
+	l.fallback.setLimit(rate.Limit(cfg.RateLimit.RequestsPerSecond), cfg.RateLimit.Burst)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for route, limiter := range l.routes {
+		if _, ok := cfg.RateLimit.Routes[route]; !ok {
+			limiter.stop()
+			delete(l.routes, route)
+		}
+	}
+	for route, limit := range cfg.RateLimit.Routes {
+		if limiter, ok := l.routes[route]; ok {
+			limiter.setLimit(rate.Limit(limit.RequestsPerSecond), limit.Burst)
+		} else {
+			l.routes[route] = newClientRateLimiter(rate.Limit(limit.RequestsPerSecond), limit.Burst, rateLimiterIdleTTL)
+		}
+	}
+	l.config = cfg
+	l.shared = nil
+	if cfg.RateLimit.Distributed {
+		l.shared = l.store
+	}
+}
+
+// reserve takes a token for the request's client on its route's limiter, and
+// counts it against the shared limit too when there is one. A shared count
+// that can't be taken lets the request through rather than fail it.
+func (l *rateLimits) reserve(r *http.Request) (bool, time.Duration) {
+	limiter, scope := l.fallback, ""
+	l.mu.RLock()
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			if routeLimiter, ok := l.routes[r.Method+" "+tmpl]; ok {
+				limiter, scope = routeLimiter, r.Method+" "+tmpl
+			}
+		}
+	}
+	shared, cfg := l.shared, l.config
+	l.mu.RUnlock()
+	key := rateLimitKey(r, cfg)
+	if ok, retryAfter := limiter.reserve(key); !ok || shared == nil {
+		return ok, retryAfter
+	}
+
+	window := time.Now().Truncate(sharedRateWindow)
+	hash := sha256.Sum256([]byte(scope + " " + key))
+	requests, err := shared.CountRequest(r.Context(), hex.EncodeToString(hash[:]), window)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error counting request against the shared rate limit, letting it through", "error", err)
+		return true, 0
+	}
+	if float64(requests) > limiter.perWindow(sharedRateWindow) {
+		return false, time.Until(window.Add(sharedRateWindow))
+	}
+	return true, 0
+}
+
+// rateLimitKey identifies the client a request is counted against: the
+// credential it was authenticated with, hashed, else its IP. Credentials only
+// count once verified, so made-up ones don't buy fresh buckets.
+func rateLimitKey(r *http.Request, cfg config.Config) string {
+	credential := principalFromContext(r.Context()).credential()
+	if credential == "" {
+		return "ip:" + clientIP(r, cfg)
+	}
+	hash := sha256.Sum256([]byte(credential))
+	return "key:" + hex.EncodeToString(hash[:16])
+}
+
+// rejectRateLimited writes a 429 telling the client when to retry
+func rejectRateLimited(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeProblem(w, r, http.StatusTooManyRequests, msgTooManyRequests)
+}
+
+// rateLimitMiddleware applies the route's rate limit to every request, per
+// client. On authenticated routes it goes after authentication, which tells
+// the clients apart by their verified credentials.
+func rateLimitMiddleware(limits *rateLimits) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, retryAfter := limits.reserve(r); !ok {
+				rejectRateLimited(w, r, retryAfter)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP returns the address of the caller. X-Forwarded-For is only read
+// when the peer is one of server.trusted_proxies, since anyone else may write
+// any address there. Behind them it is the rightmost entry that isn't a
+// trusted proxy: each proxy appends the address it was called from, so the
+// entries left of those are whatever the client sent.
+func clientIP(r *http.Request, cfg config.Config) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if !cfg.Server.TrustProxyHeaders || err != nil || !trustedProxy(peer.Unmap(), cfg.Server.TrustedProxies) {
+		return host
+	}
+	entries := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(entries[i]))
+		if err != nil {
+			break
+		}
+		if ip = ip.Unmap(); !trustedProxy(ip, cfg.Server.TrustedProxies) {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+// trustedProxy reports whether ip is one of the proxies of server.trusted_proxies
+func trustedProxy(ip netip.Addr, proxies []string) bool {
+	for _, proxy := range proxies {
+		if prefix, err := parseProxyPrefix(proxy); err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxyPrefix reads an entry of server.trusted_proxies, an IP or a CIDR
+func parseProxyPrefix(proxy string) (netip.Prefix, error) {
+	if strings.Contains(proxy, "/") {
+		return netip.ParsePrefix(proxy)
+	}
+	ip, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()), nil
+}
+
+// proxyProblems checks every entry of server.trusted_proxies parses, and that
+// there are some when proxy headers are trusted
+func proxyProblems(cfg config.Config) []string {
+	var problems []string
+	if cfg.Server.TrustProxyHeaders && len(cfg.Server.TrustedProxies) == 0 {
+		problems = append(problems, "server.trust_proxy_headers needs server.trusted_proxies, the proxies whose X-Forwarded-For is believed")
+	}
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if _, err := parseProxyPrefix(proxy); err != nil {
+			problems = append(problems, fmt.Sprintf("server.trusted_proxies entries must be IPs or CIDRs, got %q", proxy))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"user/user/config"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustHeaders bool
+		remoteAddr   string
+		forwardedFor []string // X-Forwarded-For headers
+		want         string
+	}{
+		{name: "no proxy", remoteAddr: "203.0.113.7:51000", want: "203.0.113.7"},
+		{name: "headers not trusted", remoteAddr: "10.0.0.2:51000", forwardedFor: []string{"198.51.100.9"}, want: "10.0.0.2"},
+		{name: "trusted proxy", trustHeaders: true, remoteAddr: "10.0.0.2:51000", forwardedFor: []string{"198.51.100.9"}, want: "198.51.100.9"},
+		// A client connecting directly can't pick the address it is counted by
+		{name: "spoofed by untrusted peer", trustHeaders: true, remoteAddr: "203.0.113.7:51000", forwardedFor: []string{"198.51.100.9"}, want: "203.0.113.7"},
+		{name: "spoofed through trusted proxy", trustHeaders: true, remoteAddr: "10.0.0.2:51000", forwardedFor: []string{"198.51.100.9, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "chain of trusted proxies", trustHeaders: true, remoteAddr: "10.0.0.2:51000", forwardedFor: []string{"203.0.113.7", "10.0.0.3"}, want: "203.0.113.7"},
+		{name: "only trusted proxies", trustHeaders: true, remoteAddr: "10.0.0.2:51000", forwardedFor: []string{"10.0.0.3"}, want: "10.0.0.2"},
+		{name: "malformed entry", trustHeaders: true, remoteAddr: "10.0.0.2:51000", forwardedFor: []string{"unknown"}, want: "10.0.0.2"},
+		{name: "mapped IPv4 peer", trustHeaders: true, remoteAddr: "[::ffff:10.0.0.2]:51000", forwardedFor: []string{"198.51.100.9"}, want: "198.51.100.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config.Config
+			cfg.Server.TrustProxyHeaders = tt.trustHeaders
+			cfg.Server.TrustedProxies = []string{"10.0.0.0/24"}
+			r := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := clientIP(r, cfg); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
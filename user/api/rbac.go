@@ -0,0 +1,77 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"user/user/store"
+)
+
+// Role stored in users.roles that grants admin rights to the person signing in
+// as that user
+const roleAdmin = "admin"
+
+// Roles an admin may assign
+var knownRoles = []string{roleAdmin}
+
+// Claims tried, in order, for the email that ties a JWT to its user record
+var emailClaims = []string{"email", "preferred_username", "upn"}
+
+// authorizeMiddleware limits people signing in with a JWT to their own record:
+// unless they are admins, by token role or by the roles column of the user
+// matching their email, they may only read and update /users/{id} for their own
+// ID, and may never delete. Callers using API keys are services and keep the
+// access their key grants.
+func authorizeMiddleware(userStore store.UserStore) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := principalFromContext(r.Context())
+			if principal.Claims == nil || principal.Admin {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Find the caller's own record, which may make them an admin
+			var self store.User
+			for _, claim := range emailClaims {
+				if email, _ := principal.Claims[claim].(string); email != "" {
+					user, err := userStore.GetUserByEmail(r.Context(), tenantFromContext(r.Context()), email)
+					if err != nil && !errors.Is(err, store.ErrUserNotFound) {
+						dbError(w, r, err, msgErrorFetchingCaller)
+						return
+					}
+					self = user
+					break
+				}
+			}
+			principal.UserID = self.ID
+			if self.LockedAt != nil {
+				accountLocked(w, r)
+				return
+			}
+			if slices.Contains(self.Roles, roleAdmin) {
+				principal.Admin = true
+				next.ServeHTTP(w, withPrincipal(r, principal))
+				return
+			}
+
+			id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+			switch {
+			case err != nil:
+				writeProblem(w, r, http.StatusForbidden, msgOnlyAdminsAccessOthers)
+				return
+			case r.Method == http.MethodDelete:
+				writeProblem(w, r, http.StatusForbidden, msgOnlyAdminsDelete)
+				return
+			case self.ID == 0 || id != self.ID:
+				writeProblem(w, r, http.StatusForbidden, msgOwnUserOnly)
+				return
+			}
+			next.ServeHTTP(w, withPrincipal(r, principal))
+		})
+	}
+}
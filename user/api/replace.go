@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"user/user/events"
+	"user/user/store"
+)
+
+// API to Replace a User (PUT /users/{id}). Name and email are required; a new
+// picture may be uploaded as "photo" or referenced as "photo_url", otherwise the
+// current one is kept.
+func (h *handler) replaceUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+
+	tenant := tenantFromContext(r.Context())
+	previous, err := h.users.GetUser(r.Context(), tenant, id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+	if !parseUploadForm(w, r) {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	email := strings.TrimSpace(r.FormValue("email"))
+	photoURL := r.FormValue("photo_url")
+	var errs validationErrors
+	errs.check("name", validateName(name, h.config.Validation.MaxNameLength))
+	errs.check("email", validateEmail(email))
+	switch {
+	case photoURL != "":
+		errs.check("photo_url", validatePhotoURL(photoURL, h.config.Validation.MaxLinkLength))
+	case hasFormFile(r, "photo"):
+		errs.check("photo", validatePhotoFile(r.MultipartForm.File["photo"][0], h.config))
+	}
+	_, replaceMetadata := r.MultipartForm.Value["metadata"]
+	metadata, err := parseMetadataForm(r.FormValue("metadata"))
+	errs.check("metadata", err)
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	var bodyVersion *int64
+	if value := r.FormValue("version"); value != "" {
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			bodyVersion = &v
+		}
+	}
+	version, ok := requireVersion(w, r, bodyVersion, func() (int64, bool) { return previous.Version, true })
+	if !ok {
+		return
+	}
+	if version != previous.Version {
+		// Don't bother uploading a picture that can't be saved
+		staleUpdate(w, r)
+		return
+	}
+	if !strings.EqualFold(email, previous.Email) && !requireRecentTwoFactor(w, r, h.sessions, id) {
+		return
+	}
+
+	changes := store.UserChanges{Version: version, Name: &name, Email: &email}
+	if replaceMetadata {
+		changes.Metadata = &metadata
+	}
+	var photo uploadedPhoto
+	switch {
+	case photoURL != "":
+		photo.Link = photoURL
+		changes.Link, changes.ThumbnailLink, changes.Thumbnails = &photo.Link, &photo.ThumbnailLink, &photo.Thumbnails
+	case hasFormFile(r, "photo"):
+		photo, ok = h.uploadPhoto(w, r, id)
+		if !ok {
+			return
+		}
+		changes.Link, changes.ThumbnailLink, changes.Thumbnails = &photo.Link, &photo.ThumbnailLink, &photo.Thumbnails
+	}
+
+	user, err := h.users.UpdateUser(store.WithOutboxEvent(r.Context(), events.UserUpdated), tenant, id, changes)
+	if err != nil {
+		if photo.Blob != "" {
+			h.discard(r.Context(), photo)
+		}
+		switch {
+		case errors.Is(err, store.ErrStaleVersion):
+			staleUpdate(w, r)
+		case errors.Is(err, store.ErrUserNotFound):
+			// Deleted between the lookup and the update
+			writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		case errors.Is(err, store.ErrDuplicateEmail):
+			writeEmailTaken(w, r, msgEmailTaken)
+		default:
+			dbError(w, r, err, msgErrorUpdatingUser)
+		}
+		return
+	}
+	if changes.Link != nil {
+		deleteReplacedPhoto(r.Context(), h.blobs, h.pictures, h.config.Azure.PicturesContainer, previous)
+	}
+
+	h.webhooks.notify(r.Context(), events.UserUpdated, user)
+	if !strings.EqualFold(email, previous.Email) {
+		h.verifier.send(r, user)
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	json.NewEncoder(w).Encode(h.links.user(user))
+}
+
+// hasFormFile reports whether the parsed multipart form carries a file under key
+func hasFormFile(r *http.Request, key string) bool {
+	return r.MultipartForm != nil && len(r.MultipartForm.File[key]) > 0
+}
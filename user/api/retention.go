@@ -0,0 +1,219 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"user/user/blob"
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// What a retention rule removes
+const (
+	retentionInactiveUsers = "inactive_users" // Live users who haven't logged in for the rule's age, deleted as deletion.mode says
+	retentionAuditEvents   = "audit_events"   // Audit events older than the rule's age, removed for good
+)
+
+// Rows a retention rule reads or removes at a time
+const retentionBatchSize = 500
+
+// Outcome of POST /admin/retention, and of each scheduled run
+type RetentionReport struct {
+	DryRun bool                  `json:"dryRun"`
+	Rules  []RetentionRuleReport `json:"rules"`
+}
+
+// What one retention rule found and removed
+type RetentionRuleReport struct {
+	Name    string    `json:"name"`
+	Target  string    `json:"target"`
+	Cutoff  time.Time `json:"cutoff"`  // Removed what is older than this
+	Matched int64     `json:"matched"` // Users or events the rule applies to
+	Deleted int64     `json:"deleted"` // Of those, removed; none in dry-run mode
+	Failed  int64     `json:"failed,omitempty"`
+}
+
+// retentionProblems checks the rules of retention.rules
+func retentionProblems(cfg config.Config) []string {
+	var problems []string
+	names := map[string]bool{}
+	for i, rule := range cfg.Retention.Rules {
+		key := fmt.Sprintf("retention.rules[%d]", i)
+		switch {
+		case rule.Name == "":
+			problems = append(problems, key+".name is required")
+		case names[rule.Name]:
+			problems = append(problems, fmt.Sprintf("%s.name %q is used by another rule", key, rule.Name))
+		}
+		names[rule.Name] = true
+		switch rule.Target {
+		case retentionInactiveUsers:
+		case retentionAuditEvents:
+			if len(rule.Tenants) > 0 {
+				problems = append(problems, key+".tenants only applies to inactive_users")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%s.target must be %s or %s, got %q", key, retentionInactiveUsers, retentionAuditEvents, rule.Target))
+		}
+		if rule.Days < 0 || rule.Months < 0 || rule.Days+rule.Months == 0 {
+			problems = append(problems, key+" needs a positive days or months")
+		}
+	}
+	if _, ok := cfg.Scheduler.Jobs[jobRetention]; ok && len(cfg.Retention.Rules) == 0 {
+		problems = append(problems, "scheduler.jobs."+jobRetention+" requires retention.rules")
+	}
+	return problems
+}
+
+// retentionPolicy applies retention.rules. Deleted users go as DELETE
+// /users/{id} would take them: with a user.deleted event through the outbox, a
+// webhook delivery and an audit event, and with their pictures when
+// deletion.mode is hard. A user logging in while their rule runs may still be
+// deleted.
+type retentionPolicy struct {
+	rules            []config.RetentionRule
+	hard             bool
+	users            store.UserStore
+	audit            store.AuditStore
+	pictures         store.PictureStore
+	blobs            blob.Storage
+	pictureContainer string // azure.pictures_container
+	webhooks         *webhookDispatcher
+}
+
+func newRetentionPolicy(cfg config.Config, deps ServerDeps, webhooks *webhookDispatcher) *retentionPolicy {
+	return &retentionPolicy{
+		rules:            cfg.Retention.Rules,
+		hard:             cfg.Deletion.Mode == config.DeletionModeHard,
+		users:            deps.Users,
+		audit:            deps.Audit,
+		pictures:         deps.Pictures,
+		blobs:            deps.Blobs,
+		pictureContainer: cfg.Azure.PicturesContainer,
+		webhooks:         webhooks,
+	}
+}
+
+// enforce applies every rule, or in dry-run mode only counts what each
+// matches, counting them in the retention metrics. A rule that fails is
+// reported with what it got through, and the others still run; the first
+// failure is returned.
+func (p *retentionPolicy) enforce(ctx context.Context, dryRun bool) (RetentionReport, error) {
+	report := RetentionReport{DryRun: dryRun, Rules: []RetentionRuleReport{}}
+	var firstErr error
+	now := time.Now().UTC()
+	for _, rule := range p.rules {
+		result := RetentionRuleReport{Name: rule.Name, Target: rule.Target, Cutoff: rule.Cutoff(now)}
+		var err error
+		switch rule.Target {
+		case retentionInactiveUsers:
+			err = p.deleteInactiveUsers(ctx, rule, dryRun, &result)
+		case retentionAuditEvents:
+			err = p.purgeAuditEvents(ctx, dryRun, &result)
+		}
+		switch {
+		case dryRun:
+			telemetry.RetentionRecordsTotal.WithLabelValues(rule.Name, "reported").Add(float64(result.Matched))
+		default:
+			telemetry.RetentionRecordsTotal.WithLabelValues(rule.Name, "deleted").Add(float64(result.Deleted))
+			telemetry.RetentionRecordsTotal.WithLabelValues(rule.Name, "failure").Add(float64(result.Failed))
+		}
+		logger := slog.With("rule", rule.Name, "target", rule.Target, "cutoff", result.Cutoff, "dry_run", dryRun)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error applying retention rule", "error", err)
+			firstErr = cmp.Or(firstErr, fmt.Errorf("rule %s: %w", rule.Name, err))
+		}
+		if result.Matched > 0 {
+			logger.InfoContext(ctx, "Applied retention rule", "matched", result.Matched, "deleted", result.Deleted, "failed", result.Failed)
+		}
+		report.Rules = append(report.Rules, result)
+	}
+	return report, firstErr
+}
+
+// deleteInactiveUsers deletes the users of the rule's tenants who went
+// inactive before its cutoff. Failed deletes are counted and logged, and the
+// rest carry on.
+func (p *retentionPolicy) deleteInactiveUsers(ctx context.Context, rule config.RetentionRule, dryRun bool, result *RetentionRuleReport) error {
+	var afterID int64
+	for ctx.Err() == nil {
+		users, err := p.users.ListInactiveUsers(ctx, result.Cutoff, afterID, retentionBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			afterID = user.ID
+			if len(rule.Tenants) > 0 && !slices.Contains(rule.Tenants, user.TenantID) {
+				continue
+			}
+			result.Matched++
+			if dryRun {
+				continue
+			}
+			err := p.users.DeleteUser(store.WithOutboxEvent(ctx, events.UserDeleted), user.TenantID, user.ID, p.hard)
+			switch {
+			case errors.Is(err, store.ErrUserNotFound):
+				// Deleted meanwhile
+				result.Matched--
+				continue
+			case err != nil:
+				result.Failed++
+				slog.ErrorContext(ctx, "Error deleting inactive user", "rule", rule.Name, "tenant", user.TenantID, "user_id", user.ID, "error", err)
+				continue
+			}
+			result.Deleted++
+			if p.hard {
+				deleteReplacedPhoto(ctx, p.blobs, p.pictures, p.pictureContainer, user)
+			}
+			p.webhooks.notify(ctx, events.UserDeleted, user)
+		}
+		if len(users) < retentionBatchSize {
+			break
+		}
+	}
+	return ctx.Err()
+}
+
+// purgeAuditEvents removes the audit events recorded before the rule's cutoff
+func (p *retentionPolicy) purgeAuditEvents(ctx context.Context, dryRun bool, result *RetentionRuleReport) error {
+	if dryRun {
+		count, err := p.audit.CountAuditEvents(ctx, store.AuditFilter{Until: result.Cutoff})
+		result.Matched = count
+		return err
+	}
+	for ctx.Err() == nil {
+		purged, err := p.audit.PurgeAuditEvents(ctx, result.Cutoff, retentionBatchSize)
+		if err != nil {
+			return err
+		}
+		result.Matched += purged
+		result.Deleted += purged
+		if purged < retentionBatchSize {
+			break
+		}
+	}
+	return ctx.Err()
+}
+
+// API to Apply the Retention Rules (POST /admin/retention[?dry_run=true])
+//
+// Runs every rule of retention.rules now, as the retention job does, and
+// reports what each found and removed. In dry-run mode nothing is removed.
+func (h *handler) enforceRetention(w http.ResponseWriter, r *http.Request) {
+	report, err := h.retention.enforce(r.Context(), r.URL.Query().Get("dry_run") == "true")
+	if err != nil {
+		dbError(w, r, err, msgErrorApplyingRetention)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
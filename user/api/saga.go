@@ -0,0 +1,45 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+)
+
+// saga tracks the completed steps of a write spanning several stores, so that
+// if a later step fails the earlier ones can be undone and no partial state is
+// left behind
+type saga struct {
+	name  string
+	steps []sagaStep // Completed, oldest first
+}
+
+// sagaStep is a completed step and the compensation that undoes it
+type sagaStep struct {
+	name       string
+	compensate func(ctx context.Context) error
+}
+
+func newSaga(name string) *saga {
+	return &saga{name: name}
+}
+
+// done records that a step completed and how to undo it
+func (s *saga) done(step string, compensate func(ctx context.Context) error) {
+	s.steps = append(s.steps, sagaStep{name: step, compensate: compensate})
+}
+
+// rollback runs the compensations of the completed steps, newest first. They
+// run even if the request was cancelled; a failed one is logged and the rest
+// still run.
+func (s *saga) rollback(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		step := s.steps[i]
+		if err := step.compensate(ctx); err != nil {
+			slog.ErrorContext(ctx, "Error compensating step", "saga", s.name, "step", step.name, "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "Compensated step", "saga", s.name, "step", step.name)
+	}
+	s.steps = nil
+}
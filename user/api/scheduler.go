@@ -0,0 +1,402 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"user/user/config"
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// Jobs scheduler.jobs may schedule
+const (
+	jobBlobCleanup    = "blob_cleanup"    // Collects orphaned blobs, as blob_cleanup configures
+	jobOutboxDispatch = "outbox_dispatch" // Drains the outbox, instead of it being polled all the time
+	jobPurge          = "purge"           // Purges users soft-deleted more than deletion.retention_days ago
+	jobCacheWarmup    = "cache_warmup"    // Reads the first page of users of scheduler.warm_tenants into the cache
+	jobRetention      = "retention"       // Applies retention.rules
+)
+
+var scheduledJobNames = []string{jobBlobCleanup, jobOutboxDispatch, jobPurge, jobCacheWarmup, jobRetention}
+
+// How far ahead a cron expression is searched for its next time
+const scheduleSearchYears = 5
+
+// A job the scheduler runs; errors are logged and it runs again next time
+type jobFunc func(ctx context.Context) error
+
+// jobSchedule is when a job runs, in UTC
+type jobSchedule interface {
+	// next is the first time after after that the job runs; zero if it never does
+	next(after time.Time) time.Time
+}
+
+// Shorthands of scheduler.jobs schedules
+var scheduleShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseSchedule reads a schedule of scheduler.jobs: a cron expression of
+// minute, hour, day of month, month and day of week, one of the @ shorthands,
+// or @every and a duration
+func parseSchedule(spec string) (jobSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, err
+		}
+		if every < time.Second {
+			return nil, errors.New("@every must be at least 1s")
+		}
+		return everySchedule(every), nil
+	}
+	if expression, ok := scheduleShorthands[spec]; ok {
+		spec = expression
+	}
+	return parseCron(spec)
+}
+
+// everySchedule runs a job at each multiple of its interval since the zero
+// time, so every instance agrees on when the runs are
+type everySchedule time.Duration
+
+func (s everySchedule) next(after time.Time) time.Time {
+	return after.UTC().Truncate(time.Duration(s)).Add(time.Duration(s))
+}
+
+// cronSchedule runs a job at the minutes matching a cron expression, each field
+// a set of bits
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDOM, anyDOW                bool // Day of month or of week is *, so only the other one picks days
+}
+
+// A field of a cron expression
+type cronField struct {
+	name     string
+	min, max int
+	names    []string // Of the values from min, e.g. months
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// parseCron reads a 5-field cron expression. A field is *, a value, a range
+// a-b, or either with a /step, or a comma-separated list of those; months and
+// days of week may go by name, and Sunday is 0 or 7.
+func parseCron(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("want %d fields (minute hour day-of-month month day-of-week), an @ shorthand or @every, got %q", len(cronFields), expression)
+	}
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		if sets[i], err = cronFields[i].parse(field); err != nil {
+			return nil, err
+		}
+	}
+	// 7 is Sunday too
+	if sets[4]&(1<<7) != 0 {
+		sets[4] = sets[4]&^(1<<7) | 1
+	}
+	return &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		anyDOM: strings.HasPrefix(fields[2], "*"),
+		anyDOW: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parse reads one field of a cron expression as the set of values it matches
+func (f cronField) parse(field string) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		spec, stepText, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("%s: step of %q must be a positive number", f.name, part)
+			}
+		}
+		low, high := f.min, f.max
+		if spec != "*" {
+			first, last, isRange := strings.Cut(spec, "-")
+			var err error
+			if low, err = f.value(first); err != nil {
+				return 0, err
+			}
+			high = low
+			switch {
+			case isRange:
+				if high, err = f.value(last); err != nil {
+					return 0, err
+				}
+			case stepped:
+				high = f.max
+			}
+			if low > high {
+				return 0, fmt.Errorf("%s: range %q runs backwards", f.name, spec)
+			}
+		}
+		for v := low; v <= high; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// value reads a number or name of the field
+func (f cronField) value(text string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(text, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(text)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s: %q must be between %d and %d", f.name, text, f.min, f.max)
+	}
+	return v, nil
+}
+
+// next skips the months, days, hours and minutes that don't match in turn,
+// giving up after scheduleSearchYears for an expression such as 30 February
+func (s *cronSchedule) next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(scheduleSearchYears, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay reports whether a job runs on t's day. As in cron, when both day
+// of month and day of week are restricted, a day matching either is taken.
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	if s.anyDOM || s.anyDOW {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// schedulerProblems checks the jobs of scheduler.jobs
+func schedulerProblems(cfg config.Config) []string {
+	var problems []string
+	for name, job := range cfg.Scheduler.Jobs {
+		key := "scheduler.jobs." + name
+		switch name {
+		case jobBlobCleanup, jobOutboxDispatch, jobRetention:
+		case jobPurge:
+			if cfg.Deletion.RetentionDays <= 0 {
+				problems = append(problems, key+" requires deletion.retention_days")
+			}
+		case jobCacheWarmup:
+			if cfg.Cache.RedisURL == "" {
+				problems = append(problems, key+" requires cache.redis_url")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("scheduler.jobs: unknown job %q, want one of %s", name, strings.Join(scheduledJobNames, ", ")))
+			continue
+		}
+		schedule, err := parseSchedule(job.Schedule)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s.schedule: %v", key, err))
+			continue
+		}
+		if schedule.next(time.Now()).IsZero() {
+			problems = append(problems, fmt.Sprintf("%s.schedule %q never runs", key, job.Schedule))
+		}
+		if job.TimeoutMinutes < 0 {
+			problems = append(problems, fmt.Sprintf("%s.timeout_minutes may not be negative, got %d", key, job.TimeoutMinutes))
+		}
+	}
+	return problems
+}
+
+// A job of scheduler.jobs, ready to run
+type scheduledJob struct {
+	name     string
+	schedule jobSchedule
+	timeout  time.Duration
+	run      jobFunc
+}
+
+// scheduler runs the jobs of scheduler.jobs on their schedules. Every instance
+// runs the scheduler, and each run is claimed in runs first, so one instance
+// makes it while the others skip it; the claim holds until the run finishes or
+// its timeout passes. Runs missed while the previous one went on aren't made
+// up. A nil scheduler runs nothing.
+type scheduler struct {
+	jobs  []scheduledJob
+	runs  store.JobRunStore
+	owner string // This instance, in the claims
+}
+
+// newScheduler schedules the jobs of scheduler.jobs out of registry, or
+// returns nil when none is scheduled
+func newScheduler(cfg config.Config, runs store.JobRunStore, registry map[string]jobFunc) *scheduler {
+	if len(cfg.Scheduler.Jobs) == 0 {
+		return nil
+	}
+	s := &scheduler{runs: runs, owner: newRequestID()}
+	for name, job := range cfg.Scheduler.Jobs {
+		// Checked by ValidateConfig
+		schedule, err := parseSchedule(job.Schedule)
+		if err != nil || registry[name] == nil {
+			slog.Error("Job isn't scheduled", "job", name, "schedule", job.Schedule, "error", err)
+			continue
+		}
+		s.jobs = append(s.jobs, scheduledJob{
+			name:     name,
+			schedule: schedule,
+			timeout:  time.Duration(job.TimeoutMinutes) * time.Minute,
+			run:      registry[name],
+		})
+	}
+	return s
+}
+
+// registeredJobs is what each job of scheduledJobNames runs
+func registeredJobs(cfg config.Config, deps ServerDeps, notifier *lifecycleNotifier, retention *retentionPolicy) map[string]jobFunc {
+	return map[string]jobFunc{
+		jobBlobCleanup: func(ctx context.Context) error {
+			_, err := collectOrphanedBlobs(ctx, deps.Blobs, deps.Users, deps.Pictures, cfg.Azure.PicturesContainer, cfg.BlobCleanup.DryRun)
+			return err
+		},
+		jobOutboxDispatch: func(ctx context.Context) error {
+			drainOutbox(ctx, deps.Events, deps.Outbox, notifier)
+			return nil
+		},
+		jobPurge: func(ctx context.Context) error {
+			return purgeDeletedUsers(ctx, deps.Blobs, deps.Users, deps.Pictures, cfg.Azure.PicturesContainer, time.Now().Add(-time.Duration(cfg.Deletion.RetentionDays)*24*time.Hour))
+		},
+		jobCacheWarmup: func(ctx context.Context) error {
+			return warmCache(ctx, deps.Users, cfg.Scheduler.WarmTenants)
+		},
+		jobRetention: func(ctx context.Context) error {
+			_, err := retention.enforce(ctx, cfg.Retention.DryRun)
+			return err
+		},
+	}
+}
+
+// scheduled reports whether scheduler.jobs schedules job, which then doesn't
+// also run in the background on its own
+func (s *scheduler) scheduled(job string) bool {
+	if s == nil {
+		return false
+	}
+	for _, scheduled := range s.jobs {
+		if scheduled.name == job {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs each job on its schedule until ctx is cancelled, waiting for the
+// runs in progress
+func (s *scheduler) run(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	var loops sync.WaitGroup
+	for _, job := range s.jobs {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			s.loop(ctx, job)
+		}()
+	}
+	loops.Wait()
+}
+
+// loop waits for each of the job's scheduled times and runs it
+func (s *scheduler) loop(ctx context.Context, job scheduledJob) {
+	for {
+		scheduledAt := job.schedule.next(time.Now())
+		if scheduledAt.IsZero() {
+			slog.Warn("Scheduled job has no more runs", "job", job.name)
+			return
+		}
+		timer := time.NewTimer(time.Until(scheduledAt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.execute(ctx, job, scheduledAt)
+	}
+}
+
+// execute makes the run of job scheduled at scheduledAt, unless another
+// instance claimed it
+func (s *scheduler) execute(ctx context.Context, job scheduledJob, scheduledAt time.Time) {
+	logger := slog.With("job", job.name, "scheduled_at", scheduledAt)
+	claimed, err := s.runs.ClaimJobRun(ctx, job.name, scheduledAt, s.owner, job.timeout)
+	if err != nil {
+		telemetry.ScheduledJobRunsTotal.WithLabelValues(job.name, "failure").Inc()
+		logger.Error("Error claiming scheduled job run", "error", err)
+		return
+	}
+	if !claimed {
+		telemetry.ScheduledJobRunsTotal.WithLabelValues(job.name, "skipped").Inc()
+		logger.Debug("Scheduled job run claimed by another instance")
+		return
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, job.timeout)
+	runCtx, span := telemetry.StartSpan(runCtx, "scheduled job", attribute.String("job.name", job.name))
+	start := time.Now()
+	err = job.run(runCtx)
+	telemetry.EndSpan(span, err)
+	cancel()
+	telemetry.ScheduledJobDuration.WithLabelValues(job.name).Observe(time.Since(start).Seconds())
+	// Released even at shutdown, so the next run needn't wait out the timeout
+	if err := s.runs.FinishJobRun(context.WithoutCancel(ctx), job.name, s.owner); err != nil {
+		logger.Warn("Error releasing scheduled job run; the next waits for its timeout", "error", err)
+	}
+	if err != nil {
+		telemetry.ScheduledJobRunsTotal.WithLabelValues(job.name, "failure").Inc()
+		logger.Error("Scheduled job failed", "duration", time.Since(start), "error", err)
+		return
+	}
+	telemetry.ScheduledJobRunsTotal.WithLabelValues(job.name, "success").Inc()
+	logger.Info("Scheduled job finished", "duration", time.Since(start))
+}
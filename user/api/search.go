@@ -0,0 +1,115 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"user/user/store"
+)
+
+// Sort recorded in search cursors, so a list cursor can't be replayed here
+const searchCursorSort = "relevance"
+
+// API to Search Users by Name or Email (GET /users/search?q=&limit=&cursor=)
+//
+// Kept apart from the list endpoint so the SQL matching can be swapped for a
+// search index without touching listing. With search_index.endpoint set, the
+// index answers, tolerating typos; while it fails, searches fall back to the
+// database. Cursors carry which of the two answered, and follow it. The
+// search_index feature flag takes tenants off the index.
+func (h *handler) searchUsers(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		writeProblem(w, r, http.StatusBadRequest, msgParamRequired.with("q"))
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+
+	var after store.SearchHit
+	offset := 0
+	useIndex := h.searchIdx != nil && h.settings.featureEnabled(r.Context(), featureSearchIndex)
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		cursor, err := decodeCursor(token)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+			return
+		}
+		key, err := strconv.Atoi(cursor.SortKey)
+		switch {
+		case err != nil:
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidCursor)
+			return
+		case cursor.Sort == searchCursorSort:
+			after = store.SearchHit{User: store.User{ID: cursor.ID}, Rank: key}
+			useIndex = false
+		case cursor.Sort == searchIndexCursorSort && h.searchIdx != nil && key >= 0:
+			// Pages go on from the index even if the flag was turned off since
+			offset, useIndex = key, true
+		default:
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidCursor)
+			return
+		}
+	}
+
+	page := UserPage{Users: []store.User{}}
+	tenant := tenantFromContext(r.Context())
+	if useIndex {
+		// Fetch one extra match to learn whether another page follows
+		ids, err := h.searchIdx.search(r.Context(), tenant, query, offset, limit+1)
+		if err == nil {
+			for i, id := range ids {
+				if i == limit {
+					page.NextCursor = encodeCursor(pageCursor{ID: id, SortKey: strconv.Itoa(offset + limit), Sort: searchIndexCursorSort})
+					break
+				}
+				user, err := h.users.GetUser(r.Context(), tenant, id)
+				if errors.Is(err, store.ErrUserNotFound) {
+					// Deleted since it was indexed
+					continue
+				}
+				if err != nil {
+					dbError(w, r, err, msgErrorSearchingUsers)
+					return
+				}
+				page.Users = append(page.Users, h.links.user(user))
+			}
+			if err := writeNegotiatedWithETag(w, r, page); err != nil {
+				slog.ErrorContext(r.Context(), "Error encoding users", "error", err)
+			}
+			return
+		}
+		if offset > 0 {
+			slog.ErrorContext(r.Context(), "Error searching the search index", "error", err)
+			writeProblem(w, r, http.StatusServiceUnavailable, msgSearchIndexDown)
+			return
+		}
+		slog.WarnContext(r.Context(), "Search index unavailable; searching the database", "error", err)
+	}
+
+	// Fetch one extra row to learn whether another page follows
+	hits, err := h.users.SearchUsers(r.Context(), tenant, query, after, limit+1)
+	if err != nil {
+		dbError(w, r, err, msgErrorSearchingUsers)
+		return
+	}
+
+	for i, hit := range hits {
+		if i == limit {
+			last := hits[limit-1]
+			page.NextCursor = encodeCursor(pageCursor{ID: last.ID, SortKey: strconv.Itoa(last.Rank), Sort: searchCursorSort})
+			break
+		}
+		page.Users = append(page.Users, h.links.user(hit.User))
+	}
+
+	if err := writeNegotiatedWithETag(w, r, page); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding users", "error", err)
+	}
+}
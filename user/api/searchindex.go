@@ -0,0 +1,270 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+)
+
+// REST API version of Azure AI Search the index is called with
+const searchAPIVersion = "2024-07-01"
+
+// Scope of the access tokens Azure AI Search accepts
+const searchTokenScope = "https://search.azure.com/.default"
+
+// Sort recorded in cursors of searches answered by the index, whose sort key is
+// the offset of the next page
+const searchIndexCursorSort = "index"
+
+// searchIndex is the Azure AI Search index of search_index.endpoint, holding a
+// document per live user with their name and email, for fuzzy, typo-tolerant
+// search. The indexer keeps it up to date from the user events; searches read
+// the users found from the store, so a document that is briefly stale never
+// shows a deleted user or outdated fields.
+type searchIndex struct {
+	endpoint string
+	name     string
+	apiKey   string // Empty signs in with config.AzureCredential
+	client   *http.Client
+}
+
+// newSearchIndex returns the index configured, or nil when search is left to the database
+func newSearchIndex(cfg config.Config) *searchIndex {
+	if cfg.SearchIndex.Endpoint == "" {
+		return nil
+	}
+	return &searchIndex{
+		endpoint: strings.TrimSuffix(cfg.SearchIndex.Endpoint, "/"),
+		name:     cfg.SearchIndex.Index,
+		apiKey:   cfg.SearchIndex.APIKey,
+		client:   &http.Client{Timeout: config.Seconds(cfg.SearchIndex.TimeoutSeconds)},
+	}
+}
+
+// searchDocument is a user as the index holds them, keyed by ID
+type searchDocument struct {
+	Action   string `json:"@search.action,omitempty"`
+	ID       string `json:"id"`
+	TenantID string `json:"tenantId,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// call sends body, if any, as JSON to path under the service and decodes the
+// response into out, if given
+func (s *searchIndex) call(ctx context.Context, method, path string, body, out any) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+path+"?api-version="+searchAPIVersion, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if s.apiKey != "" {
+		req.Header.Set("api-key", s.apiKey)
+	} else {
+		credential, err := config.AzureCredential()
+		if err != nil {
+			return err
+		}
+		token, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{searchTokenScope}})
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: unexpected status %s: %s", method, path, resp.Status, bytes.TrimSpace(detail))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ensure creates the index, or brings an existing one's fields up to date
+func (s *searchIndex) ensure(ctx context.Context) error {
+	definition := map[string]any{
+		"name": s.name,
+		"fields": []map[string]any{
+			{"name": "id", "type": "Edm.String", "key": true, "sortable": true, "searchable": false},
+			{"name": "tenantId", "type": "Edm.String", "filterable": true, "searchable": false},
+			{"name": "name", "type": "Edm.String", "searchable": true},
+			{"name": "email", "type": "Edm.String", "searchable": true},
+		},
+	}
+	return s.call(ctx, http.MethodPut, "/indexes/"+s.name, definition, nil)
+}
+
+// search returns the IDs of up to top users of the tenant matching query, best
+// match first, skipping the first skip
+func (s *searchIndex) search(ctx context.Context, tenant, query string, skip, top int) ([]int64, error) {
+	request := map[string]any{
+		"search":       searchQuery(query),
+		"queryType":    "full",
+		"searchMode":   "all",
+		"searchFields": "name,email",
+		"filter":       "tenantId eq '" + strings.ReplaceAll(tenant, "'", "''") + "'",
+		"select":       "id",
+		"orderby":      "search.score() desc, id asc",
+		"skip":         skip,
+		"top":          top,
+	}
+	var response struct {
+		Value []searchDocument `json:"value"`
+	}
+	if err := s.call(ctx, http.MethodPost, "/indexes/"+s.name+"/docs/search", request, &response); err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(response.Value))
+	for _, document := range response.Value {
+		id, err := strconv.ParseInt(document.ID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("index document %q has no user ID", document.ID)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// apply uploads or deletes documents, as their actions say
+func (s *searchIndex) apply(ctx context.Context, documents []searchDocument) error {
+	var response struct {
+		Value []struct {
+			Key          string `json:"key"`
+			Status       bool   `json:"status"`
+			ErrorMessage string `json:"errorMessage"`
+		} `json:"value"`
+	}
+	if err := s.call(ctx, http.MethodPost, "/indexes/"+s.name+"/docs/index", map[string]any{"value": documents}, &response); err != nil {
+		return err
+	}
+	var errs []error
+	for _, result := range response.Value {
+		if !result.Status {
+			errs = append(errs, fmt.Errorf("document %s: %s", result.Key, result.ErrorMessage))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// searchQuery turns what a client searched for into a Lucene query matching
+// every word, as typed, as a prefix, or within an edit or two of it
+func searchQuery(query string) string {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	clauses := make([]string, 0, len(words))
+	for _, word := range words {
+		clause := word + " OR " + word + "*"
+		switch n := len([]rune(word)); {
+		case n > 5:
+			clause += " OR " + word + "~2"
+		case n > 2:
+			clause += " OR " + word + "~1"
+		}
+		clauses = append(clauses, "("+clause+")")
+	}
+	if len(clauses) == 0 {
+		return "*"
+	}
+	return strings.Join(clauses, " ")
+}
+
+// searchIndexer keeps the index in step with the user events read from
+// search_index.subscription. Each event only says which user changed: the
+// indexer reads them from the store and indexes what it finds, or removes them
+// when they are gone, so events handled out of order or twice still leave the
+// index matching the database. Restoring a user publishes no event, so a
+// restored user is found by search again from their next change.
+type searchIndexer struct {
+	index *searchIndex
+	store store.UserStore
+}
+
+func (h searchIndexer) HandleMessage(ctx context.Context, msg *azservicebus.ReceivedMessage) error {
+	var user store.User
+	data, err := events.MessageData(msg)
+	if err == nil {
+		err = json.Unmarshal(data, &user)
+	}
+	if err != nil {
+		return &deadLetterError{Reason: deadLetterBadPayload, Description: err.Error()}
+	}
+	if user.ID == 0 {
+		return &deadLetterError{Reason: deadLetterBadPayload, Description: "the event names no user"}
+	}
+
+	document := searchDocument{Action: "delete", ID: strconv.FormatInt(user.ID, 10)}
+	current, err := h.store.GetUser(ctx, user.TenantID, user.ID)
+	switch {
+	case err == nil:
+		document = searchDocument{Action: "mergeOrUpload", ID: document.ID, TenantID: current.TenantID, Name: current.Name, Email: current.Email}
+	case !errors.Is(err, store.ErrUserNotFound):
+		return fmt.Errorf("failed to read the user to index: %w", err)
+	}
+	if err := h.index.apply(ctx, []searchDocument{document}); err != nil {
+		return fmt.Errorf("failed to index user: %w", err)
+	}
+	return nil
+}
+
+// runSearchIndexer indexes the user events of search_index.subscription until
+// ctx is cancelled, settling each as the consumer does
+func runSearchIndexer(ctx context.Context, client *azservicebus.Client, cfg config.Config, indexer searchIndexer) error {
+	receiver, err := client.NewReceiverForSubscription(cfg.SearchIndex.Topic, cfg.SearchIndex.Subscription, nil)
+	if err != nil {
+		return err
+	}
+	defer receiver.Close(context.Background())
+
+	slog.Info("Search indexer started", "topic", cfg.SearchIndex.Topic, "subscription", cfg.SearchIndex.Subscription, "index", indexer.index.name)
+	for {
+		messages, err := receiver.ReceiveMessages(ctx, config.ConsumerBatchSize, nil)
+		if ctx.Err() != nil {
+			slog.Info("Search indexer stopped")
+			return nil
+		}
+		if err != nil {
+			slog.Error("Error receiving user events to index", "error", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(consumerErrorBackoff):
+			}
+			continue
+		}
+		for _, msg := range messages {
+			processMessage(receiver, indexer, msg, cfg.Consumer.MaxAttempts)
+		}
+	}
+}
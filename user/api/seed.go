@@ -0,0 +1,192 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"strings"
+
+	"user/user/blob"
+	"user/user/config"
+	"user/user/store"
+)
+
+// Domain of the demo users' emails, reserved so mail to them goes nowhere
+const seedEmailDomain = "example.com"
+
+// Seed of the generator picking the demo users' names, fixed so every run
+// produces the same users
+const seedNamesSeed = 20240101
+
+// Size of a demo avatar: a 5x5 mirrored identicon on a light background
+const (
+	seedAvatarCells   = 5
+	seedAvatarCellPx  = 48
+	seedAvatarPadding = 16
+	seedAvatarFile    = "avatar.png"
+)
+
+var (
+	seedFirstNames = []string{
+		"Ada", "Alan", "Amara", "Ana", "Arjun", "Beatriz", "Chen", "Chloe", "Daniel", "Diego",
+		"Elena", "Emeka", "Fatima", "Grace", "Hana", "Hiroshi", "Ines", "Ivan", "Jamal", "Julia",
+		"Kai", "Kwame", "Lars", "Layla", "Lucas", "Maria", "Mateo", "Mei", "Nadia", "Noah",
+		"Olga", "Omar", "Priya", "Rafael", "Sakura", "Samuel", "Sofia", "Tariq", "Yara", "Zoe",
+	}
+	seedLastNames = []string{
+		"Abe", "Adeyemi", "Andersson", "Bianchi", "Costa", "Dubois", "Fischer", "Garcia", "Haddad", "Ivanova",
+		"Jensen", "Kim", "Kowalski", "Lee", "Mensah", "Moreau", "Muller", "Nakamura", "Nguyen", "Novak",
+		"Okafor", "Olsen", "Patel", "Petrov", "Rossi", "Santos", "Schmidt", "Silva", "Singh", "Tanaka",
+	}
+)
+
+// SeedUsers creates count demo users in tenant, or refreshes them if they are
+// there already, so running it again doesn't add more. The users, and with
+// avatars their generated pictures, are the same on every run.
+func SeedUsers(ctx context.Context, cfg config.Config, blobs blob.Storage, userStore store.UserStore, pictures store.PictureStore, tenant string, count int, avatars bool) error {
+	for i := 1; i <= count; i++ {
+		user := seedUser(i)
+		user.TenantID = tenant
+		if avatars {
+			if err := seedAvatar(ctx, cfg, blobs, userStore, pictures, &user); err != nil {
+				return fmt.Errorf("failed to seed the avatar of %s: %w", user.Email, err)
+			}
+		}
+		if err := userStore.UpsertUser(ctx, user); err != nil {
+			return fmt.Errorf("failed to seed %s: %w", user.Email, err)
+		}
+	}
+	slog.Info("Seeded demo users", "users", count, "tenant", tenant, "avatars", avatars)
+	return nil
+}
+
+// seedUser returns the ith demo user, whose name depends on i alone
+func seedUser(i int) store.User {
+	names := rand.New(rand.NewPCG(seedNamesSeed, uint64(i)))
+	first := seedFirstNames[names.IntN(len(seedFirstNames))]
+	last := seedLastNames[names.IntN(len(seedLastNames))]
+	return store.User{
+		Name:  first + " " + last,
+		Email: fmt.Sprintf("%s.%s.%d@%s", strings.ToLower(first), strings.ToLower(last), i, seedEmailDomain),
+	}
+}
+
+// seedAvatar gives user their generated picture, uploading it with its
+// thumbnails unless the tenant stored it already. A demo user that has a
+// picture keeps it, so seeding again takes no more references to theirs.
+func seedAvatar(ctx context.Context, cfg config.Config, blobs blob.Storage, userStore store.UserStore, pictures store.PictureStore, user *store.User) error {
+	existing, err := userStore.GetUserByEmail(ctx, user.TenantID, user.Email)
+	if err == nil && existing.Link != "" {
+		user.Link, user.ThumbnailLink, user.Thumbnails = existing.Link, existing.ThumbnailLink, existing.Thumbnails
+		return nil
+	}
+	if err != nil && !errors.Is(err, store.ErrUserNotFound) {
+		return err
+	}
+
+	data, err := identicon(user.Email)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	stored, err := pictures.AcquirePicture(ctx, user.TenantID, sum[:])
+	if err == nil {
+		photo := storedPhoto(cfg.Azure.PicturesContainer, user.TenantID, stored)
+		user.Link, user.ThumbnailLink, user.Thumbnails = photo.Link, photo.ThumbnailLink, photo.Thumbnails
+		return nil
+	}
+	if !errors.Is(err, store.ErrPictureNotFound) {
+		return err
+	}
+
+	filename := photoBlobName(user.TenantID, 0, seedAvatarFile, "image/png")
+	link, checksum, err := blob.UploadAndLink(ctx, blobs, cfg.Azure.PicturesContainer, bytes.NewReader(data), filename, seedAvatarFile, "image/png")
+	if err != nil {
+		return err
+	}
+	photo := uploadedPhoto{Link: link, Blob: filename, Checksum: checksum, Tenant: user.TenantID}
+	photo.ThumbnailLink, photo.Thumbnails, err = uploadThumbnails(ctx, blobs, bytes.NewReader(data), filename, cfg)
+	if err != nil {
+		slog.WarnContext(ctx, "Skipping thumbnail", "blob", filename, "error", err)
+	}
+	stored, added, err := pictures.AddPicture(ctx, user.TenantID, store.StoredPicture{
+		SHA256: sum[:], Blob: filename, Checksum: checksum, ThumbnailLink: photo.ThumbnailLink, Thumbnails: photo.Thumbnails,
+	})
+	if err != nil {
+		photo.deleteBlobs(ctx, blobs, cfg.Azure.PicturesContainer)
+		return err
+	}
+	if !added {
+		photo.deleteBlobs(ctx, blobs, cfg.Azure.PicturesContainer)
+		photo = storedPhoto(cfg.Azure.PicturesContainer, user.TenantID, stored)
+	}
+	user.Link, user.ThumbnailLink, user.Thumbnails = photo.Link, photo.ThumbnailLink, photo.Thumbnails
+	return nil
+}
+
+// identicon draws the PNG avatar of key: cells of its left half, mirrored to
+// the right, filled in a color of its own, all chosen by its SHA-256
+func identicon(key string) ([]byte, error) {
+	sum := sha256.Sum256([]byte(key))
+	fill := hslColor(float64(sum[0])/255*360, 0.55, 0.5)
+	background := color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+	side := seedAvatarCells*seedAvatarCellPx + 2*seedAvatarPadding
+	img := image.NewRGBA(image.Rect(0, 0, side, side))
+	for y := range side {
+		for x := range side {
+			img.Set(x, y, background)
+		}
+	}
+	for row := range seedAvatarCells {
+		for col := range (seedAvatarCells + 1) / 2 {
+			if sum[1+row*3+col]&1 == 0 {
+				continue
+			}
+			for _, c := range []int{col, seedAvatarCells - 1 - col} {
+				x0, y0 := seedAvatarPadding+c*seedAvatarCellPx, seedAvatarPadding+row*seedAvatarCellPx
+				for y := y0; y < y0+seedAvatarCellPx; y++ {
+					for x := x0; x < x0+seedAvatarCellPx; x++ {
+						img.Set(x, y, fill)
+					}
+				}
+			}
+		}
+	}
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// hslColor converts a hue in degrees, saturation and lightness to RGB
+func hslColor(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g = c, x
+	case h < 120:
+		r, g = x, c
+	case h < 180:
+		g, b = c, x
+	case h < 240:
+		g, b = x, c
+	case h < 300:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	return color.RGBA{R: uint8((r + m) * 255), G: uint8((g + m) * 255), B: uint8((b + m) * 255), A: 0xff}
+}
@@ -0,0 +1,612 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+
+	"user/user/blob"
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+)
+
+// ServerDeps is what a Server runs on: the stores, opened and wrapped by main
+// as every subcommand uses them, blob storage, the event publisher and the
+// upload scanner, and the watchers of settings that change while running
+type ServerDeps struct {
+	DB         *sql.DB      // Nil with the in-memory store
+	Stores     store.Stores // The stores of database.driver, unwrapped
+	Users      store.UserStore
+	Audit      store.AuditStore
+	Pictures   store.PictureStore
+	Outbox     store.OutboxStore
+	Blobs      blob.Storage
+	Events     events.Publisher
+	ServiceBus *azservicebus.Client // Nil unless azure.service_bus_driver is azure
+	Scanner    Scanner
+	Secrets    *SecretsProvider
+	AppConfig  *AppConfigWatcher
+}
+
+// Server is what the serve subcommand runs: the HTTP API, with gRPC and
+// GraphQL on its routes, and the background workers
+type Server struct {
+	config    config.Config
+	deps      ServerDeps
+	router    *mux.Router
+	cors      *liveCORS
+	webhooks  *webhookDispatcher
+	stream    *eventStream
+	creations *creationQueue
+	searchIdx *searchIndex
+	notifier  *lifecycleNotifier
+	scheduler *scheduler
+}
+
+// handler serves the API routes. New gives it the stores and clients of
+// ServerDeps and the services built over them, so the handlers reach nothing
+// but what they are given.
+type handler struct {
+	config       config.Config
+	users        store.UserStore
+	pictures     store.PictureStore
+	audit        store.AuditStore
+	credentials  store.CredentialStore
+	importJobs   store.ImportJobStore
+	apiKeys      store.APIKeyStore
+	groups       store.GroupStore
+	activities   store.ActivityStore
+	webhookStore store.WebhookStore
+	suppressions store.MailSuppressionStore
+	blobs        blob.Storage
+	events       events.Publisher
+	serviceBus   *azservicebus.Client
+	scanner      Scanner
+	links        pictureLinks
+	sessions     *sessionManager // Nil without auth.sessions.secret
+	jwts         *jwtVerifier    // Nil without an identity provider
+	providers    map[string]*oauthProvider
+	guard        *bruteForceGuard
+	webhooks     *webhookDispatcher
+	verifier     *emailVerifier    // Nil without verification emails
+	resetter     *passwordResetter // Nil without password reset emails
+	creations    *creationQueue
+	searchIdx    *searchIndex // Nil without Azure AI Search
+	stream       *eventStream
+	retention    *retentionPolicy
+	emailLookups *clientRateLimiter
+	settings     *AppConfigWatcher // The settings in effect, for feature flags
+}
+
+// New sets up the routes and the workers' dependencies over deps,
+// listening on nothing until Run
+func New(cfg config.Config, deps ServerDeps) *Server {
+	backend, userStore, audit, pictures, appConfig := deps.Stores, deps.Users, deps.Audit, deps.Pictures, deps.AppConfig
+	// Searches are answered by Azure AI Search when it is configured
+	searchIdx := newSearchIndex(cfg)
+	if searchIdx != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), config.Seconds(cfg.SearchIndex.TimeoutSeconds))
+		if err := searchIdx.ensure(ctx); err != nil {
+			slog.Warn("Failed to set up the search index; searches go to the database until it answers", "index", cfg.SearchIndex.Index, "error", err)
+		}
+		cancel()
+	}
+
+	// Webhook notifications to the configured URLs and the registered webhooks,
+	// delivered in the background
+	var webhookStore store.WebhookStore = store.TracedWebhookStore{Next: backend.Webhooks}
+	// The same events stream to GET /events, from here or from Service Bus
+	stream := newEventStream(cfg)
+	var internalStream *eventStream
+	if cfg.EventStream.Source == config.EventSourceInternal {
+		internalStream = stream
+	}
+	webhooks := newWebhookDispatcher(cfg, webhookStore, internalStream)
+	// Email verification links, sent to new users and changed emails, and
+	// password reset links
+	mailer := newMailer(cfg)
+	verifier := newEmailVerifier(cfg, mailer)
+	resetter := newPasswordResetter(cfg, store.TracedPasswordResetStore{Next: backend.PasswordResets}, userStore, mailer)
+	// Welcome and profile change emails, sent for the events the outbox publishes
+	var suppressions store.MailSuppressionStore = store.TracedMailSuppressionStore{Next: backend.Suppressions}
+	notifier := newLifecycleNotifier(cfg, mailer, suppressions)
+	// retention.rules, applied by the retention job and on demand
+	retention := newRetentionPolicy(cfg, deps, webhooks)
+
+	// Define routes
+	r := mux.NewRouter()
+	r.NotFoundHandler = unmatchedRoute(r)
+	r.MethodNotAllowedHandler = r.NotFoundHandler
+	r.Use(requestIDMiddleware(cfg.Server.RequireRequestID))
+	r.Use(tracingMiddleware)
+	r.Use(loggingMiddleware(newAccessLogger(cfg)))
+	r.Use(recoveryMiddleware)
+	r.Use(shedBeyond(requestClassAll, cfg.Server.MaxInFlightRequests))
+	r.Use(maxBodyMiddleware(cfg.Server.MaxBodyBytes))
+	routeTimeouts := map[string]time.Duration{}
+	for route, timeout := range cfg.Server.RouteTimeouts {
+		routeTimeouts[route] = config.Seconds(timeout)
+	}
+	r.Use(routeTimeoutMiddleware(config.Seconds(cfg.Server.RequestTimeoutSeconds), routeTimeouts))
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", healthz).Methods("GET")
+	r.HandleFunc("/livez", healthz).Methods("GET")
+	r.HandleFunc("/readyz", readyz(readinessChecks(cfg, deps))).Methods("GET")
+	r.HandleFunc("/openapi.json", serveOpenAPISpec(mustMarshalSpec())).Methods("GET")
+	r.HandleFunc("/docs", serveDocs).Methods("GET")
+
+	// User routes, rate limited and behind bearer auth when there are credentials to check
+	var jwts *jwtVerifier
+	switch {
+	case cfg.Auth.Entra.TenantID != "":
+		jwts = newEntraVerifier(cfg)
+	case cfg.Auth.JWT.JWKSURL != "":
+		jwts = newJWTVerifier(cfg)
+	}
+	var sessions *sessionManager
+	if cfg.Auth.Sessions.Secret != "" {
+		sessions = newSessionManager(cfg, store.TracedSessionStore{Next: backend.Sessions}, store.TracedTwoFactorStore{Next: backend.TwoFactor})
+	}
+	var apiKeys store.APIKeyStore = store.TracedAPIKeyStore{Next: backend.APIKeys}
+	var groups store.GroupStore = store.TracedGroupStore{Next: backend.Groups}
+	var credentials store.CredentialStore = store.TracedCredentialStore{Next: backend.Credentials}
+	var importJobs store.ImportJobStore = store.TracedImportJobStore{Next: backend.ImportJobs}
+	var activities store.ActivityStore = store.TracedActivityStore{Next: backend.Activities}
+	guard := newBruteForceGuard(cfg, store.TracedAuthFailureStore{Next: backend.AuthFailures}, userStore)
+	h := &handler{
+		config:       cfg,
+		users:        userStore,
+		pictures:     pictures,
+		audit:        audit,
+		credentials:  credentials,
+		importJobs:   importJobs,
+		apiKeys:      apiKeys,
+		groups:       groups,
+		activities:   activities,
+		webhookStore: webhookStore,
+		suppressions: suppressions,
+		blobs:        deps.Blobs,
+		events:       deps.Events,
+		serviceBus:   deps.ServiceBus,
+		scanner:      deps.Scanner,
+		links:        newPictureLinks(cfg),
+		sessions:     sessions,
+		jwts:         jwts,
+		providers:    newOAuthProviders(cfg),
+		guard:        guard,
+		webhooks:     webhooks,
+		verifier:     verifier,
+		resetter:     resetter,
+		searchIdx:    searchIdx,
+		stream:       stream,
+		retention:    retention,
+		emailLookups: newClientRateLimiter(rate.Limit(cfg.EmailLookup.RequestsPerMinute/60), cfg.EmailLookup.Burst, rateLimiterIdleTTL),
+		settings:     appConfig,
+	}
+	auth := bearerAuthMiddleware(authenticators{
+		apiKeys:    cfg.Auth.APIKeys,
+		adminKeys:  cfg.Auth.AdminAPIKeys,
+		tenantKeys: cfg.Auth.TenantAPIKeys,
+		jwts:       jwts,
+		managed:    newAPIKeyVerifier(apiKeys),
+		sessions:   sessions,
+		guard:      guard,
+	})
+	// Every route authorized like /users checks credentials once there are any
+	// to check: configured keys, an identity provider, sessions or managed keys
+	authEnabled := len(cfg.Auth.APIKeys) > 0 || len(cfg.Auth.AdminAPIKeys) > 0 || len(cfg.Auth.TenantAPIKeys) > 0 ||
+		jwts != nil || sessions != nil || managedAPIKeysExist(apiKeys)
+	// API routes live under /v1; legacyPathShim still serves them unversioned
+	v1 := apiVersionRouter(r, apiV1)
+	users := v1.PathPrefix("/users").Subrouter()
+	// Rate limits count verified callers by their credential, so they come
+	// after authentication; the rest are counted by IP
+	limits := newRateLimits(cfg, store.TracedRateLimitStore{Next: backend.RateLimits})
+	users.Use(guard.middleware)
+	if authEnabled {
+		users.Use(auth, requireScopes)
+	} else {
+		slog.Warn("No API keys, identity provider or sessions configured, /users is unauthenticated")
+	}
+	users.Use(rateLimitMiddleware(limits))
+	users.Use(tenantMiddleware(cfg))
+	users.Use(authorizeMiddleware(userStore))
+
+	// Uploads and exports outlast the server-wide read/write timeouts, and uploads
+	// may carry a larger body than the global limit, with a cap of their own on
+	// how many run at once
+	longRunning := extendDeadlines(config.Seconds(cfg.Server.UploadTimeoutSeconds))
+	shedUploads := shedBeyond(requestClassUpload, cfg.Server.MaxInFlightUploads)
+	upload := func(h http.Handler) http.Handler {
+		return longRunning(shedUploads(raiseBodyLimit(cfg.Server.MaxUploadBytes)(h)))
+	}
+
+	// Listings, searches, counts and reads of a user may lag behind writes by the
+	// replica's delay, when there is a replica
+	users.Handle("", store.ReadFromReplica(http.HandlerFunc(h.getUsers))).Methods("GET")
+	// Retried creates with the same Idempotency-Key get the first response back;
+	// a request may hold its key as long as an upload may take
+	idempotent := idempotencyMiddleware(store.TracedIdempotencyStore{Next: backend.Idempotency},
+		time.Duration(cfg.Idempotency.TTLHours)*time.Hour, config.Seconds(cfg.Server.UploadTimeoutSeconds))
+	// Heavy creations may be left to the creation workers, with Prefer: respond-async
+	var creationJobs store.CreationJobStore = store.TracedCreationJobStore{Next: backend.CreationJobs}
+	creations := newCreationQueue(cfg, creationJobs, h.createUserFrom)
+	h.creations = creations
+	users.Handle("", upload(idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if prefersAsync(r) && h.settings.featureEnabled(r.Context(), featureAsyncCreation) {
+			h.createUserAsync(w, r)
+			return
+		}
+		h.createUser(w, r)
+	})))).Methods("POST")
+	users.Handle("/bulk", longRunning(http.HandlerFunc(h.bulkCreateUsers))).Methods("POST")
+	// CSV imports stream in, however long that takes, up to their own body limit
+	users.Handle("/import", longRunning(raiseBodyLimit(cfg.Bulk.MaxImportBytes)(http.HandlerFunc(h.importUsers)))).Methods("POST")
+	users.HandleFunc("/import", h.listImportJobs).Methods("GET")
+	users.HandleFunc("/import/{id:[0-9]+}", h.getImportJob).Methods("GET")
+	users.Handle("/search", store.ReadFromReplica(http.HandlerFunc(h.searchUsers))).Methods("GET")
+	users.Handle("/count", store.ReadFromReplica(http.HandlerFunc(h.countUsers))).Methods("GET")
+	users.HandleFunc("/exists", h.checkEmailsExist).Methods("POST")
+	users.Handle("/export", longRunning(http.HandlerFunc(h.exportUsers))).Methods("GET")
+	users.Handle("/{id:[0-9]+}", store.ReadFromReplica(http.HandlerFunc(h.getUser))).Methods("GET")
+	users.HandleFunc("/by-email/{email}", h.upsertUserByEmail).Methods("PUT")
+	users.Handle("/{id:[0-9]+}", upload(http.HandlerFunc(h.replaceUser))).Methods("PUT")
+	users.HandleFunc("/{id:[0-9]+}", h.patchUser).Methods("PATCH")
+	users.HandleFunc("/{id:[0-9]+}", h.deleteUser).Methods("DELETE")
+	users.Handle("/{id:[0-9]+}/export", longRunning(http.HandlerFunc(h.exportUserData))).Methods("GET")
+	users.HandleFunc("/{id:[0-9]+}/personal-data", h.erasePersonalData).Methods("DELETE")
+	users.HandleFunc("/{id:[0-9]+}/groups", h.listUserGroups).Methods("GET")
+	users.Handle("/{id:[0-9]+}/activity", store.ReadFromReplica(http.HandlerFunc(h.listUserActivity))).Methods("GET")
+	users.HandleFunc("/{id:[0-9]+}/touch", h.touchUser).Methods("POST")
+	users.HandleFunc("/{id:[0-9]+}/restore", h.restoreUser).Methods("POST")
+	users.HandleFunc("/{id:[0-9]+}/unlock", h.unlockUser).Methods("POST")
+	users.HandleFunc("/{id:[0-9]+}/photo/sas", h.getPhotoSAS).Methods("GET")
+	users.Handle("/{id:[0-9]+}/photo", longRunning(http.HandlerFunc(h.getUserPhoto))).Methods("GET", "HEAD")
+	users.Handle("/{id:[0-9]+}/photo", upload(http.HandlerFunc(h.updateUserPhoto))).Methods("PUT", "POST")
+	// Chunked uploads, for clients that need to resume; each chunk is an upload of its own
+	users.HandleFunc("/{id:[0-9]+}/photo/uploads", h.startPhotoUpload).Methods("POST")
+	users.HandleFunc("/{id:[0-9]+}/photo/uploads/{upload:[0-9a-f]{32}}", h.getPhotoUpload).Methods("GET")
+	users.Handle("/{id:[0-9]+}/photo/uploads/{upload:[0-9a-f]{32}}/chunks/{index:[0-9]+}", upload(http.HandlerFunc(h.uploadPhotoChunk))).Methods("PUT")
+	users.Handle("/{id:[0-9]+}/photo/uploads/{upload:[0-9a-f]{32}}/commit", longRunning(http.HandlerFunc(h.commitPhotoUpload))).Methods("POST")
+	users.HandleFunc("/{id:[0-9]+}/password", h.setPassword).Methods("PUT")
+
+	// Bulk creation in the custom method style, which mux can't route under the
+	// /users prefix, so it repeats the /users middleware. It is idempotent so
+	// integrators can retry a batch.
+	batchRoutes := v1.Path("/users:batch").Subrouter()
+	batchRoutes.Use(guard.middleware)
+	if authEnabled {
+		batchRoutes.Use(auth, requireScopes)
+	}
+	batchRoutes.Use(rateLimitMiddleware(limits))
+	batchRoutes.Use(tenantMiddleware(cfg), authorizeMiddleware(userStore))
+	batchRoutes.Handle("", longRunning(idempotent(http.HandlerFunc(h.bulkCreateUsers)))).Methods("POST")
+
+	// Creation jobs, polled by whoever may create users
+	jobRoutes := v1.PathPrefix("/jobs").Subrouter()
+	jobRoutes.Use(guard.middleware)
+	if authEnabled {
+		jobRoutes.Use(auth, requireScopes)
+	}
+	jobRoutes.Use(rateLimitMiddleware(limits))
+	jobRoutes.Use(tenantMiddleware(cfg), authorizeMiddleware(userStore))
+	jobRoutes.HandleFunc("/{job:[0-9]+}", h.getCreationJob).Methods("GET")
+
+	// Live user events, authorized like the /users listing
+	eventRoutes := v1.PathPrefix("/events").Subrouter()
+	eventRoutes.Use(guard.middleware)
+	if authEnabled {
+		eventRoutes.Use(auth, requireScopes)
+	}
+	eventRoutes.Use(rateLimitMiddleware(limits))
+	eventRoutes.Use(tenantMiddleware(cfg), authorizeMiddleware(userStore))
+	// The stream stays open as long as the client listens
+	eventRoutes.Handle("", withTimeout(0)(http.HandlerFunc(h.streamEvents))).Methods("GET")
+
+	// Auth routes, open to anyone and so rate limited
+	authRoutes := v1.PathPrefix("/auth").Subrouter()
+	authRoutes.Use(rateLimitMiddleware(limits), guard.middleware)
+	if resetter != nil {
+		authRoutes.Handle("/forgot-password", tenantMiddleware(cfg)(http.HandlerFunc(h.forgotPassword))).Methods("POST")
+		authRoutes.HandleFunc("/reset-password", h.resetPassword).Methods("POST")
+	}
+
+	// Session routes, exchanging an identity provider token, a password or a
+	// social login for this service's own tokens, and two-factor enrollment,
+	// which needs sessions to ask for the codes
+	if sessions != nil {
+		users.HandleFunc("/{id:[0-9]+}/2fa", h.enrollTwoFactor).Methods("POST")
+		users.HandleFunc("/{id:[0-9]+}/2fa/confirm", h.confirmTwoFactor).Methods("POST")
+
+		// The tenant tells which user is signing in, for their password and two-factor setting
+		authRoutes.Handle("/login", tenantMiddleware(cfg)(http.HandlerFunc(h.login))).Methods("POST")
+		authRoutes.HandleFunc("/2fa", h.verifyTwoFactor).Methods("POST")
+		if len(h.providers) > 0 {
+			authRoutes.HandleFunc("/{provider}/login", h.oauthLogin).Methods("GET")
+			authRoutes.HandleFunc("/{provider}/callback", h.oauthCallback).Methods("GET")
+		}
+		authRoutes.HandleFunc("/refresh", h.refreshSession).Methods("POST")
+		authRoutes.HandleFunc("/logout", h.logout).Methods("POST")
+	}
+
+	// Admin routes, restricted to admin API keys and JWTs with the admin role
+	admin := v1.PathPrefix("/admin").Subrouter()
+	admin.Use(guard.middleware, auth)
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/api-keys", h.listAPIKeys).Methods("GET")
+	admin.HandleFunc("/api-keys", h.createAPIKey).Methods("POST")
+	admin.HandleFunc("/api-keys/{id:[0-9]+}", h.revokeAPIKey).Methods("DELETE")
+	admin.HandleFunc("/deadletters", h.listDeadLetters).Methods("GET")
+	admin.Handle("/deadletters", longRunning(http.HandlerFunc(h.purgeDeadLettersHandler))).Methods("DELETE")
+	admin.Handle("/deadletters/requeue", longRunning(http.HandlerFunc(h.requeueDeadLettersHandler))).Methods("POST")
+	admin.HandleFunc("/deadletters/{sequence:[0-9]+}", h.getDeadLetterHandler).Methods("GET")
+	admin.Handle("/deadletters/{sequence:[0-9]+}", longRunning(http.HandlerFunc(h.purgeDeadLettersHandler))).Methods("DELETE")
+	admin.Handle("/deadletters/{sequence:[0-9]+}/requeue", longRunning(http.HandlerFunc(h.requeueDeadLettersHandler))).Methods("POST")
+	admin.Handle("/cleanup-blobs", longRunning(http.HandlerFunc(h.cleanupBlobs))).Methods("POST")
+	admin.Handle("/retention", longRunning(http.HandlerFunc(h.enforceRetention))).Methods("POST")
+	admin.HandleFunc("/mail/suppressions", h.listMailSuppressions).Methods("GET")
+	admin.HandleFunc("/mail/suppressions/{email}", h.suppressEmail).Methods("PUT")
+	admin.HandleFunc("/mail/suppressions/{email}", h.unsuppressEmail).Methods("DELETE")
+
+	// Verification links are opened straight from an email, so carry no credentials
+	if verifier != nil {
+		v1.HandleFunc("/verify", h.verifyEmail).Methods("GET")
+	}
+
+	// Groups model org structure, so only admins shape them; members can list
+	// their own through /users/{id}/groups
+	groupRoutes := v1.PathPrefix("/groups").Subrouter()
+	groupRoutes.Use(guard.middleware, auth)
+	groupRoutes.Use(requireAdmin, tenantMiddleware(cfg))
+	groupRoutes.HandleFunc("", h.createGroup).Methods("POST")
+	groupRoutes.HandleFunc("/{id:[0-9]+}/members", h.addGroupMember).Methods("POST")
+
+	// Webhook registrations, an admin's to make for their tenant
+	webhookRoutes := v1.PathPrefix("/webhooks").Subrouter()
+	webhookRoutes.Use(guard.middleware, auth)
+	webhookRoutes.Use(requireAdmin, tenantMiddleware(cfg))
+	webhookRoutes.HandleFunc("", h.createWebhook).Methods("POST")
+	webhookRoutes.HandleFunc("", h.listWebhooks).Methods("GET")
+	webhookRoutes.HandleFunc("/{id:[0-9]+}", h.deleteWebhook).Methods("DELETE")
+	webhookRoutes.HandleFunc("/{id:[0-9]+}/deliveries", h.listWebhookAttempts).Methods("GET")
+
+	// The audit log, which like the admin routes spans every tenant
+	auditRoutes := v1.PathPrefix("/audit").Subrouter()
+	auditRoutes.Use(guard.middleware, auth)
+	auditRoutes.Use(requireAdmin)
+	auditRoutes.HandleFunc("", h.listAuditEvents).Methods("GET")
+
+	// GraphQL resolves each field through the /v1 routes above, which
+	// authenticate and authorize it, so it needs no auth of its own
+	graphQL := newGraphQLSchema(cfg, r)
+	r.Handle("/graphql", upload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGraphQL(w, r, graphQL)
+	}))).Methods("POST")
+
+	// Create a new CORS handler
+	corsHandler := newLiveCORS(cfg)
+	appConfig.onChange(corsHandler.update)
+	appConfig.onChange(limits.update)
+
+	return &Server{
+		config:    cfg,
+		deps:      deps,
+		router:    r,
+		cors:      corsHandler,
+		webhooks:  webhooks,
+		stream:    stream,
+		creations: creations,
+		searchIdx: searchIdx,
+		notifier:  notifier,
+		scheduler: newScheduler(cfg, store.TracedJobRunStore{Next: backend.JobRuns}, registeredJobs(cfg, deps, notifier, retention)),
+	}
+}
+
+// Run serves the APIs and runs the workers until ctx is done or a server
+// fails, then shuts down gracefully, returning the failure if there was one.
+// The workers run on until the requests in flight are done, since those still
+// queue creations and write to the outbox.
+func (s *Server) Run(ctx context.Context) error {
+	workCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	// Optionally persist the events we publish
+	var workers sync.WaitGroup
+	for range s.config.Webhooks.Workers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.webhooks.run(workCtx)
+		}()
+	}
+	if s.config.EventStream.Source == config.EventSourceServiceBus {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			if err := runEventFeed(workCtx, s.deps.ServiceBus, s.config, s.stream); err != nil {
+				slog.Error("Event stream feed failed", "error", err)
+			}
+		}()
+	}
+	if s.config.Consumer.Enabled {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			if err := runConsumer(workCtx, s.deps.ServiceBus, s.config, userEventHandler{store: s.deps.Users}); err != nil {
+				slog.Error("Service Bus consumer failed", "error", err)
+			}
+		}()
+	}
+	if s.searchIdx != nil && s.config.SearchIndex.Subscription != "" {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			if err := runSearchIndexer(workCtx, s.deps.ServiceBus, s.config, searchIndexer{index: s.searchIdx, store: s.deps.Users}); err != nil {
+				slog.Error("Search indexer failed", "error", err)
+			}
+		}()
+	}
+	if s.config.Deletion.RetentionDays > 0 && !s.scheduler.scheduled(jobPurge) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			runPurge(workCtx, s.deps.Blobs, s.deps.Users, s.deps.Pictures, s.config.Azure.PicturesContainer, time.Duration(s.config.Deletion.RetentionDays)*24*time.Hour)
+		}()
+	}
+	if !s.scheduler.scheduled(jobOutboxDispatch) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			runOutboxDispatcher(workCtx, s.deps.Events, s.deps.Outbox, s.notifier)
+		}()
+	}
+	// Apart from the other workers, as the outbox is flushed to it after they stop
+	var senders sync.WaitGroup
+	if s.notifier != nil {
+		for range s.config.Mail.Notifications.Workers {
+			senders.Add(1)
+			go func() {
+				defer senders.Done()
+				s.notifier.run(workCtx)
+			}()
+		}
+	}
+	for range s.config.AsyncCreation.Workers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.creations.run(workCtx)
+		}()
+	}
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		s.deps.AppConfig.run(workCtx, time.Duration(s.config.AppConfiguration.RefreshSeconds)*time.Second)
+	}()
+	if s.config.KeyVault.RefreshMinutes > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.deps.Secrets.run(workCtx, time.Duration(s.config.KeyVault.RefreshMinutes)*time.Minute)
+		}()
+	}
+	if s.config.BlobCleanup.IntervalMinutes > 0 && !s.scheduler.scheduled(jobBlobCleanup) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			runBlobCleanup(workCtx, s.deps.Blobs, s.deps.Users, s.deps.Pictures, s.config.Azure.PicturesContainer, time.Duration(s.config.BlobCleanup.IntervalMinutes)*time.Minute, s.config.BlobCleanup.DryRun)
+		}()
+	}
+	if s.scheduler != nil {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.scheduler.run(workCtx)
+		}()
+	}
+
+	// Start server with CORS middleware. Responses are compressed here rather
+	// than on the router, which gRPC and GraphQL reuse internally.
+	handler := legacyPathShim(s.router)
+	if s.config.Server.CompressMinBytes > 0 {
+		handler = compressionMiddleware(s.config.Server.CompressMinBytes)(handler)
+	}
+	server := &http.Server{
+		Addr:              s.config.Server.Addr,
+		Handler:           s.cors.Handler(handler),
+		ReadHeaderTimeout: config.Seconds(s.config.Server.ReadHeaderTimeoutSeconds),
+		ReadTimeout:       config.Seconds(s.config.Server.ReadTimeoutSeconds),
+		WriteTimeout:      config.Seconds(s.config.Server.WriteTimeoutSeconds),
+		IdleTimeout:       config.Seconds(s.config.Server.IdleTimeoutSeconds),
+		MaxHeaderBytes:    s.config.Server.MaxHeaderBytes,
+	}
+	server.RegisterOnShutdown(s.stream.close)
+	// Each server reports at most one failure, so sending never blocks
+	failed := make(chan error, 3)
+	redirect := configureTransport(s.config, server)
+	go func() {
+		slog.Info("Starting server", "addr", server.Addr, "tls", server.TLSConfig != nil)
+		if err := serve(s.config, server); !errors.Is(err, http.ErrServerClosed) {
+			failed <- fmt.Errorf("server stopped: %w", err)
+		}
+	}()
+	if redirect != nil {
+		go func() {
+			slog.Info("Redirecting plain HTTP to HTTPS", "addr", redirect.Addr)
+			if err := redirect.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				failed <- fmt.Errorf("HTTPS redirect stopped: %w", err)
+			}
+		}()
+	}
+
+	// The gRPC API serves the same /v1 routes, so it skips CORS and the legacy paths
+	var grpcServer *grpc.Server
+	if addr := s.config.Server.GRPCAddr; addr != "" {
+		tlsConfig, err := grpcTLSConfig(s.config, server)
+		if err != nil {
+			failed <- fmt.Errorf("loading the TLS certificate for gRPC: %w", err)
+		} else if listener, err := net.Listen("tcp", addr); err != nil {
+			failed <- fmt.Errorf("listening for gRPC on %s: %w", addr, err)
+		} else {
+			grpcServer = newGRPCServer(s.config, s.router, tlsConfig)
+			go func() {
+				slog.Info("Starting gRPC server", "addr", addr, "tls", tlsConfig != nil)
+				if err := grpcServer.Serve(listener); err != nil {
+					failed <- fmt.Errorf("gRPC server stopped: %w", err)
+				}
+			}()
+		}
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down", "timeout", config.Seconds(s.config.Server.ShutdownTimeoutSeconds))
+	case err = <-failed:
+		slog.Error("Shutting down after a server failed", "timeout", config.Seconds(s.config.Server.ShutdownTimeoutSeconds), "error", err)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Seconds(s.config.Server.ShutdownTimeoutSeconds))
+	defer cancel()
+	// Stop accepting connections and let the requests in flight finish, cutting
+	// off whatever is still running at the deadline
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Requests still in flight at the shutdown deadline, closing their connections", "error", err)
+		server.Close()
+	}
+	if redirect != nil {
+		redirect.Shutdown(shutdownCtx)
+	}
+	if grpcServer != nil {
+		stopGRPCServer(shutdownCtx, grpcServer)
+	}
+	stopWorkers()
+	s.webhooks.close()
+	workers.Wait()
+	// Relay what the last requests wrote rather than leave it to another instance;
+	// the Service Bus and database connections close once main returns
+	flushOutbox(shutdownCtx, s.deps.Events, s.deps.Outbox, s.notifier)
+	// The emails of those events go out too, though no longer retried
+	s.notifier.close()
+	senders.Wait()
+	return err
+}
+
+// ValidateConfig validates the configuration with the checks of the settings
+// each feature reads
+func ValidateConfig(cfg config.Config) error {
+	return config.Validate(cfg, blob.ConfigProblems, events.ConfigProblems, tenancyProblems, corsProblems,
+		featureProblems, schedulerProblems, retentionProblems, templateProblems, proxyProblems)
+}
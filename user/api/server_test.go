@@ -0,0 +1,203 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+
+	"user/user/blob"
+	"user/user/config"
+	"user/user/events"
+	"user/user/fakes"
+	"user/user/resilience"
+	"user/user/store"
+)
+
+// newTestServer builds the server as main does over the in-memory stores,
+// with blobs and publisher in place of Azure
+func newTestServer(t *testing.T, cfg config.Config, blobs *fakes.BlobStorage, publisher *fakes.Publisher) (*Server, store.Stores) {
+	t.Helper()
+	backend := store.NewMemoryStores()
+	return newTestServerOver(t, cfg, backend, blobs, publisher), backend
+}
+
+// newTestServerOver builds the server over backend, which may already hold
+// what the server reads at startup
+func newTestServerOver(t *testing.T, cfg config.Config, backend store.Stores, blobs *fakes.BlobStorage, publisher *fakes.Publisher) *Server {
+	t.Helper()
+	cfg.Database.Driver = config.DatabaseDriverMemory
+	resilience.Setup(cfg)
+	resilience.SetupBulkheads(cfg)
+	appConfig, err := NewAppConfigWatcher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blob.EnsureContainers(context.Background(), cfg, blobs); err != nil {
+		t.Fatal(err)
+	}
+	return New(cfg, ServerDeps{
+		Stores:    backend,
+		Users:     backend.Users,
+		Audit:     backend.Audit,
+		Pictures:  backend.Pictures,
+		Outbox:    backend.Outbox,
+		Blobs:     blobs,
+		Events:    publisher,
+		Scanner:   NewScanner(cfg),
+		AppConfig: appConfig,
+	})
+}
+
+// testPNG returns a small PNG, base64 encoded as photo_base64 takes it
+func testPNG(t *testing.T) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestCreateUserWithPhoto(t *testing.T) {
+	tests := []struct {
+		name      string
+		uploadErr error
+		sendErr   error
+		status    int
+		stored    bool // Whether the user and picture are stored
+		published bool // Whether user.created reaches the user queue
+	}{
+		{name: "created", status: http.StatusOK, stored: true, published: true},
+		{name: "upload fails", uploadErr: errors.New("storage unavailable"), status: http.StatusInternalServerError},
+		// The user is committed with its event, which waits in the outbox for the next send
+		{name: "publish fails", sendErr: errors.New("namespace unavailable"), status: http.StatusOK, stored: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blobs := fakes.NewBlobStorage()
+			var cfg config.Config
+			config.ApplyDefaults(&cfg)
+			publisher := fakes.NewPublisher(cfg)
+			server, backend := newTestServer(t, cfg, blobs, publisher)
+			blobs.UploadErr, publisher.SendErr = tt.uploadErr, tt.sendErr
+
+			body := `{"name":"Bob","email":"bob@example.com","photo_filename":"bob.png","photo_base64":"` + testPNG(t) + `"}`
+			rec := serveTest(server.router, http.MethodPost, "/v1/users", "application/json", body, nil)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+
+			users, err := backend.Users.ListUsers(context.Background(), "", store.UserFilter{}, store.UserSort{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored := len(users) == 1; stored != tt.stored {
+				t.Fatalf("user stored = %v, want %v", stored, tt.stored)
+			}
+			if pictures := blobs.Names(cfg.Azure.PicturesContainer); (len(pictures) == 1) != tt.stored {
+				t.Errorf("pictures = %v, want one stored = %v", pictures, tt.stored)
+			}
+			if tt.stored {
+				picture := blobs.Names(cfg.Azure.PicturesContainer)[0]
+				if users[0].Link != blob.Link(cfg.Azure.PicturesContainer, picture) {
+					t.Errorf("link = %q, want the stored picture %s", users[0].Link, picture)
+				}
+				if len(blobs.Names(blob.ThumbnailsContainer)) == 0 {
+					t.Error("no thumbnails stored")
+				}
+			}
+
+			flushOutbox(context.Background(), publisher, backend.Outbox, server.notifier)
+			sent := publisher.Sent(config.UserQueueName)
+			if published := len(sent) == 1; published != tt.published {
+				t.Fatalf("%d messages on %s, want published = %v", len(sent), config.UserQueueName, tt.published)
+			}
+			if tt.published && sent[0].ApplicationProperties["eventType"] != events.UserCreated {
+				t.Errorf("event type = %v, want %s", sent[0].ApplicationProperties["eventType"], events.UserCreated)
+			}
+		})
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name     string
+		checkErr error
+		status   int
+	}{
+		{name: "ready", status: http.StatusOK},
+		{name: "service bus down", checkErr: errors.New("namespace unavailable"), status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config.Config
+			config.ApplyDefaults(&cfg)
+			publisher := fakes.NewPublisher(cfg)
+			publisher.CheckErr = tt.checkErr
+			server, _ := newTestServer(t, cfg, fakes.NewBlobStorage(), publisher)
+
+			rec := serveTest(server.router, http.MethodGet, "/readyz", "", "", nil)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	tests := []struct {
+		name       string
+		configure  func(cfg *config.Config)
+		managedKey bool // Whether an unrevoked managed key is stored
+		status     int
+	}{
+		{name: "nothing to check", configure: func(cfg *config.Config) {}, status: http.StatusOK},
+		{name: "api key", configure: func(cfg *config.Config) { cfg.Auth.APIKeys = []string{"key"} }, status: http.StatusUnauthorized},
+		// Social logins issue sessions with nothing else configured
+		{name: "sessions", configure: func(cfg *config.Config) {
+			cfg.Auth.Sessions.Secret = strings.Repeat("s", 32)
+			cfg.OAuth.BaseURL = "https://users.example.com"
+			cfg.OAuth.Providers = map[string]config.OAuthProviderConfig{config.OAuthProviderGitHub: {ClientID: "id", ClientSecret: "secret"}}
+		}, status: http.StatusUnauthorized},
+		{name: "managed key", configure: func(cfg *config.Config) {}, managedKey: true, status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config.Config
+			config.ApplyDefaults(&cfg)
+			tt.configure(&cfg)
+			backend := store.NewMemoryStores()
+			if tt.managedKey {
+				key := store.APIKey{Name: "service", Prefix: "usk_service", Scopes: apiKeyScopes}
+				if _, err := backend.APIKeys.CreateAPIKey(context.Background(), key, hashToken(apiKeyPrefix+"service")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			server := newTestServerOver(t, cfg, backend, fakes.NewBlobStorage(), fakes.NewPublisher(cfg))
+
+			rec := serveTest(server.router, http.MethodGet, "/v1/users", "", "", nil)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusUnauthorized {
+				return
+			}
+			// The routes authorized like /users are behind the same auth
+			for _, route := range []struct{ method, path string }{
+				{http.MethodPost, "/v1/users:batch"},
+				{http.MethodGet, "/v1/jobs/1"},
+				{http.MethodGet, "/v1/events"},
+			} {
+				if rec := serveTest(server.router, route.method, route.path, "application/json", "", nil); rec.Code != http.StatusUnauthorized {
+					t.Errorf("%s %s status = %d, want %d: %s", route.method, route.path, rec.Code, http.StatusUnauthorized, rec.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+// Claim of access tokens naming the tenant of their session
+const sessionTenantClaim = "tenant"
+
+// Refresh tokens are random, like managed API keys, and only stored hashed
+const (
+	refreshTokenPrefix      = "usr_"
+	refreshTokenRandomBytes = 32
+)
+
+// Response of /auth/login, /auth/refresh and /auth/2fa
+type sessionTokens struct {
+	AccessToken       string `json:"accessToken"`
+	TokenType         string `json:"tokenType"`
+	ExpiresIn         int    `json:"expiresIn"`              // Seconds until the access token expires
+	RefreshToken      string `json:"refreshToken,omitempty"` // Unchanged by /auth/2fa, so omitted there
+	TwoFactorRequired bool   `json:"twoFactorRequired,omitempty"`
+}
+
+// Body of /auth/refresh and /auth/logout
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Returned by verify for the access token of a session still waiting for its
+// two-factor code
+var errTwoFactorPending = errors.New("two-factor verification pending")
+
+// sessionManager issues access tokens for sessions and verifies them
+type sessionManager struct {
+	store      store.SessionStore
+	twoFactor  store.TwoFactorStore
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	totpIssuer string        // Account issuer shown by authenticator apps
+	recentTTL  time.Duration // How recent a two-factor check sensitive changes need
+	// Claim of a JWT logging in that must name the tenant logged into, with
+	// tenancy enabled; empty otherwise
+	tenantClaim string
+
+	requireVerifiedEmail bool // Refuse sessions to known users whose email isn't verified
+}
+
+func newSessionManager(cfg config.Config, store store.SessionStore, twoFactor store.TwoFactorStore) *sessionManager {
+	return &sessionManager{
+		store:      store,
+		twoFactor:  twoFactor,
+		secret:     []byte(cfg.Auth.Sessions.Secret),
+		accessTTL:  time.Duration(cfg.Auth.Sessions.AccessTokenMinutes) * time.Minute,
+		refreshTTL: time.Duration(cfg.Auth.Sessions.RefreshTokenDays) * 24 * time.Hour,
+		totpIssuer: cfg.Auth.TwoFactor.Issuer,
+		recentTTL:  time.Duration(cfg.Auth.TwoFactor.RecentMinutes) * time.Minute,
+
+		tenantClaim:          tenancyClaim(cfg),
+		requireVerifiedEmail: cfg.Verification.RequireForLogin,
+	}
+}
+
+// issue signs an access token for the session and pairs it with refreshToken
+func (m *sessionManager) issue(session store.Session, refreshToken string) (sessionTokens, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   config.SessionIssuer,
+		"aud":   config.SessionIssuer,
+		"sub":   session.Subject,
+		"email": session.Email,
+		"admin": session.Admin,
+		"sid":   strconv.FormatInt(session.ID, 10),
+		"iat":   now.Unix(),
+		"exp":   now.Add(m.accessTTL).Unix(),
+	}
+	if session.UserID != 0 {
+		claims["uid"] = strconv.FormatInt(session.UserID, 10)
+	}
+	if session.Tenant != "" {
+		claims[sessionTenantClaim] = session.Tenant
+	}
+	if session.TwoFactorPending {
+		claims["mfa"] = "pending"
+	}
+	if session.TwoFactorAt != nil {
+		claims["mfa_at"] = session.TwoFactorAt.Unix()
+	}
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.secret)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+	return sessionTokens{
+		AccessToken:       accessToken,
+		TokenType:         "Bearer",
+		ExpiresIn:         int(m.accessTTL / time.Second),
+		RefreshToken:      refreshToken,
+		TwoFactorRequired: session.TwoFactorPending,
+	}, nil
+}
+
+// verify checks an access token issued by this service. Access tokens are
+// short-lived and not checked against the session, so revoking one takes
+// effect at its next refresh. Tokens still waiting for a two-factor code give
+// errTwoFactorPending.
+func (m *sessionManager) verify(token string) (Principal, error) {
+	claims, err := m.parse(token)
+	if err != nil {
+		return Principal{}, err
+	}
+	if claims["mfa"] == "pending" {
+		return Principal{}, errTwoFactorPending
+	}
+	subject, _ := claims.GetSubject()
+	admin, _ := claims["admin"].(bool)
+	tenant, _ := claims[sessionTenantClaim].(string)
+	principal := Principal{Subject: subject, Claims: claims, Admin: admin, Tenant: tenant}
+	if at, ok := claims["mfa_at"].(float64); ok {
+		principal.TwoFactorAt = time.Unix(int64(at), 0)
+	}
+	return principal, nil
+}
+
+// parse checks the signature and lifetime of an access token issued by this
+// service and returns its claims
+func (m *sessionManager) parse(token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) { return m.secret, nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(config.SessionIssuer),
+		jwt.WithAudience(config.SessionIssuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway),
+	)
+	return claims, err
+}
+
+// newRefreshToken returns a fresh random refresh token
+func newRefreshToken() (string, error) {
+	random := make([]byte, refreshTokenRandomBytes)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return refreshTokenPrefix + base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// API to Start a Session (POST /auth/login)
+//
+// The caller proves who they are with a bearer token from the configured
+// identity provider, or without one with their email and password, and gets
+// back this service's own short-lived access token plus a refresh token, so the
+// frontend needn't go back to the provider each time. Users with two-factor
+// enabled then have to verify a code at /auth/2fa.
+func (h *handler) login(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") == "" {
+		passwordLogin(w, r, h.sessions, h.users, h.credentials, h.guard)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !looksLikeJWT(token) || h.jwts == nil {
+		unauthorized(w, r)
+		return
+	}
+	principal, err := h.jwts.verify(r.Context(), token)
+	if err != nil {
+		h.guard.fail(r, 0)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="users", error="invalid_token"`)
+		writeProblem(w, r, http.StatusUnauthorized, msgUnauthorized)
+		return
+	}
+	tenant := tenantFromContext(r.Context())
+	if claim := h.sessions.tenantClaim; claim != "" {
+		if fromToken, _ := principal.Claims[claim].(string); fromToken != tenant {
+			writeProblem(w, r, http.StatusForbidden, msgLoginTenantMismatch)
+			return
+		}
+	}
+	var email string
+	for _, claim := range emailClaims {
+		if email, _ = principal.Claims[claim].(string); email != "" {
+			break
+		}
+	}
+	session := store.Session{Subject: principal.Subject, Email: email, Admin: principal.Admin, Tenant: tenant}
+	if email != "" {
+		user, err := h.users.GetUserByEmail(r.Context(), tenantFromContext(r.Context()), email)
+		if err != nil && !errors.Is(err, store.ErrUserNotFound) {
+			dbError(w, r, err, msgErrorFetchingUser)
+			return
+		}
+		if user.LockedAt != nil {
+			accountLocked(w, r)
+			return
+		}
+		if h.sessions.requireVerifiedEmail && user.ID != 0 && user.EmailVerifiedAt == nil {
+			emailNotVerified(w, r)
+			return
+		}
+		session.UserID = user.ID
+	}
+	startSession(w, r, h.sessions, session)
+}
+
+// startSession stores a new session and responds with its first tokens. Sessions
+// of users with two-factor enabled start pending.
+func startSession(w http.ResponseWriter, r *http.Request, sessions *sessionManager, session store.Session) {
+	if session.UserID != 0 {
+		totp, err := sessions.twoFactor.GetTOTP(r.Context(), session.UserID)
+		if err != nil && !errors.Is(err, store.ErrNoTOTP) {
+			dbError(w, r, err, msgErrorCheckingTwoFactorEnrolled)
+			return
+		}
+		session.TwoFactorPending = totp.EnabledAt != nil
+	}
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorGeneratingRefreshToken)
+		return
+	}
+	session.ExpiresAt = time.Now().Add(sessions.refreshTTL)
+	session, err = sessions.store.CreateSession(r.Context(), session, hashToken(refreshToken))
+	if err != nil {
+		dbError(w, r, err, msgErrorSavingSession)
+		return
+	}
+	writeSessionTokens(w, r, sessions, session, refreshToken)
+}
+
+// API to Refresh a Session (POST /auth/refresh)
+//
+// Each refresh token works once: it is replaced by the one returned.
+func (h *handler) refreshSession(w http.ResponseWriter, r *http.Request) {
+	presented, ok := readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorGeneratingRefreshToken)
+		return
+	}
+	session, err := h.sessions.store.RotateSession(r.Context(), hashToken(presented), hashToken(refreshToken), time.Now().Add(h.sessions.refreshTTL))
+	if errors.Is(err, store.ErrNoSession) {
+		h.guard.fail(r, 0)
+		writeProblem(w, r, http.StatusUnauthorized, msgRefreshTokenInvalid)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorRefreshingSession)
+		return
+	}
+	writeSessionTokens(w, r, h.sessions, session, refreshToken)
+}
+
+// API to End a Session (POST /auth/logout)
+func (h *handler) logout(w http.ResponseWriter, r *http.Request) {
+	presented, ok := readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	err := h.sessions.store.RevokeSession(r.Context(), hashToken(presented))
+	if err != nil && !errors.Is(err, store.ErrNoSession) {
+		dbError(w, r, err, msgErrorRevokingSession)
+		return
+	}
+	// Unknown tokens are treated as already logged out
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readRefreshToken decodes a refreshRequest body. On failure it writes the error response.
+func readRefreshToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return "", false
+	}
+	if !strings.HasPrefix(req.RefreshToken, refreshTokenPrefix) {
+		writeProblem(w, r, http.StatusBadRequest, msgParamRequired.with("refreshToken"))
+		return "", false
+	}
+	return req.RefreshToken, true
+}
+
+func writeSessionTokens(w http.ResponseWriter, r *http.Request, sessions *sessionManager, session store.Session, refreshToken string) {
+	tokens, err := sessions.issue(session, refreshToken)
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorSigningAccessToken)
+		return
+	}
+	// Tokens must not end up in shared caches
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(tokens)
+}
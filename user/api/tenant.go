@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+
+	"user/user/config"
+)
+
+const tenantKey contextKey = "tenant"
+
+// tenantMiddleware resolves the tenant every /users query is scoped to. The tenant
+// is the one the caller's credential is bound to: a tenant's configured key, a
+// managed key or session started in the tenant, or a token carrying the
+// configured claim. A header naming another tenant is refused. Only admins and
+// callers without credentials, with auth off, take the tenant from the header,
+// and admins may pick another with ?tenant=. With tenancy disabled every
+// request belongs to the default (empty) tenant.
+func tenantMiddleware(cfg config.Config) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !cfg.Tenancy.Enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			principal := principalFromContext(r.Context())
+			tenant := r.Header.Get(cfg.Tenancy.Header)
+			bound := principal.Tenant
+			if claim := tenancyClaim(cfg); bound == "" && claim != "" {
+				bound, _ = principal.Claims[claim].(string)
+			}
+			switch {
+			case bound != "":
+				if tenant != "" && tenant != bound {
+					writeProblem(w, r, http.StatusForbidden, msgTenantMismatch.with(cfg.Tenancy.Header))
+					return
+				}
+				tenant = bound
+			case principal.credential() != "" && !principal.Admin:
+				writeProblem(w, r, http.StatusForbidden, msgCredentialUnbound)
+				return
+			}
+			if override := r.URL.Query().Get("tenant"); override != "" {
+				if !principal.Admin {
+					writeProblem(w, r, http.StatusForbidden, msgOnlyAdminsSelectTenant)
+					return
+				}
+				tenant = override
+			}
+			if tenant == "" {
+				writeProblem(w, r, http.StatusBadRequest, msgMissingHeader.with(cfg.Tenancy.Header))
+				return
+			}
+			if !config.TenantIDPattern.MatchString(tenant) {
+				writeProblem(w, r, http.StatusBadRequest, msgInvalidTenantID)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey, tenant)))
+		})
+	}
+}
+
+// tenancyClaim is the claim tokens carry their tenant in, when tenancy is enabled
+func tenancyClaim(cfg config.Config) string {
+	if !cfg.Tenancy.Enabled {
+		return ""
+	}
+	return cfg.Tenancy.Claim
+}
+
+// tenancyProblems checks that no credential can pick its tenant: with tenancy
+// enabled, configured keys must be bound to one and JWTs must carry theirs
+func tenancyProblems(cfg config.Config) []string {
+	var problems []string
+	if !cfg.Tenancy.Enabled {
+		if len(cfg.Auth.TenantAPIKeys) > 0 {
+			problems = append(problems, "auth.tenant_api_keys needs tenancy.enabled")
+		}
+		return problems
+	}
+	if len(cfg.Auth.APIKeys) > 0 {
+		problems = append(problems, "auth.api_keys could pick any tenant; bind each key to its tenant in auth.tenant_api_keys")
+	}
+	if (cfg.Auth.JWT.JWKSURL != "" || cfg.Auth.Entra.TenantID != "") && cfg.Tenancy.Claim == "" {
+		problems = append(problems, "tenancy.claim is required with auth.jwt or auth.entra, so tokens can't pick their tenant")
+	}
+	seen := map[string]string{}
+	for _, tenant := range slices.Sorted(maps.Keys(cfg.Auth.TenantAPIKeys)) {
+		if !config.TenantIDPattern.MatchString(tenant) {
+			problems = append(problems, fmt.Sprintf("auth.tenant_api_keys has an invalid tenant ID: %q", tenant))
+		}
+		for _, key := range cfg.Auth.TenantAPIKeys[tenant] {
+			if other, ok := seen[key]; ok && other != tenant {
+				problems = append(problems, fmt.Sprintf("auth.tenant_api_keys binds a key to both %q and %q", other, tenant))
+			}
+			seen[key] = tenant
+		}
+	}
+	return problems
+}
+
+// tenantFromContext returns the tenant resolved by tenantMiddleware
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey).(string)
+	return tenant
+}
+
+// tenantBlobName namespaces a blob under its tenant's folder, so tenants
+// uploading pictures of the same name don't overwrite each other's
+func tenantBlobName(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + "/" + name
+}
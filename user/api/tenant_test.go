@@ -0,0 +1,206 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+// tenantTestRouter serves /users and /users/{id} behind the middleware the
+// /users routes use, answering with the tenant and admin rights resolved
+func tenantTestRouter(t *testing.T) (http.Handler, *sessionManager, *store.MemoryStore) {
+	t.Helper()
+	var cfg config.Config
+	cfg.Tenancy.Enabled = true
+	cfg.Tenancy.Header = "X-Tenant-ID"
+	cfg.Auth.AdminAPIKeys = []string{"admin-key"}
+	cfg.Auth.TenantAPIKeys = map[string][]string{"acme": {"acme-key"}, "globex": {"globex-key"}}
+	cfg.Auth.Sessions.Secret = strings.Repeat("s", 32)
+	cfg.Auth.Sessions.AccessTokenMinutes = 15
+
+	userStore := store.NewMemoryStore()
+	ctx := context.Background()
+	// The same person has a plain record in acme and an admin one in globex
+	if _, err := userStore.CreateUser(ctx, store.User{TenantID: "acme", Name: "Alice", Email: "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userStore.CreateUser(ctx, store.User{TenantID: "globex", Name: "Alice", Email: "alice@example.com", Roles: []string{roleAdmin}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userStore.CreateAPIKey(ctx, store.APIKey{Name: "acme service", Prefix: "usk_acme", Scopes: apiKeyScopes, Tenant: "acme"}, hashToken(apiKeyPrefix+"acme-managed")); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := newSessionManager(cfg, userStore, userStore)
+	r := mux.NewRouter()
+	r.Use(bearerAuthMiddleware(authenticators{
+		adminKeys:  cfg.Auth.AdminAPIKeys,
+		tenantKeys: cfg.Auth.TenantAPIKeys,
+		managed:    newAPIKeyVerifier(userStore),
+		sessions:   sessions,
+		guard:      newBruteForceGuard(cfg, userStore, userStore),
+	}))
+	r.Use(tenantMiddleware(cfg), authorizeMiddleware(userStore))
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"tenant": tenantFromContext(r.Context()),
+			"admin":  principalFromContext(r.Context()).Admin,
+		})
+	}
+	r.HandleFunc("/users", echo)
+	r.HandleFunc("/users/{id}", echo)
+	return r, sessions, userStore
+}
+
+func TestTenantIsolation(t *testing.T) {
+	router, sessions, _ := tenantTestRouter(t)
+	accessToken := func(tenant string) string {
+		tokens, err := sessions.issue(store.Session{ID: 1, Subject: "password:1", Email: "alice@example.com", UserID: 1, Tenant: tenant}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokens.AccessToken
+	}
+	acmeSession := "Bearer " + accessToken("acme")
+	unboundSession := "Bearer " + accessToken("")
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		apiKey        string
+		tenant        string // X-Tenant-ID
+		status        int
+		wantTenant    string
+		wantAdmin     bool
+	}{
+		{name: "session in its tenant", path: "/users/1", authorization: acmeSession, status: http.StatusOK, wantTenant: "acme"},
+		{name: "session naming its tenant", path: "/users/1", authorization: acmeSession, tenant: "acme", status: http.StatusOK, wantTenant: "acme"},
+		{name: "session naming another tenant", path: "/users/1", authorization: acmeSession, tenant: "globex", status: http.StatusForbidden},
+		{name: "session selecting another tenant", path: "/users/1?tenant=globex", authorization: acmeSession, status: http.StatusForbidden},
+		// The admin record in globex is out of reach, so listing stays forbidden
+		{name: "session listing users", path: "/users", authorization: acmeSession, status: http.StatusForbidden},
+		{name: "session bound to no tenant", path: "/users/1", authorization: unboundSession, tenant: "globex", status: http.StatusForbidden},
+		{name: "tenant key in its tenant", path: "/users", authorization: "Bearer acme-key", status: http.StatusOK, wantTenant: "acme"},
+		{name: "tenant key naming another tenant", path: "/users", authorization: "Bearer acme-key", tenant: "globex", status: http.StatusForbidden},
+		{name: "tenant key selecting another tenant", path: "/users?tenant=globex", authorization: "Bearer acme-key", status: http.StatusForbidden},
+		{name: "managed key in its tenant", path: "/users", apiKey: apiKeyPrefix + "acme-managed", status: http.StatusOK, wantTenant: "acme"},
+		{name: "managed key naming another tenant", path: "/users", apiKey: apiKeyPrefix + "acme-managed", tenant: "globex", status: http.StatusForbidden},
+		{name: "admin key naming a tenant", path: "/users", authorization: "Bearer admin-key", tenant: "globex", status: http.StatusOK, wantTenant: "globex", wantAdmin: true},
+		{name: "admin key selecting a tenant", path: "/users?tenant=globex", authorization: "Bearer admin-key", tenant: "acme", status: http.StatusOK, wantTenant: "globex", wantAdmin: true},
+		{name: "admin key without a tenant", path: "/users", authorization: "Bearer admin-key", status: http.StatusBadRequest},
+		{name: "unknown key", path: "/users", authorization: "Bearer other-key", tenant: "acme", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.apiKey != "" {
+				req.Header.Set("X-API-Key", tt.apiKey)
+			}
+			if tt.tenant != "" {
+				req.Header.Set("X-Tenant-ID", tt.tenant)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got struct {
+				Tenant string `json:"tenant"`
+				Admin  bool   `json:"admin"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Tenant != tt.wantTenant || got.Admin != tt.wantAdmin {
+				t.Errorf("tenant = %q, admin = %v; want %q, %v", got.Tenant, got.Admin, tt.wantTenant, tt.wantAdmin)
+			}
+		})
+	}
+}
+
+func TestSessionsKeepTheirTenant(t *testing.T) {
+	_, sessions, userStore := tenantTestRouter(t)
+	ctx := context.Background()
+	session, err := userStore.CreateSession(ctx, store.Session{Subject: "password:1", Email: "alice@example.com", UserID: 1, Tenant: "acme", ExpiresAt: time.Now().Add(time.Hour)}, hashToken("refresh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A refreshed session's tokens are bound to the tenant it was started in
+	session, err = userStore.RotateSession(ctx, hashToken("refresh"), hashToken("refreshed"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := sessions.issue(session, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err := sessions.verify(tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Tenant != "acme" {
+		t.Errorf("tenant = %q, want acme", principal.Tenant)
+	}
+}
+
+func TestTenancyProblems(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*config.Config)
+		problem   string // Part of the only problem expected; none when empty
+	}{
+		{name: "bound keys", configure: func(c *config.Config) {
+			c.Auth.TenantAPIKeys = map[string][]string{"acme": {"a"}, "globex": {"g"}}
+		}},
+		{name: "unbound keys", configure: func(c *config.Config) { c.Auth.APIKeys = []string{"k"} }, problem: "auth.api_keys"},
+		{name: "JWTs without a tenant claim", configure: func(c *config.Config) { c.Auth.JWT.JWKSURL = "https://idp.example.com/keys" }, problem: "tenancy.claim"},
+		{name: "JWTs with a tenant claim", configure: func(c *config.Config) {
+			c.Auth.JWT.JWKSURL = "https://idp.example.com/keys"
+			c.Tenancy.Claim = "tenant_id"
+		}},
+		{name: "invalid tenant", configure: func(c *config.Config) {
+			c.Auth.TenantAPIKeys = map[string][]string{"a/b": {"k"}}
+		}, problem: "invalid tenant ID"},
+		{name: "key bound twice", configure: func(c *config.Config) {
+			c.Auth.TenantAPIKeys = map[string][]string{"acme": {"k"}, "globex": {"k"}}
+		}, problem: "both"},
+		{name: "tenant keys without tenancy", configure: func(c *config.Config) {
+			c.Tenancy.Enabled = false
+			c.Auth.TenantAPIKeys = map[string][]string{"acme": {"k"}}
+		}, problem: "tenancy.enabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config.Config
+			cfg.Tenancy.Enabled = true
+			tt.configure(&cfg)
+			problems := tenancyProblems(cfg)
+			if tt.problem == "" {
+				if len(problems) > 0 {
+					t.Errorf("problems = %q, want none", problems)
+				}
+				return
+			}
+			if len(problems) != 1 || !strings.Contains(problems[0], tt.problem) {
+				t.Errorf("problems = %q, want one about %s", problems, tt.problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif" // Register decoders for the formats pictures are uploaded in
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"user/user/blob"
+	"user/user/config"
+	"user/user/store"
+)
+
+// Quality thumbnails are encoded at
+const thumbnailJPEGQuality = 85
+
+// thumbnailLink builds the link stored for a generated thumbnail
+func thumbnailLink(filename string) string {
+	return fmt.Sprintf("%s/%s", blob.ThumbnailsContainer, filename)
+}
+
+// thumbnailNameFromLink returns the blob name behind a link produced by thumbnailLink
+func thumbnailNameFromLink(link string) (string, bool) {
+	return strings.CutPrefix(link, blob.ThumbnailsContainer+"/")
+}
+
+// thumbnailVariantName returns the blob name of a picture's thumbnail variant
+// of the given size, beside its thumbnail in the thumbnails container
+func thumbnailVariantName(filename string, size int) string {
+	return fmt.Sprintf("%dpx/%s", size, filename)
+}
+
+// makeThumbnail re-encodes an image as a JPEG no larger than maxDimension on
+// either side. Smaller images keep their size.
+func makeThumbnail(src image.Image, maxDimension int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(src, maxDimension), &jpeg.Options{Quality: thumbnailJPEGQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleDown shrinks src to fit within maxDimension, keeping its aspect ratio.
+// Each destination pixel averages the block of source pixels it covers.
+func scaleDown(src image.Image, maxDimension int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= maxDimension && srcH <= maxDimension {
+		return src
+	}
+
+	dstW, dstH := maxDimension, maxDimension
+	if srcW > srcH {
+		dstH = max(1, srcH*maxDimension/srcW)
+	} else {
+		dstW = max(1, srcW*maxDimension/srcH)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcH/dstH)
+		for x := 0; x < dstW; x++ {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcW/dstW)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8((r / n) >> 8)
+			dst.Pix[i+1] = uint8((g / n) >> 8)
+			dst.Pix[i+2] = uint8((b / n) >> 8)
+			dst.Pix[i+3] = uint8((a / n) >> 8)
+		}
+	}
+	return dst
+}
+
+// uploadThumbnails generates and uploads the thumbnail of an uploaded picture
+// and its variants in each configured size, returning their links. The picture
+// is only decoded once. A variant that fails is left out rather than failing
+// the upload.
+func uploadThumbnails(ctx context.Context, blobs blob.Storage, file io.ReadSeeker, filename string, cfg config.Config) (string, store.ThumbnailLinks, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	upload := func(name string, maxDimension int) error {
+		data, err := makeThumbnail(src, maxDimension)
+		if err != nil {
+			return err
+		}
+		_, err = blob.Upload(ctx, blobs, blob.ThumbnailsContainer, bytes.NewReader(data), name, "", "image/jpeg")
+		return err
+	}
+	if err := upload(filename, cfg.Thumbnails.MaxDimension); err != nil {
+		return "", nil, err
+	}
+
+	variants := store.ThumbnailLinks{}
+	for _, size := range cfg.Thumbnails.Sizes {
+		name := thumbnailVariantName(filename, size)
+		if err := upload(name, size); err != nil {
+			slog.WarnContext(ctx, "Skipping thumbnail variant", "blob", name, "error", err)
+			continue
+		}
+		variants[strconv.Itoa(size)] = thumbnailLink(name)
+	}
+	return thumbnailLink(filename), variants, nil
+}
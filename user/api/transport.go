@@ -0,0 +1,114 @@
+package api
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"slices"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"user/user/config"
+)
+
+// configureTransport sets server up to serve TLS, from certificate files or
+// from Let's Encrypt through autocert, with HTTP/2 unless server.disable_http2
+// is set. Without TLS it serves plain HTTP, and cleartext HTTP/2 too with
+// server.h2c. It returns the plain HTTP server for server.tls.redirect_addr,
+// which sends clients on to HTTPS and answers ACME challenges, or nil.
+func configureTransport(cfg config.Config, server *http.Server) *http.Server {
+	settings := cfg.Server.TLS
+	var challenges func(http.Handler) http.Handler
+	switch {
+	case len(settings.Autocert.Domains) > 0:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(settings.Autocert.Domains...),
+			Cache:      autocert.DirCache(settings.Autocert.CacheDir),
+			Email:      settings.Autocert.Email,
+		}
+		server.TLSConfig = manager.TLSConfig()
+		challenges = manager.HTTPHandler
+	case settings.CertFile != "":
+		server.TLSConfig = &tls.Config{}
+	default:
+		if cfg.Server.H2C && !cfg.Server.DisableHTTP2 {
+			server.Handler = h2c.NewHandler(server.Handler, &http2.Server{IdleTimeout: server.IdleTimeout})
+		}
+		return nil
+	}
+
+	server.TLSConfig.MinVersion = tls.VersionTLS12
+	if cfg.Server.DisableHTTP2 {
+		// A non-nil, empty TLSNextProto keeps net/http from adding h2
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		server.TLSConfig.NextProtos = slices.DeleteFunc(server.TLSConfig.NextProtos, func(proto string) bool { return proto == "h2" })
+	}
+	if settings.RedirectAddr == "" {
+		return nil
+	}
+	var redirect http.Handler = http.HandlerFunc(redirectToHTTPS(server.Addr))
+	if challenges != nil {
+		redirect = challenges(redirect)
+	}
+	return &http.Server{
+		Addr:              settings.RedirectAddr,
+		Handler:           redirect,
+		ReadHeaderTimeout: server.ReadHeaderTimeout,
+		ReadTimeout:       server.ReadTimeout,
+		WriteTimeout:      server.WriteTimeout,
+		IdleTimeout:       server.IdleTimeout,
+		MaxHeaderBytes:    server.MaxHeaderBytes,
+	}
+}
+
+// grpcTLSConfig is the TLS configuration configureTransport gave server, for
+// the gRPC listener, with the certificate files loaded into it since there is
+// no ListenAndServeTLS to load them. It is nil when server serves plain HTTP.
+func grpcTLSConfig(cfg config.Config, server *http.Server) (*tls.Config, error) {
+	if server.TLSConfig == nil {
+		return nil, nil
+	}
+	tlsConfig := server.TLSConfig.Clone()
+	if settings := cfg.Server.TLS; settings.CertFile != "" && tlsConfig.GetCertificate == nil {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	// gRPC needs HTTP/2, even with server.disable_http2 turning it off for the REST API
+	if !slices.Contains(tlsConfig.NextProtos, "h2") {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, "h2")
+	}
+	return tlsConfig, nil
+}
+
+// redirectToHTTPS answers 308 with the same URL on HTTPS, at the port addr
+// listens on unless it is the default one
+func redirectToHTTPS(addr string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(addr)
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := *r.URL
+		target.Scheme, target.Host = "https", host
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	}
+}
+
+// serve serves server the way configureTransport set it up, until it is shut down
+func serve(cfg config.Config, server *http.Server) error {
+	if server.TLSConfig == nil {
+		return server.ListenAndServe()
+	}
+	// Empty files make ListenAndServeTLS take autocert's certificates from TLSConfig
+	return server.ListenAndServeTLS(cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile)
+}
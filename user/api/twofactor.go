@@ -0,0 +1,324 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"user/user/store"
+)
+
+// TOTP parameters; RFC 6238's defaults, the only ones every authenticator app supports
+const (
+	totpPeriod      = 30 * time.Second
+	totpDigits      = 6
+	totpSecretBytes = 20
+	totpSkew        = 1 // Steps either side of now still accepted, for clock drift
+)
+
+// Recovery codes are random, like refresh tokens, and only stored hashed
+const (
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 10 // 16 base32 characters
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Response of POST /users/{id}/2fa
+type totpEnrollment struct {
+	Secret string `json:"secret"` // Base32, for typing into an authenticator app
+	URI    string `json:"uri"`    // otpauth:// provisioning URI, to show as a QR code
+}
+
+// Body of POST /users/{id}/2fa/confirm and /auth/2fa
+type twoFactorRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"` // Instead of code, at /auth/2fa only
+}
+
+// totpCode computes the code for a time step (RFC 4226 section 5.3)
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(step)))
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1_000_000)
+}
+
+// matchTOTP returns the time step near now whose code is code
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	var matched int64
+	found := false
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			matched, found = step, true
+		}
+	}
+	return matched, found
+}
+
+// totpURI builds the Key Uri Format understood by authenticator apps
+func totpURI(issuer, account string, secret []byte) string {
+	query := url.Values{
+		"secret":    {totpEncoding.EncodeToString(secret)},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(int(totpPeriod / time.Second))},
+	}
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query.Encode()
+}
+
+// newRecoveryCodes returns fresh recovery codes, formatted for display, and their hashes
+func newRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(random))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		hashes[i] = hashToken(code)
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode undoes the display formatting of a recovery code
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// readTwoFactorRequest decodes a twoFactorRequest body. On failure it writes the error response.
+func readTwoFactorRequest(w http.ResponseWriter, r *http.Request) (twoFactorRequest, bool) {
+	var req twoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return req, false
+	}
+	return req, true
+}
+
+// requireSelf rejects callers other than the user the route is for: a user's
+// authenticator secret is for their eyes only, admins included.
+func requireSelf(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return 0, false
+	}
+	if self := principalFromContext(r.Context()).UserID; self == 0 || self != id {
+		writeProblem(w, r, http.StatusForbidden, msgOnlySelfTwoFactor)
+		return 0, false
+	}
+	return id, true
+}
+
+// API to Start Two-Factor Enrollment (POST /users/{id}/2fa)
+//
+// Returns a new secret, which takes effect once a code from it is confirmed at
+// /users/{id}/2fa/confirm. Enrolling again before then replaces it.
+func (h *handler) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, ok := requireSelf(w, r)
+	if !ok {
+		return
+	}
+	user, err := h.users.GetUser(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+
+	secret := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorGeneratingSecret)
+		return
+	}
+	err = h.sessions.twoFactor.EnrollTOTP(r.Context(), id, secret)
+	if errors.Is(err, store.ErrTOTPEnabled) {
+		writeProblem(w, r, http.StatusConflict, msgTwoFactorAlreadyEnabled)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorSavingTwoFactorSecret)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(totpEnrollment{
+		Secret: totpEncoding.EncodeToString(secret),
+		URI:    totpURI(h.sessions.totpIssuer, user.Email, secret),
+	})
+}
+
+// API to Confirm Two-Factor Enrollment (POST /users/{id}/2fa/confirm)
+//
+// Enables two-factor authentication once the caller proves their app has the
+// secret, and returns the recovery codes. They are shown only this once.
+func (h *handler) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, ok := requireSelf(w, r)
+	if !ok {
+		return
+	}
+	req, ok := readTwoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+
+	totp, err := h.sessions.twoFactor.GetTOTP(r.Context(), id)
+	if errors.Is(err, store.ErrNoTOTP) {
+		writeProblem(w, r, http.StatusConflict, msgStartEnrollmentFirst)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingTwoFactorSecret)
+		return
+	}
+	if totp.EnabledAt != nil {
+		writeProblem(w, r, http.StatusConflict, msgTwoFactorAlreadyEnabled)
+		return
+	}
+	step, ok := matchTOTP(totp.Secret, req.Code, time.Now())
+	if !ok {
+		writeProblem(w, r, http.StatusUnprocessableEntity, msgInvalidCode)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, msgErrorGeneratingRecoveryCodes)
+		return
+	}
+	err = h.sessions.twoFactor.EnableTOTP(r.Context(), id, step, hashes)
+	if errors.Is(err, store.ErrNoTOTP) {
+		// Enabled by a concurrent confirmation
+		writeProblem(w, r, http.StatusConflict, msgTwoFactorAlreadyEnabled)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorEnablingTwoFactor)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+}
+
+// API to Verify a Two-Factor Code (POST /auth/2fa)
+//
+// Takes the session's access token, pending or not, and a code from the
+// authenticator app or an unused recovery code. Completes a pending login, or
+// refreshes the verification time sensitive changes check, and returns a new
+// access token; the refresh token is unchanged.
+func (h *handler) verifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !looksLikeJWT(token) {
+		unauthorized(w, r)
+		return
+	}
+	claims, err := h.sessions.parse(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="users", error="invalid_token"`)
+		writeProblem(w, r, http.StatusUnauthorized, msgUnauthorized)
+		return
+	}
+	sid, _ := claims["sid"].(string)
+	uid, _ := claims["uid"].(string)
+	sessionID, _ := strconv.ParseInt(sid, 10, 64)
+	userID, _ := strconv.ParseInt(uid, 10, 64)
+
+	req, ok := readTwoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+	var totp store.TOTPSecret
+	if userID != 0 {
+		totp, err = h.sessions.twoFactor.GetTOTP(r.Context(), userID)
+		if err != nil && !errors.Is(err, store.ErrNoTOTP) {
+			dbError(w, r, err, msgErrorFetchingTwoFactorSecret)
+			return
+		}
+	}
+	if totp.EnabledAt == nil {
+		writeProblem(w, r, http.StatusBadRequest, msgTwoFactorNotEnabled)
+		return
+	}
+
+	switch {
+	case req.Code != "":
+		step, ok := matchTOTP(totp.Secret, req.Code, time.Now())
+		err = store.ErrInvalidCode
+		if ok {
+			err = h.sessions.twoFactor.UseTOTPStep(r.Context(), userID, step)
+		}
+	case req.RecoveryCode != "":
+		err = h.sessions.twoFactor.UseRecoveryCode(r.Context(), userID, hashToken(normalizeRecoveryCode(req.RecoveryCode)))
+	default:
+		writeProblem(w, r, http.StatusBadRequest, msgCodeRequired)
+		return
+	}
+	if errors.Is(err, store.ErrInvalidCode) {
+		// Guessing codes is what lockout is for
+		h.guard.fail(r, userID)
+		writeProblem(w, r, http.StatusUnauthorized, msgInvalidOrUsedCode)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorCheckingTwoFactorCode)
+		return
+	}
+
+	session, err := h.sessions.store.VerifySessionTwoFactor(r.Context(), sessionID)
+	if errors.Is(err, store.ErrNoSession) {
+		writeProblem(w, r, http.StatusUnauthorized, msgSessionExpired)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorUpdatingSession)
+		return
+	}
+	writeSessionTokens(w, r, h.sessions, session, "")
+}
+
+// requireRecentTwoFactor makes users with two-factor enabled who are changing
+// their own account show a code was verified in the last few minutes. Admins
+// acting on other users and API keys are not asked. On failure it writes the
+// error response.
+func requireRecentTwoFactor(w http.ResponseWriter, r *http.Request, sessions *sessionManager, userID int64) bool {
+	principal := principalFromContext(r.Context())
+	if sessions == nil || principal.UserID == 0 || principal.UserID != userID || time.Since(principal.TwoFactorAt) <= sessions.recentTTL {
+		return true
+	}
+	totp, err := sessions.twoFactor.GetTOTP(r.Context(), userID)
+	if errors.Is(err, store.ErrNoTOTP) || (err == nil && totp.EnabledAt == nil) {
+		return true
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorCheckingTwoFactorEnrolled)
+		return false
+	}
+	writeProblem(w, r, http.StatusForbidden, msgRecentTwoFactorRequired.with(int(sessions.recentTTL/time.Minute)))
+	return false
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"user/user/events"
+	"user/user/store"
+)
+
+// upsertUserRequest is the JSON body of PUT /users/by-email/{email}
+type upsertUserRequest struct {
+	Name     string             `json:"name"`
+	PhotoURL string             `json:"photo_url,omitempty"` // Existing picture URL; without one a user keeps theirs
+	Metadata store.UserMetadata `json:"metadata,omitempty"`  // Replaces the user's metadata when given
+}
+
+// API to Create or Update a User by Email (PUT /users/by-email/{email})
+//
+// For syncing users from another system of record: the same request can be
+// sent any number of times and leaves one user. The live user of the tenant
+// with the email, compared case-insensitively, gets the name and, if given,
+// the picture and metadata; when there is none they are created, and the
+// response is 201 instead of 200.
+func (h *handler) upsertUserByEmail(w http.ResponseWriter, r *http.Request) {
+	var req upsertUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return
+	}
+	email := strings.TrimSpace(mux.Vars(r)["email"])
+	name := strings.TrimSpace(req.Name)
+	var errs validationErrors
+	errs.check("email", validateEmail(email))
+	errs.check("name", validateName(name, h.config.Validation.MaxNameLength))
+	errs.check("metadata", validateMetadata(req.Metadata))
+	if req.PhotoURL != "" {
+		errs.check("photo_url", validatePhotoURL(req.PhotoURL, h.config.Validation.MaxLinkLength))
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	user := store.User{Name: name, Email: email, Link: req.PhotoURL, TenantID: tenantFromContext(r.Context()), Metadata: req.Metadata}
+	// The store writes user.created instead when it creates the user
+	user, created, err := h.users.UpsertUserByEmail(store.WithOutboxEvent(r.Context(), events.UserUpdated), user)
+	if err != nil {
+		if errors.Is(err, store.ErrDuplicateEmail) {
+			writeEmailTaken(w, r, msgEmailTaken)
+			return
+		}
+		dbError(w, r, err, msgErrorSavingUser)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	if created {
+		h.webhooks.notify(r.Context(), events.UserCreated, user)
+		h.verifier.send(r, user)
+		w.Header().Set("Location", versionedPath(apiV1, "/users/"+strconv.FormatInt(user.ID, 10)))
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		h.webhooks.notify(r.Context(), events.UserUpdated, user)
+	}
+	json.NewEncoder(w).Encode(h.links.user(user))
+}
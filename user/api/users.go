@@ -0,0 +1,510 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+)
+
+func toPtr[T any](v T) *T {
+	return &v
+}
+
+func deref[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
+
+// A POST /users body that passed validation, whichever way it was encoded
+type newUserInput struct {
+	Name          string
+	Email         string
+	PhotoURL      string        // Existing picture to link to instead of uploading one
+	Photo         io.ReadSeeker // Picture to upload, if any
+	PhotoFilename string
+	Metadata      store.UserMetadata
+	Password      string // Optional local password, not yet hashed
+}
+
+// JSON body of POST /users, the alternative to a multipart form
+type createUserRequest struct {
+	Name          string             `json:"name"`
+	Email         string             `json:"email"`
+	PhotoURL      string             `json:"photo_url,omitempty"`
+	PhotoBase64   string             `json:"photo_base64,omitempty"`   // Standard base64 of the picture
+	PhotoFilename string             `json:"photo_filename,omitempty"` // File name of photo_base64, kept with the stored picture
+	Metadata      store.UserMetadata `json:"metadata,omitempty"`
+	Password      string             `json:"password,omitempty"`
+}
+
+// readNewUserForm parses and validates a multipart POST /users body, which
+// must carry a photo file or photo_url. On failure it writes the error response.
+func readNewUserForm(w http.ResponseWriter, r *http.Request, cfg config.Config) (newUserInput, bool) {
+	if !parseUploadForm(w, r) {
+		return newUserInput{}, false
+	}
+	input := newUserInput{
+		Name:     strings.TrimSpace(r.FormValue("name")),
+		Email:    strings.TrimSpace(r.FormValue("email")),
+		PhotoURL: r.FormValue("photo_url"),
+		Password: r.FormValue("password"),
+	}
+
+	// Check every field before uploading anything
+	var errs validationErrors
+	var err error
+	errs.check("name", validateName(input.Name, cfg.Validation.MaxNameLength))
+	errs.check("email", validateEmail(input.Email))
+	input.Metadata, err = parseMetadataForm(r.FormValue("metadata"))
+	errs.check("metadata", err)
+	if input.Password != "" {
+		errs.check("password", validatePassword(input.Password, store.User{Email: input.Email}, cfg.Auth.Passwords.MinLength))
+	}
+	switch {
+	case input.PhotoURL != "":
+		errs.check("photo_url", validatePhotoURL(input.PhotoURL, cfg.Validation.MaxLinkLength))
+	case hasFormFile(r, "photo"):
+		errs.check("photo", validatePhotoFile(r.MultipartForm.File["photo"][0], cfg))
+	default:
+		errs.check("photo", msgPhotoRequired)
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return newUserInput{}, false
+	}
+
+	if input.PhotoURL == "" {
+		file, header, err := r.FormFile("photo")
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidFileUpload)
+			return newUserInput{}, false
+		}
+		input.Photo, input.PhotoFilename = file, header.Filename
+	}
+	return input, true
+}
+
+// readNewUserJSON decodes and validates a JSON POST /users body, whose photo
+// is optional. On failure it writes the error response.
+func readNewUserJSON(w http.ResponseWriter, r *http.Request, cfg config.Config) (newUserInput, bool) {
+	var req createUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return newUserInput{}, false
+	}
+	input := newUserInput{
+		Name:     strings.TrimSpace(req.Name),
+		Email:    strings.TrimSpace(req.Email),
+		PhotoURL: req.PhotoURL,
+		Metadata: req.Metadata,
+		Password: req.Password,
+	}
+
+	var errs validationErrors
+	errs.check("name", validateName(input.Name, cfg.Validation.MaxNameLength))
+	errs.check("email", validateEmail(input.Email))
+	errs.check("metadata", validateMetadata(input.Metadata))
+	if input.Password != "" {
+		errs.check("password", validatePassword(input.Password, store.User{Email: input.Email}, cfg.Auth.Passwords.MinLength))
+	}
+	switch {
+	case req.PhotoURL != "" && req.PhotoBase64 != "":
+		errs.check("photo_base64", msgPhotoWithPhotoURL)
+	case req.PhotoURL != "":
+		errs.check("photo_url", validatePhotoURL(req.PhotoURL, cfg.Validation.MaxLinkLength))
+	case req.PhotoBase64 != "":
+		data, err := base64.StdEncoding.DecodeString(req.PhotoBase64)
+		if err != nil {
+			errs.check("photo_base64", msgNotBase64)
+			break
+		}
+		// Like a multipart filename, the name may not pick another directory
+		if req.PhotoFilename == "" || req.PhotoFilename == "." || req.PhotoFilename == ".." || strings.ContainsAny(req.PhotoFilename, `/\`) {
+			errs.check("photo_filename", msgPhotoFilenameRequired)
+			break
+		}
+		errs.check("photo_base64", validatePhoto(req.PhotoFilename, int64(len(data)), data[:min(len(data), 512)], cfg))
+		input.Photo, input.PhotoFilename = bytes.NewReader(data), req.PhotoFilename
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return newUserInput{}, false
+	}
+	return input, true
+}
+
+// readNewUser reads and validates a POST /users body of either kind. On
+// failure it writes the error response.
+func readNewUser(w http.ResponseWriter, r *http.Request, cfg config.Config) (newUserInput, bool) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		return readNewUserJSON(w, r, cfg)
+	}
+	return readNewUserForm(w, r, cfg)
+}
+
+// API to Create a New User (POST /users)
+//
+// Takes a multipart form with a photo file or photo_url, or, with Content-Type
+// application/json, a createUserRequest whose photo is optional. With Prefer:
+// respond-async the route hands the request to createUserAsync instead, for
+// tenants with the async_creation feature flag on.
+func (h *handler) createUser(w http.ResponseWriter, r *http.Request) {
+	input, ok := readNewUser(w, r, h.config)
+	if !ok {
+		return
+	}
+	if closer, ok := input.Photo.(io.Closer); ok {
+		defer closer.Close()
+	}
+	h.createUserFrom(w, r, input)
+}
+
+// createUserFrom creates the user described by validated input and writes the
+// response, whether a request is waiting for it or a creation job is
+func (h *handler) createUserFrom(w http.ResponseWriter, r *http.Request, input newUserInput) {
+	name, email := input.Name, input.Email
+	var passwordHash []byte
+	if input.Password != "" {
+		var err error
+		if passwordHash, err = hashPassword(input.Password); err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, msgErrorHashingPassword)
+			return
+		}
+	}
+
+	// Each step that completes is undone if a later one fails, so a failed create
+	// leaves neither an orphaned blob nor a user without the password asked for
+	steps := newSaga("create user")
+	var photo uploadedPhoto
+	switch {
+	case input.PhotoURL != "":
+		// Client supplied an existing picture URL instead of uploading one
+		photo.Link = input.PhotoURL
+	case input.Photo != nil:
+		var ok bool
+		photo, ok = h.storePhoto(w, r, input.Photo, input.PhotoFilename, 0)
+		if !ok {
+			return
+		}
+		steps.done("upload picture", func(ctx context.Context) error {
+			h.discard(ctx, photo)
+			return nil
+		})
+	}
+
+	// Prepare user data
+	user := store.User{
+		Name:          name,
+		Email:         email,
+		Link:          photo.Link,
+		ThumbnailLink: photo.ThumbnailLink,
+		Thumbnails:    photo.Thumbnails,
+		TenantID:      tenantFromContext(r.Context()),
+		Metadata:      input.Metadata,
+	}
+
+	// The event is committed with the row, for the outbox dispatcher to publish
+	user, err := h.users.CreateUser(store.WithOutboxEvent(r.Context(), events.UserCreated), user)
+	if err != nil {
+		steps.rollback(r.Context())
+		if errors.Is(err, store.ErrDuplicateEmail) {
+			writeEmailTaken(w, r, msgEmailTaken)
+			return
+		}
+		dbError(w, r, err, msgErrorSavingUser)
+		return
+	}
+	steps.done("insert user", func(ctx context.Context) error {
+		// The created event is already in the outbox, so consumers are told the user went again
+		return h.users.DeleteUser(store.WithOutboxEvent(ctx, events.UserDeleted), user.TenantID, user.ID, true)
+	})
+
+	if passwordHash != nil {
+		if err := h.credentials.SetPasswordHash(r.Context(), user.ID, passwordHash); err != nil {
+			steps.rollback(r.Context())
+			dbError(w, r, err, msgErrorSavingPassword)
+			return
+		}
+	}
+
+	// Only a user that was created in full is announced
+	h.webhooks.notify(r.Context(), events.UserCreated, user)
+	h.verifier.send(r, user)
+
+	// Respond with success message and the stored row, generated ID and createdAt included
+	link, thumbnailLink, thumbnails := h.responseLinks(r, photo, user.Version)
+	json.NewEncoder(w).Encode(map[string]any{
+		"message":         "User created successfully",
+		"profile_pic_url": link,
+		"thumbnail_url":   thumbnailLink,
+		"thumbnail_urls":  thumbnails,
+		"profile_pic_md5": photo.Checksum,
+		"user":            h.links.user(user),
+	})
+}
+
+// userFilter reads the q, active_since, include_deleted and metadata.<key> query
+// parameters shared by the list, count and export endpoints. On failure it writes
+// the error response.
+func userFilter(w http.ResponseWriter, r *http.Request) (store.UserFilter, bool) {
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return store.UserFilter{}, false
+	}
+	filter := store.UserFilter{
+		Search:         strings.TrimSpace(r.URL.Query().Get("q")),
+		Email:          strings.TrimSpace(r.URL.Query().Get("email")),
+		IncludeDeleted: withDeleted,
+	}
+	if since := r.URL.Query().Get("active_since"); since != "" {
+		activeSince, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, msgTimestampInvalid.with("active_since"))
+			return store.UserFilter{}, false
+		}
+		filter.ActiveSince = activeSince
+	}
+	if after := r.URL.Query().Get("createdAfter"); after != "" {
+		createdAfter, err := time.Parse(time.RFC3339, after)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, msgTimestampInvalid.with("createdAfter"))
+			return store.UserFilter{}, false
+		}
+		filter.CreatedAfter = createdAfter
+	}
+	if filter.Metadata, ok = metadataFilter(w, r); !ok {
+		return store.UserFilter{}, false
+	}
+	return filter, true
+}
+
+// userSort reads the sort and order query parameters of a listing.
+// On failure it writes the error response.
+func userSort(w http.ResponseWriter, r *http.Request) (store.UserSort, bool) {
+	var sort store.UserSort
+	switch field := r.URL.Query().Get("sort"); field {
+	case "", store.SortByID, store.SortByName, store.SortByCreatedAt:
+		sort.Field = field
+	default:
+		writeProblem(w, r, http.StatusBadRequest, msgSortInvalid)
+		return store.UserSort{}, false
+	}
+	switch r.URL.Query().Get("order") {
+	case "", "asc":
+	case "desc":
+		sort.Descending = true
+	default:
+		writeProblem(w, r, http.StatusBadRequest, msgOrderInvalid)
+		return store.UserSort{}, false
+	}
+	return sort, true
+}
+
+// API to Get All Users (GET /users[?q=&email=&active_since=&createdAfter=&sort=&order=&fields=])
+//
+// fields lists the user fields to return, read alone from the database, for
+// clients fetching many users but only needing a few of their fields.
+//
+// Without limit or cursor the first page still comes back as a bare array, as
+// before pagination, with a Link header to the page after it when there is one.
+func (h *handler) getUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Has("limit") || query.Has("cursor") {
+		h.getUsersPage(w, r)
+		return
+	}
+	filter, ok := userFilter(w, r)
+	if !ok {
+		return
+	}
+	sort, ok := userSort(w, r)
+	if !ok {
+		return
+	}
+	filter.Fields, ok = sparseFields(w, r)
+	if !ok {
+		return
+	}
+
+	// Fetch one extra row to learn whether another page follows
+	users, err := h.users.ListUsersAfter(r.Context(), tenantFromContext(r.Context()), store.User{}, defaultPageSize+1, filter, sort)
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUsers)
+		return
+	}
+	if len(users) > defaultPageSize {
+		users = users[:defaultPageSize]
+		next := r.URL.Query()
+		next.Set("limit", strconv.Itoa(defaultPageSize))
+		next.Set("cursor", encodeCursor(cursorFor(users[len(users)-1], sort)))
+		w.Header().Add("Link", "<"+r.URL.Path+"?"+next.Encode()+`>; rel="next"`)
+	}
+	total, err := h.users.CountUsers(r.Context(), tenantFromContext(r.Context()), filter)
+	if err != nil {
+		dbError(w, r, err, msgErrorCountingUsers)
+		return
+	}
+
+	w.Header().Set("X-Total-Count", fmt.Sprint(total))
+	if users == nil {
+		users = []store.User{}
+	}
+	users = h.links.users(users)
+	var body any = users
+	if filter.Fields != nil {
+		if body, err = sparseUsers(users, filter.Fields); err != nil {
+			slog.ErrorContext(r.Context(), "Error encoding users", "error", err)
+			return
+		}
+	}
+	if err := writeNegotiatedWithETag(w, r, body); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding users", "error", err)
+	}
+}
+
+// API to Get a Page of Users (GET /users?limit=&cursor=)
+//
+// Pages after the first also carry a prevCursor, which pages back to the users
+// before them.
+func (h *handler) getUsersPage(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	filter, ok := userFilter(w, r)
+	if !ok {
+		return
+	}
+	sort, ok := userSort(w, r)
+	if !ok {
+		return
+	}
+	filter.Fields, ok = sparseFields(w, r)
+	if !ok {
+		return
+	}
+
+	var after store.User
+	var cursor pageCursor
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		cursor, err = decodeCursor(token)
+		if err == nil {
+			after, err = cursorAfter(cursor, sort)
+		}
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+			return
+		}
+	}
+	// A cursor paging back reads the users before it in the reverse order
+	listSort := sort
+	if cursor.Back {
+		listSort.Descending = !sort.Descending
+	}
+
+	// Fetch one extra row to learn whether another page follows
+	users, err := h.users.ListUsersAfter(r.Context(), tenantFromContext(r.Context()), after, limit+1, filter, listSort)
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUsers)
+		return
+	}
+
+	more := len(users) > limit
+	if more {
+		users = users[:limit]
+	}
+	if cursor.Back {
+		slices.Reverse(users)
+	}
+	page := UserPage{Users: users}
+	if len(users) > 0 {
+		first, last := users[0], users[len(users)-1]
+		if more || cursor.Back {
+			page.NextCursor = encodeCursor(cursorFor(last, sort))
+		}
+		if (more && cursor.Back) || (cursor.ID != 0 && !cursor.Back) {
+			page.PrevCursor = encodeCursor(cursorBefore(first, sort))
+		}
+	}
+	if page.Users == nil {
+		page.Users = []store.User{}
+	}
+	// Counted separately with the same filters, so UIs can show how many pages there are
+	page.Total, err = h.users.CountUsers(r.Context(), tenantFromContext(r.Context()), filter)
+	if err != nil {
+		dbError(w, r, err, msgErrorCountingUsers)
+		return
+	}
+	w.Header().Set("X-Total-Count", fmt.Sprint(page.Total))
+
+	page.Users = h.links.users(page.Users)
+	var body any = page
+	if filter.Fields != nil {
+		users, err := sparseUsers(page.Users, filter.Fields)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error encoding users", "error", err)
+			return
+		}
+		body = sparseUserPage{Users: users, NextCursor: page.NextCursor, PrevCursor: page.PrevCursor, Total: page.Total}
+	}
+	if err := writeNegotiatedWithETag(w, r, body); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding users", "error", err)
+	}
+}
+
+// API to Get a User (GET /users/{id})
+//
+// Responses carry an ETag and Cache-Control: private, no-cache, so clients may keep
+// a copy but must revalidate it: send the stored ETag in If-None-Match and a 304
+// Not Modified (with no body) means the cached copy is still current.
+func (h *handler) getUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+
+	user, err := h.users.GetUser(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgUserNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingUser)
+		return
+	}
+
+	encoder, ok := negotiateEncoder(w, r, user)
+	if !ok {
+		return
+	}
+	etag := userETag(user)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if ifNoneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeEncoded(w, encoder, h.links.user(user))
+}
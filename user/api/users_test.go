@@ -0,0 +1,346 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+// newUsersTestRouter serves the /users CRUD routes over a memory store, as
+// server.go registers them, without auth or tenancy
+func newUsersTestRouter(t *testing.T) (http.Handler, *store.MemoryStore) {
+	t.Helper()
+	var cfg config.Config
+	config.ApplyDefaults(&cfg)
+	store := store.NewMemoryStore()
+	h := &handler{config: cfg, users: store, pictures: store, credentials: store, links: newPictureLinks(cfg)}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users", h.createUser).Methods("POST")
+	r.HandleFunc("/users", h.getUsers).Methods("GET")
+	r.HandleFunc("/users/{id}", h.getUser).Methods("GET")
+	r.HandleFunc("/users/{id}", h.patchUser).Methods("PATCH")
+	r.HandleFunc("/users/{id}", h.deleteUser).Methods("DELETE")
+	return r, store
+}
+
+// storeTestUser stores a user directly, for tests of the routes that read it
+func storeTestUser(t *testing.T, userStore store.UserStore, name, email string) store.User {
+	t.Helper()
+	user, err := userStore.CreateUser(context.Background(), store.User{Name: name, Email: email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// serveTest sends one request to router and returns the recorded response
+func serveTest(router http.Handler, method, path, contentType, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCreateUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		problem string // Problem detail expected, for failures
+	}{
+		{name: "created", body: `{"name":"Bob","email":"bob@example.com"}`, status: http.StatusOK},
+		{name: "name trimmed", body: `{"name":"  Bob  ","email":"bob@example.com"}`, status: http.StatusOK},
+		{name: "email taken", body: `{"name":"Alice","email":"alice@example.com"}`, status: http.StatusConflict, problem: "A user with this email already exists"},
+		{name: "missing name", body: `{"email":"bob@example.com"}`, status: http.StatusUnprocessableEntity, problem: "Validation failed"},
+		{name: "invalid email", body: `{"name":"Bob","email":"bob"}`, status: http.StatusUnprocessableEntity, problem: "Validation failed"},
+		{name: "photo with photo_url", body: `{"name":"Bob","email":"bob@example.com","photo_url":"https://example.com/a.png","photo_base64":"AA=="}`, status: http.StatusUnprocessableEntity, problem: "Validation failed"},
+		{name: "invalid JSON", body: `{"name":`, status: http.StatusBadRequest, problem: "Invalid JSON body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, userStore := newUsersTestRouter(t)
+			storeTestUser(t, userStore, "Alice", "alice@example.com")
+
+			rec := serveTest(router, http.MethodPost, "/users", "application/json", tt.body, nil)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.problem != "" {
+				if detail := decodeProblem(t, rec).Detail; detail != tt.problem {
+					t.Errorf("detail = %q, want %q", detail, tt.problem)
+				}
+				return
+			}
+			var created struct {
+				User store.User `json:"user"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+				t.Fatal(err)
+			}
+			if created.User.ID == 0 || created.User.Name != "Bob" {
+				t.Errorf("user = %+v, want Bob with an ID", created.User)
+			}
+			if _, err := userStore.GetUser(context.Background(), "", created.User.ID); err != nil {
+				t.Errorf("created user not stored: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	router, userStore := newUsersTestRouter(t)
+	alice := storeTestUser(t, userStore, "Alice", "alice@example.com")
+
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+	}{
+		{name: "found", path: "/users/1", status: http.StatusOK},
+		{name: "not found", path: "/users/99", status: http.StatusNotFound},
+		{name: "invalid id", path: "/users/abc", status: http.StatusBadRequest},
+		{name: "not modified", path: "/users/1", header: http.Header{"If-None-Match": {userETag(alice)}}, status: http.StatusNotModified},
+		{name: "modified", path: "/users/1", header: http.Header{"If-None-Match": {`"stale"`}}, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveTest(router, http.MethodGet, tt.path, "", "", tt.header)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if etag := rec.Header().Get("ETag"); etag != userETag(alice) {
+				t.Errorf("ETag = %q, want %q", etag, userETag(alice))
+			}
+			var user store.User
+			if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+				t.Fatal(err)
+			}
+			if user.ID != alice.ID || user.Email != alice.Email {
+				t.Errorf("user = %+v, want %+v", user, alice)
+			}
+		})
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	router, userStore := newUsersTestRouter(t)
+	storeTestUser(t, userStore, "Alice", "alice@example.com")
+	storeTestUser(t, userStore, "Bob", "bob@example.com")
+	storeTestUser(t, userStore, "Carol", "carol@example.com")
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		emails []string
+	}{
+		{name: "all", status: http.StatusOK, emails: []string{"alice@example.com", "bob@example.com", "carol@example.com"}},
+		{name: "search", query: "?q=bob", status: http.StatusOK, emails: []string{"bob@example.com"}},
+		{name: "no match", query: "?q=dave", status: http.StatusOK, emails: []string{}},
+		{name: "unknown sort", query: "?sort=height", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveTest(router, http.MethodGet, "/users"+tt.query, "", "", nil)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var users []store.User
+			if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+				t.Fatal(err)
+			}
+			emails := []string{}
+			for _, user := range users {
+				emails = append(emails, user.Email)
+			}
+			if strings.Join(emails, ",") != strings.Join(tt.emails, ",") {
+				t.Errorf("emails = %q, want %q", emails, tt.emails)
+			}
+		})
+	}
+}
+
+func TestGetUsersUnpaged(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  int
+		want    int  // Users in the response
+		hasNext bool // Whether a Link to the next page comes back
+	}{
+		{name: "one page", stored: defaultPageSize, want: defaultPageSize},
+		{name: "more than a page", stored: defaultPageSize + 1, want: defaultPageSize, hasNext: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, userStore := newUsersTestRouter(t)
+			for i := range tt.stored {
+				storeTestUser(t, userStore, fmt.Sprintf("User %d", i), fmt.Sprintf("user%d@example.com", i))
+			}
+
+			rec := serveTest(router, http.MethodGet, "/users?sort=name", "", "", nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			var users []store.User
+			if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != tt.want {
+				t.Errorf("%d users, want %d", len(users), tt.want)
+			}
+			if total := rec.Header().Get("X-Total-Count"); total != strconv.Itoa(tt.stored) {
+				t.Errorf("X-Total-Count = %s, want %d", total, tt.stored)
+			}
+			link := rec.Header().Get("Link")
+			if !tt.hasNext {
+				if link != "" {
+					t.Errorf("Link = %q, want none", link)
+				}
+				return
+			}
+
+			// The next page picks up after the last user of the first, in the same order
+			next, ok := strings.CutPrefix(link, "<")
+			next, _, cut := strings.Cut(next, `>; rel="next"`)
+			if !ok || !cut {
+				t.Fatalf("Link = %q, want the next page", link)
+			}
+			rec = serveTest(router, http.MethodGet, next, "", "", nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("next page status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			var page UserPage
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Users) != tt.stored-tt.want || page.Users[0].Name <= users[len(users)-1].Name {
+				t.Errorf("next page = %+v, want the %d users after %q", page.Users, tt.stored-tt.want, users[len(users)-1].Name)
+			}
+		})
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		header      http.Header
+		status      int
+		wantName    string
+	}{
+		{name: "renamed", path: "/users/1", contentType: mergePatchContentType, body: `{"name":"Alicia","version":1}`, status: http.StatusOK, wantName: "Alicia"},
+		{name: "plain JSON", path: "/users/1", contentType: "application/json", body: `{"name":"Alicia","version":1}`, status: http.StatusOK, wantName: "Alicia"},
+		{name: "If-Match", path: "/users/1", contentType: mergePatchContentType, body: `{"name":"Alicia"}`, header: http.Header{"If-Match": {userETag(store.User{Version: 1})}}, status: http.StatusOK, wantName: "Alicia"},
+		{name: "If-Match any version", path: "/users/1", contentType: mergePatchContentType, body: `{"name":"Alicia"}`, header: http.Header{"If-Match": {"*"}}, status: http.StatusOK, wantName: "Alicia"},
+		{name: "If-Match list", path: "/users/1", contentType: mergePatchContentType, body: `{"name":"Alicia"}`, header: http.Header{"If-Match": {`W/"7", ` + userETag(store.User{Version: 1})}}, status: http.StatusOK, wantName: "Alicia"},
+		// If-Match uses strong comparison, so a weak tag alone never matches
+		{name: "weak If-Match", path: "/users/1", contentType: mergePatchContentType, body: `{"name":"Alicia"}`, header: http.Header{"If-Match": {`W/"1"`}}, status: http.StatusPreconditionFailed},
+		{name: "stale If-Match", path: "/users/1", contentType: mergePatchContentType, body: `{"name":"Alicia"}`, header: http.Header{"If-Match": {userETag(store.User{Version: 7})}}, status: http.StatusPreconditionFailed},
+		{name: "If-Match any version not found", path: "/users/99", contentType: mergePatchContentType, body: `{"name":"Alicia"}`, header: http.Header{"If-Match": {"*"}}, status: http.StatusNotFound},
+		{name: "stale version", path: "/users/1", contentType: mergePatchContentType, body: `{"name":"Alicia","version":7}`, status: http.StatusConflict},
+		{name: "no version", path: "/users/1", contentType: mergePatchContentType, body: `{"name":"Alicia"}`, status: http.StatusPreconditionRequired},
+		{name: "name removed", path: "/users/1", contentType: mergePatchContentType, body: `{"name":null,"version":1}`, status: http.StatusBadRequest},
+		{name: "invalid email", path: "/users/1", contentType: mergePatchContentType, body: `{"email":"alice","version":1}`, status: http.StatusUnprocessableEntity},
+		{name: "wrong content type", path: "/users/1", contentType: "text/plain", body: `name=Alicia`, status: http.StatusUnsupportedMediaType},
+		{name: "not found", path: "/users/99", contentType: mergePatchContentType, body: `{"name":"Alicia","version":1}`, status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, store := newUsersTestRouter(t)
+			alice := storeTestUser(t, store, "Alice", "alice@example.com")
+			if alice.Version != 1 {
+				t.Fatalf("seeded version = %d, want 1", alice.Version)
+			}
+
+			rec := serveTest(router, http.MethodPatch, tt.path, tt.contentType, tt.body, tt.header)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			stored, err := store.GetUser(context.Background(), "", alice.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantName := tt.wantName
+			if tt.status != http.StatusOK {
+				wantName = alice.Name
+			}
+			if stored.Name != wantName {
+				t.Errorf("stored name = %q, want %q", stored.Name, wantName)
+			}
+		})
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+	}{
+		{name: "deleted", path: "/users/1", status: http.StatusNoContent},
+		{name: "If-Match", path: "/users/1", header: http.Header{"If-Match": {userETag(store.User{Version: 1})}}, status: http.StatusNoContent},
+		{name: "stale If-Match", path: "/users/1", header: http.Header{"If-Match": {userETag(store.User{Version: 7})}}, status: http.StatusPreconditionFailed},
+		{name: "not found", path: "/users/99", status: http.StatusNotFound},
+		{name: "invalid id", path: "/users/abc", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, store := newUsersTestRouter(t)
+			alice := storeTestUser(t, store, "Alice", "alice@example.com")
+
+			rec := serveTest(router, http.MethodDelete, tt.path, "", "", tt.header)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			_, err := store.GetUser(context.Background(), "", alice.ID)
+			if deleted := err != nil; deleted != (tt.status == http.StatusNoContent) {
+				t.Errorf("deleted = %v after %d", deleted, rec.Code)
+			}
+			if tt.status == http.StatusNoContent {
+				if rec := serveTest(router, http.MethodDelete, tt.path, "", "", nil); rec.Code != http.StatusNotFound {
+					t.Errorf("second delete status = %d, want %d", rec.Code, http.StatusNotFound)
+				}
+			}
+		})
+	}
+}
+
+// decodeProblem reads a problem details response
+func decodeProblem(t *testing.T, rec *httptest.ResponseRecorder) Problem {
+	t.Helper()
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/problem+json") {
+		t.Fatalf("Content-Type = %q, want application/problem+json", contentType)
+	}
+	var problem Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	return problem
+}
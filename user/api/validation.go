@@ -0,0 +1,146 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"user/user/blob"
+	"user/user/config"
+)
+
+// validateLink checks that a link fits the link column and contains no control characters
+func validateLink(link string, maxLength int) error {
+	if len(link) > maxLength {
+		return msgLinkTooLong.with(maxLength)
+	}
+	if !utf8.ValidString(link) {
+		return msgLinkInvalidUTF8
+	}
+	for _, c := range link {
+		if unicode.IsControl(c) {
+			return msgLinkControlCharacters
+		}
+	}
+	return nil
+}
+
+// validatePhotoURL checks a client-supplied photo URL is a storable absolute http(s) URL
+func validatePhotoURL(photoURL string, maxLength int) error {
+	if err := validateLink(photoURL, maxLength); err != nil {
+		return msgPhotoURLInvalid.with(err)
+	}
+	u, err := url.Parse(photoURL)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return msgPhotoURLNotAbsolute
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return msgPhotoURLScheme
+	}
+	return nil
+}
+
+// FieldError reports what is wrong with one request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationErrors collects every problem with a request, so clients can show
+// them all at once rather than one per attempt
+type validationErrors []fieldProblem
+
+// fieldProblem is what is wrong with one field, written as a FieldError in the
+// request's language
+type fieldProblem struct {
+	field   string
+	message Message
+}
+
+func (v *validationErrors) check(field string, err error) {
+	if err != nil {
+		*v = append(*v, fieldProblem{field: field, message: messageOf(err)})
+	}
+}
+
+// writeValidationErrors responds 422 with a problem listing the invalid fields
+func writeValidationErrors(w http.ResponseWriter, r *http.Request, errs validationErrors) {
+	writeProblemDetails(w, r, http.StatusUnprocessableEntity, msgValidationFailed, "", errs)
+}
+
+// validateName checks a trimmed user name is present, fits and is printable
+func validateName(name string, maxLength int) error {
+	if name == "" {
+		return msgRequired
+	}
+	if !utf8.ValidString(name) {
+		return msgInvalidUTF8
+	}
+	if utf8.RuneCountInString(name) > maxLength {
+		return msgMaxLength.with(maxLength)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return msgControlCharacters
+		}
+	}
+	return nil
+}
+
+// validateEmail checks a trimmed email is a bare address with a dotted domain
+func validateEmail(email string) error {
+	if email == "" {
+		return msgRequired
+	}
+	if len(email) > config.MaxEmailColumnLength {
+		return msgMaxLength.with(config.MaxEmailColumnLength)
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || address.Name != "" {
+		return msgInvalidEmail
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	if !strings.Contains(strings.Trim(domain, "."), ".") {
+		return msgInvalidEmail
+	}
+	return nil
+}
+
+// validatePhotoFile checks an uploaded picture's size and, sniffed from its
+// content rather than the client's Content-Type, its type
+func validatePhotoFile(header *multipart.FileHeader, cfg config.Config) error {
+	file, err := header.Open()
+	if err != nil {
+		return msgUnreadable
+	}
+	defer file.Close()
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return msgUnreadable
+	}
+	return validatePhoto(header.Filename, header.Size, sniff[:n], cfg)
+}
+
+// validatePhoto checks a picture of size bytes stored as filename, given at
+// least the first 512 bytes of it to sniff its type from
+func validatePhoto(filename string, size int64, head []byte, cfg config.Config) error {
+	if size > cfg.Validation.MaxPhotoBytes {
+		return msgMaxBytes.with(cfg.Validation.MaxPhotoBytes)
+	}
+	if err := validateLink(blob.Link(cfg.Azure.PicturesContainer, filename), cfg.Validation.MaxLinkLength); err != nil {
+		return msgFilenameInvalid.with(err)
+	}
+	contentType := http.DetectContentType(head)
+	if !slices.Contains(cfg.Validation.PhotoContentTypes, contentType) {
+		return msgContentTypeNotAllowed.with(strings.Join(cfg.Validation.PhotoContentTypes, ", "), contentType)
+	}
+	return nil
+}
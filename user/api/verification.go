@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+// Audience of email verification tokens, so no other token of this service passes for one
+const verificationAudience = "email-verification"
+
+// emailVerifier signs the links that prove a user owns their email and mails
+// them out. A nil emailVerifier sends nothing.
+type emailVerifier struct {
+	secret  []byte
+	ttl     time.Duration
+	linkURL string // Page the link opens; empty derives this service's /v1/verify from the request
+	mailer  Mailer
+}
+
+// newEmailVerifier returns the verifier configured in config.Verification, or
+// nil when verification is off
+func newEmailVerifier(cfg config.Config, mailer Mailer) *emailVerifier {
+	if cfg.Verification.Secret == "" {
+		return nil
+	}
+	return &emailVerifier{
+		secret:  []byte(cfg.Verification.Secret),
+		ttl:     time.Duration(cfg.Verification.TTLHours) * time.Hour,
+		linkURL: cfg.Verification.LinkURL,
+		mailer:  mailer,
+	}
+}
+
+// token signs a verification token for the user's current email, which stops
+// working once the email changes
+func (v *emailVerifier) token(user store.User) (string, error) {
+	now := time.Now()
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":   config.SessionIssuer,
+		"aud":   verificationAudience,
+		"sub":   strconv.FormatInt(user.ID, 10),
+		"email": user.Email,
+		"tid":   user.TenantID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(v.ttl).Unix(),
+	}).SignedString(v.secret)
+}
+
+// parse checks a verification token and returns the user and email it verifies
+func (v *emailVerifier) parse(token string) (tenant string, id int64, email string, err error) {
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) { return v.secret, nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(config.SessionIssuer),
+		jwt.WithAudience(verificationAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway),
+	)
+	if err != nil {
+		return "", 0, "", err
+	}
+	subject, _ := claims.GetSubject()
+	id, err = strconv.ParseInt(subject, 10, 64)
+	email, _ = claims["email"].(string)
+	tenant, _ = claims["tid"].(string)
+	if err != nil || email == "" {
+		return "", 0, "", errors.New("verification token lacks its user")
+	}
+	return tenant, id, email, nil
+}
+
+// send mails the user a link to verify their email, unless it already is. A
+// failure is logged rather than failing the change that prompted it.
+func (v *emailVerifier) send(r *http.Request, user store.User) {
+	if v == nil || user.EmailVerifiedAt != nil {
+		return
+	}
+	ctx := context.WithoutCancel(r.Context())
+	token, err := v.token(user)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error signing verification token", "user_id", user.ID, "error", err)
+		return
+	}
+	link := v.linkURL
+	if link == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		link = scheme + "://" + r.Host + "/" + string(apiV1) + "/verify"
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid verification link", "link", link, "error", err)
+		return
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+
+	err = v.mailer.Send(ctx, MailMessage{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body:    "Hello " + user.Name + ",\n\nPlease confirm this is your email address by opening the link below. It works for " + strconv.Itoa(int(v.ttl.Hours())) + " hours.\n\n" + u.String() + "\n\nIf you didn't expect this email, you can ignore it.\n",
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending verification email", "user_id", user.ID, "error", err)
+	}
+}
+
+// emailNotVerified writes the response refusing a session to a user whose
+// email isn't verified yet
+func emailNotVerified(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusForbidden, msgEmailNotVerified)
+}
+
+// API to Verify an Email (GET /verify?token=)
+//
+// Opened from the link emailed to the user, so it needs no credentials besides
+// the token, and answers with no more than the token already holds. Following a
+// link again succeeds without changing anything.
+func (h *handler) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	tenant, id, email, err := h.verifier.parse(r.URL.Query().Get("token"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidVerificationLink)
+		return
+	}
+	user, err := h.users.VerifyEmail(r.Context(), tenant, id, email)
+	if errors.Is(err, store.ErrUserNotFound) {
+		// Deleted since, or the email changed and needs a link of its own
+		writeProblem(w, r, http.StatusGone, msgVerificationLinkStale)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorVerifyingEmail)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"message":         "Email verified",
+		"email":           user.Email,
+		"emailVerifiedAt": user.EmailVerifiedAt,
+	})
+}
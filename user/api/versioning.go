@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// API versions, each mounted under /<version> with its own routes. A new version
+// gets its own subrouter from apiVersionRouter and registers only what it
+// changes or adds; the older versions' routes stay in place beside it.
+const (
+	apiV1 = "v1"
+
+	// Version the unversioned paths from before /v1 are served by
+	legacyAPIVersion = apiV1
+)
+
+// Path prefixes that were served unversioned before /v1. Probes, metrics and
+// the docs stay unversioned.
+var legacyAPIPrefixes = []string{"/users", "/auth", "/admin"}
+
+// apiVersionRouter returns the subrouter a version's routes are registered on
+func apiVersionRouter(r *mux.Router, version string) *mux.Router {
+	return r.PathPrefix("/" + version).Subrouter()
+}
+
+// versionedPath returns path as served by version
+func versionedPath(version, path string) string {
+	return "/" + version + path
+}
+
+// isLegacyAPIPath reports whether path is an API path without a version
+func isLegacyAPIPath(path string) bool {
+	for _, prefix := range legacyAPIPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyPathShim serves unversioned API paths as their legacyAPIVersion
+// equivalents, marking the responses with a Deprecation header and linking the
+// versioned path. It runs before routing, so routes are only registered once.
+func legacyPathShim(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLegacyAPIPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		successor := versionedPath(legacyAPIVersion, r.URL.Path)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+
+		r = r.Clone(r.Context())
+		r.URL.Path = successor
+		if r.URL.RawPath != "" {
+			r.URL.RawPath = versionedPath(legacyAPIVersion, r.URL.RawPath)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
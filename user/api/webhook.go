@@ -0,0 +1,373 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"user/user/config"
+	"user/user/events"
+	"user/user/store"
+	"user/user/telemetry"
+)
+
+// Webhook delivery tuning
+const (
+	webhookQueueSize    = 256
+	webhookBaseDelay    = time.Second
+	webhookSignatureHdr = "X-Signature"
+)
+
+// Upper bounds of the webhooks and webhook_deliveries columns
+const (
+	maxWebhookURLLength    = 2048
+	maxWebhookSecretLength = 255
+	maxWebhookErrorLength  = 1000
+)
+
+// Events registered webhooks may subscribe to
+var webhookEventTypes = []string{events.UserCreated, events.UserUpdated, events.UserDeleted}
+
+// A pending POST of one event to one webhook URL
+type webhookDelivery struct {
+	ID        string // Sent as X-Delivery-ID with every attempt, so receivers can drop repeats
+	URL       string
+	Secret    []byte
+	WebhookID int64 // Registered webhook whose attempts are logged; 0 for webhooks.urls
+	EventType string
+	UserID    int64
+	Body      []byte
+	Trace     trace.SpanContext // Of the request that made the change, which continues to the receiver
+}
+
+// webhookDispatcher posts user events to the configured webhook URLs and the
+// registered webhooks from a bounded pool of workers, so slow receivers never
+// hold up API responses
+type webhookDispatcher struct {
+	urls        []string
+	secret      []byte
+	store       store.WebhookStore
+	stream      *eventStream // Also handed every event, when it is fed from here
+	maxAttempts int
+	client      *http.Client
+
+	mu     sync.RWMutex // Guards sends to queue against close
+	closed bool
+	queue  chan webhookDelivery
+}
+
+func newWebhookDispatcher(cfg config.Config, store store.WebhookStore, stream *eventStream) *webhookDispatcher {
+	return &webhookDispatcher{
+		urls:        cfg.Webhooks.URLs,
+		secret:      []byte(cfg.Webhooks.Secret),
+		store:       store,
+		stream:      stream,
+		maxAttempts: cfg.Webhooks.MaxAttempts,
+		client:      &http.Client{Timeout: config.Seconds(cfg.Webhooks.TimeoutSeconds)},
+		queue:       make(chan webhookDelivery, webhookQueueSize),
+	}
+}
+
+// run delivers queued events until the queue is closed and drained. Once ctx is
+// cancelled, failed deliveries are no longer retried.
+func (d *webhookDispatcher) run(ctx context.Context) {
+	for delivery := range d.queue {
+		d.deliver(ctx, delivery)
+	}
+}
+
+// close stops accepting events; workers exit after draining the queue
+func (d *webhookDispatcher) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	close(d.queue)
+}
+
+// notify queues an event for the configured webhook URLs, which only receive
+// created users, and for the user's tenant's webhooks subscribed to it. A nil
+// dispatcher sends nothing. Events are dropped, and logged, when the queue is full.
+func (d *webhookDispatcher) notify(ctx context.Context, eventType string, user store.User) {
+	if d == nil {
+		return
+	}
+	d.stream.publish(eventType, user)
+	body, err := json.Marshal(user)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error encoding webhook payload", "user_id", user.ID, "error", err)
+		return
+	}
+	var deliveries []webhookDelivery
+	if eventType == events.UserCreated {
+		for _, url := range d.urls {
+			deliveries = append(deliveries, webhookDelivery{URL: url, Secret: d.secret})
+		}
+	}
+	registered, err := d.store.ListSubscribedWebhooks(ctx, user.TenantID, eventType)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching webhooks", "event_type", eventType, "user_id", user.ID, "error", err)
+	}
+	for _, webhook := range registered {
+		deliveries = append(deliveries, webhookDelivery{URL: webhook.URL, Secret: []byte(webhook.Secret), WebhookID: webhook.ID})
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		slog.WarnContext(ctx, "Webhooks shut down, dropping event", "event_type", eventType, "user_id", user.ID)
+		return
+	}
+	for _, delivery := range deliveries {
+		delivery.ID, delivery.EventType, delivery.UserID, delivery.Body = newRequestID(), eventType, user.ID, body
+		delivery.Trace = trace.SpanContextFromContext(ctx)
+		select {
+		case d.queue <- delivery:
+		default:
+			slog.ErrorContext(ctx, "Webhook queue full, dropping event", "url", delivery.URL, "event_type", eventType, "user_id", user.ID)
+		}
+	}
+}
+
+// deliver posts an event, retrying with exponential backoff. Attempts at
+// registered webhooks are logged to the store.
+func (d *webhookDispatcher) deliver(ctx context.Context, delivery webhookDelivery) {
+	delay := webhookBaseDelay
+	for attempt := 1; ; attempt++ {
+		status, err := d.post(delivery)
+		d.record(delivery, attempt, status, err)
+		if err == nil {
+			slog.Info("Webhook delivered", "url", delivery.URL, "event_type", delivery.EventType, "attempt", attempt)
+			return
+		}
+		if attempt >= d.maxAttempts {
+			slog.Error("Webhook delivery failed", "url", delivery.URL, "event_type", delivery.EventType, "attempts", attempt, "error", err)
+			return
+		}
+		slog.Warn("Webhook delivery failed, retrying", "url", delivery.URL, "event_type", delivery.EventType, "attempt", attempt, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			slog.Error("Webhook delivery abandoned on shutdown", "url", delivery.URL, "event_type", delivery.EventType, "attempts", attempt)
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post makes one attempt at a delivery, returning the receiver's status if it
+// answered. The attempt's span carries on the trace of the change, in the
+// request's traceparent header too.
+func (d *webhookDispatcher) post(delivery webhookDelivery) (status int, err error) {
+	ctx, span := telemetry.StartSpan(trace.ContextWithRemoteSpanContext(context.Background(), delivery.Trace), "webhook deliver",
+		semconv.HTTPRequestMethodKey.String(http.MethodPost), attribute.String("webhook.event_type", delivery.EventType))
+	defer func() {
+		if status != 0 {
+			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		}
+		telemetry.EndSpan(span, err)
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return 0, err
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Type", delivery.EventType)
+	req.Header.Set("X-Delivery-ID", delivery.ID)
+	req.Header.Set(webhookSignatureHdr, signWebhookPayload(delivery.Secret, delivery.Body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// record logs an attempt at a registered webhook. It runs after shutdown began
+// too, so it doesn't take the workers' context.
+func (d *webhookDispatcher) record(delivery webhookDelivery, attempt, status int, err error) {
+	if delivery.WebhookID == 0 {
+		return
+	}
+	entry := store.WebhookAttempt{
+		WebhookID:  delivery.WebhookID,
+		DeliveryID: delivery.ID,
+		EventType:  delivery.EventType,
+		UserID:     delivery.UserID,
+		Attempt:    attempt,
+		StatusCode: status,
+		Succeeded:  err == nil,
+	}
+	if err != nil {
+		entry.Error = truncate(err.Error(), maxWebhookErrorLength)
+	}
+	if err := d.store.RecordWebhookAttempt(context.Background(), entry); err != nil {
+		slog.Error("Error logging webhook attempt", "webhook_id", delivery.WebhookID, "error", err)
+	}
+}
+
+// signWebhookPayload returns the X-Signature value: the hex HMAC-SHA256 of the
+// body under the shared secret, so receivers can check who sent it
+func signWebhookPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Body of POST /webhooks
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"` // Generated when empty
+	Events []string `json:"events,omitempty"` // Every event type when empty
+}
+
+// validateWebhookURL checks a webhook URL is an absolute http or https URL
+func validateWebhookURL(link string) error {
+	if len(link) > maxWebhookURLLength {
+		return msgMaxLength.with(maxWebhookURLLength)
+	}
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return msgWebhookURLInvalid
+	}
+	return nil
+}
+
+// API to Register a Webhook (POST /webhooks)
+//
+// The response holds the secret signing the payloads, which is never shown again.
+func (h *handler) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !rejectOversizedBody(w, r, err) {
+			writeProblem(w, r, http.StatusBadRequest, msgInvalidJSON)
+		}
+		return
+	}
+	webhook := store.Webhook{
+		TenantID: tenantFromContext(r.Context()),
+		URL:      strings.TrimSpace(req.URL),
+		Secret:   req.Secret,
+		Events:   req.Events,
+	}
+	var errs validationErrors
+	errs.check("url", validateWebhookURL(webhook.URL))
+	if len(webhook.Secret) > maxWebhookSecretLength {
+		errs.check("secret", msgMaxLength.with(maxWebhookSecretLength))
+	}
+	if len(webhook.Events) == 0 {
+		webhook.Events = slices.Clone(webhookEventTypes)
+	}
+	for _, event := range webhook.Events {
+		if !slices.Contains(webhookEventTypes, event) {
+			errs.check("events", msgUnknownEvents.with(strings.Join(webhookEventTypes, ", ")))
+			break
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	slices.Sort(webhook.Events)
+	webhook.Events = slices.Compact(webhook.Events)
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, msgErrorGeneratingSecret)
+			return
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	created, err := h.webhookStore.CreateWebhook(r.Context(), webhook)
+	if err != nil {
+		dbError(w, r, err, msgErrorSavingWebhook)
+		return
+	}
+	created.Secret = webhook.Secret
+	w.Header().Set("Location", r.URL.Path+"/"+strconv.FormatInt(created.ID, 10))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// API to List Webhooks (GET /webhooks)
+func (h *handler) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := h.webhookStore.ListWebhooks(r.Context(), tenantFromContext(r.Context()))
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingWebhooks)
+		return
+	}
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+// API to Delete a Webhook (DELETE /webhooks/{id})
+//
+// Deliveries already queued are still attempted, but no longer logged.
+func (h *handler) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidWebhookID)
+		return
+	}
+	err = h.webhookStore.DeleteWebhook(r.Context(), tenantFromContext(r.Context()), id)
+	if errors.Is(err, store.ErrWebhookNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgWebhookNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorDeletingWebhook)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// API to List a Webhook's Delivery Attempts (GET /webhooks/{id}/deliveries[?limit=])
+//
+// Newest first.
+func (h *handler) listWebhookAttempts(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		writeProblem(w, r, http.StatusBadRequest, msgInvalidWebhookID)
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, messageOf(err))
+		return
+	}
+	attempts, err := h.webhookStore.ListWebhookAttempts(r.Context(), tenantFromContext(r.Context()), id, limit)
+	if errors.Is(err, store.ErrWebhookNotFound) {
+		writeProblem(w, r, http.StatusNotFound, msgWebhookNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, r, err, msgErrorFetchingWebhookDeliveries)
+		return
+	}
+	json.NewEncoder(w).Encode(attempts)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"user/user/blob"
+	"user/user/config"
+	"user/user/events"
+)
+
+// initAzure makes the clients shared by every request and worker once at
+// startup, as initDB does the database pool, so their connections are reused
+// instead of set up on every call; they're all safe for concurrent use. Blob
+// storage and event publishing go through interfaces, so anything else
+// implementing them can stand in for Azure; the Service Bus client is nil when
+// something does.
+func initAzure(cfg config.Config) (blob.Storage, *azservicebus.Client, events.Publisher) {
+	var blobs blob.Storage
+	var err error
+	if cfg.Azure.BlobDriver == config.BlobDriverFilesystem {
+		slog.Warn("Storing blobs in a local directory", "directory", cfg.Azure.BlobDirectory)
+		blobs, err = blob.NewFileStorage(cfg.Azure.BlobDirectory)
+	} else {
+		blobs, err = blob.NewAzureStorage(cfg)
+	}
+	if err != nil {
+		fatal("Error creating blob client", "error", err)
+	}
+	if cfg.Azure.ServiceBusDriver == config.ServiceBusDriverMemory {
+		slog.Warn("Publishing events to in-process queues; nothing outside this process receives them")
+		return blobs, nil, events.NewMemoryPublisher(cfg)
+	}
+	serviceBus, err := events.NewServiceBusClient(cfg)
+	if err != nil {
+		fatal("Error creating service bus client", "error", err)
+	}
+	publisher, err := events.NewServiceBusPublisher(serviceBus, cfg)
+	if err != nil {
+		fatal("Error creating service bus senders", "error", err)
+	}
+	return blobs, serviceBus, publisher
+}
+
+// How long startup waits on the storage account before giving up on it
+const blobStartupTimeout = 30 * time.Second
+
+// checkBlobStorage makes sure the picture container is there to upload to,
+// creating the containers first with azure.auto_create_container, so an
+// unreachable account or a missing container stops startup instead of failing
+// every upload
+func checkBlobStorage(cfg config.Config, blobs blob.Storage) {
+	ctx, cancel := context.WithTimeout(context.Background(), blobStartupTimeout)
+	defer cancel()
+	// Directories cost nothing to create, and a fresh one has none
+	if cfg.Azure.AutoCreateContainer || cfg.Azure.BlobDriver == config.BlobDriverFilesystem {
+		if err := blob.EnsureContainers(ctx, cfg, blobs); err != nil {
+			fatal("Error preparing blob containers; is the storage account reachable?", "error", err)
+		}
+	}
+	container := cfg.Azure.PicturesContainer
+	err := blobs.CheckContainer(ctx, container)
+	if errors.Is(err, blob.ErrContainerNotFound) {
+		fatal("Blob container does not exist; create it or set azure.auto_create_container", "container", container)
+	}
+	if err != nil {
+		fatal("Cannot reach the storage account", "container", container, "error", err)
+	}
+	slog.Info("Blob container is ready", "container", container)
+}
+
+// How long closing the Service Bus links may hold up exit
+const azureCloseTimeout = 10 * time.Second
+
+// closeAzure closes the publisher and the Service Bus connection, if any, once
+// nothing sends or receives
+func closeAzure(publisher events.Publisher, serviceBus *azservicebus.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), azureCloseTimeout)
+	defer cancel()
+	publisher.Close(ctx)
+	if serviceBus == nil {
+		return
+	}
+	if err := serviceBus.Close(ctx); err != nil {
+		slog.Warn("Error closing Service Bus connection", "error", err)
+	}
+}
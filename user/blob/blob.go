@@ -0,0 +1,256 @@
+package blob
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"user/user/config"
+	"user/user/resilience"
+	"user/user/telemetry"
+)
+
+// Containers beside the pictures' one
+const (
+	ThumbnailsContainer   = "thumbnails"    // Profile picture thumbnails, stored under the picture's name
+	DataExportsContainer  = "data-exports"  // Private; staged data exports are uploaded to it
+	PhotoUploadsContainer = "photo-uploads" // Chunked picture uploads' chunks, as the uncommitted blocks of one blob per upload
+	QuarantineContainer   = "quarantine"    // Uploads a scan flagged, for whoever investigates them
+)
+
+// Errors of Storage that callers act on
+var (
+	ErrNotFound          = errors.New("blob not found")
+	ErrContainerNotFound = errors.New("blob container not found")
+	ErrContainerExists   = errors.New("blob container already exists")
+	ErrChecksumMismatch  = errors.New("blob content doesn't match its checksum")
+)
+
+// Storage holds the pictures, thumbnails, data exports, chunked uploads
+// and quarantined uploads, each kind in a container of its own: Azure Blob
+// Storage, through AzureStorage. Its methods are the bare operations;
+// Upload and the other helpers add the tracing, retries and metrics.
+type Storage interface {
+	// CreateContainer creates a container whose blobs are readable by anyone
+	// as access says, or returns ErrContainerExists
+	CreateContainer(ctx context.Context, name, access string) error
+	// CheckContainer returns ErrContainerNotFound unless the container exists
+	CheckContainer(ctx context.Context, name string) error
+	// Upload stores body as the named blob, replacing any blob by that name.
+	// The storage checks the body against MD5s computed on the way and keeps
+	// the MD5 of all of it as the blob's Content-MD5, whatever headers say.
+	Upload(ctx context.Context, container, name string, body io.Reader, headers Headers, metadata map[string]string) error
+	// SetHeaders replaces the headers a blob is served with
+	SetHeaders(ctx context.Context, container, name string, headers Headers) error
+	// Download opens a blob for reading, or returns ErrNotFound; the caller closes it
+	Download(ctx context.Context, container, name string) (io.ReadCloser, error)
+	// Properties reads a blob's properties without its content, or returns ErrNotFound
+	Properties(ctx context.Context, container, name string) (Properties, error)
+	// Delete removes a blob, or returns ErrNotFound
+	Delete(ctx context.Context, container, name string) error
+	// List calls page with the container's blobs, up to pageSize at a time; a
+	// blob whose last modification is unknown has a zero LastModified
+	List(ctx context.Context, container string, pageSize int, page func([]Properties) error) error
+	// StageBlock stores data as an uncommitted block of the named blob,
+	// returning ErrChecksumMismatch if checksum, its MD5, doesn't match
+	StageBlock(ctx context.Context, container, name, blockID string, data, checksum []byte) error
+	// UncommittedBlocks returns the sizes of a blob's staged blocks by block
+	// ID; none for a blob nothing was staged for
+	UncommittedBlocks(ctx context.Context, container, name string) (map[string]int64, error)
+	// CommitBlocks makes the blob the staged blocks given, in order
+	CommitBlocks(ctx context.Context, container, name string, blockIDs []string) error
+	// Signer returns a signer of read-only blob URLs that work until expiresAt
+	Signer(ctx context.Context, expiresAt time.Time) (Signer, error)
+}
+
+// Signer makes read-only URLs for blobs, all expiring at the same time
+type Signer interface {
+	Sign(container, name string) (string, error)
+}
+
+// Headers are the HTTP headers a blob is served with; empty ones are left unset
+type Headers struct {
+	ContentType        string
+	ContentDisposition string
+	ContentMD5         []byte
+}
+
+// Properties describes a stored blob
+type Properties struct {
+	Name          string
+	ETag          string // Empty if unknown
+	ContentType   string
+	ContentLength int64
+	LastModified  time.Time
+}
+
+// EnsureContainers creates the picture, thumbnail, data export, chunked upload and quarantine containers if they don't exist yet.
+// The access level only applies to a picture container created here; an existing one keeps
+// its own, which decides whether clients can read links directly or need a SAS URL.
+func EnsureContainers(ctx context.Context, cfg config.Config, blobs Storage) error {
+	for _, name := range []string{cfg.Azure.PicturesContainer, ThumbnailsContainer} {
+		err := blobs.CreateContainer(ctx, name, cfg.Azure.ContainerAccess)
+		if errors.Is(err, ErrContainerExists) {
+			slog.Info("Blob container already exists", "container", name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create container %s: %w", name, err)
+		}
+		slog.Info("Created blob container", "container", name, "access", cfg.Azure.ContainerAccess)
+	}
+
+	// Staged data exports are personal data, only ever shared through a SAS URL,
+	// and neither chunks of uploads in progress nor quarantined uploads are
+	// anyone's to read
+	for _, name := range []string{DataExportsContainer, PhotoUploadsContainer, QuarantineContainer} {
+		err := blobs.CreateContainer(ctx, name, config.ContainerAccessPrivate)
+		if err != nil && !errors.Is(err, ErrContainerExists) {
+			return fmt.Errorf("failed to create container %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ConfigProblems checks azure.pictures_container names none of the
+// containers kept for other blobs
+func ConfigProblems(cfg config.Config) []string {
+	switch name := cfg.Azure.PicturesContainer; name {
+	case ThumbnailsContainer, DataExportsContainer, PhotoUploadsContainer, QuarantineContainer:
+		return []string{fmt.Sprintf("azure.pictures_container may not be %q, which holds other blobs", name)}
+	}
+	return nil
+}
+
+// Link builds the link stored for a profile picture uploaded to container
+func Link(container, filename string) string {
+	return fmt.Sprintf("%s/%s", container, filename)
+}
+
+// NameFromLink returns the blob name behind a link produced by Link.
+// Links supplied by clients as photo_url don't point into our container.
+func NameFromLink(container, link string) (string, bool) {
+	return strings.CutPrefix(link, container+"/")
+}
+
+// UploadAndLink uploads a picture, returning its link and base64 MD5
+func UploadAndLink(ctx context.Context, blobs Storage, container string, file io.Reader, filename, original, contentType string) (string, string, error) {
+	checksum, err := Upload(ctx, blobs, container, file, filename, original, contentType)
+	if err != nil {
+		return "", "", err
+	}
+	return Link(container, filename), checksum, nil
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// Upload stores an image of the given type in the given container and returns its base64 MD5.
+// A non-empty original is the client's filename for it, kept in the OriginalFilename metadata
+// percent-encoded, as metadata must be ASCII.
+// The file is streamed, and Storage has the blocks it is sent in checked
+// against their MD5 and sets the blob's Content-MD5, so downloads can be
+// checked too.
+func Upload(ctx context.Context, blobs Storage, containerName string, file io.Reader, filename, original, contentType string) (string, error) {
+	metadata := map[string]string{
+		"ContentType": contentType,
+	}
+	if original != "" {
+		metadata["OriginalFilename"] = url.PathEscape(original)
+	}
+	hash := md5.New()
+	var size byteCounter
+	start := time.Now()
+	ctx, span := telemetry.StartSpan(ctx, "blob upload", attribute.String("blob.container", containerName), attribute.String("blob.name", filename))
+	upload := func() error {
+		hash.Reset()
+		size = 0
+		return blobs.Upload(ctx, containerName, filename, io.TeeReader(file, io.MultiWriter(hash, &size)), Headers{ContentType: contentType}, metadata)
+	}
+	// One slot is held for the whole upload, retries included
+	err := resilience.WithBulkhead(ctx, resilience.DependencyBlob, func() error {
+		if seeker, ok := file.(io.Seeker); ok {
+			// Rewind before each attempt so a retried upload sends the whole file
+			return resilience.WithRetry(ctx, resilience.DependencyBlob, func() error {
+				if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				return upload()
+			})
+		}
+		// A consumed stream can't be replayed, so it only goes through the breaker
+		return resilience.WithBreaker(resilience.DependencyBlob, upload)
+	})
+	telemetry.BlobUploadsTotal.WithLabelValues(resilience.ResultLabel(err)).Inc()
+	telemetry.BlobUploadDuration.WithLabelValues(resilience.ResultLabel(err)).Observe(time.Since(start).Seconds())
+	if err == nil {
+		telemetry.BlobUploadBytes.Observe(float64(size))
+	}
+	telemetry.EndSpan(span, err)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload to blob: %w", err)
+	}
+
+	checksum := base64.StdEncoding.EncodeToString(hash.Sum(nil))
+	slog.Debug("Uploaded blob", "container", containerName, "blob", filename, "bytes", int64(size), "md5", checksum, "duration", time.Since(start))
+	return checksum, nil
+}
+
+// Delete removes a blob from the given container
+func Delete(ctx context.Context, blobs Storage, containerName string, filename string) error {
+	ctx, span := telemetry.StartSpan(ctx, "blob delete", attribute.String("blob.container", containerName), attribute.String("blob.name", filename))
+	err := resilience.WithRetry(ctx, resilience.DependencyBlob, func() error {
+		return blobs.Delete(ctx, containerName, filename)
+	})
+	telemetry.EndSpan(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to delete blob: %v", err)
+	}
+	return nil
+}
+
+// Download opens a blob in the given container for reading; the caller closes it
+func Download(ctx context.Context, blobs Storage, containerName string, filename string) (io.ReadCloser, error) {
+	ctx, span := telemetry.StartSpan(ctx, "blob download", attribute.String("blob.container", containerName), attribute.String("blob.name", filename))
+	var body io.ReadCloser
+	err := resilience.WithRetry(ctx, resilience.DependencyBlob, func() error {
+		var err error
+		body, err = blobs.Download(ctx, containerName, filename)
+		return err
+	})
+	telemetry.EndSpan(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download blob: %w", err)
+	}
+	return body, nil
+}
+
+// Stat reads a blob's headers, such as its ETag, without its content
+func Stat(ctx context.Context, blobs Storage, containerName string, filename string) (Properties, error) {
+	ctx, span := telemetry.StartSpan(ctx, "blob properties", attribute.String("blob.container", containerName), attribute.String("blob.name", filename))
+	var props Properties
+	err := resilience.WithRetry(ctx, resilience.DependencyBlob, func() error {
+		var err error
+		props, err = blobs.Properties(ctx, containerName, filename)
+		return err
+	})
+	telemetry.EndSpan(span, err)
+	if err != nil {
+		return Properties{}, fmt.Errorf("failed to read blob properties: %w", err)
+	}
+	return props, nil
+}
@@ -0,0 +1,306 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+
+	"user/user/config"
+)
+
+// Connection string of Azurite's blob service on its default port, with the
+// well-known development account key, for UseDevelopmentStorage=true, which
+// the SDK doesn't read itself
+const azuriteConnectionString = "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;" +
+	"AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tK/K1SZFPTOtr/KBHBeksoGMGw==;" +
+	"BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;"
+
+// newBlobClient connects to the storage account the configured way
+func newBlobClient(cfg config.Config) (*azblob.Client, error) {
+	if cfg.Azure.Auth == config.AzureAuthDefaultCredential {
+		credential, err := config.AzureCredential()
+		if err != nil {
+			return nil, err
+		}
+		return azblob.NewClient(cfg.Azure.BlobAccountURL, credential, nil)
+	}
+	connectionString := cfg.Azure.BlobConnectionString
+	if config.ParseAzureConnectionString(connectionString)["usedevelopmentstorage"] == "true" {
+		connectionString = azuriteConnectionString
+	}
+	return azblob.NewClientFromConnectionString(connectionString, nil)
+}
+
+// AzureStorage is Storage on an Azure Storage account
+type AzureStorage struct {
+	client *azblob.Client
+	// With azure.auth default_credential there is no account key, so SAS URLs
+	// are signed with a user delegation key instead
+	delegated bool
+}
+
+// NewAzureStorage connects to the storage account the configured way
+func NewAzureStorage(cfg config.Config) (*AzureStorage, error) {
+	client, err := newBlobClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &AzureStorage{client: client, delegated: cfg.Azure.Auth == config.AzureAuthDefaultCredential}, nil
+}
+
+// blobError marks the errors of the blob service that callers tell apart with
+// their sentinel, keeping the service's error for retries to classify
+func blobError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case bloberror.HasCode(err, bloberror.BlobNotFound):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case bloberror.HasCode(err, bloberror.ContainerNotFound):
+		return fmt.Errorf("%w: %w", ErrContainerNotFound, err)
+	case bloberror.HasCode(err, bloberror.ContainerAlreadyExists):
+		return fmt.Errorf("%w: %w", ErrContainerExists, err)
+	case bloberror.HasCode(err, bloberror.MD5Mismatch):
+		return fmt.Errorf("%w: %w", ErrChecksumMismatch, err)
+	}
+	return err
+}
+
+func (s *AzureStorage) blob(containerName, name string) *blob.Client {
+	return s.client.ServiceClient().NewContainerClient(containerName).NewBlobClient(name)
+}
+
+func (s *AzureStorage) blockBlob(containerName, name string) *blockblob.Client {
+	return s.client.ServiceClient().NewContainerClient(containerName).NewBlockBlobClient(name)
+}
+
+func (s *AzureStorage) CreateContainer(ctx context.Context, name, access string) error {
+	var options azblob.CreateContainerOptions
+	switch access {
+	case config.ContainerAccessBlob:
+		options.Access = toPtr(container.PublicAccessTypeBlob)
+	case config.ContainerAccessContainer:
+		options.Access = toPtr(container.PublicAccessTypeContainer)
+	}
+	_, err := s.client.CreateContainer(ctx, name, &options)
+	return blobError(err)
+}
+
+func (s *AzureStorage) CheckContainer(ctx context.Context, name string) error {
+	_, err := s.client.ServiceClient().NewContainerClient(name).GetProperties(ctx, nil)
+	return blobError(err)
+}
+
+// Size of the blocks Upload stages
+const uploadBlockSize = 4 << 20
+
+// Upload stages the body in blocks, each with its MD5 for Azure to verify
+// before accepting it, and commits them with the MD5 of the whole body as the
+// blob's Content-MD5
+func (s *AzureStorage) Upload(ctx context.Context, containerName, name string, body io.Reader, headers Headers, metadata map[string]string) error {
+	hash := md5.New()
+	var blockIDs []string
+	block := make([]byte, uploadBlockSize)
+	for {
+		n, err := io.ReadFull(body, block)
+		if n > 0 {
+			sum := md5.Sum(block[:n])
+			hash.Write(block[:n])
+			blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%06d", len(blockIDs))))
+			if err := s.StageBlock(ctx, containerName, name, blockID, block[:n], sum[:]); err != nil {
+				return err
+			}
+			blockIDs = append(blockIDs, blockID)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	headers.ContentMD5 = hash.Sum(nil)
+	options := &blockblob.CommitBlockListOptions{HTTPHeaders: headers.azure()}
+	if len(metadata) > 0 {
+		options.Metadata = map[string]*string{}
+		for key, value := range metadata {
+			options.Metadata[key] = toPtr(value)
+		}
+	}
+	_, err := s.blockBlob(containerName, name).CommitBlockList(ctx, blockIDs, options)
+	return blobError(err)
+}
+
+func (s *AzureStorage) SetHeaders(ctx context.Context, containerName, name string, headers Headers) error {
+	_, err := s.blob(containerName, name).SetHTTPHeaders(ctx, *headers.azure(), nil)
+	return blobError(err)
+}
+
+func (s *AzureStorage) Download(ctx context.Context, containerName, name string) (io.ReadCloser, error) {
+	resp, err := s.client.DownloadStream(ctx, containerName, name, nil)
+	if err != nil {
+		return nil, blobError(err)
+	}
+	return resp.Body, nil
+}
+
+func (s *AzureStorage) Properties(ctx context.Context, containerName, name string) (Properties, error) {
+	props, err := s.blob(containerName, name).GetProperties(ctx, nil)
+	if err != nil {
+		return Properties{}, blobError(err)
+	}
+	properties := Properties{
+		Name:          name,
+		ContentType:   deref(props.ContentType),
+		ContentLength: deref(props.ContentLength),
+		LastModified:  deref(props.LastModified),
+	}
+	if props.ETag != nil {
+		properties.ETag = string(*props.ETag)
+	}
+	return properties, nil
+}
+
+func (s *AzureStorage) Delete(ctx context.Context, containerName, name string) error {
+	_, err := s.client.DeleteBlob(ctx, containerName, name, nil)
+	return blobError(err)
+}
+
+func (s *AzureStorage) List(ctx context.Context, containerName string, pageSize int, page func([]Properties) error) error {
+	pager := s.client.NewListBlobsFlatPager(containerName, &azblob.ListBlobsFlatOptions{MaxResults: toPtr(int32(pageSize))})
+	for pager.More() {
+		resp, err := pager.NextPage(ctx)
+		if err != nil {
+			return blobError(err)
+		}
+		blobs := make([]Properties, 0, len(resp.Segment.BlobItems))
+		for _, item := range resp.Segment.BlobItems {
+			properties := Properties{Name: deref(item.Name)}
+			if item.Properties != nil {
+				properties.ContentType = deref(item.Properties.ContentType)
+				properties.ContentLength = deref(item.Properties.ContentLength)
+				properties.LastModified = deref(item.Properties.LastModified)
+			}
+			blobs = append(blobs, properties)
+		}
+		if err := page(blobs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *AzureStorage) StageBlock(ctx context.Context, containerName, name, blockID string, data, checksum []byte) error {
+	var options blockblob.StageBlockOptions
+	if checksum != nil {
+		options.TransactionalValidation = blob.TransferValidationTypeMD5(checksum)
+	}
+	_, err := s.blockBlob(containerName, name).StageBlock(ctx, blockID, streaming.NopCloser(bytes.NewReader(data)), &options)
+	return blobError(err)
+}
+
+func (s *AzureStorage) UncommittedBlocks(ctx context.Context, containerName, name string) (map[string]int64, error) {
+	resp, err := s.blockBlob(containerName, name).GetBlockList(ctx, blockblob.BlockListTypeUncommitted, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return map[string]int64{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	blocks := map[string]int64{}
+	for _, block := range resp.BlockList.UncommittedBlocks {
+		if block.Name != nil && block.Size != nil {
+			blocks[*block.Name] = *block.Size
+		}
+	}
+	return blocks, nil
+}
+
+func (s *AzureStorage) CommitBlocks(ctx context.Context, containerName, name string, blockIDs []string) error {
+	_, err := s.blockBlob(containerName, name).CommitBlockList(ctx, blockIDs, nil)
+	return blobError(err)
+}
+
+// Signer makes SAS URLs with the account key when there is one. Without, a
+// user delegation key is fetched from the account when the signer is made.
+func (s *AzureStorage) Signer(ctx context.Context, expiresAt time.Time) (Signer, error) {
+	signer := azureBlobSigner{storage: s, expiresAt: expiresAt}
+	if !s.delegated {
+		return signer, nil
+	}
+	var err error
+	signer.delegation, err = s.client.ServiceClient().GetUserDelegationCredential(ctx, service.KeyInfo{
+		Start:  toPtr(time.Now().UTC().Format(sas.TimeFormat)),
+		Expiry: toPtr(expiresAt.UTC().Format(sas.TimeFormat)),
+	}, nil)
+	return signer, err
+}
+
+// azureBlobSigner makes read-only SAS URLs for blobs, all working until the
+// same time
+type azureBlobSigner struct {
+	storage    *AzureStorage
+	expiresAt  time.Time
+	delegation *service.UserDelegationCredential
+}
+
+func (s azureBlobSigner) Sign(containerName, name string) (string, error) {
+	blobClient := s.storage.blob(containerName, name)
+	if s.delegation == nil {
+		return blobClient.GetSASURL(sas.BlobPermissions{Read: true}, s.expiresAt, nil)
+	}
+	query, err := sas.BlobSignatureValues{
+		Protocol:      sas.ProtocolHTTPS,
+		ContainerName: containerName,
+		BlobName:      name,
+		Permissions:   (&sas.BlobPermissions{Read: true}).String(),
+		ExpiryTime:    s.expiresAt.UTC(),
+	}.SignWithUserDelegation(s.delegation)
+	if err != nil {
+		return "", err
+	}
+	return blobClient.URL() + "?" + query.Encode(), nil
+}
+
+// azure returns the headers as the blob service takes them, leaving unset the
+// ones that are empty
+func (h Headers) azure() *blob.HTTPHeaders {
+	headers := &blob.HTTPHeaders{}
+	if h.ContentType != "" {
+		headers.BlobContentType = toPtr(h.ContentType)
+	}
+	if h.ContentDisposition != "" {
+		headers.BlobContentDisposition = toPtr(h.ContentDisposition)
+	}
+	if h.ContentMD5 != nil {
+		headers.BlobContentMD5 = h.ContentMD5
+	}
+	return headers
+}
+
+func toPtr[T any](v T) *T {
+	return &v
+}
+
+func deref[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
@@ -0,0 +1,76 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"user/user/config"
+	"user/user/resilience"
+)
+
+// benchmarkContainer is where the upload benchmarks put their blob
+const benchmarkContainer = "benchmarks"
+
+// BenchmarkUpload compares connecting to the storage account for every upload,
+// as the handlers once did, with the storage made once at startup. Uploads go to
+// the account in USERSVC_TEST_BLOB, a connection string, or to a stand-in for
+// the blob endpoint when it isn't set.
+func BenchmarkUpload(b *testing.B) {
+	var cfg config.Config
+	config.ApplyDefaults(&cfg)
+	cfg.Azure.BlobConnectionString = os.Getenv("USERSVC_TEST_BLOB")
+	if cfg.Azure.BlobConnectionString == "" {
+		endpoint := httptest.NewServer(http.HandlerFunc(serveBenchmarkBlob))
+		b.Cleanup(endpoint.Close)
+		cfg.Azure.BlobConnectionString = strings.Replace(azuriteConnectionString, "http://127.0.0.1:10000", endpoint.URL, 1)
+	}
+	resilience.Setup(cfg)
+	resilience.SetupBulkheads(cfg)
+	shared, err := NewAzureStorage(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := shared.CreateContainer(context.Background(), benchmarkContainer, config.ContainerAccessPrivate); err != nil && !errors.Is(err, ErrContainerExists) {
+		b.Fatal(err)
+	}
+	photo := bytes.Repeat([]byte{0x89}, 64<<10)
+
+	tests := []struct {
+		name    string
+		storage func() (Storage, error)
+	}{
+		{name: "new client per call", storage: func() (Storage, error) { return NewAzureStorage(cfg) }},
+		{name: "shared client", storage: func() (Storage, error) { return shared, nil }},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			b.SetBytes(int64(len(photo)))
+			for range b.N {
+				storage, err := tt.storage()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := Upload(context.Background(), storage, benchmarkContainer, bytes.NewReader(photo), "photo.png", "", "image/png"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// serveBenchmarkBlob answers the requests of container creation and block
+// uploads as the blob service does, keeping nothing
+func serveBenchmarkBlob(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	w.Header().Set("x-ms-request-id", "benchmark")
+	w.Header().Set("ETag", `"0x1"`)
+	w.Header().Set("Last-Modified", "Wed, 14 Oct 2026 00:00:00 GMT")
+	w.WriteHeader(http.StatusCreated)
+}
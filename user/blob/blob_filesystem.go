@@ -0,0 +1,372 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Directories of FileStorage's root beside the containers, which Azure
+// container names, having no dots, can't clash with
+const (
+	fileBlobPropertiesDir = ".properties" // A JSON file of headers and metadata per blob
+	fileBlobBlocksDir     = ".blocks"     // A directory of staged blocks per blob
+)
+
+var ErrInvalidName = errors.New("blob name leaves its container")
+
+// FileStorage is Storage with azure.blob_driver filesystem: each
+// container a directory under root and each blob a file, named by its blob
+// name, for local development. Access levels are ignored, and SAS URLs are
+// file:// URLs that work on this machine only and never expire.
+type FileStorage struct {
+	root string
+}
+
+// fileBlobHeaders is what a blob's properties file holds
+type fileBlobHeaders struct {
+	ContentType        string            `json:"content_type,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	ContentMD5         []byte            `json:"content_md5,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+func NewFileStorage(root string) (*FileStorage, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStorage{root: root}, nil
+}
+
+// path returns where a blob of a container lives under dir, the root or one of
+// the directories beside the containers
+func (s *FileStorage) path(dir, containerName, name string) (string, error) {
+	clean := path.Clean(name)
+	if name == "" || clean != name || clean == ".." || strings.HasPrefix(clean, "../") || path.IsAbs(clean) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return filepath.Join(dir, containerName, filepath.FromSlash(clean)), nil
+}
+
+func (s *FileStorage) blobPath(containerName, name string) (string, error) {
+	return s.path(s.root, containerName, name)
+}
+
+func (s *FileStorage) propertiesPath(containerName, name string) (string, error) {
+	p, err := s.path(filepath.Join(s.root, fileBlobPropertiesDir), containerName, name)
+	return p + ".json", err
+}
+
+func (s *FileStorage) blocksPath(containerName, name string) (string, error) {
+	return s.path(filepath.Join(s.root, fileBlobBlocksDir), containerName, name)
+}
+
+func (s *FileStorage) CreateContainer(ctx context.Context, name, access string) error {
+	err := os.Mkdir(filepath.Join(s.root, name), 0o755)
+	if errors.Is(err, fs.ErrExist) {
+		return ErrContainerExists
+	}
+	return err
+}
+
+func (s *FileStorage) CheckContainer(ctx context.Context, name string) error {
+	info, err := os.Stat(filepath.Join(s.root, name))
+	if errors.Is(err, fs.ErrNotExist) || err == nil && !info.IsDir() {
+		return ErrContainerNotFound
+	}
+	return err
+}
+
+// Upload writes the body beside the blob and renames it into place, so
+// readers see either the old blob or the new one, keeping the MD5 of what was
+// written as its Content-MD5
+func (s *FileStorage) Upload(ctx context.Context, containerName, name string, body io.Reader, headers Headers, metadata map[string]string) error {
+	target, err := s.blobPath(containerName, name)
+	if err != nil {
+		return err
+	}
+	if err := s.CheckContainer(ctx, containerName); err != nil {
+		return err
+	}
+	hash := md5.New()
+	if err := writeFileAtomically(target, io.TeeReader(body, hash)); err != nil {
+		return err
+	}
+	return s.writeHeaders(containerName, name, fileBlobHeaders{
+		ContentType:        headers.ContentType,
+		ContentDisposition: headers.ContentDisposition,
+		ContentMD5:         hash.Sum(nil),
+		Metadata:           metadata,
+	})
+}
+
+func (s *FileStorage) SetHeaders(ctx context.Context, containerName, name string, headers Headers) error {
+	if _, err := s.stat(containerName, name); err != nil {
+		return err
+	}
+	stored, err := s.readHeaders(containerName, name)
+	if err != nil {
+		return err
+	}
+	stored.ContentType, stored.ContentDisposition, stored.ContentMD5 = headers.ContentType, headers.ContentDisposition, headers.ContentMD5
+	return s.writeHeaders(containerName, name, stored)
+}
+
+func (s *FileStorage) Download(ctx context.Context, containerName, name string) (io.ReadCloser, error) {
+	p, err := s.blobPath(containerName, name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (s *FileStorage) Properties(ctx context.Context, containerName, name string) (Properties, error) {
+	info, err := s.stat(containerName, name)
+	if err != nil {
+		return Properties{}, err
+	}
+	headers, err := s.readHeaders(containerName, name)
+	if err != nil {
+		return Properties{}, err
+	}
+	properties := fileBlobProperties(name, info)
+	properties.ContentType = headers.ContentType
+	return properties, nil
+}
+
+func (s *FileStorage) Delete(ctx context.Context, containerName, name string) error {
+	p, err := s.blobPath(containerName, name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if props, err := s.propertiesPath(containerName, name); err == nil {
+		os.Remove(props)
+	}
+	return nil
+}
+
+// List walks the container's directory in lexical order, as Azure lists blobs
+// by name. Content types aren't read, as no caller of List needs them.
+func (s *FileStorage) List(ctx context.Context, containerName string, pageSize int, page func([]Properties) error) error {
+	if err := s.CheckContainer(ctx, containerName); err != nil {
+		return err
+	}
+	dir := filepath.Join(s.root, containerName)
+	var blobs []Properties
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		// Uploads in progress
+		if strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, fileBlobProperties(filepath.ToSlash(rel), info))
+		if len(blobs) < pageSize {
+			return nil
+		}
+		full := blobs
+		blobs = nil
+		return page(full)
+	})
+	if err != nil {
+		return err
+	}
+	if len(blobs) > 0 {
+		return page(blobs)
+	}
+	return nil
+}
+
+// StageBlock writes the block to a file of the blob's blocks directory, named
+// by the block ID in hex, as block IDs are base64 and may hold a slash
+func (s *FileStorage) StageBlock(ctx context.Context, containerName, name, blockID string, data, checksum []byte) error {
+	if checksum != nil {
+		if sum := md5.Sum(data); !bytes.Equal(sum[:], checksum) {
+			return ErrChecksumMismatch
+		}
+	}
+	dir, err := s.blocksPath(containerName, name)
+	if err != nil {
+		return err
+	}
+	if err := s.CheckContainer(ctx, containerName); err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath.Join(dir, hex.EncodeToString([]byte(blockID))), bytes.NewReader(data))
+}
+
+func (s *FileStorage) UncommittedBlocks(ctx context.Context, containerName, name string) (map[string]int64, error) {
+	dir, err := s.blocksPath(containerName, name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]int64{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	blocks := map[string]int64{}
+	for _, entry := range entries {
+		blockID, err := hex.DecodeString(entry.Name())
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		blocks[string(blockID)] = info.Size()
+	}
+	return blocks, nil
+}
+
+// CommitBlocks joins the staged blocks into the blob and drops all of them, as
+// Azure discards the blocks a commit leaves out
+func (s *FileStorage) CommitBlocks(ctx context.Context, containerName, name string, blockIDs []string) error {
+	dir, err := s.blocksPath(containerName, name)
+	if err != nil {
+		return err
+	}
+	readers := make([]io.Reader, len(blockIDs))
+	for i, blockID := range blockIDs {
+		block, err := os.Open(filepath.Join(dir, hex.EncodeToString([]byte(blockID))))
+		if err != nil {
+			return fmt.Errorf("block %s isn't staged: %w", blockID, err)
+		}
+		defer block.Close()
+		readers[i] = block
+	}
+	if err := s.Upload(ctx, containerName, name, io.MultiReader(readers...), Headers{}, nil); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *FileStorage) Signer(ctx context.Context, expiresAt time.Time) (Signer, error) {
+	return fileBlobSigner{storage: s}, nil
+}
+
+// fileBlobSigner makes file:// URLs for blobs
+type fileBlobSigner struct {
+	storage *FileStorage
+}
+
+func (s fileBlobSigner) Sign(containerName, name string) (string, error) {
+	p, err := s.storage.blobPath(containerName, name)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(p)}).String(), nil
+}
+
+// stat describes the blob's file, or returns ErrNotFound
+func (s *FileStorage) stat(containerName, name string) (fs.FileInfo, error) {
+	p, err := s.blobPath(containerName, name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && info.IsDir() {
+		return nil, ErrNotFound
+	}
+	return info, err
+}
+
+// readHeaders reads a blob's properties file; none for a blob that has none
+func (s *FileStorage) readHeaders(containerName, name string) (fileBlobHeaders, error) {
+	var headers fileBlobHeaders
+	p, err := s.propertiesPath(containerName, name)
+	if err != nil {
+		return headers, err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return headers, nil
+	}
+	if err != nil {
+		return headers, err
+	}
+	return headers, json.Unmarshal(data, &headers)
+}
+
+func (s *FileStorage) writeHeaders(containerName, name string, headers fileBlobHeaders) error {
+	p, err := s.propertiesPath(containerName, name)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(p, bytes.NewReader(data))
+}
+
+// fileBlobProperties describes a blob by its file, the ETag changing whenever
+// the file is written
+func fileBlobProperties(name string, info fs.FileInfo) Properties {
+	return Properties{
+		Name:          name,
+		ETag:          fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()),
+		ContentLength: info.Size(),
+		LastModified:  info.ModTime().UTC(),
+	}
+}
+
+// writeFileAtomically writes body to a hidden file beside target, creating the
+// directories on the way, and renames it to target once complete
+func writeFileAtomically(target string, body io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(target), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), target)
+}
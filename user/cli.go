@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"user/user/api"
+	"user/user/config"
+)
+
+// Subcommands of the binary, each one operational role
+const (
+	commandServe   = "serve"   // The APIs and background workers, consuming the user queue too with consumer.enabled (the default)
+	commandWorker  = "worker"  // Only a consumer of the user queue, however consumer.enabled is set
+	commandMigrate = "migrate" // Apply the pending database migrations, then exit
+	commandSeed    = "seed"    // Create demo users for local development, then exit
+	commandAdmin   = "admin"   // Run an admin operation on users, blobs, dead letters or API keys, then exit
+)
+
+// commandLine is what the binary was asked to do
+type commandLine struct {
+	command    string
+	configFile string // Over USERSVC_CONFIG_FILE
+	port       int    // Over the port of server.addr
+	logLevel   string // Over logging.level
+	baseline   string // migrate: record migrations up to this one as applied without running them
+	seedUsers  int    // seed: how many users
+	avatars    bool   // seed: whether they get generated pictures
+	tenant     string // seed and admin: the tenant of the users
+	admin      api.AdminOperation
+	adminAPI   string // admin: base URL of the instance to send the operation to; empty runs it directly
+	adminToken string // admin: admin API key or JWT for adminAPI, over USERSVC_ADMIN_TOKEN
+}
+
+// parseCommandLine reads the subcommand and its flags. Without a subcommand
+// the binary serves, as it did before they existed, still honouring -mode.
+func parseCommandLine(args []string) commandLine {
+	cmd := commandLine{command: commandServe}
+	if len(args) > 0 {
+		switch args[0] {
+		case commandServe, commandWorker, commandMigrate, commandSeed, commandAdmin:
+			cmd.command, args = args[0], args[1:]
+		}
+	}
+
+	flags := flag.NewFlagSet(cmd.command, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [serve|worker|migrate|seed|admin] [flags]\n\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "  serve    run the APIs and background workers (default)")
+		fmt.Fprintln(flags.Output(), "  worker   only consume the user queue")
+		fmt.Fprintln(flags.Output(), "  migrate  apply the pending database migrations")
+		fmt.Fprintln(flags.Output(), "  seed     create demo users")
+		fmt.Fprintln(flags.Output(), "  admin    run an admin operation")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+		if cmd.command == commandAdmin {
+			fmt.Fprint(flags.Output(), api.AdminUsage)
+		}
+	}
+	flags.StringVar(&cmd.configFile, "config", "", "config file to read, over "+config.FileEnv+" (default config.json)")
+	flags.StringVar(&cmd.logLevel, "log-level", "", "debug, info, warn or error, over logging.level")
+	var mode string
+	switch cmd.command {
+	case commandServe:
+		flags.IntVar(&cmd.port, "port", 0, "port to serve the API on, over the one in server.addr")
+		flags.StringVar(&mode, "mode", "", "deprecated: server or consumer; use the serve and worker subcommands")
+	case commandMigrate:
+		flags.StringVar(&cmd.baseline, "baseline", "", "record the migrations up to and including this one, e.g. 0029, as applied without running them, for a database set up by hand")
+	case commandSeed:
+		flags.IntVar(&cmd.seedUsers, "users", 10, "demo users to create or refresh")
+		flags.StringVar(&cmd.tenant, "tenant", "", "tenant the demo users belong to")
+		flags.BoolVar(&cmd.avatars, "avatars", true, "give the demo users generated pictures")
+	case commandAdmin:
+		flags.StringVar(&cmd.adminAPI, "api", "", "base URL of a running instance to send the operation to, e.g. https://users.example.com; without it the operation runs against the configured stores")
+		flags.StringVar(&cmd.adminToken, "token", os.Getenv(api.AdminTokenEnv), "admin API key or JWT sent with -api, over "+api.AdminTokenEnv)
+		flags.StringVar(&cmd.tenant, "tenant", "", "tenant of the users worked on")
+	}
+	flags.Parse(args)
+	if cmd.command == commandAdmin {
+		var err error
+		if cmd.admin, err = api.ParseAdminOperation(flags.Args(), cmd.tenant); err != nil {
+			fmt.Fprintln(flags.Output(), err)
+			flags.Usage()
+			os.Exit(2)
+		}
+	} else if flags.NArg() > 0 {
+		fmt.Fprintf(flags.Output(), "unexpected arguments: %v\n", flags.Args())
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	switch mode {
+	case "", "server":
+	case "consumer":
+		cmd.command = commandWorker
+	default:
+		fatal("Unknown mode", "mode", mode)
+	}
+	if cmd.port < 0 || cmd.port > 65535 {
+		fatal("Invalid port", "port", cmd.port)
+	}
+	return cmd
+}
+
+// apply puts the flags given over the settings they override
+func (cmd commandLine) apply(cfg *config.Config) {
+	if cmd.port != 0 {
+		host, _, _ := net.SplitHostPort(cfg.Server.Addr)
+		cfg.Server.Addr = net.JoinHostPort(host, strconv.Itoa(cmd.port))
+	}
+	if cmd.logLevel != "" {
+		cfg.Logging.Level = cmd.logLevel
+	}
+}
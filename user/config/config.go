@@ -0,0 +1,1151 @@
+package config
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/denisenkom/go-mssqldb/msdsn"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// AzureCredential is the identity used with auth default_credential, made once
+// so every client shares its token cache
+var AzureCredential = sync.OnceValues(func() (azcore.TokenCredential, error) {
+	return azidentity.NewDefaultAzureCredential(nil)
+})
+
+// Config struct for holding configuration
+type Config struct {
+	Database struct {
+		Driver                      string `json:"driver"` // The database the stores speak to: sqlserver (default), for Azure SQL and SQL Server, postgres, mysql, or memory, keeping everything in the process for local development
+		ConnectionString            string `json:"connection_string"`
+		QueryTimeoutSeconds         int    `json:"query_timeout_seconds"`
+		MigrateOnStartup            bool   `json:"migrate_on_startup"`             // Apply pending migrations before serving, as the migrate command does; instances starting together take turns
+		MaxOpenConns                int    `json:"max_open_conns"`                 // Connections the pool may hold open, in use and idle (default 50)
+		MaxIdleConns                int    `json:"max_idle_conns"`                 // Idle connections kept for reuse, at most max_open_conns (default 10)
+		ConnMaxLifetimeMinutes      int    `json:"conn_max_lifetime_minutes"`      // Age after which a connection is closed rather than reused, so failovers and rotated credentials are picked up (default 30)
+		StartupTimeoutSeconds       int    `json:"startup_timeout_seconds"`        // How long startup waits for the database to come up, retrying with backoff (default 60)
+		ReplicaConnectionString     string `json:"replica_connection_string"`      // Read-only replica, e.g. a geo-replica or ApplicationIntent=ReadOnly for a readable secondary; the API's listings, searches, counts and user reads go to it while it's healthy
+		ReplicaCheckIntervalSeconds int    `json:"replica_check_interval_seconds"` // How often the replica is pinged to decide whether reads may go to it (default 10)
+	} `json:"database"`
+	Azure struct {
+		Auth                       string `json:"auth"`               // connection_string (default) uses the connection strings' keys, default_credential the identity azidentity finds, like a managed identity, which signs in to the database on sqlserver only
+		BlobDriver                 string `json:"blob_driver"`        // azure (default) stores blobs in the storage account, or Azurite's with UseDevelopmentStorage=true; filesystem in blob_directory, for working offline
+		BlobDirectory              string `json:"blob_directory"`     // Directory of the blobs with blob_driver filesystem (default blobs), a subdirectory per container
+		ServiceBusDriver           string `json:"service_bus_driver"` // azure (default) publishes to the namespace; memory to in-process queues that log the events, leaving out the consumers and dead letters
+		BlobConnectionString       string `json:"blob_connection_string"`
+		ServiceBusConnectionString string `json:"service_bus_connection_string"`
+		BlobAccountURL             string `json:"blob_account_url"`      // e.g. https://account.blob.core.windows.net, for auth default_credential
+		ServiceBusNamespace        string `json:"service_bus_namespace"` // e.g. namespace.servicebus.windows.net, for auth default_credential
+		PicturesContainer          string `json:"pictures_container"`    // Container of the profile pictures (default profile-pictures); stored links name it, so renaming one in use strands them
+		AutoCreateContainer        bool   `json:"auto_create_container"` // Create the blob containers at startup if missing
+		ContainerAccess            string `json:"container_access"`      // Public access for a created container: private (default), blob or container
+	} `json:"azure"`
+	KeyVault struct {
+		RefreshMinutes int `json:"refresh_minutes"` // How often keyvault:// settings without a version are read again for rotated secrets (default 60); negative reads them only at startup
+	} `json:"key_vault"`
+	AppConfiguration struct {
+		Endpoint         string `json:"endpoint"`          // e.g. https://store.azconfig.io, read as the service's identity; App Configuration is off when it and connection_string are empty
+		ConnectionString string `json:"connection_string"` // Access key connection string, in place of the endpoint and identity
+		Label            string `json:"label"`             // Only read keys with this label, e.g. the environment; unlabelled keys when empty
+		KeyPrefix        string `json:"key_prefix"`        // Prefix of this service's keys (default usersvc:)
+		RefreshSeconds   int    `json:"refresh_seconds"`   // How often it is polled for changes (default 30)
+		FeatureFlags     bool   `json:"feature_flags"`     // Also read the flags of its feature manager, under the same label, over features
+	} `json:"app_configuration"`
+	Thumbnails struct {
+		MaxDimension int   `json:"max_dimension"` // Longest side of generated thumbnails, in pixels
+		Sizes        []int `json:"sizes"`         // Longest sides of the variants also generated, in pixels (default 64 and 256)
+	} `json:"thumbnails"`
+	Tracing struct {
+		Endpoint   string            `json:"endpoint"`    // OTLP/HTTP collector URL, e.g. http://localhost:4318; tracing is off when empty and OTEL_EXPORTER_OTLP_ENDPOINT is unset
+		Headers    map[string]string `json:"headers"`     // Sent with every export, e.g. the collector's API key
+		SampleRate float64           `json:"sample_rate"` // Fraction of new traces recorded, 0-1 (default 1)
+	} `json:"tracing"`
+	Webhooks struct {
+		URLs           []string `json:"urls"`            // Endpoints POSTed each created user, besides the webhooks registered at /webhooks
+		Secret         string   `json:"secret"`          // Shared HMAC key for the X-Signature header to webhooks.urls
+		Workers        int      `json:"workers"`         // Concurrent deliveries
+		MaxAttempts    int      `json:"max_attempts"`    // Delivery attempts before an event is given up on
+		TimeoutSeconds int      `json:"timeout_seconds"` // Per-attempt request timeout
+	} `json:"webhooks"`
+	EventStream struct {
+		Source           string `json:"source"`            // "internal" (default) streams this instance's changes, "servicebus" those read from a subscription
+		Topic            string `json:"topic"`             // Service Bus topic the user events reach, for source servicebus
+		Subscription     string `json:"subscription"`      // This instance's own subscription to the topic
+		HeartbeatSeconds int    `json:"heartbeat_seconds"` // Idle time after which a comment keeps connections open
+		BufferSize       int    `json:"buffer_size"`       // Recent events kept for clients resuming with Last-Event-ID
+	} `json:"event_stream"`
+	Publishing struct {
+		Default    PublishDestination            `json:"default"`     // Where events go unless routed by type; the user queue when unset
+		EventTypes map[string]PublishDestination `json:"event_types"` // By event type, e.g. {"user.erased": {"topic": "user-erasures"}}; the consumer only reads the user queue
+		Format     string                        `json:"format"`      // "cloudevents" (default) wraps bodies in a CloudEvents 1.0 envelope; "legacy" sends the bare user while consumers migrate
+		Source     string                        `json:"source"`      // CloudEvents source attribute, default "/users"
+	} `json:"publishing"`
+	Consumer struct {
+		Enabled     bool `json:"enabled"`      // Persist events from the user queue into the users table
+		MaxAttempts int  `json:"max_attempts"` // Processing attempts before a message is dead-lettered
+		Receivers   int  `json:"receivers"`    // Concurrent receivers on the queue (default 1)
+		Prefetch    int  `json:"prefetch"`     // Messages each receiver asks for at a time (default 10); all are locked while the batch is worked through
+	} `json:"consumer"`
+	Resilience struct {
+		MaxAttempts        int `json:"max_attempts"`         // Tries of a blob, Service Bus or new SQL connection call that fails transiently (default 3)
+		BaseDelayMs        int `json:"base_delay_ms"`        // Backoff before the first retry, doubling after each; jittered (default 200)
+		MaxDelaySeconds    int `json:"max_delay_seconds"`    // Longest backoff between retries (default 5)
+		BreakerFailures    int `json:"breaker_failures"`     // Consecutive transient failures that open a dependency's circuit breaker (default 5)
+		BreakerOpenSeconds int `json:"breaker_open_seconds"` // How long an open breaker fails calls fast before letting one through (default 30)
+	} `json:"resilience"`
+	DependencyLimits struct {
+		BlobUploads      int `json:"blob_uploads"`       // Blob uploads in flight at once (default 16)
+		ServiceBusSends  int `json:"service_bus_sends"`  // Service Bus sends in flight at once (default 8)
+		QueueSize        int `json:"queue_size"`         // Further calls to each that may wait for a slot; more are answered 503 (default 64)
+		QueueWaitSeconds int `json:"queue_wait_seconds"` // Longest wait for a slot before a 503 (default 10)
+	} `json:"dependency_limits"`
+	Logging struct {
+		Level  string `json:"level"`  // debug, info (default), warn or error
+		Format string `json:"format"` // json (default) or text for local development
+		// Fraction of successful requests written to the access log, 0-1 (default
+		// 1); failures are always logged
+		AccessSampleRate float64 `json:"access_sample_rate"`
+		// Sample rates of single routes, keyed like server.route_timeouts
+		AccessRouteSampleRates map[string]float64 `json:"access_route_sample_rates"`
+	} `json:"logging"`
+	Validation struct {
+		MaxLinkLength     int      `json:"max_link_length"`
+		MaxNameLength     int      `json:"max_name_length"`     // At most the 255 the name column holds
+		MaxPhotoBytes     int64    `json:"max_photo_bytes"`     // Largest picture accepted, within server.max_upload_bytes
+		PhotoContentTypes []string `json:"photo_content_types"` // Picture types accepted, as sniffed from the file
+	} `json:"validation"`
+	EmailLookup struct {
+		MaxEmails         int     `json:"max_emails"`
+		RequestsPerMinute float64 `json:"requests_per_minute"`
+		Burst             int     `json:"burst"`
+	} `json:"email_lookup"`
+	Auth struct {
+		APIKeys      []string `json:"api_keys"`       // Bearer tokens accepted on /users; auth is off with none of these, no identity provider, no sessions and no managed keys
+		AdminAPIKeys []string `json:"admin_api_keys"` // Bearer tokens that also grant admin rights
+		// Bearer tokens by the tenant they are bound to, which with tenancy
+		// enabled replace api_keys, as those could pick any tenant
+		TenantAPIKeys map[string][]string `json:"tenant_api_keys"`
+		JWT           struct {
+			JWKSURL   string `json:"jwks_url"` // Enables bearer JWTs signed by these keys, alongside the API keys
+			Issuer    string `json:"issuer"`
+			Audience  string `json:"audience"`
+			AdminRole string `json:"admin_role"` // Entry of the roles claim that grants admin rights
+		} `json:"jwt"`
+		Sessions struct {
+			Secret             string `json:"secret"` // Signs access tokens; enables /auth/login, which needs auth.jwt or auth.entra
+			AccessTokenMinutes int    `json:"access_token_minutes"`
+			RefreshTokenDays   int    `json:"refresh_token_days"`
+		} `json:"sessions"`
+		TwoFactor struct {
+			Issuer        string `json:"issuer"`         // Name authenticator apps show for this service
+			RecentMinutes int    `json:"recent_minutes"` // How recent a code must be to delete an account or change its email
+		} `json:"two_factor"`
+		Passwords struct {
+			MinLength int `json:"min_length"` // Shortest password accepted for local credentials
+		} `json:"passwords"`
+		Lockout struct {
+			MaxFailures   int `json:"max_failures"`    // Failed passwords or two-factor codes that lock an account
+			MaxIPFailures int `json:"max_ip_failures"` // Failed attempts of any kind that block a source IP
+			WindowMinutes int `json:"window_minutes"`  // How long failures count, and how long an IP stays blocked
+		} `json:"lockout"`
+		Entra struct {
+			TenantID  string `json:"tenant_id"` // Enables Entra ID access tokens from this directory, instead of auth.jwt
+			ClientID  string `json:"client_id"` // Application (client) ID of this API's app registration
+			AdminRole string `json:"admin_role"`
+		} `json:"entra"`
+	} `json:"auth"`
+	OAuth struct {
+		BaseURL   string                         `json:"base_url"`  // Public URL of this service; providers call back to <base_url>/v1/auth/<provider>/callback
+		Tenant    string                         `json:"tenant"`    // Tenant social logins are provisioned into
+		Providers map[string]OAuthProviderConfig `json:"providers"` // "google" and/or "github"; needs auth.sessions
+	} `json:"oauth"`
+	Tenancy struct {
+		Enabled bool   `json:"enabled"`
+		Header  string `json:"header"` // Request header carrying the tenant ID
+		Claim   string `json:"claim"`  // Token claim carrying the tenant ID, e.g. "tenant_id"; preferred over the header
+	} `json:"tenancy"`
+	Concurrency struct {
+		Required bool `json:"required"` // Require If-Match on deletes; updates always need the version they replace
+	} `json:"concurrency"`
+	Deletion struct {
+		Mode          string `json:"mode"`           // "soft" (default) keeps the row with deleted_at set, "hard" removes it
+		RetentionDays int    `json:"retention_days"` // Soft-deleted users are purged for good after this many days; kept forever when 0
+	} `json:"deletion"`
+	BlobCleanup struct {
+		IntervalMinutes int  `json:"interval_minutes"` // Orphaned blobs are collected this often in the background; never when 0, nor when scheduler.jobs schedules blob_cleanup
+		DryRun          bool `json:"dry_run"`          // Only report and count the orphans found, deleting nothing
+	} `json:"blob_cleanup"`
+	Scheduler struct {
+		Jobs        map[string]ScheduledJob `json:"jobs"`         // Background jobs run on a schedule, by name (blob_cleanup, outbox_dispatch, purge, cache_warmup), each by one instance; a job scheduled here no longer runs on its own
+		WarmTenants []string                `json:"warm_tenants"` // Tenants whose first page of users cache_warmup reads into the cache (default the default tenant)
+	} `json:"scheduler"`
+	Retention struct {
+		Rules  []RetentionRule `json:"rules"`   // What the retention job, and POST /admin/retention, remove once old enough: inactive users or audit events
+		DryRun bool            `json:"dry_run"` // The retention job only reports and counts what the rules match, removing nothing
+	} `json:"retention"`
+	Seed struct {
+		Users       int    `json:"users"`        // Demo users serve creates or refreshes at startup, for demo environments and the in-memory store; none when 0
+		Tenant      string `json:"tenant"`       // Tenant the demo users belong to
+		SkipAvatars bool   `json:"skip_avatars"` // Leave them without generated pictures
+	} `json:"seed"`
+	AsyncCreation struct {
+		Workers   int `json:"workers"`    // Users created at once from POST /users with Prefer: respond-async (default 4)
+		QueueSize int `json:"queue_size"` // Creations waiting for a worker before more get 503; each holds its photo in memory (default 32)
+	} `json:"async_creation"`
+	Bulk struct {
+		MaxBatchSize   int   `json:"max_batch_size"`
+		MaxImportBytes int64 `json:"max_import_bytes"` // Largest CSV accepted by POST /users/import
+	} `json:"bulk"`
+	PictureLinks struct {
+		SAS         bool   `json:"sas"`          // Answer uploads with SAS URLs rather than container paths, for private containers
+		LinkMinutes int    `json:"link_minutes"` // How long picture SAS URLs work
+		CDNBaseURL  string `json:"cdn_base_url"` // e.g. https://pictures.azureedge.net; clients are given links on the CDN rather than container paths
+	} `json:"picture_links"`
+	DataExport struct {
+		LinkMinutes int `json:"link_minutes"` // How long the link to a staged GET /users/{id}/export works
+	} `json:"data_export"`
+	Verification struct {
+		Secret          string `json:"secret"`            // Signs email verification links; new users aren't sent one when empty
+		TTLHours        int    `json:"ttl_hours"`         // How long a link works
+		LinkURL         string `json:"link_url"`          // Page the link opens, with ?token= added; defaults to this service's /v1/verify
+		RequireForLogin bool   `json:"require_for_login"` // Refuse sessions to users whose email isn't verified
+	} `json:"verification"`
+	PasswordReset struct {
+		Enabled    bool   `json:"enabled"`      // Serves /auth/forgot-password and /auth/reset-password, mailing links through mail
+		TTLMinutes int    `json:"ttl_minutes"`  // How long a link works
+		LinkURL    string `json:"link_url"`     // Page the link opens, with ?token= added, which posts the new password to /auth/reset-password
+		MaxPerHour int    `json:"max_per_hour"` // Links sent to one user per hour, so nobody can flood an inbox
+	} `json:"password_reset"`
+	MalwareScan struct {
+		Provider string `json:"provider"` // "none" (default) stores uploads unscanned, "clamav" scans them with clamd first
+		ClamAV   struct {
+			Address        string `json:"address"`         // clamd's TCP address, e.g. localhost:3310
+			TimeoutSeconds int    `json:"timeout_seconds"` // Per-scan limit, defaults to 30
+		} `json:"clamav"`
+	} `json:"malware_scan"`
+	Mail struct {
+		Provider string `json:"provider"` // "log" (default) only logs messages; "smtp", "acs" (Azure Communication Services) and "sendgrid" send them
+		From     string `json:"from"`
+		SMTP     struct {
+			Host     string `json:"host"`
+			Port     int    `json:"port"` // Defaults to 587
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"smtp"`
+		ACS struct {
+			Endpoint         string `json:"endpoint"`          // e.g. https://name.communication.azure.com, signed in to as the service's identity
+			ConnectionString string `json:"connection_string"` // endpoint=...;accesskey=..., in place of the endpoint and identity
+		} `json:"acs"`
+		SendGrid struct {
+			APIKey string `json:"api_key"` // Needs the Mail Send permission
+		} `json:"sendgrid"`
+		Notifications struct {
+			Welcome        bool   `json:"welcome"`         // Email new users on user.created, bulk creations and imports included
+			ProfileChanges bool   `json:"profile_changes"` // Email users when their profile changes, on user.updated
+			TemplateDir    string `json:"template_dir"`    // Directory of welcome.tmpl and profile_changed.tmpl replacing the built-in templates, each a text/template defining subject and body
+			Workers        int    `json:"workers"`         // Concurrent senders (default 2)
+			MaxAttempts    int    `json:"max_attempts"`    // Sends of a notification before it is given up on (default 5); rejections aren't retried
+		} `json:"notifications"`
+	} `json:"mail"`
+	Idempotency struct {
+		TTLHours int `json:"ttl_hours"` // How long responses to POST /users with an Idempotency-Key are replayed
+	} `json:"idempotency"`
+	Cache struct {
+		RedisURL       string `json:"redis_url"`        // redis:// or rediss:// URL of the Redis caching user reads, e.g. Azure Cache for Redis; caching is off when empty
+		KeyPrefix      string `json:"key_prefix"`       // Prepended to every key, so services can share the Redis (default usersvc:)
+		UserTTLSeconds int    `json:"user_ttl_seconds"` // How long a user read is served from the cache (default 60)
+		ListTTLSeconds int    `json:"list_ttl_seconds"` // How long a listing or count is served from the cache (default 15)
+	} `json:"cache"`
+	SearchIndex struct {
+		Endpoint       string `json:"endpoint"`        // Azure AI Search service, e.g. https://name.search.windows.net; GET /users/search queries the database when empty
+		APIKey         string `json:"api_key"`         // Admin key; when empty the service signs in as the azure.auth default_credential identity
+		Index          string `json:"index"`           // Index of the user documents, created at startup if missing (default users)
+		Topic          string `json:"topic"`           // Topic the user events are published to, see publishing
+		Subscription   string `json:"subscription"`    // Subscription of topic the indexer keeps the index up to date from; without one the index is only queried
+		TimeoutSeconds int    `json:"timeout_seconds"` // Per-request timeout for calls to the index (default 5)
+	} `json:"search_index"`
+	RateLimit struct {
+		RequestsPerSecond float64                   `json:"requests_per_second"`
+		Burst             int                       `json:"burst"`
+		Routes            map[string]RouteRateLimit `json:"routes"`      // Limits of single routes, keyed like server.route_timeouts
+		Distributed       bool                      `json:"distributed"` // Also count requests in the database, so the limits hold across instances
+	} `json:"rate_limit"`
+	CORS struct {
+		AllowedOrigins   []string `json:"allowed_origins"`   // Origins browsers may call from, exactly or as https://*.example.com for subdomains (default http://localhost:3000)
+		AllowedMethods   []string `json:"allowed_methods"`   // Default GET, POST, PUT, PATCH, DELETE and OPTIONS
+		AllowedHeaders   []string `json:"allowed_headers"`   // Request headers allowed, besides tenancy.header; default the ones the API reads
+		AllowCredentials *bool    `json:"allow_credentials"` // Let browsers send cookies and auth headers (default true)
+		MaxAgeSeconds    int      `json:"max_age_seconds"`   // How long browsers may cache a preflight; 0 leaves it to them
+	} `json:"cors"`
+	Server struct {
+		Addr string `json:"addr"` // Where the HTTP API listens, default :8080
+		TLS  struct {
+			CertFile     string `json:"cert_file"` // PEM certificate chain; with key_file, serves HTTPS
+			KeyFile      string `json:"key_file"`
+			RedirectAddr string `json:"redirect_addr"` // Where plain HTTP is redirected to HTTPS, e.g. :80; off when empty
+			Autocert     struct {
+				Domains  []string `json:"domains"`   // Hosts to get Let's Encrypt certificates for, instead of cert_file
+				CacheDir string   `json:"cache_dir"` // Where certificates are kept between restarts
+				Email    string   `json:"email"`     // Contact for the ACME account
+			} `json:"autocert"`
+		} `json:"tls"`
+		DisableHTTP2             bool     `json:"disable_http2"`       // Serve HTTPS over HTTP/1.1 only
+		H2C                      bool     `json:"h2c"`                 // Accept cleartext HTTP/2 when not serving TLS, for proxies that speak it
+		RequireRequestID         bool     `json:"require_request_id"`  // Reject requests without X-Request-ID instead of generating one
+		TrustProxyHeaders        bool     `json:"trust_proxy_headers"` // Take the client IP from X-Forwarded-For, when a trusted proxy sent it
+		TrustedProxies           []string `json:"trusted_proxies"`     // IPs or CIDRs of the proxies in front, whose X-Forwarded-For is believed and whose own entries are skipped
+		ReadHeaderTimeoutSeconds int      `json:"read_header_timeout_seconds"`
+		ReadTimeoutSeconds       int      `json:"read_timeout_seconds"`
+		WriteTimeoutSeconds      int      `json:"write_timeout_seconds"`
+		IdleTimeoutSeconds       int      `json:"idle_timeout_seconds"`
+		UploadTimeoutSeconds     int      `json:"upload_timeout_seconds"`   // Read/write deadline for uploads and exports
+		RequestTimeoutSeconds    int      `json:"request_timeout_seconds"`  // How long a request may run before it gets 504
+		ShutdownTimeoutSeconds   int      `json:"shutdown_timeout_seconds"` // How long shutdown waits for requests in flight and the outbox
+		MaxInFlightRequests      int      `json:"max_in_flight_requests"`   // Requests handled at once before the rest get 503; negative for no cap
+		MaxInFlightUploads       int      `json:"max_in_flight_uploads"`    // The same for uploads, within max_in_flight_requests
+		MaxBodyBytes             int64    `json:"max_body_bytes"`           // Largest request body accepted
+		MaxHeaderBytes           int      `json:"max_header_bytes"`         // Largest request line and headers accepted, default 64 KiB
+		MaxUploadBytes           int64    `json:"max_upload_bytes"`         // Largest body accepted by photo uploads, file included
+		GRPCAddr                 string   `json:"grpc_addr"`                // Where UserService listens for gRPC, e.g. :9090; off when empty
+		CompressMinBytes         int      `json:"compress_min_bytes"`       // Smallest response body compressed; negative turns compression off
+		// Request timeouts of single routes, keyed by method and route template
+		// as in the HTTP metrics, e.g. "GET /v1/users/{id:[0-9]+}"; 0 for none
+		RouteTimeouts map[string]int `json:"route_timeouts"`
+	} `json:"server"`
+	Features map[string]FeatureFlag `json:"features"` // Feature flags by name, which App Configuration may switch while running; see featureDefaults for those left unset
+}
+
+// RouteRateLimit is the token bucket of one route, for each client
+type RouteRateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// OAuthProviderConfig holds the client registered with a social login provider
+type OAuthProviderConfig struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// Longest thumbnail side accepted, beyond which resizing costs more memory than an upload is worth
+const maxThumbnailDimension = 4096
+
+// connectionStringProblems lists the connection strings and Azure addresses
+// that are malformed, so they fail at startup rather than on the first call
+// that uses them. The problems never quote the values, which hold keys.
+func connectionStringProblems(config Config) []string {
+	var problems []string
+	for _, setting := range []struct{ key, dsn string }{
+		{"database.connection_string", config.Database.ConnectionString},
+		{"database.replica_connection_string", config.Database.ReplicaConnectionString},
+	} {
+		if setting.dsn == "" {
+			continue
+		}
+		if problem := databaseDSNProblem(config.Database.Driver, setting.dsn); problem != "" {
+			problems = append(problems, configKey(setting.key)+" "+problem)
+		}
+	}
+	switch config.Azure.Auth {
+	case AzureAuthConnectionString:
+		if s := config.Azure.BlobConnectionString; s != "" {
+			parts := ParseAzureConnectionString(s)
+			if parts["blobendpoint"] == "" && (parts["accountname"] == "" || parts["accountkey"] == "") && parts["usedevelopmentstorage"] != "true" {
+				problems = append(problems, configKey("azure.blob_connection_string")+" needs AccountName and AccountKey, or BlobEndpoint")
+			}
+		}
+		if s := config.Azure.ServiceBusConnectionString; s != "" {
+			parts := ParseAzureConnectionString(s)
+			if !strings.HasPrefix(parts["endpoint"], "sb://") {
+				problems = append(problems, configKey("azure.service_bus_connection_string")+" needs an Endpoint=sb://<namespace>.servicebus.windows.net/")
+			}
+			if parts["sharedaccesssignature"] == "" && (parts["sharedaccesskeyname"] == "" || parts["sharedaccesskey"] == "") {
+				problems = append(problems, configKey("azure.service_bus_connection_string")+" needs SharedAccessKeyName and SharedAccessKey, or SharedAccessSignature")
+			}
+		}
+	case AzureAuthDefaultCredential:
+		if link := config.Azure.BlobAccountURL; link != "" {
+			if u, err := url.Parse(link); err != nil || u.Scheme != "https" || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("azure.blob_account_url must be an https URL, e.g. https://account.blob.core.windows.net, got %q", link))
+			}
+		}
+		if namespace := config.Azure.ServiceBusNamespace; namespace != "" && (strings.Contains(namespace, "://") || strings.Contains(namespace, "/")) {
+			problems = append(problems, fmt.Sprintf("azure.service_bus_namespace must be a host, e.g. namespace.servicebus.windows.net, got %q", namespace))
+		}
+	}
+	if s := config.AppConfiguration.ConnectionString; s != "" {
+		parts := ParseAzureConnectionString(s)
+		if parts["endpoint"] == "" || parts["id"] == "" || parts["secret"] == "" {
+			problems = append(problems, configKey("app_configuration.connection_string")+" needs Endpoint, Id and Secret")
+		}
+	}
+	if s := config.Cache.RedisURL; s != "" {
+		// Not quoting the error either, which can hold the URL and its password
+		if _, err := redis.ParseURL(s); err != nil {
+			problems = append(problems, configKey("cache.redis_url")+" must be a redis:// or rediss:// URL, e.g. rediss://:<key>@name.redis.cache.windows.net:6380/0")
+		}
+	}
+	return problems
+}
+
+// ParseAzureConnectionString splits a Key=Value;... connection string, with
+// the keys in lower case
+func ParseAzureConnectionString(s string) map[string]string {
+	parts := map[string]string{}
+	for _, part := range strings.Split(s, ";") {
+		if key, value, ok := strings.Cut(part, "="); ok {
+			parts[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+	}
+	return parts
+}
+
+// Blob container names Azure accepts, besides their length
+var containerNamePattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// ApplyDefaults fills in optional settings left unset in config.json and the environment
+func ApplyDefaults(config *Config) {
+	if len(config.CORS.AllowedOrigins) == 0 {
+		config.CORS.AllowedOrigins = defaultCORSOrigins
+	}
+	if len(config.CORS.AllowedMethods) == 0 {
+		config.CORS.AllowedMethods = defaultCORSMethods
+	}
+	if len(config.CORS.AllowedHeaders) == 0 {
+		config.CORS.AllowedHeaders = defaultCORSHeaders
+	}
+	if config.CORS.AllowCredentials == nil {
+		config.CORS.AllowCredentials = toPtr(true)
+	}
+	if config.Azure.Auth == "" {
+		config.Azure.Auth = AzureAuthConnectionString
+	}
+	if config.Azure.BlobDriver == "" {
+		config.Azure.BlobDriver = BlobDriverAzure
+	}
+	if config.Azure.BlobDirectory == "" {
+		config.Azure.BlobDirectory = defaultBlobDirectory
+	}
+	if config.Azure.ServiceBusDriver == "" {
+		config.Azure.ServiceBusDriver = ServiceBusDriverAzure
+	}
+	if config.Azure.PicturesContainer == "" {
+		config.Azure.PicturesContainer = defaultPicturesContainer
+	}
+	if config.Validation.MaxLinkLength <= 0 {
+		config.Validation.MaxLinkLength = defaultMaxLinkLength
+	}
+	if config.Validation.MaxNameLength <= 0 {
+		config.Validation.MaxNameLength = maxNameColumnLength
+	}
+	if config.Validation.MaxPhotoBytes <= 0 {
+		config.Validation.MaxPhotoBytes = defaultMaxPhotoBytes
+	}
+	if len(config.Validation.PhotoContentTypes) == 0 {
+		config.Validation.PhotoContentTypes = defaultPhotoContentTypes
+	}
+	if config.Auth.Sessions.AccessTokenMinutes <= 0 {
+		config.Auth.Sessions.AccessTokenMinutes = defaultAccessTokenMinutes
+	}
+	if config.Auth.Sessions.RefreshTokenDays <= 0 {
+		config.Auth.Sessions.RefreshTokenDays = defaultRefreshTokenDays
+	}
+	if config.Auth.TwoFactor.Issuer == "" {
+		config.Auth.TwoFactor.Issuer = SessionIssuer
+	}
+	if config.Auth.Passwords.MinLength <= 0 {
+		config.Auth.Passwords.MinLength = defaultMinPasswordLength
+	}
+	if config.Auth.Lockout.MaxFailures <= 0 {
+		config.Auth.Lockout.MaxFailures = defaultLockoutMaxFailures
+	}
+	if config.Auth.Lockout.MaxIPFailures <= 0 {
+		config.Auth.Lockout.MaxIPFailures = defaultLockoutMaxIPFailures
+	}
+	if config.Auth.Lockout.WindowMinutes <= 0 {
+		config.Auth.Lockout.WindowMinutes = defaultLockoutWindowMinutes
+	}
+	if config.Auth.TwoFactor.RecentMinutes <= 0 {
+		config.Auth.TwoFactor.RecentMinutes = defaultTwoFactorRecentMinutes
+	}
+	if config.Thumbnails.MaxDimension <= 0 {
+		config.Thumbnails.MaxDimension = defaultThumbnailMaxDimension
+	}
+	if config.Thumbnails.Sizes == nil {
+		config.Thumbnails.Sizes = defaultThumbnailSizes
+	}
+	if config.Logging.AccessSampleRate <= 0 {
+		config.Logging.AccessSampleRate = 1
+	}
+	if config.Tracing.SampleRate <= 0 {
+		config.Tracing.SampleRate = 1
+	}
+	if config.SearchIndex.Index == "" {
+		config.SearchIndex.Index = defaultSearchIndexName
+	}
+	if config.SearchIndex.TimeoutSeconds <= 0 {
+		config.SearchIndex.TimeoutSeconds = defaultSearchIndexTimeoutSeconds
+	}
+	if config.Cache.KeyPrefix == "" {
+		config.Cache.KeyPrefix = defaultCacheKeyPrefix
+	}
+	if config.Cache.UserTTLSeconds <= 0 {
+		config.Cache.UserTTLSeconds = defaultCacheUserTTLSeconds
+	}
+	if config.Cache.ListTTLSeconds <= 0 {
+		config.Cache.ListTTLSeconds = defaultCacheListTTLSeconds
+	}
+	if config.Webhooks.Workers <= 0 {
+		config.Webhooks.Workers = 4
+	}
+	if config.Webhooks.MaxAttempts <= 0 {
+		config.Webhooks.MaxAttempts = 5
+	}
+	if config.Webhooks.TimeoutSeconds <= 0 {
+		config.Webhooks.TimeoutSeconds = 10
+	}
+	if config.EventStream.Source == "" {
+		config.EventStream.Source = EventSourceInternal
+	}
+	if config.EventStream.HeartbeatSeconds <= 0 {
+		config.EventStream.HeartbeatSeconds = defaultEventHeartbeatSeconds
+	}
+	if config.EventStream.BufferSize <= 0 {
+		config.EventStream.BufferSize = defaultEventBufferSize
+	}
+	if config.EmailLookup.MaxEmails <= 0 {
+		config.EmailLookup.MaxEmails = 100
+	}
+	if config.EmailLookup.RequestsPerMinute <= 0 {
+		config.EmailLookup.RequestsPerMinute = 10
+	}
+	if config.EmailLookup.Burst <= 0 {
+		config.EmailLookup.Burst = 5
+	}
+	if config.Publishing.Default == (PublishDestination{}) {
+		config.Publishing.Default.Queue = UserQueueName
+	}
+	if config.Publishing.Format == "" {
+		config.Publishing.Format = EventFormatCloudEvents
+	}
+	if config.Publishing.Source == "" {
+		config.Publishing.Source = defaultEventSource
+	}
+	if config.Consumer.MaxAttempts <= 0 {
+		config.Consumer.MaxAttempts = 5
+	}
+	if config.Consumer.Receivers <= 0 {
+		config.Consumer.Receivers = 1
+	}
+	if config.Consumer.Prefetch <= 0 {
+		config.Consumer.Prefetch = ConsumerBatchSize
+	}
+	if config.Resilience.MaxAttempts <= 0 {
+		config.Resilience.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if config.Resilience.BaseDelayMs <= 0 {
+		config.Resilience.BaseDelayMs = DefaultRetryBaseDelayMs
+	}
+	if config.Resilience.MaxDelaySeconds <= 0 {
+		config.Resilience.MaxDelaySeconds = DefaultRetryMaxDelaySecs
+	}
+	if config.Resilience.BreakerFailures <= 0 {
+		config.Resilience.BreakerFailures = defaultBreakerFailures
+	}
+	if config.Resilience.BreakerOpenSeconds <= 0 {
+		config.Resilience.BreakerOpenSeconds = defaultBreakerOpenSeconds
+	}
+	if config.DependencyLimits.BlobUploads <= 0 {
+		config.DependencyLimits.BlobUploads = defaultBlobUploadSlots
+	}
+	if config.DependencyLimits.ServiceBusSends <= 0 {
+		config.DependencyLimits.ServiceBusSends = defaultServiceBusSendSlots
+	}
+	if config.DependencyLimits.QueueSize <= 0 {
+		config.DependencyLimits.QueueSize = defaultLimitQueueSize
+	}
+	if config.DependencyLimits.QueueWaitSeconds <= 0 {
+		config.DependencyLimits.QueueWaitSeconds = defaultLimitQueueWaitSeconds
+	}
+	if config.Tenancy.Header == "" {
+		config.Tenancy.Header = "X-Tenant-ID"
+	}
+	if config.Deletion.Mode == "" {
+		config.Deletion.Mode = DeletionModeSoft
+	}
+	if config.AsyncCreation.Workers <= 0 {
+		config.AsyncCreation.Workers = defaultCreationWorkers
+	}
+	if config.AsyncCreation.QueueSize <= 0 {
+		config.AsyncCreation.QueueSize = defaultCreationQueueSize
+	}
+	if config.Bulk.MaxBatchSize <= 0 {
+		config.Bulk.MaxBatchSize = 1000
+	}
+	if config.Bulk.MaxImportBytes <= 0 {
+		config.Bulk.MaxImportBytes = defaultMaxImportBytes
+	}
+	if config.PictureLinks.LinkMinutes <= 0 {
+		config.PictureLinks.LinkMinutes = defaultPictureLinkMinutes
+	}
+	if config.DataExport.LinkMinutes <= 0 {
+		config.DataExport.LinkMinutes = defaultDataExportLinkMinutes
+	}
+	if config.Verification.TTLHours <= 0 {
+		config.Verification.TTLHours = defaultVerificationTTLHours
+	}
+	if config.PasswordReset.TTLMinutes <= 0 {
+		config.PasswordReset.TTLMinutes = defaultPasswordResetTTLMinutes
+	}
+	if config.PasswordReset.MaxPerHour <= 0 {
+		config.PasswordReset.MaxPerHour = defaultPasswordResetsPerHour
+	}
+	if config.MalwareScan.Provider == "" {
+		config.MalwareScan.Provider = ScanProviderNone
+	}
+	if config.MalwareScan.ClamAV.TimeoutSeconds <= 0 {
+		config.MalwareScan.ClamAV.TimeoutSeconds = 30
+	}
+	if config.Mail.Provider == "" {
+		config.Mail.Provider = MailProviderLog
+	}
+	if config.Mail.SMTP.Port <= 0 {
+		config.Mail.SMTP.Port = 587
+	}
+	if config.Mail.Notifications.Workers <= 0 {
+		config.Mail.Notifications.Workers = defaultMailWorkers
+	}
+	if config.Mail.Notifications.MaxAttempts <= 0 {
+		config.Mail.Notifications.MaxAttempts = defaultMailMaxAttempts
+	}
+	for name, job := range config.Scheduler.Jobs {
+		if job.TimeoutMinutes == 0 {
+			job.TimeoutMinutes = defaultJobTimeoutMinutes
+			config.Scheduler.Jobs[name] = job
+		}
+	}
+	if len(config.Scheduler.WarmTenants) == 0 {
+		config.Scheduler.WarmTenants = []string{""}
+	}
+	if config.Idempotency.TTLHours <= 0 {
+		config.Idempotency.TTLHours = defaultIdempotencyTTLHours
+	}
+	if config.RateLimit.RequestsPerSecond <= 0 {
+		config.RateLimit.RequestsPerSecond = 10
+	}
+	if config.RateLimit.Burst <= 0 {
+		config.RateLimit.Burst = 20
+	}
+	if config.Server.ReadHeaderTimeoutSeconds <= 0 {
+		config.Server.ReadHeaderTimeoutSeconds = 5
+	}
+	if config.Server.ReadTimeoutSeconds <= 0 {
+		config.Server.ReadTimeoutSeconds = 15
+	}
+	if config.Server.WriteTimeoutSeconds <= 0 {
+		config.Server.WriteTimeoutSeconds = 30
+	}
+	if config.Server.IdleTimeoutSeconds <= 0 {
+		config.Server.IdleTimeoutSeconds = 120
+	}
+	if config.Server.UploadTimeoutSeconds <= 0 {
+		config.Server.UploadTimeoutSeconds = 300
+	}
+	if config.Server.RequestTimeoutSeconds <= 0 {
+		config.Server.RequestTimeoutSeconds = 30
+	}
+	if config.Server.Addr == "" {
+		config.Server.Addr = ":8080"
+	}
+	if config.Server.TLS.Autocert.CacheDir == "" {
+		config.Server.TLS.Autocert.CacheDir = defaultAutocertCacheDir
+	}
+	if config.Database.Driver == "" {
+		config.Database.Driver = DatabaseDriverSQLServer
+	}
+	if config.Database.MaxOpenConns <= 0 {
+		config.Database.MaxOpenConns = defaultMaxOpenConns
+	}
+	if config.Database.MaxIdleConns <= 0 {
+		config.Database.MaxIdleConns = min(defaultMaxIdleConns, config.Database.MaxOpenConns)
+	}
+	if config.Database.ConnMaxLifetimeMinutes <= 0 {
+		config.Database.ConnMaxLifetimeMinutes = defaultConnMaxLifetimeMinutes
+	}
+	if config.Database.StartupTimeoutSeconds <= 0 {
+		config.Database.StartupTimeoutSeconds = defaultDBStartupTimeoutSeconds
+	}
+	if config.Database.ReplicaCheckIntervalSeconds <= 0 {
+		config.Database.ReplicaCheckIntervalSeconds = defaultReplicaCheckIntervalSeconds
+	}
+	if config.AppConfiguration.KeyPrefix == "" {
+		config.AppConfiguration.KeyPrefix = defaultAppConfigPrefix
+	}
+	if config.AppConfiguration.RefreshSeconds <= 0 {
+		config.AppConfiguration.RefreshSeconds = defaultAppConfigRefreshSeconds
+	}
+	if config.KeyVault.RefreshMinutes == 0 {
+		config.KeyVault.RefreshMinutes = defaultKeyVaultRefreshMinutes
+	}
+	if config.Server.ShutdownTimeoutSeconds <= 0 {
+		config.Server.ShutdownTimeoutSeconds = 30
+	}
+	if config.Server.MaxInFlightRequests == 0 {
+		config.Server.MaxInFlightRequests = defaultMaxInFlightRequests
+	}
+	if config.Server.MaxInFlightUploads == 0 {
+		config.Server.MaxInFlightUploads = defaultMaxInFlightUploads
+	}
+	if config.Server.MaxHeaderBytes <= 0 {
+		config.Server.MaxHeaderBytes = 64 << 10
+	}
+	if config.Server.MaxBodyBytes <= 0 {
+		config.Server.MaxBodyBytes = 1 << 20
+	}
+	if config.Server.MaxUploadBytes <= 0 {
+		config.Server.MaxUploadBytes = 10 << 20
+	}
+	if config.Server.CompressMinBytes == 0 {
+		config.Server.CompressMinBytes = defaultCompressMinBytes
+	}
+}
+
+// Seconds converts a whole-seconds config value to a duration
+func Seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+// databaseDSNProblem says what is wrong with a connection string to the
+// database.driver database, if anything
+func databaseDSNProblem(driver, dsn string) string {
+	switch driver {
+	case DatabaseDriverSQLServer:
+		sql, _, err := msdsn.Parse(dsn)
+		if err != nil {
+			return fmt.Sprintf("can't be parsed: %v", err)
+		}
+		if sql.Host == "" {
+			return "names no server"
+		}
+	case DatabaseDriverPostgres:
+		dsn, err := PostgresDSN(dsn)
+		if err == nil {
+			_, err = pq.NewConnector(dsn)
+		}
+		if err != nil {
+			return fmt.Sprintf("can't be parsed: %v", err)
+		}
+	case DatabaseDriverMySQL:
+		config, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return fmt.Sprintf("can't be parsed: %v", err)
+		}
+		if config.DBName == "" {
+			return "names no database"
+		}
+	}
+	return ""
+}
+
+// Validate checks required settings and reports every problem at once,
+// along with those found by checks of the settings other packages read
+func Validate(config Config, checks ...func(Config) []string) error {
+	var problems []string
+	type setting struct{ key, value string }
+	var required []setting
+	switch config.Database.Driver {
+	case DatabaseDriverSQLServer, DatabaseDriverPostgres, DatabaseDriverMySQL:
+		required = append(required, setting{"database.connection_string", config.Database.ConnectionString})
+	case DatabaseDriverMemory:
+		if config.Database.ReplicaConnectionString != "" {
+			problems = append(problems, configKey("database.replica_connection_string")+" needs a database.driver other than memory")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("database.driver must be %q, %q, %q or %q, got %q", DatabaseDriverSQLServer, DatabaseDriverPostgres, DatabaseDriverMySQL, DatabaseDriverMemory, config.Database.Driver))
+	}
+	if config.Database.MaxIdleConns > config.Database.MaxOpenConns {
+		problems = append(problems, fmt.Sprintf("database.max_idle_conns (%d) may not exceed database.max_open_conns (%d)", config.Database.MaxIdleConns, config.Database.MaxOpenConns))
+	}
+	blobAzure, serviceBusAzure := config.Azure.BlobDriver == BlobDriverAzure, config.Azure.ServiceBusDriver == ServiceBusDriverAzure
+	switch config.Azure.Auth {
+	case AzureAuthConnectionString:
+		if blobAzure {
+			required = append(required, setting{"azure.blob_connection_string", config.Azure.BlobConnectionString})
+		}
+		if serviceBusAzure {
+			required = append(required, setting{"azure.service_bus_connection_string", config.Azure.ServiceBusConnectionString})
+		}
+	case AzureAuthDefaultCredential:
+		// The identity takes the place of the keys; the database connection string still names the server
+		if blobAzure {
+			required = append(required, setting{"azure.blob_account_url", config.Azure.BlobAccountURL})
+		}
+		if serviceBusAzure {
+			required = append(required, setting{"azure.service_bus_namespace", config.Azure.ServiceBusNamespace})
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("azure.auth must be %q or %q, got %q", AzureAuthConnectionString, AzureAuthDefaultCredential, config.Azure.Auth))
+	}
+	switch config.Azure.BlobDriver {
+	case BlobDriverAzure, BlobDriverFilesystem:
+	default:
+		problems = append(problems, fmt.Sprintf("azure.blob_driver must be %q or %q, got %q", BlobDriverAzure, BlobDriverFilesystem, config.Azure.BlobDriver))
+	}
+	switch config.Azure.ServiceBusDriver {
+	case ServiceBusDriverAzure:
+	case ServiceBusDriverMemory:
+		// Nothing can be received from the in-process queues
+		if config.Consumer.Enabled {
+			problems = append(problems, "consumer.enabled needs azure.service_bus_driver azure")
+		}
+		if config.EventStream.Source == EventSourceServiceBus {
+			problems = append(problems, "event_stream.source servicebus needs azure.service_bus_driver azure")
+		}
+		if config.SearchIndex.Subscription != "" {
+			problems = append(problems, "search_index.subscription needs azure.service_bus_driver azure")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("azure.service_bus_driver must be %q or %q, got %q", ServiceBusDriverAzure, ServiceBusDriverMemory, config.Azure.ServiceBusDriver))
+	}
+	for _, field := range required {
+		if strings.TrimSpace(field.value) == "" {
+			problems = append(problems, configKey(field.key)+" is required")
+		}
+	}
+	problems = append(problems, connectionStringProblems(config)...)
+
+	if mode := config.Deletion.Mode; mode != DeletionModeSoft && mode != DeletionModeHard {
+		problems = append(problems, fmt.Sprintf("deletion.mode must be %q or %q, got %q", DeletionModeSoft, DeletionModeHard, mode))
+	}
+	if config.Seed.Users < 0 {
+		problems = append(problems, fmt.Sprintf("seed.users may not be negative, got %d", config.Seed.Users))
+	}
+	if config.Deletion.RetentionDays < 0 {
+		problems = append(problems, fmt.Sprintf("deletion.retention_days may not be negative, got %d", config.Deletion.RetentionDays))
+	}
+	checkDestination := func(key string, destination PublishDestination) {
+		if (destination.Queue == "") == (destination.Topic == "") {
+			problems = append(problems, fmt.Sprintf("%s needs exactly one of queue and topic", key))
+		}
+	}
+	checkDestination("publishing.default", config.Publishing.Default)
+	for _, eventType := range slices.Sorted(maps.Keys(config.Publishing.EventTypes)) {
+		checkDestination("publishing.event_types."+eventType, config.Publishing.EventTypes[eventType])
+	}
+	if format := config.Publishing.Format; format != EventFormatCloudEvents && format != EventFormatLegacy {
+		problems = append(problems, fmt.Sprintf("publishing.format must be %q or %q, got %q", EventFormatCloudEvents, EventFormatLegacy, format))
+	}
+	if config.BlobCleanup.IntervalMinutes < 0 {
+		problems = append(problems, fmt.Sprintf("blob_cleanup.interval_minutes may not be negative, got %d", config.BlobCleanup.IntervalMinutes))
+	}
+	if link := config.PictureLinks.CDNBaseURL; link != "" {
+		if u, err := url.Parse(link); err != nil || !u.IsAbs() || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("picture_links.cdn_base_url must be an absolute URL, got %q", link))
+		}
+		if config.PictureLinks.SAS {
+			problems = append(problems, "picture_links.cdn_base_url and picture_links.sas can't both be set")
+		}
+	}
+	if name := config.Azure.PicturesContainer; len(name) < 3 || len(name) > 63 || !containerNamePattern.MatchString(name) {
+		problems = append(problems, fmt.Sprintf("azure.pictures_container must be 3-63 lowercase letters, digits and single hyphens, starting and ending with a letter or digit, got %q", name))
+	}
+	switch config.Azure.ContainerAccess {
+	case "", ContainerAccessPrivate, ContainerAccessBlob, ContainerAccessContainer:
+	default:
+		problems = append(problems, fmt.Sprintf("azure.container_access must be private, blob or container, got %q", config.Azure.ContainerAccess))
+	}
+	if config.Validation.MaxNameLength > maxNameColumnLength {
+		problems = append(problems, fmt.Sprintf("validation.max_name_length may be at most %d, got %d", maxNameColumnLength, config.Validation.MaxNameLength))
+	}
+	for _, size := range config.Thumbnails.Sizes {
+		if size <= 0 {
+			problems = append(problems, fmt.Sprintf("thumbnails.sizes must be positive, got %d", size))
+		}
+	}
+	if len(config.Webhooks.URLs) > 0 && config.Webhooks.Secret == "" {
+		problems = append(problems, "webhooks.secret is required when webhooks.urls is set")
+	}
+	if jwtConfig := config.Auth.JWT; jwtConfig.JWKSURL != "" {
+		if u, err := url.Parse(jwtConfig.JWKSURL); err != nil || !u.IsAbs() || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("auth.jwt.jwks_url must be an absolute URL, got %q", jwtConfig.JWKSURL))
+		}
+		if jwtConfig.Issuer == "" || jwtConfig.Audience == "" {
+			problems = append(problems, "auth.jwt.issuer and auth.jwt.audience are required when auth.jwt.jwks_url is set")
+		}
+	}
+	if entra := config.Auth.Entra; entra.TenantID != "" {
+		if !entraTenantPattern.MatchString(entra.TenantID) {
+			problems = append(problems, fmt.Sprintf("auth.entra.tenant_id must be a directory GUID, got %q", entra.TenantID))
+		}
+		if entra.ClientID == "" {
+			problems = append(problems, "auth.entra.client_id is required when auth.entra.tenant_id is set")
+		}
+		if config.Auth.JWT.JWKSURL != "" {
+			problems = append(problems, "auth.entra and auth.jwt can't both be configured")
+		}
+	}
+	if secret := config.Auth.Sessions.Secret; secret != "" {
+		if len(secret) < 32 {
+			problems = append(problems, "auth.sessions.secret must be at least 32 characters")
+		}
+		if config.Auth.JWT.JWKSURL == "" && config.Auth.Entra.TenantID == "" && len(config.OAuth.Providers) == 0 {
+			problems = append(problems, "auth.sessions needs auth.jwt, auth.entra or oauth.providers to verify logins")
+		}
+	}
+	if len(config.OAuth.Providers) > 0 {
+		for name, provider := range config.OAuth.Providers {
+			if name != OAuthProviderGoogle && name != OAuthProviderGitHub {
+				problems = append(problems, fmt.Sprintf("oauth.providers may be google or github, got %q", name))
+			}
+			if provider.ClientID == "" || provider.ClientSecret == "" {
+				problems = append(problems, fmt.Sprintf("oauth.providers.%s needs client_id and client_secret", name))
+			}
+		}
+		if u, err := url.Parse(config.OAuth.BaseURL); err != nil || !u.IsAbs() || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("oauth.base_url must be an absolute URL, got %q", config.OAuth.BaseURL))
+		}
+		if config.Auth.Sessions.Secret == "" {
+			problems = append(problems, "oauth.providers needs auth.sessions.secret to issue sessions")
+		}
+		if config.OAuth.Tenant != "" && !TenantIDPattern.MatchString(config.OAuth.Tenant) {
+			problems = append(problems, fmt.Sprintf("oauth.tenant is not a valid tenant ID: %q", config.OAuth.Tenant))
+		}
+	}
+	if secret := config.Verification.Secret; secret != "" && len(secret) < 32 {
+		problems = append(problems, "verification.secret must be at least 32 characters")
+	}
+	if config.Verification.RequireForLogin && config.Verification.Secret == "" {
+		problems = append(problems, "verification.require_for_login needs verification.secret to send links")
+	}
+	if link := config.Verification.LinkURL; link != "" {
+		if u, err := url.Parse(link); err != nil || !u.IsAbs() || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("verification.link_url must be an absolute URL, got %q", link))
+		}
+	}
+	if config.PasswordReset.Enabled {
+		if u, err := url.Parse(config.PasswordReset.LinkURL); err != nil || !u.IsAbs() || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("password_reset.link_url must be an absolute URL, got %q", config.PasswordReset.LinkURL))
+		}
+	}
+	switch config.EventStream.Source {
+	case EventSourceInternal:
+	case EventSourceServiceBus:
+		if config.EventStream.Topic == "" || config.EventStream.Subscription == "" {
+			problems = append(problems, "event_stream.topic and event_stream.subscription are required when event_stream.source is servicebus")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("event_stream.source must be internal or servicebus, got %q", config.EventStream.Source))
+	}
+	switch config.MalwareScan.Provider {
+	case ScanProviderNone:
+	case ScanProviderClamAV:
+		if config.MalwareScan.ClamAV.Address == "" {
+			problems = append(problems, "malware_scan.clamav.address is required when malware_scan.provider is clamav")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("malware_scan.provider must be %q or %q, got %q", ScanProviderNone, ScanProviderClamAV, config.MalwareScan.Provider))
+	}
+	switch config.Mail.Provider {
+	case MailProviderLog:
+	case MailProviderSMTP:
+		if config.Mail.SMTP.Host == "" || config.Mail.From == "" {
+			problems = append(problems, "mail.smtp.host and mail.from are required when mail.provider is smtp")
+		}
+	case MailProviderACS:
+		if config.Mail.ACS.Endpoint == "" && config.Mail.ACS.ConnectionString == "" {
+			problems = append(problems, "mail.acs.endpoint or "+configKey("mail.acs.connection_string")+" is required when mail.provider is acs")
+		}
+		if s := config.Mail.ACS.ConnectionString; s != "" {
+			if parts := ParseAzureConnectionString(s); parts["endpoint"] == "" || parts["accesskey"] == "" {
+				problems = append(problems, configKey("mail.acs.connection_string")+" needs endpoint and accesskey")
+			}
+		}
+		if config.Mail.From == "" {
+			problems = append(problems, "mail.from is required when mail.provider is acs")
+		}
+	case MailProviderSendGrid:
+		if config.Mail.SendGrid.APIKey == "" || config.Mail.From == "" {
+			problems = append(problems, configKey("mail.sendgrid.api_key")+" and mail.from are required when mail.provider is sendgrid")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("mail.provider must be log, smtp, acs or sendgrid, got %q", config.Mail.Provider))
+	}
+	if tls := config.Server.TLS; (tls.CertFile == "") != (tls.KeyFile == "") {
+		problems = append(problems, "server.tls.cert_file and server.tls.key_file must be set together")
+	} else if tls.CertFile != "" && len(tls.Autocert.Domains) > 0 {
+		problems = append(problems, "server.tls.cert_file and server.tls.autocert.domains may not both be set")
+	} else if tls.RedirectAddr != "" && tls.CertFile == "" && len(tls.Autocert.Domains) == 0 {
+		problems = append(problems, "server.tls.redirect_addr needs server.tls.cert_file or server.tls.autocert.domains")
+	}
+	for _, check := range checks {
+		problems = append(problems, check(config)...)
+	}
+	for route, limit := range config.RateLimit.Routes {
+		if limit.RequestsPerSecond <= 0 || limit.Burst <= 0 {
+			problems = append(problems, fmt.Sprintf("rate_limit.routes[%q] needs a positive requests_per_second and burst", route))
+		}
+	}
+	for route, timeout := range config.Server.RouteTimeouts {
+		if method, path, ok := strings.Cut(route, " "); !ok || method == "" || !strings.HasPrefix(path, "/") {
+			problems = append(problems, fmt.Sprintf("server.route_timeouts keys must be a method and a route template, e.g. \"GET /v1/users\", got %q", route))
+		}
+		if timeout < 0 {
+			problems = append(problems, fmt.Sprintf("server.route_timeouts[%q] may not be negative, got %d", route, timeout))
+		}
+	}
+	if _, _, err := net.SplitHostPort(config.Server.Addr); err != nil {
+		problems = append(problems, fmt.Sprintf("server.addr must be [host]:port, e.g. :8080, got %q", config.Server.Addr))
+	}
+	if config.Resilience.BaseDelayMs > config.Resilience.MaxDelaySeconds*1000 {
+		problems = append(problems, fmt.Sprintf("resilience.base_delay_ms (%d) may not exceed resilience.max_delay_seconds (%d)", config.Resilience.BaseDelayMs, config.Resilience.MaxDelaySeconds))
+	}
+	if config.Thumbnails.MaxDimension > maxThumbnailDimension {
+		problems = append(problems, fmt.Sprintf("thumbnails.max_dimension may be at most %d, got %d", maxThumbnailDimension, config.Thumbnails.MaxDimension))
+	}
+	if settings := config.AppConfiguration; settings.Endpoint != "" && settings.ConnectionString != "" {
+		problems = append(problems, "app_configuration.endpoint and app_configuration.connection_string may not both be set")
+	}
+	if link := config.SearchIndex.Endpoint; link != "" {
+		if u, err := url.Parse(link); err != nil || u.Scheme != "https" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("search_index.endpoint must be an https URL, e.g. https://name.search.windows.net, got %q", link))
+		}
+		if config.SearchIndex.APIKey == "" && config.Azure.Auth != AzureAuthDefaultCredential {
+			problems = append(problems, configKey("search_index.api_key")+" is required unless azure.auth is "+AzureAuthDefaultCredential)
+		}
+		if (config.SearchIndex.Topic == "") != (config.SearchIndex.Subscription == "") {
+			problems = append(problems, "search_index.topic and search_index.subscription must be set together")
+		}
+	}
+	if config.Tracing.SampleRate > 1 {
+		problems = append(problems, fmt.Sprintf("tracing.sample_rate must be between 0 and 1, got %v", config.Tracing.SampleRate))
+	}
+	switch strings.ToLower(config.Logging.Level) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("logging.level must be debug, info, warn or error, got %q", config.Logging.Level))
+	}
+	if config.Logging.AccessSampleRate > 1 {
+		problems = append(problems, fmt.Sprintf("logging.access_sample_rate must be between 0 and 1, got %v", config.Logging.AccessSampleRate))
+	}
+	for route, rate := range config.Logging.AccessRouteSampleRates {
+		if rate < 0 || rate > 1 {
+			problems = append(problems, fmt.Sprintf("logging.access_route_sample_rates[%q] must be between 0 and 1, got %v", route, rate))
+		}
+	}
+	switch strings.ToLower(config.Logging.Format) {
+	case "", "json", "text":
+	default:
+		problems = append(problems, fmt.Sprintf("logging.format must be json or text, got %q", config.Logging.Format))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("configuration has problems:\n  - " + strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// PostgresDSN is a PostgreSQL URL or key=value connection string as key=value
+// pairs whose session runs in UTC, so timestamps read back as SQL Server's do
+func PostgresDSN(connectionString string) (string, error) {
+	dsn := connectionString
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return "", err
+		}
+	}
+	return dsn + " timezone=UTC", nil
+}
+
+// FeatureFlag is one of features, rolled out by tenant. In the config a flag
+// may also be just true or false, for every tenant.
+type FeatureFlag struct {
+	Enabled           bool     `json:"enabled"`            // Off for every tenant when false
+	Tenants           []string `json:"tenants"`            // On for these tenants whatever rollout_percentage; "" is the default tenant
+	ExcludedTenants   []string `json:"excluded_tenants"`   // Off for these tenants whatever else says
+	RolloutPercentage int      `json:"rollout_percentage"` // Share of the other tenants it's on for (default 100), the same ones as long as it doesn't fall
+}
+
+func (f *FeatureFlag) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		*f = FeatureFlag{Enabled: enabled, RolloutPercentage: 100}
+		return nil
+	}
+	type plain FeatureFlag
+	flag := plain{RolloutPercentage: 100}
+	if err := json.Unmarshal(data, &flag); err != nil {
+		return errors.New("want true, false or an object of enabled, tenants, excluded_tenants and rollout_percentage")
+	}
+	*f = FeatureFlag(flag)
+	return nil
+}
+
+// EnabledFor reports whether the flag name is on for tenant. Which tenants
+// the rollout takes is decided by a hash of the flag's name and the tenant, so
+// each flag reaches a different share first and raising the percentage only
+// adds tenants.
+func (f FeatureFlag) EnabledFor(name, tenant string) bool {
+	switch {
+	case !f.Enabled || slices.Contains(f.ExcludedTenants, tenant):
+		return false
+	case slices.Contains(f.Tenants, tenant):
+		return true
+	}
+	sum := sha256.Sum256([]byte(name + "\x00" + tenant))
+	return int(binary.BigEndian.Uint64(sum[:8])%100) < f.RolloutPercentage
+}
+
+// PublishDestination is where one type of event is published: a queue or a
+// topic, exactly one of them
+type PublishDestination struct {
+	Queue string `json:"queue"`
+	Topic string `json:"topic"`
+}
+
+// Name returns the entity's name; queues and topics share the namespace's names
+func (d PublishDestination) Name() string {
+	return cmp.Or(d.Queue, d.Topic)
+}
+
+// RetentionRule is one of retention.rules: what it removes, and how old it
+// must be. The age is days, months or both, added up.
+type RetentionRule struct {
+	Name    string   `json:"name"`    // Labels the rule in reports, logs and metrics
+	Target  string   `json:"target"`  // inactive_users or audit_events
+	Days    int      `json:"days"`    // Age in days
+	Months  int      `json:"months"`  // Age in calendar months
+	Tenants []string `json:"tenants"` // Only these tenants' users; every tenant when empty. inactive_users only
+}
+
+// Cutoff is the time before which the rule removes what it targets
+func (r RetentionRule) Cutoff(now time.Time) time.Time {
+	return now.AddDate(0, -r.Months, -r.Days)
+}
+
+// ScheduledJob is one of scheduler.jobs
+type ScheduledJob struct {
+	Schedule       string `json:"schedule"`        // UTC cron expression, e.g. "30 2 * * *", @hourly, @daily and the like, or "@every 10m"
+	TimeoutMinutes int    `json:"timeout_minutes"` // A run is cancelled after this long, and until then no instance starts another (default 60)
+}
+
+func toPtr[T any](v T) *T {
+	return &v
+}
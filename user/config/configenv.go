@@ -0,0 +1,141 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the environment variables that override config.json
+const configEnvPrefix = "USERSVC_"
+
+// Names the config file, config.json by default
+const FileEnv = configEnvPrefix + "CONFIG_FILE"
+
+// Load reads the configuration in layers, each over the one before: the
+// defaults, then the config file unless there is none, then USERSVC_
+// variables. A setting's variable is its JSON path in upper case with dots as
+// underscores, e.g. USERSVC_DATABASE_CONNECTION_STRING for
+// database.connection_string. Lists may be given comma-separated or as JSON,
+// maps and lists of objects as JSON. The file is path, or else the one
+// USERSVC_CONFIG_FILE names.
+func Load(path string) (Config, error) {
+	var config Config
+	if path == "" {
+		path = os.Getenv(FileEnv)
+	}
+	named := path != ""
+	if !named {
+		path = "config.json"
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && !named:
+		// Configured only through the environment
+	case err != nil:
+		return config, fmt.Errorf("failed to read %s: %w", path, err)
+	default:
+		if err := json.Unmarshal(data, &config); err != nil {
+			return config, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+	}
+	if err := applyConfigEnv(reflect.ValueOf(&config).Elem(), nil); err != nil {
+		return config, err
+	}
+	ApplyDefaults(&config)
+	return config, nil
+}
+
+// applyConfigEnv sets the fields of the struct v from the variables of their
+// paths, recursing into nested structs
+func applyConfigEnv(v reflect.Value, path []string) error {
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		fieldPath := append(path[:len(path):len(path)], name)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyConfigEnv(v.Field(i), fieldPath); err != nil {
+				return err
+			}
+			continue
+		}
+		env := configEnvName(fieldPath)
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if err := SetConfigValue(v.Field(i), value); err != nil {
+			return fmt.Errorf("%s (%s): %w", strings.Join(fieldPath, "."), env, err)
+		}
+	}
+	return nil
+}
+
+// configEnvName is the variable overriding the setting at path
+func configEnvName(path []string) string {
+	return configEnvPrefix + strings.ToUpper(strings.Join(path, "_"))
+}
+
+// configKey names a setting for startup errors, with the variable that sets it
+func configKey(key string) string {
+	return fmt.Sprintf("%s (%s)", key, configEnvName(strings.Split(key, ".")))
+}
+
+// SetConfigValue parses one variable into a setting of its field's type
+func SetConfigValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("want true or false, got %q", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("want an integer, got %q", value)
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return fmt.Errorf("want a number, got %q", value)
+		}
+		field.SetFloat(f)
+	case reflect.Pointer:
+		target := reflect.New(field.Type().Elem())
+		if err := SetConfigValue(target.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(target)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list).Convert(field.Type()))
+			return nil
+		}
+		fallthrough
+	default:
+		target := reflect.New(field.Type())
+		if err := json.Unmarshal([]byte(value), target.Interface()); err != nil {
+			return fmt.Errorf("want JSON: %w", err)
+		}
+		field.Set(target.Elem())
+	}
+	return nil
+}
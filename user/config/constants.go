@@ -0,0 +1,82 @@
+package config
+
+import (
+	"regexp"
+)
+
+// How the service signs in to Azure (azure.auth)
+const (
+	AzureAuthConnectionString  = "connection_string"  // The keys in the connection strings
+	AzureAuthDefaultCredential = "default_credential" // Whatever identity azidentity finds: managed or workload identity, or az login locally
+)
+
+// Blob stores azure.blob_driver may name
+const (
+	BlobDriverAzure      = "azure"      // A storage account, Azurite included
+	BlobDriverFilesystem = "filesystem" // blob.FileStorage, for local development
+)
+
+// Service Bus stand-ins azure.service_bus_driver may name
+const (
+	ServiceBusDriverAzure  = "azure"  // A Service Bus namespace
+	ServiceBusDriverMemory = "memory" // events.MemoryPublisher, for local development
+)
+
+// Public access levels for azure.container_access
+const (
+	ContainerAccessPrivate   = "private"
+	ContainerAccessBlob      = "blob"
+	ContainerAccessContainer = "container"
+)
+
+// Formats of published event bodies
+const (
+	EventFormatCloudEvents = "cloudevents" // The user wrapped in a CloudEvents 1.0 envelope
+	EventFormatLegacy      = "legacy"      // The bare user, as before envelopes, while consumers migrate
+)
+
+// Databases database.driver may name
+const (
+	DatabaseDriverSQLServer = "sqlserver" // Azure SQL Database and SQL Server, through go-mssqldb
+	DatabaseDriverPostgres  = "postgres"  // PostgreSQL 12 or later, through lib/pq
+	DatabaseDriverMySQL     = "mysql"     // MySQL 8.0.19 or later, through go-sql-driver/mysql
+	DatabaseDriverMemory    = "memory"    // No database: store.MemoryStore, for local development; nothing outlives the process
+)
+
+// Deletion modes for DELETE /users/{id}
+const (
+	DeletionModeSoft = "soft"
+	DeletionModeHard = "hard"
+)
+
+// Where GET /events gets its events from
+const (
+	EventSourceInternal   = "internal"   // The changes this instance makes
+	EventSourceServiceBus = "servicebus" // A Service Bus subscription, seeing every instance's changes
+)
+
+// A directory (tenant) ID; names like "common" would accept tokens from any tenant
+var entraTenantPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Mail providers
+const (
+	MailProviderLog      = "log"
+	MailProviderSMTP     = "smtp"
+	MailProviderACS      = "acs"      // Azure Communication Services Email
+	MailProviderSendGrid = "sendgrid" // Twilio SendGrid's v3 API
+)
+
+// Malware scan providers
+const (
+	ScanProviderNone   = "none"
+	ScanProviderClamAV = "clamav"
+)
+
+// Social login providers that can be configured
+const (
+	OAuthProviderGoogle = "google"
+	OAuthProviderGitHub = "github"
+)
+
+// Tenant IDs must fit the tenant_id column and be safe to log and use in blob paths
+var TenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
@@ -0,0 +1,175 @@
+package config
+
+// Key prefix of this service's settings in App Configuration, for
+// app_configuration.key_prefix left unset
+const defaultAppConfigPrefix = "usersvc:"
+
+// How often App Configuration is polled, for app_configuration.refresh_seconds left unset
+const defaultAppConfigRefreshSeconds = 30
+
+// Directory of the blobs with blob_driver filesystem, unless azure.blob_directory says otherwise
+const defaultBlobDirectory = "blobs"
+
+// Container holding uploaded profile pictures when azure.pictures_container
+// isn't set
+const defaultPicturesContainer = "profile-pictures"
+
+// Concurrency limit defaults, for dependency_limits settings left unset
+const (
+	defaultBlobUploadSlots       = 16
+	defaultServiceBusSendSlots   = 8
+	defaultLimitQueueSize        = 64
+	defaultLimitQueueWaitSeconds = 10
+)
+
+// Cache lifetimes, for cache.user_ttl_seconds and cache.list_ttl_seconds left unset
+const (
+	defaultCacheUserTTLSeconds = 60
+	defaultCacheListTTLSeconds = 15
+)
+
+// Key prefix of this service's entries, for cache.key_prefix left unset
+const defaultCacheKeyPrefix = "usersvc:"
+
+// Where events say they come from unless publishing.source is set
+const defaultEventSource = "/users"
+
+// Smallest response body compressed when not configured; below it the
+// encoding overhead outweighs the savings
+const defaultCompressMinBytes = 1024
+
+// Messages asked for per receive, unless consumer.prefetch says otherwise
+const ConsumerBatchSize = 10
+
+// CORS defaults, for cors settings left unset
+var (
+	defaultCORSOrigins = []string{"http://localhost:3000"}
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	defaultCORSHeaders = []string{"Content-Type", "Authorization", "X-API-Key", "X-Request-ID", "If-Match", "If-None-Match", "Idempotency-Key", "Prefer", "traceparent", "tracestate"}
+)
+
+// How long a staged export's link works when not configured
+const defaultDataExportLinkMinutes = 60
+
+// Pool settings, for the database settings left unset
+const (
+	defaultMaxOpenConns            = 50
+	defaultMaxIdleConns            = 10
+	defaultConnMaxLifetimeMinutes  = 30
+	defaultDBStartupTimeoutSeconds = 60
+)
+
+// Event stream defaults when not configured
+const (
+	defaultEventHeartbeatSeconds = 15
+	defaultEventBufferSize       = 1000
+)
+
+// How long a response is replayed to retries when not configured
+const defaultIdempotencyTTLHours = 24
+
+// Largest CSV accepted, unless bulk.max_import_bytes says otherwise
+const defaultMaxImportBytes = 100 << 20
+
+// Async creation defaults
+const (
+	defaultCreationWorkers   = 4
+	defaultCreationQueueSize = 32
+)
+
+// How often unversioned references are read again, for key_vault.refresh_minutes left unset
+const defaultKeyVaultRefreshMinutes = 60
+
+// In-flight caps, for server settings left unset
+const (
+	defaultMaxInFlightRequests = 1000
+	defaultMaxInFlightUploads  = 64
+)
+
+// Lockout thresholds when not configured
+const (
+	defaultLockoutMaxFailures   = 5
+	defaultLockoutMaxIPFailures = 50
+	defaultLockoutWindowMinutes = 15
+)
+
+// Mail notification defaults
+const (
+	defaultMailWorkers     = 2
+	defaultMailMaxAttempts = 5
+)
+
+// Minimum password length, unless auth.passwords.min_length says otherwise
+const defaultMinPasswordLength = 12
+
+// Password reset defaults when not configured
+const (
+	defaultPasswordResetTTLMinutes = 60
+	defaultPasswordResetsPerHour   = 3
+)
+
+// How long picture SAS URLs work when not configured
+const defaultPictureLinkMinutes = 60
+
+// Queue carrying user events, unless publishing routes them elsewhere, and
+// consumed by the consumer
+const UserQueueName = "user-queue"
+
+// How often the replica is pinged, for database.replica_check_interval_seconds left unset
+const defaultReplicaCheckIntervalSeconds = 10
+
+// Retry and breaker defaults, for resilience settings left unset
+const (
+	DefaultRetryMaxAttempts   = 3
+	DefaultRetryBaseDelayMs   = 200
+	DefaultRetryMaxDelaySecs  = 5
+	defaultBreakerFailures    = 5
+	defaultBreakerOpenSeconds = 30
+)
+
+// Longest a scheduled job may run, unless its timeout_minutes says otherwise
+const defaultJobTimeoutMinutes = 60
+
+// Settings for the search_index settings left unset
+const (
+	defaultSearchIndexName           = "users"
+	defaultSearchIndexTimeoutSeconds = 5
+)
+
+// Issuer and audience of the access tokens this service signs itself
+const SessionIssuer = "user-service"
+
+// Session lifetimes when not configured
+const (
+	defaultAccessTokenMinutes = 15
+	defaultRefreshTokenDays   = 30
+)
+
+// Longest side of a thumbnail, unless thumbnails.max_dimension says otherwise
+const defaultThumbnailMaxDimension = 256
+
+// Longest sides of the thumbnail variants, in pixels, when not configured
+var defaultThumbnailSizes = []int{64, 256}
+
+// Where autocert keeps its account key and certificates, for server.tls.autocert.cache_dir left unset
+const defaultAutocertCacheDir = "autocert-cache"
+
+// How recent a two-factor check must be for sensitive changes when not configured
+const defaultTwoFactorRecentMinutes = 10
+
+// Upper bound for the users.link column
+const defaultMaxLinkLength = 2048
+
+// Upper bounds of the users.name and users.email columns
+const (
+	maxNameColumnLength  = 255
+	MaxEmailColumnLength = 320
+)
+
+// Photo limits when not configured
+const defaultMaxPhotoBytes = 5 << 20
+
+var defaultPhotoContentTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// How long a verification link works when not configured
+const defaultVerificationTTLHours = 48
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"user/user/config"
+	"user/user/store"
+)
+
+// initDB opens the pool every store shares, and returns the connector under
+// it, which takes a rotated connection string
+func initDB(cfg config.Config) (*sql.DB, *store.ResilientConnector) {
+	if cfg.Database.QueryTimeoutSeconds > 0 {
+		store.QueryTimeout = time.Duration(cfg.Database.QueryTimeoutSeconds) * time.Second
+	}
+
+	next, err := store.NewDBConnector(cfg, cfg.Database.ConnectionString)
+	if err != nil {
+		fatal("Error connecting to the database", "error", err)
+	}
+	connector := store.NewResilientConnector(next)
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.Database.ConnMaxLifetimeMinutes) * time.Minute)
+
+	// Wait for the database to be reachable, as it may start after the service
+	if err = store.WaitForDB(db, config.Seconds(cfg.Database.StartupTimeoutSeconds)); err != nil {
+		fatal("Cannot reach the database", "timeout_seconds", cfg.Database.StartupTimeoutSeconds, "error", err)
+	}
+	slog.Info("Successfully connected to the database", "driver", cfg.Database.Driver)
+	return db, connector
+}
@@ -0,0 +1,69 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"user/user/config"
+)
+
+// Content type of a structured-mode CloudEvent
+const cloudEventsContentType = "application/cloudevents+json; charset=utf-8"
+
+// cloudEvent is the CloudEvents 1.0 structured-mode envelope of a user event.
+// schemaversion and tenantid are extension attributes.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	ID              string          `json:"id"`
+	Time            time.Time       `json:"time"`
+	Subject         string          `json:"subject"` // The user's ID
+	DataContentType string          `json:"datacontenttype"`
+	SchemaVersion   string          `json:"schemaversion"`
+	TenantID        string          `json:"tenantid,omitempty"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// Encode returns the body and content type an outbox event is published
+// with in format. The envelope shares the message's ID, so a resend is
+// recognizably the same event.
+func Encode(event OutboxEvent, format, source string) ([]byte, string, error) {
+	if format == config.EventFormatLegacy {
+		return event.Body, "application/json", nil
+	}
+	body, err := json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		Type:            event.EventType,
+		Source:          source,
+		ID:              event.MessageID,
+		Time:            event.CreatedAt.UTC(),
+		Subject:         strconv.FormatInt(event.UserID, 10),
+		DataContentType: "application/json",
+		SchemaVersion:   event.SchemaVersion,
+		TenantID:        event.TenantID,
+		Data:            event.Body,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal event envelope: %v", err)
+	}
+	return body, cloudEventsContentType, nil
+}
+
+// MessageData returns the user JSON a received event carries, whichever format it
+// was published in
+func MessageData(msg *azservicebus.ReceivedMessage) ([]byte, error) {
+	if msg.ContentType == nil || !strings.HasPrefix(*msg.ContentType, "application/cloudevents+json") {
+		return msg.Body, nil
+	}
+	var envelope cloudEvent
+	if err := json.Unmarshal(msg.Body, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid event envelope: %v", err)
+	}
+	return envelope.Data, nil
+}
@@ -0,0 +1,205 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"user/user/config"
+	"user/user/resilience"
+)
+
+// NewServiceBusClient connects to the Service Bus namespace the configured way
+func NewServiceBusClient(cfg config.Config) (*azservicebus.Client, error) {
+	if cfg.Azure.Auth == config.AzureAuthDefaultCredential {
+		credential, err := config.AzureCredential()
+		if err != nil {
+			return nil, err
+		}
+		return azservicebus.NewClient(cfg.Azure.ServiceBusNamespace, credential, nil)
+	}
+	return azservicebus.NewClientFromConnectionString(cfg.Azure.ServiceBusConnectionString, nil)
+}
+
+// Event types published to Service Bus
+const (
+	UserCreated = "user.created"
+	UserUpdated = "user.updated"
+	UserDeleted = "user.deleted"
+	UserLocked  = "user.locked"
+	UserErased  = "user.erased" // Consumers must purge their copies of the user's personal data
+)
+
+// Every event type published, for routing in publishing.event_types
+var UserEventTypes = []string{UserCreated, UserUpdated, UserDeleted, UserLocked, UserErased}
+
+// ConfigProblems checks publishing.event_types names only events published
+func ConfigProblems(cfg config.Config) []string {
+	var problems []string
+	for _, eventType := range slices.Sorted(maps.Keys(cfg.Publishing.EventTypes)) {
+		if !slices.Contains(UserEventTypes, eventType) {
+			problems = append(problems, fmt.Sprintf("publishing.event_types has unknown event type %q", eventType))
+		}
+	}
+	return problems
+}
+
+// Version of the event payload schema, bumped on incompatible changes
+const SchemaVersion = "1"
+
+// Publisher sends user events to Service Bus queues and topics by name:
+// ServiceBusPublisher, with a sender for each. The outbox relay publishes through
+// it and dead letters are requeued through it.
+type Publisher interface {
+	// Destination returns where events of this type are published
+	Destination(eventType string) config.PublishDestination
+	// PublishBatch sends messages, in order, to the named destination,
+	// returning how many were sent before an error
+	PublishBatch(ctx context.Context, name string, messages []*azservicebus.Message) (int, error)
+	// Send sends one message to the named destination
+	Send(ctx context.Context, name string, message *azservicebus.Message) error
+	// Check returns an error unless events can be sent to the user queue
+	Check(ctx context.Context) error
+	// Encoding returns the format of message bodies, config.EventFormatCloudEvents or
+	// config.EventFormatLegacy, and the CloudEvents source attribute
+	Encoding() (format, source string)
+	// Close releases the connections to the destinations
+	Close(ctx context.Context)
+}
+
+// routing is config.Publishing, as the Publisher implementations
+// route and encode events by it
+type routing struct {
+	routes   map[string]config.PublishDestination // By event type
+	fallback config.PublishDestination            // For event types not routed
+	format   string                               // Of message bodies, config.EventFormatCloudEvents or config.EventFormatLegacy
+	source   string                               // CloudEvents source attribute
+}
+
+func newRouting(cfg config.Config) routing {
+	return routing{
+		routes:   cfg.Publishing.EventTypes,
+		fallback: cfg.Publishing.Default,
+		format:   cfg.Publishing.Format,
+		source:   cfg.Publishing.Source,
+	}
+}
+
+// names lists every destination events are routed to, and the user queue,
+// which dead letters are requeued to
+func (r routing) names() []string {
+	names := []string{config.UserQueueName, r.fallback.Name()}
+	for _, destination := range r.routes {
+		names = append(names, destination.Name())
+	}
+	return names
+}
+
+func (r routing) Destination(eventType string) config.PublishDestination {
+	if destination, ok := r.routes[eventType]; ok {
+		return destination
+	}
+	return r.fallback
+}
+
+func (r routing) Encoding() (string, string) {
+	return r.format, r.source
+}
+
+// ServiceBusPublisher routes user events to the queue or topic configured for their
+// type, through one sender per entity made at startup
+type ServiceBusPublisher struct {
+	routing
+	senders map[string]*azservicebus.Sender
+}
+
+// NewServiceBusPublisher makes the senders for every destination in
+// config.Publishing, and for the user queue
+func NewServiceBusPublisher(client *azservicebus.Client, cfg config.Config) (*ServiceBusPublisher, error) {
+	p := &ServiceBusPublisher{routing: newRouting(cfg), senders: map[string]*azservicebus.Sender{}}
+	for _, name := range p.names() {
+		if _, ok := p.senders[name]; ok {
+			continue
+		}
+		sender, err := client.NewSender(name, nil)
+		if err != nil {
+			p.Close(context.Background())
+			return nil, fmt.Errorf("failed to create sender for %s: %w", name, err)
+		}
+		p.senders[name] = sender
+	}
+	return p, nil
+}
+
+// sender returns the sender for a destination NewServiceBusPublisher was given
+func (p *ServiceBusPublisher) sender(name string) *azservicebus.Sender {
+	return p.senders[name]
+}
+
+// PublishBatch sends the messages in as few batches as the entity's size limit
+// allows: a batch goes out once the next message doesn't fit
+func (p *ServiceBusPublisher) PublishBatch(ctx context.Context, name string, messages []*azservicebus.Message) (int, error) {
+	sender := p.sender(name)
+	sent := 0
+	for sent < len(messages) {
+		batch, err := sender.NewMessageBatch(ctx, nil)
+		if err != nil {
+			return sent, err
+		}
+		for _, message := range messages[sent:] {
+			err := batch.AddMessage(message, nil)
+			if errors.Is(err, azservicebus.ErrMessageTooLarge) && batch.NumMessages() > 0 {
+				break
+			}
+			if err != nil {
+				return sent, err
+			}
+		}
+		err = resilience.WithBulkhead(ctx, resilience.DependencyServiceBus, func() error {
+			return resilience.WithRetry(ctx, resilience.DependencyServiceBus, func() error {
+				return sender.SendMessageBatch(ctx, batch, nil)
+			})
+		})
+		if err != nil {
+			return sent, err
+		}
+		sent += int(batch.NumMessages())
+	}
+	return sent, nil
+}
+
+func (p *ServiceBusPublisher) Send(ctx context.Context, name string, message *azservicebus.Message) error {
+	return p.sender(name).SendMessage(ctx, message, nil)
+}
+
+// Check opens a batch on the user queue's sender, which attaches its link
+func (p *ServiceBusPublisher) Check(ctx context.Context) error {
+	_, err := p.sender(config.UserQueueName).NewMessageBatch(ctx, nil)
+	return err
+}
+
+// Close closes every sender
+func (p *ServiceBusPublisher) Close(ctx context.Context) {
+	for _, sender := range p.senders {
+		sender.Close(ctx)
+	}
+}
+
+// OutboxEvent is a user event waiting in the outbox to be published
+type OutboxEvent struct {
+	ID            int64
+	EventType     string
+	SchemaVersion string
+	MessageID     string // Kept across attempts, so duplicate detection drops a resend
+	UserID        int64
+	TenantID      string
+	Body          []byte         // The user as JSON
+	TraceContext  map[string]any // Of the request that made the change
+	Attempts      int            // Including the one it was claimed for
+	CreatedAt     time.Time      // When the change was made
+}
@@ -0,0 +1,66 @@
+package events
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"user/user/config"
+)
+
+// BenchmarkPublish compares connecting to Service Bus for every event, as the
+// handlers once did, with the publisher made once at startup. Events go to the
+// user queue of the namespace in USERSVC_TEST_SERVICEBUS, a connection string;
+// there is no stand-in for its AMQP endpoint, so it is skipped when not set.
+func BenchmarkPublish(b *testing.B) {
+	var cfg config.Config
+	config.ApplyDefaults(&cfg)
+	cfg.Azure.ServiceBusConnectionString = os.Getenv("USERSVC_TEST_SERVICEBUS")
+	if cfg.Azure.ServiceBusConnectionString == "" {
+		b.Skip("USERSVC_TEST_SERVICEBUS not set")
+	}
+	ctx := context.Background()
+	connect := func() (*azservicebus.Client, *ServiceBusPublisher) {
+		client, err := NewServiceBusClient(cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		publisher, err := NewServiceBusPublisher(client, cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return client, publisher
+	}
+	sharedClient, shared := connect()
+	b.Cleanup(func() {
+		shared.Close(ctx)
+		sharedClient.Close(ctx)
+	})
+
+	tests := []struct {
+		name    string
+		publish func(message *azservicebus.Message) error
+	}{
+		{name: "new client per call", publish: func(message *azservicebus.Message) error {
+			client, publisher := connect()
+			defer client.Close(ctx)
+			defer publisher.Close(ctx)
+			return publisher.Send(ctx, config.UserQueueName, message)
+		}},
+		{name: "shared client", publish: func(message *azservicebus.Message) error {
+			return shared.Send(ctx, config.UserQueueName, message)
+		}},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			for range b.N {
+				message := &azservicebus.Message{Body: []byte(`{}`), ApplicationProperties: map[string]any{"eventType": UserCreated}}
+				if err := tt.publish(message); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"user/user/config"
+)
+
+// Messages a destination of MemoryPublisher holds before sends to it fail
+const memoryQueueCapacity = 1000
+
+var (
+	ErrMemoryQueueFull = errors.New("in-process event queue is full")
+	ErrPublisherClosed = errors.New("event publisher is closed")
+)
+
+// MemoryPublisher is Publisher with azure.service_bus_driver memory:
+// each destination is a buffered channel, drained by a goroutine of its own
+// that logs the events arriving, so the outbox relay runs without a namespace.
+// A full channel fails the send, which the relay retries, as it would a
+// throttled namespace.
+type MemoryPublisher struct {
+	routing
+	mu      sync.Mutex
+	queues  map[string]chan *azservicebus.Message
+	closed  bool
+	drained sync.WaitGroup
+}
+
+func NewMemoryPublisher(cfg config.Config) *MemoryPublisher {
+	p := &MemoryPublisher{routing: newRouting(cfg), queues: map[string]chan *azservicebus.Message{}}
+	for _, name := range p.names() {
+		if _, ok := p.queues[name]; ok {
+			continue
+		}
+		queue := make(chan *azservicebus.Message, memoryQueueCapacity)
+		p.queues[name] = queue
+		p.drained.Add(1)
+		go p.drain(name, queue)
+	}
+	return p
+}
+
+// drain logs the messages sent to a destination until it is closed
+func (p *MemoryPublisher) drain(name string, queue <-chan *azservicebus.Message) {
+	defer p.drained.Done()
+	for message := range queue {
+		slog.Info("Event published in process", "destination", name, "event_type", message.ApplicationProperties["eventType"],
+			"user_id", message.ApplicationProperties["userId"], "message_id", deref(message.MessageID))
+	}
+}
+
+func (p *MemoryPublisher) PublishBatch(ctx context.Context, name string, messages []*azservicebus.Message) (int, error) {
+	for sent, message := range messages {
+		if err := p.Send(ctx, name, message); err != nil {
+			return sent, err
+		}
+	}
+	return len(messages), nil
+}
+
+func (p *MemoryPublisher) Send(ctx context.Context, name string, message *azservicebus.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPublisherClosed
+	}
+	queue, ok := p.queues[name]
+	if !ok {
+		return fmt.Errorf("no in-process queue %s", name)
+	}
+	select {
+	case queue <- message:
+		return nil
+	default:
+		return ErrMemoryQueueFull
+	}
+}
+
+func (p *MemoryPublisher) Check(ctx context.Context) error {
+	return nil
+}
+
+// Close stops taking messages, and returns once those taken are logged or ctx is done
+func (p *MemoryPublisher) Close(ctx context.Context) {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.drained.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func deref[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
@@ -0,0 +1,240 @@
+package fakes
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"user/user/blob"
+)
+
+// BlobStorage is blob.Storage in process memory, for tests: it keeps what is
+// uploaded so a test can look at it, and fails uploads with UploadErr. Like
+// the Azure storage, it refuses blobs in containers never created.
+type BlobStorage struct {
+	UploadErr error // When set, every Upload, StageBlock and CommitBlocks fails with it
+
+	mu         sync.Mutex
+	containers map[string]map[string]*storedBlob // Blobs by container, then name
+	blocks     map[string]map[string][]byte      // Staged blocks by container and name, then block ID
+	etag       int
+}
+
+type storedBlob struct {
+	body     []byte
+	headers  blob.Headers
+	metadata map[string]string
+	etag     string
+	modified time.Time
+}
+
+// NewBlobStorage returns an empty BlobStorage, with the named containers
+// already created
+func NewBlobStorage(containers ...string) *BlobStorage {
+	s := &BlobStorage{containers: map[string]map[string]*storedBlob{}, blocks: map[string]map[string][]byte{}}
+	for _, name := range containers {
+		s.containers[name] = map[string]*storedBlob{}
+	}
+	return s
+}
+
+// Blob returns the content of a stored blob
+func (s *BlobStorage) Blob(container, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.containers[container][name]
+	if !ok {
+		return nil, false
+	}
+	return slices.Clone(b.body), true
+}
+
+// Names returns the names of a container's blobs, sorted
+func (s *BlobStorage) Names(container string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.containers[container] {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (s *BlobStorage) CreateContainer(ctx context.Context, name, access string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.containers[name]; ok {
+		return blob.ErrContainerExists
+	}
+	s.containers[name] = map[string]*storedBlob{}
+	return nil
+}
+
+func (s *BlobStorage) CheckContainer(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.containers[name]; !ok {
+		return blob.ErrContainerNotFound
+	}
+	return nil
+}
+
+func (s *BlobStorage) Upload(ctx context.Context, container, name string, body io.Reader, headers blob.Headers, metadata map[string]string) error {
+	if s.UploadErr != nil {
+		return s.UploadErr
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.store(container, name, data, headers, metadata)
+}
+
+// store keeps data as the named blob, with the MD5 of it as its Content-MD5;
+// the caller holds mu
+func (s *BlobStorage) store(container, name string, data []byte, headers blob.Headers, metadata map[string]string) error {
+	blobs, ok := s.containers[container]
+	if !ok {
+		return blob.ErrContainerNotFound
+	}
+	sum := md5.Sum(data)
+	headers.ContentMD5 = sum[:]
+	s.etag++
+	blobs[name] = &storedBlob{body: data, headers: headers, metadata: metadata, etag: strconv.Itoa(s.etag), modified: time.Now()}
+	return nil
+}
+
+func (s *BlobStorage) SetHeaders(ctx context.Context, container, name string, headers blob.Headers) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.containers[container][name]
+	if !ok {
+		return blob.ErrNotFound
+	}
+	b.headers = headers
+	return nil
+}
+
+func (s *BlobStorage) Download(ctx context.Context, container, name string) (io.ReadCloser, error) {
+	body, ok := s.Blob(container, name)
+	if !ok {
+		return nil, blob.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(body)), nil
+}
+
+func (s *BlobStorage) Properties(ctx context.Context, container, name string) (blob.Properties, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.containers[container][name]
+	if !ok {
+		return blob.Properties{}, blob.ErrNotFound
+	}
+	return b.properties(name), nil
+}
+
+func (b *storedBlob) properties(name string) blob.Properties {
+	return blob.Properties{Name: name, ETag: b.etag, ContentType: b.headers.ContentType, ContentLength: int64(len(b.body)), LastModified: b.modified}
+}
+
+func (s *BlobStorage) Delete(ctx context.Context, container, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.containers[container][name]; !ok {
+		return blob.ErrNotFound
+	}
+	delete(s.containers[container], name)
+	return nil
+}
+
+func (s *BlobStorage) List(ctx context.Context, container string, pageSize int, page func([]blob.Properties) error) error {
+	if err := s.CheckContainer(ctx, container); err != nil {
+		return err
+	}
+	var all []blob.Properties
+	s.mu.Lock()
+	for _, name := range slices.Sorted(maps.Keys(s.containers[container])) {
+		all = append(all, s.containers[container][name].properties(name))
+	}
+	s.mu.Unlock()
+	for chunk := range slices.Chunk(all, pageSize) {
+		if err := page(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BlobStorage) StageBlock(ctx context.Context, container, name, blockID string, data, checksum []byte) error {
+	if s.UploadErr != nil {
+		return s.UploadErr
+	}
+	if sum := md5.Sum(data); checksum != nil && !bytes.Equal(sum[:], checksum) {
+		return blob.ErrChecksumMismatch
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.containers[container]; !ok {
+		return blob.ErrContainerNotFound
+	}
+	key := container + "/" + name
+	if s.blocks[key] == nil {
+		s.blocks[key] = map[string][]byte{}
+	}
+	s.blocks[key][blockID] = slices.Clone(data)
+	return nil
+}
+
+func (s *BlobStorage) UncommittedBlocks(ctx context.Context, container, name string) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sizes := map[string]int64{}
+	for id, data := range s.blocks[container+"/"+name] {
+		sizes[id] = int64(len(data))
+	}
+	return sizes, nil
+}
+
+func (s *BlobStorage) CommitBlocks(ctx context.Context, container, name string, blockIDs []string) error {
+	if s.UploadErr != nil {
+		return s.UploadErr
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := container + "/" + name
+	var data []byte
+	for _, id := range blockIDs {
+		block, ok := s.blocks[key][id]
+		if !ok {
+			return fmt.Errorf("block %s of %s was never staged", id, key)
+		}
+		data = append(data, block...)
+	}
+	delete(s.blocks, key)
+	return s.store(container, name, data, blob.Headers{}, nil)
+}
+
+func (s *BlobStorage) Signer(ctx context.Context, expiresAt time.Time) (blob.Signer, error) {
+	return blobSigner{expiresAt: expiresAt}, nil
+}
+
+// blobSigner signs URLs on a host no one serves, saying when they expire
+type blobSigner struct {
+	expiresAt time.Time
+}
+
+func (s blobSigner) Sign(container, name string) (string, error) {
+	u := url.URL{Scheme: "https", Host: "blobs.invalid", Path: "/" + container + "/" + name, RawQuery: url.Values{"se": {s.expiresAt.UTC().Format(time.RFC3339)}}.Encode()}
+	return u.String(), nil
+}
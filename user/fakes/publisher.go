@@ -0,0 +1,79 @@
+package fakes
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"user/user/config"
+	"user/user/events"
+)
+
+// Publisher is events.Publisher recording what is sent, for tests: it routes
+// events as config.Publishing says, keeps every message by destination and
+// fails sends with SendErr and health checks with CheckErr.
+type Publisher struct {
+	SendErr  error // When set, every Send and PublishBatch fails with it
+	CheckErr error // Returned by Check
+
+	config config.Config
+	mu     sync.Mutex
+	sent   map[string][]*azservicebus.Message // By destination name
+	closed bool
+}
+
+func NewPublisher(cfg config.Config) *Publisher {
+	return &Publisher{config: cfg, sent: map[string][]*azservicebus.Message{}}
+}
+
+// Sent returns the messages sent to a destination, in order
+func (p *Publisher) Sent(name string) []*azservicebus.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.sent[name])
+}
+
+func (p *Publisher) Destination(eventType string) config.PublishDestination {
+	if destination, ok := p.config.Publishing.EventTypes[eventType]; ok {
+		return destination
+	}
+	return p.config.Publishing.Default
+}
+
+func (p *Publisher) PublishBatch(ctx context.Context, name string, messages []*azservicebus.Message) (int, error) {
+	for sent, message := range messages {
+		if err := p.Send(ctx, name, message); err != nil {
+			return sent, err
+		}
+	}
+	return len(messages), nil
+}
+
+func (p *Publisher) Send(ctx context.Context, name string, message *azservicebus.Message) error {
+	if p.SendErr != nil {
+		return p.SendErr
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return events.ErrPublisherClosed
+	}
+	p.sent[name] = append(p.sent[name], message)
+	return nil
+}
+
+func (p *Publisher) Check(ctx context.Context) error {
+	return p.CheckErr
+}
+
+func (p *Publisher) Encoding() (string, string) {
+	return p.config.Publishing.Format, p.config.Publishing.Source
+}
+
+func (p *Publisher) Close(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// fatal logs an error and exits the process
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -3,215 +3,174 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
-	"time"
-
-	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
-	_ "github.com/denisenkom/go-mssqldb"
-	"github.com/gorilla/mux"
-	"github.com/rs/cors"
+	"os/signal"
+	"syscall"
+
+	"user/user/api"
+	"user/user/config"
+	"user/user/resilience"
+	"user/user/store"
+	"user/user/telemetry"
 )
 
-var db *sql.DB
-
-// Config struct for holding configuration
-type Config struct {
-	Database struct {
-		ConnectionString string `json:"connection_string"`
-	} `json:"database"`
-	Azure struct {
-		BlobConnectionString       string `json:"blob_connection_string"`
-		ServiceBusConnectionString string `json:"service_bus_connection_string"`
-	} `json:"azure"`
-}
-
-// User struct for the API
-type User struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Link      string    `json:"link"`
-	CreatedAt time.Time `json:"createdAt"`
-}
-
-func toPtr[T any](v T) *T {
-	return &v
-}
-
-func initDB(config Config) {
-	var err error
-	db, err = sql.Open("sqlserver", config.Database.ConnectionString) // Use "sqlserver" for Azure SQL
-	if err != nil {
-		log.Fatalf("Error connecting to the database: %v\n", err)
-	}
-
-	// Check if the database is reachable
-	if err = db.Ping(); err != nil {
-		log.Fatalf("Cannot ping the database: %v\n", err)
-	}
-	log.Println("Successfully connected to the Azure SQL Database!")
-}
-
-// Azure Blob Upload Handler
-func uploadToBlobStorage(file io.Reader, filename string, config Config) (string, error) {
-	blobServiceClient, err := azblob.NewClientFromConnectionString(config.Azure.BlobConnectionString, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create blob client: %v", err)
-	}
-
-	blobURL := fmt.Sprintf("%s/%s", "profile-pictures", filename)
-	_, err = blobServiceClient.UploadStream(context.TODO(), "profile-pictures", filename, file, &azblob.UploadStreamOptions{
-		Metadata: map[string]*string{
-			"ContentType": toPtr("image/jpeg"), // Set content type using pointer to string
-		},
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to upload to blob: %v", err)
-	}
-
-	return blobURL, nil
-}
-
-// Send User Data to Azure Service Bus
-func sendToServiceBus(user User, config Config) error {
-	client, err := azservicebus.NewClientFromConnectionString(config.Azure.ServiceBusConnectionString, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create service bus client: %v", err)
+func main() {
+	cmd := parseCommandLine(os.Args[1:])
+	// Operations sent to a running instance need none of the configuration
+	if cmd.command == commandAdmin && cmd.adminAPI != "" {
+		if err := api.RunAdminRemote(context.Background(), cmd.admin, cmd.adminAPI, cmd.adminToken); err != nil {
+			fatal("Admin command failed", "error", err)
+		}
+		return
 	}
-	defer client.Close(context.TODO())
 
-	sender, err := client.NewSender("user-queue", nil)
+	// Load configuration from config.json and USERSVC_ variables, then the flags
+	cfg, err := config.Load(cmd.configFile)
 	if err != nil {
-		return fmt.Errorf("failed to create sender: %v", err)
+		fatal("Error loading configuration", "error", err)
 	}
-	defer sender.Close(context.TODO())
-
-	// Marshal the user data into JSON format
-	userData, err := json.Marshal(user)
+	cmd.apply(&cfg)
+	api.SetupLogging(cfg.Logging.Level, cfg.Logging.Format)
+	// Settings given as keyvault:// references are read from Key Vault
+	secrets, err := api.ResolveSecrets(&cfg)
 	if err != nil {
-		return fmt.Errorf("failed to marshal user data: %v", err)
+		fatal("Error reading secrets from Key Vault", "error", err)
 	}
-
-	// Send the message to the Service Bus queue
-	message := &azservicebus.Message{
-		Body: userData,
+	if err := api.ValidateConfig(cfg); err != nil {
+		fatal("Invalid configuration", "error", err)
 	}
-	err = sender.SendMessage(context.TODO(), message, nil)
+	// App Configuration may change some settings while running, over those read so far
+	appConfig, err := api.NewAppConfigWatcher(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to send message to service bus: %v", err)
+		fatal("Error reading App Configuration", "error", err)
 	}
-
-	log.Printf("User data sent to Service Bus: %s", string(userData))
-	return nil
-}
-
-// API to Create a New User (POST /users)
-func createUser(w http.ResponseWriter, r *http.Request, config Config) {
-	// Parse form data
-	name := r.FormValue("name")
-	email := r.FormValue("email")
-	file, header, err := r.FormFile("photo")
+	cfg = *appConfig.Current()
+	resilience.Setup(cfg)
+	resilience.SetupBulkheads(cfg)
+	shutdownTracing, err := telemetry.SetupTracing(cfg)
 	if err != nil {
-		http.Error(w, "Invalid file upload", http.StatusBadRequest)
-		return
+		fatal("Error setting up tracing", "error", err)
 	}
-	defer file.Close()
 
-	// Upload profile picture to Azure Blob Storage
-	profilePicURL, err := uploadToBlobStorage(file, header.Filename, config)
+	// Initialize database
+	var db *sql.DB
+	var replica *store.ReadReplica
+	var backend store.Stores
+	if cfg.Database.Driver == config.DatabaseDriverMemory {
+		if cmd.command == commandMigrate {
+			fatal("There is no database to migrate with database.driver memory")
+		}
+		slog.Warn("Using the in-memory store; everything stored is lost when the process exits")
+		backend = store.NewMemoryStores()
+	} else {
+		var dbConnector *store.ResilientConnector
+		db, dbConnector = initDB(cfg)
+		defer db.Close()
+		if cmd.command == commandMigrate || cfg.Database.MigrateOnStartup {
+			if err := store.RunMigrations(context.Background(), db, store.DialectFor(cfg.Database.Driver), cmd.baseline); err != nil {
+				fatal("Error migrating the database", "error", err)
+			}
+			if cmd.command == commandMigrate {
+				return
+			}
+		}
+		secrets.HandleRotation("database.connection_string", func(connectionString string) {
+			connector, err := store.NewDBConnector(cfg, connectionString)
+			if err != nil {
+				slog.Error("Rotated database connection string is unusable; keeping the previous one", "error", err)
+				return
+			}
+			dbConnector.Swap(connector)
+		})
+		// Only the API reads from the replica
+		if cmd.command == commandServe {
+			replica, err = store.OpenReplica(cfg)
+			if err != nil {
+				fatal("Error connecting to the read replica", "error", err)
+			}
+		}
+		if replica != nil {
+			defer replica.Close()
+			go replica.Monitor(context.Background(), config.Seconds(cfg.Database.ReplicaCheckIntervalSeconds))
+		}
+		backend = store.NewSQLStores(db, replica, store.DialectFor(cfg.Database.Driver))
+	}
+	blobs, serviceBus, events := initAzure(cfg)
+	defer closeAzure(events, serviceBus)
+	api.RegisterMetrics(db, replica)
+	// Every change to a user is audited, whichever API or worker made it
+	var audit store.AuditStore = store.TracedAuditStore{Next: backend.Audit}
+	var userStore store.UserStore = api.AuditedUserStore{UserStore: store.TracedUserStore{Next: backend.Users}, Audit: audit}
+	// and the significant ones, logins included, go on the user's timeline
+	userStore = api.ActivityUserStore{UserStore: userStore, Activities: store.TracedActivityStore{Next: backend.Activities}}
+	cache, err := api.NewCache(cfg)
 	if err != nil {
-		log.Printf("Error uploading file to blob storage: %v", err)
-		http.Error(w, "Error uploading file", http.StatusInternalServerError)
+		fatal("Error connecting to the cache", "error", err)
+	}
+	if cache != nil {
+		defer cache.Close()
+		userStore = api.NewCachedUserStore(cfg, userStore, cache)
+	}
+	var pictures store.PictureStore = store.TracedPictureStore{Next: backend.Pictures}
+	var outbox store.OutboxStore = store.TracedOutboxStore{Next: backend.Outbox}
+	switch cmd.command {
+	case commandSeed:
+		if cmd.avatars {
+			checkBlobStorage(cfg, blobs)
+		}
+		if err := api.SeedUsers(context.Background(), cfg, blobs, userStore, pictures, cmd.tenant, cmd.seedUsers, cmd.avatars); err != nil {
+			fatal("Error seeding the database", "error", err)
+		}
 		return
-	}
-
-	// Prepare user data
-	user := User{
-		Name:  name,
-		Email: email,
-		Link:  profilePicURL,
-	}
-
-	// Send user data to Service Bus
-	err = sendToServiceBus(user, config)
-	if err != nil {
-		log.Printf("Error sending user data to Service Bus: %v", err)
-		http.Error(w, "Error sending user data", http.StatusInternalServerError)
+	case commandWorker:
+		if serviceBus == nil {
+			fatal("The worker consumes from Service Bus; set azure.service_bus_driver azure")
+		}
+		if err := api.RunConsumerMode(cfg, serviceBus, userStore, shutdownTracing); err != nil {
+			// Exit non-zero so the worker is restarted
+			fatal("Service Bus consumer failed", "error", err)
+		}
 		return
-	}
-
-	// Respond with success message
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":         "User created successfully",
-		"profile_pic_url": profilePicURL,
-	})
-}
-
-// API to Get All Users (GET /users)
-func getUsers(w http.ResponseWriter) {
-	rows, err := db.Query(`SELECT * FROM users`)
-	if err != nil {
-		log.Printf("Error fetching users from database: %v", err)
-		http.Error(w, "Error fetching users", http.StatusInternalServerError)
+	case commandAdmin:
+		deps := api.ServerDeps{Stores: backend, Users: userStore, Pictures: pictures, Blobs: blobs, Events: events, ServiceBus: serviceBus}
+		if err := api.RunAdminDirect(context.Background(), cmd.admin, cfg, deps); err != nil {
+			fatal("Admin command failed", "error", err)
+		}
 		return
 	}
-	defer rows.Close()
-
-	var users []User
-	for rows.Next() {
-		var user User
-		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Link, &user.CreatedAt); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			http.Error(w, "Error scanning user data", http.StatusInternalServerError)
-			return
+	checkBlobStorage(cfg, blobs)
+	if cfg.Seed.Users > 0 {
+		if err := api.SeedUsers(context.Background(), cfg, blobs, userStore, pictures, cfg.Seed.Tenant, cfg.Seed.Users, !cfg.Seed.SkipAvatars); err != nil {
+			fatal("Error seeding the database", "error", err)
 		}
-		users = append(users, user)
 	}
 
-	json.NewEncoder(w).Encode(users)
-}
+	// Stop on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := api.New(cfg, api.ServerDeps{
+		DB:         db,
+		Stores:     backend,
+		Users:      userStore,
+		Audit:      audit,
+		Pictures:   pictures,
+		Outbox:     outbox,
+		Blobs:      blobs,
+		Events:     events,
+		ServiceBus: serviceBus,
+		Scanner:    api.NewScanner(cfg),
+		Secrets:    secrets,
+		AppConfig:  appConfig,
+	})
+	serveErr := server.Run(ctx)
 
-func main() {
-	// Load configuration from JSON file
-	configFile, err := os.Open("config.json")
-	if err != nil {
-		log.Fatalf("Error opening config file: %v", err)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Seconds(cfg.Server.ShutdownTimeoutSeconds))
+	defer cancel()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Error flushing traces", "error", err)
 	}
-	defer configFile.Close()
-
-	var config Config
-	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
-		log.Fatalf("Error decoding config file: %v", err)
+	if serveErr != nil {
+		fatal("Server failed", "error", serveErr)
 	}
-
-	// Initialize database
-	initDB(config)
-	defer db.Close()
-
-	// Define routes
-	r := mux.NewRouter()
-	r.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
-		getUsers(w)
-	}).Methods("GET")
-	r.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
-		createUser(w, r, config)
-	}).Methods("POST")
-
-	// Create a new CORS handler
-	corsHandler := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000"}, // Allow your frontend URL
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type"},
-		AllowCredentials: true, // Allow credentials if needed
-	})
-
-	// Start server with CORS middleware
-	log.Println("Starting server on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", corsHandler.Handler(r)))
 }
@@ -0,0 +1,103 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"user/user/telemetry"
+)
+
+// ErrCircuitOpen is returned, without calling the dependency, while its breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// States of a circuit breaker, also the values of the circuit_breaker_state gauge
+const (
+	breakerClosed   = 0 // Calls go through
+	breakerHalfOpen = 1 // One trial call goes through; its result closes or reopens the breaker
+	breakerOpen     = 2 // Calls fail fast with ErrCircuitOpen
+)
+
+// CircuitBreaker stops calling a dependency after consecutive transient
+// failures, until it has been left alone for openFor
+type CircuitBreaker struct {
+	dependency string
+	threshold  int           // Consecutive failures that open the breaker
+	openFor    time.Duration // How long it stays open before a trial call
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	trial    bool // A half-open trial call is in flight
+}
+
+func newCircuitBreaker(dependency string, threshold int, openFor time.Duration) *CircuitBreaker {
+	b := &CircuitBreaker{dependency: dependency, threshold: threshold, openFor: openFor}
+	telemetry.CircuitBreakerState.WithLabelValues(dependency).Set(breakerClosed)
+	return b
+}
+
+// allow reports whether a call may go ahead, or returns an error wrapping
+// ErrCircuitOpen. Once openFor has passed a single trial call is let through.
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.openFor {
+		b.setState(breakerHalfOpen)
+	}
+	switch {
+	case b.state == breakerOpen, b.state == breakerHalfOpen && b.trial:
+		return fmt.Errorf("%s: %w", b.dependency, ErrCircuitOpen)
+	case b.state == breakerHalfOpen:
+		b.trial = true
+	}
+	return nil
+}
+
+// Refusing reports whether allow would fail fast right now, without taking
+// the half-open trial call for itself
+func (b *CircuitBreaker) Refusing() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerOpen && time.Since(b.openedAt) < b.openFor || b.state == breakerHalfOpen && b.trial
+}
+
+// record counts the outcome of a call allow let through. Only transient
+// failures count against the dependency; anything else shows it answering.
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if errors.Is(err, context.Canceled) {
+		return // The caller gave up, which says nothing about the dependency
+	}
+	if !IsTransient(err) {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState moves the breaker to state, logging and publishing the change; the caller holds mu
+func (b *CircuitBreaker) setState(state int) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	telemetry.CircuitBreakerState.WithLabelValues(b.dependency).Set(float64(state))
+	switch state {
+	case breakerOpen:
+		slog.Warn("Circuit breaker opened", "dependency", b.dependency, "failures", b.failures, "open_for", b.openFor)
+	case breakerClosed:
+		slog.Info("Circuit breaker closed", "dependency", b.dependency)
+	}
+}
@@ -0,0 +1,101 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"user/user/config"
+	"user/user/telemetry"
+)
+
+// ErrSaturated is returned, without calling the dependency, when it has as
+// many calls in flight and waiting as it may
+var ErrSaturated = errors.New("too many concurrent calls")
+
+// bulkhead bounds the calls in flight to one dependency. Calls past the limit
+// wait for a slot, up to a number of them and for a while, and are turned
+// away with ErrSaturated beyond that, so a burst can't hold unbounded streams
+// and sockets open.
+type bulkhead struct {
+	dependency string
+	slots      chan struct{}
+	maxQueued  int64
+	maxWait    time.Duration
+	queued     atomic.Int64
+}
+
+// Bulkheads of the dependencies whose calls are limited, from
+// config.DependencyLimits once SetupBulkheads has run
+var bulkheads map[string]*bulkhead
+
+// SetupBulkheads makes the bulkheads for blob uploads and Service Bus sends
+func SetupBulkheads(cfg config.Config) {
+	limits := cfg.DependencyLimits
+	maxWait := config.Seconds(limits.QueueWaitSeconds)
+	bulkheads = map[string]*bulkhead{
+		DependencyBlob:       newBulkhead(DependencyBlob, limits.BlobUploads, limits.QueueSize, maxWait),
+		DependencyServiceBus: newBulkhead(DependencyServiceBus, limits.ServiceBusSends, limits.QueueSize, maxWait),
+	}
+}
+
+func newBulkhead(dependency string, slots, maxQueued int, maxWait time.Duration) *bulkhead {
+	telemetry.DependencyInFlight.WithLabelValues(dependency).Set(0)
+	telemetry.DependencyQueueDepth.WithLabelValues(dependency).Set(0)
+	return &bulkhead{dependency: dependency, slots: make(chan struct{}, slots), maxQueued: int64(maxQueued), maxWait: maxWait}
+}
+
+// acquire takes a slot, waiting for one if need be, and returns the function
+// that gives it back
+func (b *bulkhead) acquire(ctx context.Context) (func(), error) {
+	select {
+	case b.slots <- struct{}{}:
+		telemetry.DependencyInFlight.WithLabelValues(b.dependency).Inc()
+		return b.release, nil
+	default:
+	}
+	if b.queued.Add(1) > b.maxQueued {
+		b.queued.Add(-1)
+		return nil, b.saturated()
+	}
+	telemetry.DependencyQueueDepth.WithLabelValues(b.dependency).Inc()
+	defer func() {
+		b.queued.Add(-1)
+		telemetry.DependencyQueueDepth.WithLabelValues(b.dependency).Dec()
+	}()
+
+	timer := time.NewTimer(b.maxWait)
+	defer timer.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		telemetry.DependencyInFlight.WithLabelValues(b.dependency).Inc()
+		return b.release, nil
+	case <-timer.C:
+		return nil, b.saturated()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *bulkhead) release() {
+	<-b.slots
+	telemetry.DependencyInFlight.WithLabelValues(b.dependency).Dec()
+}
+
+// saturated counts and returns the error for a call turned away
+func (b *bulkhead) saturated() error {
+	telemetry.DependencyRejectionsTotal.WithLabelValues(b.dependency).Inc()
+	return fmt.Errorf("%s: %w", b.dependency, ErrSaturated)
+}
+
+// WithBulkhead runs fn holding one of the dependency's slots
+func WithBulkhead(ctx context.Context, dependency string, fn func() error) error {
+	release, err := bulkheads[dependency].acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return fn()
+}
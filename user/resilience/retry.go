@@ -0,0 +1,238 @@
+package resilience
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-amqp"
+	"github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+
+	"user/user/config"
+	"user/user/telemetry"
+)
+
+// ResultLabel maps an error to the result label used by the dependency counters,
+// counting throttling and calls an open breaker or a full bulkhead refused
+// separately from other failures
+func ResultLabel(err error) string {
+	var throttled *ThrottledError
+	switch {
+	case err == nil:
+		return "success"
+	case errors.As(err, &throttled):
+		return "throttled"
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, ErrSaturated):
+		return "saturated"
+	default:
+		return "failure"
+	}
+}
+
+// Dependencies whose calls are retried, each behind its own circuit breaker
+const (
+	DependencyBlob       = "blob"
+	DependencyServiceBus = "service_bus"
+	DependencySQL        = "sql"
+)
+
+// Longest wait a throttled response may ask for
+const maxRetryAfter = 30 * time.Second
+
+// Retry tuning and the breakers, from config.Resilience once Setup has run
+var (
+	retryMaxAttempts = config.DefaultRetryMaxAttempts
+	retryBaseDelay   = config.DefaultRetryBaseDelayMs * time.Millisecond
+	retryMaxDelay    = config.DefaultRetryMaxDelaySecs * time.Second
+	Breakers         map[string]*CircuitBreaker
+)
+
+// Setup applies config.Resilience and makes a closed breaker per
+// dependency. It runs before initDB, whose connections go through the sql breaker.
+func Setup(cfg config.Config) {
+	retryMaxAttempts = cfg.Resilience.MaxAttempts
+	retryBaseDelay = time.Duration(cfg.Resilience.BaseDelayMs) * time.Millisecond
+	retryMaxDelay = config.Seconds(cfg.Resilience.MaxDelaySeconds)
+	openFor := config.Seconds(cfg.Resilience.BreakerOpenSeconds)
+	Breakers = map[string]*CircuitBreaker{}
+	for _, dependency := range []string{DependencyBlob, DependencyServiceBus, DependencySQL} {
+		Breakers[dependency] = newCircuitBreaker(dependency, cfg.Resilience.BreakerFailures, openFor)
+	}
+}
+
+// Service Bus reports throttling with this AMQP condition; the service asks for a 10s pause
+const (
+	serviceBusBusyCondition  = amqp.ErrCond("com.microsoft:server-busy")
+	serviceBusBusyRetryAfter = 10 * time.Second
+)
+
+// ThrottledError marks a dependency call rejected because the service is throttling us
+type ThrottledError struct {
+	Dependency string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s throttled (retry after %s): %v", e.Dependency, e.RetryAfter, e.Err)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return e.Err
+}
+
+// classifyAzureError converts 429/503 responses from the Blob SDK and server-busy
+// errors from Service Bus into a ThrottledError. Other errors are returned as-is.
+func classifyAzureError(dependency string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		if respErr.StatusCode == http.StatusTooManyRequests || respErr.StatusCode == http.StatusServiceUnavailable {
+			return &ThrottledError{Dependency: dependency, RetryAfter: retryAfterFromResponse(respErr.RawResponse), Err: err}
+		}
+		return err
+	}
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Condition == serviceBusBusyCondition {
+		return &ThrottledError{Dependency: dependency, RetryAfter: serviceBusBusyRetryAfter, Err: err}
+	}
+	return err
+}
+
+// retryAfterFromResponse reads the server's requested delay from a throttled response
+func retryAfterFromResponse(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	if ms, err := strconv.Atoi(resp.Header.Get("x-ms-retry-after-ms")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	value := resp.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// Azure SQL errors that clear up on their own: the database being moved,
+// reconfigured or out of resources, or a dropped connection
+var transientSQLErrors = []int32{233, 4060, 4221, 10053, 10054, 10060, 10928, 10929, 40143, 40197, 40501, 40540, 40613, 49918, 49919, 49920}
+
+// PostgreSQL SQLSTATE classes and codes worth retrying: lost connections,
+// running out of resources like connection slots, and the server shutting down
+// or starting up
+var (
+	transientPostgresClasses = []pq.ErrorClass{"08", "53"}
+	transientPostgresCodes   = []pq.ErrorCode{"57P01", "57P02", "57P03"}
+)
+
+// MySQL server errors worth retrying: too many connections, shutting down,
+// and lock waits and deadlocks that time out
+var transientMySQLErrors = []uint16{1040, 1053, 1205, 1213}
+
+// IsTransient reports whether err is a failure worth retrying, and one that
+// counts against the dependency's breaker: throttling, timeouts, 5xx responses,
+// lost connections and the databases' transient errors. Answers like a 404, and the
+// caller's own cancellation, are not.
+func IsTransient(err error) bool {
+	var throttled *ThrottledError
+	var respErr *azcore.ResponseError
+	var busErr *azservicebus.Error
+	var sqlErr mssql.Error
+	var pgErr *pq.Error
+	var mysqlErr *mysql.MySQLError
+	var netErr net.Error
+	switch {
+	case err == nil, errors.Is(err, context.Canceled), errors.Is(err, ErrCircuitOpen):
+		return false
+	case errors.As(err, &throttled):
+		return true
+	case errors.As(err, &respErr):
+		return respErr.StatusCode == http.StatusRequestTimeout || respErr.StatusCode >= http.StatusInternalServerError
+	case errors.As(err, &busErr):
+		return busErr.Code == azservicebus.CodeConnectionLost || busErr.Code == azservicebus.CodeTimeout
+	case errors.As(err, &sqlErr):
+		return slices.Contains(transientSQLErrors, sqlErr.Number)
+	case errors.As(err, &pgErr):
+		return slices.Contains(transientPostgresClasses, pgErr.Code.Class()) || slices.Contains(transientPostgresCodes, pgErr.Code)
+	case errors.As(err, &mysqlErr):
+		return slices.Contains(transientMySQLErrors, mysqlErr.Number)
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		return true
+	}
+	return false
+}
+
+// Backoff is the wait before retry number attempt: retryBaseDelay doubling each
+// time up to retryMaxDelay, jittered to between half and all of it so callers
+// failing together don't retry together
+func Backoff(attempt int) time.Duration {
+	delay := min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+	if delay <= 0 {
+		return retryMaxDelay // Shifted past the range of a Duration
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// WithRetry runs fn through the dependency's breaker up to retryMaxAttempts
+// times, retrying transient failures. A throttled call waits as long as the
+// server asks; others back off exponentially with jitter. While the breaker is
+// open fn isn't called at all and the error wraps ErrCircuitOpen.
+func WithRetry(ctx context.Context, dependency string, fn func() error) error {
+	breaker := Breakers[dependency]
+	for attempt := 1; ; attempt++ {
+		if err := breaker.allow(); err != nil {
+			return err
+		}
+		err := classifyAzureError(dependency, fn())
+		breaker.record(err)
+		if !IsTransient(err) || attempt >= retryMaxAttempts {
+			return err
+		}
+
+		delay := Backoff(attempt)
+		var throttled *ThrottledError
+		if errors.As(err, &throttled) && throttled.RetryAfter > 0 {
+			delay = min(throttled.RetryAfter, maxRetryAfter)
+		}
+		telemetry.DependencyRetriesTotal.WithLabelValues(dependency).Inc()
+		slog.WarnContext(ctx, "Dependency call failed, retrying", "dependency", dependency, "delay", delay, "attempt", attempt, "max_attempts", retryMaxAttempts, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// WithBreaker runs fn once through the dependency's breaker, for calls that
+// can't be repeated, like an upload from a stream already read
+func WithBreaker(dependency string, fn func() error) error {
+	breaker := Breakers[dependency]
+	if err := breaker.allow(); err != nil {
+		return err
+	}
+	err := classifyAzureError(dependency, fn())
+	breaker.record(err)
+	return err
+}
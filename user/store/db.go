@@ -0,0 +1,207 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+
+	"user/user/config"
+	"user/user/resilience"
+)
+
+// Scope of the access tokens Azure SQL accepts
+const azureSQLTokenScope = "https://database.windows.net/.default"
+
+// sqlAccessToken fetches a token for Azure SQL, for connections made with auth
+// default_credential. azidentity caches it until shortly before it expires.
+func sqlAccessToken() (string, error) {
+	credential, err := config.AzureCredential()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	token, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azureSQLTokenScope}})
+	return token.Token, err
+}
+
+const defaultQueryTimeout = 5 * time.Second
+
+// Upper bound on a single database call, set from config in initDB
+var QueryTimeout = defaultQueryTimeout
+
+// withQueryTimeout bounds a single database call by the configured query timeout.
+// Deriving from the request context also cancels the query if the client goes away.
+func withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, QueryTimeout)
+}
+
+// ResilientConnector opens database connections through the sql breaker,
+// retrying transient failures. Queries aren't retried themselves, as writes may
+// not be safe to repeat, but database/sql retries those that find a dead
+// pooled connection on a new one, which comes through here.
+type ResilientConnector struct {
+	next atomic.Pointer[driver.Connector] // Replaced when the connection string rotates
+}
+
+func NewResilientConnector(next driver.Connector) *ResilientConnector {
+	c := &ResilientConnector{}
+	c.Swap(next)
+	return c
+}
+
+func (c *ResilientConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	next := *c.next.Load()
+	var conn driver.Conn
+	err := resilience.WithRetry(ctx, resilience.DependencySQL, func() error {
+		var err error
+		conn, err = next.Connect(ctx)
+		return err
+	})
+	return conn, err
+}
+
+func (c *ResilientConnector) Driver() driver.Driver {
+	return (*c.next.Load()).Driver()
+}
+
+// Swap has new connections opened through next. Pooled ones stay open until
+// they are found broken or reach their lifetime.
+func (c *ResilientConnector) Swap(next driver.Connector) {
+	c.next.Store(&next)
+}
+
+// WaitForDB pings db until it answers or timeout passes, backing off between
+// tries, so an instance started before the database, as an orchestrator may,
+// waits for it rather than crashing. Failures retrying can't fix, like a
+// refused login, end the wait at once.
+func WaitForDB(db *sql.DB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for attempt := 1; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil || (!resilience.IsTransient(err) && !errors.Is(err, resilience.ErrCircuitOpen)) {
+			return err
+		}
+		delay := resilience.Backoff(attempt)
+		slog.Warn("Database not reachable yet, retrying", "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// statements prepares each fixed query a store runs on every request once, and
+// reuses it across requests and pooled connections, which database/sql
+// prepares it on as needed. Queries whose text is built per call, like
+// listings, aren't prepared: they would fill the cache without bound.
+type statements struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt // By query text
+}
+
+func newStatements(db *sql.DB) *statements {
+	return &statements{db: db, stmts: map[string]*sql.Stmt{}}
+}
+
+// prepare returns query prepared, preparing it the first time it is asked for.
+// A failed prepare isn't cached, so the next call tries again.
+func (s *statements) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	s.mu.Lock()
+	stmt, ok := s.stmts[query]
+	s.mu.Unlock()
+	if ok {
+		return stmt, nil
+	}
+	stmt, err := s.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prepared, ok := s.stmts[query]; ok {
+		// Prepared concurrently; keep the first
+		stmt.Close()
+		return prepared, nil
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
+// ExecContext runs query prepared, so statements serves as a querier
+func (s *statements) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	stmt, err := s.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (s *statements) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	stmt, err := s.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+// NewDBConnector connects to the database.driver database with
+// connectionString, on SQL Server signing in as the service's identity with
+// azure.auth default_credential
+func NewDBConnector(cfg config.Config, connectionString string) (driver.Connector, error) {
+	switch cfg.Database.Driver {
+	case config.DatabaseDriverPostgres:
+		dsn, err := config.PostgresDSN(connectionString)
+		if err != nil {
+			return nil, err
+		}
+		connector, err := pq.NewConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return namedParamConnector{Connector: connector, d: postgresDialect}, nil
+	case config.DatabaseDriverMySQL:
+		mysqlConfig, err := mysqlDSN(connectionString)
+		if err != nil {
+			return nil, err
+		}
+		connector, err := mysql.NewConnector(mysqlConfig)
+		if err != nil {
+			return nil, err
+		}
+		return namedParamConnector{Connector: connector, d: mysqlDialect}, nil
+	}
+	if cfg.Azure.Auth == config.AzureAuthDefaultCredential {
+		// The connection string names the server and database; the identity signs in
+		return mssql.NewAccessTokenConnector(connectionString, sqlAccessToken)
+	}
+	return mssql.NewConnector(connectionString)
+}
+
+// mysqlDSN parses a MySQL connection string, reading and writing timestamps in
+// UTC as the columns hold them
+func mysqlDSN(connectionString string) (*mysql.Config, error) {
+	cfg, err := mysql.ParseDSN(connectionString)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ParseTime, cfg.Loc = true, time.UTC
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	return cfg, nil
+}
@@ -0,0 +1,440 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"user/user/config"
+)
+
+// Dialect is how one database spells the SQL the stores share. Queries take
+// @name parameters whatever the database; those whose drivers only take
+// positional ones connect through a namedParamConnector, which rewrites them.
+type Dialect struct {
+	driver    string // database.driver it is for
+	now       string // The current time in UTC, as the timestamp columns hold it
+	zeroTime  string // A constant timestamp, selected in place of one a listing leaves out
+	count     string // Counts the rows of a query as a BIGINT
+	lockHint  string // Follows a table whose rows a select keeps locked until the transaction ends
+	forUpdate string // Ends a select keeping the rows it reads locked until the transaction ends
+}
+
+// The dialects of the SQL databases database.driver may name
+var (
+	sqlServerDialect = &Dialect{
+		driver:   config.DatabaseDriverSQLServer,
+		now:      "SYSUTCDATETIME()",
+		zeroTime: "CAST('0001-01-01' AS DATETIME2)",
+		count:    "COUNT_BIG(*)",
+		lockHint: " WITH (UPDLOCK, HOLDLOCK)",
+	}
+	postgresDialect = &Dialect{
+		driver:    config.DatabaseDriverPostgres,
+		now:       "now()",
+		zeroTime:  "CAST('0001-01-01' AS TIMESTAMPTZ)",
+		count:     "COUNT(*)",
+		forUpdate: " FOR UPDATE",
+	}
+	mysqlDialect = &Dialect{
+		driver:    config.DatabaseDriverMySQL,
+		now:       "UTC_TIMESTAMP(6)",
+		zeroTime:  "CAST('0001-01-01' AS DATETIME(6))",
+		count:     "COUNT(*)",
+		forUpdate: " FOR UPDATE",
+	}
+)
+
+// DialectFor returns the dialect of a SQL database.driver
+func DialectFor(driver string) *Dialect {
+	switch driver {
+	case config.DatabaseDriverPostgres:
+		return postgresDialect
+	case config.DatabaseDriverMySQL:
+		return mysqlDialect
+	}
+	return sqlServerDialect
+}
+
+// top starts the select list of a query returning at most the rows in the
+// limit parameter, on SQL Server; limit ends it elsewhere
+func (d *Dialect) top(limit string) string {
+	if d.driver == config.DatabaseDriverSQLServer {
+		return "TOP (" + limit + ") "
+	}
+	return ""
+}
+
+// limit ends a query returning at most the rows in the limit parameter, where
+// the database has no TOP
+func (d *Dialect) limit(limit string) string {
+	if d.driver == config.DatabaseDriverSQLServer {
+		return ""
+	}
+	return " LIMIT " + limit
+}
+
+// like matches column against a pattern parameter escaped by likeEscaper,
+// ignoring case as SQL Server's and MySQL's default collations do
+func (d *Dialect) like(column, pattern string) string {
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		return column + " ILIKE " + pattern + ` ESCAPE '\'`
+	case config.DatabaseDriverMySQL:
+		// A backslash escapes in MySQL's string literals too
+		return column + " LIKE " + pattern + ` ESCAPE '\\'`
+	}
+	return column + " LIKE " + pattern + ` ESCAPE '\'`
+}
+
+// metadataValue is the text at the JSON path in the path parameter of the
+// users' metadata, NULL where there is none
+func (d *Dialect) metadataValue(path string) string {
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		return "jsonb_path_query_first(metadata, CAST(" + path + " AS JSONPATH)) #>> '{}'"
+	case config.DatabaseDriverMySQL:
+		return "JSON_UNQUOTE(JSON_EXTRACT(metadata, " + path + "))"
+	}
+	return "JSON_VALUE(metadata, " + path + ")"
+}
+
+// nowPlus is the time the milliseconds in a parameter from now
+func (d *Dialect) nowPlus(milliseconds string) string {
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		return "now() + CAST(" + milliseconds + " AS DOUBLE PRECISION) * INTERVAL '1 millisecond'"
+	case config.DatabaseDriverMySQL:
+		return "UTC_TIMESTAMP(6) + INTERVAL " + milliseconds + " * 1000 MICROSECOND"
+	}
+	return "DATEADD(millisecond, " + milliseconds + ", SYSUTCDATETIME())"
+}
+
+// concat joins string expressions
+func (d *Dialect) concat(parts ...string) string {
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		return strings.Join(parts, " || ")
+	case config.DatabaseDriverMySQL:
+		return "CONCAT(" + strings.Join(parts, ", ") + ")"
+	}
+	return strings.Join(parts, " + ")
+}
+
+// savepoint marks a point of the transaction that rollbackTo undoes back to
+func (d *Dialect) savepoint(name string) string {
+	if d.driver == config.DatabaseDriverSQLServer {
+		return "SAVE TRANSACTION " + name
+	}
+	return "SAVEPOINT " + name
+}
+
+func (d *Dialect) rollbackTo(name string) string {
+	if d.driver == config.DatabaseDriverSQLServer {
+		return "ROLLBACK TRANSACTION " + name
+	}
+	return "ROLLBACK TO SAVEPOINT " + name
+}
+
+// eachJSONValue joins the rows selected from to a row per value of the JSON
+// object in column, as alias.value
+func (d *Dialect) eachJSONValue(column, alias string) string {
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		return "CROSS JOIN LATERAL jsonb_each_text(" + column + ") AS " + alias
+	case config.DatabaseDriverMySQL:
+		return "CROSS JOIN JSON_TABLE(JSON_EXTRACT(" + column + ", '$.*'), '$[*]' COLUMNS (value VARCHAR(2048) PATH '$')) AS " + alias
+	}
+	return "CROSS APPLY OPENJSON(" + column + ") AS " + alias
+}
+
+// anonymizedUserState is the user snapshot in column with the @name and @email
+// parameters in place of who the user was, and their picture and metadata gone
+func (d *Dialect) anonymizedUserState(column string) string {
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		return "(" + column + " - 'thumbnailLink' - 'thumbnails') || jsonb_build_object('name', CAST(@name AS TEXT), 'email', CAST(@email AS TEXT), 'link', '', 'metadata', CAST('{}' AS JSONB))"
+	case config.DatabaseDriverMySQL:
+		return "JSON_SET(JSON_REMOVE(" + column + ", '$.thumbnailLink', '$.thumbnails'), '$.name', @name, '$.email', @email, '$.link', '', '$.metadata', JSON_OBJECT())"
+	}
+	return "JSON_MODIFY(JSON_MODIFY(JSON_MODIFY(JSON_MODIFY(JSON_MODIFY(JSON_MODIFY(" + column + ",\n" +
+		"\t\t\t\t'$.name', @name), '$.email', @email), '$.link', ''), '$.thumbnailLink', NULL), '$.thumbnails', NULL), '$.metadata', JSON_QUERY('{}'))"
+}
+
+// querier runs statements, on the pool, a transaction, a connection, or
+// prepared through statements
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// row is the first row a query returns, read as sql.Row reads one: Scan
+// returns sql.ErrNoRows when there is none, and closes the rows
+type row struct {
+	rows *sql.Rows
+	err  error
+}
+
+// queryRow runs a query expected to return at most one row
+func queryRow(ctx context.Context, q querier, query string, args ...any) *row {
+	rows, err := q.QueryContext(ctx, query, args...)
+	return &row{rows: rows, err: err}
+}
+
+func (r *row) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.rows.Close()
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err := r.rows.Scan(dest...); err != nil {
+		return err
+	}
+	// Reading to the end surfaces an error raised after the row
+	return r.rows.Close()
+}
+
+// insertRow inserts a row of values, usually parameters, into the columns of
+// table, and returns the returning columns of the row as stored
+func (d *Dialect) insertRow(ctx context.Context, q querier, table, columns, values, returning string, args ...any) *row {
+	insert := "INSERT INTO " + table + " (" + columns + ")"
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		return queryRow(ctx, q, insert+" VALUES ("+values+") RETURNING "+returning, args...)
+	case config.DatabaseDriverMySQL:
+		// MySQL returns nothing of the row but its ID
+		result, err := q.ExecContext(ctx, insert+" VALUES ("+values+")", args...)
+		return d.insertedRow(ctx, q, table, returning, result, err)
+	}
+	return queryRow(ctx, q, insert+" OUTPUT "+prefixColumns("INSERTED", returning)+" VALUES ("+values+")", args...)
+}
+
+// updateRow applies set to the row of table matching where, and returns its
+// returning columns as updated, or sql.ErrNoRows if no row matches. where
+// matches one row at most.
+func (d *Dialect) updateRow(ctx context.Context, q querier, table, set, where, returning string, args ...any) *row {
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		return queryRow(ctx, q, "UPDATE "+table+" SET "+set+" WHERE "+where+" RETURNING "+returning, args...)
+	case config.DatabaseDriverMySQL:
+		// LAST_INSERT_ID(id) hands the ID of the row updated back as the
+		// insert ID; it stays 0 when no row matches, changed or not
+		result, err := q.ExecContext(ctx, "UPDATE "+table+" SET "+set+", id = LAST_INSERT_ID(id) WHERE "+where, args...)
+		return d.insertedRow(ctx, q, table, returning, result, err)
+	}
+	return queryRow(ctx, q, "UPDATE "+table+" SET "+set+" OUTPUT "+prefixColumns("INSERTED", returning)+" WHERE "+where, args...)
+}
+
+// insertedRow reads the returning columns of the row of table whose ID a MySQL
+// statement left as the insert ID
+func (d *Dialect) insertedRow(ctx context.Context, q querier, table, returning string, result sql.Result, err error) *row {
+	if err != nil {
+		return &row{err: err}
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return &row{err: err}
+	}
+	if id == 0 {
+		return &row{err: sql.ErrNoRows}
+	}
+	return queryRow(ctx, q, "SELECT "+returning+" FROM "+table+" WHERE id = @id", sql.Named("id", id))
+}
+
+// deleteRows deletes the rows of table matching where, no more than the limit
+// parameter of them unless it is empty, and reads the returning columns of each
+// with read
+func (d *Dialect) deleteRows(ctx context.Context, tx *sql.Tx, table, where, limit, returning string, read func(row interface{ Scan(...any) error }) error, args ...any) error {
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		if limit != "" {
+			where = "id IN (SELECT id FROM " + table + " WHERE " + where + " LIMIT " + limit + ")"
+		}
+		return queryRows(ctx, tx, read, "DELETE FROM "+table+" WHERE "+where+" RETURNING "+returning, args...)
+	case config.DatabaseDriverMySQL:
+		// MySQL returns nothing of the rows deleted, so they are read, locked,
+		// and then deleted by ID
+		var ids []string
+		var idArgs []any
+		err := queryRows(ctx, tx, func(row interface{ Scan(...any) error }) error {
+			var id int64
+			if err := read(prependScan{row, &id}); err != nil {
+				return err
+			}
+			name := fmt.Sprintf("id%d", len(ids))
+			ids, idArgs = append(ids, "@"+name), append(idArgs, sql.Named(name, id))
+			return nil
+		}, "SELECT id, "+returning+" FROM "+table+" WHERE "+where+d.limit(limit)+" FOR UPDATE", args...)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE id IN ("+strings.Join(ids, ", ")+")", idArgs...)
+		return err
+	}
+	top := ""
+	if limit != "" {
+		top = d.top(limit)
+	}
+	return queryRows(ctx, tx, read, "DELETE "+top+"FROM "+table+" OUTPUT "+prefixColumns("DELETED", returning)+" WHERE "+where, args...)
+}
+
+// prependScan scans a row's first column into first, and the rest where the
+// caller asks
+type prependScan struct {
+	row   interface{ Scan(...any) error }
+	first any
+}
+
+func (p prependScan) Scan(dest ...any) error {
+	return p.row.Scan(append([]any{p.first}, dest...)...)
+}
+
+// queryRows runs a query and calls read for each row it returns
+func queryRows(ctx context.Context, q querier, read func(row interface{ Scan(...any) error }) error, query string, args ...any) error {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := read(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// deleteFirst deletes up to the limit of the rows of table matching where,
+// the first of them in order unless it is empty, for pruning a few at a time
+func (d *Dialect) deleteFirst(ctx context.Context, q querier, table, where, order, limit string, args ...any) (sql.Result, error) {
+	if order != "" {
+		order = " ORDER BY " + order
+	}
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		// DELETE takes no LIMIT; ctid picks out the rows the subquery found
+		return q.ExecContext(ctx, "DELETE FROM "+table+" WHERE ctid IN (SELECT ctid FROM "+table+" WHERE "+where+order+" LIMIT "+limit+")", args...)
+	case config.DatabaseDriverMySQL:
+		return q.ExecContext(ctx, "DELETE FROM "+table+" WHERE "+where+order+" LIMIT "+limit, args...)
+	}
+	if order == "" {
+		return q.ExecContext(ctx, "DELETE TOP ("+limit+") FROM "+table+" WHERE "+where, args...)
+	}
+	// TOP in a DELETE takes no ORDER BY, so the rows are picked by a CTE
+	return q.ExecContext(ctx, "WITH picked AS (SELECT TOP ("+limit+") * FROM "+table+" WHERE "+where+order+") DELETE FROM picked", args...)
+}
+
+// upsert writes a row to table that updates the one with the same keys if
+// there is one, or is inserted
+type upsert struct {
+	table   string
+	keys    []string // Columns of the primary key, which columns starts with
+	columns []string // Columns inserted
+	values  []string // Expressions, usually parameters, inserted into columns
+	set     string   // The update of a row already there, which qualifies its columns with the table
+	where   string   // Unless empty, a row already there is only updated if it also matches this, qualified likewise
+}
+
+// upsert runs u, reporting whether it wrote the row: not when a row already
+// there didn't match u.where
+func (d *Dialect) upsert(ctx context.Context, q querier, u upsert, args ...any) (bool, error) {
+	var result sql.Result
+	var err error
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		result, err = q.ExecContext(ctx, u.onConflict(""), args...)
+	case config.DatabaseDriverMySQL:
+		if u.where == "" {
+			_, err := q.ExecContext(ctx, u.onDuplicateKey(), args...)
+			return err == nil, err
+		}
+		// ON DUPLICATE KEY UPDATE takes no condition, so a row already there
+		// is updated after the insert fails
+		result, err = q.ExecContext(ctx, u.insert(), args...)
+		if isDuplicateKeyError(err) {
+			result, err = q.ExecContext(ctx, "UPDATE "+u.table+" SET "+u.set+" WHERE "+u.matchKeys()+" AND "+u.where, args...)
+		}
+	default:
+		result, err = q.ExecContext(ctx, u.merge(""), args...)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// upsertRow runs u, which has no where, and returns the returning columns of
+// the row as written
+func (d *Dialect) upsertRow(ctx context.Context, q querier, u upsert, returning string, args ...any) *row {
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		return queryRow(ctx, q, u.onConflict(returning), args...)
+	case config.DatabaseDriverMySQL:
+		if _, err := q.ExecContext(ctx, u.onDuplicateKey(), args...); err != nil {
+			return &row{err: err}
+		}
+		return queryRow(ctx, q, "SELECT "+returning+" FROM "+u.table+" WHERE "+u.matchKeys(), args...)
+	}
+	return queryRow(ctx, q, u.merge(returning), args...)
+}
+
+func (u upsert) insert() string {
+	return "INSERT INTO " + u.table + " (" + strings.Join(u.columns, ", ") + ") VALUES (" + strings.Join(u.values, ", ") + ")"
+}
+
+// matchKeys is the condition matching the row with u's keys
+func (u upsert) matchKeys() string {
+	match := make([]string, len(u.keys))
+	for i, key := range u.keys {
+		match[i] = u.table + "." + key + " = " + u.values[i]
+	}
+	return strings.Join(match, " AND ")
+}
+
+// merge is u as a MERGE, returning the returning columns unless empty. HOLDLOCK
+// keeps the key locked from the match to the insert, so two upserts of a new
+// row don't both insert.
+func (u upsert) merge(returning string) string {
+	source := make([]string, len(u.keys))
+	on := make([]string, len(u.keys))
+	for i, key := range u.keys {
+		source[i] = u.values[i] + " AS " + key
+		on[i] = u.table + "." + key + " = source." + key
+	}
+	matched := "WHEN MATCHED"
+	if u.where != "" {
+		matched += " AND " + u.where
+	}
+	query := "MERGE " + u.table + " WITH (HOLDLOCK) USING (SELECT " + strings.Join(source, ", ") + ") AS source ON " + strings.Join(on, " AND ") + "\n" +
+		"\t\t" + matched + " THEN UPDATE SET " + u.set + "\n" +
+		"\t\tWHEN NOT MATCHED THEN INSERT (" + strings.Join(u.columns, ", ") + ") VALUES (" + strings.Join(u.values, ", ") + ")"
+	if returning != "" {
+		query += " OUTPUT " + prefixColumns("INSERTED", returning)
+	}
+	return query + ";"
+}
+
+// onConflict is u as PostgreSQL's INSERT ... ON CONFLICT, returning the
+// returning columns unless empty
+func (u upsert) onConflict(returning string) string {
+	query := u.insert() + " ON CONFLICT (" + strings.Join(u.keys, ", ") + ") DO UPDATE SET " + u.set
+	if u.where != "" {
+		query += " WHERE " + u.where
+	}
+	if returning != "" {
+		query += " RETURNING " + returning
+	}
+	return query
+}
+
+// onDuplicateKey is u, without its where, as MySQL's INSERT ... ON DUPLICATE KEY UPDATE
+func (u upsert) onDuplicateKey() string {
+	return u.insert() + " ON DUPLICATE KEY UPDATE " + u.set
+}
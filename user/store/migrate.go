@@ -0,0 +1,217 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"user/user/config"
+)
+
+// The schema's migrations, applied in file name order by the migrate command.
+// Each database has its own, in a directory named for its database.driver,
+// and every directory has the same versions.
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// Lines on their own that end a batch, as in sqlcmd; some statements, like
+// reading a column added in the same file, need a batch of their own
+var batchSeparator = regexp.MustCompile(`(?im)^\s*GO\s*$`)
+
+// Semicolons ending a line, which end MySQL statements; the driver runs one at a time
+var statementSeparator = regexp.MustCompile(`(?m);[ \t]*$`)
+
+// How long to wait for another instance to finish migrating
+const migrationLockTimeout = time.Minute
+
+// migrationDialect is how one database locks, records and runs migrations
+type migrationDialect struct {
+	lock string // Takes the session's migration lock, selecting a negative number if it wasn't granted
+	// Releases the lock
+	unlock string
+	// Creates the table recording which migrations have been applied, by
+	// version: the number their file name starts with
+	createTable string
+	// Splits a migration into the statements or batches run one by one; a
+	// migration runs whole without one
+	separator *regexp.Regexp
+}
+
+var migrationDialects = map[string]migrationDialect{
+	config.DatabaseDriverSQLServer: {
+		lock: `DECLARE @result INT;
+EXEC @result = sp_getapplock @Resource = 'schema_migrations', @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = 60000;
+SELECT @result`,
+		unlock: `EXEC sp_releaseapplock @Resource = 'schema_migrations', @LockOwner = 'Session'`,
+		createTable: `
+IF OBJECT_ID('schema_migrations') IS NULL
+CREATE TABLE schema_migrations (
+    version    NVARCHAR(16)  NOT NULL PRIMARY KEY,
+    name       NVARCHAR(255) NOT NULL,
+    applied_at DATETIME2     NOT NULL CONSTRAINT df_schema_migrations_applied_at DEFAULT SYSUTCDATETIME()
+)`,
+		separator: batchSeparator,
+	},
+	// The lock waits until the timeout cancels it
+	config.DatabaseDriverPostgres: {
+		lock:   `SELECT 0 FROM pg_advisory_lock(hashtext('schema_migrations'))`,
+		unlock: `SELECT pg_advisory_unlock(hashtext('schema_migrations'))`,
+		createTable: `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    VARCHAR(16)  NOT NULL PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMPTZ  NOT NULL DEFAULT now()
+)`,
+	},
+	// DDL commits implicitly in MySQL, so a migration failing part way keeps
+	// the statements before the failure, to be undone by hand before it runs again
+	config.DatabaseDriverMySQL: {
+		lock:   `SELECT CASE WHEN GET_LOCK('schema_migrations', 60) = 1 THEN 0 ELSE -1 END`,
+		unlock: `SELECT RELEASE_LOCK('schema_migrations')`,
+		createTable: `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    VARCHAR(16)  NOT NULL PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    applied_at DATETIME(6)  NOT NULL DEFAULT (UTC_TIMESTAMP(6))
+)`,
+		separator: statementSeparator,
+	},
+}
+
+type migration struct {
+	version string
+	name    string
+}
+
+// migrations lists the embedded migrations of a database.driver in the order they apply
+func migrations(driver string) ([]migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/"+driver+"/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+	var list []migration
+	for _, name := range names {
+		name = path.Base(name)
+		version, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s isn't named <version>_<description>.sql", name)
+		}
+		list = append(list, migration{version: version, name: name})
+	}
+	return list, nil
+}
+
+// RunMigrations applies each migration not yet recorded in schema_migrations,
+// its batches and record in one transaction, so a failed one can be fixed and
+// run again. Migrations up to baseline, when given, are recorded without being
+// run. An application lock keeps two instances from migrating at once.
+func RunMigrations(ctx context.Context, db *sql.DB, d *Dialect, baseline string) error {
+	dialect := migrationDialects[d.driver]
+	list, err := migrations(d.driver)
+	if err != nil {
+		return err
+	}
+	if baseline != "" && !slices.ContainsFunc(list, func(m migration) bool { return m.version == baseline }) {
+		return fmt.Errorf("there's no migration %s to baseline at", baseline)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var lock int
+	lockCtx, cancel := context.WithTimeout(ctx, migrationLockTimeout)
+	err = conn.QueryRowContext(lockCtx, dialect.lock).Scan(&lock)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to take the migration lock: %w", err)
+	}
+	if lock < 0 {
+		return fmt.Errorf("another instance is migrating the database (taking the lock returned %d)", lock)
+	}
+	defer conn.ExecContext(context.Background(), dialect.unlock)
+
+	if _, err := conn.ExecContext(ctx, dialect.createTable); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	applied := map[string]bool{}
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, m := range list {
+		if applied[m.version] {
+			continue
+		}
+		run := baseline == "" || m.version > baseline
+		if err := applyMigration(ctx, conn, d.driver, dialect.separator, m, run); err != nil {
+			if len(applied) == 0 {
+				return fmt.Errorf("migration %s: %w; if the schema was set up by hand, record what it has with migrate -baseline <version>", m.name, err)
+			}
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		if run {
+			slog.Info("Applied migration", "migration", m.name)
+		} else {
+			slog.Info("Recorded migration as applied", "migration", m.name)
+		}
+		pending++
+	}
+	slog.Info("Database schema is up to date", "applied", pending, "migrations", len(list))
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, driver string, separator *regexp.Regexp, m migration, run bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if run {
+		script, err := migrationFiles.ReadFile("migrations/" + driver + "/" + m.name)
+		if err != nil {
+			return err
+		}
+		batches := []string{string(script)}
+		if separator != nil {
+			batches = separator.Split(string(script), -1)
+		}
+		for _, batch := range batches {
+			if strings.TrimSpace(batch) == "" {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, batch); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES (@version, @name)`, sql.Named("version", m.version), sql.Named("name", m.name)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
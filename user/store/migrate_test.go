@@ -0,0 +1,31 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"user/user/config"
+)
+
+// TestMigrationsMatch checks each database has a migration of every version,
+// under the same name, so a schema_migrations table reads the same on all
+func TestMigrationsMatch(t *testing.T) {
+	want, err := migrations(config.DatabaseDriverSQLServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) == 0 {
+		t.Fatal("no sqlserver migrations embedded")
+	}
+	for _, driver := range []string{config.DatabaseDriverPostgres, config.DatabaseDriverMySQL} {
+		t.Run(driver, func(t *testing.T) {
+			got, err := migrations(driver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("migrations = %v, want %v", got, want)
+			}
+		})
+	}
+}
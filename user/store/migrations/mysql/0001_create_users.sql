@@ -0,0 +1,8 @@
+-- Initial users table, as originally provisioned by hand
+CREATE TABLE users (
+    id         BIGINT        NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    name       VARCHAR(255)  NOT NULL,
+    email      VARCHAR(320)  NOT NULL,
+    link       VARCHAR(2048) NOT NULL,
+    created_at DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6))
+);
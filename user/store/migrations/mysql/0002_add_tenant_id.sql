@@ -0,0 +1,5 @@
+-- Partition users by tenant; existing rows belong to the default (empty) tenant
+ALTER TABLE users ADD tenant_id VARCHAR(64) NOT NULL DEFAULT '';
+
+-- Emails are unique within a tenant, not across tenants
+CREATE UNIQUE INDEX ux_users_tenant_email ON users (tenant_id, email);
@@ -0,0 +1,9 @@
+-- Soft-deleted users keep their row with deleted_at set
+ALTER TABLE users ADD deleted_at DATETIME(6) NULL;
+
+-- A soft-deleted user's email may be reused by a new account. MySQL filters no
+-- index, so what is unique is a generated column holding only active users'
+-- emails; the NULLs of deleted users never collide.
+ALTER TABLE users ADD active_email VARCHAR(320) AS (CASE WHEN deleted_at IS NULL THEN email END) VIRTUAL;
+DROP INDEX ux_users_tenant_email ON users;
+CREATE UNIQUE INDEX ux_users_tenant_email ON users (tenant_id, active_email);
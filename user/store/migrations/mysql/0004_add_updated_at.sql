@@ -0,0 +1,4 @@
+-- Track the last modification of each user; drives the ETag on GET /users/{id}
+ALTER TABLE users ADD updated_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6));
+
+UPDATE users SET updated_at = created_at;
@@ -0,0 +1,2 @@
+-- Link to a downscaled copy of the profile picture; empty when none was generated
+ALTER TABLE users ADD thumbnail_link VARCHAR(2048) NOT NULL DEFAULT '';
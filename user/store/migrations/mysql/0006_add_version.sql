@@ -0,0 +1,7 @@
+-- Bumped on every write, as SQL Server's rowversion is; updates are conditional
+-- on the version they read. It counts the row's writes as the same 8-byte
+-- big-endian value. Creating the trigger with binary logging on takes SUPER,
+-- or log_bin_trust_function_creators.
+ALTER TABLE users ADD version BINARY(8) NOT NULL DEFAULT (UNHEX('0000000000000001'));
+CREATE TRIGGER tr_users_version BEFORE UPDATE ON users FOR EACH ROW
+    SET NEW.version = UNHEX(LPAD(HEX(CAST(CONV(HEX(OLD.version), 16, 10) AS UNSIGNED) + 1), 16, '0'));
@@ -0,0 +1,2 @@
+-- When the user last logged in; NULL for accounts that never have
+ALTER TABLE users ADD last_login_at DATETIME(6) NULL;
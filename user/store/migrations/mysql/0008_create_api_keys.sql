@@ -0,0 +1,12 @@
+-- Keys minted through /admin/api-keys for machine-to-machine callers. Only a
+-- SHA-256 of each key is stored; the key itself is shown once, when minted.
+CREATE TABLE api_keys (
+    id         BIGINT       NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    prefix     VARCHAR(16)  NOT NULL,
+    key_hash   BINARY(32)   NOT NULL,
+    scopes     VARCHAR(255) NOT NULL,
+    created_at DATETIME(6)  NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    revoked_at DATETIME(6)  NULL,
+    CONSTRAINT ux_api_keys_key_hash UNIQUE (key_hash)
+);
@@ -0,0 +1,2 @@
+-- Space-separated roles; empty for a regular user who may only manage their own record
+ALTER TABLE users ADD roles VARCHAR(255) NOT NULL DEFAULT '';
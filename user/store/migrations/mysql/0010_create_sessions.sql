@@ -0,0 +1,14 @@
+-- Sessions started through /auth/login. Each holds the current refresh token,
+-- stored as a SHA-256 and replaced on every refresh.
+CREATE TABLE sessions (
+    id           BIGINT       NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    subject      VARCHAR(255) NOT NULL,
+    email        VARCHAR(320) NOT NULL,
+    admin        BOOLEAN      NOT NULL,
+    refresh_hash BINARY(32)   NOT NULL,
+    created_at   DATETIME(6)  NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    refreshed_at DATETIME(6)  NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    expires_at   DATETIME(6)  NOT NULL,
+    revoked_at   DATETIME(6)  NULL,
+    CONSTRAINT ux_sessions_refresh_hash UNIQUE (refresh_hash)
+);
@@ -0,0 +1,9 @@
+-- Social login accounts linked to users; a provider's subject maps to one user
+CREATE TABLE user_identities (
+    provider   VARCHAR(32)  NOT NULL,
+    subject    VARCHAR(255) NOT NULL,
+    user_id    BIGINT       NOT NULL,
+    created_at DATETIME(6)  NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    CONSTRAINT pk_user_identities PRIMARY KEY (provider, subject),
+    CONSTRAINT fk_user_identities_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
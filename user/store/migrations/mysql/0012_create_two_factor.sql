@@ -0,0 +1,25 @@
+-- TOTP two-factor authentication. A secret is pending until its first code is
+-- confirmed; last_step is the newest time step accepted, so a code works once.
+CREATE TABLE user_totp (
+    user_id    BIGINT        NOT NULL PRIMARY KEY,
+    secret     VARBINARY(64) NOT NULL,
+    last_step  BIGINT        NULL,
+    created_at DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    enabled_at DATETIME(6)   NULL,
+    CONSTRAINT fk_user_totp_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- One-time recovery codes, stored as a SHA-256 and replaced on each enrollment
+CREATE TABLE user_recovery_codes (
+    user_id   BIGINT      NOT NULL,
+    code_hash BINARY(32)  NOT NULL,
+    used_at   DATETIME(6) NULL,
+    CONSTRAINT pk_user_recovery_codes PRIMARY KEY (user_id, code_hash),
+    CONSTRAINT fk_user_recovery_codes_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Sessions of users with two-factor enabled start pending until a code is verified
+ALTER TABLE sessions
+    ADD user_id         BIGINT      NULL,
+    ADD mfa_pending     BOOLEAN     NOT NULL DEFAULT FALSE,
+    ADD mfa_verified_at DATETIME(6) NULL;
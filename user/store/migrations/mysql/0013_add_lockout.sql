@@ -0,0 +1,14 @@
+-- Brute-force protection. Failed authentication attempts are counted per account
+-- and per source IP over a sliding window; accounts past the threshold are locked
+-- until an admin unlocks them.
+ALTER TABLE users ADD locked_at DATETIME(6) NULL;
+
+CREATE TABLE auth_failures (
+    id         BIGINT      NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id    BIGINT      NULL,
+    ip         VARCHAR(45) NOT NULL,
+    created_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    CONSTRAINT fk_auth_failures_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX ix_auth_failures_user ON auth_failures (user_id, created_at);
+CREATE INDEX ix_auth_failures_ip ON auth_failures (ip, created_at);
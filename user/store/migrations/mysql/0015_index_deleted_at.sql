@@ -0,0 +1,2 @@
+-- Lets the purge find soft-deleted users past the retention window
+CREATE INDEX ix_users_deleted_at ON users (deleted_at);
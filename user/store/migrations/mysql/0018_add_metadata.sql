@@ -0,0 +1,2 @@
+-- App-specific attributes as a JSON object of strings, filtered on with JSON_EXTRACT
+ALTER TABLE users ADD metadata JSON NOT NULL DEFAULT ('{}');
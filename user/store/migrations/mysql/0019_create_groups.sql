@@ -0,0 +1,23 @@
+-- Groups of a tenant's users, e.g. teams or departments. Named user_groups as
+-- GROUP is a reserved word.
+CREATE TABLE user_groups (
+    id          BIGINT        NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    tenant_id   VARCHAR(64)   NOT NULL DEFAULT '',
+    name        VARCHAR(255)  NOT NULL,
+    description VARCHAR(1000) NOT NULL DEFAULT '',
+    created_at  DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6))
+);
+
+-- Group names are unique within a tenant
+CREATE UNIQUE INDEX ux_user_groups_tenant_name ON user_groups (tenant_id, name);
+
+-- Which users belong to which groups; either going away ends the membership
+CREATE TABLE group_members (
+    group_id   BIGINT      NOT NULL,
+    user_id    BIGINT      NOT NULL,
+    created_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    CONSTRAINT pk_group_members PRIMARY KEY (group_id, user_id),
+    CONSTRAINT fk_group_members_group FOREIGN KEY (group_id) REFERENCES user_groups (id) ON DELETE CASCADE,
+    CONSTRAINT fk_group_members_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX ix_group_members_user ON group_members (user_id, group_id);
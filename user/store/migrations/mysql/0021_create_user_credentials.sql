@@ -0,0 +1,9 @@
+-- Local passwords, a bcrypt hash each, for users who sign in without an
+-- identity provider. Kept apart from users so no user query can return one.
+CREATE TABLE user_credentials (
+    user_id       BIGINT        NOT NULL PRIMARY KEY,
+    password_hash VARBINARY(60) NOT NULL,
+    created_at    DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    updated_at    DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    CONSTRAINT fk_user_credentials_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,15 @@
+-- One-time links from POST /auth/forgot-password. Only the SHA-256 of each
+-- token is stored; using one, or resetting the password, uses up the rest.
+CREATE TABLE password_resets (
+    id         BIGINT      NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id    BIGINT      NOT NULL,
+    token_hash BINARY(32)  NOT NULL,
+    created_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    expires_at DATETIME(6) NOT NULL,
+    used_at    DATETIME(6) NULL,
+    CONSTRAINT ux_password_resets_token_hash UNIQUE (token_hash),
+    CONSTRAINT fk_password_resets_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Counting a user's recent requests, to cap how many links they are sent
+CREATE INDEX ix_password_resets_user_id ON password_resets (user_id, created_at);
@@ -0,0 +1,28 @@
+-- Webhook endpoints registered through POST /webhooks, each receiving the
+-- user events it subscribed to. The secret signs payloads, so it is kept as is.
+CREATE TABLE webhooks (
+    id         BIGINT        NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    tenant_id  VARCHAR(64)   NOT NULL DEFAULT '',
+    url        VARCHAR(2048) NOT NULL,
+    secret     VARCHAR(255)  NOT NULL,
+    events     VARCHAR(255)  NOT NULL, -- Space-separated event types
+    created_at DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6))
+);
+CREATE INDEX ix_webhooks_tenant_id ON webhooks (tenant_id);
+
+-- Every attempt to deliver an event to a registered webhook, for GET
+-- /webhooks/{id}/deliveries
+CREATE TABLE webhook_deliveries (
+    id           BIGINT        NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    webhook_id   BIGINT        NOT NULL,
+    delivery_id  CHAR(32)      NOT NULL, -- Shared by the attempts of one delivery, sent as X-Delivery-ID
+    event_type   VARCHAR(64)   NOT NULL,
+    user_id      BIGINT        NOT NULL,
+    attempt      INT           NOT NULL,
+    status_code  INT           NULL,
+    error        VARCHAR(1000) NULL,
+    succeeded    BOOLEAN       NOT NULL,
+    attempted_at DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    CONSTRAINT fk_webhook_deliveries_webhook FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
+CREATE INDEX ix_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, id);
@@ -0,0 +1,16 @@
+-- CSV imports through POST /users/import, whose progress is kept up to date
+-- while the upload streams in
+CREATE TABLE import_jobs (
+    id          BIGINT        NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    tenant_id   VARCHAR(64)   NOT NULL DEFAULT '',
+    status      VARCHAR(16)   NOT NULL CONSTRAINT ck_import_jobs_status CHECK (status IN ('running', 'completed', 'failed')),
+    filename    VARCHAR(255)  NOT NULL DEFAULT '',
+    rows_read   INT           NOT NULL DEFAULT 0,
+    created     INT           NOT NULL DEFAULT 0,
+    failed      INT           NOT NULL DEFAULT 0,
+    error       VARCHAR(1000) NULL,
+    created_at  DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    updated_at  DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    finished_at DATETIME(6)   NULL
+);
+CREATE INDEX ix_import_jobs_tenant_id ON import_jobs (tenant_id, id);
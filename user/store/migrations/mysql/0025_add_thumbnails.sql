@@ -0,0 +1,2 @@
+-- Resized variants of the profile picture as a JSON object of size in pixels to link
+ALTER TABLE users ADD thumbnails JSON NOT NULL DEFAULT ('{}');
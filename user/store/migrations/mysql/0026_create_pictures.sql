@@ -0,0 +1,16 @@
+-- Uploaded profile pictures by content, so a picture uploaded again is
+-- referenced instead of stored twice. ref_count counts the users pointing at
+-- it; the blobs are deleted along with the row when the last one lets go.
+CREATE TABLE pictures (
+    id             BIGINT        NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    tenant_id      VARCHAR(64)   NOT NULL DEFAULT '',
+    content_sha256 BINARY(32)    NOT NULL,
+    blob_name      VARCHAR(512)  NOT NULL,
+    md5            VARCHAR(24)   NOT NULL,
+    thumbnail_link VARCHAR(2048) NOT NULL DEFAULT '',
+    thumbnails     JSON          NOT NULL DEFAULT ('{}'),
+    ref_count      INT           NOT NULL CONSTRAINT ck_pictures_ref_count CHECK (ref_count > 0),
+    created_at     DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6))
+);
+CREATE UNIQUE INDEX ux_pictures_content ON pictures (tenant_id, content_sha256);
+CREATE UNIQUE INDEX ux_pictures_blob_name ON pictures (blob_name);
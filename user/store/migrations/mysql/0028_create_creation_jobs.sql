@@ -0,0 +1,13 @@
+-- Users created in the background after POST /users with Prefer: respond-async,
+-- polled through GET /jobs/{id}. user_id is set once the job succeeds.
+CREATE TABLE creation_jobs (
+    id          BIGINT        NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    tenant_id   VARCHAR(64)   NOT NULL DEFAULT '',
+    status      VARCHAR(16)   NOT NULL CONSTRAINT ck_creation_jobs_status CHECK (status IN ('pending', 'running', 'succeeded', 'failed')),
+    user_id     BIGINT        NULL,
+    error       VARCHAR(1000) NULL,
+    created_at  DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    updated_at  DATETIME(6)   NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    finished_at DATETIME(6)   NULL
+);
+CREATE INDEX ix_creation_jobs_tenant_id ON creation_jobs (tenant_id, id);
@@ -0,0 +1,7 @@
+-- Addresses the mail.notifications emails are no longer sent to, added through
+-- PUT /admin/mail/suppressions/{email}. email is stored lower case.
+CREATE TABLE mail_suppressions (
+    email      VARCHAR(320) NOT NULL PRIMARY KEY,
+    reason     VARCHAR(255) NOT NULL DEFAULT '',
+    created_at DATETIME(6)  NOT NULL DEFAULT (UTC_TIMESTAMP(6))
+);
@@ -0,0 +1,11 @@
+-- The latest run of each scheduled job, claimed by one instance of the
+-- scheduler. locked_until holds off the others while the run goes on, and is
+-- cleared once it finishes.
+CREATE TABLE job_runs (
+    job_name     VARCHAR(64) NOT NULL PRIMARY KEY,
+    scheduled_at DATETIME(6) NOT NULL,
+    owner        VARCHAR(64) NOT NULL,
+    locked_until DATETIME(6) NULL,
+    started_at   DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    finished_at  DATETIME(6) NULL
+);
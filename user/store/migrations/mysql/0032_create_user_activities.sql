@@ -0,0 +1,14 @@
+-- Each user's timeline of significant actions, for support: created, logged
+-- in, changed email or picture. Unlike audit_events it holds no snapshots, so
+-- erasing a user leaves it as is. Rows outlive the users they describe, so
+-- there is no foreign key.
+CREATE TABLE user_activities (
+    id         BIGINT       NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    tenant_id  VARCHAR(64)  NOT NULL,
+    user_id    BIGINT       NOT NULL,
+    type       VARCHAR(32)  NOT NULL,
+    actor      VARCHAR(255) NOT NULL,
+    request_id VARCHAR(255) NULL,
+    created_at DATETIME(6)  NOT NULL DEFAULT (UTC_TIMESTAMP(6))
+);
+CREATE INDEX ix_user_activities_user ON user_activities (tenant_id, user_id, id);
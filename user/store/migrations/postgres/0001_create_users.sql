@@ -0,0 +1,8 @@
+-- Initial users table, as originally provisioned by hand
+CREATE TABLE users (
+    id         BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    name       VARCHAR(255)  NOT NULL,
+    email      VARCHAR(320)  NOT NULL,
+    link       VARCHAR(2048) NOT NULL,
+    created_at TIMESTAMPTZ   NOT NULL DEFAULT now()
+);
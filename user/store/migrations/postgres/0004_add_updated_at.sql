@@ -0,0 +1,4 @@
+-- Track the last modification of each user; drives the ETag on GET /users/{id}
+ALTER TABLE users ADD updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+UPDATE users SET updated_at = created_at;
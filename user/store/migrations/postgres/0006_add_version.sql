@@ -0,0 +1,13 @@
+-- Bumped on every write from a sequence, as SQL Server's rowversion is; updates
+-- are conditional on the version they read. int8send makes it the same
+-- 8-byte big-endian value.
+CREATE SEQUENCE users_version_seq;
+ALTER TABLE users ADD version BYTEA NOT NULL DEFAULT int8send(nextval('users_version_seq'));
+
+CREATE FUNCTION users_bump_version() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+    NEW.version := int8send(nextval('users_version_seq'));
+    RETURN NEW;
+END
+$$;
+CREATE TRIGGER tr_users_version BEFORE UPDATE ON users FOR EACH ROW EXECUTE FUNCTION users_bump_version();
@@ -0,0 +1,11 @@
+-- Keys minted through /admin/api-keys for machine-to-machine callers. Only a
+-- SHA-256 of each key is stored; the key itself is shown once, when minted.
+CREATE TABLE api_keys (
+    id         BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    prefix     VARCHAR(16)  NOT NULL,
+    key_hash   BYTEA        NOT NULL CONSTRAINT ux_api_keys_key_hash UNIQUE,
+    scopes     VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ  NULL
+);
@@ -0,0 +1,13 @@
+-- Sessions started through /auth/login. Each holds the current refresh token,
+-- stored as a SHA-256 and replaced on every refresh.
+CREATE TABLE sessions (
+    id           BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    subject      VARCHAR(255) NOT NULL,
+    email        VARCHAR(320) NOT NULL,
+    admin        BOOLEAN      NOT NULL,
+    refresh_hash BYTEA        NOT NULL CONSTRAINT ux_sessions_refresh_hash UNIQUE,
+    created_at   TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    refreshed_at TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    expires_at   TIMESTAMPTZ  NOT NULL,
+    revoked_at   TIMESTAMPTZ  NULL
+);
@@ -0,0 +1,8 @@
+-- Social login accounts linked to users; a provider's subject maps to one user
+CREATE TABLE user_identities (
+    provider   VARCHAR(32)  NOT NULL,
+    subject    VARCHAR(255) NOT NULL,
+    user_id    BIGINT       NOT NULL CONSTRAINT fk_user_identities_user REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    CONSTRAINT pk_user_identities PRIMARY KEY (provider, subject)
+);
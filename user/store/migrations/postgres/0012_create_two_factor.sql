@@ -0,0 +1,23 @@
+-- TOTP two-factor authentication. A secret is pending until its first code is
+-- confirmed; last_step is the newest time step accepted, so a code works once.
+CREATE TABLE user_totp (
+    user_id    BIGINT      NOT NULL CONSTRAINT pk_user_totp PRIMARY KEY CONSTRAINT fk_user_totp_user REFERENCES users (id) ON DELETE CASCADE,
+    secret     BYTEA       NOT NULL,
+    last_step  BIGINT      NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    enabled_at TIMESTAMPTZ NULL
+);
+
+-- One-time recovery codes, stored as a SHA-256 and replaced on each enrollment
+CREATE TABLE user_recovery_codes (
+    user_id   BIGINT      NOT NULL CONSTRAINT fk_user_recovery_codes_user REFERENCES users (id) ON DELETE CASCADE,
+    code_hash BYTEA       NOT NULL,
+    used_at   TIMESTAMPTZ NULL,
+    CONSTRAINT pk_user_recovery_codes PRIMARY KEY (user_id, code_hash)
+);
+
+-- Sessions of users with two-factor enabled start pending until a code is verified
+ALTER TABLE sessions
+    ADD user_id         BIGINT      NULL,
+    ADD mfa_pending     BOOLEAN     NOT NULL DEFAULT FALSE,
+    ADD mfa_verified_at TIMESTAMPTZ NULL;
@@ -0,0 +1,13 @@
+-- Brute-force protection. Failed authentication attempts are counted per account
+-- and per source IP over a sliding window; accounts past the threshold are locked
+-- until an admin unlocks them.
+ALTER TABLE users ADD locked_at TIMESTAMPTZ NULL;
+
+CREATE TABLE auth_failures (
+    id         BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    user_id    BIGINT      NULL CONSTRAINT fk_auth_failures_user REFERENCES users (id) ON DELETE CASCADE,
+    ip         VARCHAR(45) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX ix_auth_failures_user ON auth_failures (user_id, created_at) WHERE user_id IS NOT NULL;
+CREATE INDEX ix_auth_failures_ip ON auth_failures (ip, created_at);
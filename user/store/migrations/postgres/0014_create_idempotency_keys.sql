@@ -0,0 +1,13 @@
+-- Responses to requests made with an Idempotency-Key, replayed when they are
+-- retried. Keys are stored as a SHA-256 of the tenant, caller and key. A row
+-- without a status belongs to a request still running, and expires_at is then
+-- when a retry may take the key over.
+CREATE TABLE idempotency_keys (
+    key_hash   BYTEA       NOT NULL CONSTRAINT pk_idempotency_keys PRIMARY KEY,
+    status     INTEGER     NULL,
+    headers    TEXT        NULL,
+    body       BYTEA       NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX ix_idempotency_keys_expires_at ON idempotency_keys (expires_at);
@@ -0,0 +1,17 @@
+-- Who changed which user, when and how, for compliance reviews. The states are
+-- JSON snapshots of the user before and after the change; before is NULL for
+-- creates and restores, after for hard deletes and purges. Rows outlive the
+-- users they describe, so there is no foreign key.
+CREATE TABLE audit_events (
+    id           BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    tenant_id    VARCHAR(64)  NOT NULL,
+    actor        VARCHAR(255) NOT NULL,
+    action       VARCHAR(32)  NOT NULL,
+    user_id      BIGINT       NOT NULL,
+    before_state JSONB        NULL,
+    after_state  JSONB        NULL,
+    request_id   VARCHAR(255) NULL,
+    created_at   TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
+CREATE INDEX ix_audit_events_user ON audit_events (tenant_id, user_id, id);
+CREATE INDEX ix_audit_events_created_at ON audit_events (created_at);
@@ -0,0 +1,2 @@
+-- App-specific attributes as a JSON object of strings, filtered on with jsonb_path_query_first
+ALTER TABLE users ADD metadata JSONB NOT NULL DEFAULT '{}';
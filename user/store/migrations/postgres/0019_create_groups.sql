@@ -0,0 +1,21 @@
+-- Groups of a tenant's users, e.g. teams or departments. Named user_groups as
+-- GROUP is a reserved word.
+CREATE TABLE user_groups (
+    id          BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    tenant_id   VARCHAR(64)   NOT NULL DEFAULT '',
+    name        VARCHAR(255)  NOT NULL,
+    description VARCHAR(1000) NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ   NOT NULL DEFAULT now()
+);
+
+-- Group names are unique within a tenant, whatever their case
+CREATE UNIQUE INDEX ux_user_groups_tenant_name ON user_groups (tenant_id, LOWER(name));
+
+-- Which users belong to which groups; either going away ends the membership
+CREATE TABLE group_members (
+    group_id   BIGINT      NOT NULL CONSTRAINT fk_group_members_group REFERENCES user_groups (id) ON DELETE CASCADE,
+    user_id    BIGINT      NOT NULL CONSTRAINT fk_group_members_user REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT pk_group_members PRIMARY KEY (group_id, user_id)
+);
+CREATE INDEX ix_group_members_user ON group_members (user_id, group_id);
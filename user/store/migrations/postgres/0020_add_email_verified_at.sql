@@ -0,0 +1,4 @@
+-- When the user proved they own their email, by following the link sent to it
+-- or signing in with a provider that verified it; NULL until then, and again
+-- whenever the email changes
+ALTER TABLE users ADD email_verified_at TIMESTAMPTZ NULL;
@@ -0,0 +1,8 @@
+-- Local passwords, a bcrypt hash each, for users who sign in without an
+-- identity provider. Kept apart from users so no user query can return one.
+CREATE TABLE user_credentials (
+    user_id       BIGINT      NOT NULL CONSTRAINT pk_user_credentials PRIMARY KEY CONSTRAINT fk_user_credentials_user REFERENCES users (id) ON DELETE CASCADE,
+    password_hash BYTEA       NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
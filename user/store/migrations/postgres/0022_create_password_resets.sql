@@ -0,0 +1,13 @@
+-- One-time links from POST /auth/forgot-password. Only the SHA-256 of each
+-- token is stored; using one, or resetting the password, uses up the rest.
+CREATE TABLE password_resets (
+    id         BIGINT GENERATED BY DEFAULT AS IDENTITY CONSTRAINT pk_password_resets PRIMARY KEY,
+    user_id    BIGINT      NOT NULL CONSTRAINT fk_password_resets_user REFERENCES users (id) ON DELETE CASCADE,
+    token_hash BYTEA       NOT NULL CONSTRAINT ux_password_resets_token_hash UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ NULL
+);
+
+-- Counting a user's recent requests, to cap how many links they are sent
+CREATE INDEX ix_password_resets_user_id ON password_resets (user_id, created_at);
@@ -0,0 +1,16 @@
+-- CSV imports through POST /users/import, whose progress is kept up to date
+-- while the upload streams in
+CREATE TABLE import_jobs (
+    id          BIGINT GENERATED BY DEFAULT AS IDENTITY CONSTRAINT pk_import_jobs PRIMARY KEY,
+    tenant_id   VARCHAR(64)   NOT NULL DEFAULT '',
+    status      VARCHAR(16)   NOT NULL CONSTRAINT ck_import_jobs_status CHECK (status IN ('running', 'completed', 'failed')),
+    filename    VARCHAR(255)  NOT NULL DEFAULT '',
+    rows_read   INTEGER       NOT NULL DEFAULT 0,
+    created     INTEGER       NOT NULL DEFAULT 0,
+    failed      INTEGER       NOT NULL DEFAULT 0,
+    error       VARCHAR(1000) NULL,
+    created_at  TIMESTAMPTZ   NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ   NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ   NULL
+);
+CREATE INDEX ix_import_jobs_tenant_id ON import_jobs (tenant_id, id);
@@ -0,0 +1,16 @@
+-- Uploaded profile pictures by content, so a picture uploaded again is
+-- referenced instead of stored twice. ref_count counts the users pointing at
+-- it; the blobs are deleted along with the row when the last one lets go.
+CREATE TABLE pictures (
+    id             BIGINT GENERATED BY DEFAULT AS IDENTITY CONSTRAINT pk_pictures PRIMARY KEY,
+    tenant_id      VARCHAR(64)   NOT NULL DEFAULT '',
+    content_sha256 BYTEA         NOT NULL,
+    blob_name      VARCHAR(512)  NOT NULL,
+    md5            VARCHAR(24)   NOT NULL,
+    thumbnail_link VARCHAR(2048) NOT NULL DEFAULT '',
+    thumbnails     JSONB         NOT NULL DEFAULT '{}',
+    ref_count      INTEGER       NOT NULL CONSTRAINT ck_pictures_ref_count CHECK (ref_count > 0),
+    created_at     TIMESTAMPTZ   NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX ux_pictures_content ON pictures (tenant_id, content_sha256);
+CREATE UNIQUE INDEX ux_pictures_blob_name ON pictures (blob_name);
@@ -0,0 +1,19 @@
+-- User events written in the same transaction as the change they describe,
+-- relayed to Service Bus by the outbox dispatcher. A row is deleted once sent;
+-- locked_until leases it to one dispatcher, and message_id stays the same across
+-- attempts so duplicate detection drops a resend.
+CREATE TABLE outbox_events (
+    id             BIGINT GENERATED BY DEFAULT AS IDENTITY CONSTRAINT pk_outbox_events PRIMARY KEY,
+    event_type     VARCHAR(64)   NOT NULL,
+    schema_version VARCHAR(16)   NOT NULL,
+    message_id     VARCHAR(64)   NOT NULL,
+    user_id        BIGINT        NOT NULL,
+    tenant_id      VARCHAR(64)   NOT NULL DEFAULT '',
+    body           BYTEA         NOT NULL,
+    trace_context  JSONB         NOT NULL DEFAULT '{}',
+    attempts       INTEGER       NOT NULL DEFAULT 0,
+    last_error     VARCHAR(1024) NULL,
+    locked_until   TIMESTAMPTZ   NULL,
+    created_at     TIMESTAMPTZ   NOT NULL DEFAULT now()
+);
+CREATE INDEX ix_outbox_events_locked_until ON outbox_events (locked_until);
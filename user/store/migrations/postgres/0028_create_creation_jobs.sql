@@ -0,0 +1,13 @@
+-- Users created in the background after POST /users with Prefer: respond-async,
+-- polled through GET /jobs/{id}. user_id is set once the job succeeds.
+CREATE TABLE creation_jobs (
+    id          BIGINT GENERATED BY DEFAULT AS IDENTITY CONSTRAINT pk_creation_jobs PRIMARY KEY,
+    tenant_id   VARCHAR(64)   NOT NULL DEFAULT '',
+    status      VARCHAR(16)   NOT NULL CONSTRAINT ck_creation_jobs_status CHECK (status IN ('pending', 'running', 'succeeded', 'failed')),
+    user_id     BIGINT        NULL,
+    error       VARCHAR(1000) NULL,
+    created_at  TIMESTAMPTZ   NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ   NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ   NULL
+);
+CREATE INDEX ix_creation_jobs_tenant_id ON creation_jobs (tenant_id, id);
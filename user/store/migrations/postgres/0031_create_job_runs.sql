@@ -0,0 +1,11 @@
+-- The latest run of each scheduled job, claimed by one instance of the
+-- scheduler. locked_until holds off the others while the run goes on, and is
+-- cleared once it finishes.
+CREATE TABLE job_runs (
+    job_name     VARCHAR(64) NOT NULL CONSTRAINT pk_job_runs PRIMARY KEY,
+    scheduled_at TIMESTAMPTZ NOT NULL,
+    owner        VARCHAR(64) NOT NULL,
+    locked_until TIMESTAMPTZ NULL,
+    started_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at  TIMESTAMPTZ NULL
+);
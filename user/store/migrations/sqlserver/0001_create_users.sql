@@ -0,0 +1,8 @@
+-- Initial users table, as originally provisioned by hand
+CREATE TABLE users (
+    id         BIGINT IDENTITY(1,1) PRIMARY KEY,
+    name       NVARCHAR(255)  NOT NULL,
+    email      NVARCHAR(320)  NOT NULL,
+    link       NVARCHAR(2048) NOT NULL,
+    created_at DATETIME2      NOT NULL CONSTRAINT df_users_created_at DEFAULT SYSUTCDATETIME()
+);
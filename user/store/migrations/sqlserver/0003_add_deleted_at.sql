@@ -0,0 +1,6 @@
+-- Soft-deleted users keep their row with deleted_at set
+ALTER TABLE users ADD deleted_at DATETIME2 NULL;
+
+-- A soft-deleted user's email may be reused by a new account
+DROP INDEX ux_users_tenant_email ON users;
+CREATE UNIQUE INDEX ux_users_tenant_email ON users (tenant_id, email) WHERE deleted_at IS NULL;
@@ -0,0 +1,5 @@
+-- Track the last modification of each user; drives the ETag on GET /users/{id}
+ALTER TABLE users ADD updated_at DATETIME2 NOT NULL CONSTRAINT df_users_updated_at DEFAULT SYSUTCDATETIME();
+GO
+
+UPDATE users SET updated_at = created_at;
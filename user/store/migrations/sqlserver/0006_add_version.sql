@@ -0,0 +1,2 @@
+-- Bumped by SQL Server on every write; updates are conditional on the version they read
+ALTER TABLE users ADD version ROWVERSION;
@@ -0,0 +1,11 @@
+-- Keys minted through /admin/api-keys for machine-to-machine callers. Only a
+-- SHA-256 of each key is stored; the key itself is shown once, when minted.
+CREATE TABLE api_keys (
+    id         BIGINT IDENTITY(1,1) PRIMARY KEY,
+    name       NVARCHAR(255) NOT NULL,
+    prefix     VARCHAR(16)   NOT NULL,
+    key_hash   BINARY(32)    NOT NULL CONSTRAINT ux_api_keys_key_hash UNIQUE,
+    scopes     VARCHAR(255)  NOT NULL,
+    created_at DATETIME2     NOT NULL CONSTRAINT df_api_keys_created_at DEFAULT SYSUTCDATETIME(),
+    revoked_at DATETIME2     NULL
+);
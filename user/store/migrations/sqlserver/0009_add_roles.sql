@@ -0,0 +1,2 @@
+-- Space-separated roles; empty for a regular user who may only manage their own record
+ALTER TABLE users ADD roles NVARCHAR(255) NOT NULL CONSTRAINT df_users_roles DEFAULT '';
@@ -0,0 +1,13 @@
+-- Sessions started through /auth/login. Each holds the current refresh token,
+-- stored as a SHA-256 and replaced on every refresh.
+CREATE TABLE sessions (
+    id           BIGINT IDENTITY(1,1) PRIMARY KEY,
+    subject      NVARCHAR(255) NOT NULL,
+    email        NVARCHAR(320) NOT NULL,
+    admin        BIT           NOT NULL,
+    refresh_hash BINARY(32)    NOT NULL CONSTRAINT ux_sessions_refresh_hash UNIQUE,
+    created_at   DATETIME2     NOT NULL CONSTRAINT df_sessions_created_at DEFAULT SYSUTCDATETIME(),
+    refreshed_at DATETIME2     NOT NULL CONSTRAINT df_sessions_refreshed_at DEFAULT SYSUTCDATETIME(),
+    expires_at   DATETIME2     NOT NULL,
+    revoked_at   DATETIME2     NULL
+);
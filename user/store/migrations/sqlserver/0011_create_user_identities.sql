@@ -0,0 +1,8 @@
+-- Social login accounts linked to users; a provider's subject maps to one user
+CREATE TABLE user_identities (
+    provider   NVARCHAR(32)  NOT NULL,
+    subject    NVARCHAR(255) NOT NULL,
+    user_id    BIGINT        NOT NULL CONSTRAINT fk_user_identities_user REFERENCES users (id) ON DELETE CASCADE,
+    created_at DATETIME2     NOT NULL CONSTRAINT df_user_identities_created_at DEFAULT SYSUTCDATETIME(),
+    CONSTRAINT pk_user_identities PRIMARY KEY (provider, subject)
+);
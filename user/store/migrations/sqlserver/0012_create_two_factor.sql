@@ -0,0 +1,23 @@
+-- TOTP two-factor authentication. A secret is pending until its first code is
+-- confirmed; last_step is the newest time step accepted, so a code works once.
+CREATE TABLE user_totp (
+    user_id    BIGINT         NOT NULL CONSTRAINT pk_user_totp PRIMARY KEY CONSTRAINT fk_user_totp_user REFERENCES users (id) ON DELETE CASCADE,
+    secret     VARBINARY(64)  NOT NULL,
+    last_step  BIGINT         NULL,
+    created_at DATETIME2      NOT NULL CONSTRAINT df_user_totp_created_at DEFAULT SYSUTCDATETIME(),
+    enabled_at DATETIME2      NULL
+);
+
+-- One-time recovery codes, stored as a SHA-256 and replaced on each enrollment
+CREATE TABLE user_recovery_codes (
+    user_id   BIGINT     NOT NULL CONSTRAINT fk_user_recovery_codes_user REFERENCES users (id) ON DELETE CASCADE,
+    code_hash BINARY(32) NOT NULL,
+    used_at   DATETIME2  NULL,
+    CONSTRAINT pk_user_recovery_codes PRIMARY KEY (user_id, code_hash)
+);
+
+-- Sessions of users with two-factor enabled start pending until a code is verified
+ALTER TABLE sessions ADD
+    user_id         BIGINT    NULL,
+    mfa_pending     BIT       NOT NULL CONSTRAINT df_sessions_mfa_pending DEFAULT 0,
+    mfa_verified_at DATETIME2 NULL;
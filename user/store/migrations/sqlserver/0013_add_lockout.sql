@@ -0,0 +1,13 @@
+-- Brute-force protection. Failed authentication attempts are counted per account
+-- and per source IP over a sliding window; accounts past the threshold are locked
+-- until an admin unlocks them.
+ALTER TABLE users ADD locked_at DATETIME2 NULL;
+
+CREATE TABLE auth_failures (
+    id         BIGINT IDENTITY(1,1) PRIMARY KEY,
+    user_id    BIGINT       NULL CONSTRAINT fk_auth_failures_user REFERENCES users (id) ON DELETE CASCADE,
+    ip         NVARCHAR(45) NOT NULL,
+    created_at DATETIME2    NOT NULL CONSTRAINT df_auth_failures_created_at DEFAULT SYSUTCDATETIME()
+);
+CREATE INDEX ix_auth_failures_user ON auth_failures (user_id, created_at) WHERE user_id IS NOT NULL;
+CREATE INDEX ix_auth_failures_ip ON auth_failures (ip, created_at);
@@ -0,0 +1,17 @@
+-- Who changed which user, when and how, for compliance reviews. The states are
+-- JSON snapshots of the user before and after the change; before is NULL for
+-- creates and restores, after for hard deletes and purges. Rows outlive the
+-- users they describe, so there is no foreign key.
+CREATE TABLE audit_events (
+    id           BIGINT IDENTITY(1,1) PRIMARY KEY,
+    tenant_id    NVARCHAR(64)  NOT NULL,
+    actor        NVARCHAR(255) NOT NULL,
+    action       NVARCHAR(32)  NOT NULL,
+    user_id      BIGINT        NOT NULL,
+    before_state NVARCHAR(MAX) NULL,
+    after_state  NVARCHAR(MAX) NULL,
+    request_id   NVARCHAR(255) NULL,
+    created_at   DATETIME2     NOT NULL CONSTRAINT df_audit_events_created_at DEFAULT SYSUTCDATETIME()
+);
+CREATE INDEX ix_audit_events_user ON audit_events (tenant_id, user_id, id);
+CREATE INDEX ix_audit_events_created_at ON audit_events (created_at);
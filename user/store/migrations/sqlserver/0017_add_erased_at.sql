@@ -0,0 +1,3 @@
+-- Users whose personal data was erased keep a tombstone row, soft-deleted and
+-- anonymized, that can never be restored
+ALTER TABLE users ADD erased_at DATETIME2 NULL;
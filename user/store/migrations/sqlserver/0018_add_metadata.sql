@@ -0,0 +1,3 @@
+-- App-specific attributes as a JSON object of strings, filtered on with JSON_VALUE
+ALTER TABLE users ADD metadata NVARCHAR(MAX) NOT NULL CONSTRAINT df_users_metadata DEFAULT '{}'
+	CONSTRAINT ck_users_metadata CHECK (ISJSON(metadata) = 1);
@@ -0,0 +1,21 @@
+-- Groups of a tenant's users, e.g. teams or departments. Named user_groups as
+-- GROUP is a reserved word.
+CREATE TABLE user_groups (
+    id          BIGINT IDENTITY(1,1) PRIMARY KEY,
+    tenant_id   NVARCHAR(64)   NOT NULL CONSTRAINT df_user_groups_tenant_id DEFAULT '',
+    name        NVARCHAR(255)  NOT NULL,
+    description NVARCHAR(1000) NOT NULL CONSTRAINT df_user_groups_description DEFAULT '',
+    created_at  DATETIME2      NOT NULL CONSTRAINT df_user_groups_created_at DEFAULT SYSUTCDATETIME()
+);
+
+-- Group names are unique within a tenant
+CREATE UNIQUE INDEX ux_user_groups_tenant_name ON user_groups (tenant_id, name);
+
+-- Which users belong to which groups; either going away ends the membership
+CREATE TABLE group_members (
+    group_id   BIGINT    NOT NULL CONSTRAINT fk_group_members_group REFERENCES user_groups (id) ON DELETE CASCADE,
+    user_id    BIGINT    NOT NULL CONSTRAINT fk_group_members_user REFERENCES users (id) ON DELETE CASCADE,
+    created_at DATETIME2 NOT NULL CONSTRAINT df_group_members_created_at DEFAULT SYSUTCDATETIME(),
+    CONSTRAINT pk_group_members PRIMARY KEY (group_id, user_id)
+);
+CREATE INDEX ix_group_members_user ON group_members (user_id, group_id);
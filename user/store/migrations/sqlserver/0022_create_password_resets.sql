@@ -0,0 +1,13 @@
+-- One-time links from POST /auth/forgot-password. Only the SHA-256 of each
+-- token is stored; using one, or resetting the password, uses up the rest.
+CREATE TABLE password_resets (
+    id         BIGINT IDENTITY(1,1) CONSTRAINT pk_password_resets PRIMARY KEY,
+    user_id    BIGINT     NOT NULL CONSTRAINT fk_password_resets_user REFERENCES users (id) ON DELETE CASCADE,
+    token_hash BINARY(32) NOT NULL CONSTRAINT ux_password_resets_token_hash UNIQUE,
+    created_at DATETIME2  NOT NULL CONSTRAINT df_password_resets_created_at DEFAULT SYSUTCDATETIME(),
+    expires_at DATETIME2  NOT NULL,
+    used_at    DATETIME2  NULL
+);
+
+-- Counting a user's recent requests, to cap how many links they are sent
+CREATE INDEX ix_password_resets_user_id ON password_resets (user_id, created_at);
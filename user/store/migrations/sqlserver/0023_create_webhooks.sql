@@ -0,0 +1,27 @@
+-- Webhook endpoints registered through POST /webhooks, each receiving the
+-- user events it subscribed to. The secret signs payloads, so it is kept as is.
+CREATE TABLE webhooks (
+    id         BIGINT IDENTITY(1,1) CONSTRAINT pk_webhooks PRIMARY KEY,
+    tenant_id  NVARCHAR(64)   NOT NULL CONSTRAINT df_webhooks_tenant_id DEFAULT '',
+    url        NVARCHAR(2048) NOT NULL,
+    secret     NVARCHAR(255)  NOT NULL,
+    events     NVARCHAR(255)  NOT NULL, -- Space-separated event types
+    created_at DATETIME2      NOT NULL CONSTRAINT df_webhooks_created_at DEFAULT SYSUTCDATETIME()
+);
+CREATE INDEX ix_webhooks_tenant_id ON webhooks (tenant_id);
+
+-- Every attempt to deliver an event to a registered webhook, for GET
+-- /webhooks/{id}/deliveries
+CREATE TABLE webhook_deliveries (
+    id           BIGINT IDENTITY(1,1) CONSTRAINT pk_webhook_deliveries PRIMARY KEY,
+    webhook_id   BIGINT         NOT NULL CONSTRAINT fk_webhook_deliveries_webhook REFERENCES webhooks (id) ON DELETE CASCADE,
+    delivery_id  CHAR(32)       NOT NULL, -- Shared by the attempts of one delivery, sent as X-Delivery-ID
+    event_type   NVARCHAR(64)   NOT NULL,
+    user_id      BIGINT         NOT NULL,
+    attempt      INT            NOT NULL,
+    status_code  INT            NULL,
+    error        NVARCHAR(1000) NULL,
+    succeeded    BIT            NOT NULL,
+    attempted_at DATETIME2      NOT NULL CONSTRAINT df_webhook_deliveries_attempted_at DEFAULT SYSUTCDATETIME()
+);
+CREATE INDEX ix_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, id);
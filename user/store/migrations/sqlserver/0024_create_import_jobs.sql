@@ -0,0 +1,16 @@
+-- CSV imports through POST /users/import, whose progress is kept up to date
+-- while the upload streams in
+CREATE TABLE import_jobs (
+    id          BIGINT IDENTITY(1,1) CONSTRAINT pk_import_jobs PRIMARY KEY,
+    tenant_id   NVARCHAR(64)   NOT NULL CONSTRAINT df_import_jobs_tenant_id DEFAULT '',
+    status      NVARCHAR(16)   NOT NULL CONSTRAINT ck_import_jobs_status CHECK (status IN ('running', 'completed', 'failed')),
+    filename    NVARCHAR(255)  NOT NULL CONSTRAINT df_import_jobs_filename DEFAULT '',
+    rows_read   INT            NOT NULL CONSTRAINT df_import_jobs_rows_read DEFAULT 0,
+    created     INT            NOT NULL CONSTRAINT df_import_jobs_created DEFAULT 0,
+    failed      INT            NOT NULL CONSTRAINT df_import_jobs_failed DEFAULT 0,
+    error       NVARCHAR(1000) NULL,
+    created_at  DATETIME2      NOT NULL CONSTRAINT df_import_jobs_created_at DEFAULT SYSUTCDATETIME(),
+    updated_at  DATETIME2      NOT NULL CONSTRAINT df_import_jobs_updated_at DEFAULT SYSUTCDATETIME(),
+    finished_at DATETIME2      NULL
+);
+CREATE INDEX ix_import_jobs_tenant_id ON import_jobs (tenant_id, id);
@@ -0,0 +1,3 @@
+-- Resized variants of the profile picture as a JSON object of size in pixels to link
+ALTER TABLE users ADD thumbnails NVARCHAR(MAX) NOT NULL CONSTRAINT df_users_thumbnails DEFAULT '{}'
+	CONSTRAINT ck_users_thumbnails CHECK (ISJSON(thumbnails) = 1);
@@ -0,0 +1,17 @@
+-- Uploaded profile pictures by content, so a picture uploaded again is
+-- referenced instead of stored twice. ref_count counts the users pointing at
+-- it; the blobs are deleted along with the row when the last one lets go.
+CREATE TABLE pictures (
+    id             BIGINT IDENTITY(1,1) CONSTRAINT pk_pictures PRIMARY KEY,
+    tenant_id      NVARCHAR(64)   NOT NULL CONSTRAINT df_pictures_tenant_id DEFAULT '',
+    content_sha256 BINARY(32)     NOT NULL,
+    blob_name      NVARCHAR(512)  NOT NULL,
+    md5            NVARCHAR(24)   NOT NULL,
+    thumbnail_link NVARCHAR(2048) NOT NULL CONSTRAINT df_pictures_thumbnail_link DEFAULT '',
+    thumbnails     NVARCHAR(MAX)  NOT NULL CONSTRAINT df_pictures_thumbnails DEFAULT '{}'
+        CONSTRAINT ck_pictures_thumbnails CHECK (ISJSON(thumbnails) = 1),
+    ref_count      INT            NOT NULL CONSTRAINT ck_pictures_ref_count CHECK (ref_count > 0),
+    created_at     DATETIME2      NOT NULL CONSTRAINT df_pictures_created_at DEFAULT SYSUTCDATETIME()
+);
+CREATE UNIQUE INDEX ux_pictures_content ON pictures (tenant_id, content_sha256);
+CREATE UNIQUE INDEX ux_pictures_blob_name ON pictures (blob_name);
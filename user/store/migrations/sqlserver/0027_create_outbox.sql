@@ -0,0 +1,20 @@
+-- User events written in the same transaction as the change they describe,
+-- relayed to Service Bus by the outbox dispatcher. A row is deleted once sent;
+-- locked_until leases it to one dispatcher, and message_id stays the same across
+-- attempts so duplicate detection drops a resend.
+CREATE TABLE outbox_events (
+    id             BIGINT IDENTITY(1,1) CONSTRAINT pk_outbox_events PRIMARY KEY,
+    event_type     NVARCHAR(64)   NOT NULL,
+    schema_version NVARCHAR(16)   NOT NULL,
+    message_id     NVARCHAR(64)   NOT NULL,
+    user_id        BIGINT         NOT NULL,
+    tenant_id      NVARCHAR(64)   NOT NULL CONSTRAINT df_outbox_events_tenant_id DEFAULT '',
+    body           VARBINARY(MAX) NOT NULL,
+    trace_context  NVARCHAR(MAX)  NOT NULL CONSTRAINT df_outbox_events_trace_context DEFAULT '{}'
+        CONSTRAINT ck_outbox_events_trace_context CHECK (ISJSON(trace_context) = 1),
+    attempts       INT            NOT NULL CONSTRAINT df_outbox_events_attempts DEFAULT 0,
+    last_error     NVARCHAR(1024) NULL,
+    locked_until   DATETIME2      NULL,
+    created_at     DATETIME2      NOT NULL CONSTRAINT df_outbox_events_created_at DEFAULT SYSUTCDATETIME()
+);
+CREATE INDEX ix_outbox_events_locked_until ON outbox_events (locked_until);
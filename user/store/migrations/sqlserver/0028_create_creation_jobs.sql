@@ -0,0 +1,13 @@
+-- Users created in the background after POST /users with Prefer: respond-async,
+-- polled through GET /jobs/{id}. user_id is set once the job succeeds.
+CREATE TABLE creation_jobs (
+    id          BIGINT IDENTITY(1,1) CONSTRAINT pk_creation_jobs PRIMARY KEY,
+    tenant_id   NVARCHAR(64)   NOT NULL CONSTRAINT df_creation_jobs_tenant_id DEFAULT '',
+    status      NVARCHAR(16)   NOT NULL CONSTRAINT ck_creation_jobs_status CHECK (status IN ('pending', 'running', 'succeeded', 'failed')),
+    user_id     BIGINT         NULL,
+    error       NVARCHAR(1000) NULL,
+    created_at  DATETIME2      NOT NULL CONSTRAINT df_creation_jobs_created_at DEFAULT SYSUTCDATETIME(),
+    updated_at  DATETIME2      NOT NULL CONSTRAINT df_creation_jobs_updated_at DEFAULT SYSUTCDATETIME(),
+    finished_at DATETIME2      NULL
+);
+CREATE INDEX ix_creation_jobs_tenant_id ON creation_jobs (tenant_id, id);
@@ -0,0 +1,9 @@
+-- Requests counted per client and fixed window across every instance, for
+-- rate_limit.distributed. rate_key is a hash of the route and the client.
+CREATE TABLE rate_limit_windows (
+    rate_key     NVARCHAR(64) NOT NULL,
+    window_start DATETIME2    NOT NULL,
+    requests     INT          NOT NULL,
+    CONSTRAINT pk_rate_limit_windows PRIMARY KEY (rate_key, window_start)
+);
+CREATE INDEX ix_rate_limit_windows_window_start ON rate_limit_windows (window_start);
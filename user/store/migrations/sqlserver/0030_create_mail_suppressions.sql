@@ -0,0 +1,7 @@
+-- Addresses the mail.notifications emails are no longer sent to, added through
+-- PUT /admin/mail/suppressions/{email}. email is stored lower case.
+CREATE TABLE mail_suppressions (
+    email      NVARCHAR(320) NOT NULL CONSTRAINT pk_mail_suppressions PRIMARY KEY,
+    reason     NVARCHAR(255) NOT NULL CONSTRAINT df_mail_suppressions_reason DEFAULT '',
+    created_at DATETIME2     NOT NULL CONSTRAINT df_mail_suppressions_created_at DEFAULT SYSUTCDATETIME()
+);
@@ -0,0 +1,11 @@
+-- The latest run of each scheduled job, claimed by one instance of the
+-- scheduler. locked_until holds off the others while the run goes on, and is
+-- cleared once it finishes.
+CREATE TABLE job_runs (
+    job_name     NVARCHAR(64) NOT NULL CONSTRAINT pk_job_runs PRIMARY KEY,
+    scheduled_at DATETIME2    NOT NULL,
+    owner        NVARCHAR(64) NOT NULL,
+    locked_until DATETIME2    NULL,
+    started_at   DATETIME2    NOT NULL CONSTRAINT df_job_runs_started_at DEFAULT SYSUTCDATETIME(),
+    finished_at  DATETIME2    NULL
+);
@@ -0,0 +1,14 @@
+-- Each user's timeline of significant actions, for support: created, logged
+-- in, changed email or picture. Unlike audit_events it holds no snapshots, so
+-- erasing a user leaves it as is. Rows outlive the users they describe, so
+-- there is no foreign key.
+CREATE TABLE user_activities (
+    id         BIGINT IDENTITY(1,1) PRIMARY KEY,
+    tenant_id  NVARCHAR(64)  NOT NULL,
+    user_id    BIGINT        NOT NULL,
+    type       NVARCHAR(32)  NOT NULL,
+    actor      NVARCHAR(255) NOT NULL,
+    request_id NVARCHAR(255) NULL,
+    created_at DATETIME2     NOT NULL CONSTRAINT df_user_activities_created_at DEFAULT SYSUTCDATETIME()
+);
+CREATE INDEX ix_user_activities_user ON user_activities (tenant_id, user_id, id);
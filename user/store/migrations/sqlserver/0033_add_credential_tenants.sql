@@ -0,0 +1,5 @@
+-- The tenant each session and managed API key is bound to, so their callers
+-- can't pick another with the tenant header. Empty for those started with
+-- tenancy disabled.
+ALTER TABLE sessions ADD tenant_id NVARCHAR(64) NOT NULL CONSTRAINT df_sessions_tenant_id DEFAULT '';
+ALTER TABLE api_keys ADD tenant_id NVARCHAR(64) NOT NULL CONSTRAINT df_api_keys_tenant_id DEFAULT '';
@@ -0,0 +1,258 @@
+package store
+
+import (
+	"encoding/xml"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Activity is one significant action on a user's timeline
+type Activity struct {
+	ID        int64     `json:"id"`
+	TenantID  string    `json:"tenantId,omitempty"`
+	UserID    int64     `json:"userId"`
+	Type      string    `json:"type"`
+	Actor     string    `json:"actor"` // As in the audit log: JWT subject, api-key:<id>, api-key, admin-api-key, anonymous or system
+	RequestID string    `json:"requestId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// APIKey is a managed key minted through /admin/api-keys
+type APIKey struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"` // Leading characters of the key, to tell keys apart
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt"`
+	Tenant    string     `json:"tenant,omitempty"` // The only tenant the key works in, with tenancy enabled
+}
+
+// AuditEvent records one change to a user
+type AuditEvent struct {
+	ID        int64                  `json:"id"`
+	TenantID  string                 `json:"tenantId,omitempty"`
+	Actor     string                 `json:"actor"` // JWT subject, api-key:<id>, api-key, admin-api-key, anonymous or system
+	Action    string                 `json:"action"`
+	UserID    int64                  `json:"userId"`
+	Before    *User                  `json:"before"` // Null for creates, restores and erasures
+	After     *User                  `json:"after"`  // Null for hard deletes and purges
+	Changes   map[string]FieldChange `json:"changes,omitempty"`
+	RequestID string                 `json:"requestId,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+}
+
+// FieldChange is a user field's value before and after a change
+type FieldChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// AuditFilter selects audit events; zero fields match everything
+type AuditFilter struct {
+	TenantID string
+	UserID   int64
+	Actor    string
+	Action   string
+	Since    time.Time // At or after
+	Until    time.Time // Before
+}
+
+// Result for one row of a bulk import
+type BulkResult struct {
+	Index int    `json:"index"`
+	ID    int64  `json:"id,omitempty"`
+	Error string `json:"error,omitempty"` // Why the row failed, in the request's language
+	Code  string `json:"code,omitempty"`  // Machine-readable cause of the error, as in problems, e.g. email_taken
+	// Why the row failed: its validation error, ErrDuplicateEmail, or the
+	// error inserting it; described by Error and Code when the results are written
+	Err error `json:"-"`
+}
+
+// Failed reports whether the row was rejected, in validation or insertion
+func (b BulkResult) Failed() bool {
+	return b.Err != nil
+}
+
+// Name given to users whose personal data was erased
+const erasedName = "Erased user"
+
+// erasedEmail is the placeholder email of an erased user, unique so the tombstone
+// never collides with a real account
+func erasedEmail(id int64) string {
+	return "erased-" + strconv.FormatInt(id, 10) + "@erased.invalid"
+}
+
+// NormalizeEmail puts an address in the form used for comparisons
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Group is a named set of a tenant's users, such as a team or department
+type Group struct {
+	ID          int64     `json:"id"`
+	TenantID    string    `json:"tenantId,omitempty"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// IdempotentResponse is the stored response to a request made with an Idempotency-Key
+type IdempotentResponse struct {
+	Status int
+	Header http.Header // Only replayedHeaders
+	Body   []byte
+}
+
+// Import job statuses
+const (
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+)
+
+// ImportJob tracks a CSV import, updated as its rows go in
+type ImportJob struct {
+	ID         int64      `json:"id"`
+	TenantID   string     `json:"tenantId,omitempty"`
+	Status     string     `json:"status"` // running, completed or failed
+	Filename   string     `json:"filename,omitempty"`
+	Rows       int        `json:"rows"` // Data rows read so far
+	Created    int        `json:"created"`
+	Failed     int        `json:"failed"`
+	Error      string     `json:"error,omitempty"` // Why a failed job stopped early
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+}
+
+// Creation job statuses
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// CreationJob tracks a user created in the background, after POST /users with
+// Prefer: respond-async
+type CreationJob struct {
+	ID         int64      `json:"id"`
+	TenantID   string     `json:"tenantId,omitempty"`
+	Status     string     `json:"status"`          // pending, running, succeeded or failed
+	UserID     *int64     `json:"userId"`          // The user created, once the job succeeded
+	Error      string     `json:"error,omitempty"` // Why a failed job failed
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+}
+
+// AuthFailureCounts are the failed attempts recorded within the lockout window
+type AuthFailureCounts struct {
+	User int // Against the account; 0 when the attempt wasn't for a known account
+	IP   int // From the source IP
+}
+
+// UserMetadata holds attributes consuming apps attach to a user, which this
+// service stores but doesn't interpret
+type UserMetadata map[string]string
+
+// MarshalXML renders the metadata as <entry key="..."> children in key order,
+// as encoding/xml can't render maps
+func (m UserMetadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type entry struct {
+		Key   string `xml:"key,attr"`
+		Value string `xml:",chardata"`
+	}
+	entries := struct {
+		Entries []entry `xml:"entry"`
+	}{}
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		entries.Entries = append(entries.Entries, entry{key, m[key]})
+	}
+	return e.EncodeElement(entries, start)
+}
+
+// MailSuppression is an address notification emails are no longer sent to,
+// such as one that bounced or asked to stop them
+type MailSuppression struct {
+	Email     string    `json:"email"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Session is a login started through /auth/login
+type Session struct {
+	ID               int64
+	Subject          string
+	Email            string
+	Admin            bool
+	ExpiresAt        time.Time  // When the current refresh token stops working
+	UserID           int64      // The user signing in, when one matches; 0 otherwise
+	Tenant           string     // Tenant logged into, the only one the session's tokens work in
+	TwoFactorPending bool       // The user has two-factor enabled and no code was verified yet
+	TwoFactorAt      *time.Time // When a two-factor code was last verified
+}
+
+// ThumbnailLinks maps the longest side of each thumbnail variant of a picture,
+// in pixels, to its link
+type ThumbnailLinks map[string]string
+
+// MarshalXML renders the links as <entry key="..."> children, like metadata
+func (t ThumbnailLinks) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return UserMetadata(t).MarshalXML(e, start)
+}
+
+// TOTPSecret is a user's authenticator app secret
+type TOTPSecret struct {
+	Secret    []byte
+	EnabledAt *time.Time // Nil until the first code is confirmed
+}
+
+// User struct for the API
+type User struct {
+	ID              int64          `json:"id" xml:"id"`
+	Name            string         `json:"name" xml:"name"`
+	Email           string         `json:"email" xml:"email"`
+	Link            string         `json:"link" xml:"link"`
+	ThumbnailLink   string         `json:"thumbnailLink,omitempty" xml:"thumbnailLink,omitempty"`
+	Thumbnails      ThumbnailLinks `json:"thumbnails,omitempty" xml:"thumbnails,omitempty"` // Smaller variants of the thumbnail by their size in pixels, for avatars
+	CreatedAt       time.Time      `json:"createdAt" xml:"createdAt"`
+	TenantID        string         `json:"tenantId,omitempty" xml:"tenantId,omitempty"`
+	DeletedAt       *time.Time     `json:"deletedAt,omitempty" xml:"deletedAt,omitempty"`
+	UpdatedAt       time.Time      `json:"updatedAt" xml:"updatedAt"`
+	Version         int64          `json:"version" xml:"version"`                 // Changes on every write; send it back to update the user
+	LastLoginAt     *time.Time     `json:"lastLoginAt" xml:"lastLoginAt"`         // Null until the user first logs in
+	Roles           []string       `json:"roles" xml:"roles>role"`                // Empty for a regular user; see roleAdmin
+	LockedAt        *time.Time     `json:"lockedAt" xml:"lockedAt"`               // Null unless locked out after repeated failed sign-ins
+	Metadata        UserMetadata   `json:"metadata" xml:"metadata"`               // App-specific attributes; empty unless set
+	EmailVerifiedAt *time.Time     `json:"emailVerifiedAt" xml:"emailVerifiedAt"` // Null until the user verifies their email
+}
+
+// Webhook is an endpoint registered through the API to receive a tenant's user events
+type Webhook struct {
+	ID        int64     `json:"id"`
+	TenantID  string    `json:"tenantId,omitempty"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"` // Only returned when the webhook is created
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WebhookAttempt is one try at delivering an event to a registered webhook
+type WebhookAttempt struct {
+	ID          int64     `json:"id"`
+	WebhookID   int64     `json:"webhookId"`
+	DeliveryID  string    `json:"deliveryId"` // Shared by the attempts of one delivery
+	EventType   string    `json:"eventType"`
+	UserID      int64     `json:"userId"`
+	Attempt     int       `json:"attempt"`
+	StatusCode  int       `json:"statusCode,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Succeeded   bool      `json:"succeeded"`
+	AttemptedAt time.Time `json:"attemptedAt"`
+}
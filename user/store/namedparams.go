@@ -0,0 +1,255 @@
+package store
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"user/user/config"
+)
+
+// namedParamConnector connects through a driver that only takes positional
+// parameters, lib/pq's $1 or MySQL's ?, rewriting the @name parameters each
+// store query is written with for it
+type namedParamConnector struct {
+	driver.Connector
+	d *Dialect
+}
+
+func (c namedParamConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &namedParamConn{Conn: conn, d: c.d}, nil
+}
+
+// namedParamConn is a connection whose queries are rewritten as they are run
+// or prepared. Queries run without arguments, like migrations, go as they are.
+type namedParamConn struct {
+	driver.Conn
+	d *Dialect
+}
+
+func (c *namedParamConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *namedParamConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	query, names := c.d.positional(query)
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &namedParamStmt{Stmt: stmt, names: names}, nil
+}
+
+func (c *namedParamConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if len(args) == 0 {
+		return execer.ExecContext(ctx, query, nil)
+	}
+	query, names := c.d.positional(query)
+	args, err := bindNamed(names, args)
+	if err != nil {
+		return nil, err
+	}
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *namedParamConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if len(args) == 0 {
+		return queryer.QueryContext(ctx, query, nil)
+	}
+	query, names := c.d.positional(query)
+	args, err := bindNamed(names, args)
+	if err != nil {
+		return nil, err
+	}
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (c *namedParamConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *namedParamConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *namedParamConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *namedParamConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue lets the driver convert arguments as it would unwrapped;
+// names are checked by database/sql and dropped by bindNamed
+func (c *namedParamConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// namedParamStmt is a statement prepared with its parameters rewritten, binding
+// the named arguments it is run with to them
+type namedParamStmt struct {
+	driver.Stmt
+	names []string // Of the positional parameters, in order
+}
+
+// NumInput is unknown, as the arguments are named
+func (s *namedParamStmt) NumInput() int {
+	return -1
+}
+
+func (s *namedParamStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	args, err := bindNamed(s.names, args)
+	if err != nil {
+		return nil, err
+	}
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return execer.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(namedValues(args))
+}
+
+func (s *namedParamStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	args, err := bindNamed(s.names, args)
+	if err != nil {
+		return nil, err
+	}
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return queryer.QueryContext(ctx, args)
+	}
+	return s.Stmt.Query(namedValues(args))
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+// positional rewrites the @name parameters of query into the dialect's
+// positional ones, and returns the names of those in order. PostgreSQL's $n
+// refers to a name used twice again, MySQL's ? is repeated. String literals,
+// quoted identifiers, comments and @@ variables are left as they are.
+func (d *Dialect) positional(query string) (string, []string) {
+	if d.driver == config.DatabaseDriverSQLServer || !strings.Contains(query, "@") {
+		return query, nil
+	}
+	var out strings.Builder
+	var names []string
+	numbers := map[string]int{} // $n of each name, for PostgreSQL
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			// Doubled quotes inside close and reopen, which comes to the same
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				out.WriteString(query[i:])
+				return out.String(), names
+			}
+			out.WriteString(query[i : i+end+2])
+			i += end + 2
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				out.WriteString(query[i:])
+				return out.String(), names
+			}
+			out.WriteString(query[i : i+end])
+			i += end
+		case c == '@' && strings.HasPrefix(query[i:], "@@"):
+			out.WriteString("@@")
+			i += 2
+		case c == '@' && i+1 < len(query) && isParamNameStart(query[i+1]):
+			end := i + 1
+			for end < len(query) && isParamNameChar(query[end]) {
+				end++
+			}
+			name := query[i+1 : end]
+			if d.driver == config.DatabaseDriverPostgres {
+				n, ok := numbers[name]
+				if !ok {
+					names = append(names, name)
+					n = len(names)
+					numbers[name] = n
+				}
+				out.WriteString("$" + strconv.Itoa(n))
+			} else {
+				names = append(names, name)
+				out.WriteByte('?')
+			}
+			i = end
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String(), names
+}
+
+func isParamNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isParamNameChar(c byte) bool {
+	return isParamNameStart(c) || '0' <= c && c <= '9'
+}
+
+// bindNamed orders the named arguments of a query as its positional
+// parameters, named by names. Arguments of a query without named parameters
+// pass as they are.
+func bindNamed(names []string, args []driver.NamedValue) ([]driver.NamedValue, error) {
+	if len(names) == 0 {
+		return args, nil
+	}
+	byName := make(map[string]driver.Value, len(args))
+	for _, arg := range args {
+		byName[arg.Name] = arg.Value
+	}
+	bound := make([]driver.NamedValue, len(names))
+	for i, name := range names {
+		value, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("no argument for parameter @%s", name)
+		}
+		bound[i] = driver.NamedValue{Ordinal: i + 1, Value: value}
+	}
+	return bound, nil
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"testing"
+
+	"user/user/config"
+)
+
+func TestPositional(t *testing.T) {
+	const query = "SELECT @a, @b, @a FROM t WHERE x = '@c' AND \"@d\" = 1 -- @e\n AND @@ROWCOUNT > @b1"
+	tests := []struct {
+		name   string
+		driver string
+		query  string
+		names  []string
+	}{
+		{
+			name:   "sqlserver",
+			driver: config.DatabaseDriverSQLServer,
+			query:  query,
+		},
+		{
+			name:   "postgres",
+			driver: config.DatabaseDriverPostgres,
+			query:  "SELECT $1, $2, $1 FROM t WHERE x = '@c' AND \"@d\" = 1 -- @e\n AND @@ROWCOUNT > $3",
+			names:  []string{"a", "b", "b1"},
+		},
+		{
+			name:   "mysql",
+			driver: config.DatabaseDriverMySQL,
+			query:  "SELECT ?, ?, ? FROM t WHERE x = '@c' AND \"@d\" = 1 -- @e\n AND @@ROWCOUNT > ?",
+			names:  []string{"a", "b", "a", "b1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, names := DialectFor(tt.driver).positional(query)
+			if query != tt.query {
+				t.Errorf("query = %q, want %q", query, tt.query)
+			}
+			if !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("names = %q, want %q", names, tt.names)
+			}
+		})
+	}
+}
+
+func TestBindNamed(t *testing.T) {
+	args := []driver.NamedValue{{Name: "a", Ordinal: 1, Value: "x"}, {Name: "b", Ordinal: 2, Value: int64(2)}}
+	tests := []struct {
+		name  string
+		names []string
+		want  []driver.NamedValue
+		err   bool
+	}{
+		{name: "no parameters", want: args},
+		{
+			name:  "repeated",
+			names: []string{"b", "a", "b"},
+			want:  []driver.NamedValue{{Ordinal: 1, Value: int64(2)}, {Ordinal: 2, Value: "x"}, {Ordinal: 3, Value: int64(2)}},
+		},
+		{name: "missing", names: []string{"a", "c"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bound, err := bindNamed(tt.names, args)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(bound, tt.want) {
+				t.Errorf("bound = %v, want %v", bound, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"user/user/events"
+	"user/user/telemetry"
+)
+
+type contextKey string
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+const outboxEventKey contextKey = "outboxEvent"
+
+// WithOutboxEvent marks ctx so the user change the store makes with it also
+// writes an event of this type to the outbox, in the same transaction. The
+// event is then published if and only if the change commits.
+func WithOutboxEvent(ctx context.Context, eventType string) context.Context {
+	return context.WithValue(ctx, outboxEventKey, eventType)
+}
+
+// outboxEventType returns the event type ctx was marked with, if any
+func outboxEventType(ctx context.Context) string {
+	eventType, _ := ctx.Value(outboxEventKey).(string)
+	return eventType
+}
+
+// newOutboxEvent builds the event about user, carrying the trace of ctx so the
+// publish is part of the request that made the change
+func newOutboxEvent(ctx context.Context, eventType string, user User) (events.OutboxEvent, error) {
+	body, err := json.Marshal(user)
+	if err != nil {
+		return events.OutboxEvent{}, fmt.Errorf("failed to marshal user data: %v", err)
+	}
+	event := events.OutboxEvent{
+		EventType:     eventType,
+		SchemaVersion: events.SchemaVersion,
+		MessageID:     newRequestID(),
+		UserID:        user.ID,
+		TenantID:      user.TenantID,
+		Body:          body,
+		TraceContext:  map[string]any{},
+		CreatedAt:     time.Now(),
+	}
+	telemetry.InjectTraceContext(ctx, event.TraceContext)
+	return event, nil
+}
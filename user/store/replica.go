@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"user/user/config"
+)
+
+const replicaReadsKey contextKey = "replicaReads"
+
+// withReplicaReads marks ctx so the reads the store makes with it may be
+// served by the read replica, for handlers that can live with its lag
+func withReplicaReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replicaReadsKey, true)
+}
+
+// replicaReadsAllowed reports whether ctx was marked with withReplicaReads
+func replicaReadsAllowed(ctx context.Context) bool {
+	allowed, _ := ctx.Value(replicaReadsKey).(bool)
+	return allowed
+}
+
+// ReadFromReplica lets the requests h serves read from the replica
+func ReadFromReplica(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(withReplicaReads(r.Context())))
+	})
+}
+
+// ReadReplica is the pool of database.replica_connection_string, a read-only
+// copy of the primary such as a geo-replica or the readable secondary of a
+// Business Critical database. It is only used while healthy: pings every check
+// interval decide that, and a failed read marks it unhealthy until the next
+// ping succeeds. Connections to it go around the sql breaker and retries, so a
+// replica outage costs the primary nothing; reads fall back to it instead.
+type ReadReplica struct {
+	db      *sql.DB
+	stmts   *statements
+	Healthy atomic.Bool
+}
+
+// OpenReplica opens the replica's pool with the primary's pool settings, or
+// returns nil when there is no replica. A replica that is down is only logged:
+// reads go to the primary until it comes up.
+func OpenReplica(cfg config.Config) (*ReadReplica, error) {
+	if cfg.Database.ReplicaConnectionString == "" {
+		return nil, nil
+	}
+	connector, err := NewDBConnector(cfg, cfg.Database.ReplicaConnectionString)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.Database.ConnMaxLifetimeMinutes) * time.Minute)
+	r := &ReadReplica{db: db, stmts: newStatements(db)}
+	r.check(context.Background())
+	if r.Healthy.Load() {
+		slog.Info("Successfully connected to the read replica")
+	}
+	return r, nil
+}
+
+// check pings the replica and records whether it answered
+func (r *ReadReplica) check(ctx context.Context) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	r.setHealthy(r.db.PingContext(ctx))
+}
+
+// setHealthy records the replica as healthy when err is nil, logging changes
+func (r *ReadReplica) setHealthy(err error) {
+	healthy := err == nil
+	if r.Healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		slog.Info("Read replica is healthy again; reads go to it")
+	} else {
+		slog.Warn("Read replica is unhealthy; reads go to the primary", "error", err)
+	}
+}
+
+// Monitor checks the replica every interval until ctx is done
+func (r *ReadReplica) Monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.check(ctx)
+		}
+	}
+}
+
+func (r *ReadReplica) Close() error {
+	return r.db.Close()
+}
+
+// readOn runs read against the replica when ctx allows it and the replica is
+// healthy, otherwise against the primary. A read the replica fails is run again
+// on the primary; not finding a user isn't a failure.
+func readOn(ctx context.Context, replica *ReadReplica, primary *sql.DB, primaryStmts *statements, read func(db *sql.DB, stmts *statements) error) error {
+	if replica == nil || !replicaReadsAllowed(ctx) || !replica.Healthy.Load() {
+		return read(primary, primaryStmts)
+	}
+	err := read(replica.db, replica.stmts)
+	if err == nil || errors.Is(err, ErrUserNotFound) || ctx.Err() != nil {
+		return err
+	}
+	replica.setHealthy(err)
+	return read(primary, primaryStmts)
+}
@@ -0,0 +1,434 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"user/user/events"
+)
+
+// Errors returned by a UserStore
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrDuplicateEmail  = errors.New("email already exists")
+	ErrStaleVersion    = errors.New("user was modified concurrently")
+	ErrAPIKeyNotFound  = errors.New("api key not found")
+	ErrNoSession       = errors.New("session not found, expired or revoked")
+	ErrNoTOTP          = errors.New("two-factor authentication not enrolled")
+	ErrTOTPEnabled     = errors.New("two-factor authentication already enabled")
+	ErrInvalidCode     = errors.New("two-factor code is invalid or already used")
+	ErrGroupNotFound   = errors.New("group not found")
+	ErrDuplicateGroup  = errors.New("group name already exists")
+	ErrNoPassword      = errors.New("no password set")
+	ErrInvalidReset    = errors.New("password reset token is invalid, expired or used")
+	ErrWebhookNotFound = errors.New("webhook not found")
+	ErrImportNotFound  = errors.New("import job not found")
+	ErrJobNotFound     = errors.New("creation job not found")
+	ErrPictureNotFound = errors.New("picture not found")
+	ErrNotSuppressed   = errors.New("email is not suppressed")
+
+	ErrIdempotencyKeyInUse = errors.New("idempotency key is held by a request still running")
+)
+
+// UserChanges lists the fields to update; nil fields are left unchanged. A non-zero
+// Version makes the update conditional on the user still being at that version.
+type UserChanges struct {
+	Version       int64
+	Name          *string
+	Email         *string
+	Link          *string
+	ThumbnailLink *string
+	Thumbnails    *ThumbnailLinks // Replaces all the variants
+	Roles         *[]string
+	Metadata      *UserMetadata // Replaces the whole metadata
+}
+
+// UserFilter narrows the users a list, count or export covers
+type UserFilter struct {
+	Search         string            // Case-insensitive substring of the name or email
+	Email          string            // Exact email, compared case-insensitively
+	ActiveSince    time.Time         // Only users who logged in at or after this time, unless zero
+	CreatedAfter   time.Time         // Only users created after this time, unless zero
+	Metadata       map[string]string // Only users whose metadata has each of these values
+	IncludeDeleted bool
+	Fields         []string // JSON names of the fields ListUsers and ListUsersAfter need, leaving the rest zero; empty reads them all
+}
+
+// Fields a listing can be sorted by
+const (
+	SortByID        = "id"
+	SortByName      = "name"
+	SortByCreatedAt = "createdAt"
+)
+
+// UserSort orders a listing. Ties are broken by ID in the same direction, so the
+// order is total and keyset pages don't skip or repeat users.
+type UserSort struct {
+	Field      string // One of the sortBy constants; empty sorts by ID
+	Descending bool
+}
+
+// Search relevance ranks, best first
+const (
+	searchRankExact     = 0 // Name or email equals the query
+	searchRankPrefix    = 1 // Name or email starts with it
+	searchRankSubstring = 2 // Name or email contains it
+)
+
+// SearchHit is a user matched by a search, with how closely it matched
+type SearchHit struct {
+	User
+	Rank int
+}
+
+// UserStore is the persistence layer the handlers depend on. All users are
+// scoped to a tenant, and only live (not soft-deleted) users are visible unless
+// a filter includes deleted ones.
+type UserStore interface {
+	// ListUsers returns every user of the tenant matching filter, in sort order
+	ListUsers(ctx context.Context, tenant string, filter UserFilter, sort UserSort) ([]User, error)
+	// ListUsersAfter returns up to limit matching users that follow after in sort
+	// order. Only after's ID and sort field are used; a zero ID starts at the beginning.
+	ListUsersAfter(ctx context.Context, tenant string, after User, limit int, filter UserFilter, sort UserSort) ([]User, error)
+	// SearchUsers returns up to limit live users whose name or email contains query,
+	// ordered by rank and then ID, that follow after in that order. A zero after.ID
+	// starts at the best match.
+	SearchUsers(ctx context.Context, tenant, query string, after SearchHit, limit int) ([]SearchHit, error)
+	// CountUsers returns how many users of the tenant match filter
+	CountUsers(ctx context.Context, tenant string, filter UserFilter) (int64, error)
+	// ExportUsers calls fn for every matching user of the tenant, in ID order,
+	// without loading them all at once. Iteration stops at the first error fn returns.
+	ExportUsers(ctx context.Context, tenant string, filter UserFilter, fn func(User) error) error
+	// GetUser returns a live user, or ErrUserNotFound
+	GetUser(ctx context.Context, tenant string, id int64) (User, error)
+	// GetUserByEmail returns the live user with this email, compared
+	// case-insensitively, or ErrUserNotFound
+	GetUserByEmail(ctx context.Context, tenant, email string) (User, error)
+	// GetUserByIdentity returns the live user linked to a social login, or ErrUserNotFound
+	GetUserByIdentity(ctx context.Context, provider, subject string) (User, error)
+	// LinkIdentity links a social login to a user; linking it again is a no-op
+	LinkIdentity(ctx context.Context, userID int64, provider, subject string) error
+	// ExistingEmails reports which of the normalized emails belong to live users
+	ExistingEmails(ctx context.Context, tenant string, emails []string) (map[string]bool, error)
+	// ReferencedLinks reports which of the picture or thumbnail links any user row,
+	// in any tenant and deleted or not, still points at
+	ReferencedLinks(ctx context.Context, links []string) (map[string]bool, error)
+
+	// CreateUser inserts a user and returns it with its generated fields. If ctx
+	// is marked with WithOutboxEvent, the event is written to the outbox in the
+	// same transaction, as it is by UpdateUser, DeleteUser, ErasePersonalData and
+	// LockUser.
+	CreateUser(ctx context.Context, user User) (User, error)
+	// BulkCreateUsers inserts users into the tenant in one transaction, recording
+	// each row's ID or error in results. Rows whose result already carries an error
+	// are skipped. With atomic set nothing is committed if any row failed. Each
+	// row created gets its outbox event, as with CreateUser.
+	BulkCreateUsers(ctx context.Context, tenant string, users []User, results []BulkResult, atomic bool) error
+	// UpdateUser applies changes to a live user and returns the updated user,
+	// ErrUserNotFound, ErrDuplicateEmail, or ErrStaleVersion if its version moved on
+	UpdateUser(ctx context.Context, tenant string, id int64, changes UserChanges) (User, error)
+	// TouchUser records a login of a live user now, returning the time stored
+	TouchUser(ctx context.Context, tenant string, id int64) (time.Time, error)
+	// UpsertUser creates a user or updates the live user with the same tenant and email
+	UpsertUser(ctx context.Context, user User) error
+	// UpsertUserByEmail creates user, or updates the name of the live user of its
+	// tenant with its email, compared case-insensitively, and their picture and
+	// metadata if user has them, in one atomic statement. created reports which it
+	// did, and the outbox event, as with CreateUser, is user.created or user.updated
+	// accordingly, whichever type ctx is marked with.
+	UpsertUserByEmail(ctx context.Context, user User) (saved User, created bool, err error)
+	// DeleteUser soft-deletes a live user, or removes the row entirely when hard is set
+	DeleteUser(ctx context.Context, tenant string, id int64, hard bool) error
+	// ErasePersonalData irreversibly anonymizes a user, live or soft-deleted, and
+	// leaves the row as a tombstone that can't be restored. Their sign-in
+	// identities, sessions, two-factor secrets and failed attempts go too, and
+	// their audit history is scrubbed of what identified them. Returns the user as
+	// it was and as it is now, or ErrUserNotFound if none matches or it is already erased.
+	ErasePersonalData(ctx context.Context, tenant string, id int64) (before, after User, err error)
+	// PurgeDeletedUsers removes up to limit users of any tenant soft-deleted
+	// before cutoff and returns them
+	PurgeDeletedUsers(ctx context.Context, cutoff time.Time, limit int) ([]User, error)
+	// ListInactiveUsers returns up to limit live users of any tenant, in ID order
+	// after afterID, who last logged in before cutoff, or never did and were
+	// created before it
+	ListInactiveUsers(ctx context.Context, cutoff time.Time, afterID int64, limit int) ([]User, error)
+	// RestoreUser clears a soft delete and returns the user, ErrUserNotFound if no
+	// deleted user matches, or ErrDuplicateEmail if the email was taken since
+	RestoreUser(ctx context.Context, tenant string, id int64) (User, error)
+	// VerifyEmail marks the live user's email verified, provided it still is
+	// email, or returns ErrUserNotFound. Verifying again keeps the first time.
+	VerifyEmail(ctx context.Context, tenant string, id int64, email string) (User, error)
+	// LockUser locks a live, unlocked user out and revokes their sessions, or
+	// returns ErrUserNotFound
+	LockUser(ctx context.Context, id int64) (User, error)
+	// UnlockUser unlocks a live, locked user and forgets their failed attempts, or
+	// returns ErrUserNotFound
+	UnlockUser(ctx context.Context, tenant string, id int64) (User, error)
+}
+
+// AuthFailureStore records failed authentication attempts
+type AuthFailureStore interface {
+	// RecordAuthFailure records a failure from ip, against userID unless it is 0,
+	// and counts those recorded since then, this one included
+	RecordAuthFailure(ctx context.Context, userID int64, ip string, since time.Time) (AuthFailureCounts, error)
+}
+
+// RateLimitStore counts requests across every instance, for rate_limit.distributed
+type RateLimitStore interface {
+	// CountRequest counts a request against key in the window starting at
+	// window and returns the window's count, this one included
+	CountRequest(ctx context.Context, key string, window time.Time) (int, error)
+}
+
+// AuditStore persists the audit log of changes to users
+type AuditStore interface {
+	// RecordAuditEvents stores events, filling in none of their fields
+	RecordAuditEvents(ctx context.Context, events []AuditEvent) error
+	// ListAuditEvents returns up to limit events matching filter, newest first,
+	// that are older than the event beforeID; a zero beforeID starts at the newest
+	ListAuditEvents(ctx context.Context, filter AuditFilter, beforeID int64, limit int) ([]AuditEvent, error)
+	// CountAuditEvents returns how many events match filter
+	CountAuditEvents(ctx context.Context, filter AuditFilter) (int64, error)
+	// PurgeAuditEvents removes up to limit events of any tenant recorded before
+	// cutoff, oldest first, and returns how many it removed
+	PurgeAuditEvents(ctx context.Context, cutoff time.Time, limit int) (int64, error)
+}
+
+// ActivityStore persists each user's timeline of significant actions
+type ActivityStore interface {
+	// RecordActivities stores activities, filling in none of their fields
+	RecordActivities(ctx context.Context, activities []Activity) error
+	// ListActivities returns up to limit activities of the tenant's user, newest
+	// first, that are older than the activity beforeID; a zero beforeID starts at
+	// the newest
+	ListActivities(ctx context.Context, tenant string, userID, beforeID int64, limit int) ([]Activity, error)
+}
+
+// IdempotencyStore keeps the responses to requests made with an Idempotency-Key,
+// by the hash of the key
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey claims an unused key for a request about to run,
+	// holding it until leaseUntil, and returns nil. For a key already used it
+	// returns the stored response instead, or ErrIdempotencyKeyInUse while the
+	// request holding it is still running.
+	ReserveIdempotencyKey(ctx context.Context, keyHash []byte, leaseUntil time.Time) (*IdempotentResponse, error)
+	// CompleteIdempotencyKey stores the response to the request holding a key,
+	// to be replayed until expiresAt
+	CompleteIdempotencyKey(ctx context.Context, keyHash []byte, response IdempotentResponse, expiresAt time.Time) error
+	// ReleaseIdempotencyKey frees a reserved key whose request is not to be
+	// replayed, so it may be retried
+	ReleaseIdempotencyKey(ctx context.Context, keyHash []byte) error
+}
+
+// GroupStore persists groups of users and their members, both scoped to a tenant
+type GroupStore interface {
+	// CreateGroup stores a group and returns it with its generated fields, or
+	// returns ErrDuplicateGroup
+	CreateGroup(ctx context.Context, group Group) (Group, error)
+	// AddGroupMember adds a user to a group of the same tenant; adding a member
+	// again changes nothing. Returns ErrGroupNotFound, or ErrUserNotFound for
+	// users that don't exist or are deleted.
+	AddGroupMember(ctx context.Context, tenant string, groupID, userID int64) error
+	// ListUserGroups returns the groups the user belongs to, in ID order
+	ListUserGroups(ctx context.Context, tenant string, userID int64) ([]Group, error)
+}
+
+// WebhookStore persists the webhooks registered for a tenant's user events and
+// the log of attempts to deliver to them
+type WebhookStore interface {
+	// CreateWebhook stores a webhook and returns it with its generated fields
+	CreateWebhook(ctx context.Context, webhook Webhook) (Webhook, error)
+	// ListWebhooks returns the tenant's webhooks in ID order, without their secrets
+	ListWebhooks(ctx context.Context, tenant string) ([]Webhook, error)
+	// ListSubscribedWebhooks returns the tenant's webhooks subscribed to the
+	// event type, secrets included
+	ListSubscribedWebhooks(ctx context.Context, tenant, eventType string) ([]Webhook, error)
+	// DeleteWebhook removes a webhook and its log, or returns ErrWebhookNotFound
+	DeleteWebhook(ctx context.Context, tenant string, id int64) error
+	// RecordWebhookAttempt logs an attempt to deliver to a webhook; attempts at
+	// deleted webhooks are dropped
+	RecordWebhookAttempt(ctx context.Context, attempt WebhookAttempt) error
+	// ListWebhookAttempts returns up to limit attempts at one of the tenant's
+	// webhooks, newest first, or returns ErrWebhookNotFound
+	ListWebhookAttempts(ctx context.Context, tenant string, webhookID int64, limit int) ([]WebhookAttempt, error)
+}
+
+// ImportJobStore persists the progress of CSV imports, scoped to a tenant
+type ImportJobStore interface {
+	// CreateImportJob stores a running job and returns it with its generated fields
+	CreateImportJob(ctx context.Context, job ImportJob) (ImportJob, error)
+	// UpdateImportJob saves a job's counts, status and error
+	UpdateImportJob(ctx context.Context, job ImportJob) error
+	// GetImportJob returns one of the tenant's jobs, or ErrImportNotFound
+	GetImportJob(ctx context.Context, tenant string, id int64) (ImportJob, error)
+	// ListImportJobs returns up to limit of the tenant's jobs, newest first
+	ListImportJobs(ctx context.Context, tenant string, limit int) ([]ImportJob, error)
+}
+
+// CreationJobStore persists the progress of users created in the background,
+// scoped to a tenant
+type CreationJobStore interface {
+	// CreateCreationJob stores a pending job and returns it with its generated fields
+	CreateCreationJob(ctx context.Context, job CreationJob) (CreationJob, error)
+	// UpdateCreationJob saves a job's status, user and error
+	UpdateCreationJob(ctx context.Context, job CreationJob) error
+	// GetCreationJob returns one of the tenant's jobs, or ErrJobNotFound
+	GetCreationJob(ctx context.Context, tenant string, id int64) (CreationJob, error)
+}
+
+// APIKeyStore persists managed API keys, which are only ever stored hashed
+type APIKeyStore interface {
+	// CreateAPIKey stores a key under its hash and returns it with its generated fields
+	CreateAPIKey(ctx context.Context, key APIKey, hash []byte) (APIKey, error)
+	// ListAPIKeys returns every key, revoked ones included, in ID order
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// LookupAPIKey returns the unrevoked key with this hash, or ErrAPIKeyNotFound
+	LookupAPIKey(ctx context.Context, hash []byte) (APIKey, error)
+	// RevokeAPIKey revokes an unrevoked key, or returns ErrAPIKeyNotFound
+	RevokeAPIKey(ctx context.Context, id int64) error
+}
+
+// SessionStore persists login sessions, keyed by the hash of their current refresh token
+type SessionStore interface {
+	// CreateSession stores a session under its first refresh token's hash
+	CreateSession(ctx context.Context, session Session, refreshHash []byte) (Session, error)
+	// RotateSession swaps a live session's refresh token for a new one and extends
+	// it to expiresAt, or returns ErrNoSession
+	RotateSession(ctx context.Context, refreshHash, newHash []byte, expiresAt time.Time) (Session, error)
+	// RevokeSession ends the live session holding this refresh token, or returns ErrNoSession
+	RevokeSession(ctx context.Context, refreshHash []byte) error
+	// VerifySessionTwoFactor records that the live session passed a two-factor
+	// check just now, or returns ErrNoSession
+	VerifySessionTwoFactor(ctx context.Context, id int64) (Session, error)
+}
+
+// CredentialStore persists the password hashes of users with local credentials
+type CredentialStore interface {
+	// SetPasswordHash stores the user's password hash, replacing any earlier one
+	SetPasswordHash(ctx context.Context, userID int64, hash []byte) error
+	// GetPasswordHash returns the user's password hash, or ErrNoPassword
+	GetPasswordHash(ctx context.Context, userID int64) ([]byte, error)
+}
+
+// StoredPicture is an uploaded profile picture, shared by every user who
+// uploaded the same content
+type StoredPicture struct {
+	SHA256        []byte
+	Blob          string // Name in the profile pictures container
+	Checksum      string // Base64 MD5
+	ThumbnailLink string
+	Thumbnails    ThumbnailLinks
+}
+
+// PictureStore counts the users referencing each uploaded picture, so identical
+// uploads are stored once and deleted with the last user letting go of them
+type PictureStore interface {
+	// AcquirePicture takes a reference to the tenant's picture with this
+	// content hash, or returns ErrPictureNotFound
+	AcquirePicture(ctx context.Context, tenant string, sha256 []byte) (StoredPicture, error)
+	// AddPicture records a picture just uploaded, with one reference. If a
+	// concurrent upload of the same content was recorded first, that one is
+	// referenced and returned instead, with added false.
+	AddPicture(ctx context.Context, tenant string, picture StoredPicture) (stored StoredPicture, added bool, err error)
+	// ReleasePicture drops a reference to the tenant's picture stored as blob,
+	// reporting whether it was the last, so the blobs are to be deleted.
+	// Pictures uploaded before they were counted are their one user's, so
+	// releasing them always is.
+	ReleasePicture(ctx context.Context, tenant, blob string) (last bool, err error)
+	// ForgetPicture drops the record of the picture stored as blob, whatever
+	// its references, once the blob is deleted as an orphan
+	ForgetPicture(ctx context.Context, blob string) error
+}
+
+// OutboxStore holds the user events written alongside the changes they describe
+// until the dispatcher has published them
+type OutboxStore interface {
+	// ClaimOutboxEvents leases up to limit due events, oldest first; other
+	// dispatchers skip them until the lease runs out
+	ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]events.OutboxEvent, error)
+	// DeleteOutboxEvent removes an event once it is published
+	DeleteOutboxEvent(ctx context.Context, id int64) error
+	// FailOutboxEvent records why publishing an event failed and holds it back
+	// for retryAfter
+	FailOutboxEvent(ctx context.Context, id int64, reason string, retryAfter time.Duration) error
+}
+
+// PasswordResetStore persists the one-time tokens of password reset links, only hashed
+type PasswordResetStore interface {
+	// CreatePasswordReset stores a token for the user that works until expiresAt
+	CreatePasswordReset(ctx context.Context, userID int64, tokenHash []byte, expiresAt time.Time) error
+	// CountPasswordResets returns how many tokens the user was issued since then
+	CountPasswordResets(ctx context.Context, userID int64, since time.Time) (int, error)
+	// LookupPasswordReset returns the tenant and ID of the user a live token is
+	// for, or ErrInvalidReset
+	LookupPasswordReset(ctx context.Context, tokenHash []byte) (tenant string, userID int64, err error)
+	// ResetPassword uses up a live token, sets its user's password hash, and
+	// uses up their other tokens and revokes their sessions, or returns ErrInvalidReset
+	ResetPassword(ctx context.Context, tokenHash, passwordHash []byte) (userID int64, err error)
+}
+
+// TwoFactorStore persists TOTP secrets and recovery codes, the latter only hashed
+type TwoFactorStore interface {
+	// EnrollTOTP stores a pending secret for the user, replacing any earlier
+	// pending one, or returns ErrTOTPEnabled
+	EnrollTOTP(ctx context.Context, userID int64, secret []byte) error
+	// GetTOTP returns the user's secret, pending or enabled, or ErrNoTOTP
+	GetTOTP(ctx context.Context, userID int64) (TOTPSecret, error)
+	// EnableTOTP turns on the pending secret, whose code for step was just
+	// confirmed, and replaces the user's recovery codes, or returns ErrNoTOTP
+	EnableTOTP(ctx context.Context, userID int64, step int64, recoveryHashes [][]byte) error
+	// UseTOTPStep accepts a code for step unless one for it or a later step was
+	// already accepted, returning ErrInvalidCode
+	UseTOTPStep(ctx context.Context, userID int64, step int64) error
+	// UseRecoveryCode uses up an unused recovery code, or returns ErrInvalidCode
+	UseRecoveryCode(ctx context.Context, userID int64, hash []byte) error
+}
+
+// MailSuppressionStore persists the addresses notification emails aren't sent
+// to, by email in lower case, across every tenant
+type MailSuppressionStore interface {
+	// SuppressEmail adds an address, or replaces the reason of one already there
+	SuppressEmail(ctx context.Context, suppression MailSuppression) (MailSuppression, error)
+	// IsEmailSuppressed reports whether an address is suppressed
+	IsEmailSuppressed(ctx context.Context, email string) (bool, error)
+	// ListMailSuppressions returns every address, in email order
+	ListMailSuppressions(ctx context.Context) ([]MailSuppression, error)
+	// UnsuppressEmail removes an address, or returns ErrNotSuppressed
+	UnsuppressEmail(ctx context.Context, email string) error
+}
+
+// JobRunStore records the runs of scheduled jobs, so of the instances running
+// the scheduler only one makes each run
+type JobRunStore interface {
+	// ClaimJobRun claims the run of job scheduled at scheduledAt for owner,
+	// holding off the others for lease, and reports whether it got the run: not
+	// when it or a later run was claimed already, nor while an earlier run
+	// still holds its lease
+	ClaimJobRun(ctx context.Context, job string, scheduledAt time.Time, owner string, lease time.Duration) (bool, error)
+	// FinishJobRun ends owner's run of job, releasing its lease
+	FinishJobRun(ctx context.Context, job, owner string) error
+}
+
+// Stores is one implementation of every store, for the database.driver configured
+type Stores struct {
+	Users          UserStore
+	Audit          AuditStore
+	Pictures       PictureStore
+	Outbox         OutboxStore
+	Webhooks       WebhookStore
+	PasswordResets PasswordResetStore
+	Sessions       SessionStore
+	TwoFactor      TwoFactorStore
+	APIKeys        APIKeyStore
+	Groups         GroupStore
+	Credentials    CredentialStore
+	ImportJobs     ImportJobStore
+	AuthFailures   AuthFailureStore
+	RateLimits     RateLimitStore
+	Idempotency    IdempotencyStore
+	CreationJobs   CreationJobStore
+	Suppressions   MailSuppressionStore
+	JobRuns        JobRunStore
+	Activities     ActivityStore
+}
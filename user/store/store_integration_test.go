@@ -0,0 +1,229 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"user/user/config"
+)
+
+// TestStores runs the same contract against the memory store and each SQL
+// database named by its environment variable, a connection string to an empty
+// or already migrated database, skipping those not set
+func TestStores(t *testing.T) {
+	tests := []struct {
+		driver string
+		env    string // Connection string variable; empty for the memory store
+	}{
+		{driver: config.DatabaseDriverMemory},
+		{driver: config.DatabaseDriverSQLServer, env: "USERSVC_TEST_SQLSERVER"},
+		{driver: config.DatabaseDriverPostgres, env: "USERSVC_TEST_POSTGRES"},
+		{driver: config.DatabaseDriverMySQL, env: "USERSVC_TEST_MYSQL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.driver, func(t *testing.T) {
+			if tt.env == "" {
+				testStoreContract(t, NewMemoryStores())
+				return
+			}
+			dsn := os.Getenv(tt.env)
+			if dsn == "" {
+				t.Skipf("%s not set", tt.env)
+			}
+			testStoreContract(t, openTestStores(t, tt.driver, dsn))
+		})
+	}
+}
+
+// openTestStores connects to a test database and migrates it, as main does
+func openTestStores(t *testing.T, driver, dsn string) Stores {
+	t.Helper()
+	var cfg config.Config
+	cfg.Database.Driver = driver
+	config.ApplyDefaults(&cfg)
+	connector, err := NewDBConnector(cfg, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	t.Cleanup(func() { db.Close() })
+	d := DialectFor(driver)
+	if err := RunMigrations(context.Background(), db, d, ""); err != nil {
+		t.Fatal(err)
+	}
+	return NewSQLStores(db, nil, d)
+}
+
+// testStoreContract checks the behavior every set of stores must share. Each run
+// works in a tenant of its own, so runs against one database don't collide.
+func testStoreContract(t *testing.T, stores Stores) {
+	ctx := context.Background()
+	tenant := randomTestName(t)
+	users := stores.Users
+
+	alice, err := users.CreateUser(ctx, User{TenantID: tenant, Name: "Alice", Email: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := users.CreateUser(ctx, User{TenantID: tenant, Name: "Bob", Email: "bob@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("duplicate email", func(t *testing.T) {
+		_, err := users.CreateUser(ctx, User{TenantID: tenant, Name: "Other", Email: "ALICE@example.com"})
+		if !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("err = %v, want %v", err, ErrDuplicateEmail)
+		}
+	})
+
+	t.Run("get by email", func(t *testing.T) {
+		got, err := users.GetUserByEmail(ctx, tenant, "Alice@Example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != alice.ID {
+			t.Errorf("ID = %d, want %d", got.ID, alice.ID)
+		}
+	})
+
+	t.Run("list after", func(t *testing.T) {
+		got, err := users.ListUsersAfter(ctx, tenant, User{}, 1, UserFilter{}, UserSort{Field: SortByName, Descending: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].ID != bob.ID {
+			t.Errorf("users = %v, want only %d", got, bob.ID)
+		}
+	})
+
+	t.Run("search", func(t *testing.T) {
+		got, err := users.SearchUsers(ctx, tenant, "ali", SearchHit{}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].ID != alice.ID || got[0].Rank != searchRankPrefix {
+			t.Errorf("hits = %v, want %d at rank %d", got, alice.ID, searchRankPrefix)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		name := "Alice Smith"
+		got, err := users.UpdateUser(ctx, tenant, alice.ID, UserChanges{Version: alice.Version, Name: &name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != name || got.Version == alice.Version {
+			t.Errorf("user = %+v, want name %q at a new version", got, name)
+		}
+		_, err = users.UpdateUser(ctx, tenant, alice.ID, UserChanges{Version: alice.Version, Name: &name})
+		if !errors.Is(err, ErrStaleVersion) {
+			t.Errorf("err = %v, want %v", err, ErrStaleVersion)
+		}
+	})
+
+	t.Run("upsert by email", func(t *testing.T) {
+		saved, created, err := users.UpsertUserByEmail(ctx, User{TenantID: tenant, Name: "Robert", Email: "BOB@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created || saved.ID != bob.ID || saved.Name != "Robert" {
+			t.Errorf("saved = %+v, created = %v, want %d renamed", saved, created, bob.ID)
+		}
+		saved, created, err = users.UpsertUserByEmail(ctx, User{TenantID: tenant, Name: "Carol", Email: "carol@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !created || saved.ID == 0 {
+			t.Errorf("saved = %+v, created = %v, want a new user", saved, created)
+		}
+	})
+
+	t.Run("delete and restore", func(t *testing.T) {
+		if err := users.DeleteUser(ctx, tenant, bob.ID, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := users.GetUser(ctx, tenant, bob.ID); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("err = %v, want %v", err, ErrUserNotFound)
+		}
+		n, err := users.CountUsers(ctx, tenant, UserFilter{IncludeDeleted: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			t.Errorf("count = %d, want 3", n)
+		}
+		if _, err := users.RestoreUser(ctx, tenant, bob.ID); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("password hash", func(t *testing.T) {
+		for _, hash := range []string{"first", "second"} {
+			if err := stores.Credentials.SetPasswordHash(ctx, alice.ID, []byte(hash)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := stores.Credentials.GetPasswordHash(ctx, alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "second" {
+			t.Errorf("hash = %q, want %q", got, "second")
+		}
+	})
+
+	t.Run("count requests", func(t *testing.T) {
+		window := time.Now().UTC().Truncate(time.Minute)
+		for want := 1; want <= 2; want++ {
+			n, err := stores.RateLimits.CountRequest(ctx, tenant, window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != want {
+				t.Errorf("count = %d, want %d", n, want)
+			}
+		}
+	})
+
+	t.Run("claim job run", func(t *testing.T) {
+		scheduled := time.Now().UTC().Truncate(time.Second)
+		for _, want := range []bool{true, false} {
+			claimed, err := stores.JobRuns.ClaimJobRun(ctx, tenant, scheduled, "owner", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claimed != want {
+				t.Errorf("claimed = %v, want %v", claimed, want)
+			}
+		}
+	})
+
+	t.Run("reserve idempotency key", func(t *testing.T) {
+		key := sha256.Sum256([]byte(tenant))
+		leaseUntil := time.Now().Add(time.Minute)
+		if _, err := stores.Idempotency.ReserveIdempotencyKey(ctx, key[:], leaseUntil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stores.Idempotency.ReserveIdempotencyKey(ctx, key[:], leaseUntil); !errors.Is(err, ErrIdempotencyKeyInUse) {
+			t.Errorf("err = %v, want %v", err, ErrIdempotencyKeyInUse)
+		}
+	})
+}
+
+// randomTestName is a name no earlier test run has used
+func randomTestName(t *testing.T) string {
+	t.Helper()
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return "test-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,1599 @@
+package store
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"user/user/events"
+)
+
+// MemoryStore implements every store in process memory, for database.driver
+// memory: the service runs without a database, and forgets everything when it
+// exits. It keeps the semantics of the SQL stores, the email index, versions
+// and cascades included, behind one lock that serves as their transactions.
+// Name sorting and email matching ignore case, as the database's collation does.
+type MemoryStore struct {
+	mu      sync.Mutex
+	lastID  map[string]int64 // Last ID given out, by table
+	version int64            // Last user version given out, shared by every user as rowversion is
+
+	users         map[int64]*memoryUser
+	identities    map[memoryIdentity]int64 // User ID by social login
+	credentials   map[int64][]byte         // Password hash by user ID
+	groups        map[int64]Group
+	members       map[int64]map[int64]bool // User IDs by group ID
+	webhooks      map[int64]Webhook        // Secrets included
+	attempts      []WebhookAttempt         // In ID order
+	importJobs    map[int64]ImportJob
+	creationJobs  map[int64]CreationJob
+	apiKeys       map[int64]*memoryAPIKey
+	sessions      map[int64]*memorySession
+	pictures      map[string]*memoryPicture // By blob name
+	outbox        map[int64]*memoryOutboxEvent
+	resets        []*memoryPasswordReset
+	totp          map[int64]*memoryTOTP
+	recoveryCodes map[int64][]*memoryRecoveryCode
+	authFailures  []memoryAuthFailure
+	rateWindows   map[memoryRateWindow]int
+	audit         []AuditEvent                     // In ID order
+	activities    []Activity                       // In ID order
+	idempotency   map[string]*memoryIdempotencyKey // By key hash
+	suppressions  map[string]MailSuppression       // By email
+	jobRuns       map[string]*memoryJobRun         // By job name
+}
+
+type memoryUser struct {
+	User
+	erasedAt *time.Time
+}
+
+type memoryIdentity struct{ provider, subject string }
+
+type memoryAPIKey struct {
+	APIKey
+	hash []byte
+}
+
+type memorySession struct {
+	Session
+	refreshHash []byte
+	revoked     bool
+}
+
+type memoryPicture struct {
+	StoredPicture
+	tenant string
+	refs   int
+}
+
+type memoryOutboxEvent struct {
+	events.OutboxEvent
+	lockedUntil time.Time
+	lastError   string
+}
+
+type memoryPasswordReset struct {
+	userID    int64
+	tokenHash []byte
+	expiresAt time.Time
+	createdAt time.Time
+	used      bool
+}
+
+type memoryTOTP struct {
+	TOTPSecret
+	lastStep *int64
+}
+
+type memoryRecoveryCode struct {
+	hash []byte
+	used bool
+}
+
+type memoryAuthFailure struct {
+	userID    int64
+	ip        string
+	createdAt time.Time
+}
+
+type memoryRateWindow struct {
+	key   string
+	start time.Time
+}
+
+type memoryJobRun struct {
+	scheduledAt time.Time
+	owner       string
+	lockedUntil time.Time // Zero once the run finished
+}
+
+type memoryIdempotencyKey struct {
+	response  *IdempotentResponse // Nil while the request holding the key runs
+	expiresAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		lastID:        map[string]int64{},
+		users:         map[int64]*memoryUser{},
+		identities:    map[memoryIdentity]int64{},
+		credentials:   map[int64][]byte{},
+		groups:        map[int64]Group{},
+		members:       map[int64]map[int64]bool{},
+		webhooks:      map[int64]Webhook{},
+		importJobs:    map[int64]ImportJob{},
+		creationJobs:  map[int64]CreationJob{},
+		apiKeys:       map[int64]*memoryAPIKey{},
+		sessions:      map[int64]*memorySession{},
+		pictures:      map[string]*memoryPicture{},
+		outbox:        map[int64]*memoryOutboxEvent{},
+		totp:          map[int64]*memoryTOTP{},
+		recoveryCodes: map[int64][]*memoryRecoveryCode{},
+		rateWindows:   map[memoryRateWindow]int{},
+		idempotency:   map[string]*memoryIdempotencyKey{},
+		suppressions:  map[string]MailSuppression{},
+		jobRuns:       map[string]*memoryJobRun{},
+	}
+}
+
+// NewMemoryStores is every store kept in one MemoryStore
+func NewMemoryStores() Stores {
+	m := NewMemoryStore()
+	return Stores{
+		Users:          m,
+		Audit:          m,
+		Pictures:       m,
+		Outbox:         m,
+		Webhooks:       m,
+		PasswordResets: m,
+		Sessions:       m,
+		TwoFactor:      m,
+		APIKeys:        m,
+		Groups:         m,
+		Credentials:    m,
+		ImportJobs:     m,
+		AuthFailures:   m,
+		RateLimits:     m,
+		Idempotency:    m,
+		CreationJobs:   m,
+		Suppressions:   m,
+		JobRuns:        m,
+		Activities:     m,
+	}
+}
+
+// nextID gives out the next identity value of table
+func (m *MemoryStore) nextID(table string) int64 {
+	m.lastID[table]++
+	return m.lastID[table]
+}
+
+// memoryNow is the time a write is stamped with, as SYSUTCDATETIME() would
+func memoryNow() time.Time {
+	return time.Now().UTC()
+}
+
+// copyUser is a user as a query would return it, sharing nothing the store may change later
+func copyUser(user User) User {
+	user.Roles = slices.Clone(user.Roles)
+	if user.Roles == nil {
+		user.Roles = []string{}
+	}
+	user.Metadata = maps.Clone(user.Metadata)
+	if user.Metadata == nil {
+		user.Metadata = UserMetadata{}
+	}
+	if len(user.Thumbnails) == 0 {
+		user.Thumbnails = nil
+	}
+	user.Thumbnails = maps.Clone(user.Thumbnails)
+	return user
+}
+
+// write stamps a changed user with a new version and the time of the change
+func (m *MemoryStore) write(u *memoryUser, now time.Time) {
+	m.version++
+	u.Version = m.version
+	u.UpdatedAt = now
+}
+
+// emailTaken reports whether another live user of the tenant has the email
+func (m *MemoryStore) emailTaken(tenant, email string, except int64) bool {
+	for _, u := range m.users {
+		if u.ID != except && u.TenantID == tenant && u.DeletedAt == nil && strings.EqualFold(u.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// insertUser adds a user with its generated fields, or returns ErrDuplicateEmail
+func (m *MemoryStore) insertUser(user User) (User, error) {
+	if m.emailTaken(user.TenantID, user.Email, 0) {
+		return User{}, ErrDuplicateEmail
+	}
+	now := memoryNow()
+	user = copyUser(user)
+	user.ID = m.nextID("users")
+	user.CreatedAt = now
+	user.DeletedAt, user.LastLoginAt, user.LockedAt = nil, nil, nil
+	user.Roles = []string{}
+	u := &memoryUser{User: user}
+	m.write(u, now)
+	m.users[u.ID] = u
+	return copyUser(u.User), nil
+}
+
+// removeUser deletes a user's row and, as the foreign keys cascade, what hangs off it
+func (m *MemoryStore) removeUser(id int64) {
+	delete(m.users, id)
+	m.forgetSignIns(id)
+	maps.DeleteFunc(m.identities, func(_ memoryIdentity, userID int64) bool { return userID == id })
+	for _, members := range m.members {
+		delete(members, id)
+	}
+}
+
+// forgetSignIns drops the user's credentials, two-factor secrets, reset tokens
+// and failed attempts
+func (m *MemoryStore) forgetSignIns(id int64) {
+	delete(m.credentials, id)
+	delete(m.totp, id)
+	delete(m.recoveryCodes, id)
+	m.resets = slices.DeleteFunc(m.resets, func(r *memoryPasswordReset) bool { return r.userID == id })
+	m.authFailures = slices.DeleteFunc(m.authFailures, func(f memoryAuthFailure) bool { return f.userID == id })
+}
+
+// revokeSessions ends every live session of the user
+func (m *MemoryStore) revokeSessions(userID int64) {
+	for _, s := range m.sessions {
+		if s.UserID == userID {
+			s.revoked = true
+		}
+	}
+}
+
+// enqueueOutboxEvent writes the event ctx is marked with, if any, about user to the outbox
+func (m *MemoryStore) enqueueOutboxEvent(ctx context.Context, user User) error {
+	eventType := outboxEventType(ctx)
+	if eventType == "" {
+		return nil
+	}
+	event, err := newOutboxEvent(ctx, eventType, user)
+	if err != nil {
+		return err
+	}
+	event.ID = m.nextID("outbox_events")
+	m.outbox[event.ID] = &memoryOutboxEvent{OutboxEvent: event}
+	return nil
+}
+
+// matchesFilter reports whether a user of any tenant is one of tenant's
+// users that filter selects, as filterClause does
+func matchesFilter(user User, tenant string, filter UserFilter) bool {
+	switch {
+	case user.TenantID != tenant:
+		return false
+	case !filter.IncludeDeleted && user.DeletedAt != nil:
+		return false
+	case filter.Search != "" && !containsFold(user.Name, filter.Search) && !containsFold(user.Email, filter.Search):
+		return false
+	case filter.Email != "" && strings.ToLower(user.Email) != NormalizeEmail(filter.Email):
+		return false
+	case !filter.ActiveSince.IsZero() && (user.LastLoginAt == nil || user.LastLoginAt.Before(filter.ActiveSince)):
+		return false
+	case !filter.CreatedAfter.IsZero() && !user.CreatedAt.After(filter.CreatedAfter):
+		return false
+	}
+	for key, value := range filter.Metadata {
+		if v, ok := user.Metadata[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// compareUsers orders users as orderClause does, by the sort field and then ID
+func compareUsers(a, b User, sort UserSort) int {
+	var c int
+	switch sort.Field {
+	case SortByName:
+		c = cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	case SortByCreatedAt:
+		c = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if c == 0 {
+		c = cmp.Compare(a.ID, b.ID)
+	}
+	if sort.Descending {
+		return -c
+	}
+	return c
+}
+
+// selectUsers returns copies of the users of tenant matching filter, in sort order
+func (m *MemoryStore) selectUsers(tenant string, filter UserFilter, sort UserSort) []User {
+	var users []User
+	for _, u := range m.users {
+		if matchesFilter(u.User, tenant, filter) {
+			users = append(users, copyUser(u.User))
+		}
+	}
+	slices.SortFunc(users, func(a, b User) int { return compareUsers(a, b, sort) })
+	return users
+}
+
+// liveUser is the tenant's user with this ID unless it is deleted
+func (m *MemoryStore) liveUser(tenant string, id int64) (*memoryUser, bool) {
+	u, ok := m.users[id]
+	if !ok || u.TenantID != tenant || u.DeletedAt != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+func (m *MemoryStore) ListUsers(ctx context.Context, tenant string, filter UserFilter, sort UserSort) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selectUsers(tenant, filter, sort), nil
+}
+
+func (m *MemoryStore) ListUsersAfter(ctx context.Context, tenant string, after User, limit int, filter UserFilter, sort UserSort) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := m.selectUsers(tenant, filter, sort)
+	if after.ID != 0 {
+		users = slices.DeleteFunc(users, func(u User) bool { return compareUsers(u, after, sort) <= 0 })
+	}
+	return users[:min(limit, len(users))], nil
+}
+
+func (m *MemoryStore) SearchUsers(ctx context.Context, tenant, query string, after SearchHit, limit int) ([]SearchHit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	exact := strings.ToLower(query)
+	var hits []SearchHit
+	for _, user := range m.selectUsers(tenant, UserFilter{Search: query}, UserSort{}) {
+		name, email := strings.ToLower(user.Name), strings.ToLower(user.Email)
+		hit := SearchHit{User: user, Rank: searchRankSubstring}
+		switch {
+		case name == exact || email == exact:
+			hit.Rank = searchRankExact
+		case strings.HasPrefix(name, exact) || strings.HasPrefix(email, exact):
+			hit.Rank = searchRankPrefix
+		}
+		if after.ID != 0 && (hit.Rank < after.Rank || (hit.Rank == after.Rank && hit.ID <= after.ID)) {
+			continue
+		}
+		hits = append(hits, hit)
+	}
+	slices.SortStableFunc(hits, func(a, b SearchHit) int { return cmp.Compare(a.Rank, b.Rank) })
+	return hits[:min(limit, len(hits))], nil
+}
+
+func (m *MemoryStore) CountUsers(ctx context.Context, tenant string, filter UserFilter) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int64
+	for _, u := range m.users {
+		if matchesFilter(u.User, tenant, filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryStore) ExportUsers(ctx context.Context, tenant string, filter UserFilter, fn func(User) error) error {
+	// A snapshot, so fn may call back into the store
+	m.mu.Lock()
+	users := m.selectUsers(tenant, filter, UserSort{})
+	m.mu.Unlock()
+	for _, user := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetUser(ctx context.Context, tenant string, id int64) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.liveUser(tenant, id)
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return copyUser(u.User), nil
+}
+
+func (m *MemoryStore) GetUserByEmail(ctx context.Context, tenant, email string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	email = NormalizeEmail(email)
+	for _, u := range m.users {
+		if u.TenantID == tenant && u.DeletedAt == nil && strings.ToLower(u.Email) == email {
+			return copyUser(u.User), nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+func (m *MemoryStore) GetUserByIdentity(ctx context.Context, provider, subject string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[m.identities[memoryIdentity{provider, subject}]]
+	if !ok || u.DeletedAt != nil {
+		return User{}, ErrUserNotFound
+	}
+	return copyUser(u.User), nil
+}
+
+func (m *MemoryStore) LinkIdentity(ctx context.Context, userID int64, provider, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	identity := memoryIdentity{provider, subject}
+	if _, ok := m.identities[identity]; ok {
+		return nil
+	}
+	if _, ok := m.users[userID]; !ok {
+		// The foreign key would refuse it
+		return ErrUserNotFound
+	}
+	m.identities[identity] = userID
+	return nil
+}
+
+func (m *MemoryStore) ExistingEmails(ctx context.Context, tenant string, emails []string) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found := make(map[string]bool)
+	for _, u := range m.users {
+		if email := strings.ToLower(u.Email); u.TenantID == tenant && u.DeletedAt == nil && slices.Contains(emails, email) {
+			found[email] = true
+		}
+	}
+	return found, nil
+}
+
+func (m *MemoryStore) ReferencedLinks(ctx context.Context, links []string) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wanted := map[string]bool{}
+	for _, link := range links {
+		wanted[link] = true
+	}
+	found := make(map[string]bool)
+	for _, u := range m.users {
+		for _, link := range append([]string{u.Link, u.ThumbnailLink}, slices.Collect(maps.Values(u.Thumbnails))...) {
+			if wanted[link] {
+				found[link] = true
+			}
+		}
+	}
+	return found, nil
+}
+
+func (m *MemoryStore) CreateUser(ctx context.Context, user User) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	created, err := m.insertUser(user)
+	if err != nil {
+		return user, err
+	}
+	if err := m.enqueueOutboxEvent(ctx, created); err != nil {
+		m.removeUser(created.ID)
+		return user, err
+	}
+	return created, nil
+}
+
+func (m *MemoryStore) BulkCreateUsers(ctx context.Context, tenant string, users []User, results []BulkResult, atomic bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var created []int64
+	firstEvent := m.lastID["outbox_events"]
+	failed := false
+	for i, user := range users {
+		if results[i].Failed() {
+			failed = true
+			continue
+		}
+		row, err := m.insertUser(User{Name: user.Name, Email: user.Email, Link: user.Link, TenantID: tenant, Metadata: user.Metadata})
+		if err == nil {
+			if err = m.enqueueOutboxEvent(ctx, row); err != nil {
+				m.removeUser(row.ID)
+			}
+		}
+		if err == nil {
+			created = append(created, row.ID)
+			results[i].ID = row.ID
+			continue
+		}
+
+		failed = true
+		if !errors.Is(err, ErrDuplicateEmail) {
+			slog.ErrorContext(ctx, "Error inserting bulk row", "row", i, "error", err)
+		}
+		results[i].Err = err
+	}
+
+	// In atomic mode any failure discards the whole batch
+	if atomic && failed {
+		for _, id := range created {
+			m.removeUser(id)
+		}
+		maps.DeleteFunc(m.outbox, func(id int64, _ *memoryOutboxEvent) bool { return id > firstEvent })
+		for i := range results {
+			results[i].ID = 0
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateUser(ctx context.Context, tenant string, id int64, changes UserChanges) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.liveUser(tenant, id)
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	if changes.Version != 0 && u.Version != changes.Version {
+		return User{}, ErrStaleVersion
+	}
+	if changes.Email != nil && m.emailTaken(tenant, *changes.Email, id) {
+		return User{}, ErrDuplicateEmail
+	}
+
+	updated := copyUser(u.User)
+	if changes.Name != nil {
+		updated.Name = *changes.Name
+	}
+	if changes.Email != nil {
+		// A new address has to be verified again
+		if !strings.EqualFold(updated.Email, *changes.Email) {
+			updated.EmailVerifiedAt = nil
+		}
+		updated.Email = *changes.Email
+	}
+	if changes.Link != nil {
+		updated.Link = *changes.Link
+	}
+	if changes.ThumbnailLink != nil {
+		updated.ThumbnailLink = *changes.ThumbnailLink
+	}
+	if changes.Thumbnails != nil {
+		updated.Thumbnails = maps.Clone(*changes.Thumbnails)
+	}
+	if changes.Roles != nil {
+		updated.Roles = slices.Clone(*changes.Roles)
+	}
+	if changes.Metadata != nil {
+		updated.Metadata = maps.Clone(*changes.Metadata)
+	}
+	previous := u.User
+	u.User = copyUser(updated)
+	m.write(u, memoryNow())
+	if err := m.enqueueOutboxEvent(ctx, copyUser(u.User)); err != nil {
+		u.User = previous
+		return User{}, err
+	}
+	return copyUser(u.User), nil
+}
+
+func (m *MemoryStore) TouchUser(ctx context.Context, tenant string, id int64) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.liveUser(tenant, id)
+	if !ok {
+		return time.Time{}, ErrUserNotFound
+	}
+	now := memoryNow()
+	u.LastLoginAt = &now
+	m.version++
+	u.Version = m.version
+	return now, nil
+}
+
+func (m *MemoryStore) UpsertUser(ctx context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.TenantID == user.TenantID && u.DeletedAt == nil && strings.EqualFold(u.Email, user.Email) {
+			u.Name, u.Link, u.ThumbnailLink, u.Thumbnails = user.Name, user.Link, user.ThumbnailLink, maps.Clone(user.Thumbnails)
+			m.write(u, memoryNow())
+			return nil
+		}
+	}
+	_, err := m.insertUser(User{Name: user.Name, Email: user.Email, Link: user.Link, ThumbnailLink: user.ThumbnailLink, Thumbnails: user.Thumbnails, TenantID: user.TenantID})
+	return err
+}
+
+func (m *MemoryStore) UpsertUserByEmail(ctx context.Context, user User) (User, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.TenantID != user.TenantID || u.DeletedAt != nil || !strings.EqualFold(u.Email, user.Email) {
+			continue
+		}
+		previous := u.User
+		updated := copyUser(u.User)
+		updated.Name = user.Name
+		if user.Link != "" {
+			updated.Link, updated.ThumbnailLink, updated.Thumbnails = user.Link, "", nil
+		}
+		if user.Metadata != nil {
+			updated.Metadata = maps.Clone(user.Metadata)
+		}
+		u.User = updated
+		m.write(u, memoryNow())
+		if err := m.enqueueOutboxEvent(ctx, copyUser(u.User)); err != nil {
+			u.User = previous
+			return User{}, false, err
+		}
+		return copyUser(u.User), false, nil
+	}
+	created, err := m.insertUser(User{Name: user.Name, Email: user.Email, Link: user.Link, TenantID: user.TenantID, Metadata: user.Metadata})
+	if err != nil {
+		return User{}, false, err
+	}
+	if outboxEventType(ctx) != "" {
+		ctx = WithOutboxEvent(ctx, events.UserCreated)
+	}
+	if err := m.enqueueOutboxEvent(ctx, created); err != nil {
+		m.removeUser(created.ID)
+		return User{}, false, err
+	}
+	return created, true, nil
+}
+
+func (m *MemoryStore) DeleteUser(ctx context.Context, tenant string, id int64, hard bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The row as deleted is the event's payload
+	u, ok := m.users[id]
+	if !ok || u.TenantID != tenant || (!hard && u.DeletedAt != nil) {
+		return ErrUserNotFound
+	}
+	if hard {
+		if err := m.enqueueOutboxEvent(ctx, copyUser(u.User)); err != nil {
+			return err
+		}
+		m.removeUser(id)
+		return nil
+	}
+	previous := u.User
+	now := memoryNow()
+	u.DeletedAt = &now
+	m.write(u, now)
+	if err := m.enqueueOutboxEvent(ctx, copyUser(u.User)); err != nil {
+		u.User = previous
+		return err
+	}
+	return nil
+}
+
+func (m *MemoryStore) PurgeDeletedUsers(ctx context.Context, cutoff time.Time, limit int) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var purged []User
+	for _, id := range slices.Sorted(maps.Keys(m.users)) {
+		if len(purged) == limit {
+			break
+		}
+		if u := m.users[id]; u.DeletedAt != nil && u.DeletedAt.Before(cutoff) {
+			purged = append(purged, copyUser(u.User))
+			m.removeUser(id)
+		}
+	}
+	return purged, nil
+}
+
+func (m *MemoryStore) ListInactiveUsers(ctx context.Context, cutoff time.Time, afterID int64, limit int) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var users []User
+	for _, id := range slices.Sorted(maps.Keys(m.users)) {
+		if len(users) == limit {
+			break
+		}
+		u := m.users[id]
+		if id <= afterID || u.DeletedAt != nil {
+			continue
+		}
+		if lastActive := cmp.Or(deref(u.LastLoginAt), u.CreatedAt); lastActive.Before(cutoff) {
+			users = append(users, copyUser(u.User))
+		}
+	}
+	return users, nil
+}
+
+func (m *MemoryStore) RestoreUser(ctx context.Context, tenant string, id int64) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok || u.TenantID != tenant || u.DeletedAt == nil || u.erasedAt != nil {
+		return User{}, ErrUserNotFound
+	}
+	if m.emailTaken(tenant, u.Email, id) {
+		return User{}, ErrDuplicateEmail
+	}
+	u.DeletedAt = nil
+	m.write(u, memoryNow())
+	return copyUser(u.User), nil
+}
+
+func (m *MemoryStore) ErasePersonalData(ctx context.Context, tenant string, id int64) (User, User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok || u.TenantID != tenant || u.erasedAt != nil {
+		return User{}, User{}, ErrUserNotFound
+	}
+	before := copyUser(u.User)
+	now := memoryNow()
+	name, email := erasedName, erasedEmail(id)
+	u.Name, u.Email, u.Link, u.ThumbnailLink, u.Thumbnails = name, email, "", "", nil
+	u.LastLoginAt, u.Metadata, u.EmailVerifiedAt = nil, UserMetadata{}, nil
+	if u.DeletedAt == nil {
+		u.DeletedAt = &now
+	}
+	u.erasedAt = &now
+	m.write(u, now)
+	after := copyUser(u.User)
+
+	m.forgetSignIns(id)
+	maps.DeleteFunc(m.identities, func(_ memoryIdentity, userID int64) bool { return userID == id })
+	maps.DeleteFunc(m.sessions, func(_ int64, s *memorySession) bool { return s.UserID == id })
+	// Audit snapshots keep what changed, but not who the user was
+	scrub := func(state *User) *User {
+		if state == nil {
+			return nil
+		}
+		scrubbed := copyUser(*state)
+		scrubbed.Name, scrubbed.Email, scrubbed.Link, scrubbed.ThumbnailLink, scrubbed.Thumbnails, scrubbed.Metadata = name, email, "", "", nil, UserMetadata{}
+		return &scrubbed
+	}
+	for i, event := range m.audit {
+		if event.TenantID == tenant && event.UserID == id {
+			m.audit[i].Before, m.audit[i].After = scrub(event.Before), scrub(event.After)
+		}
+	}
+	if err := m.enqueueOutboxEvent(ctx, after); err != nil {
+		return User{}, User{}, err
+	}
+	return before, after, nil
+}
+
+func (m *MemoryStore) VerifyEmail(ctx context.Context, tenant string, id int64, email string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.liveUser(tenant, id)
+	if !ok || !strings.EqualFold(u.Email, email) {
+		return User{}, ErrUserNotFound
+	}
+	now := memoryNow()
+	if u.EmailVerifiedAt == nil {
+		u.EmailVerifiedAt = &now
+	}
+	m.write(u, now)
+	return copyUser(u.User), nil
+}
+
+func (m *MemoryStore) LockUser(ctx context.Context, id int64) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok || u.LockedAt != nil || u.DeletedAt != nil {
+		return User{}, ErrUserNotFound
+	}
+	previous := u.User
+	now := memoryNow()
+	u.LockedAt = &now
+	m.write(u, now)
+	if err := m.enqueueOutboxEvent(ctx, copyUser(u.User)); err != nil {
+		u.User = previous
+		return User{}, err
+	}
+	m.revokeSessions(id)
+	return copyUser(u.User), nil
+}
+
+func (m *MemoryStore) UnlockUser(ctx context.Context, tenant string, id int64) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.liveUser(tenant, id)
+	if !ok || u.LockedAt == nil {
+		return User{}, ErrUserNotFound
+	}
+	u.LockedAt = nil
+	m.write(u, memoryNow())
+	m.authFailures = slices.DeleteFunc(m.authFailures, func(f memoryAuthFailure) bool { return f.userID == id })
+	return copyUser(u.User), nil
+}
+
+func (m *MemoryStore) CreateGroup(ctx context.Context, group Group) (Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, g := range m.groups {
+		if g.TenantID == group.TenantID && strings.EqualFold(g.Name, group.Name) {
+			return Group{}, ErrDuplicateGroup
+		}
+	}
+	group.ID, group.CreatedAt = m.nextID("user_groups"), memoryNow()
+	m.groups[group.ID] = group
+	return group, nil
+}
+
+func (m *MemoryStore) AddGroupMember(ctx context.Context, tenant string, groupID, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if g, ok := m.groups[groupID]; !ok || g.TenantID != tenant {
+		return ErrGroupNotFound
+	}
+	if _, ok := m.liveUser(tenant, userID); !ok {
+		return ErrUserNotFound
+	}
+	if m.members[groupID] == nil {
+		m.members[groupID] = map[int64]bool{}
+	}
+	m.members[groupID][userID] = true
+	return nil
+}
+
+func (m *MemoryStore) ListUserGroups(ctx context.Context, tenant string, userID int64) ([]Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	groups := []Group{}
+	for _, id := range slices.Sorted(maps.Keys(m.groups)) {
+		if g := m.groups[id]; g.TenantID == tenant && m.members[id][userID] {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+func (m *MemoryStore) CreateWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	webhook.ID, webhook.CreatedAt = m.nextID("webhooks"), memoryNow()
+	webhook.Events = slices.Clone(webhook.Events)
+	m.webhooks[webhook.ID] = webhook
+	// The secret is read back only by ListSubscribedWebhooks
+	webhook.Secret = ""
+	return webhook, nil
+}
+
+func (m *MemoryStore) ListWebhooks(ctx context.Context, tenant string) ([]Webhook, error) {
+	return m.selectWebhooks(tenant, func(w Webhook) bool { return true }, false), nil
+}
+
+func (m *MemoryStore) ListSubscribedWebhooks(ctx context.Context, tenant, eventType string) ([]Webhook, error) {
+	return m.selectWebhooks(tenant, func(w Webhook) bool { return slices.Contains(w.Events, eventType) }, true), nil
+}
+
+// selectWebhooks returns the tenant's webhooks that match, in ID order, and
+// their secrets when withSecret is set
+func (m *MemoryStore) selectWebhooks(tenant string, match func(Webhook) bool, withSecret bool) []Webhook {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	webhooks := []Webhook{}
+	for _, id := range slices.Sorted(maps.Keys(m.webhooks)) {
+		webhook := m.webhooks[id]
+		if webhook.TenantID != tenant || !match(webhook) {
+			continue
+		}
+		webhook.Events = slices.Clone(webhook.Events)
+		if !withSecret {
+			webhook.Secret = ""
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks
+}
+
+func (m *MemoryStore) DeleteWebhook(ctx context.Context, tenant string, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if w, ok := m.webhooks[id]; !ok || w.TenantID != tenant {
+		return ErrWebhookNotFound
+	}
+	delete(m.webhooks, id)
+	m.attempts = slices.DeleteFunc(m.attempts, func(a WebhookAttempt) bool { return a.WebhookID == id })
+	return nil
+}
+
+func (m *MemoryStore) RecordWebhookAttempt(ctx context.Context, attempt WebhookAttempt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[attempt.WebhookID]; !ok {
+		return nil
+	}
+	attempt.ID, attempt.AttemptedAt = m.nextID("webhook_deliveries"), memoryNow()
+	m.attempts = append(m.attempts, attempt)
+	return nil
+}
+
+func (m *MemoryStore) ListWebhookAttempts(ctx context.Context, tenant string, webhookID int64, limit int) ([]WebhookAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if w, ok := m.webhooks[webhookID]; !ok || w.TenantID != tenant {
+		return nil, ErrWebhookNotFound
+	}
+	attempts := []WebhookAttempt{}
+	for i := len(m.attempts) - 1; i >= 0 && len(attempts) < limit; i-- {
+		if m.attempts[i].WebhookID == webhookID {
+			attempts = append(attempts, m.attempts[i])
+		}
+	}
+	return attempts, nil
+}
+
+// finishedAt is when a job that reached status finished: now, unless it still runs
+func finishedAt(status string, running ...string) *time.Time {
+	if slices.Contains(running, status) {
+		return nil
+	}
+	return toPtr(memoryNow())
+}
+
+func (m *MemoryStore) CreateImportJob(ctx context.Context, job ImportJob) (ImportJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := memoryNow()
+	job = ImportJob{ID: m.nextID("import_jobs"), TenantID: job.TenantID, Status: job.Status, Filename: job.Filename, CreatedAt: now, UpdatedAt: now}
+	m.importJobs[job.ID] = job
+	return job, nil
+}
+
+func (m *MemoryStore) UpdateImportJob(ctx context.Context, job ImportJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.importJobs[job.ID]
+	if !ok || stored.TenantID != job.TenantID {
+		return nil
+	}
+	stored.Status, stored.Rows, stored.Created, stored.Failed, stored.Error = job.Status, job.Rows, job.Created, job.Failed, job.Error
+	stored.UpdatedAt, stored.FinishedAt = memoryNow(), finishedAt(job.Status, ImportRunning)
+	m.importJobs[job.ID] = stored
+	return nil
+}
+
+func (m *MemoryStore) GetImportJob(ctx context.Context, tenant string, id int64) (ImportJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.importJobs[id]
+	if !ok || job.TenantID != tenant {
+		return ImportJob{}, ErrImportNotFound
+	}
+	return job, nil
+}
+
+func (m *MemoryStore) ListImportJobs(ctx context.Context, tenant string, limit int) ([]ImportJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := []ImportJob{}
+	for _, id := range slices.Backward(slices.Sorted(maps.Keys(m.importJobs))) {
+		if job := m.importJobs[id]; job.TenantID == tenant && len(jobs) < limit {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+func (m *MemoryStore) CreateCreationJob(ctx context.Context, job CreationJob) (CreationJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := memoryNow()
+	job = CreationJob{ID: m.nextID("creation_jobs"), TenantID: job.TenantID, Status: job.Status, CreatedAt: now, UpdatedAt: now}
+	m.creationJobs[job.ID] = job
+	return job, nil
+}
+
+func (m *MemoryStore) UpdateCreationJob(ctx context.Context, job CreationJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.creationJobs[job.ID]
+	if !ok || stored.TenantID != job.TenantID {
+		return nil
+	}
+	stored.Status, stored.Error = job.Status, job.Error
+	stored.UserID = nil
+	if job.UserID != nil {
+		stored.UserID = toPtr(*job.UserID)
+	}
+	stored.UpdatedAt, stored.FinishedAt = memoryNow(), finishedAt(job.Status, JobPending, JobRunning)
+	m.creationJobs[job.ID] = stored
+	return nil
+}
+
+func (m *MemoryStore) GetCreationJob(ctx context.Context, tenant string, id int64) (CreationJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.creationJobs[id]
+	if !ok || job.TenantID != tenant {
+		return CreationJob{}, ErrJobNotFound
+	}
+	return job, nil
+}
+
+func (m *MemoryStore) CreateAPIKey(ctx context.Context, key APIKey, hash []byte) (APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key = APIKey{ID: m.nextID("api_keys"), Name: key.Name, Prefix: key.Prefix, Scopes: slices.Clone(key.Scopes), CreatedAt: memoryNow(), Tenant: key.Tenant}
+	m.apiKeys[key.ID] = &memoryAPIKey{APIKey: key, hash: bytes.Clone(hash)}
+	return key, nil
+}
+
+func (m *MemoryStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := []APIKey{}
+	for _, id := range slices.Sorted(maps.Keys(m.apiKeys)) {
+		keys = append(keys, m.apiKeys[id].APIKey)
+	}
+	return keys, nil
+}
+
+func (m *MemoryStore) LookupAPIKey(ctx context.Context, hash []byte) (APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range m.apiKeys {
+		if key.RevokedAt == nil && bytes.Equal(key.hash, hash) {
+			return key.APIKey, nil
+		}
+	}
+	return APIKey{}, ErrAPIKeyNotFound
+}
+
+func (m *MemoryStore) RevokeAPIKey(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.apiKeys[id]
+	if !ok || key.RevokedAt != nil {
+		return ErrAPIKeyNotFound
+	}
+	key.RevokedAt = toPtr(memoryNow())
+	return nil
+}
+
+func (m *MemoryStore) CreateSession(ctx context.Context, session Session, refreshHash []byte) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session.ID, session.TwoFactorAt = m.nextID("sessions"), nil
+	m.sessions[session.ID] = &memorySession{Session: session, refreshHash: bytes.Clone(refreshHash)}
+	return session, nil
+}
+
+// liveSession is the unrevoked, unexpired session that matches
+func (m *MemoryStore) liveSession(match func(*memorySession) bool) (*memorySession, bool) {
+	now := memoryNow()
+	for _, s := range m.sessions {
+		if !s.revoked && s.ExpiresAt.After(now) && match(s) {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+func (m *MemoryStore) RotateSession(ctx context.Context, refreshHash, newHash []byte, expiresAt time.Time) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.liveSession(func(s *memorySession) bool { return bytes.Equal(s.refreshHash, refreshHash) })
+	if !ok {
+		return Session{}, ErrNoSession
+	}
+	s.refreshHash, s.ExpiresAt = bytes.Clone(newHash), expiresAt
+	return s.Session, nil
+}
+
+func (m *MemoryStore) RevokeSession(ctx context.Context, refreshHash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.liveSession(func(s *memorySession) bool { return bytes.Equal(s.refreshHash, refreshHash) })
+	if !ok {
+		return ErrNoSession
+	}
+	s.revoked = true
+	return nil
+}
+
+func (m *MemoryStore) VerifySessionTwoFactor(ctx context.Context, id int64) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.liveSession(func(s *memorySession) bool { return s.ID == id })
+	if !ok {
+		return Session{}, ErrNoSession
+	}
+	s.TwoFactorPending, s.TwoFactorAt = false, toPtr(memoryNow())
+	return s.Session, nil
+}
+
+func (m *MemoryStore) SetPasswordHash(ctx context.Context, userID int64, hash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.credentials[userID] = bytes.Clone(hash)
+	return nil
+}
+
+func (m *MemoryStore) GetPasswordHash(ctx context.Context, userID int64) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash, ok := m.credentials[userID]
+	if !ok {
+		return nil, ErrNoPassword
+	}
+	return bytes.Clone(hash), nil
+}
+
+// copyPicture is a picture as a query would return it
+func copyPicture(p *memoryPicture) StoredPicture {
+	picture := p.StoredPicture
+	picture.SHA256 = bytes.Clone(picture.SHA256)
+	picture.Thumbnails = maps.Clone(picture.Thumbnails)
+	if len(picture.Thumbnails) == 0 {
+		picture.Thumbnails = nil
+	}
+	return picture
+}
+
+func (m *MemoryStore) AcquirePicture(ctx context.Context, tenant string, sha256 []byte) (StoredPicture, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.acquirePicture(tenant, sha256)
+}
+
+func (m *MemoryStore) acquirePicture(tenant string, sha256 []byte) (StoredPicture, error) {
+	for _, p := range m.pictures {
+		if p.tenant == tenant && bytes.Equal(p.SHA256, sha256) {
+			p.refs++
+			return copyPicture(p), nil
+		}
+	}
+	return StoredPicture{}, ErrPictureNotFound
+}
+
+func (m *MemoryStore) AddPicture(ctx context.Context, tenant string, picture StoredPicture) (StoredPicture, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stored, err := m.acquirePicture(tenant, picture.SHA256); err == nil {
+		return stored, false, nil
+	}
+	p := &memoryPicture{StoredPicture: picture, tenant: tenant, refs: 1}
+	p.StoredPicture = copyPicture(p)
+	m.pictures[picture.Blob] = p
+	return picture, true, nil
+}
+
+func (m *MemoryStore) ReleasePicture(ctx context.Context, tenant, blob string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pictures[blob]
+	if !ok || p.tenant != tenant {
+		return true, nil
+	}
+	if p.refs > 1 {
+		p.refs--
+		return false, nil
+	}
+	delete(m.pictures, blob)
+	return true, nil
+}
+
+func (m *MemoryStore) ForgetPicture(ctx context.Context, blob string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pictures, blob)
+	return nil
+}
+
+func (m *MemoryStore) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]events.OutboxEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := memoryNow()
+	var events []events.OutboxEvent
+	for _, id := range slices.Sorted(maps.Keys(m.outbox)) {
+		if len(events) == limit {
+			break
+		}
+		e := m.outbox[id]
+		if e.lockedUntil.After(now) {
+			continue
+		}
+		e.lockedUntil = now.Add(lease)
+		e.Attempts++
+		event := e.OutboxEvent
+		event.Body, event.TraceContext = bytes.Clone(event.Body), maps.Clone(event.TraceContext)
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (m *MemoryStore) DeleteOutboxEvent(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.outbox, id)
+	return nil
+}
+
+func (m *MemoryStore) FailOutboxEvent(ctx context.Context, id int64, reason string, retryAfter time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.outbox[id]; ok {
+		e.lastError = reason[:min(len(reason), 1024)]
+		e.lockedUntil = memoryNow().Add(retryAfter)
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreatePasswordReset(ctx context.Context, userID int64, tokenHash []byte, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resets = append(m.resets, &memoryPasswordReset{userID: userID, tokenHash: bytes.Clone(tokenHash), expiresAt: expiresAt.UTC(), createdAt: memoryNow()})
+	return nil
+}
+
+func (m *MemoryStore) CountPasswordResets(ctx context.Context, userID int64, since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, r := range m.resets {
+		if r.userID == userID && !r.createdAt.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// liveReset is the unused, unexpired reset with this token
+func (m *MemoryStore) liveReset(tokenHash []byte) (*memoryPasswordReset, bool) {
+	now := memoryNow()
+	for _, r := range m.resets {
+		if !r.used && r.expiresAt.After(now) && bytes.Equal(r.tokenHash, tokenHash) {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+func (m *MemoryStore) LookupPasswordReset(ctx context.Context, tokenHash []byte) (string, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.liveReset(tokenHash)
+	if !ok {
+		return "", 0, ErrInvalidReset
+	}
+	u, ok := m.users[r.userID]
+	if !ok || u.DeletedAt != nil {
+		return "", 0, ErrInvalidReset
+	}
+	return u.TenantID, u.ID, nil
+}
+
+func (m *MemoryStore) ResetPassword(ctx context.Context, tokenHash, passwordHash []byte) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.liveReset(tokenHash)
+	if !ok {
+		return 0, ErrInvalidReset
+	}
+	for _, other := range m.resets {
+		if other.userID == r.userID {
+			other.used = true
+		}
+	}
+	m.credentials[r.userID] = bytes.Clone(passwordHash)
+	m.revokeSessions(r.userID)
+	return r.userID, nil
+}
+
+func (m *MemoryStore) EnrollTOTP(ctx context.Context, userID int64, secret []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.totp[userID]; ok && t.EnabledAt != nil {
+		return ErrTOTPEnabled
+	}
+	m.totp[userID] = &memoryTOTP{TOTPSecret: TOTPSecret{Secret: bytes.Clone(secret)}}
+	return nil
+}
+
+func (m *MemoryStore) GetTOTP(ctx context.Context, userID int64) (TOTPSecret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totp[userID]
+	if !ok {
+		return TOTPSecret{}, ErrNoTOTP
+	}
+	return TOTPSecret{Secret: bytes.Clone(t.Secret), EnabledAt: t.EnabledAt}, nil
+}
+
+func (m *MemoryStore) EnableTOTP(ctx context.Context, userID int64, step int64, recoveryHashes [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totp[userID]
+	if !ok || t.EnabledAt != nil {
+		return ErrNoTOTP
+	}
+	t.EnabledAt, t.lastStep = toPtr(memoryNow()), &step
+	var codes []*memoryRecoveryCode
+	for _, hash := range recoveryHashes {
+		codes = append(codes, &memoryRecoveryCode{hash: bytes.Clone(hash)})
+	}
+	m.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (m *MemoryStore) UseTOTPStep(ctx context.Context, userID int64, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totp[userID]
+	if !ok || t.EnabledAt == nil || (t.lastStep != nil && *t.lastStep >= step) {
+		return ErrInvalidCode
+	}
+	t.lastStep = &step
+	return nil
+}
+
+func (m *MemoryStore) UseRecoveryCode(ctx context.Context, userID int64, hash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, code := range m.recoveryCodes[userID] {
+		if !code.used && bytes.Equal(code.hash, hash) {
+			code.used = true
+			return nil
+		}
+	}
+	return ErrInvalidCode
+}
+
+func (m *MemoryStore) RecordAuthFailure(ctx context.Context, userID int64, ip string, since time.Time) (AuthFailureCounts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Failures that fell out of the window are pruned as new ones arrive
+	m.authFailures = slices.DeleteFunc(m.authFailures, func(f memoryAuthFailure) bool { return !f.createdAt.After(since) })
+	m.authFailures = append(m.authFailures, memoryAuthFailure{userID: userID, ip: ip, createdAt: memoryNow()})
+	var counts AuthFailureCounts
+	for _, f := range m.authFailures {
+		if userID != 0 && f.userID == userID {
+			counts.User++
+		}
+		if f.ip == ip {
+			counts.IP++
+		}
+	}
+	return counts, nil
+}
+
+func (m *MemoryStore) CountRequest(ctx context.Context, key string, window time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Past windows are pruned as requests arrive
+	maps.DeleteFunc(m.rateWindows, func(w memoryRateWindow, _ int) bool { return w.start.Before(window) })
+	w := memoryRateWindow{key: key, start: window}
+	m.rateWindows[w]++
+	return m.rateWindows[w], nil
+}
+
+func (m *MemoryStore) SuppressEmail(ctx context.Context, suppression MailSuppression) (MailSuppression, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	suppression.Email = strings.ToLower(suppression.Email)
+	suppression.CreatedAt = memoryNow()
+	if existing, ok := m.suppressions[suppression.Email]; ok {
+		suppression.CreatedAt = existing.CreatedAt
+	}
+	m.suppressions[suppression.Email] = suppression
+	return suppression, nil
+}
+
+func (m *MemoryStore) IsEmailSuppressed(ctx context.Context, email string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.suppressions[strings.ToLower(email)]
+	return ok, nil
+}
+
+func (m *MemoryStore) ListMailSuppressions(ctx context.Context) ([]MailSuppression, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	suppressions := []MailSuppression{}
+	for _, email := range slices.Sorted(maps.Keys(m.suppressions)) {
+		suppressions = append(suppressions, m.suppressions[email])
+	}
+	return suppressions, nil
+}
+
+func (m *MemoryStore) UnsuppressEmail(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	email = strings.ToLower(email)
+	if _, ok := m.suppressions[email]; !ok {
+		return ErrNotSuppressed
+	}
+	delete(m.suppressions, email)
+	return nil
+}
+
+func (m *MemoryStore) ClaimJobRun(ctx context.Context, job string, scheduledAt time.Time, owner string, lease time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := memoryNow()
+	if run, ok := m.jobRuns[job]; ok && (!run.scheduledAt.Before(scheduledAt) || run.lockedUntil.After(now)) {
+		return false, nil
+	}
+	m.jobRuns[job] = &memoryJobRun{scheduledAt: scheduledAt, owner: owner, lockedUntil: now.Add(lease)}
+	return true, nil
+}
+
+func (m *MemoryStore) FinishJobRun(ctx context.Context, job, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if run, ok := m.jobRuns[job]; ok && run.owner == owner {
+		run.lockedUntil = time.Time{}
+	}
+	return nil
+}
+
+// copyAuditEvent is an event as a query would return it
+func copyAuditEvent(event AuditEvent) AuditEvent {
+	if event.Before != nil {
+		event.Before = toPtr(copyUser(*event.Before))
+	}
+	if event.After != nil {
+		event.After = toPtr(copyUser(*event.After))
+	}
+	event.Changes = nil
+	return event
+}
+
+func (m *MemoryStore) RecordAuditEvents(ctx context.Context, events []AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, event := range events {
+		event = copyAuditEvent(event)
+		event.ID, event.CreatedAt = m.nextID("audit_events"), memoryNow()
+		m.audit = append(m.audit, event)
+	}
+	return nil
+}
+
+func (m *MemoryStore) ListAuditEvents(ctx context.Context, filter AuditFilter, beforeID int64, limit int) ([]AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []AuditEvent
+	for i := len(m.audit) - 1; i >= 0 && len(events) < limit; i-- {
+		event := m.audit[i]
+		if beforeID != 0 && event.ID >= beforeID || !auditEventMatches(event, filter) {
+			continue
+		}
+		events = append(events, copyAuditEvent(event))
+	}
+	return events, nil
+}
+
+func (m *MemoryStore) RecordActivities(ctx context.Context, activities []Activity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, activity := range activities {
+		activity.ID, activity.CreatedAt = m.nextID("user_activities"), memoryNow()
+		m.activities = append(m.activities, activity)
+	}
+	return nil
+}
+
+func (m *MemoryStore) ListActivities(ctx context.Context, tenant string, userID, beforeID int64, limit int) ([]Activity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var activities []Activity
+	for i := len(m.activities) - 1; i >= 0 && len(activities) < limit; i-- {
+		activity := m.activities[i]
+		if beforeID != 0 && activity.ID >= beforeID || activity.TenantID != tenant || activity.UserID != userID {
+			continue
+		}
+		activities = append(activities, activity)
+	}
+	return activities, nil
+}
+
+func (m *MemoryStore) CountAuditEvents(ctx context.Context, filter AuditFilter) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int64
+	for _, event := range m.audit {
+		if auditEventMatches(event, filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// PurgeAuditEvents takes events from the front of m.audit, as they're recorded
+// in time order
+func (m *MemoryStore) PurgeAuditEvents(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	purged := 0
+	for purged < len(m.audit) && purged < limit && m.audit[purged].CreatedAt.Before(cutoff) {
+		purged++
+	}
+	m.audit = slices.Delete(m.audit, 0, purged)
+	return int64(purged), nil
+}
+
+// auditEventMatches reports whether event is one filter selects
+func auditEventMatches(event AuditEvent, filter AuditFilter) bool {
+	switch {
+	case filter.TenantID != "" && event.TenantID != filter.TenantID,
+		filter.UserID != 0 && event.UserID != filter.UserID,
+		filter.Actor != "" && event.Actor != filter.Actor,
+		filter.Action != "" && event.Action != filter.Action,
+		!filter.Since.IsZero() && event.CreatedAt.Before(filter.Since),
+		!filter.Until.IsZero() && !event.CreatedAt.Before(filter.Until):
+		return false
+	}
+	return true
+}
+
+func (m *MemoryStore) ReserveIdempotencyKey(ctx context.Context, keyHash []byte, leaseUntil time.Time) (*IdempotentResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Expired keys, and leases whose request never finished, are pruned as new ones arrive
+	now := memoryNow()
+	maps.DeleteFunc(m.idempotency, func(_ string, k *memoryIdempotencyKey) bool { return !k.expiresAt.After(now) })
+	key, ok := m.idempotency[string(keyHash)]
+	if !ok {
+		m.idempotency[string(keyHash)] = &memoryIdempotencyKey{expiresAt: leaseUntil}
+		return nil, nil
+	}
+	if key.response == nil {
+		return nil, ErrIdempotencyKeyInUse
+	}
+	response := *key.response
+	response.Header, response.Body = response.Header.Clone(), bytes.Clone(response.Body)
+	return &response, nil
+}
+
+func (m *MemoryStore) CompleteIdempotencyKey(ctx context.Context, keyHash []byte, response IdempotentResponse, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if key, ok := m.idempotency[string(keyHash)]; ok {
+		response.Header, response.Body = response.Header.Clone(), bytes.Clone(response.Body)
+		key.response, key.expiresAt = &response, expiresAt
+	}
+	return nil
+}
+
+func (m *MemoryStore) ReleaseIdempotencyKey(ctx context.Context, keyHash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if key, ok := m.idempotency[string(keyHash)]; ok && key.response == nil {
+		delete(m.idempotency, string(keyHash))
+	}
+	return nil
+}
+
+func toPtr[T any](v T) *T {
+	return &v
+}
+
+func deref[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
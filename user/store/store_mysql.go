@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"user/user/events"
+)
+
+// mysqlUserStore is the sqlUserStore with the upserts MySQL spells its own way,
+// against the unique index on active users' emails
+type mysqlUserStore struct {
+	*sqlUserStore
+}
+
+func (s mysqlUserStore) UpsertUser(ctx context.Context, user User) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO users (name, email, link, thumbnail_link, thumbnails, tenant_id) VALUES (@name, @email, @link, @thumbnail, @thumbnails, @tenant) AS new
+		ON DUPLICATE KEY UPDATE
+			name = new.name, link = new.link, thumbnail_link = new.thumbnail_link, thumbnails = new.thumbnails, updated_at = UTC_TIMESTAMP(6)`,
+		sql.Named("tenant", user.TenantID), sql.Named("email", user.Email),
+		sql.Named("name", user.Name), sql.Named("link", user.Link), sql.Named("thumbnail", user.ThumbnailLink), sql.Named("thumbnails", thumbnailsColumn(user.Thumbnails)))
+	return err
+}
+
+func (s mysqlUserStore) UpsertUserByEmail(ctx context.Context, user User) (User, bool, error) {
+	return s.upsertUserByEmail(ctx, user, func(ctx context.Context, tx *sql.Tx, args ...any) (User, bool, error) {
+		// LAST_INSERT_ID(users.id) hands the ID of a user updated back as the
+		// insert ID. MySQL counts a row inserted as 1 affected, updated as 2.
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO users (name, email, link, thumbnail_link, thumbnails, tenant_id, metadata)
+			VALUES (@name, @email, COALESCE(@link, ''), '', '{}', @tenant, COALESCE(@metadata, '{}')) AS new
+			ON DUPLICATE KEY UPDATE
+				id = LAST_INSERT_ID(users.id),
+				name = new.name,
+				link = COALESCE(@link, users.link),
+				thumbnail_link = CASE WHEN @link IS NULL THEN users.thumbnail_link ELSE '' END,
+				thumbnails = CASE WHEN @link IS NULL THEN users.thumbnails ELSE '{}' END,
+				metadata = COALESCE(@metadata, users.metadata),
+				updated_at = UTC_TIMESTAMP(6)`, args...)
+		if err != nil {
+			return User{}, false, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return User{}, false, err
+		}
+		saved, err := scanUser(s.d.insertedRow(ctx, tx, "users", userColumns, result, nil))
+		return saved, n == 1, err
+	})
+}
+
+// mysqlOutboxStore is the sqlOutboxStore claiming events with SKIP LOCKED
+type mysqlOutboxStore struct {
+	*sqlOutboxStore
+}
+
+func (s mysqlOutboxStore) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]events.OutboxEvent, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// SKIP LOCKED passes over rows another dispatcher is claiming right now.
+	// MySQL returns nothing of the rows updated, so the due ones are locked
+	// first, then leased and read by ID.
+	var ids []string
+	var args []any
+	err = queryRows(ctx, tx, func(row interface{ Scan(...any) error }) error {
+		var id int64
+		if err := row.Scan(&id); err != nil {
+			return err
+		}
+		name := fmt.Sprintf("id%d", len(ids))
+		ids, args = append(ids, "@"+name), append(args, sql.Named(name, id))
+		return nil
+	}, `
+		SELECT id FROM outbox_events
+		WHERE locked_until IS NULL OR locked_until < UTC_TIMESTAMP(6)
+		ORDER BY id LIMIT @limit
+		FOR UPDATE SKIP LOCKED`,
+		sql.Named("limit", limit))
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	in := strings.Join(ids, ", ")
+	_, err = tx.ExecContext(ctx, `UPDATE outbox_events SET locked_until = `+s.d.nowPlus("@lease")+`, attempts = attempts + 1 WHERE id IN (`+in+`)`,
+		append(args, sql.Named("lease", lease.Milliseconds()))...)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT `+outboxEventColumns+` FROM outbox_events WHERE id IN (`+in+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	events, err := scanOutboxEvents(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return events, tx.Commit()
+}
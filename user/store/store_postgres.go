@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"user/user/events"
+)
+
+// postgresUserStore is the sqlUserStore with the upserts PostgreSQL spells its
+// own way, against the partial unique index on active users' emails
+type postgresUserStore struct {
+	*sqlUserStore
+}
+
+func (s postgresUserStore) UpsertUser(ctx context.Context, user User) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO users (name, email, link, thumbnail_link, thumbnails, tenant_id) VALUES (@name, @email, @link, @thumbnail, @thumbnails, @tenant)
+		ON CONFLICT (tenant_id, LOWER(email)) WHERE deleted_at IS NULL DO UPDATE SET
+			name = EXCLUDED.name, link = EXCLUDED.link, thumbnail_link = EXCLUDED.thumbnail_link, thumbnails = EXCLUDED.thumbnails, updated_at = now()`,
+		sql.Named("tenant", user.TenantID), sql.Named("email", user.Email),
+		sql.Named("name", user.Name), sql.Named("link", user.Link), sql.Named("thumbnail", user.ThumbnailLink), sql.Named("thumbnails", thumbnailsColumn(user.Thumbnails)))
+	return err
+}
+
+func (s postgresUserStore) UpsertUserByEmail(ctx context.Context, user User) (User, bool, error) {
+	return s.upsertUserByEmail(ctx, user, func(ctx context.Context, tx *sql.Tx, args ...any) (User, bool, error) {
+		// The casts type parameters that may be NULL; xmax is only set on a
+		// row an upsert updated
+		var inserted bool
+		saved, err := scanUser(tx.QueryRowContext(ctx, `
+			INSERT INTO users (name, email, link, thumbnail_link, thumbnails, tenant_id, metadata)
+			VALUES (@name, @email, COALESCE(CAST(@link AS VARCHAR), ''), '', '{}', @tenant, COALESCE(CAST(@metadata AS JSONB), '{}'))
+			ON CONFLICT (tenant_id, LOWER(email)) WHERE deleted_at IS NULL DO UPDATE SET
+				name = EXCLUDED.name,
+				link = COALESCE(CAST(@link AS VARCHAR), users.link),
+				thumbnail_link = CASE WHEN CAST(@link AS VARCHAR) IS NULL THEN users.thumbnail_link ELSE '' END,
+				thumbnails = CASE WHEN CAST(@link AS VARCHAR) IS NULL THEN users.thumbnails ELSE '{}' END,
+				metadata = COALESCE(CAST(@metadata AS JSONB), users.metadata),
+				updated_at = now()
+			RETURNING `+userColumns+`, (xmax = 0) AS inserted`, args...), &inserted)
+		return saved, inserted, err
+	})
+}
+
+// postgresOutboxStore is the sqlOutboxStore claiming events with SKIP LOCKED
+type postgresOutboxStore struct {
+	*sqlOutboxStore
+}
+
+func (s postgresOutboxStore) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]events.OutboxEvent, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	// SKIP LOCKED passes over rows another dispatcher is claiming right now
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE outbox_events SET locked_until = `+s.d.nowPlus("@lease")+`, attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM outbox_events
+			WHERE locked_until IS NULL OR locked_until < now()
+			ORDER BY id LIMIT @limit
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+outboxEventColumns,
+		sql.Named("limit", limit), sql.Named("lease", lease.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanOutboxEvents(rows)
+}
@@ -0,0 +1,2396 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+
+	"user/user/config"
+	"user/user/events"
+)
+
+// Columns selected for a User, in the order scanUser reads them
+const userColumns = "id, name, email, link, thumbnail_link, created_at, tenant_id, deleted_at, updated_at, version, last_login_at, roles, locked_at, metadata, email_verified_at, thumbnails"
+
+// userFieldColumns ties the JSON name of each User field to its column, and to
+// the constant selected in place of the column when a listing leaves it out,
+// which scans into the same type; the dialect's zero time for an empty one.
+// They are in userColumns order.
+var userFieldColumns = []struct{ field, column, placeholder string }{
+	{"id", "id", "0"},
+	{"name", "name", "''"},
+	{"email", "email", "''"},
+	{"link", "link", "''"},
+	{"thumbnailLink", "thumbnail_link", "''"},
+	{"createdAt", "created_at", ""},
+	{"tenantId", "tenant_id", "''"},
+	{"deletedAt", "deleted_at", "NULL"},
+	{"updatedAt", "updated_at", ""},
+	{"version", "version", "NULL"},
+	{"lastLoginAt", "last_login_at", "NULL"},
+	{"roles", "roles", "''"},
+	{"lockedAt", "locked_at", "NULL"},
+	{"metadata", "metadata", "'{}'"},
+	{"emailVerifiedAt", "email_verified_at", "NULL"},
+	{"thumbnails", "thumbnails", "'{}'"},
+}
+
+// userProjection returns the select list reading only these fields of a user,
+// or userColumns for all of them. The ID and sort key are always read, as
+// paging needs them.
+func userProjection(d *Dialect, fields []string, sort UserSort) string {
+	if len(fields) == 0 {
+		return userColumns
+	}
+	columns := make([]string, len(userFieldColumns))
+	for i, c := range userFieldColumns {
+		if c.field == SortByID || c.field == sort.Field || slices.Contains(fields, c.field) {
+			columns[i] = c.column
+		} else if c.placeholder == "" {
+			columns[i] = d.zeroTime + " AS " + c.column
+		} else {
+			columns[i] = c.placeholder + " AS " + c.column
+		}
+	}
+	return strings.Join(columns, ", ")
+}
+
+// Links looked up per ReferencedLinks query
+const maxLinksPerQuery = 1000
+
+// NewSQLStores is every store, backed by the database db connects to, which
+// speaks d. The few statements with no form shared across databases are the
+// PostgreSQL and MySQL stores' own.
+func NewSQLStores(db *sql.DB, replica *ReadReplica, d *Dialect) Stores {
+	users, outbox := newSQLUserStore(db, replica, d), newSQLOutboxStore(db, d)
+	stores := Stores{
+		Users:          users,
+		Audit:          newSQLAuditStore(db, d),
+		Pictures:       newSQLPictureStore(db, d),
+		Outbox:         outbox,
+		Webhooks:       newSQLWebhookStore(db, d),
+		PasswordResets: newSQLPasswordResetStore(db, d),
+		Sessions:       newSQLSessionStore(db, d),
+		TwoFactor:      newSQLTwoFactorStore(db, d),
+		APIKeys:        newSQLAPIKeyStore(db, d),
+		Groups:         newSQLGroupStore(db, d),
+		Credentials:    newSQLCredentialStore(db, d),
+		ImportJobs:     newSQLImportJobStore(db, d),
+		AuthFailures:   newSQLAuthFailureStore(db, d),
+		RateLimits:     newSQLRateLimitStore(db, d),
+		Idempotency:    newSQLIdempotencyStore(db, d),
+		CreationJobs:   newSQLCreationJobStore(db, d),
+		Suppressions:   newSQLMailSuppressionStore(db, d),
+		JobRuns:        newSQLJobRunStore(db, d),
+		Activities:     newSQLActivityStore(db, d),
+	}
+	switch d.driver {
+	case config.DatabaseDriverPostgres:
+		stores.Users, stores.Outbox = postgresUserStore{users}, postgresOutboxStore{outbox}
+	case config.DatabaseDriverMySQL:
+		stores.Users, stores.Outbox = mysqlUserStore{users}, mysqlOutboxStore{outbox}
+	}
+	return stores
+}
+
+// sqlUserStore is the UserStore backed by the users table. Listings, counts,
+// searches and reads of single users made with a context marked by
+// withReplicaReads go to the replica, when there is one.
+type sqlUserStore struct {
+	db      *sql.DB
+	d       *Dialect
+	stmts   *statements
+	replica *ReadReplica // nil without database.replica_connection_string
+}
+
+func newSQLUserStore(db *sql.DB, replica *ReadReplica, d *Dialect) *sqlUserStore {
+	return &sqlUserStore{db: db, d: d, stmts: newStatements(db), replica: replica}
+}
+
+// read runs a query on the replica or the primary, as readOn chooses
+func (s *sqlUserStore) read(ctx context.Context, query func(db *sql.DB, stmts *statements) error) error {
+	return readOn(ctx, s.replica, s.db, s.stmts, query)
+}
+
+func (s *sqlUserStore) ListUsers(ctx context.Context, tenant string, filter UserFilter, sort UserSort) ([]User, error) {
+	where, args := filterClause(s.d, tenant, filter)
+	var users []User
+	err := s.read(ctx, func(db *sql.DB, _ *statements) error {
+		ctx, cancel := withQueryTimeout(ctx)
+		defer cancel()
+		rows, err := db.QueryContext(ctx, `SELECT `+userProjection(s.d, filter.Fields, sort)+` FROM users WHERE `+where+orderClause(sort), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		users, err = scanUsers(rows)
+		return err
+	})
+	return users, err
+}
+
+func (s *sqlUserStore) ListUsersAfter(ctx context.Context, tenant string, after User, limit int, filter UserFilter, sort UserSort) ([]User, error) {
+	where, args := filterClause(s.d, tenant, filter)
+	if after.ID != 0 {
+		// Keyset condition: strictly past the last row in (sort column, id) order
+		op := ">"
+		if sort.Descending {
+			op = "<"
+		}
+		switch sort.Field {
+		case SortByName:
+			where += " AND (name " + op + " @after_key OR (name = @after_key AND id " + op + " @after))"
+			args = append(args, sql.Named("after_key", after.Name))
+		case SortByCreatedAt:
+			where += " AND (created_at " + op + " @after_key OR (created_at = @after_key AND id " + op + " @after))"
+			args = append(args, sql.Named("after_key", after.CreatedAt))
+		default:
+			where += " AND id " + op + " @after"
+		}
+		args = append(args, sql.Named("after", after.ID))
+	}
+	args = append(args, sql.Named("limit", limit))
+	var users []User
+	err := s.read(ctx, func(db *sql.DB, _ *statements) error {
+		ctx, cancel := withQueryTimeout(ctx)
+		defer cancel()
+		rows, err := db.QueryContext(ctx,
+			`SELECT `+s.d.top("@limit")+userProjection(s.d, filter.Fields, sort)+` FROM users WHERE `+where+orderClause(sort)+s.d.limit("@limit"), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		users, err = scanUsers(rows)
+		return err
+	})
+	return users, err
+}
+
+func (s *sqlUserStore) SearchUsers(ctx context.Context, tenant, query string, after SearchHit, limit int) ([]SearchHit, error) {
+	where, args := filterClause(s.d, tenant, UserFilter{Search: query})
+	args = append(args,
+		sql.Named("exact", strings.ToLower(query)),
+		sql.Named("prefix", likeEscaper.Replace(query)+"%"),
+		sql.Named("limit", limit))
+	keyset := ""
+	if after.ID != 0 {
+		keyset = " WHERE relevance > @after_rank OR (relevance = @after_rank AND id > @after)"
+		args = append(args, sql.Named("after_rank", after.Rank), sql.Named("after", after.ID))
+	}
+	var hits []SearchHit
+	err := s.read(ctx, func(db *sql.DB, _ *statements) error {
+		ctx, cancel := withQueryTimeout(ctx)
+		defer cancel()
+		// The ranks are constants, which PostgreSQL can type where parameters would be text
+		rows, err := db.QueryContext(ctx, `
+			SELECT `+s.d.top("@limit")+userColumns+`, relevance FROM (
+				SELECT `+userColumns+`, CASE
+					WHEN LOWER(name) = @exact OR LOWER(email) = @exact THEN `+strconv.Itoa(searchRankExact)+`
+					WHEN `+s.d.like("name", "@prefix")+` OR `+s.d.like("email", "@prefix")+` THEN `+strconv.Itoa(searchRankPrefix)+`
+					ELSE `+strconv.Itoa(searchRankSubstring)+` END AS relevance
+				FROM users WHERE `+where+`
+			) AS matches`+keyset+`
+			ORDER BY relevance, id`+s.d.limit("@limit"), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		hits = nil
+		for rows.Next() {
+			var hit SearchHit
+			hit.User, err = scanUser(rows, &hit.Rank)
+			if err != nil {
+				return err
+			}
+			hits = append(hits, hit)
+		}
+		return rows.Err()
+	})
+	return hits, err
+}
+
+func (s *sqlUserStore) CountUsers(ctx context.Context, tenant string, filter UserFilter) (int64, error) {
+	where, args := filterClause(s.d, tenant, filter)
+	var count int64
+	err := s.read(ctx, func(db *sql.DB, _ *statements) error {
+		ctx, cancel := withQueryTimeout(ctx)
+		defer cancel()
+		return db.QueryRowContext(ctx, `SELECT `+s.d.count+` FROM users WHERE `+where, args...).Scan(&count)
+	})
+	return count, err
+}
+
+func (s *sqlUserStore) ExportUsers(ctx context.Context, tenant string, filter UserFilter, fn func(User) error) error {
+	where, args := filterClause(s.d, tenant, filter)
+	// No per-query timeout: an export legitimately runs as long as the table is big.
+	// The caller's context still stops the query, e.g. when the client disconnects.
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlUserStore) GetUser(ctx context.Context, tenant string, id int64) (User, error) {
+	var user User
+	err := s.read(ctx, func(_ *sql.DB, stmts *statements) error {
+		ctx, cancel := withQueryTimeout(ctx)
+		defer cancel()
+		stmt, err := stmts.prepare(ctx, `SELECT `+userColumns+` FROM users WHERE tenant_id = @tenant AND id = @id AND deleted_at IS NULL`)
+		if err != nil {
+			return err
+		}
+		row := stmt.QueryRowContext(ctx, sql.Named("tenant", tenant), sql.Named("id", id))
+		user, err = notFound(scanUser(row))
+		return err
+	})
+	return user, err
+}
+
+func (s *sqlUserStore) GetUserByEmail(ctx context.Context, tenant, email string) (User, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	stmt, err := s.stmts.prepare(ctx, `SELECT `+userColumns+` FROM users WHERE tenant_id = @tenant AND LOWER(email) = @email AND deleted_at IS NULL`)
+	if err != nil {
+		return User{}, err
+	}
+	row := stmt.QueryRowContext(ctx, sql.Named("tenant", tenant), sql.Named("email", NormalizeEmail(email)))
+	return notFound(scanUser(row))
+}
+
+func (s *sqlUserStore) GetUserByIdentity(ctx context.Context, provider, subject string) (User, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	stmt, err := s.stmts.prepare(ctx, `
+		SELECT `+prefixColumns("u", userColumns)+` FROM users u
+		JOIN user_identities i ON i.user_id = u.id
+		WHERE i.provider = @provider AND i.subject = @subject AND u.deleted_at IS NULL`)
+	if err != nil {
+		return User{}, err
+	}
+	row := stmt.QueryRowContext(ctx, sql.Named("provider", provider), sql.Named("subject", subject))
+	return notFound(scanUser(row))
+}
+
+func (s *sqlUserStore) LinkIdentity(ctx context.Context, userID int64, provider, subject string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO user_identities (provider, subject, user_id) VALUES (@provider, @subject, @user_id)`,
+		sql.Named("provider", provider), sql.Named("subject", subject), sql.Named("user_id", userID))
+	if isDuplicateKeyError(err) {
+		// Linked already, maybe concurrently
+		return nil
+	}
+	return err
+}
+
+func (s *sqlUserStore) ExistingEmails(ctx context.Context, tenant string, emails []string) (map[string]bool, error) {
+	found := make(map[string]bool)
+	if len(emails) == 0 {
+		return found, nil
+	}
+
+	placeholders := make([]string, len(emails))
+	args := make([]any, 0, len(emails)+1)
+	for i, email := range emails {
+		name := fmt.Sprintf("e%d", i)
+		placeholders[i] = "@" + name
+		args = append(args, sql.Named(name, email))
+	}
+	args = append(args, sql.Named("tenant", tenant))
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT DISTINCT LOWER(email) FROM users WHERE tenant_id = @tenant AND deleted_at IS NULL AND LOWER(email) IN (`+strings.Join(placeholders, ", ")+`)`,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		found[email] = true
+	}
+	return found, rows.Err()
+}
+
+func (s *sqlUserStore) ReferencedLinks(ctx context.Context, links []string) (map[string]bool, error) {
+	found := make(map[string]bool)
+	// SQL Server accepts at most 2100 parameters per query, MySQL's repeated ones included
+	for start := 0; start < len(links); start += maxLinksPerQuery {
+		batch := links[start:min(start+maxLinksPerQuery, len(links))]
+		placeholders := make([]string, len(batch))
+		args := make([]any, len(batch))
+		for i, link := range batch {
+			name := fmt.Sprintf("l%d", i)
+			placeholders[i] = "@" + name
+			args[i] = sql.Named(name, link)
+		}
+		in := strings.Join(placeholders, ", ")
+
+		if err := func() error {
+			ctx, cancel := withQueryTimeout(ctx)
+			defer cancel()
+			rows, err := s.db.QueryContext(ctx,
+				`SELECT link FROM users WHERE link IN (`+in+`) UNION SELECT thumbnail_link FROM users WHERE thumbnail_link IN (`+in+`)
+				UNION SELECT variant.value FROM users `+s.d.eachJSONValue("thumbnails", "variant")+` WHERE variant.value IN (`+in+`)`, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var link string
+				if err := rows.Scan(&link); err != nil {
+					return err
+				}
+				found[link] = true
+			}
+			return rows.Err()
+		}(); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+func (s *sqlUserStore) CreateUser(ctx context.Context, user User) (User, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	queryCtx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.d.insertRow(queryCtx, tx, "users", "name, email, link, thumbnail_link, thumbnails, tenant_id, metadata, email_verified_at",
+		"@name, @email, @link, @thumbnail, @thumbnails, @tenant, @metadata, @email_verified_at", userColumns,
+		sql.Named("name", user.Name), sql.Named("email", user.Email), sql.Named("link", user.Link),
+		sql.Named("thumbnail", user.ThumbnailLink), sql.Named("thumbnails", thumbnailsColumn(user.Thumbnails)), sql.Named("tenant", user.TenantID), sql.Named("metadata", metadataColumn(user.Metadata)),
+		sql.Named("email_verified_at", user.EmailVerifiedAt))
+	created, err := scanUser(row)
+	if err != nil {
+		return user, duplicateEmail(err)
+	}
+
+	if err := enqueueOutboxEvent(ctx, tx, created); err != nil {
+		return user, err
+	}
+	return created, tx.Commit()
+}
+
+// enqueueOutboxEvent writes the event ctx is marked with, if any, about user to
+// the outbox in tx
+func enqueueOutboxEvent(ctx context.Context, tx *sql.Tx, user User) error {
+	eventType := outboxEventType(ctx)
+	if eventType == "" {
+		return nil
+	}
+	event, err := newOutboxEvent(ctx, eventType, user)
+	if err != nil {
+		return err
+	}
+	traceContext, err := json.Marshal(event.TraceContext)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO outbox_events (event_type, schema_version, message_id, user_id, tenant_id, body, trace_context)
+		VALUES (@event_type, @schema_version, @message_id, @user_id, @tenant, @body, @trace_context)`,
+		sql.Named("event_type", event.EventType), sql.Named("schema_version", event.SchemaVersion), sql.Named("message_id", event.MessageID),
+		sql.Named("user_id", event.UserID), sql.Named("tenant", event.TenantID), sql.Named("body", event.Body), sql.Named("trace_context", string(traceContext)))
+	return err
+}
+
+func (s *sqlUserStore) BulkCreateUsers(ctx context.Context, tenant string, users []User, results []BulkResult, atomic bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	failed := false
+	for i, user := range users {
+		if results[i].Failed() {
+			failed = true
+			continue
+		}
+
+		// A savepoint per row lets one bad row fail without aborting the others
+		if err := execWithTimeout(ctx, tx, s.d.savepoint("bulk_row")); err != nil {
+			return err
+		}
+		queryCtx, cancel := withQueryTimeout(ctx)
+		created, err := scanUser(s.d.insertRow(queryCtx, tx, "users", "name, email, link, tenant_id, metadata", "@name, @email, @link, @tenant, @metadata", userColumns,
+			sql.Named("name", user.Name), sql.Named("email", user.Email), sql.Named("link", user.Link), sql.Named("tenant", tenant),
+			sql.Named("metadata", metadataColumn(user.Metadata))))
+		cancel()
+		if err == nil {
+			err = enqueueOutboxEvent(ctx, tx, created)
+		}
+		if err == nil {
+			results[i].ID = created.ID
+			continue
+		}
+
+		failed = true
+		if err := execWithTimeout(ctx, tx, s.d.rollbackTo("bulk_row")); err != nil {
+			return err
+		}
+		if isDuplicateKeyError(err) {
+			err = ErrDuplicateEmail
+		} else {
+			slog.ErrorContext(ctx, "Error inserting bulk row", "row", i, "error", err)
+		}
+		results[i].Err = err
+	}
+
+	// In atomic mode any failure discards the whole batch
+	if atomic && failed {
+		for i := range results {
+			results[i].ID = 0
+		}
+		return nil
+	}
+	return tx.Commit()
+}
+
+func (s *sqlUserStore) UpdateUser(ctx context.Context, tenant string, id int64, changes UserChanges) (User, error) {
+	var sets []string
+	var args []any
+	if changes.Name != nil {
+		sets = append(sets, "name = @name")
+		args = append(args, sql.Named("name", *changes.Name))
+	}
+	if changes.Email != nil {
+		// A new address has to be verified again. SQL Server's and PostgreSQL's
+		// SET see the old email throughout, MySQL's what was set before.
+		sets = append(sets, "email_verified_at = CASE WHEN email = @email THEN email_verified_at END", "email = @email")
+		args = append(args, sql.Named("email", *changes.Email))
+	}
+	if changes.Link != nil {
+		sets = append(sets, "link = @link")
+		args = append(args, sql.Named("link", *changes.Link))
+	}
+	if changes.ThumbnailLink != nil {
+		sets = append(sets, "thumbnail_link = @thumbnail")
+		args = append(args, sql.Named("thumbnail", *changes.ThumbnailLink))
+	}
+	if changes.Thumbnails != nil {
+		sets = append(sets, "thumbnails = @thumbnails")
+		args = append(args, sql.Named("thumbnails", thumbnailsColumn(*changes.Thumbnails)))
+	}
+	if changes.Roles != nil {
+		sets = append(sets, "roles = @roles")
+		args = append(args, sql.Named("roles", strings.Join(*changes.Roles, " ")))
+	}
+	if changes.Metadata != nil {
+		sets = append(sets, "metadata = @metadata")
+		args = append(args, sql.Named("metadata", metadataColumn(*changes.Metadata)))
+	}
+	sets = append(sets, "updated_at = "+s.d.now)
+	where := "tenant_id = @tenant AND id = @id AND deleted_at IS NULL"
+	args = append(args, sql.Named("tenant", tenant), sql.Named("id", id))
+	if changes.Version != 0 {
+		where += " AND version = @version"
+		args = append(args, sql.Named("version", versionBytes(changes.Version)))
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	queryCtx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.d.updateRow(queryCtx, tx, "users", strings.Join(sets, ", "), where, userColumns, args...)
+	user, err := notFound(scanUserOrDuplicate(row))
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, ErrUserNotFound) && changes.Version != 0 {
+			// Nothing matched: either the user is gone or someone else updated it first
+			if _, getErr := s.GetUser(ctx, tenant, id); getErr == nil {
+				return user, ErrStaleVersion
+			}
+		}
+		return user, err
+	}
+	if err := enqueueOutboxEvent(ctx, tx, user); err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func (s *sqlUserStore) TouchUser(ctx context.Context, tenant string, id int64) (time.Time, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	var lastLoginAt time.Time
+	err := s.d.updateRow(ctx, s.stmts, "users", "last_login_at = "+s.d.now, "tenant_id = @tenant AND id = @id AND deleted_at IS NULL", "last_login_at",
+		sql.Named("tenant", tenant), sql.Named("id", id)).Scan(&lastLoginAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return lastLoginAt, ErrUserNotFound
+	}
+	return lastLoginAt, err
+}
+
+func (s *sqlUserStore) UpsertUser(ctx context.Context, user User) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		MERGE users WITH (HOLDLOCK) AS target
+		USING (SELECT @tenant AS tenant_id, @email AS email) AS source
+		ON target.tenant_id = source.tenant_id AND target.email = source.email AND target.deleted_at IS NULL
+		WHEN MATCHED THEN
+			UPDATE SET name = @name, link = @link, thumbnail_link = @thumbnail, thumbnails = @thumbnails, updated_at = SYSUTCDATETIME()
+		WHEN NOT MATCHED THEN
+			INSERT (name, email, link, thumbnail_link, thumbnails, tenant_id) VALUES (@name, @email, @link, @thumbnail, @thumbnails, @tenant);`,
+		sql.Named("tenant", user.TenantID), sql.Named("email", user.Email),
+		sql.Named("name", user.Name), sql.Named("link", user.Link), sql.Named("thumbnail", user.ThumbnailLink), sql.Named("thumbnails", thumbnailsColumn(user.Thumbnails)))
+	return err
+}
+
+func (s *sqlUserStore) UpsertUserByEmail(ctx context.Context, user User) (User, bool, error) {
+	return s.upsertUserByEmail(ctx, user, func(ctx context.Context, tx *sql.Tx, args ...any) (User, bool, error) {
+		// HOLDLOCK keeps the range locked from the match to the insert, so two
+		// upserts of a new email don't both insert
+		var action string
+		saved, err := scanUser(tx.QueryRowContext(ctx, `
+			MERGE users WITH (HOLDLOCK) AS target
+			USING (SELECT @tenant AS tenant_id, @email AS email) AS source
+			ON target.tenant_id = source.tenant_id AND LOWER(target.email) = LOWER(source.email) AND target.deleted_at IS NULL
+			WHEN MATCHED THEN
+				UPDATE SET name = @name,
+					link = COALESCE(@link, target.link),
+					thumbnail_link = CASE WHEN @link IS NULL THEN target.thumbnail_link ELSE '' END,
+					thumbnails = CASE WHEN @link IS NULL THEN target.thumbnails ELSE '{}' END,
+					metadata = COALESCE(@metadata, target.metadata),
+					updated_at = SYSUTCDATETIME()
+			WHEN NOT MATCHED THEN
+				INSERT (name, email, link, thumbnail_link, thumbnails, tenant_id, metadata)
+				VALUES (@name, @email, COALESCE(@link, ''), '', '{}', @tenant, COALESCE(@metadata, '{}'))
+			OUTPUT `+prefixColumns("INSERTED", userColumns)+`, $action;`, args...), &action)
+		return saved, action == "INSERT", err
+	})
+}
+
+// upsertUserByEmail saves user with write, which upserts it in the transaction
+// with the @tenant, @email, @name, @link and @metadata parameters, a NULL link or
+// metadata keeping the user's, and reports whether it created the user
+func (s *sqlUserStore) upsertUserByEmail(ctx context.Context, user User, write func(ctx context.Context, tx *sql.Tx, args ...any) (User, bool, error)) (User, bool, error) {
+	// Without a new picture or metadata the user keeps theirs
+	var link, metadata any
+	if user.Link != "" {
+		link = user.Link
+	}
+	if user.Metadata != nil {
+		metadata = metadataColumn(user.Metadata)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, false, err
+	}
+	defer tx.Rollback()
+
+	queryCtx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	saved, created, err := write(queryCtx, tx,
+		sql.Named("tenant", user.TenantID), sql.Named("email", user.Email), sql.Named("name", user.Name),
+		sql.Named("link", link), sql.Named("metadata", metadata))
+	if err != nil {
+		return User{}, false, duplicateEmail(err)
+	}
+	if created && outboxEventType(ctx) != "" {
+		ctx = WithOutboxEvent(ctx, events.UserCreated)
+	}
+	if err := enqueueOutboxEvent(ctx, tx, saved); err != nil {
+		return User{}, false, err
+	}
+	return saved, created, tx.Commit()
+}
+
+func (s *sqlUserStore) DeleteUser(ctx context.Context, tenant string, id int64, hard bool) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The row as deleted is the event's payload
+	var user User
+	if hard {
+		err = s.d.deleteRows(ctx, tx, "users", "tenant_id = @tenant AND id = @id", "", userColumns, func(row interface{ Scan(...any) error }) error {
+			user, err = scanUser(row)
+			return err
+		}, sql.Named("tenant", tenant), sql.Named("id", id))
+		if err == nil && user.ID == 0 {
+			err = sql.ErrNoRows
+		}
+	} else {
+		user, err = scanUser(s.d.updateRow(ctx, tx, "users", "deleted_at = "+s.d.now+", updated_at = "+s.d.now,
+			"tenant_id = @tenant AND id = @id AND deleted_at IS NULL", userColumns,
+			sql.Named("tenant", tenant), sql.Named("id", id)))
+	}
+	user, err = notFound(user, err)
+	if err != nil {
+		return err
+	}
+	if err := enqueueOutboxEvent(ctx, tx, user); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlUserStore) PurgeDeletedUsers(ctx context.Context, cutoff time.Time, limit int) ([]User, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var users []User
+	err = s.d.deleteRows(ctx, tx, "users", "deleted_at < @cutoff", "@limit", userColumns, func(row interface{ Scan(...any) error }) error {
+		user, err := scanUser(row)
+		users = append(users, user)
+		return err
+	}, sql.Named("limit", limit), sql.Named("cutoff", cutoff))
+	if err != nil {
+		return nil, err
+	}
+	return users, tx.Commit()
+}
+
+func (s *sqlUserStore) ListInactiveUsers(ctx context.Context, cutoff time.Time, afterID int64, limit int) ([]User, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	// On the primary, as the users found are about to be deleted
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+s.d.top("@limit")+userColumns+` FROM users
+		WHERE deleted_at IS NULL AND id > @after AND COALESCE(last_login_at, created_at) < @cutoff
+		ORDER BY id`+s.d.limit("@limit"),
+		sql.Named("limit", limit), sql.Named("after", afterID), sql.Named("cutoff", cutoff))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+func (s *sqlUserStore) RestoreUser(ctx context.Context, tenant string, id int64) (User, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.d.updateRow(ctx, s.db, "users", "deleted_at = NULL, updated_at = "+s.d.now,
+		"tenant_id = @tenant AND id = @id AND deleted_at IS NOT NULL AND erased_at IS NULL", userColumns,
+		sql.Named("tenant", tenant), sql.Named("id", id))
+	return notFound(scanUserOrDuplicate(row))
+}
+
+func (s *sqlUserStore) ErasePersonalData(ctx context.Context, tenant string, id int64) (User, User, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, User{}, err
+	}
+	defer tx.Rollback()
+
+	name, email := erasedName, erasedEmail(id)
+	// The user as they were is locked until the erasure commits
+	before, err := scanUser(queryRow(ctx, tx,
+		`SELECT `+userColumns+` FROM users`+s.d.lockHint+` WHERE tenant_id = @tenant AND id = @id AND erased_at IS NULL`+s.d.forUpdate,
+		sql.Named("tenant", tenant), sql.Named("id", id)))
+	if err != nil {
+		before, err = notFound(before, err)
+		return User{}, before, err
+	}
+	after, err := scanUser(s.d.updateRow(ctx, tx, "users",
+		`name = @name, email = @email, link = '', thumbnail_link = '', thumbnails = '{}', last_login_at = NULL, metadata = '{}', email_verified_at = NULL,
+			deleted_at = COALESCE(deleted_at, `+s.d.now+`), erased_at = `+s.d.now+`, updated_at = `+s.d.now,
+		"tenant_id = @tenant AND id = @id", userColumns,
+		sql.Named("name", name), sql.Named("email", email), sql.Named("tenant", tenant), sql.Named("id", id)))
+	if err != nil {
+		return User{}, User{}, err
+	}
+
+	for _, table := range []string{"user_identities", "user_recovery_codes", "user_totp", "user_credentials", "password_resets", "sessions", "auth_failures"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id = @id`, sql.Named("id", id)); err != nil {
+			return User{}, User{}, err
+		}
+	}
+	// Audit snapshots keep what changed, but not who the user was
+	_, err = tx.ExecContext(ctx, `
+		UPDATE audit_events SET
+			before_state = `+s.d.anonymizedUserState("before_state")+`,
+			after_state = `+s.d.anonymizedUserState("after_state")+`
+		WHERE tenant_id = @tenant AND user_id = @id`,
+		sql.Named("id", id), sql.Named("tenant", tenant), sql.Named("name", name), sql.Named("email", email))
+	if err != nil {
+		return User{}, User{}, err
+	}
+	if err := enqueueOutboxEvent(ctx, tx, after); err != nil {
+		return User{}, User{}, err
+	}
+	return before, after, tx.Commit()
+}
+
+func (s *sqlUserStore) VerifyEmail(ctx context.Context, tenant string, id int64, email string) (User, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.d.updateRow(ctx, s.db, "users", "email_verified_at = COALESCE(email_verified_at, "+s.d.now+"), updated_at = "+s.d.now,
+		"tenant_id = @tenant AND id = @id AND email = @email AND deleted_at IS NULL", userColumns,
+		sql.Named("tenant", tenant), sql.Named("id", id), sql.Named("email", email))
+	return notFound(scanUser(row))
+}
+
+func (s *sqlUserStore) LockUser(ctx context.Context, id int64) (User, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(s.d.updateRow(ctx, tx, "users", "locked_at = "+s.d.now+", updated_at = "+s.d.now,
+		"id = @id AND locked_at IS NULL AND deleted_at IS NULL", userColumns,
+		sql.Named("id", id)))
+	if err != nil {
+		return notFound(user, err)
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE sessions SET revoked_at = `+s.d.now+` WHERE user_id = @id AND revoked_at IS NULL`, sql.Named("id", id))
+	if err != nil {
+		return User{}, err
+	}
+	if err := enqueueOutboxEvent(ctx, tx, user); err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func (s *sqlUserStore) UnlockUser(ctx context.Context, tenant string, id int64) (User, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(s.d.updateRow(ctx, tx, "users", "locked_at = NULL, updated_at = "+s.d.now,
+		"tenant_id = @tenant AND id = @id AND locked_at IS NOT NULL AND deleted_at IS NULL", userColumns,
+		sql.Named("tenant", tenant), sql.Named("id", id)))
+	if err != nil {
+		return notFound(user, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM auth_failures WHERE user_id = @id`, sql.Named("id", id)); err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+// filterClause builds the WHERE condition selecting a tenant's users that match filter
+func filterClause(d *Dialect, tenant string, filter UserFilter) (string, []any) {
+	where := "tenant_id = @tenant"
+	args := []any{sql.Named("tenant", tenant)}
+	if !filter.IncludeDeleted {
+		where += " AND deleted_at IS NULL"
+	}
+	if filter.Search != "" {
+		where += " AND (" + d.like("name", "@search") + " OR " + d.like("email", "@search") + ")"
+		args = append(args, sql.Named("search", "%"+likeEscaper.Replace(filter.Search)+"%"))
+	}
+	if filter.Email != "" {
+		where += " AND LOWER(email) = @email"
+		args = append(args, sql.Named("email", NormalizeEmail(filter.Email)))
+	}
+	if !filter.ActiveSince.IsZero() {
+		where += " AND last_login_at >= @active_since"
+		args = append(args, sql.Named("active_since", filter.ActiveSince))
+	}
+	if !filter.CreatedAfter.IsZero() {
+		where += " AND created_at > @created_after"
+		args = append(args, sql.Named("created_after", filter.CreatedAfter))
+	}
+	// Sorted so the same filter always builds the same statement
+	for i, key := range slices.Sorted(maps.Keys(filter.Metadata)) {
+		param := fmt.Sprintf("metadata_%d", i)
+		where += fmt.Sprintf(" AND %s = @%s", d.metadataValue("@"+param+"_path"), param)
+		args = append(args, sql.Named(param+"_path", `$."`+key+`"`), sql.Named(param, filter.Metadata[key]))
+	}
+	return where, args
+}
+
+// orderClause builds the ORDER BY for sort, with id as the tiebreaker
+func orderClause(sort UserSort) string {
+	direction := " ASC"
+	if sort.Descending {
+		direction = " DESC"
+	}
+	switch sort.Field {
+	case SortByName:
+		return " ORDER BY name" + direction + ", id" + direction
+	case SortByCreatedAt:
+		return " ORDER BY created_at" + direction + ", id" + direction
+	default:
+		return " ORDER BY id" + direction
+	}
+}
+
+// likeEscaper makes LIKE wildcards in user input match literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "[", `\[`)
+
+// scanUser reads a row selected with userColumns, followed by any extra columns
+func scanUser(row interface{ Scan(...any) error }, extra ...any) (User, error) {
+	var user User
+	var deletedAt sql.NullTime
+	var version []byte
+	var lastLoginAt sql.NullTime
+	var roles string
+	var lockedAt sql.NullTime
+	var metadata string
+	var emailVerifiedAt sql.NullTime
+	var thumbnails string
+	dest := []any{&user.ID, &user.Name, &user.Email, &user.Link, &user.ThumbnailLink, &user.CreatedAt, &user.TenantID, &deletedAt, &user.UpdatedAt, &version, &lastLoginAt, &roles, &lockedAt, &metadata, &emailVerifiedAt, &thumbnails}
+	err := row.Scan(append(dest, extra...)...)
+	user.Roles = strings.Fields(roles)
+	user.Metadata = scanMetadata(metadata)
+	user.Thumbnails = scanThumbnails(thumbnails)
+	if deletedAt.Valid {
+		user.DeletedAt = &deletedAt.Time
+	}
+	if lastLoginAt.Valid {
+		user.LastLoginAt = &lastLoginAt.Time
+	}
+	if lockedAt.Valid {
+		user.LockedAt = &lockedAt.Time
+	}
+	if emailVerifiedAt.Valid {
+		user.EmailVerifiedAt = &emailVerifiedAt.Time
+	}
+	if len(version) == 8 {
+		// rowversion is an 8-byte big-endian counter
+		user.Version = int64(binary.BigEndian.Uint64(version))
+	}
+	return user, err
+}
+
+// scanMetadata decodes the metadata column; the check constraint keeps it valid JSON
+func scanMetadata(column string) UserMetadata {
+	metadata := UserMetadata{}
+	json.Unmarshal([]byte(column), &metadata)
+	return metadata
+}
+
+// scanThumbnails decodes the thumbnails column, leaving nil when there are none
+// so the field is left out of responses
+func scanThumbnails(column string) ThumbnailLinks {
+	var thumbnails ThumbnailLinks
+	json.Unmarshal([]byte(column), &thumbnails)
+	if len(thumbnails) == 0 {
+		return nil
+	}
+	return thumbnails
+}
+
+// thumbnailsColumn encodes thumbnail links for the thumbnails column
+func thumbnailsColumn(thumbnails ThumbnailLinks) string {
+	return metadataColumn(UserMetadata(thumbnails))
+}
+
+// metadataColumn encodes metadata for the metadata column
+func metadataColumn(metadata UserMetadata) string {
+	if len(metadata) == 0 {
+		return "{}"
+	}
+	data, _ := json.Marshal(metadata)
+	return string(data)
+}
+
+// scanUserOrDuplicate scans the output of a write that may violate the email index
+func scanUserOrDuplicate(row interface{ Scan(...any) error }) (User, error) {
+	user, err := scanUser(row)
+	return user, duplicateEmail(err)
+}
+
+// scanUsers reads every row of a users query
+func scanUsers(rows *sql.Rows) ([]User, error) {
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// versionBytes converts a User.Version back to the rowversion it was read from
+func versionBytes(version int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(version))
+}
+
+// notFound maps sql.ErrNoRows to ErrUserNotFound
+func notFound(user User, err error) (User, error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrUserNotFound
+	}
+	return user, err
+}
+
+// duplicateEmail maps unique index violations to ErrDuplicateEmail
+func duplicateEmail(err error) error {
+	if isDuplicateKeyError(err) {
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+// isDuplicateKeyError reports whether err is a unique constraint or index violation
+func isDuplicateKeyError(err error) bool {
+	var sqlErr mssql.Error
+	if errors.As(err, &sqlErr) {
+		return sqlErr.Number == 2627 || sqlErr.Number == 2601
+	}
+	var pgErr *pq.Error
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505"
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062
+	}
+	return false
+}
+
+// prefixColumns qualifies each column of a comma separated list, e.g. for OUTPUT INSERTED.*
+func prefixColumns(prefix, columns string) string {
+	parts := strings.Split(columns, ", ")
+	for i, column := range parts {
+		parts[i] = prefix + "." + column
+	}
+	return strings.Join(parts, ", ")
+}
+
+// execWithTimeout runs a statement within a transaction under the query timeout
+func execWithTimeout(ctx context.Context, tx *sql.Tx, query string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := tx.ExecContext(ctx, query)
+	return err
+}
+
+// Columns selected for a Group, in the order scanGroup reads them
+const groupColumns = "id, tenant_id, name, description, created_at"
+
+// sqlGroupStore is the GroupStore backed by the user_groups and group_members tables
+type sqlGroupStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLGroupStore(db *sql.DB, d *Dialect) *sqlGroupStore {
+	return &sqlGroupStore{db: db, d: d}
+}
+
+func (s *sqlGroupStore) CreateGroup(ctx context.Context, group Group) (Group, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.d.insertRow(ctx, s.db, "user_groups", "tenant_id, name, description", "@tenant, @name, @description", groupColumns,
+		sql.Named("tenant", group.TenantID), sql.Named("name", group.Name), sql.Named("description", group.Description))
+	created, err := scanGroup(row)
+	if isDuplicateKeyError(err) {
+		return created, ErrDuplicateGroup
+	}
+	return created, err
+}
+
+func (s *sqlGroupStore) AddGroupMember(ctx context.Context, tenant string, groupID, userID int64) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	args := []any{sql.Named("tenant", tenant), sql.Named("group", groupID), sql.Named("user", userID)}
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO group_members (group_id, user_id)
+		SELECT g.id, u.id FROM user_groups g, users u
+		WHERE g.tenant_id = @tenant AND g.id = @group AND u.tenant_id = @tenant AND u.id = @user AND u.deleted_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM group_members WHERE group_id = @group AND user_id = @user)`, args...)
+	if isDuplicateKeyError(err) {
+		// Added concurrently, which is just as good
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	// Nothing inserted: already a member, or the group or user is missing
+	var groupExists, userExists bool
+	err = s.db.QueryRowContext(ctx, `
+		SELECT
+			CASE WHEN EXISTS (SELECT 1 FROM user_groups WHERE tenant_id = @tenant AND id = @group) THEN 1 ELSE 0 END,
+			CASE WHEN EXISTS (SELECT 1 FROM users WHERE tenant_id = @tenant AND id = @user AND deleted_at IS NULL) THEN 1 ELSE 0 END`, args...).
+		Scan(&groupExists, &userExists)
+	switch {
+	case err != nil:
+		return err
+	case !groupExists:
+		return ErrGroupNotFound
+	case !userExists:
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *sqlGroupStore) ListUserGroups(ctx context.Context, tenant string, userID int64) ([]Group, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+prefixColumns("g", groupColumns)+`
+		FROM user_groups g JOIN group_members m ON m.group_id = g.id
+		WHERE g.tenant_id = @tenant AND m.user_id = @user
+		ORDER BY g.id`,
+		sql.Named("tenant", tenant), sql.Named("user", userID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := []Group{}
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+// scanGroup reads a row selected with groupColumns
+func scanGroup(row interface{ Scan(...any) error }) (Group, error) {
+	var group Group
+	err := row.Scan(&group.ID, &group.TenantID, &group.Name, &group.Description, &group.CreatedAt)
+	return group, err
+}
+
+// Columns selected for a Webhook, in the order scanWebhook reads them
+const webhookColumns = "id, tenant_id, url, events, created_at"
+
+// sqlWebhookStore is the WebhookStore backed by the webhooks and webhook_deliveries tables
+type sqlWebhookStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLWebhookStore(db *sql.DB, d *Dialect) *sqlWebhookStore {
+	return &sqlWebhookStore{db: db, d: d}
+}
+
+func (s *sqlWebhookStore) CreateWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.d.insertRow(ctx, s.db, "webhooks", "tenant_id, url, secret, events", "@tenant, @url, @secret, @events", webhookColumns,
+		sql.Named("tenant", webhook.TenantID), sql.Named("url", webhook.URL), sql.Named("secret", webhook.Secret),
+		sql.Named("events", strings.Join(webhook.Events, " ")))
+	return scanWebhook(row)
+}
+
+func (s *sqlWebhookStore) ListWebhooks(ctx context.Context, tenant string) ([]Webhook, error) {
+	return s.queryWebhooks(ctx, `SELECT `+webhookColumns+` FROM webhooks WHERE tenant_id = @tenant ORDER BY id`, false,
+		sql.Named("tenant", tenant))
+}
+
+func (s *sqlWebhookStore) ListSubscribedWebhooks(ctx context.Context, tenant, eventType string) ([]Webhook, error) {
+	// The event type is one of the known ones, so holds no wildcards
+	return s.queryWebhooks(ctx, `
+		SELECT `+webhookColumns+`, secret FROM webhooks
+		WHERE tenant_id = @tenant AND `+s.d.concat("' '", "events", "' '")+` LIKE @pattern
+		ORDER BY id`, true,
+		sql.Named("tenant", tenant), sql.Named("pattern", "% "+eventType+" %"))
+}
+
+// queryWebhooks runs a query selecting webhookColumns, and the secret after
+// them when withSecret is set
+func (s *sqlWebhookStore) queryWebhooks(ctx context.Context, query string, withSecret bool, args ...any) ([]Webhook, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var secret string
+		var extra []any
+		if withSecret {
+			extra = append(extra, &secret)
+		}
+		webhook, err := scanWebhook(rows, extra...)
+		if err != nil {
+			return nil, err
+		}
+		webhook.Secret = secret
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *sqlWebhookStore) DeleteWebhook(ctx context.Context, tenant string, id int64) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, `DELETE FROM webhooks WHERE tenant_id = @tenant AND id = @id`,
+		sql.Named("tenant", tenant), sql.Named("id", id))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (s *sqlWebhookStore) RecordWebhookAttempt(ctx context.Context, attempt WebhookAttempt) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	var status, message any
+	if attempt.StatusCode != 0 {
+		status = attempt.StatusCode
+	}
+	if attempt.Error != "" {
+		message = attempt.Error
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, delivery_id, event_type, user_id, attempt, status_code, error, succeeded)
+		SELECT id, @delivery_id, @event_type, @user_id, @attempt, @status_code, @error, @succeeded FROM webhooks WHERE id = @webhook_id`,
+		sql.Named("webhook_id", attempt.WebhookID), sql.Named("delivery_id", attempt.DeliveryID), sql.Named("event_type", attempt.EventType),
+		sql.Named("user_id", attempt.UserID), sql.Named("attempt", attempt.Attempt), sql.Named("status_code", status),
+		sql.Named("error", message), sql.Named("succeeded", attempt.Succeeded))
+	return err
+}
+
+func (s *sqlWebhookStore) ListWebhookAttempts(ctx context.Context, tenant string, webhookID int64, limit int) ([]WebhookAttempt, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT CASE WHEN EXISTS (SELECT 1 FROM webhooks WHERE tenant_id = @tenant AND id = @id) THEN 1 ELSE 0 END`,
+		sql.Named("tenant", tenant), sql.Named("id", webhookID)).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWebhookNotFound
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+s.d.top("@limit")+`id, webhook_id, delivery_id, event_type, user_id, attempt, status_code, error, succeeded, attempted_at
+		FROM webhook_deliveries WHERE webhook_id = @id
+		ORDER BY id DESC`+s.d.limit("@limit"),
+		sql.Named("limit", limit), sql.Named("id", webhookID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attempts := []WebhookAttempt{}
+	for rows.Next() {
+		var attempt WebhookAttempt
+		var status sql.NullInt64
+		var message sql.NullString
+		err := rows.Scan(&attempt.ID, &attempt.WebhookID, &attempt.DeliveryID, &attempt.EventType, &attempt.UserID,
+			&attempt.Attempt, &status, &message, &attempt.Succeeded, &attempt.AttemptedAt)
+		if err != nil {
+			return nil, err
+		}
+		attempt.StatusCode, attempt.Error = int(status.Int64), message.String
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
+
+// scanWebhook reads a row selected with webhookColumns, then any extra columns
+func scanWebhook(row interface{ Scan(...any) error }, extra ...any) (Webhook, error) {
+	var webhook Webhook
+	var events string
+	err := row.Scan(append([]any{&webhook.ID, &webhook.TenantID, &webhook.URL, &events, &webhook.CreatedAt}, extra...)...)
+	webhook.Events = strings.Fields(events)
+	return webhook, err
+}
+
+// Columns selected for an ImportJob, in the order scanImportJob reads them
+const importJobColumns = "id, tenant_id, status, filename, rows_read, created, failed, error, created_at, updated_at, finished_at"
+
+// sqlImportJobStore is the ImportJobStore backed by the import_jobs table
+type sqlImportJobStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLImportJobStore(db *sql.DB, d *Dialect) *sqlImportJobStore {
+	return &sqlImportJobStore{db: db, d: d}
+}
+
+func (s *sqlImportJobStore) CreateImportJob(ctx context.Context, job ImportJob) (ImportJob, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.d.insertRow(ctx, s.db, "import_jobs", "tenant_id, status, filename", "@tenant, @status, @filename", importJobColumns,
+		sql.Named("tenant", job.TenantID), sql.Named("status", job.Status), sql.Named("filename", job.Filename))
+	return scanImportJob(row)
+}
+
+func (s *sqlImportJobStore) UpdateImportJob(ctx context.Context, job ImportJob) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	var message any
+	if job.Error != "" {
+		message = job.Error
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE import_jobs SET status = @status, rows_read = @rows, created = @created, failed = @failed, error = @error,
+			updated_at = `+s.d.now+`, finished_at = CASE WHEN @status = 'running' THEN NULL ELSE `+s.d.now+` END
+		WHERE tenant_id = @tenant AND id = @id`,
+		sql.Named("status", job.Status), sql.Named("rows", job.Rows), sql.Named("created", job.Created), sql.Named("failed", job.Failed),
+		sql.Named("error", message), sql.Named("tenant", job.TenantID), sql.Named("id", job.ID))
+	return err
+}
+
+func (s *sqlImportJobStore) GetImportJob(ctx context.Context, tenant string, id int64) (ImportJob, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.db.QueryRowContext(ctx, `SELECT `+importJobColumns+` FROM import_jobs WHERE tenant_id = @tenant AND id = @id`,
+		sql.Named("tenant", tenant), sql.Named("id", id))
+	job, err := scanImportJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return job, ErrImportNotFound
+	}
+	return job, err
+}
+
+func (s *sqlImportJobStore) ListImportJobs(ctx context.Context, tenant string, limit int) ([]ImportJob, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT `+s.d.top("@limit")+importJobColumns+` FROM import_jobs WHERE tenant_id = @tenant ORDER BY id DESC`+s.d.limit("@limit"),
+		sql.Named("limit", limit), sql.Named("tenant", tenant))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []ImportJob{}
+	for rows.Next() {
+		job, err := scanImportJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// scanImportJob reads a row selected with importJobColumns
+func scanImportJob(row interface{ Scan(...any) error }) (ImportJob, error) {
+	var job ImportJob
+	var message sql.NullString
+	var finishedAt sql.NullTime
+	err := row.Scan(&job.ID, &job.TenantID, &job.Status, &job.Filename, &job.Rows, &job.Created, &job.Failed, &message,
+		&job.CreatedAt, &job.UpdatedAt, &finishedAt)
+	job.Error = message.String
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return job, err
+}
+
+// Columns selected for a CreationJob, in the order scanCreationJob reads them
+const creationJobColumns = "id, tenant_id, status, user_id, error, created_at, updated_at, finished_at"
+
+// sqlCreationJobStore is the CreationJobStore backed by the creation_jobs table
+type sqlCreationJobStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLCreationJobStore(db *sql.DB, d *Dialect) *sqlCreationJobStore {
+	return &sqlCreationJobStore{db: db, d: d}
+}
+
+func (s *sqlCreationJobStore) CreateCreationJob(ctx context.Context, job CreationJob) (CreationJob, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.d.insertRow(ctx, s.db, "creation_jobs", "tenant_id, status", "@tenant, @status", creationJobColumns,
+		sql.Named("tenant", job.TenantID), sql.Named("status", job.Status))
+	return scanCreationJob(row)
+}
+
+func (s *sqlCreationJobStore) UpdateCreationJob(ctx context.Context, job CreationJob) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	var userID, message any
+	if job.UserID != nil {
+		userID = *job.UserID
+	}
+	if job.Error != "" {
+		message = job.Error
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE creation_jobs SET status = @status, user_id = @user_id, error = @error, updated_at = `+s.d.now+`,
+			finished_at = CASE WHEN @status IN ('pending', 'running') THEN NULL ELSE `+s.d.now+` END
+		WHERE tenant_id = @tenant AND id = @id`,
+		sql.Named("status", job.Status), sql.Named("user_id", userID), sql.Named("error", message),
+		sql.Named("tenant", job.TenantID), sql.Named("id", job.ID))
+	return err
+}
+
+func (s *sqlCreationJobStore) GetCreationJob(ctx context.Context, tenant string, id int64) (CreationJob, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.db.QueryRowContext(ctx, `SELECT `+creationJobColumns+` FROM creation_jobs WHERE tenant_id = @tenant AND id = @id`,
+		sql.Named("tenant", tenant), sql.Named("id", id))
+	job, err := scanCreationJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return job, ErrJobNotFound
+	}
+	return job, err
+}
+
+// scanCreationJob reads a row selected with creationJobColumns
+func scanCreationJob(row interface{ Scan(...any) error }) (CreationJob, error) {
+	var job CreationJob
+	var userID sql.NullInt64
+	var message sql.NullString
+	var finishedAt sql.NullTime
+	err := row.Scan(&job.ID, &job.TenantID, &job.Status, &userID, &message, &job.CreatedAt, &job.UpdatedAt, &finishedAt)
+	if userID.Valid {
+		job.UserID = &userID.Int64
+	}
+	job.Error = message.String
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return job, err
+}
+
+// Columns selected for an APIKey, in the order scanAPIKey reads them
+const apiKeyColumns = "id, name, prefix, scopes, created_at, revoked_at, tenant_id"
+
+// sqlAPIKeyStore is the APIKeyStore backed by the api_keys table
+type sqlAPIKeyStore struct {
+	db    *sql.DB
+	d     *Dialect
+	stmts *statements
+}
+
+func newSQLAPIKeyStore(db *sql.DB, d *Dialect) *sqlAPIKeyStore {
+	return &sqlAPIKeyStore{db: db, d: d, stmts: newStatements(db)}
+}
+
+func (s *sqlAPIKeyStore) CreateAPIKey(ctx context.Context, key APIKey, hash []byte) (APIKey, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.d.insertRow(ctx, s.db, "api_keys", "name, prefix, key_hash, scopes, tenant_id", "@name, @prefix, @hash, @scopes, @tenant_id", apiKeyColumns,
+		sql.Named("name", key.Name), sql.Named("prefix", key.Prefix), sql.Named("hash", hash),
+		sql.Named("scopes", strings.Join(key.Scopes, " ")), sql.Named("tenant_id", key.Tenant))
+	return scanAPIKey(row)
+}
+
+func (s *sqlAPIKeyStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqlAPIKeyStore) LookupAPIKey(ctx context.Context, hash []byte) (APIKey, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	stmt, err := s.stmts.prepare(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = @hash AND revoked_at IS NULL`)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key, err := scanAPIKey(stmt.QueryRowContext(ctx, sql.Named("hash", hash)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (s *sqlAPIKeyStore) RevokeAPIKey(ctx context.Context, id int64) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = `+s.d.now+` WHERE id = @id AND revoked_at IS NULL`,
+		sql.Named("id", id))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// scanAPIKey reads a row selected with apiKeyColumns
+func scanAPIKey(row interface{ Scan(...any) error }) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var revokedAt sql.NullTime
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &revokedAt, &key.Tenant)
+	key.Scopes = strings.Fields(scopes)
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, err
+}
+
+// Columns selected for a Session, in the order scanSession reads them
+const sessionColumns = "id, subject, email, admin, expires_at, user_id, mfa_pending, mfa_verified_at, tenant_id"
+
+// sqlSessionStore is the SessionStore backed by the sessions table
+type sqlSessionStore struct {
+	db    *sql.DB
+	d     *Dialect
+	stmts *statements
+}
+
+func newSQLSessionStore(db *sql.DB, d *Dialect) *sqlSessionStore {
+	return &sqlSessionStore{db: db, d: d, stmts: newStatements(db)}
+}
+
+func (s *sqlSessionStore) CreateSession(ctx context.Context, session Session, refreshHash []byte) (Session, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.d.insertRow(ctx, s.db, "sessions", "subject, email, admin, refresh_hash, expires_at, user_id, mfa_pending, tenant_id",
+		"@subject, @email, @admin, @hash, @expires_at, @user_id, @mfa_pending, @tenant_id", sessionColumns,
+		sql.Named("subject", session.Subject), sql.Named("email", session.Email), sql.Named("admin", session.Admin),
+		sql.Named("hash", refreshHash), sql.Named("expires_at", session.ExpiresAt),
+		sql.Named("user_id", sql.NullInt64{Int64: session.UserID, Valid: session.UserID != 0}), sql.Named("mfa_pending", session.TwoFactorPending),
+		sql.Named("tenant_id", session.Tenant))
+	return scanSession(row)
+}
+
+func (s *sqlSessionStore) RotateSession(ctx context.Context, refreshHash, newHash []byte, expiresAt time.Time) (Session, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	session, err := scanSession(s.d.updateRow(ctx, s.stmts, "sessions", "refresh_hash = @new_hash, refreshed_at = "+s.d.now+", expires_at = @expires_at",
+		"refresh_hash = @hash AND revoked_at IS NULL AND expires_at > "+s.d.now, sessionColumns,
+		sql.Named("new_hash", newHash), sql.Named("expires_at", expiresAt), sql.Named("hash", refreshHash)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return session, ErrNoSession
+	}
+	return session, err
+}
+
+func (s *sqlSessionStore) RevokeSession(ctx context.Context, refreshHash []byte) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE sessions SET revoked_at = `+s.d.now+` WHERE refresh_hash = @hash AND revoked_at IS NULL AND expires_at > `+s.d.now,
+		sql.Named("hash", refreshHash))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNoSession
+	}
+	return nil
+}
+
+func (s *sqlSessionStore) VerifySessionTwoFactor(ctx context.Context, id int64) (Session, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	row := s.d.updateRow(ctx, s.db, "sessions", "mfa_pending = @pending, mfa_verified_at = "+s.d.now,
+		"id = @id AND revoked_at IS NULL AND expires_at > "+s.d.now, sessionColumns,
+		sql.Named("pending", false), sql.Named("id", id))
+	session, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return session, ErrNoSession
+	}
+	return session, err
+}
+
+// scanSession reads a row selected with sessionColumns
+func scanSession(row interface{ Scan(...any) error }) (Session, error) {
+	var session Session
+	var userID sql.NullInt64
+	var verifiedAt sql.NullTime
+	err := row.Scan(&session.ID, &session.Subject, &session.Email, &session.Admin, &session.ExpiresAt, &userID, &session.TwoFactorPending, &verifiedAt, &session.Tenant)
+	session.UserID = userID.Int64
+	if verifiedAt.Valid {
+		session.TwoFactorAt = &verifiedAt.Time
+	}
+	return session, err
+}
+
+// sqlCredentialStore is the CredentialStore backed by the user_credentials table
+type sqlCredentialStore struct {
+	db    *sql.DB
+	d     *Dialect
+	stmts *statements
+}
+
+func newSQLCredentialStore(db *sql.DB, d *Dialect) *sqlCredentialStore {
+	return &sqlCredentialStore{db: db, d: d, stmts: newStatements(db)}
+}
+
+func (s *sqlCredentialStore) SetPasswordHash(ctx context.Context, userID int64, hash []byte) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.d.upsert(ctx, s.db, credentialUpsert(s.d), sql.Named("user_id", userID), sql.Named("hash", hash))
+	return err
+}
+
+// credentialUpsert sets the password hash in the @hash parameter of the user in @user_id
+func credentialUpsert(d *Dialect) upsert {
+	return upsert{
+		table:   "user_credentials",
+		keys:    []string{"user_id"},
+		columns: []string{"user_id", "password_hash"},
+		values:  []string{"@user_id", "@hash"},
+		set:     "password_hash = @hash, updated_at = " + d.now,
+	}
+}
+
+func (s *sqlCredentialStore) GetPasswordHash(ctx context.Context, userID int64) ([]byte, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	stmt, err := s.stmts.prepare(ctx, `SELECT password_hash FROM user_credentials WHERE user_id = @user_id`)
+	if err != nil {
+		return nil, err
+	}
+	var hash []byte
+	err = stmt.QueryRowContext(ctx, sql.Named("user_id", userID)).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoPassword
+	}
+	return hash, err
+}
+
+// sqlPictureStore is the PictureStore backed by the pictures table
+type sqlPictureStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLPictureStore(db *sql.DB, d *Dialect) *sqlPictureStore {
+	return &sqlPictureStore{db: db, d: d}
+}
+
+func (s *sqlPictureStore) AcquirePicture(ctx context.Context, tenant string, sha256 []byte) (StoredPicture, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	picture := StoredPicture{SHA256: sha256}
+	var thumbnails string
+	err := s.d.updateRow(ctx, s.db, "pictures", "ref_count = ref_count + 1", "tenant_id = @tenant AND content_sha256 = @sha256",
+		"blob_name, md5, thumbnail_link, thumbnails",
+		sql.Named("tenant", tenant), sql.Named("sha256", sha256)).Scan(&picture.Blob, &picture.Checksum, &picture.ThumbnailLink, &thumbnails)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredPicture{}, ErrPictureNotFound
+	}
+	picture.Thumbnails = scanThumbnails(thumbnails)
+	return picture, err
+}
+
+func (s *sqlPictureStore) AddPicture(ctx context.Context, tenant string, picture StoredPicture) (StoredPicture, bool, error) {
+	queryCtx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(queryCtx, `
+		INSERT INTO pictures (tenant_id, content_sha256, blob_name, md5, thumbnail_link, thumbnails, ref_count)
+		VALUES (@tenant, @sha256, @blob, @md5, @thumbnail_link, @thumbnails, 1)`,
+		sql.Named("tenant", tenant), sql.Named("sha256", picture.SHA256), sql.Named("blob", picture.Blob), sql.Named("md5", picture.Checksum),
+		sql.Named("thumbnail_link", picture.ThumbnailLink), sql.Named("thumbnails", thumbnailsColumn(picture.Thumbnails)))
+	if isDuplicateKeyError(err) {
+		stored, err := s.AcquirePicture(ctx, tenant, picture.SHA256)
+		return stored, false, err
+	}
+	return picture, err == nil, err
+}
+
+func (s *sqlPictureStore) ReleasePicture(ctx context.Context, tenant, blob string) (bool, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Locked until the commit, so a concurrent acquire either comes first and
+	// keeps the picture or finds it gone and uploads its own
+	args := []any{sql.Named("tenant", tenant), sql.Named("blob", blob)}
+	var refs int
+	err = queryRow(ctx, tx, `SELECT ref_count FROM pictures`+s.d.lockHint+` WHERE tenant_id = @tenant AND blob_name = @blob`+s.d.forUpdate, args...).Scan(&refs)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Released already
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if refs > 1 {
+		_, err = tx.ExecContext(ctx, `UPDATE pictures SET ref_count = ref_count - 1 WHERE tenant_id = @tenant AND blob_name = @blob`, args...)
+	} else {
+		_, err = tx.ExecContext(ctx, `DELETE FROM pictures WHERE tenant_id = @tenant AND blob_name = @blob`, args...)
+	}
+	if err != nil {
+		return false, err
+	}
+	return refs <= 1, tx.Commit()
+}
+
+func (s *sqlPictureStore) ForgetPicture(ctx context.Context, blob string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `DELETE FROM pictures WHERE blob_name = @blob`, sql.Named("blob", blob))
+	return err
+}
+
+// Columns selected for an OutboxEvent, in the order scanOutboxEvents reads them
+const outboxEventColumns = "id, event_type, schema_version, message_id, user_id, tenant_id, body, trace_context, attempts, created_at"
+
+// sqlOutboxStore is the OutboxStore backed by the outbox_events table
+type sqlOutboxStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLOutboxStore(db *sql.DB, d *Dialect) *sqlOutboxStore {
+	return &sqlOutboxStore{db: db, d: d}
+}
+
+func (s *sqlOutboxStore) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]events.OutboxEvent, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	// READPAST skips rows another dispatcher is claiming right now
+	rows, err := s.db.QueryContext(ctx, `
+		WITH due AS (
+			SELECT TOP (@limit) id, event_type, schema_version, message_id, user_id, tenant_id, body, trace_context, attempts, created_at, locked_until
+			FROM outbox_events WITH (READPAST, UPDLOCK, ROWLOCK)
+			WHERE locked_until IS NULL OR locked_until < SYSUTCDATETIME()
+			ORDER BY id
+		)
+		UPDATE due SET locked_until = DATEADD(millisecond, @lease, SYSUTCDATETIME()), attempts = attempts + 1
+		OUTPUT `+prefixColumns("INSERTED", outboxEventColumns),
+		sql.Named("limit", limit), sql.Named("lease", lease.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanOutboxEvents(rows)
+}
+
+// scanOutboxEvents reads every row of a query selecting outboxEventColumns, in
+// order of ID
+func scanOutboxEvents(rows *sql.Rows) ([]events.OutboxEvent, error) {
+	var batch []events.OutboxEvent
+	for rows.Next() {
+		var event events.OutboxEvent
+		var traceContext string
+		if err := rows.Scan(&event.ID, &event.EventType, &event.SchemaVersion, &event.MessageID, &event.UserID, &event.TenantID,
+			&event.Body, &traceContext, &event.Attempts, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(traceContext), &event.TraceContext); err != nil {
+			return nil, err
+		}
+		batch = append(batch, event)
+	}
+	// OUTPUT and RETURNING rows come in no particular order
+	slices.SortFunc(batch, func(a, b events.OutboxEvent) int { return cmp.Compare(a.ID, b.ID) })
+	return batch, rows.Err()
+}
+
+func (s *sqlOutboxStore) DeleteOutboxEvent(ctx context.Context, id int64) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `DELETE FROM outbox_events WHERE id = @id`, sql.Named("id", id))
+	return err
+}
+
+func (s *sqlOutboxStore) FailOutboxEvent(ctx context.Context, id int64, reason string, retryAfter time.Duration) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE outbox_events SET last_error = LEFT(@reason, 1024), locked_until = `+s.d.nowPlus("@retry_after")+`
+		WHERE id = @id`,
+		sql.Named("id", id), sql.Named("reason", reason), sql.Named("retry_after", retryAfter.Milliseconds()))
+	return err
+}
+
+// sqlPasswordResetStore is the PasswordResetStore backed by the password_resets table
+type sqlPasswordResetStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLPasswordResetStore(db *sql.DB, d *Dialect) *sqlPasswordResetStore {
+	return &sqlPasswordResetStore{db: db, d: d}
+}
+
+func (s *sqlPasswordResetStore) CreatePasswordReset(ctx context.Context, userID int64, tokenHash []byte, expiresAt time.Time) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (@user_id, @hash, @expires_at)`,
+		sql.Named("user_id", userID), sql.Named("hash", tokenHash), sql.Named("expires_at", expiresAt.UTC()))
+	return err
+}
+
+func (s *sqlPasswordResetStore) CountPasswordResets(ctx context.Context, userID int64, since time.Time) (int, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM password_resets WHERE user_id = @user_id AND created_at >= @since`,
+		sql.Named("user_id", userID), sql.Named("since", since.UTC())).Scan(&n)
+	return n, err
+}
+
+func (s *sqlPasswordResetStore) LookupPasswordReset(ctx context.Context, tokenHash []byte) (string, int64, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	var tenant string
+	var userID int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT u.tenant_id, u.id FROM password_resets r JOIN users u ON u.id = r.user_id
+		WHERE r.token_hash = @hash AND r.used_at IS NULL AND r.expires_at > `+s.d.now+` AND u.deleted_at IS NULL`,
+		sql.Named("hash", tokenHash)).Scan(&tenant, &userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, ErrInvalidReset
+	}
+	return tenant, userID, err
+}
+
+func (s *sqlPasswordResetStore) ResetPassword(ctx context.Context, tokenHash, passwordHash []byte) (int64, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Using the token up first settles which of two racing resets wins
+	var userID int64
+	err = s.d.updateRow(ctx, tx, "password_resets", "used_at = "+s.d.now,
+		"token_hash = @hash AND used_at IS NULL AND expires_at > "+s.d.now, "user_id",
+		sql.Named("hash", tokenHash)).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInvalidReset
+	}
+	if err != nil {
+		return 0, err
+	}
+	args := []any{sql.Named("user_id", userID), sql.Named("hash", passwordHash)}
+	if _, err := tx.ExecContext(ctx, `UPDATE password_resets SET used_at = `+s.d.now+` WHERE user_id = @user_id AND used_at IS NULL`, args...); err != nil {
+		return 0, err
+	}
+	if _, err := s.d.upsert(ctx, tx, credentialUpsert(s.d), args...); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE sessions SET revoked_at = `+s.d.now+` WHERE user_id = @user_id AND revoked_at IS NULL`, args...); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// sqlTwoFactorStore is the TwoFactorStore backed by the user_totp and
+// user_recovery_codes tables
+type sqlTwoFactorStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLTwoFactorStore(db *sql.DB, d *Dialect) *sqlTwoFactorStore {
+	return &sqlTwoFactorStore{db: db, d: d}
+}
+
+func (s *sqlTwoFactorStore) EnrollTOTP(ctx context.Context, userID int64, secret []byte) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	// A secret not yet enabled is replaced, an enabled one kept
+	written, err := s.d.upsert(ctx, s.db, upsert{
+		table:   "user_totp",
+		keys:    []string{"user_id"},
+		columns: []string{"user_id", "secret"},
+		values:  []string{"@user_id", "@secret"},
+		set:     "secret = @secret, last_step = NULL, created_at = " + s.d.now,
+		where:   "user_totp.enabled_at IS NULL",
+	}, sql.Named("user_id", userID), sql.Named("secret", secret))
+	if err != nil {
+		return err
+	}
+	if !written {
+		return ErrTOTPEnabled
+	}
+	return nil
+}
+
+func (s *sqlTwoFactorStore) GetTOTP(ctx context.Context, userID int64) (TOTPSecret, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	var totp TOTPSecret
+	var enabledAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, `SELECT secret, enabled_at FROM user_totp WHERE user_id = @user_id`,
+		sql.Named("user_id", userID)).Scan(&totp.Secret, &enabledAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return totp, ErrNoTOTP
+	}
+	if enabledAt.Valid {
+		totp.EnabledAt = &enabledAt.Time
+	}
+	return totp, err
+}
+
+func (s *sqlTwoFactorStore) EnableTOTP(ctx context.Context, userID int64, step int64, recoveryHashes [][]byte) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		`UPDATE user_totp SET enabled_at = `+s.d.now+`, last_step = @step WHERE user_id = @user_id AND enabled_at IS NULL`,
+		sql.Named("step", step), sql.Named("user_id", userID))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNoTOTP
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = @user_id`, sql.Named("user_id", userID)); err != nil {
+		return err
+	}
+	for _, hash := range recoveryHashes {
+		_, err := tx.ExecContext(ctx, `INSERT INTO user_recovery_codes (user_id, code_hash) VALUES (@user_id, @hash)`,
+			sql.Named("user_id", userID), sql.Named("hash", hash))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlTwoFactorStore) UseTOTPStep(ctx context.Context, userID int64, step int64) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE user_totp SET last_step = @step
+		WHERE user_id = @user_id AND enabled_at IS NOT NULL AND (last_step IS NULL OR last_step < @step)`,
+		sql.Named("step", step), sql.Named("user_id", userID))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (s *sqlTwoFactorStore) UseRecoveryCode(ctx context.Context, userID int64, hash []byte) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE user_recovery_codes SET used_at = `+s.d.now+` WHERE user_id = @user_id AND code_hash = @hash AND used_at IS NULL`,
+		sql.Named("user_id", userID), sql.Named("hash", hash))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// sqlAuthFailureStore is the AuthFailureStore backed by the auth_failures table
+type sqlAuthFailureStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLAuthFailureStore(db *sql.DB, d *Dialect) *sqlAuthFailureStore {
+	return &sqlAuthFailureStore{db: db, d: d}
+}
+
+func (s *sqlAuthFailureStore) RecordAuthFailure(ctx context.Context, userID int64, ip string, since time.Time) (AuthFailureCounts, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	// Failures that fell out of the window are pruned a few at a time as new ones arrive
+	var counts AuthFailureCounts
+	args := []any{sql.Named("since", since), sql.Named("user_id", sql.NullInt64{Int64: userID, Valid: userID != 0}), sql.Named("ip", ip)}
+	if _, err := s.d.deleteFirst(ctx, s.db, "auth_failures", "created_at <= @since", "", "100", args...); err != nil {
+		return counts, err
+	}
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO auth_failures (user_id, ip) VALUES (@user_id, @ip)`, args...); err != nil {
+		return counts, err
+	}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM auth_failures WHERE user_id = @user_id AND created_at > @since),
+			(SELECT COUNT(*) FROM auth_failures WHERE ip = @ip AND created_at > @since)`, args...,
+	).Scan(&counts.User, &counts.IP)
+	return counts, err
+}
+
+// sqlRateLimitStore is the RateLimitStore backed by the rate_limit_windows table
+type sqlRateLimitStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLRateLimitStore(db *sql.DB, d *Dialect) *sqlRateLimitStore {
+	return &sqlRateLimitStore{db: db, d: d}
+}
+
+func (s *sqlRateLimitStore) CountRequest(ctx context.Context, key string, window time.Time) (int, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	// Past windows are pruned a few at a time as requests arrive
+	args := []any{sql.Named("key", key), sql.Named("window", window)}
+	if _, err := s.d.deleteFirst(ctx, s.db, "rate_limit_windows", "window_start < @window", "", "100", args...); err != nil {
+		return 0, err
+	}
+	var requests int
+	err := s.d.upsertRow(ctx, s.db, upsert{
+		table:   "rate_limit_windows",
+		keys:    []string{"rate_key", "window_start"},
+		columns: []string{"rate_key", "window_start", "requests"},
+		values:  []string{"@key", "@window", "1"},
+		set:     "requests = rate_limit_windows.requests + 1",
+	}, "requests", args...).Scan(&requests)
+	return requests, err
+}
+
+// sqlMailSuppressionStore is the MailSuppressionStore backed by the
+// mail_suppressions table
+type sqlMailSuppressionStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLMailSuppressionStore(db *sql.DB, d *Dialect) *sqlMailSuppressionStore {
+	return &sqlMailSuppressionStore{db: db, d: d}
+}
+
+func (s *sqlMailSuppressionStore) SuppressEmail(ctx context.Context, suppression MailSuppression) (MailSuppression, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	err := s.d.upsertRow(ctx, s.db, upsert{
+		table:   "mail_suppressions",
+		keys:    []string{"email"},
+		columns: []string{"email", "reason"},
+		values:  []string{"@email", "@reason"},
+		set:     "reason = @reason",
+	}, "email, reason, created_at",
+		sql.Named("email", strings.ToLower(suppression.Email)), sql.Named("reason", suppression.Reason),
+	).Scan(&suppression.Email, &suppression.Reason, &suppression.CreatedAt)
+	return suppression, err
+}
+
+func (s *sqlMailSuppressionStore) IsEmailSuppressed(ctx context.Context, email string) (bool, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	var suppressed bool
+	err := s.db.QueryRowContext(ctx, `SELECT CASE WHEN EXISTS (SELECT 1 FROM mail_suppressions WHERE email = @email) THEN 1 ELSE 0 END`,
+		sql.Named("email", strings.ToLower(email))).Scan(&suppressed)
+	return suppressed, err
+}
+
+func (s *sqlMailSuppressionStore) ListMailSuppressions(ctx context.Context) ([]MailSuppression, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT email, reason, created_at FROM mail_suppressions ORDER BY email`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	suppressions := []MailSuppression{}
+	for rows.Next() {
+		var suppression MailSuppression
+		if err := rows.Scan(&suppression.Email, &suppression.Reason, &suppression.CreatedAt); err != nil {
+			return nil, err
+		}
+		suppressions = append(suppressions, suppression)
+	}
+	return suppressions, rows.Err()
+}
+
+func (s *sqlMailSuppressionStore) UnsuppressEmail(ctx context.Context, email string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, `DELETE FROM mail_suppressions WHERE email = @email`, sql.Named("email", strings.ToLower(email)))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotSuppressed
+	}
+	return nil
+}
+
+// sqlJobRunStore is the JobRunStore backed by the job_runs table
+type sqlJobRunStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLJobRunStore(db *sql.DB, d *Dialect) *sqlJobRunStore {
+	return &sqlJobRunStore{db: db, d: d}
+}
+
+func (s *sqlJobRunStore) ClaimJobRun(ctx context.Context, job string, scheduledAt time.Time, owner string, lease time.Duration) (bool, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	// Leases run on the database's clock, which every instance shares
+	return s.d.upsert(ctx, s.db, upsert{
+		table:   "job_runs",
+		keys:    []string{"job_name"},
+		columns: []string{"job_name", "scheduled_at", "owner", "locked_until"},
+		values:  []string{"@job", "@scheduled_at", "@owner", s.d.nowPlus("@lease")},
+		set: "scheduled_at = @scheduled_at, owner = @owner, locked_until = " + s.d.nowPlus("@lease") + ",\n" +
+			"\t\t\tstarted_at = " + s.d.now + ", finished_at = NULL",
+		where: "job_runs.scheduled_at < @scheduled_at AND (job_runs.locked_until IS NULL OR job_runs.locked_until < " + s.d.now + ")",
+	}, sql.Named("job", job), sql.Named("scheduled_at", scheduledAt), sql.Named("owner", owner), sql.Named("lease", lease.Milliseconds()))
+}
+
+func (s *sqlJobRunStore) FinishJobRun(ctx context.Context, job, owner string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `UPDATE job_runs SET locked_until = NULL, finished_at = `+s.d.now+` WHERE job_name = @job AND owner = @owner`,
+		sql.Named("job", job), sql.Named("owner", owner))
+	return err
+}
+
+// sqlAuditStore is the AuditStore backed by the audit_events table
+type sqlAuditStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLAuditStore(db *sql.DB, d *Dialect) *sqlAuditStore {
+	return &sqlAuditStore{db: db, d: d}
+}
+
+func (s *sqlAuditStore) RecordAuditEvents(ctx context.Context, events []AuditEvent) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO audit_events (tenant_id, actor, action, user_id, before_state, after_state, request_id)
+		VALUES (@tenant, @actor, @action, @user_id, @before, @after, @request_id)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, event := range events {
+		before, err := userState(event.Before)
+		if err != nil {
+			return err
+		}
+		after, err := userState(event.After)
+		if err != nil {
+			return err
+		}
+		queryCtx, cancel := withQueryTimeout(ctx)
+		_, err = stmt.ExecContext(queryCtx, sql.Named("tenant", event.TenantID), sql.Named("actor", event.Actor), sql.Named("action", event.Action),
+			sql.Named("user_id", event.UserID), sql.Named("before", before), sql.Named("after", after),
+			sql.Named("request_id", sql.NullString{String: event.RequestID, Valid: event.RequestID != ""}))
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlAuditStore) ListAuditEvents(ctx context.Context, filter AuditFilter, beforeID int64, limit int) ([]AuditEvent, error) {
+	where, args := auditFilterClause(filter)
+	args = append(args, sql.Named("limit", limit))
+	if beforeID != 0 {
+		where += " AND id < @before_id"
+		args = append(args, sql.Named("before_id", beforeID))
+	}
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+s.d.top("@limit")+`id, tenant_id, actor, action, user_id, before_state, after_state, request_id, created_at
+		FROM audit_events WHERE `+where+` ORDER BY id DESC`+s.d.limit("@limit"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var event AuditEvent
+		var before, after, requestID sql.NullString
+		if err := rows.Scan(&event.ID, &event.TenantID, &event.Actor, &event.Action, &event.UserID, &before, &after, &requestID, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		if event.Before, err = scanUserState(before); err != nil {
+			return nil, err
+		}
+		if event.After, err = scanUserState(after); err != nil {
+			return nil, err
+		}
+		event.RequestID = requestID.String
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqlAuditStore) CountAuditEvents(ctx context.Context, filter AuditFilter) (int64, error) {
+	where, args := auditFilterClause(filter)
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	var count int64
+	err := s.db.QueryRowContext(ctx, `SELECT `+s.d.count+` FROM audit_events WHERE `+where, args...).Scan(&count)
+	return count, err
+}
+
+func (s *sqlAuditStore) PurgeAuditEvents(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	result, err := s.d.deleteFirst(ctx, s.db, "audit_events", "created_at < @cutoff", "created_at", "@limit",
+		sql.Named("limit", limit), sql.Named("cutoff", cutoff))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// sqlActivityStore is the ActivityStore backed by the user_activities table
+type sqlActivityStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLActivityStore(db *sql.DB, d *Dialect) *sqlActivityStore {
+	return &sqlActivityStore{db: db, d: d}
+}
+
+func (s *sqlActivityStore) RecordActivities(ctx context.Context, activities []Activity) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO user_activities (tenant_id, user_id, type, actor, request_id)
+		VALUES (@tenant, @user_id, @type, @actor, @request_id)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, activity := range activities {
+		queryCtx, cancel := withQueryTimeout(ctx)
+		_, err = stmt.ExecContext(queryCtx, sql.Named("tenant", activity.TenantID), sql.Named("user_id", activity.UserID),
+			sql.Named("type", activity.Type), sql.Named("actor", activity.Actor),
+			sql.Named("request_id", sql.NullString{String: activity.RequestID, Valid: activity.RequestID != ""}))
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlActivityStore) ListActivities(ctx context.Context, tenant string, userID, beforeID int64, limit int) ([]Activity, error) {
+	where := "tenant_id = @tenant AND user_id = @user_id"
+	args := []any{sql.Named("tenant", tenant), sql.Named("user_id", userID), sql.Named("limit", limit)}
+	if beforeID != 0 {
+		where += " AND id < @before_id"
+		args = append(args, sql.Named("before_id", beforeID))
+	}
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+s.d.top("@limit")+`id, tenant_id, user_id, type, actor, request_id, created_at
+		FROM user_activities WHERE `+where+` ORDER BY id DESC`+s.d.limit("@limit"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var activities []Activity
+	for rows.Next() {
+		var activity Activity
+		var requestID sql.NullString
+		if err := rows.Scan(&activity.ID, &activity.TenantID, &activity.UserID, &activity.Type, &activity.Actor, &requestID, &activity.CreatedAt); err != nil {
+			return nil, err
+		}
+		activity.RequestID = requestID.String
+		activities = append(activities, activity)
+	}
+	return activities, rows.Err()
+}
+
+// auditFilterClause builds the WHERE conditions and arguments for filter
+func auditFilterClause(filter AuditFilter) (string, []any) {
+	where := "1 = 1"
+	var args []any
+	if filter.TenantID != "" {
+		where += " AND tenant_id = @tenant"
+		args = append(args, sql.Named("tenant", filter.TenantID))
+	}
+	if filter.UserID != 0 {
+		where += " AND user_id = @user_id"
+		args = append(args, sql.Named("user_id", filter.UserID))
+	}
+	if filter.Actor != "" {
+		where += " AND actor = @actor"
+		args = append(args, sql.Named("actor", filter.Actor))
+	}
+	if filter.Action != "" {
+		where += " AND action = @action"
+		args = append(args, sql.Named("action", filter.Action))
+	}
+	if !filter.Since.IsZero() {
+		where += " AND created_at >= @since"
+		args = append(args, sql.Named("since", filter.Since))
+	}
+	if !filter.Until.IsZero() {
+		where += " AND created_at < @until"
+		args = append(args, sql.Named("until", filter.Until))
+	}
+	return where, args
+}
+
+// userState encodes a user snapshot for audit_events; NULL for nil
+func userState(user *User) (sql.NullString, error) {
+	if user == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(user)
+	return sql.NullString{String: string(data), Valid: true}, err
+}
+
+// scanUserState decodes a snapshot stored by userState
+func scanUserState(state sql.NullString) (*User, error) {
+	if !state.Valid {
+		return nil, nil
+	}
+	var user User
+	if err := json.Unmarshal([]byte(state.String), &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// sqlIdempotencyStore is the IdempotencyStore backed by the idempotency_keys table
+type sqlIdempotencyStore struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+func newSQLIdempotencyStore(db *sql.DB, d *Dialect) *sqlIdempotencyStore {
+	return &sqlIdempotencyStore{db: db, d: d}
+}
+
+func (s *sqlIdempotencyStore) ReserveIdempotencyKey(ctx context.Context, keyHash []byte, leaseUntil time.Time) (*IdempotentResponse, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	// Expired keys, and leases whose request never finished, are pruned a few at
+	// a time as new ones arrive
+	args := []any{sql.Named("hash", keyHash), sql.Named("lease_until", leaseUntil)}
+	if _, err := s.d.deleteFirst(ctx, s.db, "idempotency_keys", "expires_at <= "+s.d.now, "", "100"); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key_hash = @hash AND expires_at <= `+s.d.now, args...); err != nil {
+		return nil, err
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO idempotency_keys (key_hash, expires_at) VALUES (@hash, @lease_until)`, args...)
+	if !isDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	var status sql.NullInt32
+	var headers sql.NullString
+	var response IdempotentResponse
+	err = s.db.QueryRowContext(ctx, `SELECT status, headers, body FROM idempotency_keys WHERE key_hash = @hash`,
+		sql.Named("hash", keyHash)).Scan(&status, &headers, &response.Body)
+	// A key released since the insert failed is as good as in use: its request just finished
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !status.Valid) {
+		return nil, ErrIdempotencyKeyInUse
+	}
+	if err != nil {
+		return nil, err
+	}
+	response.Status = int(status.Int32)
+	if headers.Valid {
+		if err := json.Unmarshal([]byte(headers.String), &response.Header); err != nil {
+			return nil, err
+		}
+	}
+	return &response, nil
+}
+
+func (s *sqlIdempotencyStore) CompleteIdempotencyKey(ctx context.Context, keyHash []byte, response IdempotentResponse, expiresAt time.Time) error {
+	headers, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE idempotency_keys SET status = @status, headers = @headers, body = @body, expires_at = @expires_at WHERE key_hash = @hash`,
+		sql.Named("status", response.Status), sql.Named("headers", string(headers)), sql.Named("body", response.Body),
+		sql.Named("expires_at", expiresAt), sql.Named("hash", keyHash))
+	return err
+}
+
+func (s *sqlIdempotencyStore) ReleaseIdempotencyKey(ctx context.Context, keyHash []byte) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key_hash = @hash AND status IS NULL`, sql.Named("hash", keyHash))
+	return err
+}
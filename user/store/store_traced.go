@@ -0,0 +1,726 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"user/user/events"
+	"user/user/resilience"
+	"user/user/telemetry"
+)
+
+// TracedUserStore wraps a UserStore with a client span per call
+type TracedUserStore struct {
+	Next UserStore
+}
+
+// storeSpan is the span of one store call, timed for db_query_duration_seconds
+type storeSpan struct {
+	trace.Span
+	operation string
+	start     time.Time
+}
+
+// startStoreSpan opens the client span for one store call
+func startStoreSpan(ctx context.Context, operation string) (context.Context, storeSpan) {
+	ctx, span := telemetry.StartSpan(ctx, "db "+operation, semconv.DBSystemMSSQL, semconv.DBOperationName(operation))
+	return ctx, storeSpan{Span: span, operation: operation, start: time.Now()}
+}
+
+// endStoreSpan finishes a store span and records the call's duration. Not-found
+// and conflict outcomes are answers rather than failures, so they don't mark the
+// span as an error or count as failed.
+func endStoreSpan(span storeSpan, err error) {
+	if errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrDuplicateEmail) || errors.Is(err, ErrStaleVersion) || errors.Is(err, ErrAPIKeyNotFound) || errors.Is(err, ErrNoSession) ||
+		errors.Is(err, ErrNoTOTP) || errors.Is(err, ErrTOTPEnabled) || errors.Is(err, ErrInvalidCode) || errors.Is(err, ErrIdempotencyKeyInUse) ||
+		errors.Is(err, ErrGroupNotFound) || errors.Is(err, ErrDuplicateGroup) || errors.Is(err, ErrNoPassword) ||
+		errors.Is(err, ErrInvalidReset) || errors.Is(err, ErrWebhookNotFound) ||
+		errors.Is(err, ErrImportNotFound) || errors.Is(err, ErrJobNotFound) || errors.Is(err, ErrPictureNotFound) ||
+		errors.Is(err, ErrNotSuppressed) {
+		err = nil
+	}
+	telemetry.DBQueryDuration.WithLabelValues(span.operation, resilience.ResultLabel(err)).Observe(time.Since(span.start).Seconds())
+	telemetry.EndSpan(span.Span, err)
+}
+
+func (s TracedUserStore) ListUsers(ctx context.Context, tenant string, filter UserFilter, sort UserSort) ([]User, error) {
+	ctx, span := startStoreSpan(ctx, "ListUsers")
+	users, err := s.Next.ListUsers(ctx, tenant, filter, sort)
+	endStoreSpan(span, err)
+	return users, err
+}
+
+func (s TracedUserStore) ListUsersAfter(ctx context.Context, tenant string, after User, limit int, filter UserFilter, sort UserSort) ([]User, error) {
+	ctx, span := startStoreSpan(ctx, "ListUsersAfter")
+	users, err := s.Next.ListUsersAfter(ctx, tenant, after, limit, filter, sort)
+	endStoreSpan(span, err)
+	return users, err
+}
+
+func (s TracedUserStore) SearchUsers(ctx context.Context, tenant, query string, after SearchHit, limit int) ([]SearchHit, error) {
+	ctx, span := startStoreSpan(ctx, "SearchUsers")
+	hits, err := s.Next.SearchUsers(ctx, tenant, query, after, limit)
+	endStoreSpan(span, err)
+	return hits, err
+}
+
+func (s TracedUserStore) CountUsers(ctx context.Context, tenant string, filter UserFilter) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "CountUsers")
+	count, err := s.Next.CountUsers(ctx, tenant, filter)
+	endStoreSpan(span, err)
+	return count, err
+}
+
+func (s TracedUserStore) ExportUsers(ctx context.Context, tenant string, filter UserFilter, fn func(User) error) error {
+	ctx, span := startStoreSpan(ctx, "ExportUsers")
+	err := s.Next.ExportUsers(ctx, tenant, filter, fn)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedUserStore) GetUser(ctx context.Context, tenant string, id int64) (User, error) {
+	ctx, span := startStoreSpan(ctx, "GetUser")
+	user, err := s.Next.GetUser(ctx, tenant, id)
+	endStoreSpan(span, err)
+	return user, err
+}
+
+func (s TracedUserStore) GetUserByEmail(ctx context.Context, tenant, email string) (User, error) {
+	ctx, span := startStoreSpan(ctx, "GetUserByEmail")
+	user, err := s.Next.GetUserByEmail(ctx, tenant, email)
+	endStoreSpan(span, err)
+	return user, err
+}
+
+func (s TracedUserStore) GetUserByIdentity(ctx context.Context, provider, subject string) (User, error) {
+	ctx, span := startStoreSpan(ctx, "GetUserByIdentity")
+	user, err := s.Next.GetUserByIdentity(ctx, provider, subject)
+	endStoreSpan(span, err)
+	return user, err
+}
+
+func (s TracedUserStore) LinkIdentity(ctx context.Context, userID int64, provider, subject string) error {
+	ctx, span := startStoreSpan(ctx, "LinkIdentity")
+	err := s.Next.LinkIdentity(ctx, userID, provider, subject)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedUserStore) ExistingEmails(ctx context.Context, tenant string, emails []string) (map[string]bool, error) {
+	ctx, span := startStoreSpan(ctx, "ExistingEmails")
+	found, err := s.Next.ExistingEmails(ctx, tenant, emails)
+	endStoreSpan(span, err)
+	return found, err
+}
+
+func (s TracedUserStore) ReferencedLinks(ctx context.Context, links []string) (map[string]bool, error) {
+	ctx, span := startStoreSpan(ctx, "ReferencedLinks")
+	found, err := s.Next.ReferencedLinks(ctx, links)
+	endStoreSpan(span, err)
+	return found, err
+}
+
+func (s TracedUserStore) CreateUser(ctx context.Context, user User) (User, error) {
+	ctx, span := startStoreSpan(ctx, "CreateUser")
+	user, err := s.Next.CreateUser(ctx, user)
+	endStoreSpan(span, err)
+	return user, err
+}
+
+func (s TracedUserStore) BulkCreateUsers(ctx context.Context, tenant string, users []User, results []BulkResult, atomic bool) error {
+	ctx, span := startStoreSpan(ctx, "BulkCreateUsers")
+	err := s.Next.BulkCreateUsers(ctx, tenant, users, results, atomic)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedUserStore) UpdateUser(ctx context.Context, tenant string, id int64, changes UserChanges) (User, error) {
+	ctx, span := startStoreSpan(ctx, "UpdateUser")
+	user, err := s.Next.UpdateUser(ctx, tenant, id, changes)
+	endStoreSpan(span, err)
+	return user, err
+}
+
+func (s TracedUserStore) TouchUser(ctx context.Context, tenant string, id int64) (time.Time, error) {
+	ctx, span := startStoreSpan(ctx, "TouchUser")
+	lastLoginAt, err := s.Next.TouchUser(ctx, tenant, id)
+	endStoreSpan(span, err)
+	return lastLoginAt, err
+}
+
+func (s TracedUserStore) UpsertUser(ctx context.Context, user User) error {
+	ctx, span := startStoreSpan(ctx, "UpsertUser")
+	err := s.Next.UpsertUser(ctx, user)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedUserStore) UpsertUserByEmail(ctx context.Context, user User) (User, bool, error) {
+	ctx, span := startStoreSpan(ctx, "UpsertUserByEmail")
+	saved, created, err := s.Next.UpsertUserByEmail(ctx, user)
+	endStoreSpan(span, err)
+	return saved, created, err
+}
+
+func (s TracedUserStore) DeleteUser(ctx context.Context, tenant string, id int64, hard bool) error {
+	ctx, span := startStoreSpan(ctx, "DeleteUser")
+	err := s.Next.DeleteUser(ctx, tenant, id, hard)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedUserStore) RestoreUser(ctx context.Context, tenant string, id int64) (User, error) {
+	ctx, span := startStoreSpan(ctx, "RestoreUser")
+	user, err := s.Next.RestoreUser(ctx, tenant, id)
+	endStoreSpan(span, err)
+	return user, err
+}
+
+func (s TracedUserStore) VerifyEmail(ctx context.Context, tenant string, id int64, email string) (User, error) {
+	ctx, span := startStoreSpan(ctx, "VerifyEmail")
+	user, err := s.Next.VerifyEmail(ctx, tenant, id, email)
+	endStoreSpan(span, err)
+	return user, err
+}
+
+func (s TracedUserStore) LockUser(ctx context.Context, id int64) (User, error) {
+	ctx, span := startStoreSpan(ctx, "LockUser")
+	user, err := s.Next.LockUser(ctx, id)
+	endStoreSpan(span, err)
+	return user, err
+}
+
+func (s TracedUserStore) ErasePersonalData(ctx context.Context, tenant string, id int64) (User, User, error) {
+	ctx, span := startStoreSpan(ctx, "ErasePersonalData")
+	before, after, err := s.Next.ErasePersonalData(ctx, tenant, id)
+	endStoreSpan(span, err)
+	return before, after, err
+}
+
+func (s TracedUserStore) PurgeDeletedUsers(ctx context.Context, cutoff time.Time, limit int) ([]User, error) {
+	ctx, span := startStoreSpan(ctx, "PurgeDeletedUsers")
+	users, err := s.Next.PurgeDeletedUsers(ctx, cutoff, limit)
+	endStoreSpan(span, err)
+	return users, err
+}
+
+func (s TracedUserStore) ListInactiveUsers(ctx context.Context, cutoff time.Time, afterID int64, limit int) ([]User, error) {
+	ctx, span := startStoreSpan(ctx, "ListInactiveUsers")
+	users, err := s.Next.ListInactiveUsers(ctx, cutoff, afterID, limit)
+	endStoreSpan(span, err)
+	return users, err
+}
+
+func (s TracedUserStore) UnlockUser(ctx context.Context, tenant string, id int64) (User, error) {
+	ctx, span := startStoreSpan(ctx, "UnlockUser")
+	user, err := s.Next.UnlockUser(ctx, tenant, id)
+	endStoreSpan(span, err)
+	return user, err
+}
+
+// TracedGroupStore wraps a GroupStore with a client span per call
+type TracedGroupStore struct {
+	Next GroupStore
+}
+
+func (s TracedGroupStore) CreateGroup(ctx context.Context, group Group) (Group, error) {
+	ctx, span := startStoreSpan(ctx, "CreateGroup")
+	group, err := s.Next.CreateGroup(ctx, group)
+	endStoreSpan(span, err)
+	return group, err
+}
+
+func (s TracedGroupStore) AddGroupMember(ctx context.Context, tenant string, groupID, userID int64) error {
+	ctx, span := startStoreSpan(ctx, "AddGroupMember")
+	err := s.Next.AddGroupMember(ctx, tenant, groupID, userID)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedGroupStore) ListUserGroups(ctx context.Context, tenant string, userID int64) ([]Group, error) {
+	ctx, span := startStoreSpan(ctx, "ListUserGroups")
+	groups, err := s.Next.ListUserGroups(ctx, tenant, userID)
+	endStoreSpan(span, err)
+	return groups, err
+}
+
+// TracedAPIKeyStore wraps an APIKeyStore with a client span per call
+type TracedAPIKeyStore struct {
+	Next APIKeyStore
+}
+
+func (s TracedAPIKeyStore) CreateAPIKey(ctx context.Context, key APIKey, hash []byte) (APIKey, error) {
+	ctx, span := startStoreSpan(ctx, "CreateAPIKey")
+	key, err := s.Next.CreateAPIKey(ctx, key, hash)
+	endStoreSpan(span, err)
+	return key, err
+}
+
+func (s TracedAPIKeyStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	ctx, span := startStoreSpan(ctx, "ListAPIKeys")
+	keys, err := s.Next.ListAPIKeys(ctx)
+	endStoreSpan(span, err)
+	return keys, err
+}
+
+func (s TracedAPIKeyStore) LookupAPIKey(ctx context.Context, hash []byte) (APIKey, error) {
+	ctx, span := startStoreSpan(ctx, "LookupAPIKey")
+	key, err := s.Next.LookupAPIKey(ctx, hash)
+	endStoreSpan(span, err)
+	return key, err
+}
+
+func (s TracedAPIKeyStore) RevokeAPIKey(ctx context.Context, id int64) error {
+	ctx, span := startStoreSpan(ctx, "RevokeAPIKey")
+	err := s.Next.RevokeAPIKey(ctx, id)
+	endStoreSpan(span, err)
+	return err
+}
+
+// TracedSessionStore wraps a SessionStore with a client span per call
+type TracedSessionStore struct {
+	Next SessionStore
+}
+
+func (s TracedSessionStore) CreateSession(ctx context.Context, session Session, refreshHash []byte) (Session, error) {
+	ctx, span := startStoreSpan(ctx, "CreateSession")
+	session, err := s.Next.CreateSession(ctx, session, refreshHash)
+	endStoreSpan(span, err)
+	return session, err
+}
+
+func (s TracedSessionStore) RotateSession(ctx context.Context, refreshHash, newHash []byte, expiresAt time.Time) (Session, error) {
+	ctx, span := startStoreSpan(ctx, "RotateSession")
+	session, err := s.Next.RotateSession(ctx, refreshHash, newHash, expiresAt)
+	endStoreSpan(span, err)
+	return session, err
+}
+
+func (s TracedSessionStore) RevokeSession(ctx context.Context, refreshHash []byte) error {
+	ctx, span := startStoreSpan(ctx, "RevokeSession")
+	err := s.Next.RevokeSession(ctx, refreshHash)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedSessionStore) VerifySessionTwoFactor(ctx context.Context, id int64) (Session, error) {
+	ctx, span := startStoreSpan(ctx, "VerifySessionTwoFactor")
+	session, err := s.Next.VerifySessionTwoFactor(ctx, id)
+	endStoreSpan(span, err)
+	return session, err
+}
+
+// TracedCredentialStore wraps a CredentialStore with a client span per call
+type TracedCredentialStore struct {
+	Next CredentialStore
+}
+
+func (s TracedCredentialStore) SetPasswordHash(ctx context.Context, userID int64, hash []byte) error {
+	ctx, span := startStoreSpan(ctx, "SetPasswordHash")
+	err := s.Next.SetPasswordHash(ctx, userID, hash)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedCredentialStore) GetPasswordHash(ctx context.Context, userID int64) ([]byte, error) {
+	ctx, span := startStoreSpan(ctx, "GetPasswordHash")
+	hash, err := s.Next.GetPasswordHash(ctx, userID)
+	endStoreSpan(span, err)
+	return hash, err
+}
+
+// TracedPictureStore wraps a PictureStore with a client span per call
+type TracedPictureStore struct {
+	Next PictureStore
+}
+
+func (s TracedPictureStore) AcquirePicture(ctx context.Context, tenant string, sha256 []byte) (StoredPicture, error) {
+	ctx, span := startStoreSpan(ctx, "AcquirePicture")
+	picture, err := s.Next.AcquirePicture(ctx, tenant, sha256)
+	endStoreSpan(span, err)
+	return picture, err
+}
+
+func (s TracedPictureStore) AddPicture(ctx context.Context, tenant string, picture StoredPicture) (StoredPicture, bool, error) {
+	ctx, span := startStoreSpan(ctx, "AddPicture")
+	picture, added, err := s.Next.AddPicture(ctx, tenant, picture)
+	endStoreSpan(span, err)
+	return picture, added, err
+}
+
+func (s TracedPictureStore) ReleasePicture(ctx context.Context, tenant, blob string) (bool, error) {
+	ctx, span := startStoreSpan(ctx, "ReleasePicture")
+	last, err := s.Next.ReleasePicture(ctx, tenant, blob)
+	endStoreSpan(span, err)
+	return last, err
+}
+
+func (s TracedPictureStore) ForgetPicture(ctx context.Context, blob string) error {
+	ctx, span := startStoreSpan(ctx, "ForgetPicture")
+	err := s.Next.ForgetPicture(ctx, blob)
+	endStoreSpan(span, err)
+	return err
+}
+
+// TracedOutboxStore wraps an OutboxStore with a client span per call
+type TracedOutboxStore struct {
+	Next OutboxStore
+}
+
+func (s TracedOutboxStore) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]events.OutboxEvent, error) {
+	ctx, span := startStoreSpan(ctx, "ClaimOutboxEvents")
+	events, err := s.Next.ClaimOutboxEvents(ctx, limit, lease)
+	endStoreSpan(span, err)
+	return events, err
+}
+
+func (s TracedOutboxStore) DeleteOutboxEvent(ctx context.Context, id int64) error {
+	ctx, span := startStoreSpan(ctx, "DeleteOutboxEvent")
+	err := s.Next.DeleteOutboxEvent(ctx, id)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedOutboxStore) FailOutboxEvent(ctx context.Context, id int64, reason string, retryAfter time.Duration) error {
+	ctx, span := startStoreSpan(ctx, "FailOutboxEvent")
+	err := s.Next.FailOutboxEvent(ctx, id, reason, retryAfter)
+	endStoreSpan(span, err)
+	return err
+}
+
+// TracedWebhookStore wraps a WebhookStore with a client span per call
+type TracedWebhookStore struct {
+	Next WebhookStore
+}
+
+func (s TracedWebhookStore) CreateWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	ctx, span := startStoreSpan(ctx, "CreateWebhook")
+	webhook, err := s.Next.CreateWebhook(ctx, webhook)
+	endStoreSpan(span, err)
+	return webhook, err
+}
+
+func (s TracedWebhookStore) ListWebhooks(ctx context.Context, tenant string) ([]Webhook, error) {
+	ctx, span := startStoreSpan(ctx, "ListWebhooks")
+	webhooks, err := s.Next.ListWebhooks(ctx, tenant)
+	endStoreSpan(span, err)
+	return webhooks, err
+}
+
+func (s TracedWebhookStore) ListSubscribedWebhooks(ctx context.Context, tenant, eventType string) ([]Webhook, error) {
+	ctx, span := startStoreSpan(ctx, "ListSubscribedWebhooks")
+	webhooks, err := s.Next.ListSubscribedWebhooks(ctx, tenant, eventType)
+	endStoreSpan(span, err)
+	return webhooks, err
+}
+
+func (s TracedWebhookStore) DeleteWebhook(ctx context.Context, tenant string, id int64) error {
+	ctx, span := startStoreSpan(ctx, "DeleteWebhook")
+	err := s.Next.DeleteWebhook(ctx, tenant, id)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedWebhookStore) RecordWebhookAttempt(ctx context.Context, attempt WebhookAttempt) error {
+	ctx, span := startStoreSpan(ctx, "RecordWebhookAttempt")
+	err := s.Next.RecordWebhookAttempt(ctx, attempt)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedWebhookStore) ListWebhookAttempts(ctx context.Context, tenant string, webhookID int64, limit int) ([]WebhookAttempt, error) {
+	ctx, span := startStoreSpan(ctx, "ListWebhookAttempts")
+	attempts, err := s.Next.ListWebhookAttempts(ctx, tenant, webhookID, limit)
+	endStoreSpan(span, err)
+	return attempts, err
+}
+
+// TracedImportJobStore wraps an ImportJobStore with a client span per call
+type TracedImportJobStore struct {
+	Next ImportJobStore
+}
+
+func (s TracedImportJobStore) CreateImportJob(ctx context.Context, job ImportJob) (ImportJob, error) {
+	ctx, span := startStoreSpan(ctx, "CreateImportJob")
+	job, err := s.Next.CreateImportJob(ctx, job)
+	endStoreSpan(span, err)
+	return job, err
+}
+
+func (s TracedImportJobStore) UpdateImportJob(ctx context.Context, job ImportJob) error {
+	ctx, span := startStoreSpan(ctx, "UpdateImportJob")
+	err := s.Next.UpdateImportJob(ctx, job)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedImportJobStore) GetImportJob(ctx context.Context, tenant string, id int64) (ImportJob, error) {
+	ctx, span := startStoreSpan(ctx, "GetImportJob")
+	job, err := s.Next.GetImportJob(ctx, tenant, id)
+	endStoreSpan(span, err)
+	return job, err
+}
+
+func (s TracedImportJobStore) ListImportJobs(ctx context.Context, tenant string, limit int) ([]ImportJob, error) {
+	ctx, span := startStoreSpan(ctx, "ListImportJobs")
+	jobs, err := s.Next.ListImportJobs(ctx, tenant, limit)
+	endStoreSpan(span, err)
+	return jobs, err
+}
+
+// TracedCreationJobStore wraps a CreationJobStore with a client span per call
+type TracedCreationJobStore struct {
+	Next CreationJobStore
+}
+
+func (s TracedCreationJobStore) CreateCreationJob(ctx context.Context, job CreationJob) (CreationJob, error) {
+	ctx, span := startStoreSpan(ctx, "CreateCreationJob")
+	job, err := s.Next.CreateCreationJob(ctx, job)
+	endStoreSpan(span, err)
+	return job, err
+}
+
+func (s TracedCreationJobStore) UpdateCreationJob(ctx context.Context, job CreationJob) error {
+	ctx, span := startStoreSpan(ctx, "UpdateCreationJob")
+	err := s.Next.UpdateCreationJob(ctx, job)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedCreationJobStore) GetCreationJob(ctx context.Context, tenant string, id int64) (CreationJob, error) {
+	ctx, span := startStoreSpan(ctx, "GetCreationJob")
+	job, err := s.Next.GetCreationJob(ctx, tenant, id)
+	endStoreSpan(span, err)
+	return job, err
+}
+
+// TracedPasswordResetStore wraps a PasswordResetStore with a client span per call
+type TracedPasswordResetStore struct {
+	Next PasswordResetStore
+}
+
+func (s TracedPasswordResetStore) CreatePasswordReset(ctx context.Context, userID int64, tokenHash []byte, expiresAt time.Time) error {
+	ctx, span := startStoreSpan(ctx, "CreatePasswordReset")
+	err := s.Next.CreatePasswordReset(ctx, userID, tokenHash, expiresAt)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedPasswordResetStore) CountPasswordResets(ctx context.Context, userID int64, since time.Time) (int, error) {
+	ctx, span := startStoreSpan(ctx, "CountPasswordResets")
+	n, err := s.Next.CountPasswordResets(ctx, userID, since)
+	endStoreSpan(span, err)
+	return n, err
+}
+
+func (s TracedPasswordResetStore) LookupPasswordReset(ctx context.Context, tokenHash []byte) (string, int64, error) {
+	ctx, span := startStoreSpan(ctx, "LookupPasswordReset")
+	tenant, userID, err := s.Next.LookupPasswordReset(ctx, tokenHash)
+	endStoreSpan(span, err)
+	return tenant, userID, err
+}
+
+func (s TracedPasswordResetStore) ResetPassword(ctx context.Context, tokenHash, passwordHash []byte) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "ResetPassword")
+	userID, err := s.Next.ResetPassword(ctx, tokenHash, passwordHash)
+	endStoreSpan(span, err)
+	return userID, err
+}
+
+// TracedTwoFactorStore wraps a TwoFactorStore with a client span per call
+type TracedTwoFactorStore struct {
+	Next TwoFactorStore
+}
+
+func (s TracedTwoFactorStore) EnrollTOTP(ctx context.Context, userID int64, secret []byte) error {
+	ctx, span := startStoreSpan(ctx, "EnrollTOTP")
+	err := s.Next.EnrollTOTP(ctx, userID, secret)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedTwoFactorStore) GetTOTP(ctx context.Context, userID int64) (TOTPSecret, error) {
+	ctx, span := startStoreSpan(ctx, "GetTOTP")
+	totp, err := s.Next.GetTOTP(ctx, userID)
+	endStoreSpan(span, err)
+	return totp, err
+}
+
+func (s TracedTwoFactorStore) EnableTOTP(ctx context.Context, userID int64, step int64, recoveryHashes [][]byte) error {
+	ctx, span := startStoreSpan(ctx, "EnableTOTP")
+	err := s.Next.EnableTOTP(ctx, userID, step, recoveryHashes)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedTwoFactorStore) UseTOTPStep(ctx context.Context, userID int64, step int64) error {
+	ctx, span := startStoreSpan(ctx, "UseTOTPStep")
+	err := s.Next.UseTOTPStep(ctx, userID, step)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedTwoFactorStore) UseRecoveryCode(ctx context.Context, userID int64, hash []byte) error {
+	ctx, span := startStoreSpan(ctx, "UseRecoveryCode")
+	err := s.Next.UseRecoveryCode(ctx, userID, hash)
+	endStoreSpan(span, err)
+	return err
+}
+
+// TracedAuthFailureStore wraps an AuthFailureStore with a client span per call
+type TracedAuthFailureStore struct {
+	Next AuthFailureStore
+}
+
+func (s TracedAuthFailureStore) RecordAuthFailure(ctx context.Context, userID int64, ip string, since time.Time) (AuthFailureCounts, error) {
+	ctx, span := startStoreSpan(ctx, "RecordAuthFailure")
+	counts, err := s.Next.RecordAuthFailure(ctx, userID, ip, since)
+	endStoreSpan(span, err)
+	return counts, err
+}
+
+// TracedRateLimitStore wraps a RateLimitStore with a client span per call
+type TracedRateLimitStore struct {
+	Next RateLimitStore
+}
+
+func (s TracedRateLimitStore) CountRequest(ctx context.Context, key string, window time.Time) (int, error) {
+	ctx, span := startStoreSpan(ctx, "CountRequest")
+	requests, err := s.Next.CountRequest(ctx, key, window)
+	endStoreSpan(span, err)
+	return requests, err
+}
+
+// TracedAuditStore wraps an AuditStore with a client span per call
+type TracedAuditStore struct {
+	Next AuditStore
+}
+
+func (s TracedAuditStore) RecordAuditEvents(ctx context.Context, events []AuditEvent) error {
+	ctx, span := startStoreSpan(ctx, "RecordAuditEvents")
+	err := s.Next.RecordAuditEvents(ctx, events)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedAuditStore) ListAuditEvents(ctx context.Context, filter AuditFilter, beforeID int64, limit int) ([]AuditEvent, error) {
+	ctx, span := startStoreSpan(ctx, "ListAuditEvents")
+	events, err := s.Next.ListAuditEvents(ctx, filter, beforeID, limit)
+	endStoreSpan(span, err)
+	return events, err
+}
+
+func (s TracedAuditStore) CountAuditEvents(ctx context.Context, filter AuditFilter) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "CountAuditEvents")
+	count, err := s.Next.CountAuditEvents(ctx, filter)
+	endStoreSpan(span, err)
+	return count, err
+}
+
+func (s TracedAuditStore) PurgeAuditEvents(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "PurgeAuditEvents")
+	purged, err := s.Next.PurgeAuditEvents(ctx, cutoff, limit)
+	endStoreSpan(span, err)
+	return purged, err
+}
+
+// TracedIdempotencyStore wraps an IdempotencyStore with a client span per call
+type TracedIdempotencyStore struct {
+	Next IdempotencyStore
+}
+
+func (s TracedIdempotencyStore) ReserveIdempotencyKey(ctx context.Context, keyHash []byte, leaseUntil time.Time) (*IdempotentResponse, error) {
+	ctx, span := startStoreSpan(ctx, "ReserveIdempotencyKey")
+	response, err := s.Next.ReserveIdempotencyKey(ctx, keyHash, leaseUntil)
+	endStoreSpan(span, err)
+	return response, err
+}
+
+func (s TracedIdempotencyStore) CompleteIdempotencyKey(ctx context.Context, keyHash []byte, response IdempotentResponse, expiresAt time.Time) error {
+	ctx, span := startStoreSpan(ctx, "CompleteIdempotencyKey")
+	err := s.Next.CompleteIdempotencyKey(ctx, keyHash, response, expiresAt)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedIdempotencyStore) ReleaseIdempotencyKey(ctx context.Context, keyHash []byte) error {
+	ctx, span := startStoreSpan(ctx, "ReleaseIdempotencyKey")
+	err := s.Next.ReleaseIdempotencyKey(ctx, keyHash)
+	endStoreSpan(span, err)
+	return err
+}
+
+// TracedMailSuppressionStore wraps a MailSuppressionStore with a client span per call
+type TracedMailSuppressionStore struct {
+	Next MailSuppressionStore
+}
+
+func (s TracedMailSuppressionStore) SuppressEmail(ctx context.Context, suppression MailSuppression) (MailSuppression, error) {
+	ctx, span := startStoreSpan(ctx, "SuppressEmail")
+	suppression, err := s.Next.SuppressEmail(ctx, suppression)
+	endStoreSpan(span, err)
+	return suppression, err
+}
+
+func (s TracedMailSuppressionStore) IsEmailSuppressed(ctx context.Context, email string) (bool, error) {
+	ctx, span := startStoreSpan(ctx, "IsEmailSuppressed")
+	suppressed, err := s.Next.IsEmailSuppressed(ctx, email)
+	endStoreSpan(span, err)
+	return suppressed, err
+}
+
+func (s TracedMailSuppressionStore) ListMailSuppressions(ctx context.Context) ([]MailSuppression, error) {
+	ctx, span := startStoreSpan(ctx, "ListMailSuppressions")
+	suppressions, err := s.Next.ListMailSuppressions(ctx)
+	endStoreSpan(span, err)
+	return suppressions, err
+}
+
+func (s TracedMailSuppressionStore) UnsuppressEmail(ctx context.Context, email string) error {
+	ctx, span := startStoreSpan(ctx, "UnsuppressEmail")
+	err := s.Next.UnsuppressEmail(ctx, email)
+	endStoreSpan(span, err)
+	return err
+}
+
+// TracedJobRunStore wraps a JobRunStore with a client span per call
+type TracedJobRunStore struct {
+	Next JobRunStore
+}
+
+func (s TracedJobRunStore) ClaimJobRun(ctx context.Context, job string, scheduledAt time.Time, owner string, lease time.Duration) (bool, error) {
+	ctx, span := startStoreSpan(ctx, "ClaimJobRun")
+	claimed, err := s.Next.ClaimJobRun(ctx, job, scheduledAt, owner, lease)
+	endStoreSpan(span, err)
+	return claimed, err
+}
+
+func (s TracedJobRunStore) FinishJobRun(ctx context.Context, job, owner string) error {
+	ctx, span := startStoreSpan(ctx, "FinishJobRun")
+	err := s.Next.FinishJobRun(ctx, job, owner)
+	endStoreSpan(span, err)
+	return err
+}
+
+// TracedActivityStore wraps an ActivityStore with a client span per call
+type TracedActivityStore struct {
+	Next ActivityStore
+}
+
+func (s TracedActivityStore) RecordActivities(ctx context.Context, activities []Activity) error {
+	ctx, span := startStoreSpan(ctx, "RecordActivities")
+	err := s.Next.RecordActivities(ctx, activities)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (s TracedActivityStore) ListActivities(ctx context.Context, tenant string, userID, beforeID int64, limit int) ([]Activity, error) {
+	ctx, span := startStoreSpan(ctx, "ListActivities")
+	activities, err := s.Next.ListActivities(ctx, tenant, userID, beforeID, limit)
+	endStoreSpan(span, err)
+	return activities, err
+}
@@ -0,0 +1,127 @@
+package telemetry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	HTTPRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests processed, by route and status code.",
+	}, []string{"handler", "code"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency, by route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler", "code"})
+
+	HTTPPanicsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_panics_total",
+		Help: "HTTP handlers that panicked and were answered 500, by route.",
+	}, []string{"handler"})
+
+	HTTPInFlightRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_in_flight_requests",
+		Help: "HTTP requests being handled, by capped class (all, upload).",
+	}, []string{"class"})
+
+	HTTPShedRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_shed_requests_total",
+		Help: "HTTP requests answered 503 because their class was at its in-flight cap.",
+	}, []string{"class"})
+
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Store call latency, by operation and result (success, failure, throttled, circuit_open).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+
+	BlobUploadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blob_uploads_total",
+		Help: "Profile picture uploads to blob storage, by result (success, failure, throttled, circuit_open, saturated).",
+	}, []string{"result"})
+
+	BlobUploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blob_upload_duration_seconds",
+		Help:    "Profile picture upload latency, retries and waiting for a slot included, by result.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"result"})
+
+	BlobUploadBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "blob_upload_bytes",
+		Help:    "Size of profile pictures uploaded to blob storage.",
+		Buckets: prometheus.ExponentialBuckets(16<<10, 4, 8), // 16 KiB to 256 MiB
+	})
+
+	ServiceBusPublishesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "service_bus_publishes_total",
+		Help: "Messages published to Service Bus, by result (success, failure, throttled, circuit_open, saturated).",
+	}, []string{"result"})
+
+	DependencyRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dependency_retries_total",
+		Help: "Calls to blob storage, Service Bus and SQL retried after a transient failure, by dependency.",
+	}, []string{"dependency"})
+
+	CircuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "State of each dependency's circuit breaker: 0 closed, 1 half-open, 2 open.",
+	}, []string{"dependency"})
+
+	DependencyInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dependency_in_flight",
+		Help: "Blob uploads and Service Bus sends holding one of their dependency's slots.",
+	}, []string{"dependency"})
+
+	DependencyQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dependency_queue_depth",
+		Help: "Blob uploads and Service Bus sends waiting for a slot, by dependency.",
+	}, []string{"dependency"})
+
+	DependencyRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dependency_rejections_total",
+		Help: "Blob uploads and Service Bus sends turned away because their dependency was saturated.",
+	}, []string{"dependency"})
+
+	UploadScansTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "upload_scans_total",
+		Help: "Uploads scanned for malware, by result (clean, infected, failure).",
+	}, []string{"result"})
+
+	BlobCleanupOrphansTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blob_cleanup_orphans_total",
+		Help: "Orphaned blobs found by blob cleanup, by outcome (deleted, failure, reported in dry-run mode).",
+	}, []string{"result"})
+
+	BlobCleanupReclaimedBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blob_cleanup_reclaimed_bytes_total",
+		Help: "Bytes of orphaned blobs deleted by blob cleanup.",
+	})
+
+	CacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_requests_total",
+		Help: "User reads looked up in the cache, by kind (user, list, count) and result (hit, miss, error).",
+	}, []string{"kind", "result"})
+
+	MailNotificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mail_notifications_total",
+		Help: "Notification emails, by event type and outcome (sent, suppressed, rejected, failure).",
+	}, []string{"event_type", "result"})
+
+	RetentionRecordsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "retention_records_total",
+		Help: "Users and audit events matched by retention rules, by rule and outcome (deleted, failure, reported in dry-run mode).",
+	}, []string{"rule", "result"})
+
+	ScheduledJobRunsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scheduled_job_runs_total",
+		Help: "Scheduled job runs, by job and outcome (success, failure, skipped when another instance made the run).",
+	}, []string{"job", "result"})
+
+	ScheduledJobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "scheduled_job_duration_seconds",
+		Help:    "Duration of the scheduled job runs this instance made, by job.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 9),
+	}, []string{"job"})
+)
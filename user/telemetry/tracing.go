@@ -0,0 +1,103 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"user/user/config"
+)
+
+const serviceName = "user-service"
+
+// Tracer delegates to whichever provider SetupTracing installs, and to the
+// global no-op provider when tracing is off
+var Tracer = otel.Tracer(serviceName)
+
+// SetupTracing exports spans over OTLP/HTTP when tracing.endpoint is set, or
+// when the standard OTEL_EXPORTER_OTLP_* variables configure the exporter
+// instead. Those, and OTEL_RESOURCE_ATTRIBUTES, still apply to whatever
+// config.json leaves out. The returned function flushes buffered spans on shutdown.
+func SetupTracing(cfg config.Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.Tracing.Endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var options []otlptracehttp.Option
+	if cfg.Tracing.Endpoint != "" {
+		options = append(options, otlptracehttp.WithEndpointURL(cfg.Tracing.Endpoint))
+	}
+	if len(cfg.Tracing.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(cfg.Tracing.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the service for tracing: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Tracing.SampleRate))),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// StartSpan starts a client span for a call to one of our dependencies
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// EndSpan records err, if any, on span and ends it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InjectTraceContext adds the span context of ctx to Service Bus message properties,
+// so consumers can continue the trace
+func InjectTraceContext(ctx context.Context, properties map[string]any) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	for key, value := range carrier {
+		properties[key] = value
+	}
+}
+
+// ExtractTraceContext continues the trace recorded in Service Bus message properties
+func ExtractTraceContext(ctx context.Context, properties map[string]any) context.Context {
+	carrier := propagation.MapCarrier{}
+	for key, value := range properties {
+		if s, ok := value.(string); ok {
+			carrier[key] = s
+		}
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// TraceIDFromContext returns the ID of the trace ctx belongs to, if it is sampled
+func TraceIDFromContext(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsSampled() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}